@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp"
+)
+
+const defaultConfigPath = "config.yaml"
+
+// command of the cloud-morph CLI, run parses its own flags and returns the exit code
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{"serve", "run the app of the config with lobby and chat, the default without a command", serveCommand},
+	{"relay", "run only lobby and chat, routing users to the workers of discovery, e.g. on Windows or macOS", relayCommand},
+	{"worker", "run only the app instance of the config, e.g. behind a coordinator", workerCommand},
+	{"doctor", "check the host environment for the config before the first launch", doctorCommand},
+	{"loadtest", "join an instance with headless sessions and report join times and throughput", loadtestCommand},
+	{"replay-signaling", "re-drive the WebRTC negotiation of a recorded session offline to reproduce its failure", replaySignalingCommand},
+}
+
+func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(args))
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: cloud-morph <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun cloud-morph <command> -h for the flags of a command")
+}
+
+// configFlags are the flags of commands running with a config
+type configFlags struct {
+	path string
+	addr string
+}
+
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{}
+	fs.StringVar(&f.path, "config", defaultConfigPath, "config file")
+	fs.StringVar(&f.addr, "addr", "", "listen address, overrides addr of the config, e.g. :9090 or unix:/run/cloudmorph.sock")
+	return f
+}
+
+func (f *configFlags) read() (config.Config, error) {
+	cfg, err := config.ReadConfig(f.path)
+	if err != nil {
+		return cfg, err
+	}
+	if f.addr != "" {
+		cfg.Addr = f.addr
+	}
+	return cfg, nil
+}
+
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags := newConfigFlags(fs)
+	fs.Parse(args)
+	cfg, err := flags.read()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Wrong config:", err)
+		return 1
+	}
+	serve(cfg)
+	return 0
+}
+
+func relayCommand(args []string) int {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	flags := newConfigFlags(fs)
+	discovery := fs.String("discovery", "", "discovery host of the workers, overrides discoveryHost of the config")
+	fs.Parse(args)
+	cfg, err := flags.read()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Wrong config:", err)
+		return 1
+	}
+	if *discovery != "" {
+		cfg.DiscoveryHost = *discovery
+	}
+	if !cfg.HasDiscovery() {
+		fmt.Fprintln(os.Stderr, "Wrong config: relay: discoveryHost or a registry is required to route users to workers")
+		return 1
+	}
+	cfg.Relay = true
+	serve(cfg)
+	return 0
+}
+
+func workerCommand(args []string) int {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	flags := newConfigFlags(fs)
+	fs.Parse(args)
+	cfg, err := flags.read()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Wrong config:", err)
+		return 1
+	}
+	cloudapp.Run(cfg)
+	return 0
+}
+
+func doctorCommand(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	path := fs.String("config", defaultConfigPath, "config file")
+	fs.Parse(args)
+	cfg, err := config.ReadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Wrong config:", err)
+		return 1
+	}
+	if !cloudapp.Doctor(cfg, os.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+func replaySignalingCommand(args []string) int {
+	fs := flag.NewFlagSet("replay-signaling", flag.ExitOnError)
+	path := fs.String("config", defaultConfigPath, "config file of the worker which recorded the session")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: cloud-morph replay-signaling [flags] <recording.jsonl>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	cfg, err := config.ReadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Wrong config:", err)
+		return 1
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	if err := cloudapp.ReplaySignaling(cfg, f, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Replay:", err)
+		return 1
+	}
+	return 0
+}
@@ -4,13 +4,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/mtls"
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/mux"
 	"go.etcd.io/etcd/client/v3"
@@ -23,6 +29,13 @@ const (
 const addr string = ":7700"
 const etcdAddr string = ":2379"
 
+// Mutual TLS of the fleet, only workers with a certificate signed by the CA can register
+var (
+	caFile   = flag.String("ca", "", "CA of the fleet, discovery requires certificates it signed")
+	certFile = flag.String("cert", "", "certificate of discovery, signed by the CA of the fleet")
+	keyFile  = flag.String("key", "", "key of the certificate of discovery")
+)
+
 type kvstorage struct {
 	kv clientv3.KV
 }
@@ -36,6 +49,14 @@ type appDiscoveryMeta struct {
 	PageTitle    string `json:"page_title"`
 	ScreenWidth  int    `json:"screen_width"`
 	ScreenHeight int    `json:"screen_height"`
+	MaxInstances int    `json:"max_instances,omitempty"`
+	AgeRating    int    `json:"age_rating,omitempty"`
+	RequiredRole string `json:"required_role,omitempty"`
+	// Capacity from the latest heartbeat, not stored in etcd
+	Capacity  *capacity.Report `json:"capacity,omitempty"`
+	Saturated bool             `json:"saturated"`
+	// Players are the sessions of the latest heartbeat, counted in the lobby
+	Players int `json:"players"`
 }
 
 type appDiscovery struct {
@@ -46,6 +67,81 @@ type server struct {
 	httpServer *http.Server
 	httpClient *http.Client // For http get
 	discovery  *appDiscovery
+	reclaimed  *reclaimedLog
+	heartbeats *heartbeats
+}
+
+// heartbeatTTL is how long a capacity heartbeat is trusted
+const heartbeatTTL = 30 * time.Second
+
+// heartbeats keeps the latest capacity reported by each app instance
+type heartbeats struct {
+	mu      sync.Mutex
+	reports map[string]heartbeat
+}
+
+type heartbeat struct {
+	report capacity.Report
+	at     time.Time
+}
+
+func (h *heartbeats) set(appID string, report capacity.Report) {
+	h.mu.Lock()
+	h.reports[appID] = heartbeat{report: report, at: time.Now()}
+	h.mu.Unlock()
+}
+
+// annotate sets capacity of apps with a recent heartbeat
+func (h *heartbeats) annotate(apps []appDiscoveryMeta) []appDiscoveryMeta {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, app := range apps {
+		hb, ok := h.reports[app.ID]
+		if !ok {
+			continue
+		}
+		if time.Since(hb.at) > heartbeatTTL {
+			delete(h.reports, app.ID)
+			continue
+		}
+		report := hb.report
+		apps[i].Capacity = &report
+		apps[i].Saturated = report.Saturated
+		apps[i].Players = report.Sessions
+	}
+	return apps
+}
+
+// reclaimedEvent is reported by a worker when its spot/preemptible instance is reclaimed
+type reclaimedEvent struct {
+	AppID    string    `json:"app_id"`
+	Provider string    `json:"provider"`
+	Action   string    `json:"action"`
+	Time     time.Time `json:"time"`
+	Addr     string    `json:"addr,omitempty"`
+}
+
+const maxReclaimedEvents = 100
+
+// reclaimedLog keeps the latest reclaimed events
+type reclaimedLog struct {
+	mu     sync.Mutex
+	events []reclaimedEvent
+}
+
+func (l *reclaimedLog) add(e reclaimedEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+	if len(l.events) > maxReclaimedEvents {
+		l.events = l.events[len(l.events)-maxReclaimedEvents:]
+	}
+}
+
+func (l *reclaimedLog) list() []reclaimedEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]reclaimedEvent{}, l.events...)
 }
 
 const appHostPrefix = "apphost_"
@@ -74,6 +170,12 @@ func (s *kvstorage) getByPrefix(ctx context.Context, prefix string) ([][]byte, e
 	return respVals, nil
 }
 
+// hasKey returns if the key exists, errors count as existing so an etcd hiccup doesn't drop anything
+func (s *kvstorage) hasKey(ctx context.Context, key string) bool {
+	resp, err := s.kv.Get(ctx, key, clientv3.WithCountOnly())
+	return err != nil || resp.Count > 0
+}
+
 func (s *kvstorage) setValue(ctx context.Context, key string, value string) error {
 	_, err := s.kv.Put(ctx, key, value)
 	if err != nil {
@@ -128,6 +230,13 @@ func (d *appDiscovery) removeApp(appID string) error {
 	return d.storage.removeValue(ctx, appHostPrefix+appID)
 }
 
+// hasApp returns if the app instance is registered
+func (d *appDiscovery) hasApp(appID string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return d.storage.hasKey(ctx, appHostPrefix+appID)
+}
+
 func (d *appDiscovery) getApps() []appDiscoveryMeta {
 	var app appDiscoveryMeta
 	var apps []appDiscoveryMeta
@@ -261,6 +370,19 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 	if !s.isValidIP(h.Addr) {
 		return
 	}
+	if h.MaxInstances > 0 {
+		instances := 0
+		for _, app := range s.discovery.getApps() {
+			if app.AppName == h.AppName && app.Addr != h.Addr {
+				instances++
+			}
+		}
+		if instances >= h.MaxInstances {
+			log.Println("Refuse register,", h.AppName, "reached max instances", h.MaxInstances)
+			http.Error(w, fmt.Sprintf("CAPACITY: %s reached max instances %d", h.AppName, h.MaxInstances), http.StatusConflict)
+			return
+		}
+	}
 	appID, err := s.discovery.addApp(h)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -271,7 +393,7 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	go s.refineAppsList()
+	crash.Go("refine apps", s.refineAppsList)
 	w.Write(encodedResp)
 }
 
@@ -292,12 +414,61 @@ func (s *server) remove(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// reportReclaimed removes the app of a reclaimed instance so new users are routed elsewhere
+func (s *server) reportReclaimed(w http.ResponseWriter, r *http.Request) {
+	var e reclaimedEvent
+	err := json.NewDecoder(r.Body).Decode(&e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, app := range s.discovery.getApps() {
+		if app.ID == e.AppID {
+			e.Addr = app.Addr
+		}
+	}
+	log.Println("Received Reclaimed Report", e)
+	s.reclaimed.add(e)
+	err = s.discovery.removeApp(e.AppID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+func (s *server) getReclaimed(w http.ResponseWriter, r *http.Request) {
+	encodedResp, err := json.Marshal(s.reclaimed.list())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(encodedResp)
+}
+
+func (s *server) heartbeat(w http.ResponseWriter, r *http.Request) {
+	var hb struct {
+		AppID    string          `json:"app_id"`
+		Capacity capacity.Report `json:"capacity"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&hb)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Workers register again when they're unknown, e.g. after the storage of discovery was reset
+	if !s.discovery.hasApp(hb.AppID) {
+		http.Error(w, "app is not registered", http.StatusNotFound)
+		return
+	}
+	s.heartbeats.set(hb.AppID, hb.Capacity)
+}
+
 func (s *server) getApps(w http.ResponseWriter, r *http.Request) {
 	type GetAppsResponse struct {
 		Apps []appDiscoveryMeta `json:"apps"`
 	}
 	resp := GetAppsResponse{
-		Apps: s.discovery.getApps(),
+		Apps: s.heartbeats.annotate(s.discovery.getApps()),
 	}
 
 	log.Println("Received GetApps Request")
@@ -310,12 +481,18 @@ func (s *server) getApps(w http.ResponseWriter, r *http.Request) {
 }
 
 func NewServer() server {
-	server := server{}
+	server := server{
+		reclaimed:  &reclaimedLog{},
+		heartbeats: &heartbeats{reports: map[string]heartbeat{}},
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/register", server.register)
 	r.HandleFunc("/remove", server.remove)
 	r.HandleFunc("/get-apps", server.getApps)
+	r.HandleFunc("/heartbeat", server.heartbeat).Methods(http.MethodPost)
+	r.HandleFunc("/reclaimed", server.reportReclaimed).Methods(http.MethodPost)
+	r.HandleFunc("/reclaimed", server.getReclaimed).Methods(http.MethodGet)
 
 	svmux := &http.ServeMux{}
 	svmux.Handle("/", r)
@@ -336,17 +513,27 @@ func NewServer() server {
 	server.httpClient = &http.Client{
 		Timeout: 3 * time.Second,
 	}
-	go server.refineAppsList()
+	crash.Go("refine apps", server.refineAppsList)
 
 	return server
 }
 
 func (s *server) Run() {
 	fmt.Println("Listening at", addr)
-	s.httpServer.ListenAndServe()
+	if *caFile == "" {
+		s.httpServer.ListenAndServe()
+		return
+	}
+	tlsConfig, err := mtls.ServerConfig(config.FleetTLSConfig{CAFile: *caFile, CertFile: *certFile, KeyFile: *keyFile})
+	if err != nil {
+		log.Fatal("Cannot load the fleet certificate: ", err)
+	}
+	s.httpServer.TLSConfig = tlsConfig
+	log.Fatal(s.httpServer.ListenAndServeTLS("", ""))
 }
 
 func main() {
+	flag.Parse()
 	s := NewServer()
 	s.Run()
 }
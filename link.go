@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/backoff"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+var errNotRegistered = errors.New("discovery: the worker is not registered")
+
+var (
+	linkUp       = metrics.NewGauge("cloudmorph_coordinator_link_up", "1 while the worker is registered with discovery or the registry")
+	linkFlaps    = metrics.NewCounter("cloudmorph_coordinator_link_flaps_total", "Times the link of the worker to discovery or the registry went down")
+	linkAttempts = metrics.NewCounter("cloudmorph_coordinator_reconnect_attempts_total", "Registrations of the worker retried after a failure or a lost link")
+)
+
+// coordinatorLink keeps the worker registered with discovery or the registry. Failed heartbeats in a row, or
+// discovery no longer knowing the worker, take the link down. The worker then registers again with backoff and
+// resyncs its sessions and capacity right away, so coordinator restarts don't need worker restarts
+type coordinatorLink struct {
+	s        *Server
+	policy   config.ReconnectConfig
+	interval time.Duration
+	// lost wakes the link when discovery lists the apps without the worker
+	lost chan struct{}
+
+	mu sync.Mutex
+	id string
+}
+
+func newCoordinatorLink(s *Server, policy config.ReconnectConfig, interval time.Duration) *coordinatorLink {
+	return &coordinatorLink{s: s, policy: policy, interval: interval, lost: make(chan struct{}, 1)}
+}
+
+// appID returns the app ID of the current registration, empty while the worker isn't registered
+func (l *coordinatorLink) appID() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id
+}
+
+func (l *coordinatorLink) setAppID(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.id = id
+}
+
+// markLost takes the link down at the next chance, the heartbeats may still succeed, e.g. when discovery lost its storage
+func (l *coordinatorLink) markLost() {
+	select {
+	case l.lost <- struct{}{}:
+	default:
+	}
+}
+
+// run registers the worker and sends its heartbeats, registering it again whenever the link goes down
+func (l *coordinatorLink) run() {
+	l.connect(false)
+	tick := time.NewTicker(l.interval)
+	defer tick.Stop()
+	failures := 0
+	for {
+		select {
+		case <-tick.C:
+			if l.s.cappServer.IsDraining() {
+				continue
+			}
+			err := l.heartbeat()
+			if err == nil {
+				failures = 0
+				continue
+			}
+			log.Println(err)
+			if failures++; err != errNotRegistered && failures < l.policy.Failures {
+				continue
+			}
+		case <-l.lost:
+		}
+		if l.s.cappServer.IsDraining() {
+			continue
+		}
+		log.Println("Link to discovery is down, registering again")
+		linkUp.Set(0)
+		linkFlaps.Inc()
+		l.connect(true)
+		failures = 0
+	}
+}
+
+// connect registers the worker until it succeeds or drains. Reconnections wait before the first attempt too,
+// so the workers of a restarted coordinator spread out. The previous registration is dropped first, leases of
+// etcd and Consul would otherwise be kept alive next to the new one
+func (l *coordinatorLink) connect(reconnect bool) {
+	b := backoff.Backoff{
+		Min:        time.Duration(l.policy.MinDelay * float64(time.Second)),
+		Max:        time.Duration(l.policy.MaxDelay * float64(time.Second)),
+		Multiplier: l.policy.Multiplier,
+		Jitter:     l.policy.Jitter,
+	}
+	stale := l.appID()
+	l.setAppID("")
+	for {
+		if reconnect {
+			time.Sleep(b.Next())
+			linkAttempts.Inc()
+		}
+		reconnect = true
+		if l.s.cappServer.IsDraining() {
+			return
+		}
+		if stale != "" {
+			if err := l.s.discoveryHandler.Remove(stale); err != nil {
+				log.Println(err)
+			}
+		}
+		appID, err := l.s.RegisterApp(l.s.appMeta)
+		if err == nil && appID == "" {
+			err = errNotRegistered
+		}
+		if err != nil {
+			log.Println("Cannot register:", err)
+			continue
+		}
+		l.setAppID(appID)
+		log.Println("Registered with AppID", appID)
+		linkUp.Set(1)
+		// Discovery learns the sessions of the worker now rather than at the next tick
+		if err := l.heartbeat(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+}
+
+func (l *coordinatorLink) heartbeat() error {
+	return l.s.discoveryHandler.Heartbeat(l.appID(), l.s.cappServer.Capacity())
+}
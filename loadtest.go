@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/client"
+	"github.com/pion/webrtc/v3"
+)
+
+// loadResult is the outcome of a session of the load test
+type loadResult struct {
+	joinTime time.Duration
+	err      error
+	// video bytes received while the session lasted
+	bytes int64
+	// streamed is how long the session received video
+	streamed time.Duration
+}
+
+func loadtestCommand(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "instance to join, host:port")
+	sessions := fs.Int("sessions", 10, "sessions to join")
+	ramp := fs.Duration("ramp", time.Second, "delay between session starts")
+	duration := fs.Duration("duration", 30*time.Second, "how long every session streams")
+	timeout := fs.Duration("timeout", 30*time.Second, "time a session has to join, including the admission queue")
+	token := fs.String("token", "", "API token of the sessions, issued with POST /api/admin/tokens")
+	useTLS := fs.Bool("tls", false, "join with wss")
+	protobuf := fs.Bool("protobuf", false, "negotiate protobuf packets")
+	fs.Parse(args)
+	if *sessions <= 0 {
+		fmt.Fprintln(os.Stderr, "sessions must be positive")
+		return 2
+	}
+
+	fmt.Printf("Joining %s with %d sessions, one every %v, streaming %v each\n", *addr, *sessions, *ramp, *duration)
+	results := make([]loadResult, *sessions)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = loadSession(*addr, client.Options{Token: *token, TLS: *useTLS, Protobuf: *protobuf}, *timeout, *duration)
+		}(i)
+		time.Sleep(*ramp)
+	}
+	wg.Wait()
+	return loadReport(results)
+}
+
+// loadSession joins the instance and receives video for the duration
+func loadSession(addr string, opts client.Options, timeout, duration time.Duration) loadResult {
+	var r loadResult
+	var bytes int64
+	var firstByte atomic.Value
+	opts.OnTrack = func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := track.Read(buf)
+			if err != nil {
+				return
+			}
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				if atomic.AddInt64(&bytes, int64(n)) == int64(n) {
+					firstByte.Store(time.Now())
+				}
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	c, err := client.Dial(ctx, addr, opts)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.joinTime = time.Since(start)
+	select {
+	case <-time.After(duration):
+	case <-c.Done():
+		r.err = client.ErrClosed
+	}
+	end := time.Now()
+	c.Close()
+	r.bytes = atomic.LoadInt64(&bytes)
+	if at, ok := firstByte.Load().(time.Time); ok {
+		r.streamed = end.Sub(at)
+	}
+	return r
+}
+
+// loadReport prints the join times, failures and video throughput of the sessions, it fails when a session failed
+func loadReport(results []loadResult) int {
+	var joins []time.Duration
+	failures := map[string]int{}
+	var kbps []float64
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			// refusals are reported as PACKET: reason, group by the packet type
+			reason := r.err.Error()
+			if i := strings.Index(reason, ":"); i > 0 {
+				reason = reason[:i]
+			}
+			failures[reason]++
+		}
+		if r.joinTime > 0 {
+			joins = append(joins, r.joinTime)
+		}
+		if r.streamed > 0 {
+			kbps = append(kbps, float64(r.bytes*8)/r.streamed.Seconds()/1000)
+		}
+	}
+
+	// sessions which joined and dropped count as failed as well
+	fmt.Printf("\nSessions:  %d joined, %d failed\n", len(joins), failed)
+	for reason, n := range failures {
+		fmt.Printf("  %-20s %d\n", reason, n)
+	}
+	if len(joins) > 0 {
+		sort.Slice(joins, func(i, j int) bool { return joins[i] < joins[j] })
+		fmt.Printf("Join time: p50 %v, p95 %v, max %v\n",
+			percentile(joins, 50).Round(time.Millisecond), percentile(joins, 95).Round(time.Millisecond), joins[len(joins)-1].Round(time.Millisecond))
+	}
+	if len(kbps) > 0 {
+		sort.Float64s(kbps)
+		var sum float64
+		for _, v := range kbps {
+			sum += v
+		}
+		fmt.Printf("Video:     %d sessions streamed, avg %.0f kbps, min %.0f kbps\n", len(kbps), sum/float64(len(kbps)), kbps[0])
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/pion/turn/v2"
+)
+
+// mediaRelayRealm is the TURN realm of the media relay
+const mediaRelayRealm = "cloudmorph"
+
+// relaySessionIdle is how long a client keeps its credentials without a request to the relay. Browsers refresh
+// their allocations and permissions every few minutes, allocations live 10 minutes without a refresh
+const relaySessionIdle = 15 * time.Minute
+
+// startMediaRelay runs the TURN server forwarding the media of workers to clients which can't reach them directly.
+// Workers hand clients credentials signed with the token secret for their session, see relayAuth
+func startMediaRelay(cfg config.MediaRelayConfig, secret string) (*turn.Server, error) {
+	peers, err := cfg.PeerNets()
+	if err != nil {
+		return nil, err
+	}
+	addr := ":" + strconv.Itoa(cfg.Port)
+	udp, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	auth := &relayAuth{secret: secret, sessions: map[string]relaySession{}}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:             mediaRelayRealm,
+		AuthHandler:       auth.handle,
+		PacketConnConfigs: []turn.PacketConnConfig{{PacketConn: udp, RelayAddressGenerator: relayAddresses(cfg, peers)}},
+		ListenerConfigs:   []turn.ListenerConfig{{Listener: tcp, RelayAddressGenerator: relayAddresses(cfg, peers)}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+// relayAddresses allocates the relayed streams at the public IP, within the port range when it's set.
+// The streams only reach the peers
+func relayAddresses(cfg config.MediaRelayConfig, peers []*net.IPNet) turn.RelayAddressGenerator {
+	ip := net.ParseIP(cfg.PublicIP)
+	if cfg.PortMin == 0 {
+		return peerRelay{&turn.RelayAddressGeneratorStatic{RelayAddress: ip, Address: "0.0.0.0"}, peers}
+	}
+	return peerRelay{&turn.RelayAddressGeneratorPortRange{RelayAddress: ip, Address: "0.0.0.0", MinPort: cfg.PortMin, MaxPort: cfg.PortMax}, peers}
+}
+
+// peerRelay limits the relayed streams to the peers. The TURN server grants permissions for any peer,
+// packets to and from others are dropped instead, so clients can't reach other hosts through the relay
+type peerRelay struct {
+	turn.RelayAddressGenerator
+	peers []*net.IPNet
+}
+
+func (g peerRelay) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &peerConn{PacketConn: conn, peers: g.peers}, addr, nil
+}
+
+type peerConn struct {
+	net.PacketConn
+	peers []*net.IPNet
+}
+
+func (c *peerConn) allowed(addr net.Addr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, peer := range c.peers {
+		if peer.Contains(udp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *peerConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.allowed(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *peerConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allowed(addr) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// relayAuth checks the credentials of the workers. Their username is the expiry and the client, the password
+// its HMAC with the token secret. Credentials expire shortly after the worker hands them out, a client
+// which allocated with them keeps using them from its address till it leaves the relay, so they last
+// the session of the client and can't be used again afterwards
+type relayAuth struct {
+	secret string
+
+	mu sync.Mutex
+	// sessions are the credentials in use by client address
+	sessions map[string]relaySession
+}
+
+type relaySession struct {
+	username string
+	seen     time.Time
+}
+
+func (a *relayAuth) handle(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for addr, session := range a.sessions {
+		if now.Sub(session.seen) > relaySessionIdle {
+			delete(a.sessions, addr)
+		}
+	}
+	session, ok := a.sessions[srcAddr.String()]
+	if !ok || session.username != username {
+		expiry, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+		if err != nil || now.Unix() > expiry {
+			return nil, false
+		}
+	}
+	a.sessions[srcAddr.String()] = relaySession{username: username, seen: now}
+	mac := hmac.New(sha1.New, []byte(a.secret))
+	mac.Write([]byte(username))
+	return turn.GenerateAuthKey(username, realm, base64.StdEncoding.EncodeToString(mac.Sum(nil))), true
+}
@@ -0,0 +1,24 @@
+#!/usr/bin/env bash
+# Snapshot and restore the Wine prefix of appvm for live session migration
+# Usage: ./migrate-wine.sh snapshot|restore|resume <file>
+set -e
+case "$1" in
+snapshot)
+    # Freeze the app so the prefix is consistent while it's copied
+    docker pause appvm
+    docker run --rm --volume "winecfg:/root/.wine" --volume "$(dirname "$(realpath "$2")"):/snapshot" \
+        syncwine tar -czf "/snapshot/$(basename "$2")" -C /root/.wine .
+    ;;
+restore)
+    docker rm -f appvm || true
+    docker run --rm --volume "winecfg:/root/.wine" --volume "$(dirname "$(realpath "$2")"):/snapshot" \
+        syncwine sh -c "rm -rf /root/.wine/* && tar -xzf /snapshot/$(basename "$2") -C /root/.wine"
+    ;;
+resume)
+    docker unpause appvm
+    ;;
+*)
+    echo "unknown command $1"
+    exit 1
+    ;;
+esac
@@ -0,0 +1,53 @@
+package textchat
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// eventDMFailed tells the sender a DM is not delivered. It doesn't tell if the recipient left or blocked the sender
+const eventDMFailed = "DM_FAILED"
+
+// direct sends a DM to the recipient and echoes it to the sender. DMs are not kept in the history
+func (t *TextChat) direct(e chatEvent) error {
+	msg := e.Msg
+	msg.Room = ""
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sender, ok := t.clients[e.ClientID]
+	if !ok {
+		return nil
+	}
+	recipient, ok := t.clients[msg.To]
+	if !ok || recipient.blocked[e.ClientID] || msg.To == e.ClientID {
+		failed, _ := json.Marshal(ChatMessage{ID: msg.ID, To: msg.To})
+		sender.ws.Send(cws.WSPacket{Type: eventDMFailed, Data: string(failed)}, nil)
+		return fmt.Errorf("DM from %s to %s is not delivered", e.ClientID, msg.To)
+	}
+	for _, client := range []*chatClient{recipient, sender} {
+		client.ws.Send(cws.WSPacket{Type: eventDM, Data: string(data)}, nil)
+	}
+	return nil
+}
+
+// block adds or removes the other client from the block list of the client
+func (t *TextChat) block(clientID string, other string, blocked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	client, ok := t.clients[clientID]
+	if !ok || other == "" {
+		return
+	}
+	if blocked {
+		client.blocked[other] = true
+	} else {
+		delete(client.blocked, other)
+	}
+}
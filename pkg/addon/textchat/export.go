@@ -0,0 +1,68 @@
+package textchat
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export returns the messages of the room sent in [from, to), oldest first. Zero times are unbounded.
+// The persisted history is read when there is a store
+func (t *TextChat) Export(room string, from, to time.Time) []ChatMessage {
+	in := func(msg ChatMessage) bool {
+		return msg.Room == room && (from.IsZero() || !msg.Time.Before(from)) && (to.IsZero() || msg.Time.Before(to))
+	}
+	msgs := []ChatMessage{}
+	if t.store != nil {
+		t.store.Each(historyCollection, func(id string, data json.RawMessage) error {
+			var msg ChatMessage
+			if err := json.Unmarshal(data, &msg); err == nil && in(msg) {
+				msgs = append(msgs, msg)
+			}
+			return nil
+		})
+	} else {
+		t.mu.Lock()
+		if r, ok := t.rooms[room]; ok {
+			for _, msg := range r.msgs {
+				if in(msg) {
+					msgs = append(msgs, msg)
+				}
+			}
+		}
+		t.mu.Unlock()
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Time.Before(msgs[j].Time) })
+	return msgs
+}
+
+// WriteCSV writes the messages with a header row
+func WriteCSV(w io.Writer, msgs []ChatMessage) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "id", "room", "user", "author_id", "message", "edited"})
+	for _, msg := range msgs {
+		cw.Write([]string{
+			msg.Time.UTC().Format(time.RFC3339Nano),
+			msg.ID,
+			msg.Room,
+			csvSafe(msg.User),
+			msg.AuthorID,
+			csvSafe(msg.Message),
+			strconv.FormatBool(msg.Edited),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvSafe stops spreadsheets from running the cell as a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
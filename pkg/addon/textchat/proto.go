@@ -0,0 +1,81 @@
+package textchat
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/cws/cwspb"
+)
+
+// Packets carrying a ChatMessage are sent as its typed body to protobuf clients, see cloudmorph.proto
+func init() {
+	cws.RegisterBody(cws.BodyCodec{
+		Marshal: func(data string, p *cwspb.WSPacket) error {
+			var msg ChatMessage
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				return err
+			}
+			p.Body = &cwspb.WSPacket_Chat{Chat: msg.toProto()}
+			return nil
+		},
+		Unmarshal: func(p *cwspb.WSPacket) (string, error) {
+			data, err := json.Marshal(chatFromProto(p.GetChat()))
+			return string(data), err
+		},
+	}, eventChat, eventEdit, eventDM, eventDMFailed)
+}
+
+func (m ChatMessage) toProto() *cwspb.ChatMessage {
+	msg := &cwspb.ChatMessage{
+		Id:       m.ID,
+		User:     m.User,
+		Message:  m.Message,
+		Room:     m.Room,
+		AuthorId: m.AuthorID,
+		Edited:   m.Edited,
+		Emoji:    m.Emoji,
+		Typing:   m.Typing,
+		To:       m.To,
+	}
+	if !m.Time.IsZero() {
+		msg.Time = m.Time.UnixNano() / int64(time.Millisecond)
+	}
+	if len(m.Reactions) > 0 {
+		msg.Reactions = make(map[string]int32, len(m.Reactions))
+		for emoji, count := range m.Reactions {
+			msg.Reactions[emoji] = int32(count)
+		}
+	}
+	for _, link := range m.Links {
+		msg.Links = append(msg.Links, &cwspb.LinkPreview{Url: link.URL, Title: link.Title, Description: link.Description, Image: link.Image})
+	}
+	return msg
+}
+
+func chatFromProto(msg *cwspb.ChatMessage) ChatMessage {
+	m := ChatMessage{
+		ID:       msg.GetId(),
+		User:     msg.GetUser(),
+		Message:  msg.GetMessage(),
+		Room:     msg.GetRoom(),
+		AuthorID: msg.GetAuthorId(),
+		Edited:   msg.GetEdited(),
+		Emoji:    msg.GetEmoji(),
+		Typing:   msg.GetTyping(),
+		To:       msg.GetTo(),
+	}
+	if ms := msg.GetTime(); ms != 0 {
+		m.Time = time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC()
+	}
+	if len(msg.GetReactions()) > 0 {
+		m.Reactions = make(map[string]int, len(msg.GetReactions()))
+		for emoji, count := range msg.GetReactions() {
+			m.Reactions[emoji] = int(count)
+		}
+	}
+	for _, link := range msg.GetLinks() {
+		m.Links = append(m.Links, LinkPreview{URL: link.GetUrl(), Title: link.GetTitle(), Description: link.GetDescription(), Image: link.GetImage()})
+	}
+	return m
+}
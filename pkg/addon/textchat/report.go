@@ -0,0 +1,225 @@
+package textchat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/gofrs/uuid"
+)
+
+// reportCollection of abuse reports in the store
+const reportCollection = "reports"
+
+const (
+	eventReport       = "REPORT"
+	eventReported     = "REPORTED"
+	eventReportFailed = "REPORT_FAILED"
+)
+
+const (
+	// reportContext is the number of recent messages of the room attached to a report
+	reportContext = 20
+	// maxReasonLength in bytes of the reason of a report
+	maxReasonLength = 500
+)
+
+// Statuses of reports in the moderation inbox
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+var (
+	ErrReportNotFound = errors.New("report not found")
+	ErrReportStatus   = errors.New("status is open, resolved or dismissed")
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// Report is a report of a user about another participant of the chat
+type Report struct {
+	ID         string `json:"id"`
+	ReporterID string `json:"reporter_id"`
+	ReportedID string `json:"reported_id"`
+	// ReportedUser is the last name the reported client used in the chat
+	ReportedUser string `json:"reported_user,omitempty"`
+	// MessageID is the reported message, empty for reports about the participant
+	MessageID string `json:"message_id,omitempty"`
+	Reason    string `json:"reason"`
+	Room      string `json:"room"`
+	// Context is the recent chat of the room up to the reported message, oldest first
+	Context []ChatMessage `json:"context"`
+	Time    time.Time     `json:"time"`
+	Status  string        `json:"status"`
+	// Note of the moderator who handled the report
+	Note string `json:"note,omitempty"`
+}
+
+// reportRequest is the data of REPORT packet
+type reportRequest struct {
+	ClientID  string `json:"client_id"`
+	MessageID string `json:"message_id"`
+	Room      string `json:"room"`
+	Reason    string `json:"reason"`
+}
+
+// report adds the report of the client to the moderation inbox and notifies the webhooks
+func (t *TextChat) report(reporterID string, req reportRequest) (Report, error) {
+	r := Report{
+		ID:         uuid.Must(uuid.NewV4()).String(),
+		ReporterID: reporterID,
+		ReportedID: req.ClientID,
+		MessageID:  req.MessageID,
+		Reason:     truncate(stripControl(strings.TrimSpace(req.Reason)), maxReasonLength),
+		Room:       req.Room,
+		Time:       time.Now(),
+		Status:     ReportOpen,
+	}
+
+	t.mu.Lock()
+	msgs := t.room(r.Room).msgs
+	end := len(msgs)
+	if r.MessageID != "" {
+		end = t.room(r.Room).find(r.MessageID) + 1
+		if end == 0 {
+			t.mu.Unlock()
+			return r, fmt.Errorf("message %s is not found", r.MessageID)
+		}
+		// The author of the message is reported, whoever the client says
+		r.ReportedID = msgs[end-1].AuthorID
+	}
+	start := end - reportContext
+	if start < 0 {
+		start = 0
+	}
+	r.Context = append([]ChatMessage{}, msgs[start:end]...)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].AuthorID == r.ReportedID {
+			r.ReportedUser = msgs[i].User
+			break
+		}
+	}
+	_, online := t.clients[r.ReportedID]
+	t.mu.Unlock()
+
+	if r.ReportedID == "" || r.ReportedID == reporterID {
+		return r, fmt.Errorf("invalid report from %s", reporterID)
+	}
+	if !online && r.ReportedUser == "" {
+		return r, fmt.Errorf("reported client %s is not in the chat", r.ReportedID)
+	}
+	if err := t.saveReport(r); err != nil {
+		return r, err
+	}
+	log.Println("Chat: report", r.ID, "about", r.ReportedID, "from", reporterID)
+	for _, hook := range t.reportWebhooks {
+		hook := hook
+		crash.Go("report webhook", func() {
+			if err := postReport(hook, r); err != nil {
+				log.Println("Failed to notify report webhook:", err)
+			}
+		}, "report", r.ID)
+	}
+	return r, nil
+}
+
+func (t *TextChat) saveReport(r Report) error {
+	if t.store != nil {
+		if err := t.store.Put(reportCollection, r.ID, r); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	t.reports[r.ID] = r
+	t.mu.Unlock()
+	return nil
+}
+
+// Reports returns the reports with the status, all reports with an empty status, oldest first
+func (t *TextChat) Reports(status string) []Report {
+	t.mu.Lock()
+	reports := []Report{}
+	for _, r := range t.reports {
+		if status == "" || r.Status == status {
+			reports = append(reports, r)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Time.Before(reports[j].Time) })
+	return reports
+}
+
+// UpdateReport sets the status of the report with a note of the moderator
+func (t *TextChat) UpdateReport(id string, status string, note string) (Report, error) {
+	switch status {
+	case ReportOpen, ReportResolved, ReportDismissed:
+	default:
+		return Report{}, ErrReportStatus
+	}
+	t.mu.Lock()
+	r, ok := t.reports[id]
+	t.mu.Unlock()
+	if !ok {
+		return Report{}, ErrReportNotFound
+	}
+	r.Status = status
+	r.Note = note
+	return r, t.saveReport(r)
+}
+
+// postReport posts the report with a text summary, which chat webhooks like Slack's show
+func postReport(endpoint string, r Report) error {
+	body, err := json.Marshal(struct {
+		Text   string `json:"text"`
+		Report Report `json:"report"`
+	}{fmt.Sprintf("Chat report %s about %s: %s", r.ID, reportedName(r), r.Reason), r})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+func reportedName(r Report) string {
+	if r.ReportedUser != "" {
+		return r.ReportedUser
+	}
+	return r.ReportedID
+}
+
+// routeReport lets the client report another participant, it's told if the report is taken
+func (c *chatClient) routeReport() {
+	c.ws.Receive(eventReport, func(request cws.WSPacket) cws.WSPacket {
+		var req reportRequest
+		if err := json.Unmarshal([]byte(request.Data), &req); err != nil {
+			log.Println("Wrong report packet from", c.clientID, err)
+			return cws.WSPacket{Type: eventReportFailed}
+		}
+		if req.Room != LobbyRoom || !c.lobby {
+			req.Room = c.room
+		}
+		r, err := c.report(c.clientID, req)
+		if err != nil {
+			log.Println("Chat:", err)
+			return cws.WSPacket{Type: eventReportFailed}
+		}
+		return cws.WSPacket{Type: eventReported, Data: r.ID}
+	})
+}
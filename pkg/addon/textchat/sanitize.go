@@ -0,0 +1,313 @@
+package textchat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// maxMessageLength in runes, longer messages are cut
+	maxMessageLength = 1000
+	maxUserLength    = 32
+	// maxLinks unfurled per message
+	maxLinks = 3
+	// maxPreviewBody is read from a page to find its OpenGraph tags
+	maxPreviewBody = 512 << 10
+	unfurlTimeout  = 3 * time.Second
+	// maxCachedPreviews of recent links
+	maxCachedPreviews = 256
+)
+
+const removedLink = "[link removed]"
+
+var errNotPublic = errors.New("address is not public")
+
+// linkPattern matches web links and the script/data/file schemes, which are always removed
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|javascript:|data:|vbscript:|file:)[^\s<>"]+`)
+
+// LinkPreview is the OpenGraph metadata of an allowed link in a message
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+// sanitizer strips markup from messages, removes links which are not allowed and unfurls the allowed ones
+type sanitizer struct {
+	allowed []string
+	unfurl  bool
+	client  *http.Client
+
+	mu       sync.Mutex
+	previews map[string]*LinkPreview
+}
+
+func newSanitizer(allowed []string, unfurl bool) *sanitizer {
+	hosts := make([]string, 0, len(allowed))
+	for _, h := range allowed {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return &sanitizer{
+		allowed: hosts,
+		// Fetching any page would let clients probe the internal network, so only allowlisted links are unfurled
+		unfurl: unfurl && len(hosts) > 0,
+		client: &http.Client{
+			Timeout: unfurlTimeout,
+			Transport: &http.Transport{
+				// Check the dialed address, so neither redirects nor DNS can make unfurling reach the internal network
+				DialContext:         (&net.Dialer{Timeout: unfurlTimeout, Control: publicOnly}).DialContext,
+				TLSHandshakeTimeout: unfurlTimeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		},
+		previews: map[string]*LinkPreview{},
+	}
+}
+
+// message returns the sanitized user and text of the message with the previews of its allowed links
+func (s *sanitizer) message(msg ChatMessage) ChatMessage {
+	msg.User = truncate(stripMarkup(msg.User), maxUserLength)
+	text := truncate(stripMarkup(msg.Message), maxMessageLength)
+
+	var links []string
+	msg.Message = linkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		u, ok := s.allowedLink(link)
+		if !ok {
+			return removedLink
+		}
+		links = append(links, u)
+		return u
+	})
+	msg.Links = nil
+	if s.unfurl {
+		for _, link := range links {
+			if len(msg.Links) == maxLinks {
+				break
+			}
+			if p := s.preview(link); p != nil {
+				msg.Links = append(msg.Links, *p)
+			}
+		}
+	}
+	return msg
+}
+
+// allowedLink checks the scheme and host of the link and returns it normalized
+func (s *sanitizer) allowedLink(link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return "", false
+	}
+	if len(s.allowed) == 0 {
+		return u.String(), true
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range s.allowed {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return u.String(), true
+		}
+	}
+	return "", false
+}
+
+// preview returns the cached OpenGraph metadata of the link, nil if the page has none
+func (s *sanitizer) preview(link string) *LinkPreview {
+	s.mu.Lock()
+	p, ok := s.previews[link]
+	s.mu.Unlock()
+	if ok {
+		return p
+	}
+
+	p = s.fetchPreview(link)
+	s.mu.Lock()
+	if len(s.previews) >= maxCachedPreviews {
+		s.previews = map[string]*LinkPreview{}
+	}
+	s.previews[link] = p
+	s.mu.Unlock()
+	return p
+}
+
+func (s *sanitizer) fetchPreview(link string) *LinkPreview {
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("User-Agent", "cloud-morph-unfurl/1.0")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+
+	p := openGraph(io.LimitReader(resp.Body, maxPreviewBody))
+	if p == nil {
+		return nil
+	}
+	p.URL = link
+	// The image is loaded by every client, so it must be an allowed link too
+	if p.Image != "" {
+		if img, ok := s.allowedLink(p.Image); ok && strings.HasPrefix(img, "https://") {
+			p.Image = img
+		} else {
+			p.Image = ""
+		}
+	}
+	return p
+}
+
+// openGraph reads og:title, og:description and og:image of the page head
+func openGraph(r io.Reader) *LinkPreview {
+	p := &LinkPreview{}
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return p.orNil()
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				return p.orNil()
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "meta" || !hasAttr {
+				continue
+			}
+			var property, content string
+			for {
+				key, val, more := z.TagAttr()
+				switch string(key) {
+				case "property", "name":
+					property = string(val)
+				case "content":
+					content = string(val)
+				}
+				if !more {
+					break
+				}
+			}
+			switch property {
+			case "og:title":
+				p.Title = truncate(stripMarkup(content), 200)
+			case "og:description":
+				p.Description = truncate(stripMarkup(content), 300)
+			case "og:image":
+				p.Image = content
+			}
+		}
+	}
+}
+
+func (p *LinkPreview) orNil() *LinkPreview {
+	if p.Title == "" && p.Description == "" {
+		return nil
+	}
+	return p
+}
+
+// stripMarkup returns the text of s without tags, scripts, styles and control characters
+func stripMarkup(s string) string {
+	if !strings.ContainsAny(s, "<&") {
+		return stripControl(s)
+	}
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return stripControl(b.String())
+		case html.StartTagToken:
+			if name, _ := z.TagName(); isRawTag(string(name)) {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); isRawTag(string(name)) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+}
+
+func isRawTag(name string) bool {
+	switch name {
+	case "script", "style", "iframe", "object", "noscript", "template":
+		return true
+	}
+	return false
+}
+
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicOnly refuses to connect to loopback, private and link-local addresses
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errNotPublic
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return errNotPublic
+		}
+	}
+	return nil
+}
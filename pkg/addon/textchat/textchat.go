@@ -4,122 +4,622 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/bus"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+	"github.com/giongto35/cloud-morph/pkg/common/store"
+	"github.com/gofrs/uuid"
+)
+
+const broadcastQueueSize = 256
+
+// maxHistory is the number of messages kept per room and sent to new clients
+const maxHistory = 500
+
+// historyCollection of chat messages in the store
+const historyCollection = "chat"
+
+// LobbyRoom is the global channel shared by clients of all rooms when the lobby is enabled
+const LobbyRoom = "lobby"
+
+// chat event types, the same as the WS packet types
+const (
+	eventChat    = "CHAT"
+	eventEdit    = "CHAT_EDIT"
+	eventDelete  = "CHAT_DELETE"
+	eventReact   = "REACT"
+	eventTyping  = "TYPING"
+	eventDM      = "DM"
+	eventBlock   = "BLOCK"
+	eventUnblock = "UNBLOCK"
+)
+
+// typingTimeout removes a typing user who hasn't sent TYPING again
+const typingTimeout = 5 * time.Second
+
+const (
+	// maxEmojiLength in bytes of a reaction
+	maxEmojiLength = 32
+	// maxReactions is the number of different reactions per message
+	maxReactions = 20
+)
+
+// TopicMessage carries every ChatMessage posted to a room, e.g. for moderation or archiving subscribers
+var TopicMessage = bus.NewTopic("chat", ChatMessage{})
+
+var (
+	chatQueueDepth = metrics.NewGauge("cloudmorph_chat_queue_depth", "Number of chat messages waiting to be broadcasted")
+	chatDropped    = metrics.NewCounter("cloudmorph_chat_messages_dropped_total", "Chat messages dropped because the broadcast queue is full")
 )
 
 type ChatMessage struct {
+	ID      string `json:"id"`
 	User    string `json:"user"`
 	Message string `json:"message"`
+	// Room of the message, LobbyRoom for the global channel. Clients can only choose the lobby
+	Room string `json:"room,omitempty"`
+	// AuthorID is the client which sent the message, only the author can edit it
+	AuthorID string    `json:"author_id,omitempty"`
+	Time     time.Time `json:"time"`
+	Edited   bool      `json:"edited,omitempty"`
+	// Reactions counts the clients reacted with each emoji
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// Emoji of REACT packet. With Typing, it is only used in packets from clients
+	Emoji string `json:"emoji,omitempty"`
+	// Typing of TYPING packet
+	Typing bool `json:"typing,omitempty"`
+	// To is the recipient of DM or the client of BLOCK/UNBLOCK packets
+	To string `json:"to,omitempty"`
+	// Links are the previews of allowed links in the message
+	Links []LinkPreview `json:"links,omitempty"`
+}
+
+// chatReactions is the data of REACT packet broadcasted to clients
+type chatReactions struct {
+	ID        string         `json:"id"`
+	Room      string         `json:"room"`
+	Reactions map[string]int `json:"reactions"`
+}
+
+// chatTyping is the data of TYPING packet broadcasted to clients
+type chatTyping struct {
+	Room  string   `json:"room"`
+	Users []string `json:"users"`
+}
+
+// typingUser is a client who is typing until the deadline
+type typingUser struct {
+	user  string
+	until time.Time
+}
+
+// chatDeletion is the data of CHAT_DELETE packet
+type chatDeletion struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	// By is author or moderator
+	By string `json:"by,omitempty"`
+}
+
+// chatEvent is a message, an edit or a deletion from a client
+type chatEvent struct {
+	Type      string
+	ClientID  string
+	Moderator bool
+	Msg       ChatMessage
+}
+
+// chatRoom is the history and typing users of a room
+type chatRoom struct {
+	msgs   []ChatMessage
+	typing map[string]typingUser
 }
 
 // TextChat is the service to handle all chat over websocket
 type TextChat struct {
-	chatMsgs    []ChatMessage
-	broadcastCh chan ChatMessage
+	mu          sync.Mutex
+	rooms       map[string]*chatRoom
+	broadcastCh chan chatEvent
 	clients     map[string]*chatClient
+	// lobby enables LobbyRoom
+	lobby bool
+	// store persists the history, nil keeps it in memory only
+	store *store.Store
+	// reactors are clients by emoji by message. Only counts are persisted
+	reactors  map[string]map[string]map[string]bool
+	sanitizer *sanitizer
+	// events receives posted messages, nil publishes nothing
+	events *bus.Bus
+	// reports of the moderation inbox by ID
+	reports        map[string]Report
+	reportWebhooks []string
 }
 
 type chatClient struct {
 	clientID    string
 	ws          *cws.Client
-	broadcastCh chan ChatMessage
+	broadcastCh chan chatEvent
 	WSEvents    chan cws.WSPacket
+	// room the client is attached to
+	room  string
+	lobby bool
+	// moderators can delete any message
+	moderator bool
+	sanitizer *sanitizer
+	// blocked clients can't send DMs to this client
+	blocked map[string]bool
+	// report adds a REPORT of the client to the moderation inbox
+	report func(reporterID string, req reportRequest) (Report, error)
 }
 
-// NewTextChat spawns a new text chat
-func NewTextChat() *TextChat {
-	return &TextChat{
-		chatMsgs:    []ChatMessage{},
+// NewTextChat spawns a new text chat. The history is loaded from and persisted to the store if it's not nil.
+// With lobby, clients can chat in LobbyRoom next to their own room
+func NewTextChat(st *store.Store, cfg config.ChatConfig) *TextChat {
+	t := &TextChat{
+		rooms:       map[string]*chatRoom{},
 		clients:     map[string]*chatClient{},
-		broadcastCh: make(chan ChatMessage, 1),
+		broadcastCh: make(chan chatEvent, broadcastQueueSize),
+		lobby:       cfg.Lobby,
+		store:       st,
+		reactors:    map[string]map[string]map[string]bool{},
+		sanitizer:   newSanitizer(cfg.AllowedLinks, cfg.Unfurl),
+		reports:     map[string]Report{},
+
+		reportWebhooks: cfg.ReportWebhooks,
 	}
+	if st != nil {
+		st.Each(historyCollection, func(id string, data json.RawMessage) error {
+			var msg ChatMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				log.Println("Skip broken chat message", id, err)
+				return nil
+			}
+			room := t.room(msg.Room)
+			room.msgs = append(room.msgs, msg)
+			return nil
+		})
+		for _, room := range t.rooms {
+			msgs := room.msgs
+			sort.Slice(msgs, func(i, j int) bool { return msgs[i].Time.Before(msgs[j].Time) })
+			for _, msg := range room.trim() {
+				t.persist(msg.ID, nil)
+			}
+		}
+		st.Each(reportCollection, func(id string, data json.RawMessage) error {
+			var r Report
+			if err := json.Unmarshal(data, &r); err != nil {
+				log.Println("Skip broken report", id, err)
+				return nil
+			}
+			t.reports[id] = r
+			return nil
+		})
+	}
+	return t
 }
 
-// broadcast broadcasts a message to all clients
-func (t *TextChat) broadcast(e ChatMessage) error {
-	data, err := json.Marshal(ChatMessage{
-		User:    e.User,
-		Message: e.Message,
-	})
+// room returns the room by name, it's created on the first use. The caller holds the lock
+func (t *TextChat) room(name string) *chatRoom {
+	room, ok := t.rooms[name]
+	if !ok {
+		room = &chatRoom{msgs: []ChatMessage{}, typing: map[string]typingUser{}}
+		t.rooms[name] = room
+	}
+	return room
+}
+
+// trim removes the messages over maxHistory and returns them
+func (r *chatRoom) trim() []ChatMessage {
+	if len(r.msgs) <= maxHistory {
+		return nil
+	}
+	expired := append([]ChatMessage{}, r.msgs[:len(r.msgs)-maxHistory]...)
+	r.msgs = append([]ChatMessage{}, r.msgs[len(r.msgs)-maxHistory:]...)
+	return expired
+}
+
+// find returns the index of the message
+func (r *chatRoom) find(id string) int {
+	for i := range r.msgs {
+		if r.msgs[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// send sends the packet to clients of the room, the lobby goes to all clients
+func (t *TextChat) send(room string, packetType string, v interface{}) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	for _, client := range t.clients {
+		if room != LobbyRoom && client.room != room {
+			continue
+		}
 		client.ws.Send(cws.WSPacket{
-			Type: "CHAT",
+			Type: packetType,
 			Data: string(data),
 		}, nil)
 	}
-	t.chatMsgs = append(t.chatMsgs, e)
+	return nil
+}
+
+// broadcast adds a new message to the history and broadcasts it to the room
+func (t *TextChat) broadcast(e ChatMessage) error {
+	t.mu.Lock()
+	room := t.room(e.Room)
+	room.msgs = append(room.msgs, e)
+	expired := room.trim()
+	for _, msg := range expired {
+		delete(t.reactors, msg.ID)
+	}
+	t.mu.Unlock()
+
+	t.persist(e.ID, &e)
+	for _, msg := range expired {
+		t.persist(msg.ID, nil)
+	}
+	t.events.Publish(TopicMessage, e)
+	return t.send(e.Room, eventChat, e)
+}
+
+// edit replaces the text of a message of the author
+func (t *TextChat) edit(e chatEvent) error {
+	t.mu.Lock()
+	room := t.room(e.Msg.Room)
+	i := room.find(e.Msg.ID)
+	if i < 0 || room.msgs[i].AuthorID != e.ClientID {
+		t.mu.Unlock()
+		return fmt.Errorf("message %s is not found or not editable by %s", e.Msg.ID, e.ClientID)
+	}
+	room.msgs[i].Message = e.Msg.Message
+	room.msgs[i].Links = e.Msg.Links
+	room.msgs[i].Edited = true
+	msg := room.msgs[i]
+	t.mu.Unlock()
+
+	t.persist(msg.ID, &msg)
+	return t.send(msg.Room, eventEdit, msg)
+}
+
+// remove deletes a message of the author, moderators can delete any message
+func (t *TextChat) remove(e chatEvent) error {
+	t.mu.Lock()
+	room := t.room(e.Msg.Room)
+	i := room.find(e.Msg.ID)
+	if i < 0 || (room.msgs[i].AuthorID != e.ClientID && !e.Moderator) {
+		t.mu.Unlock()
+		return fmt.Errorf("message %s is not found or not deletable by %s", e.Msg.ID, e.ClientID)
+	}
+	deletion := chatDeletion{ID: e.Msg.ID, Room: e.Msg.Room, By: "author"}
+	if room.msgs[i].AuthorID != e.ClientID {
+		deletion.By = "moderator"
+	}
+	room.msgs = append(room.msgs[:i], room.msgs[i+1:]...)
+	delete(t.reactors, e.Msg.ID)
+	t.mu.Unlock()
+
+	t.persist(e.Msg.ID, nil)
+	return t.send(deletion.Room, eventDelete, deletion)
+}
 
+// react toggles the reaction of the client on a message and broadcasts the new counts
+func (t *TextChat) react(e chatEvent) error {
+	emoji := e.Msg.Emoji
+	if emoji == "" || len(emoji) > maxEmojiLength {
+		return fmt.Errorf("invalid reaction from %s", e.ClientID)
+	}
+	t.mu.Lock()
+	room := t.room(e.Msg.Room)
+	i := room.find(e.Msg.ID)
+	if i < 0 {
+		t.mu.Unlock()
+		return fmt.Errorf("message %s is not found", e.Msg.ID)
+	}
+	msg := &room.msgs[i]
+	if msg.Reactions == nil {
+		msg.Reactions = map[string]int{}
+	}
+	if _, ok := msg.Reactions[emoji]; !ok && len(msg.Reactions) >= maxReactions {
+		t.mu.Unlock()
+		return fmt.Errorf("message %s has too many reactions", e.Msg.ID)
+	}
+	byEmoji, ok := t.reactors[msg.ID]
+	if !ok {
+		byEmoji = map[string]map[string]bool{}
+		t.reactors[msg.ID] = byEmoji
+	}
+	if byEmoji[emoji] == nil {
+		byEmoji[emoji] = map[string]bool{}
+	}
+	if byEmoji[emoji][e.ClientID] {
+		delete(byEmoji[emoji], e.ClientID)
+		msg.Reactions[emoji]--
+	} else {
+		byEmoji[emoji][e.ClientID] = true
+		msg.Reactions[emoji]++
+	}
+	if msg.Reactions[emoji] <= 0 {
+		delete(msg.Reactions, emoji)
+		delete(byEmoji, emoji)
+	}
+	reactions := chatReactions{ID: msg.ID, Room: msg.Room, Reactions: map[string]int{}}
+	for k, v := range msg.Reactions {
+		reactions.Reactions[k] = v
+	}
+	stored := *msg
+	t.mu.Unlock()
+
+	t.persist(stored.ID, &stored)
+	return t.send(reactions.Room, eventReact, reactions)
+}
+
+// setTyping updates the typing state of the client and broadcasts the typing users of the room
+func (t *TextChat) setTyping(e chatEvent) error {
+	t.mu.Lock()
+	room := t.room(e.Msg.Room)
+	_, wasTyping := room.typing[e.ClientID]
+	if e.Msg.Typing {
+		room.typing[e.ClientID] = typingUser{user: e.Msg.User, until: time.Now().Add(typingTimeout)}
+	} else {
+		delete(room.typing, e.ClientID)
+	}
+	t.mu.Unlock()
+
+	// Refreshing the deadline doesn't change the list
+	if wasTyping == e.Msg.Typing {
+		return nil
+	}
+	return t.sendTyping(e.Msg.Room)
+}
+
+// expireTyping removes typing users after timeout
+func (t *TextChat) expireTyping(now time.Time) error {
+	t.mu.Lock()
+	var changed []string
+	for name, room := range t.rooms {
+		expired := false
+		for id, u := range room.typing {
+			if now.After(u.until) {
+				delete(room.typing, id)
+				expired = true
+			}
+		}
+		if expired {
+			changed = append(changed, name)
+		}
+	}
+	t.mu.Unlock()
+	for _, name := range changed {
+		if err := t.sendTyping(name); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// sendTyping broadcasts the sorted list of typing users of the room
+func (t *TextChat) sendTyping(name string) error {
+	t.mu.Lock()
+	typing := chatTyping{Room: name, Users: []string{}}
+	for _, u := range t.room(name).typing {
+		typing.Users = append(typing.Users, u.user)
+	}
+	t.mu.Unlock()
+	sort.Strings(typing.Users)
+	return t.send(name, eventTyping, typing)
+}
+
+// persist stores the message, nil deletes it
+func (t *TextChat) persist(id string, msg *ChatMessage) {
+	if t.store == nil {
+		return
+	}
+	var err error
+	if msg == nil {
+		err = t.store.Delete(historyCollection, id)
+	} else {
+		err = t.store.Put(historyCollection, id, msg)
+	}
+	if err != nil {
+		log.Println("Failed to persist chat history", err)
+	}
+}
+
 // Handle is main handler for TextChat
 func (t *TextChat) Handle() {
-	for e := range t.broadcastCh {
-		t.broadcast(e)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case e, ok := <-t.broadcastCh:
+			if !ok {
+				return
+			}
+			chatQueueDepth.Set(int64(len(t.broadcastCh)))
+			switch e.Type {
+			case eventChat:
+				e.Msg.Reactions = nil
+				err = t.broadcast(e.Msg)
+			case eventEdit:
+				err = t.edit(e)
+			case eventDelete:
+				err = t.remove(e)
+			case eventReact:
+				err = t.react(e)
+			case eventTyping:
+				err = t.setTyping(e)
+			case eventDM:
+				err = t.direct(e)
+			case eventBlock, eventUnblock:
+				t.block(e.ClientID, e.Msg.To, e.Type == eventBlock)
+			}
+		case now := <-ticker.C:
+			err = t.expireTyping(now)
+		}
+		if err != nil {
+			log.Println("Chat:", err)
+		}
 	}
 }
 
 // NewChatClient returns a new chat client
-func NewChatClient(clientID string, ws *cws.Client, broadcastCh chan ChatMessage, wsEvents chan cws.WSPacket) *chatClient {
+func NewChatClient(clientID string, ws *cws.Client, broadcastCh chan chatEvent, wsEvents chan cws.WSPacket) *chatClient {
 	return &chatClient{
 		broadcastCh: broadcastCh,
 		clientID:    clientID,
 		ws:          ws,
 		WSEvents:    wsEvents,
+		blocked:     map[string]bool{},
 	}
 }
 
-// AddClient add a new chat client to TextChat
-func (t *TextChat) AddClient(clientID string, ws *cws.Client) *chatClient {
+// AddClient add a new chat client attached to the room. Moderators can delete messages of others
+func (t *TextChat) AddClient(clientID string, ws *cws.Client, room string, moderator bool) *chatClient {
 	client := NewChatClient(clientID, ws, t.broadcastCh, make(chan cws.WSPacket, 1))
+	client.room = room
+	client.lobby = t.lobby
+	client.sanitizer = t.sanitizer
+	client.moderator = moderator
+	client.report = t.report
+	t.mu.Lock()
 	t.clients[clientID] = client
+	t.mu.Unlock()
 	return client
 }
 
-// SendChatHistory sends chat history to all clients
+// RemoveClient stops broadcasting to the client
+func (t *TextChat) RemoveClient(clientID string) {
+	t.mu.Lock()
+	client, ok := t.clients[clientID]
+	delete(t.clients, clientID)
+	var typing []string
+	if ok {
+		for _, name := range []string{client.room, LobbyRoom} {
+			if room, ok := t.rooms[name]; ok {
+				if _, ok := room.typing[clientID]; ok {
+					delete(room.typing, clientID)
+					typing = append(typing, name)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, name := range typing {
+		t.sendTyping(name)
+	}
+}
+
+// PublishTo publishes posted messages on TopicMessage of the bus. It's set before Handle starts
+func (t *TextChat) PublishTo(events *bus.Bus) {
+	t.events = events
+}
+
+// SendChatHistory sends the history of the lobby and the room of the client
 func (t *TextChat) SendChatHistory(clientID string) {
+	// Marshal under the lock because reactions are updated in place
+	t.mu.Lock()
 	client, ok := t.clients[clientID]
+	var history [][]byte
+	if ok {
+		rooms := []string{client.room}
+		if t.lobby {
+			rooms = []string{LobbyRoom, client.room}
+		}
+		for _, name := range rooms {
+			for _, msg := range t.room(name).msgs {
+				data, err := json.Marshal(msg)
+				if err != nil {
+					log.Println("Failed to send ", msg)
+					continue
+				}
+				history = append(history, data)
+			}
+		}
+	}
+	t.mu.Unlock()
 	if !ok {
 		fmt.Println("Client not found", clientID)
 		return
 	}
 
-	for _, msg := range t.chatMsgs {
-		data, err := json.Marshal(ChatMessage{
-			User:    msg.User,
-			Message: msg.Message,
-		})
-		if err != nil {
-			log.Println("Failed to send ", msg)
-			continue
-		}
-
+	for _, data := range history {
 		client.ws.Send(cws.WSPacket{
-			Type: "CHAT",
+			Type: eventChat,
 			Data: string(data),
 		}, nil)
 	}
 }
 
-func convert(packet cws.WSPacket) ChatMessage {
+func convert(packet cws.WSPacket) (ChatMessage, error) {
 	chatMsg := ChatMessage{}
 	err := json.Unmarshal([]byte(packet.Data), &chatMsg)
-	if err != nil {
-		panic(err)
-	}
+	return chatMsg, err
+}
 
-	return chatMsg
+// push queues the event for Handle. Don't block the client when broadcasting is behind
+func (c *chatClient) push(e chatEvent) {
+	select {
+	case c.broadcastCh <- e:
+		chatQueueDepth.Set(int64(len(c.broadcastCh)))
+	default:
+		log.Println("Chat queue is full, drop message from", c.clientID)
+		chatDropped.Inc()
+	}
 }
 
 func (c *chatClient) Route() {
-	c.ws.Receive("CHAT", func(request cws.WSPacket) (response cws.WSPacket) {
-		c.broadcastCh <- convert(request)
-		return cws.EmptyPacket
-	})
+	for _, eventType := range []string{eventChat, eventEdit, eventDelete, eventReact, eventTyping, eventDM, eventBlock, eventUnblock} {
+		eventType := eventType
+		c.ws.Receive(eventType, func(request cws.WSPacket) (response cws.WSPacket) {
+			msg, err := convert(request)
+			if err != nil {
+				log.Println("Wrong chat packet from", c.clientID, err)
+				return cws.EmptyPacket
+			}
+			// Clients chat in their own room unless they choose the lobby
+			if msg.Room != LobbyRoom || !c.lobby {
+				msg.Room = c.room
+			}
+			if eventType == eventChat || eventType == eventDM {
+				// The server owns ID, author and time of new messages
+				msg.ID = uuid.Must(uuid.NewV4()).String()
+				msg.AuthorID = c.clientID
+				msg.Time = time.Now()
+				msg.Edited = false
+			}
+			// Emoji and Typing only belong to their packets
+			if eventType != eventReact {
+				msg.Emoji = ""
+			}
+			if eventType != eventTyping {
+				msg.Typing = false
+			}
+			if eventType == eventChat {
+				msg.To = ""
+			}
+			// Unfurling may take a while, it blocks only the packets of this client
+			switch eventType {
+			case eventChat, eventEdit, eventDM:
+				msg = c.sanitizer.message(msg)
+			}
+			c.push(chatEvent{Type: eventType, ClientID: c.clientID, Moderator: c.moderator, Msg: msg})
+			return cws.EmptyPacket
+		})
+	}
+	if c.report != nil {
+		c.routeReport()
+	}
 }
 
 func (c *chatClient) Close() {
@@ -0,0 +1,345 @@
+// Package client streams a cloud-morph app from Go like the web page does, e.g. for bots, test harnesses and kiosks.
+// It joins the instance over the websocket, answers the WebRTC offer of the worker and sends input over the DataChannel
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+const inputChannelLabel = "app-input"
+
+var ErrClosed = errors.New("connection is closed")
+
+// Options of a connection
+type Options struct {
+	// Token is an API token issued with the admin API of the instance, sent as bearer token
+	Token string
+	// TLS connects with wss
+	TLS bool
+	// Protobuf negotiates protobuf encoded packets instead of JSON, see cws/cwspb/cloudmorph.proto
+	Protobuf bool
+	// Compression negotiates permessage-deflate, the instance compresses larger packets when it's enabled there
+	Compression bool
+	// ICEServers replace the STUN/TURN servers the worker sends
+	ICEServers []webrtc.ICEServer
+	// OnTrack is called with the video and audio tracks of the app, also with tracks added later, e.g. app windows
+	OnTrack func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
+	// Handlers are called with the data of websocket packets by type, e.g. CHAT, QUEUE or WINDOW.
+	// They are registered before the connection starts so no early packet is missed
+	Handlers map[string]func(data string)
+}
+
+// Client is a session of an app instance
+type Client struct {
+	opts Options
+	ws   *cws.Client
+
+	mu    sync.Mutex
+	pc    *webrtc.PeerConnection
+	input *webrtc.DataChannel
+	// wsInput sends input over the websocket, the worker has the input DataChannel off for the session
+	wsInput bool
+	// candidates of the worker which arrive before its offer
+	pending   []webrtc.ICECandidateInit
+	ready     chan struct{}
+	readyOnce sync.Once
+	failed    chan error
+}
+
+// Dial joins the instance at addr, e.g. localhost:8080, and returns once input can be sent.
+// It fails when the session is refused, e.g. with ACCESS_DENIED or CAPACITY
+func Dial(ctx context.Context, addr string, opts Options) (*Client, error) {
+	scheme := "ws"
+	if opts.TLS {
+		scheme = "wss"
+	}
+	header := http.Header{}
+	if opts.Token != "" {
+		header.Set("Authorization", "Bearer "+opts.Token)
+	}
+	dialer := *websocket.DefaultDialer
+	if opts.Protobuf {
+		dialer.Subprotocols = []string{cws.EncodingProto}
+	}
+	dialer.EnableCompression = opts.Compression
+	conn, resp, err := dialer.DialContext(ctx, scheme+"://"+addr+"/ws", header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("dial %s: %s", addr, resp.Status)
+		}
+		return nil, err
+	}
+
+	c := &Client{
+		opts:   opts,
+		ws:     cws.NewClient(conn),
+		ready:  make(chan struct{}),
+		failed: make(chan error, 1),
+	}
+	c.route()
+	go c.ws.Listen()
+	go c.ws.Heartbeat()
+
+	select {
+	case <-c.ready:
+		return c, nil
+	case err = <-c.failed:
+	case <-c.ws.Done:
+		err = ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.Close()
+	return nil, err
+}
+
+// route registers handlers of the signaling packets of the worker and of the options
+func (c *Client) route() {
+	for packetType, handler := range c.opts.Handlers {
+		handler := handler
+		c.ws.Receive(packetType, func(req cws.WSPacket) cws.WSPacket {
+			handler(req.Data)
+			return cws.EmptyPacket
+		})
+	}
+	for _, refused := range []string{"ACCESS_DENIED", "VIEW_DENIED", "CAPACITY"} {
+		refused := refused
+		handler := c.opts.Handlers[refused]
+		c.ws.Receive(refused, func(req cws.WSPacket) cws.WSPacket {
+			if handler != nil {
+				handler(req.Data)
+			}
+			c.fail(fmt.Errorf("%s: %s", refused, req.Data))
+			return cws.EmptyPacket
+		})
+	}
+	// Feature flags of the session, input without the DataChannel goes over the websocket
+	c.ws.Receive("FEATURES", func(req cws.WSPacket) cws.WSPacket {
+		var features map[string]bool
+		if err := json.Unmarshal([]byte(req.Data), &features); err == nil {
+			c.mu.Lock()
+			c.wsInput = !features["datachannelInput"]
+			c.mu.Unlock()
+		}
+		return cws.EmptyPacket
+	})
+	// The worker sends its ICE servers when the session is admitted
+	c.ws.Receive("init", func(req cws.WSPacket) cws.WSPacket {
+		if err := c.start(req.Data); err != nil {
+			c.fail(err)
+		}
+		return cws.EmptyPacket
+	})
+	// Later offers renegotiate tracks of the running session
+	c.ws.Receive("offer", func(req cws.WSPacket) cws.WSPacket {
+		if err := c.answer(req.Data); err != nil {
+			c.fail(err)
+		}
+		return cws.EmptyPacket
+	})
+	c.ws.Receive("candidate", func(req cws.WSPacket) cws.WSPacket {
+		if err := c.addCandidate(req.Data); err != nil {
+			c.fail(err)
+		}
+		return cws.EmptyPacket
+	})
+}
+
+// start creates the peer connection and asks the worker for its offer
+func (c *Client) start(iceServers string) error {
+	conf := webrtc.Configuration{ICEServers: c.opts.ICEServers}
+	if len(conf.ICEServers) == 0 {
+		servers, err := parseICEServers(iceServers)
+		if err != nil {
+			return err
+		}
+		conf.ICEServers = servers
+	}
+	pc, err := webrtc.NewPeerConnection(conf)
+	if err != nil {
+		return err
+	}
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if c.opts.OnTrack != nil {
+			c.opts.OnTrack(track, receiver)
+			return
+		}
+		// RTP must be read for RTCP to flow
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := track.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != inputChannelLabel {
+			return
+		}
+		dc.OnOpen(func() {
+			c.mu.Lock()
+			c.input = dc
+			c.mu.Unlock()
+			c.readyOnce.Do(func() { close(c.ready) })
+		})
+	})
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		data, err := encode(candidate.ToJSON())
+		if err != nil {
+			return
+		}
+		c.ws.Send(cws.WSPacket{Type: "candidate", Data: data}, nil)
+	})
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateFailed {
+			c.fail(errors.New("ice connection failed"))
+		}
+		c.mu.Lock()
+		wsInput := c.wsInput
+		c.mu.Unlock()
+		if state == webrtc.ICEConnectionStateConnected && wsInput {
+			c.readyOnce.Do(func() { close(c.ready) })
+		}
+	})
+	c.mu.Lock()
+	c.pc = pc
+	c.mu.Unlock()
+
+	// The offer comes back as the response of initwebrtc
+	c.ws.Send(cws.WSPacket{Type: "initwebrtc"}, func(resp cws.WSPacket) {
+		if err := c.answer(resp.Data); err != nil {
+			c.fail(err)
+		}
+	})
+	return nil
+}
+
+// answer sets the offer of the worker and sends the answer back
+func (c *Client) answer(offer string) error {
+	var sdp webrtc.SessionDescription
+	if err := decode(offer, &sdp); err != nil {
+		return fmt.Errorf("wrong offer: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pc == nil {
+		return errors.New("offer before init")
+	}
+	if err := c.pc.SetRemoteDescription(sdp); err != nil {
+		return err
+	}
+	for _, candidate := range c.pending {
+		if err := c.pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	c.pending = nil
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	data, err := encode(answer)
+	if err != nil {
+		return err
+	}
+	c.ws.Send(cws.WSPacket{Type: "answer", Data: data}, nil)
+	return nil
+}
+
+// addCandidate adds an ICE candidate of the worker, an empty one ends gathering
+func (c *Client) addCandidate(data string) error {
+	if data == "" {
+		return nil
+	}
+	var candidate webrtc.ICECandidateInit
+	if err := decode(data, &candidate); err != nil {
+		return fmt.Errorf("wrong candidate: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pc == nil || c.pc.RemoteDescription() == nil {
+		c.pending = append(c.pending, candidate)
+		return nil
+	}
+	return c.pc.AddICECandidate(candidate)
+}
+
+func (c *Client) fail(err error) {
+	select {
+	case c.failed <- err:
+	default:
+	}
+}
+
+// Send sends a websocket packet to the instance, e.g. CHAT or WINDOW_CAPTURE
+func (c *Client) Send(packetType string, data string) {
+	c.ws.Send(cws.WSPacket{Type: packetType, Data: data}, nil)
+}
+
+// Done is closed when the websocket connection ends
+func (c *Client) Done() <-chan struct{} {
+	return c.ws.Done
+}
+
+// Close leaves the session
+func (c *Client) Close() error {
+	c.mu.Lock()
+	pc := c.pc
+	c.mu.Unlock()
+	c.ws.Close()
+	if pc != nil {
+		return pc.Close()
+	}
+	return nil
+}
+
+// parseICEServers reads the ICE servers of the init packet: a STUN url or a JSON list
+func parseICEServers(data string) ([]webrtc.ICEServer, error) {
+	if data == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(data, "[") {
+		return []webrtc.ICEServer{{URLs: []string{data}}}, nil
+	}
+	var servers []webrtc.ICEServer
+	if err := json.Unmarshal([]byte(data), &servers); err != nil {
+		return nil, fmt.Errorf("wrong ICE servers: %w", err)
+	}
+	return servers, nil
+}
+
+// encode and decode SDP and candidates like the worker, base64 of JSON
+func encode(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decode(in string, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
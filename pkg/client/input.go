@@ -0,0 +1,102 @@
+package client
+
+import (
+	"encoding/json"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// Input events of the worker
+const (
+	KeyDown   = "KEYDOWN"
+	KeyUp     = "KEYUP"
+	MouseMove = "MOUSEMOVE"
+	MouseDown = "MOUSEDOWN"
+	MouseUp   = "MOUSEUP"
+	// Blur releases the keys and buttons the client holds
+	Blur = "BLUR"
+	// Macro runs a macro of the instance config by name
+	Macro = "MACRO"
+)
+
+type keyData struct {
+	KeyCode int `json:"keycode"`
+}
+
+// mouseData positions are relative to the width and height, the worker scales them to the app screen
+type mouseData struct {
+	IsLeft byte    `json:"isLeft"`
+	X      float32 `json:"x"`
+	Y      float32 `json:"y"`
+	Width  float32 `json:"width"`
+	Height float32 `json:"height"`
+}
+
+// Key sends a KeyDown or KeyUp event of the JavaScript key code, e.g. 13 for Enter
+func (c *Client) Key(event string, keyCode int) error {
+	return c.sendInput(event, keyData{KeyCode: keyCode})
+}
+
+// Press sends key down and up of the key code
+func (c *Client) Press(keyCode int) error {
+	if err := c.Key(KeyDown, keyCode); err != nil {
+		return err
+	}
+	return c.Key(KeyUp, keyCode)
+}
+
+// Mouse sends a MouseMove, MouseDown or MouseUp event. x and y are fractions of the picture from 0 to 1
+func (c *Client) Mouse(event string, left bool, x, y float32) error {
+	data := mouseData{X: x, Y: y, Width: 1, Height: 1}
+	if left {
+		data.IsLeft = 1
+	}
+	return c.sendInput(event, data)
+}
+
+// Click moves the mouse to x and y, fractions of the picture from 0 to 1, and clicks the left button
+func (c *Client) Click(x, y float32) error {
+	for _, event := range []string{MouseMove, MouseDown, MouseUp} {
+		if err := c.Mouse(event, true, x, y); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunMacro runs the macro of the instance config by name
+func (c *Client) RunMacro(name string) error {
+	return c.send(cws.WSPacket{Type: Macro, Data: name})
+}
+
+// ReleaseAll releases the keys and buttons the client holds
+func (c *Client) ReleaseAll() error {
+	return c.send(cws.WSPacket{Type: Blur})
+}
+
+func (c *Client) sendInput(event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return c.send(cws.WSPacket{Type: event, Data: string(b)})
+}
+
+// send writes the packet to the input DataChannel like the web page, or to the websocket without one
+func (c *Client) send(packet cws.WSPacket) error {
+	b, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	input, wsInput := c.input, c.wsInput
+	c.mu.Unlock()
+	if wsInput {
+		c.ws.Send(cws.WSPacket{Type: "INPUT", Data: string(b)}, nil)
+		return nil
+	}
+	if input == nil {
+		return ErrClosed
+	}
+	return input.Send(b)
+}
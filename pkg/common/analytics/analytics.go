@@ -0,0 +1,122 @@
+// Package analytics emits structured session events to pluggable sinks
+package analytics
+
+import (
+	"log"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+const (
+	EventJoin  = "join"
+	EventLeave = "leave"
+	EventError = "error"
+	// Audit events of admins attaching to sessions and taking control
+	EventAdminAttach = "admin_attach"
+	EventAdminDetach = "admin_detach"
+	EventAssistStart = "assist_start"
+	EventAssistStop  = "assist_stop"
+	// A guest signed in during the session
+	EventGuestUpgrade = "guest_upgrade"
+)
+
+const queueSize = 1024
+
+var eventsDropped = metrics.NewCounter("cloudmorph_analytics_events_dropped_total", "Analytics events dropped because sinks are behind")
+
+// Event is an analytics event of a session
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id"`
+	AppName  string    `json:"app_name"`
+	// Session duration in seconds, for leave events
+	Duration float64 `json:"duration,omitempty"`
+	Codec    string  `json:"codec,omitempty"`
+	// Average video bitrate in kbps, for leave events
+	AvgBitrate int64  `json:"avg_bitrate,omitempty"`
+	ErrorType  string `json:"error_type,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Remote address of the admin, for audit events
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Region of the client, for leave events
+	Region string `json:"region,omitempty"`
+}
+
+// Sink receives analytics events
+type Sink interface {
+	Write(e Event) error
+	Close() error
+}
+
+// Pipeline delivers events to sinks in background so emitting never blocks streaming
+type Pipeline struct {
+	sinks  []Sink
+	events chan Event
+	done   chan struct{}
+}
+
+// NewPipeline returns a pipeline with sinks from config. It returns nil when no sink is configured
+func NewPipeline(cfg config.AnalyticsConfig) *Pipeline {
+	var sinks []Sink
+	for _, sinkCfg := range cfg.Sinks {
+		sink, err := newSink(sinkCfg)
+		if err != nil {
+			log.Println("Analytics: skip sink", sinkCfg.Type, err)
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	p := &Pipeline{
+		sinks:  sinks,
+		events: make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	crash.Go("analytics", p.run)
+	return p
+}
+
+// Emit queues an event. It's safe to call on a nil pipeline
+func (p *Pipeline) Emit(e Event) {
+	if p == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case p.events <- e:
+	default:
+		eventsDropped.Inc()
+	}
+}
+
+// Close flushes queued events and closes sinks
+func (p *Pipeline) Close() {
+	if p == nil {
+		return
+	}
+	close(p.events)
+	<-p.done
+}
+
+func (p *Pipeline) run() {
+	for e := range p.events {
+		for _, sink := range p.sinks {
+			if err := sink.Write(e); err != nil {
+				log.Println("Analytics: sink write failed", err)
+			}
+		}
+	}
+	for _, sink := range p.sinks {
+		sink.Close()
+	}
+	close(p.done)
+}
@@ -0,0 +1,182 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+const (
+	httpBatchSize     = 100
+	httpFlushInterval = 5 * time.Second
+)
+
+func newSink(cfg config.AnalyticsSink) (Sink, error) {
+	switch cfg.Type {
+	case "stdout":
+		return &jsonSink{w: os.Stdout}, nil
+	case "file":
+		f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSink{w: f, closer: f}, nil
+	case "http":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("http sink requires url")
+		}
+		return newHTTPSink(cfg.URL, cfg.Headers, "application/json", encodeBatch), nil
+	case "kafkaRest":
+		if cfg.KafkaRestURL == "" || cfg.Topic == "" {
+			return nil, fmt.Errorf("kafkaRest sink requires kafkaRestURL and topic")
+		}
+		u := strings.TrimSuffix(cfg.KafkaRestURL, "/") + "/topics/" + url.PathEscape(cfg.Topic)
+		return newHTTPSink(u, cfg.Headers, kafkaRestContentType, encodeKafkaRecords), nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+// jsonSink writes one JSON event per line
+type jsonSink struct {
+	w      io.Writer
+	closer io.Closer
+}
+
+func (s *jsonSink) Write(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *jsonSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// kafkaRestContentType is the embedded JSON format of produce requests of the Kafka REST proxy
+const kafkaRestContentType = "application/vnd.kafka.json.v2+json"
+
+// kafkaRecords is the body of a produce request of the Kafka REST proxy
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Value Event `json:"value"`
+}
+
+// encodeBatch encodes the batch as a JSON array
+func encodeBatch(batch []Event) ([]byte, error) {
+	return json.Marshal(batch)
+}
+
+// encodeKafkaRecords encodes the batch as records of a produce request of the Kafka REST proxy
+func encodeKafkaRecords(batch []Event) ([]byte, error) {
+	records := kafkaRecords{Records: make([]kafkaRecord, len(batch))}
+	for i, e := range batch {
+		records.Records[i].Value = e
+	}
+	return json.Marshal(records)
+}
+
+// httpSink posts batches of events encoded by the sink type: a JSON array to collectors, or records produced to
+// a topic by a Kafka REST proxy, e.g. Confluent REST Proxy. The worker doesn't speak the Kafka protocol itself
+type httpSink struct {
+	url         string
+	headers     map[string]string
+	contentType string
+	encode      func([]Event) ([]byte, error)
+	client      *http.Client
+
+	mu    sync.Mutex
+	batch []Event
+	stop  chan struct{}
+}
+
+func newHTTPSink(endpoint string, headers map[string]string, contentType string, encode func([]Event) ([]byte, error)) *httpSink {
+	s := &httpSink{
+		url:         endpoint,
+		headers:     headers,
+		contentType: contentType,
+		encode:      encode,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		stop:        make(chan struct{}),
+	}
+	crash.Go("analytics http sink", func() {
+		ticker := time.NewTicker(httpFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-s.stop:
+				return
+			}
+		}
+	})
+	return s
+}
+
+func (s *httpSink) Write(e Event) error {
+	s.mu.Lock()
+	s.batch = append(s.batch, e)
+	full := len(s.batch) >= httpBatchSize
+	s.mu.Unlock()
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *httpSink) flush() error {
+	s.mu.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	b, err := s.encode(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", s.contentType)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("http sink got status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	close(s.stop)
+	return s.flush()
+}
@@ -0,0 +1,45 @@
+// Package backoff spaces out retries exponentially with jitter, so clients of a restarted service don't retry in lockstep
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff returns the delays of consecutive attempts. It's not safe for concurrent use
+type Backoff struct {
+	// Min is the delay of the first attempt and Max caps the delays
+	Min, Max time.Duration
+	// Multiplier grows the delay per attempt
+	Multiplier float64
+	// Jitter spreads each delay by up to this fraction of it in both directions, 0-1
+	Jitter float64
+
+	attempts int
+}
+
+// Next returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	d := float64(b.Min)
+	for i := 0; i < b.attempts && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	b.attempts++
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Attempts returns the attempts since the last reset
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset starts over from Min after a success
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
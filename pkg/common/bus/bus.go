@@ -0,0 +1,88 @@
+// Package bus is an in-process publish/subscribe event bus. Subsystems publish events of typed topics,
+// and subscribers like the input recorder, analytics and addons are added without wiring them into the publisher
+package bus
+
+import (
+	"log"
+	"reflect"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+// Topic is a named stream of events of one type
+type Topic struct {
+	name string
+	typ  reflect.Type
+}
+
+// NewTopic returns a topic of events of the type of the sample event
+func NewTopic(name string, sample interface{}) Topic {
+	return Topic{name: name, typ: reflect.TypeOf(sample)}
+}
+
+func (t Topic) String() string {
+	return t.name
+}
+
+type subscriber struct {
+	id     int
+	name   string
+	handle func(event interface{})
+}
+
+// Bus delivers published events to the subscribers of their topic
+type Bus struct {
+	mu     sync.RWMutex
+	subs   map[string][]subscriber
+	nextID int
+}
+
+func New() *Bus {
+	return &Bus{subs: map[string][]subscriber{}}
+}
+
+// Subscribe calls handle with every event of the topic in publishing order. It returns the function unsubscribing.
+// Handlers run on the goroutine of the publisher and must not block, subscribers doing slow work queue events themselves
+func (b *Bus) Subscribe(topic Topic, name string, handle func(event interface{})) func() {
+	b.mu.Lock()
+	b.nextID++
+	id := b.nextID
+	b.subs[topic.name] = append(b.subs[topic.name], subscriber{id: id, name: name, handle: handle})
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		subs := b.subs[topic.name]
+		for i, s := range subs {
+			if s.id == id {
+				b.subs[topic.name] = append(subs[:i:i], subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers the event to the subscribers of the topic. Events of another type than the topic are dropped.
+// It's safe to call on a nil bus
+func (b *Bus) Publish(topic Topic, event interface{}) {
+	if b == nil {
+		return
+	}
+	if reflect.TypeOf(event) != topic.typ {
+		log.Printf("Bus: drop %T event of topic %s of %s", event, topic.name, topic.typ)
+		return
+	}
+	b.mu.RLock()
+	subs := b.subs[topic.name]
+	b.mu.RUnlock()
+	for _, s := range subs {
+		deliver(topic, s, event)
+	}
+}
+
+// deliver contains a panic of the subscriber, so it doesn't break the publisher
+func deliver(topic Topic, s subscriber, event interface{}) {
+	defer crash.Recover("subscriber "+s.name, "topic", topic.name)
+	s.handle(event)
+}
@@ -0,0 +1,195 @@
+// Package capacity collects the resource usage of a worker for heartbeats and admission control
+package capacity
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// Report is the capacity of a worker sent in heartbeats
+type Report struct {
+	// CPU usage in percent of all cores since the previous report
+	CPU float64 `json:"cpu"`
+	// Memory in bytes
+	MemoryTotal uint64 `json:"memory_total"`
+	MemoryUsed  uint64 `json:"memory_used"`
+	GPUs        []GPU  `json:"gpus,omitempty"`
+	// Hardware encoder sessions, 0 slots when they are not tracked
+	EncoderSlots     int `json:"encoder_slots"`
+	EncoderSlotsUsed int `json:"encoder_slots_used"`
+	Sessions         int `json:"sessions"`
+	MaxSessions      int `json:"max_sessions,omitempty"`
+	// Slots held for reservations, they count as sessions for other users
+	ReservedSlots int  `json:"reserved_slots,omitempty"`
+	Saturated     bool `json:"saturated"`
+}
+
+// GPU is the usage of a GPU reported by nvidia-smi
+type GPU struct {
+	Index           int     `json:"index"`
+	Name            string  `json:"name"`
+	Utilization     float64 `json:"utilization"`
+	MemoryTotal     uint64  `json:"memory_total"`
+	MemoryUsed      uint64  `json:"memory_used"`
+	EncoderSessions int     `json:"encoder_sessions"`
+}
+
+// MemoryPercent returns used memory in percent
+func (r Report) MemoryPercent() float64 {
+	if r.MemoryTotal == 0 {
+		return 0
+	}
+	return float64(r.MemoryUsed) * 100 / float64(r.MemoryTotal)
+}
+
+// IsSaturated returns if a new session would degrade the existing ones
+func (r Report) IsSaturated(limits config.CapacityConfig) bool {
+	return (limits.MaxSessions > 0 && r.Sessions+r.ReservedSlots >= limits.MaxSessions) ||
+		r.CPU >= limits.MaxCPU ||
+		r.MemoryPercent() >= limits.MaxMemory ||
+		(r.EncoderSlots > 0 && r.EncoderSlotsUsed >= r.EncoderSlots)
+}
+
+// Collector reads resource usage from /proc and nvidia-smi. Other platforms report zero usage
+type Collector struct {
+	mu           sync.Mutex
+	limits       config.CapacityConfig
+	prevIdle     uint64
+	prevTotal    uint64
+	hasNvidiaSMI bool
+}
+
+// NewCollector returns a collector for the limits
+func NewCollector(limits config.CapacityConfig) *Collector {
+	_, err := exec.LookPath("nvidia-smi")
+	c := &Collector{limits: limits, hasNvidiaSMI: err == nil}
+	c.cpu()
+	return c
+}
+
+// Collect returns the current capacity with the number of sessions on the worker
+func (c *Collector) Collect(sessions int) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := Report{
+		CPU:         c.cpu(),
+		Sessions:    sessions,
+		MaxSessions: c.limits.MaxSessions,
+	}
+	r.MemoryTotal, r.MemoryUsed = memory()
+	if c.hasNvidiaSMI {
+		r.GPUs = gpus()
+	}
+	if c.limits.EncoderSlotsPerGPU > 0 {
+		r.EncoderSlots = c.limits.EncoderSlotsPerGPU * len(r.GPUs)
+		for _, gpu := range r.GPUs {
+			r.EncoderSlotsUsed += gpu.EncoderSessions
+		}
+	}
+	r.Saturated = r.IsSaturated(c.limits)
+	return r
+}
+
+// CPU returns the CPU usage in percent since the previous sample
+func (c *Collector) CPU() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cpu()
+}
+
+// cpu returns the CPU usage since the previous call from /proc/stat
+func (c *Collector) cpu() float64 {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0
+	}
+	// cpu user nice system idle iowait irq softirq steal
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0
+	}
+	var idle, total uint64
+	for i, field := range fields[1:] {
+		v, _ := strconv.ParseUint(field, 10, 64)
+		total += v
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	deltaIdle, deltaTotal := idle-c.prevIdle, total-c.prevTotal
+	c.prevIdle, c.prevTotal = idle, total
+	if deltaTotal == 0 {
+		return 0
+	}
+	return float64(deltaTotal-deltaIdle) * 100 / float64(deltaTotal)
+}
+
+// memory returns total and used memory from /proc/meminfo
+func memory() (uint64, uint64) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	var total, available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = v * 1024
+		case "MemAvailable:":
+			available = v * 1024
+		}
+	}
+	return total, total - available
+}
+
+func gpus() []GPU {
+	out, err := exec.Command("nvidia-smi",
+		"--query-gpu=index,name,utilization.gpu,memory.total,memory.used,encoder.stats.sessionCount",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil
+	}
+
+	var list []GPU
+	for _, line := range bytes.Split(bytes.TrimSpace(out), []byte("\n")) {
+		fields := strings.Split(string(line), ",")
+		if len(fields) != 6 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		gpu := GPU{Name: fields[1]}
+		gpu.Index, _ = strconv.Atoi(fields[0])
+		gpu.Utilization, _ = strconv.ParseFloat(fields[2], 64)
+		// nvidia-smi reports memory in MiB
+		memTotal, _ := strconv.ParseUint(fields[3], 10, 64)
+		memUsed, _ := strconv.ParseUint(fields[4], 10, 64)
+		gpu.MemoryTotal, gpu.MemoryUsed = memTotal<<20, memUsed<<20
+		gpu.EncoderSessions, _ = strconv.Atoi(fields[5])
+		list = append(list, gpu)
+	}
+	return list
+}
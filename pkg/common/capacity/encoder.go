@@ -0,0 +1,26 @@
+package capacity
+
+import "os/exec"
+
+// GPUs returns the usage of NVIDIA GPUs, nil when nvidia-smi isn't available
+func GPUs() []GPU {
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return nil
+	}
+	return gpus()
+}
+
+// FreeGPU returns the GPU with the most free encoder slots. It's false when every slot is taken
+func FreeGPU(gpus []GPU, slotsPerGPU int) (GPU, bool) {
+	var best GPU
+	found := false
+	for _, gpu := range gpus {
+		if slotsPerGPU > 0 && gpu.EncoderSessions >= slotsPerGPU {
+			continue
+		}
+		if !found || gpu.EncoderSessions < best.EncoderSessions {
+			best, found = gpu, true
+		}
+	}
+	return best, found
+}
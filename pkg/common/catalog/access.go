@@ -0,0 +1,26 @@
+package catalog
+
+// Audience is who lists or launches apps, from a signed user token
+type Audience struct {
+	Age   int      `json:"age,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// ContentControls restrict who can see and launch an app on shared community servers
+type ContentControls struct {
+	// Minimum age of users, e.g. 18. 0 is for everyone
+	AgeRating int `yaml:"ageRating" json:"age_rating,omitempty"`
+	// Role users need, e.g. member. Empty is for everyone
+	RequiredRole string `yaml:"requiredRole" json:"required_role,omitempty"`
+}
+
+// Allows reports if the audience can see and launch the app. Users of unknown age only see unrated apps
+func (c ContentControls) Allows(a Audience) bool {
+	if c.AgeRating > 0 && a.Age < c.AgeRating {
+		return false
+	}
+	if c.RequiredRole != "" && !contains(a.Roles, c.RequiredRole) {
+		return false
+	}
+	return true
+}
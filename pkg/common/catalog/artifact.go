@@ -0,0 +1,225 @@
+package catalog
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ArtifactZip = "zip"
+	// ArtifactExe is a portable executable copied as the app file
+	ArtifactExe = "exe"
+)
+
+// Artifact is an app package downloaded from object storage on first launch
+type Artifact struct {
+	// HTTP(S) URL or s3://bucket/key of a public object. Use a presigned HTTPS URL for private buckets
+	URL    string `yaml:"url" json:"url"`
+	SHA256 string `yaml:"sha256" json:"sha256"`
+	// zip or exe. Default: zip
+	Type string `yaml:"type" json:"type,omitempty"`
+}
+
+var downloadClient = &http.Client{Timeout: 30 * time.Minute}
+
+// extractMu serializes extractions, the instances of rooms prepare the same app at once
+var extractMu sync.Mutex
+
+// Prepare downloads the artifact into the cache unless it's cached, and extracts it into appsDir/name.
+// Extraction is skipped when the same artifact is already there, concurrent calls extract it once.
+// It returns the app directory
+func (a Artifact) Prepare(cacheDir string, appsDir string, name string) (string, error) {
+	if a.SHA256 == "" {
+		return "", fmt.Errorf("artifact %s has no sha256", a.URL)
+	}
+	sum := strings.ToLower(a.SHA256)
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	cached := filepath.Join(cacheDir, sum)
+	if err := verify(cached, sum); err != nil {
+		log.Println("Artifact: download", a.URL)
+		if err := download(a.downloadURL(), cached, sum); err != nil {
+			return "", err
+		}
+	} else {
+		log.Println("Artifact: use cached", cached)
+	}
+
+	dest := filepath.Join(appsDir, sanitize(name))
+	marker := filepath.Join(dest, ".artifact-"+sum)
+	extractMu.Lock()
+	defer extractMu.Unlock()
+	if _, err := os.Stat(marker); err == nil {
+		return dest, nil
+	}
+	// The artifact is extracted next to the app directory and replaces it complete
+	if err := os.MkdirAll(appsDir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(appsDir, ".extract-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	switch a.Type {
+	case "", ArtifactZip:
+		err = unzip(cached, tmp)
+	case ArtifactExe:
+		err = copyFile(cached, filepath.Join(tmp, path.Base(a.URL)))
+	default:
+		err = fmt.Errorf("unknown artifact type %s", a.Type)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, ".artifact-"+sum), []byte(a.URL), 0644); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", err
+	}
+	log.Println("Artifact: extracted", a.URL, "into", dest)
+	return dest, nil
+}
+
+func (a Artifact) downloadURL() string {
+	if strings.HasPrefix(a.URL, "s3://") {
+		bucketKey := strings.SplitN(strings.TrimPrefix(a.URL, "s3://"), "/", 2)
+		if len(bucketKey) == 2 {
+			return "https://" + bucketKey[0] + ".s3.amazonaws.com/" + bucketKey[1]
+		}
+	}
+	return a.URL
+}
+
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '.' || r == ' ' {
+			return '-'
+		}
+		return r
+	}, name)
+}
+
+func verify(file string, sum string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != sum {
+		return fmt.Errorf("checksum mismatch of %s", file)
+	}
+	return nil
+}
+
+// download writes the url to file after its checksum is verified
+func download(url string, file string, sum string) error {
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", url, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != sum {
+		return fmt.Errorf("download %s: checksum mismatch, got %s", url, got)
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func unzip(src string, dest string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		target := filepath.Join(dest, f.Name)
+		// Guard against zip slip
+		if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal file path %s in artifact", f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := extractFile(f, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode()|0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,59 @@
+package catalog
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestPrepareConcurrently checks instances preparing the same app at once all get the complete app directory
+func TestPrepareConcurrently(t *testing.T) {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	f, _ := w.Create("app/game.exe")
+	f.Write([]byte("game"))
+	w.Close()
+	sum := sha256.Sum256(archive.Bytes())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive.Bytes())
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := Artifact{URL: srv.URL + "/game.zip", SHA256: hex.EncodeToString(sum[:])}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dest, err := a.Prepare(filepath.Join(dir, "cache"), filepath.Join(dir, "apps"), "game")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(dest, "app", "game.exe")); err != nil || string(data) != "game" {
+				t.Errorf("app file is %q, %v", data, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if entries, _ := ioutil.ReadDir(filepath.Join(dir, "apps")); len(entries) != 1 {
+		t.Fatalf("%d entries in the apps directory, want the app directory only", len(entries))
+	}
+
+	if _, err := (Artifact{URL: srv.URL + "/game.zip", SHA256: "00"}).Prepare(filepath.Join(dir, "cache"), filepath.Join(dir, "apps"), "other"); err == nil {
+		t.Fatal("artifact with a wrong checksum is prepared")
+	}
+}
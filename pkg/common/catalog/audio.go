@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Audio configures the Opus encoder of the app VM, e.g. 128 kbps stereo for music-heavy apps, 24 kbps mono for utilities
+type Audio struct {
+	// Bitrate in kbps, 6 to 510
+	Bitrate int `yaml:"bitrate" json:"bitrate"`
+	// Channels is 1 for mono or 2 for stereo
+	Channels int `yaml:"channels" json:"channels"`
+	// DTX sends almost nothing while the app is silent
+	DTX bool `yaml:"dtx" json:"dtx"`
+	// FEC adds in-band forward error correction, a lost packet is recovered from the next one
+	FEC bool `yaml:"fec" json:"fec"`
+	// Filters applied to the captured audio before it's encoded
+	Filters AudioFilters `yaml:"filters" json:"filters"`
+}
+
+// AudioFilters make quiet or clipping apps listenable
+type AudioFilters struct {
+	// Normalize evens the loudness out. It delays the audio by about 150 ms, avSyncOffset can make up for it
+	Normalize bool `yaml:"normalize" json:"normalize"`
+	// Gate mutes noise below the threshold in dBFS, e.g. -50. 0 is off
+	Gate float64 `yaml:"gate" json:"gate,omitempty"`
+	// Limit keeps peaks below the ceiling in dBFS, e.g. -1. 0 is off
+	Limit float64 `yaml:"limit" json:"limit,omitempty"`
+}
+
+// filterGraph returns the ffmpeg audio filters, empty without filters. The gate goes first,
+// so normalization doesn't raise the noise, and the limiter last
+func (f AudioFilters) filterGraph() string {
+	var filters []string
+	if f.Gate != 0 {
+		filters = append(filters, fmt.Sprintf("agate=threshold=%gdB", f.Gate))
+	}
+	if f.Normalize {
+		filters = append(filters, "dynaudnorm=f=100:g=3")
+	}
+	if f.Limit != 0 {
+		filters = append(filters, fmt.Sprintf("alimiter=limit=%gdB:level=false", f.Limit))
+	}
+	return strings.Join(filters, ",")
+}
+
+// Validate returns an error if the encoder can't run with the settings, zero values are defaults
+func (a Audio) Validate() error {
+	if a.Bitrate != 0 && (a.Bitrate < 6 || a.Bitrate > 510) {
+		return fmt.Errorf("audio bitrate %d is not within 6-510 kbps", a.Bitrate)
+	}
+	if a.Channels < 0 || a.Channels > 2 {
+		return fmt.Errorf("audio channels %d is not 1 (mono) or 2 (stereo)", a.Channels)
+	}
+	if a.Filters.Gate < -90 || a.Filters.Gate > 0 {
+		return fmt.Errorf("audio gate %g is not within -90-0 dBFS", a.Filters.Gate)
+	}
+	if a.Filters.Limit < -24 || a.Filters.Limit > 0 {
+		return fmt.Errorf("audio limit %g is not within -24-0 dBFS", a.Filters.Limit)
+	}
+	return nil
+}
+
+// EncoderOptions returns the ffmpeg libopus options of the settings
+func (a Audio) EncoderOptions() string {
+	options := fmt.Sprintf("-b:a %dk -ac %d", a.Bitrate, a.Channels)
+	if graph := a.Filters.filterGraph(); graph != "" {
+		options += " -af " + graph
+	}
+	if a.DTX {
+		options += " -dtx 1"
+	}
+	if a.FEC {
+		// libopus only adds FEC when it expects loss
+		options += " -fec 1 -packet_loss 10"
+	}
+	return options
+}
@@ -0,0 +1,297 @@
+// Package catalog loads per-app manifests from a directory and keeps them in sync at runtime
+package catalog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/secret"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	InputProfileApp  = "app"
+	InputProfileGame = "game"
+	// InputProfileScancode sends raw scan codes for games reading DirectInput, which ignore virtual keys
+	InputProfileScancode = "scancode"
+)
+
+// Reset policies run when the last user leaves a shared instance
+const (
+	ResetNone = "none"
+	// ResetRestart restarts the app, the Wine prefix with documents and logins is kept
+	ResetRestart = "restart"
+	// ResetSnapshot restores the pristine snapshot of the Wine prefix and restarts the app
+	ResetSnapshot = "snapshot"
+)
+
+// InputBackends an app can choose, see cloudapp.InputInjector
+var InputBackends = []string{"syncinput", "xdotool", "sendinput"}
+
+// Manifest describes an app of the catalog, one YAML file per app in apps.d/
+type Manifest struct {
+	Name string `yaml:"name" json:"name"`
+	// Docker image of the app VM. Default: syncwine built from winvm
+	Image   string `yaml:"image" json:"image,omitempty"`
+	Path    string `yaml:"path" json:"path"`
+	AppFile string `yaml:"appFile" json:"app_file"`
+	// Substring of the window title to help WinAPI search the app
+	WindowTitle string `yaml:"windowTitle" json:"window_title"`
+	PageTitle   string `yaml:"pageTitle" json:"page_title,omitempty"`
+	// Description, category and tags shown in the lobby, e.g. games with tags puzzle, multiplayer
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Category    string   `yaml:"category" json:"category,omitempty"`
+	Tags        []string `yaml:"tags" json:"tags,omitempty"`
+	// app, game or scancode. Games using DirectX need hardware keys, DirectInput games need raw scan codes
+	InputProfile string `yaml:"inputProfile" json:"input_profile"`
+	// Optional input backend overriding the worker's, e.g. xdotool for apps which miss the events of syncinput
+	InputBackend string `yaml:"inputBackend" json:"input_backend,omitempty"`
+	// x264 preset of the software encoder, e.g. ultrafast, veryfast
+	EncoderPreset string `yaml:"encoderPreset" json:"encoder_preset,omitempty"`
+	// Optional Opus settings replacing the worker's
+	Audio *Audio `yaml:"audio" json:"audio,omitempty"`
+	// Optional package downloaded and extracted into the apps directory on first launch
+	Artifact *Artifact `yaml:"artifact" json:"artifact,omitempty"`
+	// Optional winetricks verbs, registry tweaks and DLL overrides for a new Wine prefix
+	Provision *Provision `yaml:"provision" json:"provision,omitempty"`
+	// Icon URL or path relative to the manifest directory
+	Icon         string `yaml:"icon" json:"icon,omitempty"`
+	ScreenWidth  int    `yaml:"screenWidth" json:"screen_width,omitempty"`
+	ScreenHeight int    `yaml:"screenHeight" json:"screen_height,omitempty"`
+	// Optional crop region and letterboxing of the stream
+	Capture *CaptureGeometry `yaml:"capture" json:"capture,omitempty"`
+	// Reset policy when the last user leaves: none, restart or snapshot
+	Reset string `yaml:"reset" json:"reset,omitempty"`
+	// Optional degradation of spectators as they pile up, replacing the one of the worker
+	Viewers *ViewerPolicy `yaml:"viewers" json:"viewers,omitempty"`
+	// Optional logo and watermark composited into the stream, replacing the one of the worker
+	Overlay *Overlay `yaml:"overlay" json:"-"`
+	// Secrets by environment variable name, e.g. license keys, see secret.Ref. They are never listed
+	Secrets map[string]secret.Ref `yaml:"secrets" json:"-"`
+	// Age rating and required role of users, enforced in the lobby and when a session starts
+	ContentControls `yaml:",inline"`
+	// File is the manifest file the app is loaded from
+	File string `yaml:"-" json:"-"`
+}
+
+func (m Manifest) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if m.AppFile == "" {
+		return fmt.Errorf("appFile is required")
+	}
+	if m.Artifact != nil && (m.Artifact.URL == "" || m.Artifact.SHA256 == "") {
+		return fmt.Errorf("artifact needs url and sha256")
+	}
+	if m.Provision != nil {
+		if err := m.Provision.validate(); err != nil {
+			return err
+		}
+	}
+	switch m.InputProfile {
+	case "", InputProfileApp, InputProfileGame, InputProfileScancode:
+	default:
+		return fmt.Errorf("unknown inputProfile %s", m.InputProfile)
+	}
+	if m.InputBackend != "" && !contains(InputBackends, m.InputBackend) {
+		return fmt.Errorf("unknown inputBackend %s", m.InputBackend)
+	}
+	switch m.Reset {
+	case "", ResetNone, ResetRestart, ResetSnapshot:
+	default:
+		return fmt.Errorf("unknown reset %s", m.Reset)
+	}
+	if err := secret.Validate(m.Secrets); err != nil {
+		return err
+	}
+	if m.AgeRating < 0 {
+		return fmt.Errorf("wrong ageRating %d", m.AgeRating)
+	}
+	if m.Audio != nil {
+		if err := m.Audio.Validate(); err != nil {
+			return err
+		}
+	}
+	if m.Viewers != nil {
+		if err := m.Viewers.Validate(); err != nil {
+			return err
+		}
+	}
+	if m.Capture != nil {
+		return m.Capture.Validate()
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Catalog is the set of apps in a manifest directory
+type Catalog struct {
+	dir string
+
+	mu       sync.RWMutex
+	apps     map[string]Manifest
+	modTime  map[string]time.Time
+	onChange []func(added []Manifest, removed []string)
+}
+
+// New returns the catalog of the manifest directory
+func New(dir string) *Catalog {
+	c := &Catalog{
+		dir:     dir,
+		apps:    map[string]Manifest{},
+		modTime: map[string]time.Time{},
+	}
+	c.sync()
+	return c
+}
+
+// Get returns the app by name
+func (c *Catalog) Get(name string) (Manifest, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.apps[name]
+	return m, ok
+}
+
+// List returns apps sorted by name
+func (c *Catalog) List() []Manifest {
+	c.mu.RLock()
+	list := make([]Manifest, 0, len(c.apps))
+	for _, m := range c.apps {
+		list = append(list, m)
+	}
+	c.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Dir returns the manifest directory
+func (c *Catalog) Dir() string {
+	return c.dir
+}
+
+// OnChange registers a hook called with added or updated apps and removed app names
+func (c *Catalog) OnChange(hook func(added []Manifest, removed []string)) {
+	c.mu.Lock()
+	c.onChange = append(c.onChange, hook)
+	c.mu.Unlock()
+}
+
+// Watch polls the directory and adds, updates or removes apps as their manifests change
+func (c *Catalog) Watch(interval time.Duration) {
+	crash.Go("catalog watch", func() {
+		for range time.Tick(interval) {
+			c.sync()
+		}
+	})
+}
+
+// sync reloads changed manifests of the directory
+func (c *Catalog) sync() {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.y*ml"))
+	if err != nil {
+		log.Println("Catalog:", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	var added []Manifest
+	var removed []string
+	c.mu.Lock()
+	for _, file := range files {
+		if ext := filepath.Ext(file); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		seen[file] = true
+		if t, ok := c.modTime[file]; ok && t.Equal(info.ModTime()) {
+			continue
+		}
+		c.modTime[file] = info.ModTime()
+
+		m, err := load(file)
+		if err != nil {
+			log.Println("Catalog: skip", file, err)
+			continue
+		}
+		if other, ok := c.apps[m.Name]; ok && other.File != file {
+			log.Println("Catalog: skip", file, "duplicated app", m.Name, "in", other.File)
+			continue
+		}
+		// The app can be renamed in the same manifest
+		for name, app := range c.apps {
+			if app.File == file && name != m.Name {
+				delete(c.apps, name)
+				removed = append(removed, name)
+			}
+		}
+		c.apps[m.Name] = m
+		added = append(added, m)
+	}
+	for file := range c.modTime {
+		if seen[file] {
+			continue
+		}
+		delete(c.modTime, file)
+		for name, app := range c.apps {
+			if app.File == file {
+				delete(c.apps, name)
+				removed = append(removed, name)
+			}
+		}
+	}
+	hooks := c.onChange
+	c.mu.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	for _, m := range added {
+		log.Println("Catalog: loaded app", m.Name, "from", m.File)
+	}
+	if len(removed) > 0 {
+		log.Println("Catalog: removed apps", strings.Join(removed, ", "))
+	}
+	for _, hook := range hooks {
+		hook(added, removed)
+	}
+}
+
+func load(file string) (Manifest, error) {
+	var m Manifest
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return m, err
+	}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return m, err
+	}
+	if err := m.validate(); err != nil {
+		return m, err
+	}
+	if m.InputProfile == "" {
+		m.InputProfile = InputProfileApp
+	}
+	m.File = file
+	return m, nil
+}
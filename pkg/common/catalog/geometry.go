@@ -0,0 +1,26 @@
+package catalog
+
+import "fmt"
+
+// CaptureGeometry is the part of the app VM display streamed, for apps rendering in odd window sizes
+type CaptureGeometry struct {
+	// Crop region on the display. A zero width or height is the app screen
+	X      int `yaml:"x" json:"x"`
+	Y      int `yaml:"y" json:"y"`
+	Width  int `yaml:"width" json:"width"`
+	Height int `yaml:"height" json:"height"`
+	// The region is scaled into the output size keeping its aspect ratio, with black bars. 0 streams the region as is
+	OutputWidth  int `yaml:"outputWidth" json:"output_width"`
+	OutputHeight int `yaml:"outputHeight" json:"output_height"`
+}
+
+// Validate checks the geometry is not negative and the output has both sides or none
+func (g CaptureGeometry) Validate() error {
+	if g.X < 0 || g.Y < 0 || g.Width < 0 || g.Height < 0 {
+		return fmt.Errorf("negative capture region %dx%d+%d+%d", g.Width, g.Height, g.X, g.Y)
+	}
+	if g.OutputWidth < 0 || g.OutputHeight < 0 || (g.OutputWidth == 0) != (g.OutputHeight == 0) {
+		return fmt.Errorf("wrong capture output %dx%d", g.OutputWidth, g.OutputHeight)
+	}
+	return nil
+}
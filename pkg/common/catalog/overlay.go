@@ -0,0 +1,61 @@
+package catalog
+
+import "path/filepath"
+
+// Overlay is composited into the video before encoding, for branding and against leaks
+type Overlay struct {
+	// Logo is a PNG drawn in the top right corner, a path relative to the manifest directory in manifests
+	Logo string `yaml:"logo" json:"logo,omitempty"`
+	// Text drawn in the bottom left corner, e.g. DEMO. {user} is replaced with the name of the player, {timer} with the session time
+	Text string `yaml:"text" json:"text,omitempty"`
+	// Roles replace the overlay for players with the role, e.g. no watermark for members. The first matching entry wins
+	Roles []RoleOverlay `yaml:"roles" json:"roles,omitempty"`
+}
+
+// RoleOverlay is the overlay of players with the role
+type RoleOverlay struct {
+	Role string `yaml:"role" json:"role"`
+	Logo string `yaml:"logo" json:"logo,omitempty"`
+	Text string `yaml:"text" json:"text,omitempty"`
+}
+
+// Enabled reports if anything is drawn for some player
+func (o Overlay) Enabled() bool {
+	if o.Logo != "" || o.Text != "" {
+		return true
+	}
+	for _, r := range o.Roles {
+		if r.Logo != "" || r.Text != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// For returns the logo and text of a player with the roles
+func (o Overlay) For(roles []string) (logo string, text string) {
+	for _, r := range o.Roles {
+		if contains(roles, r.Role) {
+			return r.Logo, r.Text
+		}
+	}
+	return o.Logo, o.Text
+}
+
+// Resolve returns the overlay with logo paths relative to dir made absolute
+func (o Overlay) Resolve(dir string) Overlay {
+	resolve := func(logo string) string {
+		if logo == "" || filepath.IsAbs(logo) {
+			return logo
+		}
+		return filepath.Join(dir, logo)
+	}
+	resolved := o
+	resolved.Logo = resolve(o.Logo)
+	resolved.Roles = make([]RoleOverlay, len(o.Roles))
+	for i, r := range o.Roles {
+		r.Logo = resolve(r.Logo)
+		resolved.Roles[i] = r
+	}
+	return resolved
+}
@@ -0,0 +1,74 @@
+package catalog
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Provision are steps run once when the Wine prefix of an instance is first created
+type Provision struct {
+	// winetricks verbs, e.g. vcrun2019, corefonts, dotnet48
+	Winetricks []string        `yaml:"winetricks" json:"winetricks,omitempty"`
+	Registry   []RegistryValue `yaml:"registry" json:"registry,omitempty"`
+	// DLL overrides by DLL name, e.g. d3d9: native,builtin
+	DLLOverrides map[string]string `yaml:"dllOverrides" json:"dll_overrides,omitempty"`
+}
+
+// RegistryValue is a registry tweak applied with wine reg add
+type RegistryValue struct {
+	Key  string `yaml:"key" json:"key"`
+	Name string `yaml:"name" json:"name"`
+	// REG_SZ, REG_DWORD... Default: REG_SZ
+	Type  string `yaml:"type" json:"type,omitempty"`
+	Value string `yaml:"value" json:"value"`
+}
+
+const dllOverridesKey = `HKEY_CURRENT_USER\Software\Wine\DllOverrides`
+
+var verbPattern = regexp.MustCompile(`^[A-Za-z0-9_.=-]+$`)
+
+func (p Provision) validate() error {
+	for _, verb := range p.Winetricks {
+		if !verbPattern.MatchString(verb) {
+			return fmt.Errorf("invalid winetricks verb %q", verb)
+		}
+	}
+	for _, v := range p.Registry {
+		if v.Key == "" {
+			return fmt.Errorf("registry value needs a key")
+		}
+	}
+	return nil
+}
+
+// Script returns the shell script running the provisioning steps in the app VM
+func (p Provision) Script() string {
+	var b strings.Builder
+	b.WriteString("#!/usr/bin/env bash\nset -e\n")
+	if len(p.Winetricks) > 0 {
+		fmt.Fprintf(&b, "winetricks -q %s\n", strings.Join(p.Winetricks, " "))
+	}
+	for _, v := range p.Registry {
+		regType := v.Type
+		if regType == "" {
+			regType = "REG_SZ"
+		}
+		fmt.Fprintf(&b, "wine reg add %s /v %s /t %s /d %s /f\n", quote(v.Key), quote(v.Name), quote(regType), quote(v.Value))
+	}
+	dlls := make([]string, 0, len(p.DLLOverrides))
+	for dll := range p.DLLOverrides {
+		dlls = append(dlls, dll)
+	}
+	sort.Strings(dlls)
+	for _, dll := range dlls {
+		fmt.Fprintf(&b, "wine reg add %s /v %s /d %s /f\n", quote(dllOverridesKey), quote(dll), quote(p.DLLOverrides[dll]))
+	}
+	return b.String()
+}
+
+// quote returns s as a single-quoted shell word
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
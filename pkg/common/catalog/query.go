@@ -0,0 +1,40 @@
+package catalog
+
+import "strings"
+
+// Query filters apps of the catalog, empty fields match every app
+type Query struct {
+	// Text is a case-insensitive substring of the name or page title
+	Text     string
+	Category string
+	// Tags the app must all have
+	Tags []string
+}
+
+// Matches reports if the app matches the query
+func (q Query) Matches(m Manifest) bool {
+	if q.Text != "" {
+		text := strings.ToLower(q.Text)
+		if !strings.Contains(strings.ToLower(m.Name), text) && !strings.Contains(strings.ToLower(m.PageTitle), text) {
+			return false
+		}
+	}
+	if q.Category != "" && !strings.EqualFold(q.Category, m.Category) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !containsFold(m.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, v string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
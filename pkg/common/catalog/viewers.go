@@ -0,0 +1,24 @@
+package catalog
+
+import "fmt"
+
+// ViewerPolicy protects the player of an instance as spectators of view links pile up. Counts are of the spectators
+// the worker streams to, viewers of the SFU cost it nothing. 0 turns a step off
+type ViewerPolicy struct {
+	// Above this many spectators, their streams are thinned like on a congested link, non-reference frames first.
+	// The player keeps the full frame rate
+	ReduceFPSAbove int `yaml:"reduceFPSAbove" json:"reduce_fps_above,omitempty"`
+	// Spectators with a peer connection of the worker, later ones watch the fragmented MP4 stream over websocket
+	MaxDirect int `yaml:"maxDirect" json:"max_direct,omitempty"`
+}
+
+// Validate returns an error for negative counts
+func (p ViewerPolicy) Validate() error {
+	if p.ReduceFPSAbove < 0 {
+		return fmt.Errorf("viewers reduceFPSAbove %d is negative", p.ReduceFPSAbove)
+	}
+	if p.MaxDirect < 0 {
+		return fmt.Errorf("viewers maxDirect %d is negative", p.MaxDirect)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Package chaos degrades outgoing traffic on purpose, so adaptive bitrate, FEC and reconnections can be tested
+// without a bad network. It's for development, workers enable it with the chaos config
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+const (
+	// queueSize is the number of delayed sends of a link, later ones are lost
+	queueSize = 4096
+	// retransmitTimeout delays lost packets of reliable links, TCP resends them instead of losing them
+	retransmitTimeout = 200 * time.Millisecond
+)
+
+// Impairment is the loss, latency and jitter added to a path
+type Impairment struct {
+	// Loss of packets in percent
+	Loss float64 `json:"loss"`
+	// Latency added to packets in ms
+	Latency int `json:"latency"`
+	// Jitter is the maximum deviation from the latency in ms
+	Jitter int `json:"jitter"`
+}
+
+// Validate returns an error for values out of range
+func (i Impairment) Validate() error {
+	if i.Loss < 0 || i.Loss > 100 {
+		return fmt.Errorf("chaos: loss %v is not a percentage", i.Loss)
+	}
+	if i.Latency < 0 || i.Jitter < 0 {
+		return fmt.Errorf("chaos: latency %d and jitter %d must not be negative", i.Latency, i.Jitter)
+	}
+	return nil
+}
+
+// lost draws whether a packet is lost
+func (i Impairment) lost() bool {
+	return i.Loss > 0 && rand.Float64()*100 < i.Loss
+}
+
+// delay draws the delay of a packet
+func (i Impairment) delay() time.Duration {
+	ms := i.Latency
+	if i.Jitter > 0 {
+		ms += rand.Intn(2*i.Jitter+1) - i.Jitter
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+type delayed struct {
+	due  time.Time
+	send func()
+}
+
+// Link impairs a path, sends pass through until an impairment is set. Delayed sends keep their order,
+// a packet due earlier than the one before waits for it
+type Link struct {
+	reliable   bool
+	impairment atomic.Value
+
+	once      sync.Once
+	queue     chan delayed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLink returns a link. Lost sends of a reliable link, e.g. a websocket over TCP, are delayed by a retransmission instead
+func NewLink(reliable bool) *Link {
+	l := &Link{reliable: reliable, queue: make(chan delayed, queueSize), done: make(chan struct{})}
+	l.impairment.Store(Impairment{})
+	return l
+}
+
+// Set changes the impairment of the link, the zero value turns it off
+func (l *Link) Set(i Impairment) {
+	l.impairment.Store(i)
+}
+
+// Impairment returns the impairment of the link
+func (l *Link) Impairment() Impairment {
+	return l.impairment.Load().(Impairment)
+}
+
+// Send runs send now, later or never by the impairment
+func (l *Link) Send(send func()) {
+	i := l.Impairment()
+	d := i.delay()
+	if i.lost() {
+		if !l.reliable {
+			return
+		}
+		d += retransmitTimeout
+	}
+	if d == 0 && len(l.queue) == 0 {
+		send()
+		return
+	}
+	l.once.Do(func() { crash.Go("chaos link", l.run) })
+	select {
+	case l.queue <- delayed{due: time.Now().Add(d), send: send}:
+	default:
+	}
+}
+
+func (l *Link) run() {
+	for {
+		select {
+		case <-l.done:
+			return
+		case p := <-l.queue:
+			if wait := time.Until(p.due); wait > 0 {
+				select {
+				case <-l.done:
+					return
+				case <-time.After(wait):
+				}
+			}
+			p.send()
+		}
+	}
+}
+
+// Close drops the delayed sends
+func (l *Link) Close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
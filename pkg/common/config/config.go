@@ -5,13 +5,30 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"path/filepath"
+	"strings"
 
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/secret"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
+	// App manifest directory, apps are added and removed at runtime. Default: apps.d
+	AppsDir string `yaml:"appsDir"`
+	// Optional app of the manifest directory to run, its manifest overrides the app fields below
+	App     string `yaml:"app"`
 	Path    string `yaml:"path"`
 	AppFile string `yaml:"appFile"`
+	// Docker image of the app VM. Default: syncwine
+	Image string `yaml:"image"`
+	// Optional app package downloaded on first launch, see catalog.Artifact
+	Artifact *catalog.Artifact `yaml:"artifact"`
+	// Optional steps run once when the Wine prefix is first created, see catalog.Provision
+	Provision *catalog.Provision `yaml:"provision"`
+	// Cache directory of downloaded artifacts. Default: cache/artifacts
+	ArtifactCache string `yaml:"artifactCache"`
 	// To help WinAPI search the app
 	WindowTitle  string `yaml:"windowTitle"`
 	HWKey        bool   `yaml:"hardwareKey"`
@@ -20,20 +37,698 @@ type Config struct {
 	ScreenWidth  int    `yaml:"screenWidth"`  // Default: 800
 	ScreenHeight int    `yaml:"screenHeight"` // Default: 600
 	IsWindowMode *bool  `yaml:"isWindowMode"`
+	// Age rating and required role of users of the app, see catalog.ContentControls. App manifests override them
+	catalog.ContentControls `yaml:",inline"`
+	// Instances of the app allowed in discovery and players per instance. 0 is unlimited
+	MaxInstances          int `yaml:"maxInstances"`
+	MaxPlayersPerInstance int `yaml:"maxPlayersPerInstance"`
+	// Input coalescing frequency (Hz). Mouse moves within a tick are merged. 0 disables it
+	InputTickRate int `yaml:"inputTickRate"`
+	// Input backend: syncinput, xdotool or sendinput. Default: syncinput. App manifests can override it
+	InputBackend string `yaml:"inputBackend"`
+	// Scancodes injects keys as raw scan codes mapped from browser key codes. Set by the scancode input profile
+	Scancodes bool `yaml:"scancodes"`
+	// Named input sequences clients run with a MACRO packet, e.g. to open a menu or to log in.
+	// Macros run on the worker, typed text like credentials is never sent to clients
+	Macros map[string][]MacroStep `yaml:"macros"`
+	// Secrets of the app by environment variable name, e.g. license keys or logins, see secret.Ref.
+	// They are set in the app environment and expanded in text macros. App manifests add to them
+	Secrets map[string]secret.Ref `yaml:"secrets"`
+	// Vault server of vault secrets
+	Vault secret.VaultConfig `yaml:"vault"`
+	// Crop region and letterboxing of the stream, see catalog.CaptureGeometry. App manifests override it
+	Capture catalog.CaptureGeometry `yaml:"capture"`
+	// Logo and watermark composited into the stream, per role of the player. App manifests override it
+	Overlay catalog.Overlay `yaml:"overlay"`
+	// WindowCapture is what the stream shows at start: screen, app window, focused or all windows. Clients switch it.
+	// Default: screen, app with hideDesktop
+	WindowCapture string `yaml:"windowCapture"`
+	// HideDesktop blanks the stream while the app window is missing, e.g. during app restarts, and streams
+	// the app window by default instead of the app screen
+	HideDesktop bool `yaml:"hideDesktop"`
+	// AutoRefocus activates the app window whenever no window has the keyboard focus, e.g. after a dialog closed
+	AutoRefocus bool `yaml:"autoRefocus"`
+	// Reset policy when the last user leaves: none, restart the app or restore the pristine snapshot of its Wine prefix.
+	// Default: none, snapshot for kiosks. App manifests override it
+	Reset string `yaml:"reset"`
+	// RecordInput records all input of the app session to dataDir/recordings. Recordings are replayed with the admin API
+	RecordInput bool `yaml:"recordInput"`
+	// RecordSignaling records the WebRTC negotiation of each session to dataDir/signaling, replayed offline with replay-signaling
+	RecordSignaling bool `yaml:"recordSignaling"`
 	// Discovery service
 	DiscoveryHost string `yaml:"discoveryHost"`
-	InstanceAddr  string `yaml:"instanceAddr"`
+	// Registry of the workers in etcd or Consul instead of the discovery service
+	Registry RegistryConfig `yaml:"registry"`
+	// Reconnection of the worker to discovery or the registry after they were unreachable, e.g. restarted
+	Reconnect    ReconnectConfig `yaml:"reconnect"`
+	InstanceAddr string          `yaml:"instanceAddr"`
+	// Relay runs only the lobby and chat, routing users to the Linux workers of discovery without an app of its own,
+	// e.g. on a Windows or macOS machine. The cloud-morph relay command sets it
+	Relay bool `yaml:"relay"`
+	// Media relay of the coordinator for clients which can't reach a worker directly
+	MediaRelay MediaRelayConfig `yaml:"mediaRelay"`
+	// External SFU viewers of view links watch the stream from
+	SFU SFUConfig `yaml:"sfu"`
+	// Degradation of spectators as they pile up, so the player's stream is protected. Apps can replace it
+	Viewers catalog.ViewerPolicy `yaml:"viewers"`
+	// Geography of clients, input RTT is aggregated by region
+	Regions RegionsConfig `yaml:"regions"`
 	// Frontend plugin
-	HasChat   bool   `yaml:"hasChat"`
-	PageTitle string `yaml:"pageTitle"`
+	HasChat   bool       `yaml:"hasChat"`
+	Chat      ChatConfig `yaml:"chat"`
+	PageTitle string     `yaml:"pageTitle"`
+	// Permessage-deflate of websocket packets, e.g. chat history, catalog and stats
+	WSCompression WSCompressionConfig `yaml:"wsCompression"`
+	// Message of the day shown to every client when joining
+	MOTD string `yaml:"motd"`
+	// Directory of translations of messages sent to clients, <locale>.yaml like de.yaml. Default: locales
+	Locales string `yaml:"locales"`
+	// Seconds between the cached app thumbnails shown in the lobby. Default: 30
+	ThumbnailInterval int        `yaml:"thumbnailInterval"`
+	Clips             ClipConfig `yaml:"clips"`
 	// WebRTC config
-	StunTurn   string `yaml:"stunturn"` // Default: Google STUN, disable it with the "none" value
+	StunTurn string `yaml:"stunturn"` // Default: Google STUN, disable it with the "none" value
+	// Video codec: h264 / vpx / av1
 	VideoCodec string `yaml:"videoCodec"`
+	// Codec of the stream while a viewer's browser can't decode videoCodec, e.g. AV1. Default: h264 for av1
+	FallbackCodec string `yaml:"fallbackCodec"`
+	// x264 preset of the software encoder, e.g. ultrafast
+	EncoderPreset string `yaml:"encoderPreset"`
+	// Opus encoder of the app VM, app manifests replace it. Default: 96 kbps stereo
+	Audio catalog.Audio `yaml:"audio"`
+	// Hardware video encoder: nvenc or empty for software encoding. Encoder slots are limited by capacity.encoderSlotsPerGPU
+	HWEncoder string `yaml:"hwEncoder"`
+	// Steady-state video bitrate in kbps. Default: 1500
+	VideoBitrate int `yaml:"videoBitrate"`
+	// New viewers get a keyframe at joinBitrate, boosted for joinRampSeconds. Default: 2x videoBitrate for 3s
+	JoinBitrate     int `yaml:"joinBitrate"`
+	JoinRampSeconds int `yaml:"joinRampSeconds"`
+	// Delay of audio against video in ms for lip-sync, negative to play audio earlier
+	AVSyncOffset int `yaml:"avSyncOffset"`
 	// Virtualization mode: To use in Windows. Linux is already fully virtualized with Docker+Wine
 	IsVirtualized bool `yaml:"virtualize"`
 	// Optional 1:1 NAT mapping
 	NAT1To1IP           string `yaml:"nat1to1ip"`
 	DisableInterceptors bool   `yaml:"disableInterceptors"`
+	// Disable the stats DataChannel feed of the debug HUD, e.g. in production
+	DisableStats bool `yaml:"disableStats"`
+	// Debug only: admins impair the outgoing RTP and websocket of sessions with loss, latency and jitter
+	Chaos  bool         `yaml:"chaos"`
+	WebRTC WebRTCConfig `yaml:"webrtc"`
+	// HTTP server
+	// host:port, unix:/path/to.sock or systemd (systemd:<name>) for a socket activated listener. Default: :8080
+	Addr string    `yaml:"addr"`
+	TLS  TLSConfig `yaml:"tls"`
+	// Mutual TLS between discovery, registries and the nodes of the fleet
+	FleetTLS FleetTLSConfig `yaml:"fleetTLS"`
+	// Reverse proxy in front of the HTTP server, e.g. nginx or Traefik
+	Proxy ProxyConfig `yaml:"proxy"`
+	// Token to access admin/monitoring endpoints
+	AdminToken string `yaml:"adminToken"`
+	// Secret signing view links and other tokens. Random when empty, then links don't survive restarts
+	TokenSecret string           `yaml:"tokenSecret"`
+	Monitoring  MonitoringConfig `yaml:"monitoring"`
+	Analytics   AnalyticsConfig  `yaml:"analytics"`
+	Crash       crash.Config     `yaml:"crash"`
+	Preemption  PreemptionConfig `yaml:"preemption"`
+	Capacity    CapacityConfig   `yaml:"capacity"`
+	LoadShed    LoadShedConfig   `yaml:"loadShed"`
+	// Feature flags of experimental capabilities by name, admins toggle them at runtime
+	Features map[string]FeatureFlag `yaml:"features"`
+	// Directory of persisted state like reservations. Default: data
+	DataDir string `yaml:"dataDir"`
+	// Base URL of join links sent to users. Default: http(s)://instanceAddr
+	PublicURL    string            `yaml:"publicURL"`
+	Reservations ReservationConfig `yaml:"reservations"`
+	Idle         IdleConfig        `yaml:"idle"`
+	// DuplicateSessions decides about a second connection of a player, e.g. another tab of the same user. Default: takeover
+	DuplicateSessions string             `yaml:"duplicateSessions"`
+	Kiosk             KioskConfig        `yaml:"kiosk"`
+	Guests            GuestConfig        `yaml:"guests"`
+	ControlQueue      ControlQueueConfig `yaml:"controlQueue"`
+	Rooms             RoomsConfig        `yaml:"rooms"`
+}
+
+// Window capture targets besides a window ID
+const (
+	// CaptureScreen streams the app screen
+	CaptureScreen = "screen"
+	// CaptureApp follows the window of the app, found by the window title. Nothing else of the display is streamed
+	CaptureApp = "app"
+	// CaptureFocused follows the focused window, e.g. a dialog
+	CaptureFocused = "focused"
+	// CaptureAll streams the bounding box of all windows
+	CaptureAll = "all"
+)
+
+// Video codecs
+const (
+	CodecH264 = "h264"
+	CodecVPX  = "vpx"
+	CodecAV1  = "av1"
+)
+
+// Idle actions
+const (
+	IdleDisconnect = "disconnect"
+	IdleSpectate   = "spectate"
+)
+
+// Policies of a second connection of the same player
+const (
+	// DuplicateDeny refuses the new connection
+	DuplicateDeny = "deny"
+	// DuplicateTakeover closes the old connection, the new one plays
+	DuplicateTakeover = "takeover"
+	// DuplicateSpectate attaches the new connection as spectator without input
+	DuplicateSpectate = "spectate"
+)
+
+// KioskConfig locks the instance down for demo stations and trade shows. Visitors are assigned to the app
+// one at a time at / and /kiosk without chat and lobby, and can't hand control over with view links or admin takeover.
+// The app is reset between visitors with the reset policy
+type KioskConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// IdleConfig detects AFK clients who send no input, so they don't hold scarce app instances
+type IdleConfig struct {
+	// Seconds without input before a client is warned. 0 disables idle detection
+	WarnAfter int `yaml:"warnAfter"`
+	// Seconds without input before the action is taken. Default: warnAfter + 60
+	Timeout int `yaml:"timeout"`
+	// disconnect ends the session and frees its slot, spectate keeps watching without input. Default: disconnect
+	Action string `yaml:"action"`
+}
+
+// ControlQueueConfig hands input of a shared room to one player at a time. Players request control and wait
+// in line, a turn ends after its time, when the player releases control or leaves
+type ControlQueueConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Seconds of a turn. Default: 60
+	Turn int `yaml:"turn"`
+	// Players with the role reorder and freeze the queue like admins. Empty leaves it to admins
+	ModeratorRole string `yaml:"moderatorRole"`
+}
+
+// GuestConfig caps sessions of anonymous users, who join without a user or API token
+type GuestConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Seconds a guest plays before being disconnected, reconnecting doesn't restart it. Default: 600
+	SessionLimit int `yaml:"sessionLimit"`
+	// Watermark the stream of guests with a session timer, composited by the encoder like overlays
+	Watermark bool `yaml:"watermark"`
+}
+
+// ReservationConfig configures scheduled sessions
+type ReservationConfig struct {
+	// Minutes the instance is pre-warmed and slots are held before a reservation starts. Default: 2
+	PrewarmMinutes int `yaml:"prewarmMinutes"`
+	// Join links are emailed to invitees when SMTP is configured
+	SMTP SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig is the mail server sending notifications
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"` // Default: 587
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// CapacityConfig sets the limits within which a worker admits new sessions
+type CapacityConfig struct {
+	MaxSessions int     `yaml:"maxSessions"` // 0 is unlimited
+	MaxCPU      float64 `yaml:"maxCPU"`      // Percent, Default: 90
+	MaxMemory   float64 `yaml:"maxMemory"`   // Percent, Default: 90
+	// Concurrent hardware encoder sessions per GPU, e.g. NVENC limit. 0 doesn't track encoder slots
+	EncoderSlotsPerGPU int `yaml:"encoderSlotsPerGPU"`
+	// Interval of capacity heartbeats to discovery in seconds. Default: 5
+	HeartbeatInterval int `yaml:"heartbeatInterval"`
+	// Seconds a new session waits in queue for capacity before it's refused. Default: 60
+	QueueTimeout int `yaml:"queueTimeout"`
+}
+
+// Registry backends
+const (
+	RegistryEtcd   = "etcd"
+	RegistryConsul = "consul"
+)
+
+// RegistryConfig registers workers in etcd or Consul with a TTL lease, they drop out when they stop renewing it.
+// Coordinators watch the workers instead of polling the discovery service
+type RegistryConfig struct {
+	// Backend is etcd or consul. Empty uses discoveryHost
+	Backend string `yaml:"backend"`
+	// Endpoints of the backend, e.g. 127.0.0.1:2379 for etcd or http://127.0.0.1:8500 for Consul
+	Endpoints []string `yaml:"endpoints"`
+	// Prefix of the worker keys. Default: cloudmorph/workers/
+	Prefix string `yaml:"prefix"`
+	// TTL of the lease in seconds, a stopped worker is gone after it. Default: 15
+	TTL int `yaml:"ttl"`
+}
+
+// ReconnectConfig is the backoff of a worker registering again after its heartbeats failed or discovery lost it.
+// Delays grow from minDelay by multiplier up to maxDelay and are spread by jitter, so the workers of a restarted
+// coordinator don't register all at once
+type ReconnectConfig struct {
+	// Failed heartbeats in a row taking the link down. Default: 2
+	Failures int `yaml:"failures"`
+	// Seconds before the first attempt. Default: 1
+	MinDelay float64 `yaml:"minDelay"`
+	// Seconds between attempts at most. Default: 60
+	MaxDelay float64 `yaml:"maxDelay"`
+	// Default: 2
+	Multiplier float64 `yaml:"multiplier"`
+	// Fraction of the delay added or taken at random, 0-1. Default: 0.2
+	Jitter float64 `yaml:"jitter"`
+}
+
+// MaxRooms bounds the rooms of a worker, their app VMs take ports of the host above the default ones
+const MaxRooms = 16
+
+// RoomsConfig runs independent instances of the app in one worker, keyed by the ?room= of the session.
+// Sessions without room share the default instance
+type RoomsConfig struct {
+	// Max is the number of rooms besides the default one, 0 disables rooms
+	Max int `yaml:"max"`
+	// Seconds an empty room keeps its instance, then another room may take it. Default: 300
+	IdleTimeout int `yaml:"idleTimeout"`
+}
+
+// HasDiscovery returns if workers are listed by the discovery service or a registry
+func (c Config) HasDiscovery() bool {
+	return c.DiscoveryHost != "" || c.Registry.Backend != ""
+}
+
+// LoadShedConfig steps the encoder down a quality ladder of faster presets and lower frame rates while the worker is
+// overloaded, so encoding keeps up for every session, and back up when headroom returns
+type LoadShedConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Percent of the busiest of CPU and GPUs above which the encoder steps down. Default: 90
+	High float64 `yaml:"high"`
+	// Percent below which the encoder steps back up. Default: 2/3 of high
+	Low float64 `yaml:"low"`
+	// Seconds the load stays above high or below low before each step. Default: 10
+	Hold int `yaml:"hold"`
+}
+
+// Experimental capabilities gated by feature flags
+const (
+	// FeatureAudio streams the sound of the app
+	FeatureAudio = "audio"
+	// FeatureDataChannelInput sends input over a WebRTC DataChannel, otherwise over the websocket
+	FeatureDataChannelInput = "datachannelInput"
+	// FeatureSimulcast and FeatureHLSFallback are announced to clients ahead of their rollout
+	FeatureSimulcast   = "simulcast"
+	FeatureHLSFallback = "hlsFallback"
+)
+
+// DefaultFeatures are the flags of features missing in the config
+var DefaultFeatures = map[string]FeatureFlag{
+	FeatureAudio:            {Enabled: true},
+	FeatureDataChannelInput: {Enabled: true},
+	FeatureSimulcast:        {},
+	FeatureHLSFallback:      {},
+}
+
+// FeatureFlag rolls a feature out to all clients, to roles or to a share of the clients
+type FeatureFlag struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Roles the feature is limited to. Empty is for everyone
+	Roles []string `yaml:"roles" json:"roles,omitempty"`
+	// Percent of clients getting the feature, picked by a stable hash of the user. Default: 100
+	Percent int `yaml:"percent" json:"percent"`
+}
+
+// Validate checks the percent of the flag and defaults it
+func (f *FeatureFlag) Validate() error {
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("percent %d is not between 0 and 100", f.Percent)
+	}
+	if f.Percent == 0 {
+		f.Percent = 100
+	}
+	return nil
+}
+
+// Macro step types
+const (
+	MacroKey       = "key" // Press and release keyCode
+	MacroKeyDown   = "keydown"
+	MacroKeyUp     = "keyup"
+	MacroClick     = "click" // Press and release a mouse button at x, y
+	MacroMouseDown = "mousedown"
+	MacroMouseUp   = "mouseup"
+	MacroMouseMove = "mousemove"
+	MacroText      = "text" // Type text on a US keyboard layout
+)
+
+// MacroStep is an input event of a macro
+type MacroStep struct {
+	Type string `yaml:"type"`
+	// Browser key code of key steps
+	KeyCode int `yaml:"keyCode"`
+	// Position in the app screen and button of mouse steps
+	X     int  `yaml:"x"`
+	Y     int  `yaml:"y"`
+	Right bool `yaml:"right"`
+	// Text of text steps. ${VAR} is expanded from the secrets and the environment of the worker
+	Text string `yaml:"text"`
+	// Milliseconds to wait after the step
+	Delay int `yaml:"delay"`
+}
+
+func validateMacros(macros map[string][]MacroStep) error {
+	for name, steps := range macros {
+		for i, step := range steps {
+			switch step.Type {
+			case MacroKey, MacroKeyDown, MacroKeyUp:
+				if step.KeyCode <= 0 {
+					return fmt.Errorf("macro %s: step %d has no keyCode", name, i)
+				}
+			case MacroClick, MacroMouseDown, MacroMouseUp, MacroMouseMove, MacroText:
+			default:
+				return fmt.Errorf("macro %s: step %d has unknown type %q", name, i, step.Type)
+			}
+			if step.Delay < 0 {
+				return fmt.Errorf("macro %s: step %d has negative delay", name, i)
+			}
+		}
+	}
+	return nil
+}
+
+// ChatConfig configures the built-in chat. Chat is scoped to the room of each app instance
+type ChatConfig struct {
+	// Lobby adds a global lobby channel shared by all rooms
+	Lobby bool `yaml:"lobby"`
+	// Hosts of links allowed in messages, subdomains included. Empty allows links to any host
+	AllowedLinks []string `yaml:"allowedLinks"`
+	// Unfurl attaches OpenGraph previews of allowed links. It requires allowedLinks
+	Unfurl bool `yaml:"unfurl"`
+	// ReportWebhooks receive every abuse report as JSON, e.g. to page on-call moderators
+	ReportWebhooks []string `yaml:"reportWebhooks"`
+}
+
+// WSCompressionConfig compresses websocket packets of clients which negotiate permessage-deflate
+type WSCompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Threshold in bytes, smaller packets like input are sent uncompressed. Default: 512
+	Threshold int `yaml:"threshold"`
+	// Level of flate, 1 (fastest) to 9 (best). Default: 1
+	Level int `yaml:"level"`
+}
+
+// ClipConfig captures the last seconds of the session as a video clip, on demand or on schedule
+type ClipConfig struct {
+	Length   int    `yaml:"length"`   // Seconds of a clip, Default: 30
+	Interval int    `yaml:"interval"` // Minutes between scheduled clips, 0 disables them
+	Format   string `yaml:"format"`   // mp4, webm or gif of scheduled clips, Default: mp4
+	Keep     int    `yaml:"keep"`     // Clips kept on disk, older ones are removed. Default: 20
+}
+
+// PreemptionConfig watches the cloud provider metadata for spot/preemptible instance reclaim notices
+type PreemptionConfig struct {
+	// aws, gcp or azure. Empty disables it
+	Provider string `yaml:"provider"`
+	// Polling interval in seconds. Default: 5
+	Interval int `yaml:"interval"`
+	// Optional base URL of a worker to migrate the session to, e.g. https://worker2:8080
+	MigrateTarget string `yaml:"migrateTarget"`
+}
+
+// AnalyticsConfig lists sinks of session analytics events
+type AnalyticsConfig struct {
+	Sinks []AnalyticsSink `yaml:"sinks"`
+}
+
+// AnalyticsSink is a destination of analytics events
+type AnalyticsSink struct {
+	// stdout, file, http or kafkaRest
+	Type string `yaml:"type"`
+	// File path for file sink
+	Path string `yaml:"path"`
+	// Endpoint for http sink, extra headers for http and kafkaRest sinks
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Base URL of the Kafka REST proxy and the topic events are produced to for kafkaRest sink
+	KafkaRestURL string `yaml:"kafkaRestURL"`
+	Topic        string `yaml:"topic"`
+}
+
+// WebRTCConfig configures ICE of the WebRTC connections
+type WebRTCConfig struct {
+	// 1:1 NAT mapping in format of ip/candidateType, e.g. 1.2.3.4/host. Overrides nat1to1ip
+	Nat1to1 string `yaml:"nat1to1"`
+	// Public IP announced as server reflexive candidate beside host candidates, e.g. AWS elastic IP
+	PublicIP string `yaml:"publicIP"`
+	// STUN/TURN servers. TURN servers are needed for relay candidates. Overrides stunturn
+	ICEServers []ICEServer `yaml:"iceServers"`
+	// ICE transport policy: all (host/srflx/relay) or relay
+	ICETransportPolicy string `yaml:"iceTransportPolicy"`
+	// UDP port range for ICE candidates, so firewalls can be configured deterministically
+	PortMin uint16 `yaml:"portMin"`
+	PortMax uint16 `yaml:"portMax"`
+	// Optional single UDP port for all ICE traffic. Takes precedence over the port range
+	UDPMuxPort int `yaml:"udpMuxPort"`
+	// Optional TCP port for ICE-TCP candidates, for clients behind strict firewalls
+	TCPMuxPort int `yaml:"tcpMuxPort"`
+	// DTLS certificate shared by all connections, generated when missing. Default: dataDir/dtls.pem, "none" generates one per connection
+	DTLSCert string `yaml:"dtlsCert"`
+	// Seconds without ICE traffic before a connection is disconnected, then failed. Default: 3 and 10
+	ICEDisconnectedTimeout int `yaml:"iceDisconnectedTimeout"`
+	ICEFailedTimeout       int `yaml:"iceFailedTimeout"`
+	// Milliseconds between ICE keepalives when no media flows. Default: 1000
+	ICEKeepalive int `yaml:"iceKeepalive"`
+	// Sent video packets kept per connection to resend on NACK, a power of two up to 32768. Default: 1024
+	NackHistory int `yaml:"nackHistory"`
+	// Forward error correction of the video for lossy links, costs bandwidth
+	FEC FECConfig `yaml:"fec"`
+}
+
+// FECConfig adds ULPFEC packets in RED to the video, the browser recovers a lost packet without waiting for a resend
+type FECConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Overhead in percent of the media packets, one FEC packet protects 100/percent packets. Default: 20
+	Percent int `yaml:"percent"`
+}
+
+func (w WebRTCConfig) validate() error {
+	if (w.PortMin == 0) != (w.PortMax == 0) {
+		return fmt.Errorf("webrtc: both portMin and portMax must be set, got %d-%d", w.PortMin, w.PortMax)
+	}
+	if w.PortMin > w.PortMax {
+		return fmt.Errorf("webrtc: portMin %d is greater than portMax %d", w.PortMin, w.PortMax)
+	}
+	if w.UDPMuxPort < 0 || w.UDPMuxPort > 65535 {
+		return fmt.Errorf("webrtc: wrong udpMuxPort %d", w.UDPMuxPort)
+	}
+	if w.TCPMuxPort < 0 || w.TCPMuxPort > 65535 {
+		return fmt.Errorf("webrtc: wrong tcpMuxPort %d", w.TCPMuxPort)
+	}
+	if w.NackHistory < 0 || w.NackHistory > 1<<15 || w.NackHistory&(w.NackHistory-1) != 0 {
+		return fmt.Errorf("webrtc: nackHistory %d is not a power of two up to 32768", w.NackHistory)
+	}
+	if w.FEC.Percent < 0 || w.FEC.Percent > 50 {
+		return fmt.Errorf("webrtc: fec percent %d is not within 0-50", w.FEC.Percent)
+	}
+	return nil
+}
+
+// ICEServer is a STUN/TURN server
+type ICEServer struct {
+	URLs       []string `yaml:"urls" json:"urls"`
+	Username   string   `yaml:"username" json:"username,omitempty"`
+	Credential string   `yaml:"credential" json:"credential,omitempty"`
+}
+
+// TLSConfig enables HTTPS when both cert and key are provided
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// MediaRelayConfig forwards the media of workers clients can't reach directly, e.g. a worker behind NAT.
+// The coordinator runs a TURN server the worker streams to, clients switch to it after direct ICE failed
+type MediaRelayConfig struct {
+	// UDP and TCP port of the TURN server of this node, 0 runs none
+	Port int `yaml:"port"`
+	// Public IP of this node the media is relayed at. Required with port
+	PublicIP string `yaml:"publicIP"`
+	// UDP port range of the relayed streams. Default: any port
+	PortMin uint16 `yaml:"portMin"`
+	PortMax uint16 `yaml:"portMax"`
+	// Networks of the media addresses of the workers, e.g. 10.0.0.0/8. Required with port, the relay refuses
+	// to forward to other peers so it isn't an open proxy
+	Peers []string `yaml:"peers"`
+	// TURN server clients switch to, e.g. turn:coordinator.example.com:3478. Default: the one of this node
+	URL string `yaml:"url"`
+}
+
+// IsEnabled returns if clients of this node fall back to the media relay
+func (m MediaRelayConfig) IsEnabled() bool {
+	return m.URL != ""
+}
+
+// PeerNets parses the networks of the peers
+func (m MediaRelayConfig) PeerNets() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(m.Peers))
+	for _, peer := range m.Peers {
+		_, ipNet, err := net.ParseCIDR(peer)
+		if err != nil {
+			return nil, fmt.Errorf("mediaRelay: wrong peer network %s", peer)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// SFUConfig publishes the stream to an external SFU, LiveKit with its WHIP ingress, for sessions of one player
+// and hundreds of viewers. Viewers of view links join the room of the SFU with a token of the worker
+// instead of a peer connection to the worker each
+type SFUConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// WHIP endpoint of the ingress the worker publishes its tracks to, and its stream key
+	WHIPURL   string `yaml:"whipURL"`
+	WHIPToken string `yaml:"whipToken"`
+	// LiveKit server viewers join, e.g. wss://sfu.example.com
+	URL string `yaml:"url"`
+	// API key and secret of LiveKit signing the tokens of viewers
+	APIKey    string `yaml:"apiKey"`
+	APISecret string `yaml:"apiSecret"`
+	// Room of the ingress. Default: appName
+	Room string `yaml:"room"`
+	// LiveKit client SDK loaded by viewers. Default: the UMD build of jsDelivr
+	ClientScript string `yaml:"clientScript"`
+	// Minutes the token of a viewer is valid. Default: 360
+	TokenTTL int `yaml:"tokenTTL"`
+}
+
+// RegionsConfig tags sessions with the region of the client, so input RTT can be compared by region to place workers.
+// The header wins over the networks, which win over the region reported by the client. Other sessions are unknown
+type RegionsConfig struct {
+	// Header with the country of the client set by the CDN or proxy in front, e.g. CF-IPCountry.
+	// The proxy must overwrite it, clients can send it too
+	Header string `yaml:"header"`
+	// Networks of each region, e.g. exported from a GeoIP database
+	Networks map[string][]string `yaml:"networks"`
+	// Trust the time zone reported by the browser, e.g. Europe/Berlin
+	Reported bool `yaml:"reported"`
+}
+
+// Nets parses the networks of the regions
+func (r RegionsConfig) Nets() (map[string][]*net.IPNet, error) {
+	nets := make(map[string][]*net.IPNet, len(r.Networks))
+	for region, cidrs := range r.Networks {
+		for _, cidr := range cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("regions: wrong network %s of %s", cidr, region)
+			}
+			nets[region] = append(nets[region], ipNet)
+		}
+	}
+	return nets, nil
+}
+
+// FleetTLSConfig authenticates the nodes of a fleet to each other with certificates signed by the CA of the operator,
+// so rogue workers can't join. It's enabled by the CA
+type FleetTLSConfig struct {
+	CAFile string `yaml:"caFile"`
+	// Certificate of the node, signed by the CA
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// IsEnabled returns if fleet TLS is configured
+func (f FleetTLSConfig) IsEnabled() bool {
+	return f.CAFile != ""
+}
+
+// ProxyConfig describes the reverse proxy in front of the HTTP server
+type ProxyConfig struct {
+	// IPs or CIDRs of proxies whose X-Forwarded-For and X-Real-IP headers are trusted. Empty trusts none
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// BasePath the proxy serves cloud-morph under, e.g. /cloud-morph. Default: the root
+	BasePath string `yaml:"basePath"`
+	// Sticky binds browsers to the worker of their session with a signed cookie, for a load balancer spreading
+	// users over the nodes. Nodes forward requests of a bound browser to its worker
+	Sticky bool `yaml:"sticky"`
+}
+
+// TrustedNets parses the trusted proxies, single IPs become /32 or /128 networks
+func (p ProxyConfig) TrustedNets() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(p.TrustedProxies))
+	for _, proxy := range p.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("proxy: wrong trusted proxy %s", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: wrong trusted proxy %s", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// BasePath returns the base path of pages and the websocket, empty at the root
+func (c Config) BasePath() string {
+	return c.Proxy.BasePath
+}
+
+// Redacted returns a copy of the config with tokens and passwords replaced, e.g. for diagnostics bundles.
+// Secrets are references, they stay
+func (c Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "REDACTED"
+		}
+	}
+	r := c
+	redact(&r.AdminToken)
+	redact(&r.TokenSecret)
+	redact(&r.Monitoring.Password)
+	redact(&r.Reservations.SMTP.Password)
+	redact(&r.SFU.WHIPToken)
+	redact(&r.SFU.APISecret)
+	// stunturn may be a JSON list with TURN credentials
+	if strings.Contains(r.StunTurn, "credential") {
+		redact(&r.StunTurn)
+	}
+	r.WebRTC.ICEServers = make([]ICEServer, len(c.WebRTC.ICEServers))
+	for i, server := range c.WebRTC.ICEServers {
+		redact(&server.Credential)
+		r.WebRTC.ICEServers[i] = server
+	}
+	return r
+}
+
+// MonitoringConfig configures the pprof monitoring server
+type MonitoringConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Addr    string `yaml:"addr"` // Default: 127.0.0.1:3535
+	// Optional basic auth. AdminToken is accepted as well
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Serve monitoring with the same TLS config as the main server
+	UseTLS bool `yaml:"tls"`
+}
+
+// IsEnabled returns if TLS is configured
+func (t TLSConfig) IsEnabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
 }
 
 // TODO: sync with discovery.go
@@ -46,6 +741,74 @@ type AppDiscoveryMeta struct {
 	PageTitle    string `json:"page_title"`
 	ScreenWidth  int    `json:"screen_width"`
 	ScreenHeight int    `json:"screen_height"`
+	MaxInstances int    `json:"max_instances,omitempty"`
+	AgeRating    int    `json:"age_rating,omitempty"`
+	RequiredRole string `json:"required_role,omitempty"`
+}
+
+// ApplyManifest sets the app fields from its catalog manifest
+func (c *Config) ApplyManifest(m catalog.Manifest) {
+	c.AppName = m.Name
+	c.Image = m.Image
+	c.Path = m.Path
+	c.AppFile = m.AppFile
+	c.WindowTitle = m.WindowTitle
+	c.HWKey = m.InputProfile == catalog.InputProfileGame || m.InputProfile == catalog.InputProfileScancode
+	c.Scancodes = m.InputProfile == catalog.InputProfileScancode
+	c.EncoderPreset = m.EncoderPreset
+	if m.Audio != nil {
+		c.Audio = *m.Audio
+	}
+	if m.InputBackend != "" {
+		c.InputBackend = m.InputBackend
+	}
+	c.Artifact = m.Artifact
+	c.ContentControls = m.ContentControls
+	c.Provision = m.Provision
+	if m.Reset != "" {
+		c.Reset = m.Reset
+	}
+	if m.Viewers != nil {
+		c.Viewers = *m.Viewers
+	}
+	if len(m.Secrets) > 0 {
+		secrets := make(map[string]secret.Ref, len(c.Secrets)+len(m.Secrets))
+		for name, ref := range c.Secrets {
+			secrets[name] = ref
+		}
+		for name, ref := range m.Secrets {
+			secrets[name] = ref
+		}
+		c.Secrets = secrets
+	}
+	if m.Overlay != nil {
+		c.Overlay = m.Overlay.Resolve(filepath.Dir(m.File))
+	}
+	c.Capture = catalog.CaptureGeometry{}
+	if m.Capture != nil {
+		c.Capture = *m.Capture
+	}
+	if m.PageTitle != "" {
+		c.PageTitle = m.PageTitle
+	}
+	if m.ScreenWidth != 0 {
+		c.ScreenWidth = m.ScreenWidth
+	}
+	if m.ScreenHeight != 0 {
+		c.ScreenHeight = m.ScreenHeight
+	}
+}
+
+// SessionLimits returns capacity limits with the per-app player cap applied, a kiosk serves one visitor at a time
+func (c Config) SessionLimits() CapacityConfig {
+	limits := c.Capacity
+	if n := c.MaxPlayersPerInstance; n > 0 && (limits.MaxSessions == 0 || n < limits.MaxSessions) {
+		limits.MaxSessions = n
+	}
+	if c.Kiosk.Enabled {
+		limits.MaxSessions = 1
+	}
+	return limits
 }
 
 func ReadConfig(path string) (Config, error) {
@@ -57,6 +820,19 @@ func ReadConfig(path string) (Config, error) {
 	cfg := Config{}
 	err = yaml.Unmarshal(cfgyml, &cfg)
 
+	if cfg.AppsDir == "" {
+		cfg.AppsDir = "apps.d"
+	}
+	if cfg.ArtifactCache == "" {
+		cfg.ArtifactCache = "cache/artifacts"
+	}
+	if err == nil && cfg.App != "" {
+		m, ok := catalog.New(cfg.AppsDir).Get(cfg.App)
+		if !ok {
+			return cfg, fmt.Errorf("app %s is not found in %s", cfg.App, cfg.AppsDir)
+		}
+		cfg.ApplyManifest(m)
+	}
 	if cfg.AppName == "" {
 		cfg.AppName = cfg.WindowTitle
 	}
@@ -70,10 +846,303 @@ func ReadConfig(path string) (Config, error) {
 		boolTrue := true
 		cfg.IsWindowMode = &boolTrue
 	}
+	if cfg.Clips.Length <= 0 {
+		cfg.Clips.Length = 30
+	}
+	if cfg.Clips.Format == "" {
+		cfg.Clips.Format = "mp4"
+	}
+	if cfg.Clips.Keep <= 0 {
+		cfg.Clips.Keep = 20
+	}
+	if cfg.ThumbnailInterval <= 0 {
+		cfg.ThumbnailInterval = 30
+	}
+	if cfg.VideoBitrate <= 0 {
+		cfg.VideoBitrate = 1500
+	}
+	if cfg.JoinBitrate <= 0 {
+		cfg.JoinBitrate = 2 * cfg.VideoBitrate
+	}
+	if cfg.JoinRampSeconds <= 0 {
+		cfg.JoinRampSeconds = 3
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = ":8080"
+	}
+	if cfg.Monitoring.Addr == "" {
+		cfg.Monitoring.Addr = "127.0.0.1:3535"
+	}
+	if cfg.Preemption.Interval <= 0 {
+		cfg.Preemption.Interval = 5
+	}
+	if cfg.Capacity.MaxCPU <= 0 {
+		cfg.Capacity.MaxCPU = 90
+	}
+	if cfg.Capacity.MaxMemory <= 0 {
+		cfg.Capacity.MaxMemory = 90
+	}
+	if cfg.Capacity.HeartbeatInterval <= 0 {
+		cfg.Capacity.HeartbeatInterval = 5
+	}
+	if cfg.Capacity.QueueTimeout <= 0 {
+		cfg.Capacity.QueueTimeout = 60
+	}
+	if cfg.LoadShed.High <= 0 {
+		cfg.LoadShed.High = 90
+	}
+	if cfg.LoadShed.Low <= 0 || cfg.LoadShed.Low >= cfg.LoadShed.High {
+		cfg.LoadShed.Low = cfg.LoadShed.High * 2 / 3
+	}
+	if cfg.LoadShed.Hold <= 0 {
+		cfg.LoadShed.Hold = 10
+	}
+	if cfg.Features == nil {
+		cfg.Features = map[string]FeatureFlag{}
+	}
+	for name, flag := range DefaultFeatures {
+		if _, ok := cfg.Features[name]; !ok {
+			cfg.Features[name] = flag
+		}
+	}
+	for name, flag := range cfg.Features {
+		if _, ok := DefaultFeatures[name]; !ok && err == nil {
+			err = fmt.Errorf("features: unknown feature %s", name)
+		}
+		if verr := flag.Validate(); verr != nil && err == nil {
+			err = fmt.Errorf("features: %s: %v", name, verr)
+		}
+		cfg.Features[name] = flag
+	}
+	if cfg.ControlQueue.Turn <= 0 {
+		cfg.ControlQueue.Turn = 60
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = "data"
+	}
+	if cfg.WebRTC.DTLSCert == "" {
+		cfg.WebRTC.DTLSCert = filepath.Join(cfg.DataDir, "dtls.pem")
+	}
+	if cfg.WebRTC.ICEDisconnectedTimeout <= 0 {
+		cfg.WebRTC.ICEDisconnectedTimeout = 3
+	}
+	if cfg.WebRTC.ICEFailedTimeout <= 0 {
+		cfg.WebRTC.ICEFailedTimeout = 10
+	}
+	if cfg.WebRTC.ICEKeepalive <= 0 {
+		cfg.WebRTC.ICEKeepalive = 1000
+	}
+	if cfg.WebRTC.NackHistory == 0 {
+		cfg.WebRTC.NackHistory = 1024
+	}
+	if cfg.WebRTC.FEC.Percent == 0 {
+		cfg.WebRTC.FEC.Percent = 20
+	}
+	if cfg.Audio.Bitrate == 0 {
+		cfg.Audio.Bitrate = 96
+	}
+	if cfg.Audio.Channels == 0 {
+		cfg.Audio.Channels = 2
+	}
+	if err == nil {
+		err = cfg.Audio.Validate()
+	}
+	if cfg.VideoCodec == CodecAV1 && cfg.FallbackCodec == "" {
+		cfg.FallbackCodec = CodecH264
+	}
+	if err == nil && cfg.FallbackCodec == CodecAV1 {
+		err = errors.New("fallbackCodec: av1 can't be the fallback")
+	}
+	if cfg.Reservations.PrewarmMinutes <= 0 {
+		cfg.Reservations.PrewarmMinutes = 2
+	}
+	if cfg.Reservations.SMTP.Port == 0 {
+		cfg.Reservations.SMTP.Port = 587
+	}
+	if cfg.Locales == "" {
+		cfg.Locales = "locales"
+	}
+	if cfg.WSCompression.Threshold <= 0 {
+		cfg.WSCompression.Threshold = 512
+	}
+	if cfg.WSCompression.Level < 1 || cfg.WSCompression.Level > 9 {
+		cfg.WSCompression.Level = 1
+	}
+	if err == nil {
+		err = cfg.WebRTC.validate()
+	}
+	if err == nil {
+		err = validateMacros(cfg.Macros)
+	}
+	if err == nil {
+		err = secret.Validate(cfg.Secrets)
+	}
+	if cfg.Idle.WarnAfter > 0 && cfg.Idle.Timeout <= cfg.Idle.WarnAfter {
+		cfg.Idle.Timeout = cfg.Idle.WarnAfter + 60
+	}
+	if cfg.Guests.SessionLimit <= 0 {
+		cfg.Guests.SessionLimit = 600
+	}
+	if cfg.Idle.Action == "" {
+		cfg.Idle.Action = IdleDisconnect
+	}
+	if err == nil && cfg.Idle.Action != IdleDisconnect && cfg.Idle.Action != IdleSpectate {
+		err = fmt.Errorf("idle: unknown action %s", cfg.Idle.Action)
+	}
+	if cfg.DuplicateSessions == "" {
+		cfg.DuplicateSessions = DuplicateTakeover
+	}
+	if err == nil && cfg.DuplicateSessions != DuplicateDeny && cfg.DuplicateSessions != DuplicateTakeover && cfg.DuplicateSessions != DuplicateSpectate {
+		err = fmt.Errorf("duplicateSessions: unknown policy %s", cfg.DuplicateSessions)
+	}
+	if cfg.Rooms.IdleTimeout <= 0 {
+		cfg.Rooms.IdleTimeout = 300
+	}
+	if err == nil && (cfg.Rooms.Max < 0 || cfg.Rooms.Max > MaxRooms) {
+		err = fmt.Errorf("rooms: max %d is not within 0-%d", cfg.Rooms.Max, MaxRooms)
+	}
+	// Rooms run app VMs side by side, input has to reach the VM of each room
+	if err == nil && cfg.Rooms.Max > 0 && cfg.InputBackend != "" && cfg.InputBackend != "syncinput" && cfg.InputBackend != "xdotool" {
+		err = fmt.Errorf("rooms: input backend %s can't tell the app VMs of rooms apart, use syncinput or xdotool", cfg.InputBackend)
+	}
+	if err == nil {
+		err = cfg.Capture.Validate()
+	}
+	if cfg.WindowCapture == "" {
+		cfg.WindowCapture = CaptureScreen
+		if cfg.HideDesktop {
+			cfg.WindowCapture = CaptureApp
+		}
+	}
+	if cfg.Kiosk.Enabled {
+		cfg.HasChat = false
+	}
+	if cfg.Reset == "" || (cfg.Kiosk.Enabled && cfg.Reset == catalog.ResetNone) {
+		cfg.Reset = catalog.ResetNone
+		if cfg.Kiosk.Enabled {
+			cfg.Reset = catalog.ResetSnapshot
+		}
+	}
+	if err == nil && cfg.Reset != catalog.ResetNone && cfg.Reset != catalog.ResetRestart && cfg.Reset != catalog.ResetSnapshot {
+		err = fmt.Errorf("reset: unknown policy %s", cfg.Reset)
+	}
+	if err == nil && cfg.FleetTLS.IsEnabled() && (cfg.FleetTLS.CertFile == "" || cfg.FleetTLS.KeyFile == "") {
+		err = errors.New("fleetTLS: certFile and keyFile of the node are required")
+	}
+	if err == nil && cfg.FleetTLS.IsEnabled() && !cfg.Relay && !cfg.TLS.IsEnabled() {
+		err = errors.New("fleetTLS: workers need tls to verify the certificates of other nodes")
+	}
+	if cfg.Registry.Prefix == "" {
+		cfg.Registry.Prefix = "cloudmorph/workers/"
+	}
+	if cfg.Registry.TTL == 0 {
+		cfg.Registry.TTL = 15
+	}
+	if cfg.Reconnect.Failures <= 0 {
+		cfg.Reconnect.Failures = 2
+	}
+	if cfg.Reconnect.MinDelay <= 0 {
+		cfg.Reconnect.MinDelay = 1
+	}
+	if cfg.Reconnect.MaxDelay <= 0 {
+		cfg.Reconnect.MaxDelay = 60
+	}
+	if cfg.Reconnect.Multiplier == 0 {
+		cfg.Reconnect.Multiplier = 2
+	}
+	if cfg.Reconnect.Jitter == 0 {
+		cfg.Reconnect.Jitter = 0.2
+	}
+	if err == nil {
+		switch {
+		case cfg.Reconnect.MinDelay > cfg.Reconnect.MaxDelay:
+			err = fmt.Errorf("reconnect: minDelay %v is greater than maxDelay %v", cfg.Reconnect.MinDelay, cfg.Reconnect.MaxDelay)
+		case cfg.Reconnect.Multiplier < 1:
+			err = fmt.Errorf("reconnect: multiplier %v is below 1", cfg.Reconnect.Multiplier)
+		case cfg.Reconnect.Jitter < 0 || cfg.Reconnect.Jitter > 1:
+			err = fmt.Errorf("reconnect: jitter %v is not within 0-1", cfg.Reconnect.Jitter)
+		}
+	}
+	if err == nil && cfg.Registry.Backend != "" {
+		switch {
+		case cfg.Registry.Backend != RegistryEtcd && cfg.Registry.Backend != RegistryConsul:
+			err = fmt.Errorf("registry: unknown backend %s", cfg.Registry.Backend)
+		case len(cfg.Registry.Endpoints) == 0:
+			err = errors.New("registry: endpoints are required")
+		case cfg.Registry.TTL < 10:
+			// Consul sessions live 10 seconds at least
+			err = fmt.Errorf("registry: ttl %d is below 10 seconds", cfg.Registry.TTL)
+		}
+	}
+	if err == nil && cfg.Proxy.Sticky && (cfg.TokenSecret == "" || !cfg.HasDiscovery()) {
+		err = errors.New("proxy.sticky: tokenSecret shared by the nodes and discoveryHost or a registry listing them are required")
+	}
+	if cfg.MediaRelay.URL == "" && cfg.MediaRelay.Port != 0 {
+		cfg.MediaRelay.URL = fmt.Sprintf("turn:%s:%d", cfg.MediaRelay.PublicIP, cfg.MediaRelay.Port)
+	}
+	if err == nil && cfg.MediaRelay.Port != 0 {
+		switch {
+		case cfg.MediaRelay.Port < 0 || cfg.MediaRelay.Port > 65535:
+			err = fmt.Errorf("mediaRelay: wrong port %d", cfg.MediaRelay.Port)
+		case net.ParseIP(cfg.MediaRelay.PublicIP) == nil:
+			err = fmt.Errorf("mediaRelay: wrong publicIP %q", cfg.MediaRelay.PublicIP)
+		case (cfg.MediaRelay.PortMin == 0) != (cfg.MediaRelay.PortMax == 0) || cfg.MediaRelay.PortMin > cfg.MediaRelay.PortMax:
+			err = fmt.Errorf("mediaRelay: portMin %d is greater than portMax %d", cfg.MediaRelay.PortMin, cfg.MediaRelay.PortMax)
+		case len(cfg.MediaRelay.Peers) == 0:
+			err = errors.New("mediaRelay: peers, the networks of the workers, are required with port")
+		default:
+			_, err = cfg.MediaRelay.PeerNets()
+		}
+	}
+	if err == nil && cfg.MediaRelay.IsEnabled() && cfg.TokenSecret == "" {
+		err = errors.New("mediaRelay: tokenSecret shared by the coordinator and the workers is required to sign relay credentials")
+	}
+	if cfg.SFU.Room == "" {
+		cfg.SFU.Room = cfg.AppName
+	}
+	if cfg.SFU.ClientScript == "" {
+		cfg.SFU.ClientScript = "https://cdn.jsdelivr.net/npm/livekit-client/dist/livekit-client.umd.min.js"
+	}
+	if cfg.SFU.TokenTTL <= 0 {
+		cfg.SFU.TokenTTL = 360
+	}
+	if err == nil && cfg.SFU.Enabled && (cfg.SFU.WHIPURL == "" || cfg.SFU.URL == "" || cfg.SFU.APIKey == "" || cfg.SFU.APISecret == "") {
+		err = errors.New("sfu: whipURL, url, apiKey and apiSecret are required")
+	}
+	if err == nil {
+		err = cfg.Viewers.Validate()
+	}
+	if err == nil {
+		_, err = cfg.Regions.Nets()
+	}
+	if err == nil && cfg.Relay && !cfg.HasDiscovery() {
+		err = errors.New("relay: discoveryHost or a registry is required to route users to workers")
+	}
+	if err == nil && cfg.WindowCapture != CaptureScreen && cfg.WindowCapture != CaptureApp &&
+		cfg.WindowCapture != CaptureFocused && cfg.WindowCapture != CaptureAll {
+		err = fmt.Errorf("windowCapture: unknown target %s", cfg.WindowCapture)
+	}
+	if err == nil {
+		_, err = cfg.Proxy.TrustedNets()
+	}
+	// Base path is kept as /prefix without trailing slash
+	if cfg.Proxy.BasePath = strings.TrimRight(cfg.Proxy.BasePath, "/"); cfg.Proxy.BasePath != "" && !strings.HasPrefix(cfg.Proxy.BasePath, "/") {
+		cfg.Proxy.BasePath = "/" + cfg.Proxy.BasePath
+	}
+	if cfg.WebRTC.Nat1to1 == "" {
+		cfg.WebRTC.Nat1to1 = cfg.NAT1To1IP
+	}
 	if cfg.InstanceAddr == "" {
 		ip, _ := getLocalIP()
 		cfg.InstanceAddr = fmt.Sprintf("%s:%s", ip.String(), "8080")
 	}
+	if cfg.PublicURL == "" {
+		scheme := "http"
+		if cfg.TLS.IsEnabled() {
+			scheme = "https"
+		}
+		cfg.PublicURL = scheme + "://" + cfg.InstanceAddr + cfg.Proxy.BasePath
+	}
 	return cfg, err
 }
 
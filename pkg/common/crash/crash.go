@@ -0,0 +1,103 @@
+// Package crash contains panics of goroutines, so a failing subsystem or session doesn't silently take down
+// the process, and reports them with stack traces and session context to a webhook or Sentry
+package crash
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+var panics = metrics.NewCounterVec("cloudmorph_goroutine_panics_total", "Panics recovered in goroutines", "goroutine")
+
+// Config of reporters. Panics are always logged
+type Config struct {
+	// Webhook receives a JSON report per panic
+	Webhook string `yaml:"webhook"`
+	// SentryDSN sends panics to Sentry, e.g. https://<key>@sentry.io/<project>
+	SentryDSN string `yaml:"sentryDSN"`
+}
+
+// Report is a recovered panic
+type Report struct {
+	Goroutine string    `json:"goroutine"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host"`
+	// Context of the goroutine, e.g. the session
+	Context map[string]string `json:"context,omitempty"`
+}
+
+// Reporter sends reports of panics
+type Reporter interface {
+	Report(Report) error
+}
+
+var (
+	mu        sync.Mutex
+	reporters []Reporter
+)
+
+// Setup adds the reporters of the config
+func Setup(cfg Config) error {
+	var rs []Reporter
+	if cfg.Webhook != "" {
+		rs = append(rs, &webhookReporter{url: cfg.Webhook})
+	}
+	if cfg.SentryDSN != "" {
+		r, err := newSentryReporter(cfg.SentryDSN)
+		if err != nil {
+			return err
+		}
+		rs = append(rs, r)
+	}
+	mu.Lock()
+	reporters = append(reporters, rs...)
+	mu.Unlock()
+	return nil
+}
+
+// Go runs fn in a goroutine which recovers and reports a panic instead of crashing the process.
+// Context is pairs of keys and values, e.g. "client", id
+func Go(name string, fn func(), context ...string) {
+	go func() {
+		defer Recover(name, context...)
+		fn()
+	}()
+}
+
+// Recover is deferred at the start of a goroutine to recover and report its panic
+func Recover(name string, context ...string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	report := Report{
+		Goroutine: name,
+		Panic:     fmt.Sprint(r),
+		Stack:     string(debug.Stack()),
+		Time:      time.Now(),
+		Context:   map[string]string{},
+	}
+	report.Host, _ = os.Hostname()
+	for i := 0; i+1 < len(context); i += 2 {
+		report.Context[context[i]] = context[i+1]
+	}
+	panics.With(name).Inc()
+	log.Printf("[!] Recovered panic in %s %v: %s\n%s", name, report.Context, report.Panic, report.Stack)
+
+	mu.Lock()
+	rs := reporters
+	mu.Unlock()
+	for _, reporter := range rs {
+		if err := reporter.Report(report); err != nil {
+			log.Println("Failed to report panic:", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package crash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var client = &http.Client{Timeout: 5 * time.Second}
+
+func post(endpoint string, body interface{}, header http.Header) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// webhookReporter posts reports as JSON
+type webhookReporter struct {
+	url string
+}
+
+func (w *webhookReporter) Report(r Report) error {
+	return post(w.url, r, http.Header{})
+}
+
+// sentryReporter sends reports as events of the Sentry store API
+type sentryReporter struct {
+	endpoint string
+	auth     string
+}
+
+// newSentryReporter parses a DSN, https://<key>@<host>/<project>
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("wrong sentry DSN")
+	}
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	prefix, project := "", path
+	if i >= 0 {
+		prefix, project = "/"+path[:i], path[i+1:]
+	}
+	if project == "" {
+		return nil, fmt.Errorf("sentry DSN has no project")
+	}
+	return &sentryReporter{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=cloudmorph/1.0, sentry_key=%s", u.User.Username()),
+	}, nil
+}
+
+func (s *sentryReporter) Report(r Report) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   r.Time.UTC().Format("2006-01-02T15:04:05"),
+		"level":       "fatal",
+		"platform":    "go",
+		"logger":      "crash",
+		"server_name": r.Host,
+		"message":     fmt.Sprintf("panic in %s: %s", r.Goroutine, r.Panic),
+		"tags":        map[string]string{"goroutine": r.Goroutine},
+		"extra":       map[string]interface{}{"stack": r.Stack, "context": r.Context},
+	}
+	header := http.Header{}
+	header.Set("X-Sentry-Auth", s.auth)
+	return post(s.endpoint, event, header)
+}
@@ -0,0 +1,125 @@
+package cws
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Packets with more data than ChunkSize are split into CHUNK packets for clients which negotiated chunks, e.g. SDPs
+// of many tracks through proxies limiting the size of websocket messages. The chunks of a packet share its packet ID
+const (
+	chunkType = "CHUNK"
+	// ChunkSize is the data of a chunk at most
+	ChunkSize = 16 * 1024
+	// maxChunks of a packet, larger packets are dropped
+	maxChunks = 64
+	// maxAssemblies is the packets assembled at once, chunks of further packets are dropped
+	maxAssemblies = 8
+	// chunkTimeout drops packets not complete within it
+	chunkTimeout = 10 * time.Second
+)
+
+// chunk is the data of a CHUNK packet
+type chunk struct {
+	// Type of the split packet
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Total int    `json:"total"`
+	Data  string `json:"data"`
+}
+
+// assembly collects the chunks of a packet
+type assembly struct {
+	packetType string
+	parts      []string
+	received   []bool
+	missing    int
+	started    time.Time
+}
+
+// SetChunked splits the large packets sent to the client from now on, the client negotiated chunks
+func (c *Client) SetChunked(chunked bool) {
+	c.sendLock.Lock()
+	c.chunked = chunked
+	c.sendLock.Unlock()
+}
+
+// split returns the chunks of the packet, the packet itself when it's small enough or the client doesn't take chunks.
+// Data is split at UTF-8 boundaries, so every chunk is valid JSON
+func (c *Client) split(packet WSPacket) []WSPacket {
+	c.sendLock.Lock()
+	chunked := c.chunked
+	c.sendLock.Unlock()
+	if !chunked || len(packet.Data) <= ChunkSize {
+		return []WSPacket{packet}
+	}
+	var parts []string
+	for data := packet.Data; len(data) > 0; {
+		n := ChunkSize
+		if n >= len(data) {
+			n = len(data)
+		} else {
+			for n > 0 && !utf8.RuneStart(data[n]) {
+				n--
+			}
+			if n == 0 {
+				n = ChunkSize
+			}
+		}
+		parts = append(parts, data[:n])
+		data = data[n:]
+	}
+	chunks := make([]WSPacket, len(parts))
+	for i, part := range parts {
+		data, _ := json.Marshal(chunk{Type: packet.Type, Index: i, Total: len(parts), Data: part})
+		chunks[i] = WSPacket{Type: chunkType, Data: string(data), PacketID: packet.PacketID, SessionID: packet.SessionID}
+	}
+	return chunks
+}
+
+// assemble adds the chunk to its packet and returns the packet when it's complete. Malformed chunks, packets of
+// too many chunks and packets incomplete after chunkTimeout are dropped. Only the Listen goroutine assembles
+func (c *Client) assemble(packet WSPacket) (WSPacket, bool) {
+	var ch chunk
+	if err := json.Unmarshal([]byte(packet.Data), &ch); err != nil || packet.PacketID == "" || ch.Type == "" || ch.Type == chunkType ||
+		ch.Total < 1 || ch.Total > maxChunks || ch.Index < 0 || ch.Index >= ch.Total || len(ch.Data) > ChunkSize {
+		log.Println("Warn: dropping malformed chunk of", packet.PacketID)
+		return EmptyPacket, false
+	}
+	now := time.Now()
+	if c.assemblies == nil {
+		c.assemblies = map[string]*assembly{}
+	}
+	for id, a := range c.assemblies {
+		if now.Sub(a.started) > chunkTimeout {
+			log.Println("Warn: dropping incomplete packet", id, a.packetType)
+			delete(c.assemblies, id)
+		}
+	}
+	a, ok := c.assemblies[packet.PacketID]
+	if !ok {
+		if len(c.assemblies) >= maxAssemblies {
+			log.Println("Warn: dropping chunk of", packet.PacketID, "too many packets are assembled")
+			return EmptyPacket, false
+		}
+		a = &assembly{packetType: ch.Type, parts: make([]string, ch.Total), received: make([]bool, ch.Total), missing: ch.Total, started: now}
+		c.assemblies[packet.PacketID] = a
+	}
+	if ch.Type != a.packetType || ch.Total != len(a.parts) {
+		log.Println("Warn: dropping packet", packet.PacketID, "of inconsistent chunks")
+		delete(c.assemblies, packet.PacketID)
+		return EmptyPacket, false
+	}
+	if !a.received[ch.Index] {
+		a.parts[ch.Index], a.received[ch.Index] = ch.Data, true
+		a.missing--
+	}
+	if a.missing > 0 {
+		return EmptyPacket, false
+	}
+	delete(c.assemblies, packet.PacketID)
+	return WSPacket{Type: a.packetType, Data: strings.Join(a.parts, ""), PacketID: packet.PacketID, SessionID: packet.SessionID}, true
+}
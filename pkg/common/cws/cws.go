@@ -1,11 +1,12 @@
 package cws
 
 import (
-	"encoding/json"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/chaos"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -14,17 +15,37 @@ type Client struct {
 	id string
 
 	conn *websocket.Conn
+	// encoding of packets negotiated at the handshake, EncodingJSON or EncodingProto
+	encoding string
+	// locale of user-facing strings sent to the client, negotiated at the handshake
+	locale string
+	// compressAbove is the size of packets compressed with permessage-deflate, 0 disables it
+	compressAbove int
+	// compression of signaling payloads the client decompresses, negotiated at the handshake
+	compression string
+	// chunked splits large packets, the client negotiated chunks at the handshake. Guarded by sendLock
+	chunked bool
+	// assemblies of chunked packets by packet ID, only used by Listen
+	assemblies map[string]*assembly
+	// chaos impairs sent packets for tests, nil for none. Guarded by sendLock
+	chaos *chaos.Link
+	// tap sees the sent and received packets, nil for none. Guarded by sendLock
+	tap Tap
 
 	sendLock sync.Mutex
 	// sendCallback is callback based on packetID
 	sendCallback     map[string]func(req WSPacket)
 	sendCallbackLock sync.Mutex
 	// recvCallback is callback when receive based on ID of the packet
-	recvCallback map[string]func(req WSPacket)
+	recvCallback     map[string]func(req WSPacket)
+	recvCallbackLock sync.RWMutex
 
 	Done chan struct{}
 }
 
+// Tap sees the packets of a client, e.g. to record them. out tells sent packets from received ones
+type Tap func(out bool, packet WSPacket)
+
 // WSPacket represents a websocket packet
 type WSPacket struct {
 	Type string `json:"type"`
@@ -45,9 +66,15 @@ func NewClient(conn *websocket.Conn) *Client {
 	sendCallback := map[string]func(WSPacket){}
 	recvCallback := map[string]func(WSPacket){}
 
+	encoding := EncodingJSON
+	if conn != nil && conn.Subprotocol() == EncodingProto {
+		encoding = EncodingProto
+	}
+
 	return &Client{
-		id:   id,
-		conn: conn,
+		id:       id,
+		conn:     conn,
+		encoding: encoding,
 
 		sendCallback: sendCallback,
 		recvCallback: recvCallback,
@@ -59,10 +86,6 @@ func NewClient(conn *websocket.Conn) *Client {
 // Send sends a packet and trigger callback when the packet comes back
 func (c *Client) Send(request WSPacket, callback func(response WSPacket)) {
 	request.PacketID = uuid.Must(uuid.NewV4()).String()
-	data, err := json.Marshal(request)
-	if err != nil {
-		return
-	}
 
 	// Wrap callback with sessionID and packetID
 	if callback != nil {
@@ -82,14 +105,128 @@ func (c *Client) Send(request WSPacket, callback func(response WSPacket)) {
 		c.sendCallbackLock.Unlock()
 	}
 
+	c.observe(true, request)
+	c.writePacket(request)
+}
+
+// writePacket encodes and sends the packet, in chunks when it's large
+func (c *Client) writePacket(packet WSPacket) {
+	for _, p := range c.split(packet) {
+		data, err := marshalPacket(c.encoding, p)
+		if err != nil {
+			log.Println("[!] marshal error:", err)
+			return
+		}
+		c.write(data)
+	}
+}
+
+// write sends an encoded packet through the chaos link when there is one
+func (c *Client) write(data []byte) {
+	c.sendLock.Lock()
+	link := c.chaos
+	c.sendLock.Unlock()
+	if link != nil {
+		link.Send(func() { c.writeMessage(data) })
+		return
+	}
+	c.writeMessage(data)
+}
+
+// writeMessage sends an encoded packet, protobuf packets as binary frames. Clients without connection drop it
+func (c *Client) writeMessage(data []byte) {
+	if c.conn == nil {
+		return
+	}
+	messageType := websocket.TextMessage
+	if c.encoding == EncodingProto {
+		messageType = websocket.BinaryMessage
+	}
 	c.sendLock.Lock()
+	if c.compressAbove > 0 {
+		c.conn.EnableWriteCompression(len(data) >= c.compressAbove)
+	}
 	c.conn.SetWriteDeadline(time.Now().Add(20 * time.Second))
-	c.conn.WriteMessage(websocket.TextMessage, data)
+	c.conn.WriteMessage(messageType, data)
 	c.sendLock.Unlock()
 }
 
+// SetChaos impairs the packets sent from now on with the link
+func (c *Client) SetChaos(link *chaos.Link) {
+	c.sendLock.Lock()
+	c.chaos = link
+	c.sendLock.Unlock()
+}
+
+// SetTap makes the tap see the packets from now on
+func (c *Client) SetTap(tap Tap) {
+	c.sendLock.Lock()
+	c.tap = tap
+	c.sendLock.Unlock()
+}
+
+func (c *Client) observe(out bool, packet WSPacket) {
+	c.sendLock.Lock()
+	tap := c.tap
+	c.sendLock.Unlock()
+	if tap != nil {
+		tap(out, packet)
+	}
+}
+
+// Inject handles the packet as if it was received, on the goroutine of the caller.
+// Replays drive clients without connection with it
+func (c *Client) Inject(packet WSPacket) {
+	c.observe(false, packet)
+	c.recvCallbackLock.RLock()
+	recvCallback, ok := c.recvCallback[packet.Type]
+	c.recvCallbackLock.RUnlock()
+	if ok {
+		recvCallback(packet)
+	}
+}
+
+// Compress sends packets of at least threshold bytes compressed with the flate level.
+// It does nothing when the client didn't negotiate permessage-deflate
+func (c *Client) Compress(threshold, level int) error {
+	if err := c.conn.SetCompressionLevel(level); err != nil {
+		return err
+	}
+	c.sendLock.Lock()
+	c.compressAbove = threshold
+	c.sendLock.Unlock()
+	return nil
+}
+
+// SetLocale sets the locale of the client, before it starts listening
+func (c *Client) SetLocale(locale string) {
+	c.locale = locale
+}
+
+// SetCompression sets the compression of signaling payloads the client decompresses, before it starts listening
+func (c *Client) SetCompression(compression string) {
+	c.compression = compression
+}
+
+// Compression returns the compression of signaling payloads negotiated at the handshake, empty for none
+func (c *Client) Compression() string {
+	return c.compression
+}
+
+// Locale returns the locale of user-facing strings sent to the client
+func (c *Client) Locale() string {
+	return c.locale
+}
+
+// Encoding returns the encoding of packets negotiated at the handshake
+func (c *Client) Encoding() string {
+	return c.encoding
+}
+
 // Receive receive and response
 func (c *Client) Receive(id string, f func(request WSPacket) (response WSPacket)) {
+	c.recvCallbackLock.Lock()
+	defer c.recvCallbackLock.Unlock()
 	c.recvCallback[id] = func(request WSPacket) {
 		// defer func() {
 		// 	if err := recover(); err != nil {
@@ -107,14 +244,8 @@ func (c *Client) Receive(id string, f func(request WSPacket) (response WSPacket)
 		if resp == EmptyPacket {
 			return
 		}
-		respText, err := json.Marshal(resp)
-		if err != nil {
-			log.Println("[!] json marshal error:", err)
-		}
-		c.sendLock.Lock()
-		c.conn.SetWriteDeadline(time.Now().Add(20 * time.Second))
-		c.conn.WriteMessage(websocket.TextMessage, respText)
-		c.sendLock.Unlock()
+		c.observe(true, resp)
+		c.writePacket(resp)
 	}
 }
 
@@ -172,21 +303,26 @@ func (c *Client) Listen() {
 			close(c.Done)
 			break
 		}
-		wspacket := WSPacket{}
-		err = json.Unmarshal(rawMsg, &wspacket)
-
+		wspacket, err := unmarshalPacket(c.encoding, rawMsg)
 		if err != nil {
 			log.Println("Warn: error decoding", rawMsg)
 			continue
 		}
+		if wspacket.Type == chunkType {
+			var complete bool
+			if wspacket, complete = c.assemble(wspacket); !complete {
+				continue
+			}
+		}
 
+		c.observe(false, wspacket)
 		// Check if some async send is waiting for the response based on packetID
 		// TODO: Change to read lock.
 		//c.sendCallbackLock.Lock()
 		callback, ok := c.sendCallback[wspacket.PacketID]
 		//c.sendCallbackLock.Unlock()
 		if ok {
-			go callback(wspacket)
+			crash.Go("ws response "+wspacket.Type, func() { callback(wspacket) }, "client", c.id)
 			//c.sendCallbackLock.Lock()
 			delete(c.sendCallback, wspacket.PacketID)
 			//c.sendCallbackLock.Unlock()
@@ -194,8 +330,12 @@ func (c *Client) Listen() {
 			continue
 		}
 		// Check if some receiver with the ID is registered
-		if callback, ok := c.recvCallback[wspacket.Type]; ok {
-			go callback(wspacket)
+		// Receivers can be registered after Listen starts, e.g. when a queued session is admitted
+		c.recvCallbackLock.RLock()
+		recvCallback, ok := c.recvCallback[wspacket.Type]
+		c.recvCallbackLock.RUnlock()
+		if ok {
+			crash.Go("ws "+wspacket.Type, func() { recvCallback(wspacket) }, "client", c.id)
 		}
 	}
 }
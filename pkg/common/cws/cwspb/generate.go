@@ -0,0 +1,4 @@
+// Package cwspb has the protobuf types of the websocket packets, generated from cloudmorph.proto
+package cwspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative cloudmorph.proto
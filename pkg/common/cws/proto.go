@@ -0,0 +1,91 @@
+package cws
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws/cwspb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Subprotocols negotiate the encoding of packets at the websocket handshake
+const (
+	// EncodingJSON is the default of clients without a subprotocol, e.g. the web page
+	EncodingJSON = "cloudmorph.json"
+	// EncodingProto sends packets as protobuf binary frames, see cwspb/cloudmorph.proto
+	EncodingProto = "cloudmorph.proto"
+)
+
+// Subprotocols are accepted by websocket upgraders, preferred first
+var Subprotocols = []string{EncodingProto, EncodingJSON}
+
+// BodyCodec converts the JSON data of a packet type to a typed protobuf body and back
+type BodyCodec struct {
+	// Marshal sets the typed body of the packet from the JSON data
+	Marshal func(data string, p *cwspb.WSPacket) error
+	// Unmarshal returns the typed body of the packet as JSON data
+	Unmarshal func(p *cwspb.WSPacket) (string, error)
+}
+
+var (
+	bodiesLock sync.RWMutex
+	bodies     = map[string]BodyCodec{}
+)
+
+// RegisterBody sets the typed body of the packet types, e.g. ChatMessage of CHAT packets
+func RegisterBody(codec BodyCodec, packetTypes ...string) {
+	bodiesLock.Lock()
+	defer bodiesLock.Unlock()
+	for _, t := range packetTypes {
+		bodies[t] = codec
+	}
+}
+
+func bodyOf(packetType string) (BodyCodec, bool) {
+	bodiesLock.RLock()
+	defer bodiesLock.RUnlock()
+	codec, ok := bodies[packetType]
+	return codec, ok
+}
+
+func marshalPacket(encoding string, p WSPacket) ([]byte, error) {
+	if encoding != EncodingProto {
+		return json.Marshal(p)
+	}
+	packet := &cwspb.WSPacket{Type: p.Type, PacketId: p.PacketID, SessionId: p.SessionID}
+	codec, typed := bodyOf(p.Type)
+	if typed && p.Data != "" {
+		if err := codec.Marshal(p.Data, packet); err != nil {
+			return nil, fmt.Errorf("%s body: %w", p.Type, err)
+		}
+	} else {
+		packet.Data = p.Data
+	}
+	return proto.Marshal(packet)
+}
+
+func unmarshalPacket(encoding string, b []byte) (WSPacket, error) {
+	var p WSPacket
+	if encoding != EncodingProto {
+		err := json.Unmarshal(b, &p)
+		return p, err
+	}
+	var packet cwspb.WSPacket
+	if err := proto.Unmarshal(b, &packet); err != nil {
+		return p, err
+	}
+	p = WSPacket{Type: packet.Type, Data: packet.Data, PacketID: packet.PacketId, SessionID: packet.SessionId}
+	if packet.Body != nil {
+		codec, ok := bodyOf(p.Type)
+		if !ok {
+			return p, fmt.Errorf("%s has no typed body", p.Type)
+		}
+		data, err := codec.Unmarshal(&packet)
+		if err != nil {
+			return p, fmt.Errorf("%s body: %w", p.Type, err)
+		}
+		p.Data = data
+	}
+	return p, nil
+}
@@ -0,0 +1,82 @@
+// Package i18n translates the user-facing strings the server sends to clients, e.g. errors, announcements and queue messages.
+// Messages are keyed by their English text like gettext. Translations are YAML files of the locales directory
+// named by locale, e.g. de.yaml or pt-BR.yaml, mapping the English text to the translated one
+package i18n
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v2"
+)
+
+// Source is the locale of the messages in the code
+const Source = "en"
+
+// Catalog holds the translations. A nil Catalog returns messages untranslated
+type Catalog struct {
+	locales  []language.Tag
+	matcher  language.Matcher
+	messages map[string]map[string]string
+}
+
+// Load reads the translations of dir. A missing dir leaves only the source locale
+func Load(dir string) (*Catalog, error) {
+	c := &Catalog{
+		locales:  []language.Tag{language.Make(Source)},
+		messages: map[string]map[string]string{},
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".yaml")
+		tag, err := language.Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		messages := map[string]string{}
+		if err := yaml.Unmarshal(data, &messages); err != nil {
+			return nil, err
+		}
+		c.locales = append(c.locales, tag)
+		c.messages[tag.String()] = messages
+	}
+	c.matcher = language.NewMatcher(c.locales)
+	return c, nil
+}
+
+// Match returns the supported locale closest to the preferences of a client, in order:
+// a locale asked at the handshake, e.g. ?lang=de, then an Accept-Language header
+func (c *Catalog) Match(locale string, acceptLanguage string) string {
+	if c == nil {
+		return Source
+	}
+	var prefs []language.Tag
+	if tag, err := language.Parse(locale); err == nil {
+		prefs = append(prefs, tag)
+	}
+	if tags, _, err := language.ParseAcceptLanguage(acceptLanguage); err == nil {
+		prefs = append(prefs, tags...)
+	}
+	_, i, _ := c.matcher.Match(prefs...)
+	return c.locales[i].String()
+}
+
+// T translates msg to the locale, untranslated messages stay in English
+func (c *Catalog) T(locale string, msg string) string {
+	if c == nil {
+		return msg
+	}
+	if translated, ok := c.messages[locale][msg]; ok && translated != "" {
+		return translated
+	}
+	return msg
+}
@@ -0,0 +1,86 @@
+// Package listener opens the listener of the HTTP server from its configured address:
+// host:port, a Unix socket or a socket passed by systemd socket activation
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixPrefix = "unix:"
+	// systemd, or systemd:<name> to pick a socket by its FileDescriptorName
+	systemdAddr = "systemd"
+	// listenFDsStart is the first file descriptor passed by systemd
+	listenFDsStart = 3
+)
+
+// unixSocketMode lets a local proxy in the same group connect
+const unixSocketMode = 0660
+
+// Listen listens on addr, e.g. :8080, unix:/run/cloudmorph/http.sock or systemd
+func Listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		return listenUnix(strings.TrimPrefix(addr, unixPrefix))
+	case addr == systemdAddr || strings.HasPrefix(addr, systemdAddr+":"):
+		return listenSystemd(strings.TrimPrefix(strings.TrimPrefix(addr, systemdAddr), ":"))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// listenUnix removes a socket left by a previous run, the listener removes it again when closed
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen %s: file exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenSystemd inherits a listening socket from systemd, see sd_listen_fds(3).
+// The socket stays open in systemd when the process restarts, so no connection is refused meanwhile
+func listenSystemd(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no socket is passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("no socket is passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Child processes like the app must not inherit them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < count; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), "systemd socket")
+		ln, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		f.Close()
+		return ln, err
+	}
+	return nil, fmt.Errorf("no socket named %s is passed by systemd", name)
+}
@@ -0,0 +1,353 @@
+// Package metrics is a minimal metrics registry exported in Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = map[string]collector{}
+)
+
+func register(name string, c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metrics: duplicated metric " + name)
+	}
+	registry[name] = c
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v int64
+}
+
+// Inc increases the counter by 1
+func (c *Counter) Inc() { atomic.AddInt64(&c.v, 1) }
+
+// Add increases the counter by n
+func (c *Counter) Add(n int64) { atomic.AddInt64(&c.v, n) }
+
+// Value returns the current value
+func (c *Counter) Value() int64 { return atomic.LoadInt64(&c.v) }
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v int64
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v int64) { atomic.StoreInt64(&g.v, v) }
+
+// Add changes the gauge by n
+func (g *Gauge) Add(n int64) { atomic.AddInt64(&g.v, n) }
+
+// Value returns the current value
+func (g *Gauge) Value() int64 { return atomic.LoadInt64(&g.v) }
+
+// FloatGauge is a gauge of fractional values, e.g. frames per second
+type FloatGauge struct {
+	bits uint64
+}
+
+// Set sets the gauge to v
+func (g *FloatGauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+
+// Value returns the current value
+func (g *FloatGauge) Value() float64 { return math.Float64frombits(atomic.LoadUint64(&g.bits)) }
+
+// valuer formats the sample of a metric
+type valuer interface {
+	sample() string
+}
+
+func (c *Counter) sample() string    { return strconv.FormatInt(c.Value(), 10) }
+func (g *Gauge) sample() string      { return strconv.FormatInt(g.Value(), 10) }
+func (g *FloatGauge) sample() string { return strconv.FormatFloat(g.Value(), 'g', -1, 64) }
+
+// Histogram counts observations in cumulative buckets of upper bounds
+type Histogram struct {
+	bounds []float64
+	mu     sync.Mutex
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// HistogramSnapshot is the state of a histogram. Counts are cumulative, the last one is of +Inf
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Count  int64     `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+// Observe adds the value to the buckets it's within
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Snapshot returns a copy of the histogram
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make([]int64, len(h.counts)+1)
+	copy(counts, h.counts)
+	counts[len(h.counts)] = h.count
+	return HistogramSnapshot{Bounds: h.bounds, Counts: counts, Count: h.count, Sum: h.sum}
+}
+
+// Quantile estimates the q-quantile by linear interpolation within its bucket, like histogram_quantile of Prometheus.
+// It returns 0 without observations and the highest bound for quantiles in the +Inf bucket
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	lower, below := 0.0, int64(0)
+	for i, bound := range s.Bounds {
+		if float64(s.Counts[i]) >= rank {
+			in := s.Counts[i] - below
+			if in == 0 {
+				return bound
+			}
+			return lower + (bound-lower)*(rank-float64(below))/float64(in)
+		}
+		lower, below = bound, s.Counts[i]
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+// lines writes the bucket, sum and count samples of the histogram
+func (h *Histogram) lines(w io.Writer, name string, labels []string, key string) {
+	s := h.Snapshot()
+	names := append(append([]string{}, labels...), "le")
+	for i, count := range s.Counts {
+		le := "+Inf"
+		if i < len(s.Bounds) {
+			le = strconv.FormatFloat(s.Bounds[i], 'g', -1, 64)
+		}
+		bucketKey := le
+		if len(labels) > 0 {
+			bucketKey = key + "\xff" + le
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(names, bucketKey), count)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels, key), strconv.FormatFloat(s.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labels, key), s.Count)
+}
+
+func (h *Histogram) sample() string { return strconv.FormatInt(h.Snapshot().Count, 10) }
+
+// multiLine is a metric written as several samples, e.g. histograms
+type multiLine interface {
+	lines(w io.Writer, name string, labels []string, key string)
+}
+
+// vec holds metrics of the same name with different label values
+type vec struct {
+	name   string
+	help   string
+	typ    metricType
+	labels []string
+	mu     sync.Mutex
+	values map[string]valuer
+	create func() valuer
+}
+
+func (v *vec) with(labelValues ...string) valuer {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d labels", v.name, len(v.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.values[key]
+	if !ok {
+		m = v.create()
+		v.values[key] = m
+	}
+	return m
+}
+
+func (v *vec) delete(labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+func (v *vec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if m, ok := v.values[k].(multiLine); ok {
+			m.lines(w, v.name, v.labels, k)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, k), v.values[k].sample())
+	}
+	v.mu.Unlock()
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct{ v *vec }
+
+// With returns the counter of the label values
+func (c *CounterVec) With(labelValues ...string) *Counter { return c.v.with(labelValues...).(*Counter) }
+
+// Delete removes the counter of the label values
+func (c *CounterVec) Delete(labelValues ...string) { c.v.delete(labelValues...) }
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct{ v *vec }
+
+// With returns the gauge of the label values
+func (g *GaugeVec) With(labelValues ...string) *Gauge { return g.v.with(labelValues...).(*Gauge) }
+
+// Delete removes the gauge of the label values
+func (g *GaugeVec) Delete(labelValues ...string) { g.v.delete(labelValues...) }
+
+// FloatGaugeVec is a float gauge partitioned by labels
+type FloatGaugeVec struct{ v *vec }
+
+// With returns the gauge of the label values
+func (g *FloatGaugeVec) With(labelValues ...string) *FloatGauge {
+	return g.v.with(labelValues...).(*FloatGauge)
+}
+
+// Delete removes the gauge of the label values
+func (g *FloatGaugeVec) Delete(labelValues ...string) { g.v.delete(labelValues...) }
+
+func newVec(name, help string, typ metricType, labels []string, create func() valuer) *vec {
+	v := &vec{name: name, help: help, typ: typ, labels: labels, values: map[string]valuer{}, create: create}
+	register(name, v)
+	return v
+}
+
+// NewCounter registers a counter without labels
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// NewGauge registers a gauge without labels
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+// NewCounterVec registers a counter with labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, counterType, labels, func() valuer { return &Counter{} })}
+}
+
+// NewGaugeVec registers a gauge with labels
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, gaugeType, labels, func() valuer { return &Gauge{} })}
+}
+
+// NewFloatGaugeVec registers a float gauge with labels
+func NewFloatGaugeVec(name, help string, labels ...string) *FloatGaugeVec {
+	return &FloatGaugeVec{newVec(name, help, gaugeType, labels, func() valuer { return &FloatGauge{} })}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct{ v *vec }
+
+// With returns the histogram of the label values
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return h.v.with(labelValues...).(*Histogram)
+}
+
+// Delete removes the histogram of the label values
+func (h *HistogramVec) Delete(labelValues ...string) { h.v.delete(labelValues...) }
+
+// Snapshots returns the histograms by their label values joined with commas
+func (h *HistogramVec) Snapshots() map[string]HistogramSnapshot {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	snapshots := make(map[string]HistogramSnapshot, len(h.v.values))
+	for k, m := range h.v.values {
+		snapshots[strings.Replace(k, "\xff", ",", -1)] = m.(*Histogram).Snapshot()
+	}
+	return snapshots
+}
+
+// NewHistogramVec registers a histogram with labels and the ascending upper bounds of its buckets
+func NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, histogramType, labels, func() valuer {
+		return &Histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+	})}
+}
+
+// Write writes all metrics in Prometheus text format
+func Write(w io.Writer) {
+	registryLock.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = registry[name]
+	}
+	registryLock.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves metrics for Prometheus scraping
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
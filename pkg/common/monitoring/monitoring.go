@@ -0,0 +1,136 @@
+// Package monitoring serves the profiling and metrics endpoints of a cloud-morph process
+package monitoring
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+const pprofPath = "/debug/pprof"
+
+// Server is the monitoring http server
+type Server struct {
+	httpServer *http.Server
+	mux        *http.ServeMux
+	tls        config.TLSConfig
+}
+
+// NewServer returns a monitoring server. It returns nil if monitoring is disabled
+func NewServer(cfg config.Config) *Server {
+	if !cfg.Monitoring.Enabled {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	s := &Server{mux: mux}
+	if cfg.Monitoring.UseTLS {
+		if !cfg.TLS.IsEnabled() {
+			log.Println("Warn: monitoring server requests TLS but no certificate is configured")
+		}
+		s.tls = cfg.TLS
+	}
+
+	mux.Handle(pprofPath+"/", http.HandlerFunc(pprof.Index))
+	mux.Handle(pprofPath+"/cmdline", http.HandlerFunc(pprof.Cmdline))
+	mux.Handle(pprofPath+"/profile", http.HandlerFunc(pprof.Profile))
+	mux.Handle(pprofPath+"/symbol", http.HandlerFunc(pprof.Symbol))
+	mux.Handle(pprofPath+"/trace", http.HandlerFunc(pprof.Trace))
+	// pprof handler for custom pprof path needs to be explicitly specified, according to: https://github.com/gin-contrib/pprof/issues/8 . Don't know why this is not fired as ticket
+	// https://golang.org/src/net/http/pprof/pprof.go?s=7411:7461#L305 only render index page
+	mux.Handle(pprofPath+"/allocs", pprof.Handler("allocs"))
+	mux.Handle(pprofPath+"/block", pprof.Handler("block"))
+	mux.Handle(pprofPath+"/goroutine", pprof.Handler("goroutine"))
+	mux.Handle(pprofPath+"/heap", pprof.Handler("heap"))
+	mux.Handle(pprofPath+"/mutex", pprof.Handler("mutex"))
+	mux.Handle(pprofPath+"/threadcreate", pprof.Handler("threadcreate"))
+	mux.Handle("/metrics", metrics.Handler())
+
+	handler := http.Handler(mux)
+	if cfg.Monitoring.User != "" || cfg.AdminToken != "" {
+		handler = RequireAuth(cfg.Monitoring.User, cfg.Monitoring.Password, cfg.AdminToken, mux)
+	} else if !isLoopback(cfg.Monitoring.Addr) {
+		log.Println("Warn: monitoring server is exposed without authentication at", cfg.Monitoring.Addr)
+	}
+
+	s.httpServer = &http.Server{
+		Addr:        cfg.Monitoring.Addr,
+		Handler:     handler,
+		IdleTimeout: 120 * time.Second,
+	}
+	return s
+}
+
+// Handle registers an extra handler on the monitoring server
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run starts the monitoring server in background
+func (s *Server) Run() {
+	log.Println("Starting monitoring server at", s.httpServer.Addr)
+	log.Println("Profiling is enabled at", s.httpServer.Addr+pprofPath)
+	go func() {
+		var err error
+		if s.tls.IsEnabled() {
+			err = s.httpServer.ListenAndServeTLS(s.tls.CertFile, s.tls.KeyFile)
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("Monitoring server stopped:", err)
+		}
+	}()
+}
+
+// RequireAuth wraps a handler with basic auth and/or a bearer admin token check.
+// Either one of the credentials is enough to pass
+func RequireAuth(user, password, adminToken string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" && IsAdminToken(r, adminToken) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user != "" {
+			u, p, ok := r.BasicAuth()
+			if ok && secureEqual(u, user) && secureEqual(p, password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="cloud-morph"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// IsAdminToken checks if the request carries the admin token as a bearer token or X-Admin-Token header
+func IsAdminToken(r *http.Request, adminToken string) bool {
+	token := r.Header.Get("X-Admin-Token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token != "" && secureEqual(token, adminToken)
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
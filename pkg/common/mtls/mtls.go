@@ -0,0 +1,88 @@
+// Package mtls authenticates the nodes of a fleet to each other with certificates signed by the CA of the operator.
+// Discovery requires them from workers, workers present them to discovery, registries and each other
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+func load(cfg config.FleetTLSConfig) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	ca, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return tls.Certificate{}, nil, errors.New("fleetTLS: no certificate in " + cfg.CAFile)
+	}
+	return cert, pool, nil
+}
+
+// ClientConfig presents the certificate of the node and trusts only servers signed by the CA
+func ClientConfig(cfg config.FleetTLSConfig) (*tls.Config, error) {
+	cert, pool, err := load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// ServerConfig serves with the certificate of the node and requires clients signed by the CA, e.g. for discovery
+func ServerConfig(cfg config.FleetTLSConfig) (*tls.Config, error) {
+	cert, pool, err := load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// VerifyIfGiven verifies client certificates of the CA on a listener browsers use too, which have none.
+// Fleet endpoints check Verified
+func VerifyIfGiven(cfg config.FleetTLSConfig) (*tls.Config, error) {
+	_, pool, err := load(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// Client returns an HTTP client of the fleet with the timeout
+func Client(cfg config.FleetTLSConfig, timeout time.Duration) (*http.Client, error) {
+	tlsConfig, err := ClientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+// Verified returns if the request comes from a node with a certificate of the CA
+func Verified(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// Require lets only nodes of the fleet through
+func Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Verified(r) {
+			http.Error(w, "fleet certificate is required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+// Package preemption watches cloud provider metadata for spot/preemptible instance reclaim notices
+package preemption
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+const (
+	ProviderAWS   = "aws"
+	ProviderGCP   = "gcp"
+	ProviderAzure = "azure"
+)
+
+const (
+	awsTokenURL       = "http://169.254.169.254/latest/api/token"
+	awsInstanceAction = "http://169.254.169.254/latest/meta-data/spot/instance-action"
+	gcpPreempted      = "http://metadata.google.internal/computeMetadata/v1/instance/preempted"
+	azureEvents       = "http://169.254.169.254/metadata/scheduledevents?api-version=2020-07-01"
+)
+
+// Notice is a reclaim notice of the instance
+type Notice struct {
+	Provider string `json:"provider"`
+	Action   string `json:"action"`
+	// Time the instance is reclaimed, estimated when the provider doesn't tell
+	Time time.Time `json:"time"`
+}
+
+// gcp and azure preempt about 30 seconds after the notice
+const defaultNoticePeriod = 30 * time.Second
+
+type checker func(c *http.Client) (*Notice, error)
+
+// Watch polls the provider metadata and calls onNotice once when the instance is going to be reclaimed.
+// It does nothing when no provider is configured
+func Watch(cfg config.PreemptionConfig, onNotice func(Notice)) {
+	var check checker
+	switch cfg.Provider {
+	case "":
+		return
+	case ProviderAWS:
+		check = checkAWS
+	case ProviderGCP:
+		check = checkGCP
+	case ProviderAzure:
+		check = checkAzure
+	default:
+		log.Println("Preemption: unknown provider", cfg.Provider)
+		return
+	}
+
+	log.Println("Preemption: watching", cfg.Provider, "metadata")
+	crash.Go("preemption watch", func() {
+		client := &http.Client{Timeout: 2 * time.Second}
+		for range time.Tick(time.Duration(cfg.Interval) * time.Second) {
+			notice, err := check(client)
+			if err != nil {
+				log.Println("Preemption:", err)
+				continue
+			}
+			if notice != nil {
+				log.Println("Preemption: instance is reclaimed at", notice.Time, notice.Action)
+				onNotice(*notice)
+				return
+			}
+		}
+	})
+}
+
+func get(c *http.Client, req *http.Request) (int, []byte, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// checkAWS reads the spot instance action with an IMDSv2 token, it's 404 until a notice is issued
+func checkAWS(c *http.Client) (*Notice, error) {
+	tokenReq, _ := http.NewRequest(http.MethodPut, awsTokenURL, nil)
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	status, token, err := get(c, tokenReq)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("aws token: status %d", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, awsInstanceAction, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	status, body, err := get(c, req)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("aws instance-action: status %d", status)
+	}
+	var action struct {
+		Action string    `json:"action"`
+		Time   time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(body, &action); err != nil {
+		return nil, err
+	}
+	return &Notice{Provider: ProviderAWS, Action: action.Action, Time: action.Time}, nil
+}
+
+func checkGCP(c *http.Client) (*Notice, error) {
+	req, _ := http.NewRequest(http.MethodGet, gcpPreempted, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	status, body, err := get(c, req)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("gcp preempted: status %d", status)
+	}
+	if strings.TrimSpace(string(body)) != "TRUE" {
+		return nil, nil
+	}
+	return &Notice{Provider: ProviderGCP, Action: "preempt", Time: time.Now().Add(defaultNoticePeriod)}, nil
+}
+
+func checkAzure(c *http.Client) (*Notice, error) {
+	req, _ := http.NewRequest(http.MethodGet, azureEvents, nil)
+	req.Header.Set("Metadata", "true")
+	status, body, err := get(c, req)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("azure scheduledevents: status %d", status)
+	}
+	var events struct {
+		Events []struct {
+			EventType string `json:"EventType"`
+			NotBefore string `json:"NotBefore"`
+		} `json:"Events"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, err
+	}
+	for _, e := range events.Events {
+		if e.EventType != "Preempt" {
+			continue
+		}
+		at, err := time.Parse(time.RFC1123, e.NotBefore)
+		if err != nil {
+			at = time.Now().Add(defaultNoticePeriod)
+		}
+		return &Notice{Provider: ProviderAzure, Action: "preempt", Time: at}, nil
+	}
+	return nil, nil
+}
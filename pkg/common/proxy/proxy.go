@@ -0,0 +1,99 @@
+// Package proxy makes the HTTP server work behind a reverse proxy like nginx or Traefik.
+// It takes client IPs from the forwarding headers of trusted proxies and serves under a base path
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// Handler wraps the handler of the HTTP server. RemoteAddr of requests through a trusted proxy
+// becomes the client address, so logs, analytics and limits see the user instead of the proxy
+func Handler(cfg config.ProxyConfig, next http.Handler) http.Handler {
+	trusted, err := cfg.TrustedNets()
+	if err != nil {
+		// ReadConfig validates them already
+		log.Println("Warn: forwarding headers are ignored:", err)
+	}
+	handler := next
+	if cfg.BasePath != "" {
+		handler = stripBasePath(cfg.BasePath, next)
+	}
+	if len(trusted) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r, trusted); ip != "" {
+			r.RemoteAddr = net.JoinHostPort(ip, "0")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// stripBasePath serves next under base, the base itself redirects to base/ so relative links of pages resolve
+func stripBasePath(base string, next http.Handler) http.Handler {
+	stripped := http.StripPrefix(base, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base {
+			target := base + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, base+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the client IP forwarded by a trusted peer, empty if the peer isn't trusted.
+// X-Forwarded-For is read from the right, skipping trusted proxies, so clients can't spoof it
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	if !isTrusted(hostIP(r.RemoteAddr), trusted) {
+		return ""
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				return ""
+			}
+			if i == 0 || !isTrusted(ip, trusted) {
+				return ip.String()
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func hostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
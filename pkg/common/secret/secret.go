@@ -0,0 +1,143 @@
+// Package secret resolves credentials of apps, e.g. license keys and logins, from the environment, files or Vault.
+// Config only holds references, values are resolved on the worker and never logged
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Ref is where a secret is read from, exactly one source is set
+type Ref struct {
+	// Env is a variable of the worker environment
+	Env string `yaml:"env"`
+	// File is read with surrounding whitespace trimmed, e.g. a mounted Docker or Kubernetes secret
+	File string `yaml:"file"`
+	// Vault is a path and key, e.g. secret/data/apps/notepad#license. KV v1 and v2 engines are supported
+	Vault string `yaml:"vault"`
+}
+
+// VaultConfig is the Vault server of vault refs. The token is read from VAULT_TOKEN, never from config
+type VaultConfig struct {
+	// Addr, e.g. https://vault:8200. Default: VAULT_ADDR
+	Addr string `yaml:"addr"`
+}
+
+// Validate checks the names and sources of secrets
+func Validate(refs map[string]Ref) error {
+	for name, ref := range refs {
+		if !namePattern.MatchString(name) {
+			return fmt.Errorf("secret %q: name must be an environment variable name", name)
+		}
+		sources := 0
+		for _, s := range []string{ref.Env, ref.File, ref.Vault} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return fmt.Errorf("secret %s: needs one of env, file or vault", name)
+		}
+		if ref.Vault != "" && !strings.Contains(ref.Vault, "#") {
+			return fmt.Errorf("secret %s: vault ref needs a key, e.g. secret/data/app#password", name)
+		}
+	}
+	return nil
+}
+
+// Resolve reads the values of secrets by name. Errors name the secret, not its value
+func Resolve(refs map[string]Ref, vault VaultConfig) (map[string]string, error) {
+	values := make(map[string]string, len(refs))
+	for name, ref := range refs {
+		var value string
+		var err error
+		switch {
+		case ref.Env != "":
+			var ok bool
+			if value, ok = os.LookupEnv(ref.Env); !ok {
+				err = fmt.Errorf("%s is not set", ref.Env)
+			}
+		case ref.File != "":
+			var b []byte
+			b, err = ioutil.ReadFile(ref.File)
+			value = strings.TrimSpace(string(b))
+		case ref.Vault != "":
+			value, err = readVault(vault, ref.Vault)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// Lookup returns a secret, then a variable of the worker environment, for os.Expand
+func Lookup(values map[string]string) func(string) string {
+	return func(name string) string {
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	}
+}
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func readVault(conf VaultConfig, ref string) (string, error) {
+	addr := conf.Addr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return "", fmt.Errorf("vault address is not set")
+	}
+	path, key := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		path, key = ref[:i], ref[i+1:]
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault %s: %w", path, err)
+	}
+	// KV v2 nests the values in data.data
+	data := body.Data
+	if nested, ok := data["data"]; ok && data["metadata"] != nil {
+		data = nil
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", fmt.Errorf("vault %s: %w", path, err)
+		}
+	}
+	raw, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("vault %s has no key %s", path, key)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("vault %s#%s is not a string", path, key)
+	}
+	return value, nil
+}
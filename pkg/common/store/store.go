@@ -0,0 +1,108 @@
+// Package store persists small collections of JSON records in a file, e.g. reservations and chat history
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store keeps collections of records by ID and writes them to a JSON file on every change
+type Store struct {
+	path string
+
+	mu          sync.Mutex
+	collections map[string]map[string]json.RawMessage
+}
+
+// Open loads the store file, it is created on the first write
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:        path,
+		collections: map[string]map[string]json.RawMessage{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.collections); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put stores the record v with the id in the collection
+func (s *Store) Put(collection string, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, ok := s.collections[collection]
+	if !ok {
+		records = map[string]json.RawMessage{}
+		s.collections[collection] = records
+	}
+	records[id] = data
+	return s.flush()
+}
+
+// Get decodes the record with the id into v. It returns false if it doesn't exist
+func (s *Store) Get(collection string, id string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	data, ok := s.collections[collection][id]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Delete removes the record with the id
+func (s *Store) Delete(collection string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.collections[collection][id]; !ok {
+		return nil
+	}
+	delete(s.collections[collection], id)
+	return s.flush()
+}
+
+// Each calls fn with every record of the collection
+func (s *Store) Each(collection string, fn func(id string, data json.RawMessage) error) error {
+	s.mu.Lock()
+	records := make(map[string]json.RawMessage, len(s.collections[collection]))
+	for id, data := range s.collections[collection] {
+		records[id] = data
+	}
+	s.mu.Unlock()
+	for id, data := range records {
+		if err := fn(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the store atomically, the caller holds the lock
+func (s *Store) flush() error {
+	data, err := json.Marshal(s.collections)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,92 @@
+// Package token signs and verifies HMAC-SHA256 tokens carrying JSON claims
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token is expired")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Claims are the registered claims every token has
+type Claims struct {
+	// Kind separates tokens of different purposes signed with the same secret
+	Kind string `json:"knd"`
+	// Expiry in unix seconds, 0 never expires
+	Exp int64 `json:"exp,omitempty"`
+}
+
+// Expired returns if the claims are expired
+func (c Claims) Expired() bool {
+	return c.Exp != 0 && time.Now().Unix() > c.Exp
+}
+
+// Signer signs and verifies tokens with a secret
+type Signer struct {
+	secret []byte
+}
+
+// NewSigner returns a signer of the secret. A random secret is used when it's empty, then tokens don't survive restarts
+func NewSigner(secret string) *Signer {
+	if secret != "" {
+		return &Signer{secret: []byte(secret)}
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return &Signer{secret: random}
+}
+
+func (s *Signer) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return encoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the token of claims, claims embed Claims
+func (s *Signer) Sign(claims interface{}) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := encoding.EncodeToString(data)
+	return payload + "." + s.sign(payload), nil
+}
+
+// Verify decodes the token into claims after checking its signature, kind and expiry
+func (s *Signer) Verify(token string, kind string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return ErrInvalid
+	}
+	if !hmac.Equal([]byte(s.sign(parts[0])), []byte(parts[1])) {
+		return ErrInvalid
+	}
+	data, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalid
+	}
+	var registered Claims
+	if err := json.Unmarshal(data, &registered); err != nil || registered.Kind != kind {
+		return ErrInvalid
+	}
+	if registered.Expired() {
+		return ErrExpired
+	}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return ErrInvalid
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Claims
+	User string `json:"user"`
+}
+
+func TestVerify(t *testing.T) {
+	s := NewSigner("secret")
+	tok, err := s.Sign(testClaims{Claims: Claims{Kind: "share", Exp: time.Now().Add(time.Minute).Unix()}, User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims testClaims
+	if err := s.Verify(tok, "share", &claims); err != nil || claims.User != "alice" {
+		t.Fatalf("verify returns %v with claims %+v", err, claims)
+	}
+	if err := s.Verify(tok, "admin", &testClaims{}); err != ErrInvalid {
+		t.Errorf("token of another kind: %v, want invalid", err)
+	}
+	if err := NewSigner("other").Verify(tok, "share", &testClaims{}); err != ErrInvalid {
+		t.Errorf("token of another key: %v, want invalid", err)
+	}
+	if err := NewSigner("").Verify(tok, "share", &testClaims{}); err != ErrInvalid {
+		t.Errorf("token of a random key: %v, want invalid", err)
+	}
+}
+
+// TestVerifyTampered checks a token whose payload changed is refused, e.g. a user raising its own role
+func TestVerifyTampered(t *testing.T) {
+	s := NewSigner("secret")
+	tok, _ := s.Sign(testClaims{Claims: Claims{Kind: "share"}, User: "alice"})
+	parts := strings.Split(tok, ".")
+	forged, _ := s.Sign(testClaims{Claims: Claims{Kind: "share"}, User: "mallory"})
+
+	for name, tampered := range map[string]string{
+		"swapped payload": strings.Split(forged, ".")[0] + "." + parts[1],
+		"no signature":    parts[0],
+		"empty signature": parts[0] + ".",
+		"extra part":      tok + ".x",
+		"bad payload":     "!!!." + s.sign("!!!"),
+	} {
+		if err := s.Verify(tampered, "share", &testClaims{}); err != ErrInvalid {
+			t.Errorf("%s: %v, want invalid", name, err)
+		}
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	s := NewSigner("secret")
+	expired, _ := s.Sign(testClaims{Claims: Claims{Kind: "share", Exp: time.Now().Add(-time.Second).Unix()}})
+	if err := s.Verify(expired, "share", &testClaims{}); err != ErrExpired {
+		t.Errorf("expired token: %v, want expired", err)
+	}
+	forever, _ := s.Sign(testClaims{Claims: Claims{Kind: "share"}})
+	if err := s.Verify(forever, "share", &testClaims{}); err != nil {
+		t.Errorf("token without expiry: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/giongto35/cloud-morph/pkg/common/monitoring"
+	"github.com/giongto35/cloud-morph/pkg/common/mtls"
+	"github.com/gorilla/mux"
+)
+
+// registerAdminAPI adds admin endpoints under /api/admin. They are disabled without adminToken
+func (s *Server) registerAdminAPI(r *mux.Router, adminToken string) {
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	if adminToken == "" {
+		log.Println("Admin API is disabled, set adminToken to enable it")
+		admin.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "admin API is disabled", http.StatusForbidden)
+		})
+		return
+	}
+	admin.Use(func(next http.Handler) http.Handler {
+		return monitoring.RequireAuth("", "", adminToken, next)
+	})
+
+	admin.HandleFunc("/announcements", s.handleAnnounce).Methods(http.MethodPost)
+	admin.HandleFunc("/announcements", s.handleListAnnouncements).Methods(http.MethodGet)
+	admin.HandleFunc("/announcements/{id}", s.handleCancelAnnouncement).Methods(http.MethodDelete)
+	admin.HandleFunc("/motd", s.handleSetMOTD).Methods(http.MethodPut)
+	admin.HandleFunc("/drain", s.handleDrain).Methods(http.MethodPost)
+	admin.HandleFunc("/drain", s.handleDrainStatus).Methods(http.MethodGet)
+	admin.HandleFunc("/capacity", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Capacity())
+	}).Methods(http.MethodGet)
+	admin.HandleFunc("/reservations", s.handleReserve).Methods(http.MethodPost)
+	admin.HandleFunc("/reservations", s.handleListReservations).Methods(http.MethodGet)
+	admin.HandleFunc("/reservations/{id}", s.handleCancelReservation).Methods(http.MethodDelete)
+	admin.HandleFunc("/clips", s.handleCaptureClip).Methods(http.MethodPost)
+	admin.HandleFunc("/clips", s.handleListClips).Methods(http.MethodGet)
+	admin.HandleFunc("/tokens", s.handleIssueAPIToken).Methods(http.MethodPost)
+	admin.HandleFunc("/tokens", s.handleListAPITokens).Methods(http.MethodGet)
+	admin.HandleFunc("/tokens/{id}", s.handleRevokeAPIToken).Methods(http.MethodDelete)
+	admin.HandleFunc("/shares", s.handleListShares).Methods(http.MethodGet)
+	admin.HandleFunc("/shares/{id}", s.handleRevokeShare).Methods(http.MethodDelete)
+	admin.HandleFunc("/recordings", s.handleListRecordings).Methods(http.MethodGet)
+	admin.HandleFunc("/recordings/{name}", s.handleRecordingFile).Methods(http.MethodGet)
+	admin.HandleFunc("/signaling", s.handleListSignaling).Methods(http.MethodGet)
+	admin.HandleFunc("/signaling/{name}", s.handleSignalingFile).Methods(http.MethodGet)
+	admin.HandleFunc("/replay", s.handleReplay).Methods(http.MethodPost)
+	admin.HandleFunc("/replay", s.handleReplayStatus).Methods(http.MethodGet)
+	admin.HandleFunc("/replay", s.handleStopReplay).Methods(http.MethodDelete)
+	admin.HandleFunc("/attach", s.handleAdminAttach).Methods(http.MethodPost)
+	admin.HandleFunc("/capture", s.handleGetCapture).Methods(http.MethodGet)
+	admin.HandleFunc("/capture", s.handleSetCapture).Methods(http.MethodPut)
+	admin.HandleFunc("/refocus", s.handleRefocus).Methods(http.MethodPost)
+	admin.HandleFunc("/encoder", s.handleGetEncoder).Methods(http.MethodGet)
+	admin.HandleFunc("/encoder", s.handleSetEncoder).Methods(http.MethodPut)
+	admin.HandleFunc("/features", s.handleListFeatures).Methods(http.MethodGet)
+	admin.HandleFunc("/features/{name}", s.handleSetFeature).Methods(http.MethodPut)
+	admin.HandleFunc("/features/{name}", s.handleResetFeature).Methods(http.MethodDelete)
+	admin.HandleFunc("/queue", s.handleGetQueue).Methods(http.MethodGet)
+	admin.HandleFunc("/queue/move", s.handleMoveInQueue).Methods(http.MethodPost)
+	admin.HandleFunc("/queue/freeze", s.handleFreezeQueue).Methods(http.MethodPost)
+	admin.HandleFunc("/bans", s.handleBan).Methods(http.MethodPost)
+	admin.HandleFunc("/bans", s.handleListBans).Methods(http.MethodGet)
+	admin.HandleFunc("/bans/{id}", s.handleUpdateBan).Methods(http.MethodPatch)
+	admin.HandleFunc("/bans/{id}", s.handleLiftBan).Methods(http.MethodDelete)
+	admin.HandleFunc("/sessions", s.handleListSessions).Methods(http.MethodGet)
+	admin.HandleFunc("/regions", s.handleRegions).Methods(http.MethodGet)
+	admin.HandleFunc("/sessions/{id}/diagnostics", s.handleDiagnostics).Methods(http.MethodGet)
+	if s.capp.config.Chaos {
+		log.Println("Warn: chaos is enabled, admins can impair the streams of sessions")
+		admin.HandleFunc("/sessions/{id}/chaos", s.handleSetChaos).Methods(http.MethodPut)
+		admin.HandleFunc("/sessions/{id}/chaos", s.handleClearChaos).Methods(http.MethodDelete)
+	}
+	admin.HandleFunc("/pristine", s.handleSnapshotPristine).Methods(http.MethodPost)
+	admin.HandleFunc("/migrate", s.handleMigrate).Methods(http.MethodPost)
+	admin.Handle("/migration/{id}", s.fleetOnly(s.handleMigrationStatus)).Methods(http.MethodGet)
+	admin.Handle("/migration/{id}/chunk", s.fleetOnly(s.handleMigrationChunk)).Methods(http.MethodPost)
+	admin.Handle("/migration/{id}/restore", s.fleetOnly(s.handleMigrationRestore)).Methods(http.MethodPost)
+}
+
+// fleetOnly lets only workers of the fleet call the handler when fleet TLS is on, a leaked admin token
+// can't push sessions into the worker
+func (s *Server) fleetOnly(next http.HandlerFunc) http.Handler {
+	if !s.fleetTLS {
+		return next
+	}
+	return mtls.Require(next)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to write response", err)
+	}
+}
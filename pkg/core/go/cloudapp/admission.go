@@ -0,0 +1,161 @@
+package cloudapp
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/i18n"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+var (
+	admissionQueueDepth = metrics.NewGauge("cloudmorph_admission_queue_depth", "New sessions waiting for capacity")
+	sessionsRefused     = metrics.NewCounter("cloudmorph_sessions_refused_total", "New sessions refused because the worker is saturated")
+)
+
+// admission queues new sessions while the worker is saturated, so existing sessions keep their quality
+type admission struct {
+	limits    config.CapacityConfig
+	collector *capacity.Collector
+	sessions  func() int
+	// reserved returns slots held for reservations
+	reserved func() int
+	messages *i18n.Catalog
+
+	mu    sync.Mutex
+	usage capacity.Report
+	queue []string
+	// admitted counts the slots of admitted clients whose session hasn't started yet,
+	// so clients joining at once don't all pass before the first one counts as a session
+	admitted int
+}
+
+func newAdmission(limits config.CapacityConfig, sessions func() int, reserved func() int, messages *i18n.Catalog) *admission {
+	a := &admission{
+		limits:    limits,
+		collector: capacity.NewCollector(limits),
+		sessions:  sessions,
+		reserved:  reserved,
+		messages:  messages,
+	}
+	a.usage = a.collector.Collect(sessions())
+	crash.Go("admission", func() {
+		for range time.Tick(time.Duration(limits.HeartbeatInterval) * time.Second) {
+			usage := a.collector.Collect(a.sessions())
+			a.mu.Lock()
+			a.usage = usage
+			a.mu.Unlock()
+		}
+	})
+	return a
+}
+
+// Report returns the latest resource usage with the current number of sessions
+func (a *admission) Report() capacity.Report {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reportLocked()
+}
+
+// reportLocked counts admitted clients as sessions. The caller holds mu
+func (a *admission) reportLocked() capacity.Report {
+	r := a.usage
+	r.Sessions = a.sessions() + a.admitted
+	r.ReservedSlots = a.reserved()
+	r.Saturated = r.IsSaturated(a.limits)
+	return r
+}
+
+// Admit returns when the client can start its session, with the release of the slot it takes.
+// The slot is released when the session starts and counts itself, or when the client leaves before.
+// While saturated the client waits in queue with QUEUE position updates, and gets CAPACITY when the queue timeout passes
+func (a *admission) Admit(client *cws.Client) (func(), bool) {
+	id := client.GetID()
+	a.mu.Lock()
+	if len(a.queue) == 0 && !a.reportLocked().Saturated {
+		a.admitted++
+		a.mu.Unlock()
+		return a.release(), true
+	}
+	a.queue = append(a.queue, id)
+	admissionQueueDepth.Set(int64(len(a.queue)))
+	a.mu.Unlock()
+	defer a.dequeue(id)
+
+	log.Println("Worker is saturated, queue session", id)
+	lastPos := -1
+	timeout := time.After(time.Duration(a.limits.QueueTimeout) * time.Second)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if a.admitFirst(id) {
+			return a.release(), true
+		}
+		pos := a.position(id)
+		if pos != lastPos {
+			client.Send(cws.WSPacket{Type: "QUEUE", Data: strconv.Itoa(pos + 1)}, nil)
+			lastPos = pos
+		}
+		select {
+		case <-client.Done:
+			return nil, false
+		case <-timeout:
+			sessionsRefused.Inc()
+			client.Send(cws.WSPacket{Type: "CAPACITY", Data: a.messages.T(client.Locale(), "The server is at capacity, please try again later")}, nil)
+			return nil, false
+		case <-ticker.C:
+		}
+	}
+}
+
+// admitFirst takes a slot for the client when it's first in queue and the worker has capacity
+func (a *admission) admitFirst(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.queue) == 0 || a.queue[0] != id || a.reportLocked().Saturated {
+		return false
+	}
+	a.admitted++
+	return true
+}
+
+// release returns the release of an admitted slot, it can be called more than once
+func (a *admission) release() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			a.admitted--
+			a.mu.Unlock()
+		})
+	}
+}
+
+func (a *admission) position(id string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, queued := range a.queue {
+		if queued == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *admission) dequeue(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, queued := range a.queue {
+		if queued == id {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			break
+		}
+	}
+	admissionQueueDepth.Set(int64(len(a.queue)))
+}
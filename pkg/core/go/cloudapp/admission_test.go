@@ -0,0 +1,42 @@
+package cloudapp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// TestAdmitReservesSlot checks an admitted client takes its slot right away, before its session starts
+func TestAdmitReservesSlot(t *testing.T) {
+	limits := config.CapacityConfig{MaxSessions: 2, MaxCPU: 101, MaxMemory: 101, HeartbeatInterval: 60}
+	a := newAdmission(limits, func() int { return 0 }, func() int { return 0 }, nil)
+
+	var wg sync.WaitGroup
+	releases := make(chan func(), 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, ok := a.Admit(cws.NewClient(nil))
+			if !ok {
+				t.Error("client isn't admitted below the limit")
+				return
+			}
+			releases <- release
+		}()
+	}
+	wg.Wait()
+	close(releases)
+	if r := a.Report(); r.Sessions != 2 || !r.Saturated {
+		t.Fatalf("report is %+v after admitting 2 clients, want saturated", r)
+	}
+
+	release := <-releases
+	release()
+	release()
+	if r := a.Report(); r.Sessions != 1 || r.Saturated {
+		t.Fatalf("report is %+v after a slot was released twice, want 1 session", r)
+	}
+}
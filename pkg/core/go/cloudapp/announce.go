@@ -0,0 +1,194 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	announceInfo        = "info"
+	announceWarning     = "warning"
+	announceMaintenance = "maintenance"
+)
+
+// Announcement is the payload of ANNOUNCE packet rendered as an overlay by the frontend
+type Announcement struct {
+	ID      string    `json:"id"`
+	Message string    `json:"message"`
+	Level   string    `json:"level"`
+	At      time.Time `json:"at"`
+	// Clients are disconnected at this time, the frontend shows a countdown
+	DisconnectAt *time.Time `json:"disconnect_at,omitempty"`
+}
+
+// announcer keeps message of the day and scheduled announcements
+type announcer struct {
+	mu        sync.Mutex
+	motd      string
+	scheduled map[string]*scheduledAnnouncement
+	broadcast func(Announcement)
+	// disconnectAll ends all sessions at the end of maintenance countdown
+	disconnectAll func()
+}
+
+type scheduledAnnouncement struct {
+	Announcement
+	timers []*time.Timer
+}
+
+func newAnnouncer(motd string, broadcast func(Announcement), disconnectAll func()) *announcer {
+	return &announcer{
+		motd:          motd,
+		scheduled:     map[string]*scheduledAnnouncement{},
+		broadcast:     broadcast,
+		disconnectAll: disconnectAll,
+	}
+}
+
+// MOTD returns the message of the day as an announcement, nil if it's empty
+func (a *announcer) MOTD() *Announcement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.motd == "" {
+		return nil
+	}
+	return &Announcement{ID: "motd", Message: a.motd, Level: announceInfo, At: time.Now()}
+}
+
+func (a *announcer) SetMOTD(motd string) {
+	a.mu.Lock()
+	a.motd = motd
+	a.mu.Unlock()
+}
+
+// Schedule broadcasts the announcement at its time. With DisconnectAt, clients are disconnected after the countdown
+func (a *announcer) Schedule(ann Announcement) Announcement {
+	ann.ID = uuid.Must(uuid.NewV4()).String()
+	if ann.Level == "" {
+		ann.Level = announceInfo
+	}
+	if ann.At.IsZero() {
+		ann.At = time.Now()
+	}
+	if ann.DisconnectAt != nil {
+		ann.Level = announceMaintenance
+	}
+
+	sa := &scheduledAnnouncement{Announcement: ann}
+	sa.timers = append(sa.timers, time.AfterFunc(time.Until(ann.At), func() {
+		log.Println("Announce:", ann.Message)
+		a.broadcast(ann)
+		if ann.DisconnectAt == nil {
+			a.remove(ann.ID)
+		}
+	}))
+	if ann.DisconnectAt != nil {
+		sa.timers = append(sa.timers, time.AfterFunc(time.Until(*ann.DisconnectAt), func() {
+			log.Println("Maintenance: disconnecting all clients")
+			a.disconnectAll()
+			a.remove(ann.ID)
+		}))
+	}
+
+	a.mu.Lock()
+	a.scheduled[ann.ID] = sa
+	a.mu.Unlock()
+	return ann
+}
+
+// Cancel stops a scheduled announcement and its forced disconnect
+func (a *announcer) Cancel(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sa, ok := a.scheduled[id]
+	if !ok {
+		return false
+	}
+	for _, t := range sa.timers {
+		t.Stop()
+	}
+	delete(a.scheduled, id)
+	return true
+}
+
+// List returns pending announcements
+func (a *announcer) List() []Announcement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]Announcement, 0, len(a.scheduled))
+	for _, sa := range a.scheduled {
+		list = append(list, sa.Announcement)
+	}
+	return list
+}
+
+func (a *announcer) remove(id string) {
+	a.mu.Lock()
+	delete(a.scheduled, id)
+	a.mu.Unlock()
+}
+
+func announcePacket(ann Announcement) cws.WSPacket {
+	data, _ := json.Marshal(ann)
+	return cws.WSPacket{Type: "ANNOUNCE", Data: string(data)}
+}
+
+// announceRequest is the body of POST /api/admin/announcements
+type announceRequest struct {
+	Message string `json:"message"`
+	Level   string `json:"level"`
+	// Optional RFC3339 time to broadcast, default now
+	At time.Time `json:"at"`
+	// Optional countdown in seconds from At before all clients are disconnected
+	DisconnectIn int `json:"disconnect_in"`
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	var req announceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	ann := Announcement{Message: req.Message, Level: req.Level, At: req.At}
+	if req.DisconnectIn > 0 {
+		at := req.At
+		if at.IsZero() {
+			at = time.Now()
+		}
+		disconnectAt := at.Add(time.Duration(req.DisconnectIn) * time.Second)
+		ann.DisconnectAt = &disconnectAt
+	}
+	writeJSON(w, s.capp.announcer.Schedule(ann))
+}
+
+func (s *Server) handleListAnnouncements(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.capp.announcer.List())
+}
+
+func (s *Server) handleCancelAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if !s.capp.announcer.Cancel(mux.Vars(r)["id"]) {
+		http.Error(w, "announcement not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) handleSetMOTD(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.capp.announcer.SetMOTD(req.Message)
+}
@@ -0,0 +1,179 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/store"
+	"github.com/giongto35/cloud-morph/pkg/common/token"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+// tokenKindAPI tokens are issued by admins to headless clients, e.g. bots, test harnesses and kiosks
+const tokenKindAPI = "api"
+
+const apiTokenCollection = "api_tokens"
+
+var errAPITokenRevoked = errors.New("api token is revoked")
+
+// APIToken authenticates a programmatic client. The token itself is only returned when it's created
+type APIToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is zero for tokens which never expire
+	ExpiresAt time.Time        `json:"expires_at"`
+	Audience  catalog.Audience `json:"audience"`
+	Token     string           `json:"token,omitempty"`
+}
+
+type apiClaims struct {
+	token.Claims
+	TokenID string `json:"tid"`
+	catalog.Audience
+}
+
+// apiTokens keeps issued API tokens, revoked tokens are removed from the store
+type apiTokens struct {
+	signer *token.Signer
+	store  *store.Store
+
+	mu     sync.Mutex
+	tokens map[string]APIToken
+}
+
+func newAPITokens(signer *token.Signer, st *store.Store) *apiTokens {
+	a := &apiTokens{signer: signer, store: st, tokens: map[string]APIToken{}}
+	err := st.Each(apiTokenCollection, func(id string, data json.RawMessage) error {
+		var t APIToken
+		if err := json.Unmarshal(data, &t); err != nil {
+			return err
+		}
+		a.tokens[id] = t
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to load API tokens:", err)
+	}
+	return a
+}
+
+func (a *apiTokens) issue(name string, audience catalog.Audience, ttl time.Duration) (APIToken, error) {
+	t := APIToken{
+		ID:        uuid.Must(uuid.NewV4()).String(),
+		Name:      name,
+		CreatedAt: time.Now(),
+		Audience:  audience,
+	}
+	claims := apiClaims{Claims: token.Claims{Kind: tokenKindAPI}, TokenID: t.ID, Audience: audience}
+	if ttl > 0 {
+		t.ExpiresAt = t.CreatedAt.Add(ttl)
+		claims.Exp = t.ExpiresAt.Unix()
+	}
+	if err := a.store.Put(apiTokenCollection, t.ID, t); err != nil {
+		return t, err
+	}
+	a.mu.Lock()
+	a.tokens[t.ID] = t
+	a.mu.Unlock()
+	tok, err := a.signer.Sign(claims)
+	if err != nil {
+		return t, err
+	}
+	t.Token = tok
+	return t, nil
+}
+
+// verify returns the API token of tok if it's valid and not revoked
+func (a *apiTokens) verify(tok string) (APIToken, error) {
+	var claims apiClaims
+	if err := a.signer.Verify(tok, tokenKindAPI, &claims); err != nil {
+		return APIToken{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.tokens[claims.TokenID]
+	if !ok {
+		return APIToken{}, errAPITokenRevoked
+	}
+	return t, nil
+}
+
+func (a *apiTokens) revoke(id string) (bool, error) {
+	a.mu.Lock()
+	_, ok := a.tokens[id]
+	delete(a.tokens, id)
+	a.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, a.store.Delete(apiTokenCollection, id)
+}
+
+func (a *apiTokens) list() []APIToken {
+	a.mu.Lock()
+	list := make([]APIToken, 0, len(a.tokens))
+	for _, t := range a.tokens {
+		list = append(list, t)
+	}
+	a.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// apiTokenRequest is the body of the token admin API
+type apiTokenRequest struct {
+	Name string `json:"name"`
+	// TTL in hours, 0 never expires
+	TTL   int      `json:"ttl"`
+	Age   int      `json:"age"`
+	Roles []string `json:"roles"`
+}
+
+func (s *Server) handleIssueAPIToken(w http.ResponseWriter, r *http.Request) {
+	var req apiTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "api token needs a name", http.StatusBadRequest)
+		return
+	}
+	t, err := s.apiTokens.issue(req.Name, catalog.Audience{Age: req.Age, Roles: req.Roles}, time.Duration(req.TTL)*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Println("Issued API token", t.ID, "for", t.Name)
+	writeJSON(w, t)
+}
+
+func (s *Server) handleListAPITokens(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.apiTokens.list())
+}
+
+func (s *Server) handleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	ok, err := s.apiTokens.revoke(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
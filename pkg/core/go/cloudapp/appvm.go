@@ -0,0 +1,88 @@
+package cloudapp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// syncinputPort is where syncinput in the app VM connects to the worker
+	syncinputPort = 9090
+	// supervisordPort is the XML-RPC port of supervisord in the app VM
+	supervisordPort = 9001
+	// roomPortStride separates the UDP ports of instances, RTCP takes the port after each RTP port
+	roomPortStride = 10
+	// defaultDisplay is the X display number of the default instance
+	defaultDisplay = 99
+)
+
+// appVM is the container of an instance of the app and the host ports it talks to the worker on.
+// App VMs share the network of the host, X displays included, so the instances of rooms offset the ports
+// and the display of the default instance by their slot
+type appVM struct {
+	// slot is 0 for the default instance, rooms take 1 to rooms.max
+	slot int
+}
+
+func (vm appVM) name() string {
+	if vm.slot == 0 {
+		return "appvm"
+	}
+	return fmt.Sprintf("appvm-%d", vm.slot)
+}
+
+func (vm appVM) display() string {
+	return ":" + strconv.Itoa(defaultDisplay+vm.slot)
+}
+
+func (vm appVM) videoPort() int {
+	return startVideoRTPPort + vm.slot*roomPortStride
+}
+
+func (vm appVM) audioPort() int {
+	return startAudioRTPPort + vm.slot*roomPortStride
+}
+
+func (vm appVM) progressPort() int {
+	return encoderProgressPort + vm.slot*roomPortStride
+}
+
+func (vm appVM) inputPort() int {
+	return syncinputPort + vm.slot
+}
+
+func (vm appVM) rpcURL() string {
+	return fmt.Sprintf("http://127.0.0.1:%d/RPC2", supervisordPort+vm.slot)
+}
+
+// metricsApp is the app label of the metrics of the instance, rooms are told apart by their slot
+func (vm appVM) metricsApp(app string) string {
+	if vm.slot == 0 {
+		return app
+	}
+	return app + "#" + strconv.Itoa(vm.slot)
+}
+
+// volume keeps the Wine prefix of the default instance across launches, rooms start with a clean one
+func (vm appVM) volume() string {
+	if vm.slot == 0 {
+		return "winecfg"
+	}
+	return ""
+}
+
+// overlayDir is where the encoder finds the overlay text. The apps directory is shared by all app VMs,
+// the overlay of the default session stays off the streams of rooms
+func (vm appVM) overlayDir() string {
+	if vm.slot == 0 {
+		return "/apps/.overlay"
+	}
+	return ""
+}
+
+// params are the arguments of run-wine.sh after the app ones
+func (vm appVM) params() []string {
+	return []string{vm.name(), vm.display(), strconv.Itoa(vm.videoPort()), strconv.Itoa(vm.audioPort()),
+		strconv.Itoa(vm.progressPort()), strconv.Itoa(vm.inputPort()), strconv.Itoa(supervisordPort + vm.slot), vm.volume(),
+		vm.overlayDir()}
+}
@@ -0,0 +1,146 @@
+package cloudapp
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/analytics"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/monitoring"
+	"github.com/giongto35/cloud-morph/pkg/common/token"
+)
+
+var errAssistTaken = errors.New("another admin has control")
+
+// tokenKindAdmin is the kind of the tokens attaching admins to the session
+const tokenKindAdmin = "admin"
+
+// adminAttachTTL is how long an attach token is valid. It only has to last until the page connects,
+// the admin token never goes into URLs where proxies and browser history keep it
+const adminAttachTTL = time.Minute
+
+// adminAttach is an issued attach token and the page attaching with it
+type adminAttach struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// assist lets admins watch any session invisibly and take over input to help the user.
+// One admin has control at a time, users get input back when the admin hands it back or leaves
+type assist struct {
+	mu sync.Mutex
+	// controller is the client ID of the admin in control, empty when users have control
+	controller string
+}
+
+func (a *assist) active() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.controller != ""
+}
+
+// isAdmin checks if a websocket connection is an admin's: pages attach with a short-lived token of the admin API
+// in ?admin=, tools send the admin token in the Authorization header
+func (s *Server) isAdmin(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	if tok := r.URL.Query().Get("admin"); tok != "" {
+		return s.signer.Verify(tok, tokenKindAdmin, &token.Claims{}) == nil
+	}
+	return monitoring.IsAdminToken(r, s.adminToken)
+}
+
+// handleAdminAttach issues a token attaching the admin to the session, the page of its URL attaches right away
+func (s *Server) handleAdminAttach(w http.ResponseWriter, r *http.Request) {
+	expiresAt := time.Now().Add(adminAttachTTL)
+	tok, err := s.signer.Sign(token.Claims{Kind: tokenKindAdmin, Exp: expiresAt.Unix()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, adminAttach{Token: tok, URL: s.publicURL + "/embed?admin=" + tok, ExpiresAt: expiresAt})
+}
+
+// wsAdmin attaches an admin to the session. Admins take no session slot and other clients are not told about them
+func (s *Server) wsAdmin(wsClient *cws.Client, remoteAddr string) {
+	clientID := wsClient.GetID()
+	admin := s.capp.AddClient(clientID, wsClient)
+	admin.SetViewOnly(true)
+	s.audit(analytics.EventAdminAttach, clientID, remoteAddr)
+	wsClient.Send(cws.WSPacket{Type: "ADMIN_ATTACHED"}, nil)
+
+	wsClient.Receive("ASSIST_START", func(req cws.WSPacket) cws.WSPacket {
+		if s.kiosk.Enabled {
+			return cws.WSPacket{Type: "ASSIST_DENIED", Data: s.text(wsClient, errKioskLocked.Error())}
+		}
+		if err := s.takeControl(admin, remoteAddr); err != nil {
+			return cws.WSPacket{Type: "ASSIST_DENIED", Data: s.text(wsClient, err.Error())}
+		}
+		return cws.WSPacket{Type: "ASSIST_GRANTED"}
+	})
+	wsClient.Receive("ASSIST_STOP", func(req cws.WSPacket) cws.WSPacket {
+		s.handBack(admin, remoteAddr)
+		return cws.WSPacket{Type: "ASSIST_RETURNED"}
+	})
+	if s.queue != nil {
+		s.routeQueueModeration(wsClient)
+	}
+	admin.Route()
+
+	crash.Go("admin session", func() {
+		<-wsClient.Done
+		wsClient.Close()
+		s.handBack(admin, remoteAddr)
+		s.capp.RemoveClient(clientID)
+		s.audit(analytics.EventAdminDetach, clientID, remoteAddr)
+	}, "client", wsClient.GetID())
+}
+
+// takeControl gives input to the admin and takes it away from everyone else
+func (s *Server) takeControl(admin *Client, remoteAddr string) error {
+	s.assist.mu.Lock()
+	defer s.assist.mu.Unlock()
+	switch s.assist.controller {
+	case admin.clientID:
+		return nil
+	case "":
+	default:
+		return errAssistTaken
+	}
+	s.assist.controller = admin.clientID
+	s.capp.SuspendInput(admin.clientID, true)
+	admin.SetViewOnly(false)
+	s.capp.Broadcast(cws.WSPacket{Type: "ASSIST", Data: "on"})
+	s.audit(analytics.EventAssistStart, admin.clientID, remoteAddr)
+	return nil
+}
+
+// handBack returns input to the users if the admin has control
+func (s *Server) handBack(admin *Client, remoteAddr string) {
+	s.assist.mu.Lock()
+	defer s.assist.mu.Unlock()
+	if s.assist.controller != admin.clientID {
+		return
+	}
+	s.assist.controller = ""
+	admin.SetViewOnly(true)
+	s.capp.SuspendInput(admin.clientID, false)
+	s.capp.Broadcast(cws.WSPacket{Type: "ASSIST", Data: "off"})
+	s.audit(analytics.EventAssistStop, admin.clientID, remoteAddr)
+}
+
+func (s *Server) audit(eventType string, clientID string, remoteAddr string) {
+	log.Printf("Audit: %s by admin %s from %s", eventType, clientID, remoteAddr)
+	s.capp.events.Publish(TopicSession, analytics.Event{
+		Type:       eventType,
+		ClientID:   clientID,
+		AppName:    s.appMeta.AppName,
+		RemoteAddr: remoteAddr,
+	})
+}
@@ -0,0 +1,81 @@
+package cloudapp
+
+import (
+	"net/http"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/token"
+)
+
+// tokenKindUser tokens are issued by the community site with tokenSecret, carrying age and roles of the user
+const tokenKindUser = "user"
+
+type userClaims struct {
+	token.Claims
+	catalog.Audience
+	// Subject is the ID of the user on the community site, it keeps the preferences of the user
+	Subject string `json:"sub,omitempty"`
+	// Name is shown in overlays of the stream
+	Name string `json:"name,omitempty"`
+}
+
+// Audience returns the audience of the user token in the user query or the bearer header,
+// which can also be an API token. Requests without a valid token are anonymous, of unknown age and without roles
+func (s *Server) Audience(r *http.Request) catalog.Audience {
+	_, audience, _ := s.user(r)
+	return audience
+}
+
+// TokenAudience returns the audience of user tokens signed with the secret, for relays without an app instance.
+// API tokens are only known to the workers issuing them, their clients are anonymous to relays
+func TokenAudience(secret string) func(r *http.Request) catalog.Audience {
+	signer := token.NewSigner(secret)
+	return func(r *http.Request) catalog.Audience {
+		var claims userClaims
+		if err := signer.Verify(r.URL.Query().Get("user"), tokenKindUser, &claims); err != nil {
+			return catalog.Audience{}
+		}
+		return claims.Audience
+	}
+}
+
+// user returns the ID and audience of the user of the request, and if it carries a valid token.
+// The ID is empty for anonymous users and user tokens without subject, API clients are identified by their token
+func (s *Server) user(r *http.Request) (string, catalog.Audience, bool) {
+	id, _, audience, ok := s.identify(r)
+	return id, audience, ok
+}
+
+// identify is user with the display name of the user
+func (s *Server) identify(r *http.Request) (id string, name string, audience catalog.Audience, ok bool) {
+	tok := r.URL.Query().Get("user")
+	if tok == "" {
+		tok = bearerToken(r)
+	}
+	if tok == "" {
+		return "", "", catalog.Audience{}, false
+	}
+	var claims userClaims
+	if err := s.signer.Verify(tok, tokenKindUser, &claims); err == nil {
+		return claims.userID(), claims.name(), claims.Audience, true
+	}
+	if t, err := s.apiTokens.verify(tok); err == nil {
+		return tokenKindAPI + ":" + t.ID, t.Name, t.Audience, true
+	}
+	return "", "", catalog.Audience{}, false
+}
+
+func (c userClaims) userID() string {
+	if c.Subject == "" {
+		return ""
+	}
+	return tokenKindUser + ":" + c.Subject
+}
+
+// name is the display name of the user, the subject when the token has no name
+func (c userClaims) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Subject
+}
@@ -0,0 +1,376 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/store"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+const banCollection = "bans"
+
+// Statuses of ban appeals, accepted appeals lift the ban
+const (
+	appealPending  = "pending"
+	appealRejected = "rejected"
+)
+
+var (
+	errAppealStatus  = errors.New("appeal_status is pending or rejected, lift the ban to accept the appeal")
+	errBanTarget     = errors.New("a ban needs a client_id, ip or user_id")
+	errBanIP         = errors.New("ip is neither an address nor a CIDR network")
+	errBanNotFound   = errors.New("ban not found")
+	errAppealExists  = errors.New("the ban is already appealed")
+	errAppealMissing = errors.New("the ban has no appeal")
+)
+
+// Ban keeps a session, an IP or network, or a user out of the instance until it expires or is lifted
+type Ban struct {
+	ID       string `json:"id"`
+	ClientID string `json:"client_id,omitempty"`
+	// IP is an address or a CIDR network
+	IP     string `json:"ip,omitempty"`
+	UserID string `json:"user_id,omitempty"`
+	Reason string `json:"reason"`
+	// ExpiresAt is zero for permanent bans
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Appeal    *BanAppeal `json:"appeal,omitempty"`
+}
+
+// BanAppeal is the request of a banned user to lift the ban
+type BanAppeal struct {
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+	Status    string    `json:"status"`
+	// Response of the admin shown to the user
+	Response string `json:"response,omitempty"`
+}
+
+func (b Ban) expired() bool {
+	return !b.ExpiresAt.IsZero() && time.Now().After(b.ExpiresAt)
+}
+
+func (b Ban) matches(clientID string, ip net.IP, userID string) bool {
+	switch {
+	case b.ClientID != "":
+		return b.ClientID == clientID
+	case b.UserID != "":
+		return b.UserID == userID
+	case b.IP != "" && ip != nil:
+		if _, network, err := net.ParseCIDR(b.IP); err == nil {
+			return network.Contains(ip)
+		}
+		return net.ParseIP(b.IP).Equal(ip)
+	}
+	return false
+}
+
+func (b Ban) validate() error {
+	if b.ClientID == "" && b.IP == "" && b.UserID == "" {
+		return errBanTarget
+	}
+	if b.IP != "" && net.ParseIP(b.IP) == nil {
+		if _, _, err := net.ParseCIDR(b.IP); err != nil {
+			return errBanIP
+		}
+	}
+	return nil
+}
+
+// bans are kept in the store across restarts, expired bans are removed when they're looked at
+type bans struct {
+	store *store.Store
+
+	mu   sync.Mutex
+	bans map[string]Ban
+}
+
+func newBans(st *store.Store) *bans {
+	b := &bans{store: st, bans: map[string]Ban{}}
+	err := st.Each(banCollection, func(id string, data json.RawMessage) error {
+		var ban Ban
+		if err := json.Unmarshal(data, &ban); err != nil {
+			return err
+		}
+		b.bans[id] = ban
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to load bans:", err)
+	}
+	return b
+}
+
+func (b *bans) add(ban Ban) (Ban, error) {
+	if err := ban.validate(); err != nil {
+		return ban, err
+	}
+	ban.ID = uuid.Must(uuid.NewV4()).String()
+	ban.CreatedAt = time.Now()
+	ban.Appeal = nil
+	if err := b.store.Put(banCollection, ban.ID, ban); err != nil {
+		return ban, err
+	}
+	b.mu.Lock()
+	b.bans[ban.ID] = ban
+	b.mu.Unlock()
+	return ban, nil
+}
+
+// match returns the ban of the session, IP or user
+func (b *bans) match(clientID string, ip net.IP, userID string) (Ban, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, ban := range b.bans {
+		if ban.expired() {
+			b.removeLocked(id)
+			continue
+		}
+		if ban.matches(clientID, ip, userID) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+func (b *bans) list() []Ban {
+	b.mu.Lock()
+	list := make([]Ban, 0, len(b.bans))
+	for id, ban := range b.bans {
+		if ban.expired() {
+			b.removeLocked(id)
+			continue
+		}
+		list = append(list, ban)
+	}
+	b.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// update changes the ban with fn and saves it
+func (b *bans) update(id string, fn func(*Ban) error) (Ban, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, ok := b.bans[id]
+	if !ok || ban.expired() {
+		return Ban{}, errBanNotFound
+	}
+	if err := fn(&ban); err != nil {
+		return Ban{}, err
+	}
+	if err := ban.validate(); err != nil {
+		return Ban{}, err
+	}
+	if err := b.store.Put(banCollection, id, ban); err != nil {
+		return Ban{}, err
+	}
+	b.bans[id] = ban
+	return ban, nil
+}
+
+func (b *bans) lift(id string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.bans[id]; !ok {
+		return false, nil
+	}
+	return true, b.removeLocked(id)
+}
+
+func (b *bans) removeLocked(id string) error {
+	delete(b.bans, id)
+	err := b.store.Delete(banCollection, id)
+	if err != nil {
+		log.Println("Failed to remove ban:", err)
+	}
+	return err
+}
+
+// banned returns the ban of the websocket request, of its session, IP or user
+func (s *Server) banned(clientID string, r *http.Request, userID string) (Ban, bool) {
+	return s.bans.match(clientID, remoteIP(r.RemoteAddr), userID)
+}
+
+// Banned returns whether the user of the websocket request is banned, e.g. for the coordinator of the instance
+func (s *Server) Banned(r *http.Request) (Ban, bool) {
+	userID, _, _ := s.user(r)
+	return s.banned("", r, userID)
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// BannedPacket tells the client it's banned, with the ID to appeal the ban
+func BannedPacket(ban Ban) cws.WSPacket {
+	data, _ := json.Marshal(struct {
+		ID        string     `json:"id"`
+		Reason    string     `json:"reason"`
+		ExpiresAt time.Time  `json:"expires_at"`
+		Appeal    *BanAppeal `json:"appeal,omitempty"`
+	}{ban.ID, ban.Reason, ban.ExpiresAt, ban.Appeal})
+	return cws.WSPacket{Type: "BANNED", Data: string(data)}
+}
+
+// kickBanned disconnects the sessions the ban matches
+func (s *Server) kickBanned(ban Ban) {
+	for _, c := range s.capp.snapshotClients() {
+		if ban.matches(c.clientID, c.remoteIP, c.user()) {
+			c.ws.Send(BannedPacket(ban), nil)
+			c.ws.Close()
+		}
+	}
+}
+
+// banRequest is the body of the ban admin API
+type banRequest struct {
+	ClientID string `json:"client_id"`
+	IP       string `json:"ip"`
+	UserID   string `json:"user_id"`
+	Reason   string `json:"reason"`
+	// TTL in hours, 0 is permanent. Updates keep the expiry without it
+	TTL *float64 `json:"ttl"`
+	// AppealStatus rejects the appeal of the ban in updates, with the response to the user
+	AppealStatus   string `json:"appeal_status"`
+	AppealResponse string `json:"appeal_response"`
+}
+
+func (req banRequest) expiry() time.Time {
+	if req.TTL == nil || *req.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(*req.TTL * float64(time.Hour)))
+}
+
+// handleBan bans a session, IP or user. A ban of a live session covers its user, or its IP for anonymous users,
+// since the session ID changes when the client reconnects
+func (s *Server) handleBan(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ban := Ban{ClientID: req.ClientID, IP: req.IP, UserID: req.UserID, Reason: req.Reason, ExpiresAt: req.expiry()}
+	if ban.ClientID != "" {
+		if c := s.client(ban.ClientID); c != nil {
+			if userID := c.user(); userID != "" {
+				ban.ClientID, ban.UserID = "", userID
+			} else if c.remoteIP != nil {
+				ban.ClientID, ban.IP = "", c.remoteIP.String()
+			}
+		}
+	}
+	ban, err := s.bans.add(ban)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == errBanTarget || err == errBanIP {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	log.Printf("Banned %s%s%s: %s", ban.ClientID, ban.IP, ban.UserID, ban.Reason)
+	s.kickBanned(ban)
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, ban)
+}
+
+func (s *Server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.bans.list())
+}
+
+// handleUpdateBan changes the reason or expiry of a ban, or rejects its appeal
+func (s *Server) handleUpdateBan(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ban, err := s.bans.update(mux.Vars(r)["id"], func(ban *Ban) error {
+		if req.Reason != "" {
+			ban.Reason = req.Reason
+		}
+		if req.TTL != nil {
+			ban.ExpiresAt = req.expiry()
+		}
+		if req.AppealStatus != "" {
+			if ban.Appeal == nil {
+				return errAppealMissing
+			}
+			if req.AppealStatus != appealPending && req.AppealStatus != appealRejected {
+				return errAppealStatus
+			}
+			ban.Appeal.Status = req.AppealStatus
+			ban.Appeal.Response = req.AppealResponse
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		writeJSON(w, ban)
+	case errBanNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errAppealMissing, errAppealStatus, errBanTarget, errBanIP:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleLiftBan(w http.ResponseWriter, r *http.Request) {
+	ok, err := s.bans.lift(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAppealBan lets the banned user appeal the ban once with the ID of the BANNED packet
+func (s *Server) handleAppealBan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil || strings.TrimSpace(req.Message) == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	ban, err := s.bans.update(mux.Vars(r)["id"], func(ban *Ban) error {
+		if ban.Appeal != nil {
+			return errAppealExists
+		}
+		ban.Appeal = &BanAppeal{Message: strings.TrimSpace(req.Message), CreatedAt: time.Now(), Status: appealPending}
+		return nil
+	})
+	switch err {
+	case nil:
+		log.Println("Ban is appealed:", ban.ID)
+		writeJSON(w, ban.Appeal)
+	case errBanNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errAppealExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,102 @@
+package cloudapp
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/gorilla/mux"
+)
+
+// AppLoad is the number of running instances of an app and their players
+type AppLoad struct {
+	Instances int `json:"instances"`
+	// Available instances accept new sessions, they are neither saturated nor draining
+	Available int `json:"available"`
+	Players   int `json:"players"`
+}
+
+// AppEntry is a catalog app in the apps API and the runtime config of pages
+type AppEntry struct {
+	catalog.Manifest
+	AppLoad
+	IconURL string `json:"icon_url,omitempty"`
+	// Running is true for the app served by this instance
+	Running bool `json:"running"`
+}
+
+// SetAppLoad sets the source of running instances and players of all workers by app name, e.g. discovery.
+// Without it the apps API only counts this instance
+func (s *Server) SetAppLoad(load func() (map[string]AppLoad, error)) {
+	s.appLoad = load
+}
+
+// loads returns running instances and players by app name
+func (s *Server) loads() map[string]AppLoad {
+	if s.appLoad != nil {
+		loads, err := s.appLoad()
+		if err == nil {
+			return loads
+		}
+		log.Println("Cannot count running instances:", err)
+	}
+	report := s.Capacity()
+	load := AppLoad{Instances: 1, Players: report.Sessions}
+	if !report.Saturated && !s.IsDraining() {
+		load.Available = 1
+	}
+	return map[string]AppLoad{s.appMeta.AppName: load}
+}
+
+// handleListApps lists the apps the user can see. Apps are filtered by name or page title with q,
+// category, all tag parameters and with available=true by instances accepting new sessions
+func (s *Server) handleListApps(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := catalog.Query{Text: params.Get("q"), Category: params.Get("category"), Tags: params["tag"]}
+	available, _ := strconv.ParseBool(params.Get("available"))
+	writeJSON(w, s.listApps(s.Audience(r), query, available))
+}
+
+// listApps returns the catalog apps of the audience matching the query, with available only apps accepting new sessions
+func (s *Server) listApps(audience catalog.Audience, query catalog.Query, available bool) []AppEntry {
+	apps := []AppEntry{}
+	loads := s.loads()
+	for _, m := range s.catalog.List() {
+		if !m.Allows(audience) || !query.Matches(m) || (available && loads[m.Name].Available == 0) {
+			continue
+		}
+		entry := AppEntry{Manifest: m, AppLoad: loads[m.Name], Running: m.Name == s.appMeta.AppName}
+		if m.Icon != "" {
+			entry.IconURL = "/api/apps/" + m.Name + "/icon"
+		}
+		apps = append(apps, entry)
+	}
+	return apps
+}
+
+func (s *Server) handleAppIcon(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.catalog.Get(mux.Vars(r)["name"])
+	if !ok || m.Icon == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.HasPrefix(m.Icon, "http://") || strings.HasPrefix(m.Icon, "https://") {
+		http.Redirect(w, r, m.Icon, http.StatusFound)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(filepath.Dir(m.File), filepath.Clean("/"+m.Icon)))
+}
+
+// watchCatalog warns when the running app disappears from the catalog, the instance keeps running it
+func (s *Server) watchCatalog() {
+	s.catalog.OnChange(func(added []catalog.Manifest, removed []string) {
+		for _, name := range removed {
+			if name == s.appMeta.AppName {
+				log.Println("Warn: running app", name, "is removed from the catalog")
+			}
+		}
+	})
+}
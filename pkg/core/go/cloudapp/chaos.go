@@ -0,0 +1,76 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/giongto35/cloud-morph/pkg/common/chaos"
+	"github.com/gorilla/mux"
+)
+
+// Paths of a session impaired by chaos
+const (
+	chaosRTP = "rtp"
+	chaosWS  = "ws"
+)
+
+// chaosRequest is the impairment of a session, on all its paths unless they're listed
+type chaosRequest struct {
+	chaos.Impairment
+	Paths []string `json:"paths"`
+}
+
+// chaosStatus is the impairment of each path of a session
+type chaosStatus struct {
+	RTP chaos.Impairment `json:"rtp"`
+	WS  chaos.Impairment `json:"ws"`
+}
+
+// handleSetChaos impairs the outgoing RTP and websocket of a session, e.g. to watch the bitrate adapt to loss.
+// It's routed only with the chaos config
+func (s *Server) handleSetChaos(w http.ResponseWriter, r *http.Request) {
+	client := s.client(mux.Vars(r)["id"])
+	if client == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var req chaosRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "wrong impairment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Paths) == 0 {
+		req.Paths = []string{chaosRTP, chaosWS}
+	}
+	for _, path := range req.Paths {
+		switch path {
+		case chaosRTP:
+			client.rtpLink.Set(req.Impairment)
+		case chaosWS:
+			client.wsLink.Set(req.Impairment)
+		default:
+			http.Error(w, "unknown path "+path, http.StatusBadRequest)
+			return
+		}
+	}
+	log.Printf("Chaos of %s on %v: %+v", client.clientID, req.Paths, req.Impairment)
+	writeJSON(w, chaosStatus{RTP: client.rtpLink.Impairment(), WS: client.wsLink.Impairment()})
+}
+
+// handleClearChaos stops impairing a session
+func (s *Server) handleClearChaos(w http.ResponseWriter, r *http.Request) {
+	client := s.client(mux.Vars(r)["id"])
+	if client == nil {
+		http.NotFound(w, r)
+		return
+	}
+	client.rtpLink.Set(chaos.Impairment{})
+	client.wsLink.Set(chaos.Impairment{})
+	log.Println("Chaos of", client.clientID, "cleared")
+	w.WriteHeader(http.StatusNoContent)
+}
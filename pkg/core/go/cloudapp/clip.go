@@ -0,0 +1,256 @@
+package cloudapp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+// clipHistoryMaxBytes bounds the memory of the clip history
+const clipHistoryMaxBytes = 64 << 20
+
+const (
+	clipMP4  = "mp4"
+	clipWebM = "webm"
+	clipGIF  = "gif"
+)
+
+var errNoClipHistory = errors.New("no video to clip yet")
+
+// Clip is a captured video of the last seconds of the session
+type Clip struct {
+	ID        string    `json:"id"`
+	Format    string    `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int       `json:"size"`
+	URL       string    `json:"url"`
+}
+
+// clips records the latest frames and turns them into clips on demand or on schedule
+type clips struct {
+	dir     string
+	cfg     config.ClipConfig
+	width   int
+	height  int
+	history *media.FrameHistory
+	// transcode runs ffmpeg in the app VM, mp4 is muxed without it
+	transcode func(mp4 []byte, format string) ([]byte, error)
+
+	mu sync.Mutex
+}
+
+func newClips(dir string, cfg config.ClipConfig, width, height int, transcode func([]byte, string) ([]byte, error)) *clips {
+	return &clips{
+		dir:       dir,
+		cfg:       cfg,
+		width:     width,
+		height:    height,
+		history:   media.NewFrameHistory(time.Duration(cfg.Length)*time.Second, clipHistoryMaxBytes),
+		transcode: transcode,
+	}
+}
+
+// record keeps the frames of the hub in the history
+func (c *clips) record(frames *media.FrameHub) {
+	for frame := range frames.Subscribe("clip-history", 60) {
+		c.history.Add(frame)
+	}
+}
+
+// capture writes a clip of the history in the format
+func (c *clips) capture(format string) (Clip, error) {
+	clip := Clip{ID: uuid.Must(uuid.NewV4()).String(), Format: format, CreatedAt: time.Now()}
+	frames := c.history.Snapshot()
+	if len(frames) == 0 {
+		return clip, errNoClipHistory
+	}
+	muxer := media.NewFMP4Muxer(c.width, c.height)
+	var fragments []byte
+	for _, frame := range frames {
+		fragments = append(fragments, muxer.Fragment(frame)...)
+	}
+	init, err := muxer.InitSegment()
+	if err != nil {
+		return clip, err
+	}
+	data := append(init, fragments...)
+	if format != clipMP4 {
+		if data, err = c.transcode(data, format); err != nil {
+			return clip, err
+		}
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return clip, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.dir, clip.ID+"."+format), data, 0644); err != nil {
+		return clip, err
+	}
+	clip.Size = len(data)
+	clip.URL = "/clips/" + clip.ID + "." + format
+	c.prune()
+	return clip, nil
+}
+
+// prune removes the oldest clips over the limit
+func (c *clips) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil || len(files) <= c.cfg.Keep {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files[:len(files)-c.cfg.Keep] {
+		os.Remove(filepath.Join(c.dir, f.Name()))
+	}
+}
+
+// schedule captures a clip every interval
+func (c *clips) schedule(interval time.Duration) {
+	for range time.Tick(interval) {
+		clip, err := c.capture(c.cfg.Format)
+		if err != nil {
+			log.Println("Scheduled clip failed:", err)
+			continue
+		}
+		log.Println("Captured scheduled clip", clip.URL)
+	}
+}
+
+func (c *clips) list() []Clip {
+	files, _ := ioutil.ReadDir(c.dir)
+	list := []Clip{}
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		list = append(list, Clip{
+			ID:        strings.TrimSuffix(f.Name(), ext),
+			Format:    strings.TrimPrefix(ext, "."),
+			CreatedAt: f.ModTime(),
+			Size:      int(f.Size()),
+			URL:       "/clips/" + f.Name(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+func validClipFormat(format string) bool {
+	return format == clipMP4 || format == clipWebM || format == clipGIF
+}
+
+// Transcode converts the MP4 clip with ffmpeg in the app VM
+func (c *ccImpl) Transcode(mp4 []byte, format string) ([]byte, error) {
+	if c.osType == Windows {
+		return nil, fmt.Errorf("%s clips need the Linux app VM, use mp4", format)
+	}
+	args := []string{"exec", "-i", c.vm.name(), "ffmpeg", "-loglevel", "error", "-f", "mp4", "-i", "pipe:0"}
+	switch format {
+	case clipGIF:
+		args = append(args, "-vf", "fps=10,scale=480:-2:flags=lanczos", "-f", "gif")
+	case clipWebM:
+		args = append(args, "-c:v", "libvpx", "-deadline", "realtime", "-b:v", "1M", "-f", "webm")
+	}
+	args = append(args, "pipe:1")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stdin = bytes.NewReader(mp4)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// routeClip lets a participant clip the last seconds of the session
+func (s *Server) routeClip(client *cws.Client) {
+	client.Receive("CLIP", func(req cws.WSPacket) cws.WSPacket {
+		format := req.Data
+		if format == "" {
+			format = clipMP4
+		}
+		if s.clips == nil || !validClipFormat(format) {
+			return cws.WSPacket{Type: "CLIP_FAILED", Data: s.text(client, "clips are not available")}
+		}
+		// Transcoding takes a while, answer when the clip is ready
+		crash.Go("clip capture", func() {
+			clip, err := s.clips.capture(format)
+			if err != nil {
+				log.Println("Clip failed:", err)
+				client.Send(cws.WSPacket{Type: "CLIP_FAILED", Data: s.text(client, err.Error())}, nil)
+				return
+			}
+			client.Send(cws.WSPacket{Type: "CLIP_READY", Data: s.publicURL + clip.URL}, nil)
+		})
+		return cws.EmptyPacket
+	})
+}
+
+func (s *Server) handleCaptureClip(w http.ResponseWriter, r *http.Request) {
+	if s.clips == nil {
+		http.Error(w, "clips are disabled", http.StatusNotImplemented)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = clipMP4
+	}
+	if !validClipFormat(format) {
+		http.Error(w, "format is mp4, webm or gif", http.StatusBadRequest)
+		return
+	}
+	clip, err := s.clips.capture(format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	clip.URL = s.publicURL + clip.URL
+	writeJSON(w, clip)
+}
+
+func (s *Server) handleListClips(w http.ResponseWriter, r *http.Request) {
+	if s.clips == nil {
+		writeJSON(w, []Clip{})
+		return
+	}
+	writeJSON(w, s.clips.list())
+}
+
+func (s *Server) handleClipFile(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(filepath.Clean("/" + mux.Vars(r)["file"]))
+	serveDownload(w, r, filepath.Join(s.clips.dir, name), "clip-"+name)
+}
+
+// setupClips records the session for clips, they are muxed from H264 only
+func (s *Server) setupClips(r *mux.Router, cfg config.Config) {
+	if s.capp.webrtcConf.VideoCodec != pwebrtc.MimeTypeH264 {
+		log.Println("Clips are disabled, they need H264 video")
+		return
+	}
+	s.clips = newClips(filepath.Join(cfg.DataDir, "clips"), cfg.Clips, cfg.ScreenWidth, cfg.ScreenHeight, s.capp.ccApp.Transcode)
+	crash.Go("clip recorder", func() { s.clips.record(s.capp.Frames()) })
+	if cfg.Clips.Interval > 0 {
+		crash.Go("clip schedule", func() { s.clips.schedule(time.Duration(cfg.Clips.Interval) * time.Minute) })
+	}
+	r.HandleFunc("/clips/{file}", s.handleClipFile).Methods(http.MethodGet)
+}
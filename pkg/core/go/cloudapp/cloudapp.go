@@ -3,27 +3,62 @@ package cloudapp
 
 import (
 	"bufio"
-	"container/ring"
-	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
 	"github.com/pion/rtp"
 )
 
 type CloudAppClient interface {
-	VideoStream() chan *rtp.Packet
-	AudioStream() chan *rtp.Packet
+	VideoStream() chan *media.Packet
+	AudioStream() chan *media.Packet
 	SendInput(Packet)
 	Handle()
+	Relaunch()
+	// ForceKeyframe asks the encoder for a keyframe, e.g. after packet loss
+	ForceKeyframe()
+	// RampUp sends a keyframe at a boosted bitrate to a joining viewer
+	RampUp()
+	// Clocks return the capture clocks of video and audio
+	Clocks() (video *media.CaptureClock, audio *media.CaptureClock)
+	Encoder() string
+	// Screenshot returns the current screen as JPEG, scaled to the width or full size for 0
+	Screenshot(width int) ([]byte, error)
+	// Transcode converts an MP4 clip to webm or gif
+	Transcode(mp4 []byte, format string) ([]byte, error)
+	// Windows returns the visible windows of the app VM display
+	Windows() ([]AppWindow, error)
+	// SetCapture streams a region of the display, e.g. a window, letterboxed into the output size if it's set
+	SetCapture(Region, Letterbox) error
+	// SetBlank streams black frames instead of the display, or the display again
+	SetBlank(on bool) error
+	// FocusWindow raises the window of the app VM display and gives it the keyboard focus
+	FocusWindow(id string) error
+	// SetOverlayLogo draws the logo at the path in the app VM on the stream, an empty path removes it
+	SetOverlayLogo(path string) error
+	// EncoderSettings returns the bitrate, frame rate and resolution the encoder runs with
+	EncoderSettings() (EncoderSettings, error)
+	// SetEncoderSettings reconfigures the running encoder, the stream goes on with a keyframe
+	SetEncoderSettings(EncoderSettings) error
+	// SetVideoCodec restarts the encoder with another codec of the config, e.g. h264
+	SetVideoCodec(codec string) error
+	// VMLog returns the end of the log of a program in the app VM, e.g. ffmpeg
+	VMLog(program string, length int) (string, error)
 }
 
 type osTypeEnum int
@@ -35,17 +70,37 @@ const (
 )
 
 type ccImpl struct {
-	isReady       bool
 	videoListener *net.UDPConn
 	audioListener *net.UDPConn
-	videoStream   chan *rtp.Packet
-	audioStream   chan *rtp.Packet
-	appEvents     chan Packet
-	wineConn      *net.TCPConn
+	videoStream   chan *media.Packet
+	audioStream   chan *media.Packet
+	appEvents     *inputQueue
+	injector      InputInjector
 	osType        osTypeEnum
 	screenWidth   float32
 	screenHeight  float32
 	ssrc          uint32
+	// inputTickRate is the frequency of flushing coalesced input. 0 sends input immediately
+	inputTickRate int
+	cfg           config.Config
+	// encoder is nil on Windows, where the encoder can't be controlled
+	encoder     *encoderControl
+	encoderName string
+	// onGPU is set when the app VM encodes on a GPU
+	onGPU bool
+	// capture clocks of the streams for RTCP sender reports
+	videoClock *media.CaptureClock
+	audioClock *media.CaptureClock
+	// region of the display which is streamed and its letterboxed output, mouse input is mapped into the region
+	captureMu sync.Mutex
+	region    Region
+	letterbox Letterbox
+	// blanked is set while the encoder streams black frames
+	blanked bool
+	// secrets of the app by environment variable name
+	secrets map[string]string
+	// vm is the container of this instance of the app
+	vm appVM
 }
 
 // Packet represents a packet in cloudapp
@@ -56,21 +111,37 @@ type Packet struct {
 
 const startVideoRTPPort = 5004
 const startAudioRTPPort = 4004
+
+// RTP clock rate and frame rate of the encoded video
+const videoClockRate = 90000
+const videoFrameRate = 30
+const audioClockRate = 48000
 const eventKeyDown = "KEYDOWN"
 const eventKeyUp = "KEYUP"
 const eventMouseMove = "MOUSEMOVE"
 const eventMouseDown = "MOUSEDOWN"
 const eventMouseUp = "MOUSEUP"
 
-var curVideoRTPPort = startVideoRTPPort
-var curAudioRTPPort = startAudioRTPPort
+// appsHostDir is mounted at /apps in the app VM
+const appsHostDir = "winvm/apps"
 
-// NewCloudAppClient returns new cloudapp client
-func NewCloudAppClient(cfg config.Config, appEvents chan Packet) *ccImpl {
+// NewCloudAppClient returns new cloudapp client running the app in the VM
+func NewCloudAppClient(cfg config.Config, appEvents *inputQueue, secrets map[string]string, vm appVM) (*ccImpl, error) {
+	// Download the app package on first launch, apps directory is mounted to the app VM
+	cfg, err := prepareApp(cfg)
+	if err != nil {
+		return nil, err
+	}
 	c := &ccImpl{
-		videoStream: make(chan *rtp.Packet, 1),
-		audioStream: make(chan *rtp.Packet, 1),
-		appEvents:   appEvents,
+		vm:            vm,
+		secrets:       secrets,
+		videoStream:   make(chan *media.Packet, 1),
+		audioStream:   make(chan *media.Packet, 1),
+		appEvents:     appEvents,
+		inputTickRate: cfg.InputTickRate,
+		cfg:           cfg,
+		videoClock:    media.NewCaptureClock(videoClockRate, 0),
+		audioClock:    media.NewCaptureClock(audioClockRate, time.Duration(cfg.AVSyncOffset)*time.Millisecond),
 	}
 
 	switch runtime.GOOS {
@@ -78,31 +149,26 @@ func NewCloudAppClient(cfg config.Config, appEvents chan Packet) *ccImpl {
 		c.osType = Windows
 	default:
 		c.osType = Linux
+		c.encoder = newEncoderControl(vm.rpcURL(), cfg.VideoBitrate, cfg.JoinBitrate, time.Duration(cfg.JoinRampSeconds)*time.Second)
+		crash.Go("encoder progress", func() { listenEncoderProgress(vm.metricsApp(cfg.AppName), vm.progressPort()) })
 	}
 
-	la, err := net.ResolveTCPAddr("tcp4", ":9090")
-	if err != nil {
-		panic(err)
-	}
-	log.Println("listening syncinput at port 9090")
-	ln, err := net.ListenTCP("tcp", la)
-	if err != nil {
-		panic(err)
-	}
+	// Listen before launching the VM, syncinput connects to the worker
+	c.injector = mustInjector(cfg, vm)
 
 	fmt.Println(cfg)
-	c.launchAppVM(curVideoRTPPort, curAudioRTPPort, cfg)
+	c.launchAppVM(cfg)
 	log.Println("Launched application VM")
 
 	// Read video stream from encoded video stream produced by FFMPEG
 	log.Println("Setup Video Listener")
-	videoListener, listenerssrc := c.newLocalStreamListener(curVideoRTPPort)
+	videoListener, listenerssrc := c.newLocalStreamListener(vm.videoPort())
 	c.videoListener = videoListener
 	c.ssrc = listenerssrc
 	if c.osType != Windows {
 		// Don't spawn Audio in Windows
 		log.Println("Setup Audio Listener")
-		audioListener, audiolistenerssrc := c.newLocalStreamListener(curAudioRTPPort)
+		audioListener, audiolistenerssrc := c.newLocalStreamListener(vm.audioPort())
 		c.audioListener = audioListener
 		c.ssrc = audiolistenerssrc
 	}
@@ -116,27 +182,7 @@ func NewCloudAppClient(cfg config.Config, appEvents chan Packet) *ccImpl {
 		log.Println("Launched Audio stream listener")
 	}
 
-	// Maintain input stream from server to Virtual Machine over websocket
-	go c.healthCheckVM()
-	// NOTE: Why Websocket: because normal IPC cannot communicate cross OS.
-	go func() {
-		for {
-			log.Println("Waiting syncinput to connect")
-			// Polling Wine socket connection (input stream)
-			conn, err := ln.AcceptTCP()
-			log.Println("Accepted a TCP connection")
-			if err != nil {
-				log.Println("err: ", err)
-			}
-			conn.SetKeepAlive(true)
-			conn.SetKeepAlivePeriod(10 * time.Second)
-			c.wineConn = conn
-			c.isReady = true
-			log.Println("Launched IPC with VM")
-		}
-	}()
-
-	return c
+	return c, nil
 }
 
 // convertWSPacket returns cloudapp packet from ws packet
@@ -157,27 +203,31 @@ func (c *ccImpl) runApp(execCmd string, params []string) chan struct{} {
 	var cmd *exec.Cmd
 	cmd = exec.Command(execCmd, params...)
 
+	// Secrets are passed in the environment, never as logged params
 	cmd.Env = os.Environ()
+	for name, value := range c.secrets {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		log.Fatal(err)
 	}
-	go func() {
+	crash.Go("app stdout", func() {
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
 			log.Printf(scanner.Text())
 		}
-	}()
+	})
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		log.Fatal(err)
 	}
-	go func() {
+	crash.Go("app stderr", func() {
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
 			log.Printf(scanner.Text())
 		}
-	}()
+	})
 	err = cmd.Start()
 	if err != nil {
 		log.Printf("err: cmd fail, %v", err)
@@ -192,17 +242,34 @@ func (c *ccImpl) runApp(execCmd string, params []string) chan struct{} {
 
 	done := make(chan struct{})
 	// clean up func
-	go func() {
+	crash.Go("app cleanup", func() {
 		<-done
 		err := cmd.Process.Kill()
 		cmd.Process.Kill()
 		log.Println("Kill app: ", err)
-	}()
+	})
 	return done
 }
 
+// prepareApp downloads and extracts the artifact of the app, the path of the app is set to its directory
+func prepareApp(cfg config.Config) (config.Config, error) {
+	if cfg.Artifact == nil {
+		return cfg, nil
+	}
+	dir, err := cfg.Artifact.Prepare(cfg.ArtifactCache, appsHostDir, cfg.AppName)
+	if err != nil {
+		return cfg, fmt.Errorf("prepare app artifact: %w", err)
+	}
+	if runtime.GOOS == "windows" {
+		cfg.Path = dir
+	} else if rel, err := filepath.Rel("winvm", dir); err == nil {
+		cfg.Path = filepath.ToSlash(rel)
+	}
+	return cfg, nil
+}
+
 // done to forcefully stop all processes
-func (c *ccImpl) launchAppVM(curVideoRTPPort int, curAudioRTPPort int, cfg config.Config) chan struct{} {
+func (c *ccImpl) launchAppVM(cfg config.Config) chan struct{} {
 	var execCmd string
 	var params []string
 
@@ -245,31 +312,73 @@ func (c *ccImpl) launchAppVM(curVideoRTPPort int, curAudioRTPPort int, cfg confi
 		params = append(params, "windows")
 		params = append(params, "-vcodec", cfg.VideoCodec)
 	} else {
-		params = append(params, "")
+		encoder, gpu := c.videoEncoder()
+		hideDesktop := ""
+		if cfg.HideDesktop {
+			hideDesktop = "1"
+		}
+		params = append(params, "", encoder, gpu, cfg.Image, c.provisionScript(), strconv.Itoa(cfg.VideoBitrate), c.secretNames(),
+			cfg.Audio.EncoderOptions(), hideDesktop)
+		params = append(params, c.vm.params()...)
 	}
 	c.screenWidth = float32(cfg.ScreenWidth)
 	c.screenHeight = float32(cfg.ScreenHeight)
+	// the encoder of a new VM streams the app screen
+	c.captureMu.Lock()
+	c.region = Region{Width: cfg.ScreenWidth, Height: cfg.ScreenHeight}
+	c.letterbox = Letterbox{}
+	c.blanked = cfg.HideDesktop && c.osType != Windows
+	c.captureMu.Unlock()
 
 	return c.runApp(execCmd, params)
 }
 
-// healthCheckVM to maintain connection with Virtual Machine
-func (c *ccImpl) healthCheckVM() {
-	log.Println("Starting health check")
-	for {
-		if c.wineConn != nil {
-			_, err := c.wineConn.Write([]byte{0})
-			if err != nil {
-				log.Println(err)
-			}
-		}
-		time.Sleep(2 * time.Second)
+// secretNames are the secrets run-wine.sh passes on from its environment to the app VM
+func (c *ccImpl) secretNames() string {
+	names := make([]string, 0, len(c.secrets))
+	for name := range c.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// Relaunch restarts the application VM, e.g. after its Wine prefix is restored from a migration snapshot
+func (c *ccImpl) Relaunch() {
+	if s, ok := c.injector.(*syncinputInjector); ok {
+		s.disconnect()
+	}
+	c.launchAppVM(c.cfg)
+	log.Println("Relaunched application VM")
+}
+
+func (c *ccImpl) ForceKeyframe() {
+	if c.encoder != nil {
+		c.encoder.Keyframe()
+	}
+}
+
+func (c *ccImpl) RampUp() {
+	if c.encoder != nil {
+		c.encoder.RampUp()
 	}
 }
 
 func (c *ccImpl) Handle() {
-	for event := range c.appEvents {
-		c.SendInput(event)
+	if c.inputTickRate <= 0 {
+		for range c.appEvents.Ready() {
+			c.sendInputBatch(c.appEvents.Drain())
+		}
+		return
+	}
+
+	// Flush coalesced input once per tick
+	ticker := time.NewTicker(time.Second / time.Duration(c.inputTickRate))
+	defer ticker.Stop()
+	for range ticker.C {
+		if batch := c.appEvents.Drain(); len(batch) > 0 {
+			c.sendInputBatch(batch)
+		}
 	}
 }
 
@@ -297,53 +406,49 @@ func (c *ccImpl) newLocalStreamListener(rtpPort int) (*net.UDPConn, uint32) {
 	return listener, packet.SSRC
 }
 
-func (c *ccImpl) VideoStream() chan *rtp.Packet {
+func (c *ccImpl) VideoStream() chan *media.Packet {
 	return c.videoStream
 }
 
-func (c *ccImpl) AudioStream() chan *rtp.Packet {
+func (c *ccImpl) AudioStream() chan *media.Packet {
 	return c.audioStream
 }
 
+func (c *ccImpl) Clocks() (*media.CaptureClock, *media.CaptureClock) {
+	return c.videoClock, c.audioClock
+}
+
 // Listen to videostream, output to videoStream channel
 func (c *ccImpl) listenAudioStream() {
 
 	// Broadcast video stream
-	go func() {
+	crash.Go("audio listener", func() {
 		defer func() {
 			c.audioListener.Close()
 			log.Println("Closing app VM")
 		}()
-		r := ring.New(120)
 
-		n := r.Len()
-		for i := 0; i < n; i++ {
-			// r.Value = make([]byte, 4096)
-			r.Value = make([]byte, 1500)
-			r = r.Next()
-		}
-
-		// TODO: Create a precreated memory, only pop after finish processing
-		// Read RTP packets forever and send them to the WebRTC Client
+		// Read RTP packets forever and send them to the WebRTC Client.
+		// Buffers are pooled and returned when all clients are done with the packet
 		for {
-			inboundRTPPacket := r.Value.([]byte) // UDP MTU
-			r = r.Next()
-			n, _, err := c.audioListener.ReadFrom(inboundRTPPacket)
+			packet := media.NewPacket()
+			n, _, err := c.audioListener.ReadFrom(packet.Buffer())
 			if err != nil {
 				log.Printf("error during read: %s", err)
+				packet.Release()
 				continue
 			}
 
-			// TODOs: Don't assign packet here
-			packet := &rtp.Packet{}
-			if err := packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
+			if err := packet.Unmarshal(n); err != nil {
 				log.Printf("error during unmarshalling a packet: %s", err)
+				packet.Release()
 				continue
 			}
+			c.audioClock.Observe(packet.Timestamp, time.Now())
 
 			c.audioStream <- packet
 		}
-	}()
+	})
 
 }
 
@@ -351,99 +456,80 @@ func (c *ccImpl) listenAudioStream() {
 func (c *ccImpl) listenVideoStream() {
 
 	// Broadcast video stream
-	go func() {
+	crash.Go("video listener", func() {
 		defer func() {
 			c.videoListener.Close()
 			log.Println("Closing app VM")
 		}()
-		r := ring.New(120)
-
-		n := r.Len()
-		for i := 0; i < n; i++ {
-			// r.Value = make([]byte, 4096)
-			r.Value = make([]byte, 1500)
-			r = r.Next()
-		}
 
-		// TODO: Create a precreated memory, only pop after finish processing
-		// Read RTP packets forever and send them to the WebRTC Client
+		// The encoder restarts on crops, codec switches and crashes, keep the stream continuous for the browsers
+		rebaser := media.NewRebaser(videoClockRate, videoClockRate/videoFrameRate)
+		// Read RTP packets forever and send them to the WebRTC Client.
+		// Buffers are pooled and returned when all clients are done with the packet
 		for {
-			inboundRTPPacket := r.Value.([]byte) // UDP MTU
-			r = r.Next()
-			n, _, err := c.videoListener.ReadFrom(inboundRTPPacket)
+			packet := media.NewPacket()
+			n, _, err := c.videoListener.ReadFrom(packet.Buffer())
 			if err != nil {
 				log.Printf("error during read: %s", err)
+				packet.Release()
 				continue
 			}
 
-			// TODOs: Don't assign packet here
-			packet := &rtp.Packet{}
-			if err := packet.Unmarshal(inboundRTPPacket[:n]); err != nil {
+			if err := packet.Unmarshal(n); err != nil {
 				log.Printf("error during unmarshalling a packet: %s", err)
+				packet.Release()
 				continue
 			}
+			now := time.Now()
+			rebaser.Rebase(&packet.Packet, now)
+			c.videoClock.Observe(packet.Timestamp, now)
 
 			c.videoStream <- packet
 		}
-	}()
+	})
 
 }
 
 func (c *ccImpl) SendInput(packet Packet) {
-	switch packet.Type {
-	case eventKeyUp:
-		c.simulateKey(packet.Data, 0)
-	case eventKeyDown:
-		c.simulateKey(packet.Data, 1)
-	case eventMouseMove:
-		c.simulateMouseEvent(packet.Data, 0)
-	case eventMouseDown:
-		c.simulateMouseEvent(packet.Data, 1)
-	case eventMouseUp:
-		c.simulateMouseEvent(packet.Data, 2)
-	}
+	c.sendInputBatch([]Packet{packet})
 }
 
-func (c *ccImpl) simulateKey(jsonPayload string, keyState byte) {
-	if !c.isReady {
-		return
+// sendInputBatch sends multiple events to the app in one call of the input backend
+func (c *ccImpl) sendInputBatch(packets []Packet) {
+	events := make([]inputEvent, 0, len(packets))
+	region, letterbox := c.capture()
+	picture := letterbox.picture(region)
+	for _, packet := range packets {
+		if e, ok := decodeInput(packet, float32(picture.Width), float32(picture.Height)); ok {
+			e.X, e.Y = letterbox.toDisplay(region, e.X, e.Y)
+			events = append(events, e)
+		}
 	}
-
-	log.Println("KeyDown event", jsonPayload)
-	type keydownPayload struct {
-		KeyCode int `json:keycode`
+	if err := c.injector.Inject(events); err != nil {
+		log.Println("Err: ", err)
 	}
-	p := &keydownPayload{}
-	json.Unmarshal([]byte(jsonPayload), &p)
-
-	vmKeyMsg := fmt.Sprintf("K%d,%b|", p.KeyCode, keyState)
-	b, err := c.wineConn.Write([]byte(vmKeyMsg))
-	log.Printf("%+v\n", c.wineConn)
-	log.Println("Sended key: ", b, err)
 }
 
-// simulateMouseEvent handles mouse down event and send it to Virtual Machine over TCP port
-func (c *ccImpl) simulateMouseEvent(jsonPayload string, mouseState int) {
-	if !c.isReady {
-		return
+// provisionScript writes the provisioning steps of the app into the apps directory.
+// It returns the script path in the app VM, empty if there is nothing to provision
+func (c *ccImpl) provisionScript() string {
+	if c.cfg.Provision == nil {
+		return ""
 	}
-
-	type mousePayload struct {
-		IsLeft byte    `json:isLeft`
-		X      float32 `json:x`
-		Y      float32 `json:y`
-		Width  float32 `json:width`
-		Height float32 `json:height`
+	dir := filepath.Join(appsHostDir, ".provision")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("Failed to write provision script:", err)
+		return ""
 	}
-	p := &mousePayload{}
-	json.Unmarshal([]byte(jsonPayload), &p)
-	p.X = p.X * c.screenWidth / p.Width
-	p.Y = p.Y * c.screenHeight / p.Height
-
-	// Mouse is in format of comma separated "12.4,52.3"
-	vmMouseMsg := fmt.Sprintf("M%d,%d,%f,%f,%f,%f|", p.IsLeft, mouseState, p.X, p.Y, p.Width, p.Height)
-	_, err := c.wineConn.Write([]byte(vmMouseMsg))
-	if err != nil {
-		fmt.Println("Err: ", err)
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' {
+			return '-'
+		}
+		return r
+	}, c.cfg.AppName) + ".sh"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(c.cfg.Provision.Script()), 0755); err != nil {
+		log.Println("Failed to write provision script:", err)
+		return ""
 	}
+	return "/apps/.provision/" + name
 }
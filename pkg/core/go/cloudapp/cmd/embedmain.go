@@ -1,12 +1,7 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"net/http"
-	"net/http/pprof"
 	"os"
-	"os/signal"
 
 	"github.com/giongto35/cloud-morph/pkg/common/config"
 	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp"
@@ -14,55 +9,17 @@ import (
 
 const configFilePath = "./config.yaml"
 
-func monitor() {
-	monitoringServerMux := http.NewServeMux()
-
-	srv := http.Server{
-		Addr:    fmt.Sprintf(":%d", 3535),
-		Handler: monitoringServerMux,
-	}
-	log.Println("Starting monitoring server at", srv.Addr)
-
-	pprofPath := "/debug/pprof"
-	log.Println("Profiling is enabled at", srv.Addr+pprofPath)
-	monitoringServerMux.Handle(pprofPath+"/", http.HandlerFunc(pprof.Index))
-	monitoringServerMux.Handle(pprofPath+"/cmdline", http.HandlerFunc(pprof.Cmdline))
-	monitoringServerMux.Handle(pprofPath+"/profile", http.HandlerFunc(pprof.Profile))
-	monitoringServerMux.Handle(pprofPath+"/symbol", http.HandlerFunc(pprof.Symbol))
-	monitoringServerMux.Handle(pprofPath+"/trace", http.HandlerFunc(pprof.Trace))
-	// pprof handler for custom pprof path needs to be explicitly specified, according to: https://github.com/gin-contrib/pprof/issues/8 . Don't know why this is not fired as ticket
-	// https://golang.org/src/net/http/pprof/pprof.go?s=7411:7461#L305 only render index page
-	monitoringServerMux.Handle(pprofPath+"/allocs", pprof.Handler("allocs"))
-	monitoringServerMux.Handle(pprofPath+"/block", pprof.Handler("block"))
-	monitoringServerMux.Handle(pprofPath+"/goroutine", pprof.Handler("goroutine"))
-	monitoringServerMux.Handle(pprofPath+"/heap", pprof.Handler("heap"))
-	monitoringServerMux.Handle(pprofPath+"/mutex", pprof.Handler("mutex"))
-	monitoringServerMux.Handle(pprofPath+"/threadcreate", pprof.Handler("threadcreate"))
-	go srv.ListenAndServe()
-}
-
 func main() {
 	cfg, err := config.ReadConfig(configFilePath)
 	if err != nil {
 		panic(err)
 	}
-	// TODO: Make the communication over websocket
-	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets"))))
-	server := cloudapp.NewServer(cfg)
-	server.Handle()
-
-	go func() {
-		err := server.ListenAndServe()
-		if err != nil {
-			log.Fatal(err)
+	// doctor checks the host before the first launch
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		if !cloudapp.Doctor(cfg, os.Stdout) {
+			os.Exit(1)
 		}
-	}()
-
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	select {
-	case <-stop:
-		log.Println("Received SIGTERM, Quiting")
-		server.Shutdown()
+		return
 	}
+	cloudapp.Run(cfg)
 }
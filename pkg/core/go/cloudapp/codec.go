@@ -0,0 +1,118 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+// codecSwitch keeps the shared stream in a codec every viewer decodes. The stream falls back, e.g. from AV1 to H.264,
+// while a viewer's browser lacks the codec of the config, and returns to it when the last of them leaves
+type codecSwitch struct {
+	app CloudAppClient
+	// preferred and fallback are codecs of the config, e.g. av1 and h264. No fallback keeps the preferred one
+	preferred string
+	fallback  string
+	peers     func() []*webrtc.WebRTC
+
+	mu      sync.Mutex
+	current string
+	// fallbackClients are the clients which can't decode the preferred codec
+	fallbackClients map[string]bool
+}
+
+func newCodecSwitch(conf config.Config, app CloudAppClient, peers func() []*webrtc.WebRTC) *codecSwitch {
+	return &codecSwitch{
+		app:             app,
+		preferred:       conf.VideoCodec,
+		fallback:        conf.FallbackCodec,
+		peers:           peers,
+		current:         conf.VideoCodec,
+		fallbackClients: map[string]bool{},
+	}
+}
+
+// parseCodecs returns the mime types of the video codecs the browser decodes of the initwebrtc packet,
+// none for pages which don't tell
+func parseCodecs(data string) []string {
+	var init struct {
+		Codecs []string `json:"codecs"`
+	}
+	if data == "" || json.Unmarshal([]byte(data), &init) != nil {
+		return nil
+	}
+	return init.Codecs
+}
+
+// decodes returns if the browser decodes the codec. Browsers which don't tell decode every codec but AV1
+func decodes(codecs []string, codec string) bool {
+	if len(codecs) == 0 {
+		return codec != config.CodecAV1
+	}
+	mimeType := webrtc.MimeType(codec)
+	for _, c := range codecs {
+		if strings.EqualFold(c, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// join returns the mime type of the video track of the client. The stream falls back
+// when the client doesn't decode the preferred codec
+func (cs *codecSwitch) join(clientID string, codecs []string) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if decodes(codecs, cs.preferred) {
+		return webrtc.MimeType(cs.current)
+	}
+	if cs.fallback == "" || !decodes(codecs, cs.fallback) {
+		log.Printf("Client %s decodes neither %s nor the fallback codec", clientID, cs.preferred)
+		return webrtc.MimeType(cs.current)
+	}
+	cs.fallbackClients[clientID] = true
+	cs.switchTo(cs.fallback)
+	return webrtc.MimeType(cs.current)
+}
+
+// leave returns the stream to the preferred codec after the last client needing the fallback
+func (cs *codecSwitch) leave(clientID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.fallbackClients[clientID] {
+		return
+	}
+	delete(cs.fallbackClients, clientID)
+	if len(cs.fallbackClients) == 0 {
+		cs.switchTo(cs.preferred)
+	}
+}
+
+// switchTo restarts the encoder with the codec and replaces the video tracks of the peers. The caller holds mu
+func (cs *codecSwitch) switchTo(codec string) {
+	if codec == cs.current {
+		return
+	}
+	if err := cs.app.SetVideoCodec(codec); err != nil {
+		log.Printf("Failed to switch the stream to %s: %v", codec, err)
+		return
+	}
+	cs.current = codec
+	for _, peer := range cs.peers() {
+		if err := peer.SetVideoCodec(webrtc.MimeType(codec)); err != nil {
+			log.Printf("Failed to switch the video track of peer %s to %s: %v", peer.ID, codec, err)
+		}
+	}
+	log.Println("Stream switched to", codec)
+}
+
+// mimeType returns the codec the stream runs with
+func (cs *codecSwitch) mimeType() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return webrtc.MimeType(cs.current)
+}
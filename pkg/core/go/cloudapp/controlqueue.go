@@ -0,0 +1,302 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+var errNotQueued = errors.New("not in the control queue")
+
+// controlQueue gives input of a shared room to the first player in line for a turn.
+// When the turn is up the player goes to the back of the line, leaving or releasing control hands it to the next.
+// Moderators reorder the line and freeze it, which stops the turn timer
+type controlQueue struct {
+	turn time.Duration
+	// clients returns all clients of the room, which are told about the queue
+	clients func() []*Client
+
+	mu      sync.Mutex
+	entries []queueEntry
+	frozen  bool
+	// deadline of the turn, remaining while frozen
+	deadline  time.Time
+	remaining time.Duration
+	timer     *time.Timer
+}
+
+type queueEntry struct {
+	client *Client
+	name   string
+}
+
+// queueSlot is a player in the queue
+type queueSlot struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// queueView is the queue as a client sees it in CONTROL_QUEUE packets and admins in the admin API
+type queueView struct {
+	// Queue is the line, the first player has control
+	Queue []queueSlot `json:"queue"`
+	// Remaining seconds of the turn
+	Remaining int  `json:"remaining"`
+	Frozen    bool `json:"frozen"`
+	// Position of the client, 0 with control and -1 when it's not in line
+	Position int `json:"position"`
+}
+
+func newControlQueue(cfg config.ControlQueueConfig, clients func() []*Client) *controlQueue {
+	return &controlQueue{turn: time.Duration(cfg.Turn) * time.Second, clients: clients}
+}
+
+// request puts the client at the end of the line, it gets control right away when the line is empty
+func (q *controlQueue) request(c *Client, name string) {
+	q.mu.Lock()
+	if q.position(c.clientID) >= 0 {
+		q.mu.Unlock()
+		return
+	}
+	q.entries = append(q.entries, queueEntry{client: c, name: name})
+	if len(q.entries) == 1 {
+		q.grantLocked()
+	}
+	q.mu.Unlock()
+	q.broadcast()
+}
+
+// leave takes the client out of the line, control goes to the next player if it had it
+func (q *controlQueue) leave(clientID string) {
+	q.mu.Lock()
+	i := q.position(clientID)
+	if i < 0 {
+		q.mu.Unlock()
+		return
+	}
+	e := q.entries[i]
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	if i == 0 {
+		e.client.Wait(true)
+		q.grantLocked()
+	}
+	q.mu.Unlock()
+	q.broadcast()
+}
+
+// move puts the client at the position of the line, the player moved to the front gets control
+func (q *controlQueue) move(clientID string, pos int) error {
+	q.mu.Lock()
+	i := q.position(clientID)
+	if i < 0 {
+		q.mu.Unlock()
+		return errNotQueued
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	if pos >= len(q.entries) {
+		pos = len(q.entries) - 1
+	}
+	holder := q.entries[0]
+	e := q.entries[i]
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	q.entries = append(q.entries[:pos], append([]queueEntry{e}, q.entries[pos:]...)...)
+	if q.entries[0].client != holder.client {
+		holder.client.Wait(true)
+		q.grantLocked()
+	}
+	q.mu.Unlock()
+	q.broadcast()
+	return nil
+}
+
+// freeze stops the turn timer and keeps the line as it is, or starts the timer again
+func (q *controlQueue) freeze(frozen bool) {
+	q.mu.Lock()
+	if q.frozen == frozen {
+		q.mu.Unlock()
+		return
+	}
+	q.frozen = frozen
+	if frozen {
+		q.remaining = time.Until(q.deadline)
+		q.stopTimerLocked()
+	} else if len(q.entries) > 0 {
+		q.startTimerLocked(q.remaining)
+	}
+	q.mu.Unlock()
+	q.broadcast()
+}
+
+// expire ends the turn of the player in control, it goes to the back of the line
+func (q *controlQueue) expire() {
+	q.mu.Lock()
+	if q.frozen || len(q.entries) == 0 || time.Now().Before(q.deadline) {
+		q.mu.Unlock()
+		return
+	}
+	holder := q.entries[0]
+	if len(q.entries) > 1 {
+		holder.client.Wait(true)
+		q.entries = append(q.entries[1:], holder)
+	}
+	q.grantLocked()
+	q.mu.Unlock()
+	q.broadcast()
+}
+
+// grantLocked starts the turn of the first player in line
+func (q *controlQueue) grantLocked() {
+	q.stopTimerLocked()
+	if len(q.entries) == 0 {
+		return
+	}
+	q.entries[0].client.Wait(false)
+	q.remaining = q.turn
+	if !q.frozen {
+		q.startTimerLocked(q.turn)
+	}
+}
+
+func (q *controlQueue) startTimerLocked(d time.Duration) {
+	q.deadline = time.Now().Add(d)
+	q.timer = time.AfterFunc(d, q.expire)
+}
+
+func (q *controlQueue) stopTimerLocked() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+}
+
+func (q *controlQueue) position(clientID string) int {
+	for i, e := range q.entries {
+		if e.client.clientID == clientID {
+			return i
+		}
+	}
+	return -1
+}
+
+// view returns the queue as the client sees it, empty clientID for admins
+func (q *controlQueue) view(clientID string) queueView {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.viewLocked(clientID)
+}
+
+func (q *controlQueue) viewLocked(clientID string) queueView {
+	v := queueView{Queue: make([]queueSlot, 0, len(q.entries)), Frozen: q.frozen, Position: q.position(clientID)}
+	for _, e := range q.entries {
+		v.Queue = append(v.Queue, queueSlot{ID: e.client.clientID, Name: e.name})
+	}
+	remaining := q.remaining
+	if !q.frozen && len(q.entries) > 0 {
+		remaining = time.Until(q.deadline)
+	}
+	if len(q.entries) > 0 && remaining > 0 {
+		v.Remaining = int(remaining.Round(time.Second) / time.Second)
+	}
+	return v
+}
+
+// broadcast tells all clients of the room whose turn it is and their place in line
+func (q *controlQueue) broadcast() {
+	for _, c := range q.clients() {
+		c.ws.Send(queuePacket(q.view(c.clientID)), nil)
+	}
+}
+
+func queuePacket(v queueView) cws.WSPacket {
+	data, _ := json.Marshal(v)
+	return cws.WSPacket{Type: "CONTROL_QUEUE", Data: string(data)}
+}
+
+// queueMove is the body of QUEUE_MOVE packets and the queue admin API
+type queueMove struct {
+	ID       string `json:"id"`
+	Position int    `json:"position"`
+}
+
+// routeControlQueue lets the player request and release control. Players waiting for their turn have no input
+func (s *Server) routeControlQueue(client *cws.Client, serviceClient *Client, name string, roles []string) {
+	serviceClient.Wait(true)
+	client.Receive("CONTROL_REQUEST", func(req cws.WSPacket) cws.WSPacket {
+		s.queue.request(serviceClient, name)
+		return cws.EmptyPacket
+	})
+	client.Receive("CONTROL_RELEASE", func(req cws.WSPacket) cws.WSPacket {
+		s.queue.leave(serviceClient.clientID)
+		return cws.EmptyPacket
+	})
+	if s.queueModerator != "" && hasAnyRole(roles, []string{s.queueModerator}) {
+		s.routeQueueModeration(client)
+	}
+	client.Send(queuePacket(s.queue.view(serviceClient.clientID)), nil)
+}
+
+// routeQueueModeration lets moderators and admins reorder and freeze the queue
+func (s *Server) routeQueueModeration(client *cws.Client) {
+	client.Receive("QUEUE_MOVE", func(req cws.WSPacket) cws.WSPacket {
+		var m queueMove
+		if err := json.Unmarshal([]byte(req.Data), &m); err != nil {
+			return cws.WSPacket{Type: "QUEUE_FAILED", Data: s.text(client, "invalid move")}
+		}
+		if err := s.queue.move(m.ID, m.Position); err != nil {
+			return cws.WSPacket{Type: "QUEUE_FAILED", Data: s.text(client, err.Error())}
+		}
+		return cws.EmptyPacket
+	})
+	client.Receive("QUEUE_FREEZE", func(req cws.WSPacket) cws.WSPacket {
+		s.queue.freeze(req.Data == "on")
+		return cws.EmptyPacket
+	})
+}
+
+func (s *Server) handleGetQueue(w http.ResponseWriter, r *http.Request) {
+	if s.queue == nil {
+		http.Error(w, "control queue is disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.queue.view(""))
+}
+
+func (s *Server) handleMoveInQueue(w http.ResponseWriter, r *http.Request) {
+	if s.queue == nil {
+		http.Error(w, "control queue is disabled", http.StatusNotFound)
+		return
+	}
+	var m queueMove
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.queue.move(m.ID, m.Position); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.queue.view(""))
+}
+
+func (s *Server) handleFreezeQueue(w http.ResponseWriter, r *http.Request) {
+	if s.queue == nil {
+		http.Error(w, "control queue is disabled", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Frozen bool `json:"frozen"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.queue.freeze(body.Frozen)
+	writeJSON(w, s.queue.view(""))
+}
@@ -0,0 +1,43 @@
+package cloudapp
+
+import (
+	"log"
+	"time"
+)
+
+// SetBlank streams black frames instead of the display, or the display again
+func (c *ccImpl) SetBlank(on bool) error {
+	if c.encoder == nil {
+		return errWindowCaptureUnsupported
+	}
+	c.captureMu.Lock()
+	defer c.captureMu.Unlock()
+	if c.blanked == on {
+		return nil
+	}
+	if err := c.encoder.Blank(on); err != nil {
+		return err
+	}
+	c.blanked = on
+	return nil
+}
+
+// hideDesktop blanks the stream while the app window is missing, so viewers never see the bare desktop
+// of the app VM, e.g. while it boots or the app restarts. A relaunched VM starts blank by itself
+func hideDesktop(app CloudAppClient, title string) {
+	ticker := time.NewTicker(focusPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		windows, err := app.Windows()
+		if err == errWindowCaptureUnsupported {
+			return
+		}
+		_, ok := appWindow(windows, title)
+		if err := app.SetBlank(!ok); err != nil {
+			if err == errWindowCaptureUnsupported {
+				return
+			}
+			log.Println("Cannot blank the stream:", err)
+		}
+	}
+}
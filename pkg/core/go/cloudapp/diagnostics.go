@@ -0,0 +1,190 @@
+package cloudapp
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+)
+
+// diagnosticsSamples of the link are kept per session, 5 minutes at the quality interval
+const diagnosticsSamples = 150
+
+// diagnosticsLogLength is the tail of the app VM logs in a bundle, in bytes
+const diagnosticsLogLength = 256 << 10
+
+var (
+	errWebRTCNotStarted     = errors.New("webrtc is not started")
+	errVMLogUnsupported     = errors.New("logs are only available from the Linux app VM")
+	errSignalingNotRecorded = errors.New("signaling is not recorded, set recordSignaling")
+)
+
+// linkSample is a measurement of the link of a session at a time
+type linkSample struct {
+	At time.Time `json:"at"`
+	webrtc.LinkStats
+	DroppedPerSec float64 `json:"dropped_per_sec"`
+	Level         string  `json:"level"`
+}
+
+// recordSample keeps the sample, dropping the oldest ones
+func (c *Client) recordSample(sample linkSample) {
+	c.samplesMu.Lock()
+	defer c.samplesMu.Unlock()
+	if len(c.samples) >= diagnosticsSamples {
+		c.samples = append(c.samples[:0], c.samples[1:]...)
+	}
+	c.samples = append(c.samples, sample)
+}
+
+func (c *Client) recentSamples() []linkSample {
+	c.samplesMu.Lock()
+	defer c.samplesMu.Unlock()
+	return append([]linkSample(nil), c.samples...)
+}
+
+// sessionInfo is session.json of a diagnostics bundle
+type sessionInfo struct {
+	ClientID string    `json:"client_id"`
+	AppName  string    `json:"app_name"`
+	UserID   string    `json:"user_id,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Region   string    `json:"region,omitempty"`
+	JoinedAt time.Time `json:"joined_at"`
+	// Details are left out of the session list
+	Prefs    *Prefs           `json:"prefs,omitempty"`
+	Encoder  string           `json:"encoder,omitempty"`
+	Settings *EncoderSettings `json:"encoder_settings,omitempty"`
+	Capture  *captureStatus   `json:"capture,omitempty"`
+}
+
+// handleListSessions lists the sessions to pick the one a bug report is about
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	clients := s.capp.snapshotClients()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].joinedAt.Before(clients[j].joinedAt) })
+	sessions := make([]sessionInfo, 0, len(clients))
+	for _, c := range clients {
+		sessions = append(sessions, sessionInfo{ClientID: c.clientID, AppName: c.appName, UserID: c.user(), IP: c.remoteIP.String(), Region: c.region, JoinedAt: c.joinedAt})
+	}
+	writeJSON(w, sessions)
+}
+
+func (s *Server) client(clientID string) *Client {
+	s.capp.clientsLock.RLock()
+	defer s.capp.clientsLock.RUnlock()
+	return s.capp.clients[clientID]
+}
+
+// handleDiagnostics bundles the diagnostics of a session into a zip for bug reports: the session, its SDPs, ICE candidate pairs
+// and recent link samples, the encoder and app logs of the app VM and the config without credentials
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["id"]
+	client := s.client(clientID)
+	if client == nil {
+		http.NotFound(w, r)
+		return
+	}
+	client.prefsMu.Lock()
+	prefs := client.prefs
+	client.prefsMu.Unlock()
+	capture := s.capp.windows.status()
+	info := sessionInfo{
+		ClientID: clientID,
+		AppName:  client.appName,
+		UserID:   client.user(),
+		Region:   client.region,
+		JoinedAt: client.joinedAt,
+		Prefs:    &prefs,
+		Encoder:  s.capp.ccApp.Encoder(),
+		Capture:  &capture,
+	}
+	if settings, err := s.capp.ccApp.EncoderSettings(); err == nil {
+		info.Settings = &settings
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="diagnostics-%s-%s.zip"`, clientID, time.Now().Format("20060102-150405")))
+	bundle := zip.NewWriter(w)
+	defer bundle.Close()
+	files := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"session.json", jsonFile(info)},
+		{"stats.json", jsonFile(client.recentSamples())},
+		{"webrtc.json", func(out io.Writer) error {
+			if client.rtcConn == nil {
+				return errWebRTCNotStarted
+			}
+			d, err := client.rtcConn.Diagnostics()
+			if err != nil {
+				return err
+			}
+			return jsonFile(d)(out)
+		}},
+		{"signaling.jsonl", func(out io.Writer) error {
+			if client.signaling == nil || client.signaling.path() == "" {
+				return errSignalingNotRecorded
+			}
+			f, err := os.Open(client.signaling.path())
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(out, f)
+			return err
+		}},
+		{"encoder.log", s.vmLogFile(encoderProgram)},
+		{"app.log", s.vmLogFile("wineapp")},
+		{"config.yaml", func(out io.Writer) error {
+			return yaml.NewEncoder(out).Encode(s.capp.config.Redacted())
+		}},
+	}
+	for _, f := range files {
+		out, err := bundle.Create(f.name)
+		if err != nil {
+			log.Println("Failed to write diagnostics:", err)
+			return
+		}
+		// A missing part is noted in its file, the rest of the bundle is still useful
+		if err := f.write(out); err != nil {
+			fmt.Fprintf(out, "\nnot available: %v\n", err)
+		}
+	}
+}
+
+func jsonFile(v interface{}) func(io.Writer) error {
+	return func(out io.Writer) error {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+}
+
+func (s *Server) vmLogFile(program string) func(io.Writer) error {
+	return func(out io.Writer) error {
+		text, err := s.capp.ccApp.VMLog(program, diagnosticsLogLength)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, text)
+		return err
+	}
+}
+
+func (c *ccImpl) VMLog(program string, length int) (string, error) {
+	if c.encoder == nil {
+		return "", errVMLogUnsupported
+	}
+	return c.encoder.Tail(program, length)
+}
@@ -0,0 +1,337 @@
+package cloudapp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+	"github.com/pion/stun"
+)
+
+const doctorTimeout = 10 * time.Second
+
+// Results of doctor checks
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "FAIL"
+)
+
+// udpPort is a port of the worker checked by the doctor, public ports must be open for clients
+type udpPort struct {
+	name   string
+	port   int
+	public bool
+}
+
+type checkResult struct {
+	name   string
+	status string
+	detail string
+}
+
+// doctor checks the host for what the worker needs to stream the app of the config
+type doctor struct {
+	cfg     config.Config
+	results []checkResult
+	// image is the app VM image the tools are checked in, empty to check them on the host
+	image string
+}
+
+// Doctor checks the host environment of the config: docker and the app VM image, the X server, Wine,
+// ffmpeg with the encoders of the config, the UDP ports, STUN and GPU encoders.
+// It prints a report to out and returns false when a check failed
+func Doctor(cfg config.Config, out io.Writer) bool {
+	d := &doctor{cfg: cfg}
+	if runtime.GOOS == "windows" {
+		d.add("platform", checkWarn, "only the sandbox scripts are used on Windows, app VM checks are skipped")
+	} else {
+		d.checkDocker()
+		d.checkTool("X server", "Xvfb")
+		d.checkTool("Wine", "wine", "--version")
+		d.checkFFmpeg()
+		d.checkGPU()
+	}
+	d.checkPorts()
+	d.checkSTUN()
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	ok := true
+	for _, r := range d.results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.status, r.name, r.detail)
+		if r.status == checkFail {
+			ok = false
+		}
+	}
+	w.Flush()
+	if ok {
+		fmt.Fprintln(out, "\nThe host is ready to run", cfg.AppName)
+	} else {
+		fmt.Fprintln(out, "\nFix the failed checks before launching")
+	}
+	return ok
+}
+
+func (d *doctor) add(name, status, detail string) {
+	d.results = append(d.results, checkResult{name: name, status: status, detail: detail})
+}
+
+// checkDocker checks the docker daemon and picks the app VM image to check the tools in
+func (d *doctor) checkDocker() {
+	if _, err := runCommand("docker", "info", "--format", "{{.ServerVersion}}"); err != nil {
+		d.add("docker", checkFail, "the app VM runs in docker: "+err.Error())
+		return
+	}
+	d.add("docker", checkOK, "daemon is running")
+	image := d.cfg.Image
+	if image == "" {
+		image = "syncwine"
+	}
+	if _, err := runCommand("docker", "image", "inspect", image); err != nil {
+		if image == "syncwine" {
+			d.add("app VM image", checkWarn, "syncwine is built from winvm/Dockerfile on the first launch, tools are checked on the host")
+		} else {
+			d.add("app VM image", checkFail, image+" is not pulled")
+		}
+		return
+	}
+	d.add("app VM image", checkOK, image)
+	d.image = image
+}
+
+// vm runs a tool in the app VM image, or on the host without one
+func (d *doctor) vm(tool string, args ...string) (string, error) {
+	if d.image == "" {
+		return runCommand(tool, args...)
+	}
+	return runCommand("docker", append([]string{"run", "--rm", "--entrypoint", tool, d.image}, args...)...)
+}
+
+func (d *doctor) where() string {
+	if d.image == "" {
+		return "on the host"
+	}
+	return "in " + d.image
+}
+
+// checkTool runs the tool with the args, which print its version. Without args it's only looked up
+func (d *doctor) checkTool(name, tool string, args ...string) {
+	var out string
+	var err error
+	if len(args) == 0 {
+		_, err = d.vm("sh", "-c", "command -v "+tool)
+	} else {
+		out, err = d.vm(tool, args...)
+	}
+	if err != nil {
+		d.add(name, checkFail, fmt.Sprintf("%s is missing %s: %v", tool, d.where(), err))
+		return
+	}
+	detail := tool + " " + d.where()
+	if line := firstLine(out); line != "" {
+		detail += ", " + line
+	}
+	d.add(name, checkOK, detail)
+}
+
+// checkFFmpeg checks ffmpeg has the video encoder of the config and opus
+func (d *doctor) checkFFmpeg() {
+	out, err := d.vm("ffmpeg", "-hide_banner", "-encoders")
+	if err != nil {
+		d.add("ffmpeg", checkFail, fmt.Sprintf("ffmpeg is missing %s: %v", d.where(), err))
+		return
+	}
+	required := []string{"libx264", "libopus"}
+	switch d.cfg.VideoCodec {
+	case config.CodecVPX:
+		required[0] = "libvpx"
+	case config.CodecAV1:
+		required[0] = "libaom-av1"
+		if d.cfg.FallbackCodec == config.CodecVPX {
+			required = append(required, "libvpx")
+		} else {
+			required = append(required, "libx264")
+		}
+	}
+	if d.cfg.HWEncoder == "nvenc" {
+		required = append(required, "h264_nvenc")
+		if d.cfg.VideoCodec == config.CodecAV1 {
+			required = append(required, "av1_nvenc")
+		}
+	}
+	var missing []string
+	for _, encoder := range required {
+		if !strings.Contains(out, " "+encoder+" ") {
+			missing = append(missing, encoder)
+		}
+	}
+	if len(missing) > 0 {
+		d.add("ffmpeg", checkFail, fmt.Sprintf("ffmpeg %s lacks the encoders %s", d.where(), strings.Join(missing, ", ")))
+		return
+	}
+	d.add("ffmpeg", checkOK, "encoders "+strings.Join(required, ", ")+" "+d.where())
+}
+
+// checkGPU checks the GPUs and the NVIDIA container runtime of hardware encoding
+func (d *doctor) checkGPU() {
+	if d.cfg.HWEncoder != "nvenc" {
+		d.add("GPU encoder", checkOK, "software encoding, set hwEncoder: nvenc to encode on NVIDIA GPUs")
+		return
+	}
+	gpus := capacity.GPUs()
+	if len(gpus) == 0 {
+		d.add("GPU encoder", checkFail, "hwEncoder is nvenc but nvidia-smi finds no GPU, encoding falls back to software")
+		return
+	}
+	names := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		names = append(names, fmt.Sprintf("%d %s (%d encoder sessions)", gpu.Index, gpu.Name, gpu.EncoderSessions))
+	}
+	d.add("GPU encoder", checkOK, strings.Join(names, ", "))
+	if out, err := runCommand("docker", "info", "--format", "{{json .Runtimes}}"); err == nil && !strings.Contains(out, "nvidia") {
+		d.add("GPU in docker", checkFail, "the NVIDIA container toolkit is missing, the app VM can't use the GPUs")
+	}
+}
+
+// checkPorts binds the UDP ports of the worker. Reachability from clients depends on firewalls, which can't be seen from here
+func (d *doctor) checkPorts() {
+	ports := []udpPort{
+		{"video RTP", startVideoRTPPort, false},
+		{"audio RTP", startAudioRTPPort, false},
+		{"encoder progress", encoderProgressPort, false},
+	}
+	webrtcDetail := "ephemeral ports, set webrtc.portMin/portMax or udpMuxPort for firewalls"
+	switch {
+	case d.cfg.WebRTC.UDPMuxPort > 0:
+		ports = append(ports, udpPort{"WebRTC mux", d.cfg.WebRTC.UDPMuxPort, true})
+		webrtcDetail = ""
+	case d.cfg.WebRTC.PortMin > 0:
+		ports = append(ports, udpPort{"WebRTC first", int(d.cfg.WebRTC.PortMin), true}, udpPort{"WebRTC last", int(d.cfg.WebRTC.PortMax), true})
+		webrtcDetail = ""
+	}
+	for _, p := range ports {
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(p.port))
+		if err != nil {
+			d.add("UDP "+p.name, checkFail, err.Error())
+			continue
+		}
+		conn.Close()
+		detail := fmt.Sprintf("port %d is free", p.port)
+		if p.public {
+			detail += ", open it in the firewall for clients"
+		}
+		d.add("UDP "+p.name, checkOK, detail)
+	}
+	if webrtcDetail != "" {
+		d.add("UDP WebRTC", checkWarn, webrtcDetail)
+	}
+}
+
+// checkSTUN asks the STUN servers of the config for the public address of the host
+func (d *doctor) checkSTUN() {
+	urls := stunURLs(d.cfg)
+	if len(urls) == 0 {
+		d.add("STUN", checkWarn, "no STUN server, clients outside the network only connect with TURN or a public IP")
+		return
+	}
+	for _, url := range urls {
+		addr, err := stunMappedAddress(url)
+		if err != nil {
+			d.add("STUN", checkFail, fmt.Sprintf("%s: %v", url, err))
+			continue
+		}
+		detail := fmt.Sprintf("%s maps the host to %s", url, addr)
+		if d.cfg.WebRTC.PublicIP != "" && !strings.HasPrefix(addr, d.cfg.WebRTC.PublicIP+":") {
+			d.add("STUN", checkWarn, detail+", which is not webrtc.publicIP "+d.cfg.WebRTC.PublicIP)
+			continue
+		}
+		d.add("STUN", checkOK, detail)
+	}
+}
+
+// stunURLs are the STUN servers the worker hands to clients
+func stunURLs(cfg config.Config) []string {
+	var servers []string
+	if len(cfg.WebRTC.ICEServers) > 0 {
+		for _, server := range cfg.WebRTC.ICEServers {
+			servers = append(servers, server.URLs...)
+		}
+	} else {
+		switch cfg.StunTurn {
+		case "none":
+		case "":
+			for _, server := range webrtc.DefaultConfig.ICEServers {
+				servers = append(servers, server.URLs...)
+			}
+		default:
+			servers = append(servers, cfg.StunTurn)
+		}
+	}
+	var urls []string
+	for _, url := range servers {
+		if strings.HasPrefix(url, "stun:") {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// stunMappedAddress sends a binding request to the STUN server and returns the address it sees
+func stunMappedAddress(url string) (string, error) {
+	host := strings.TrimPrefix(url, "stun:")
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "3478")
+	}
+	conn, err := net.DialTimeout("udp", host, doctorTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(doctorTimeout))
+	if _, err := conn.Write(stun.MustBuild(stun.TransactionID, stun.BindingRequest).Raw); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	resp := &stun.Message{Raw: buf[:n]}
+	if err := resp.Decode(); err != nil {
+		return "", err
+	}
+	var mapped stun.XORMappedAddress
+	if err := mapped.GetFrom(resp); err != nil {
+		return "", err
+	}
+	return mapped.String(), nil
+}
+
+// runCommand returns the output of the command, stdout and stderr combined
+func runCommand(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
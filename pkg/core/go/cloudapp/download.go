@@ -0,0 +1,39 @@
+package cloudapp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// downloadRate is the slowest rate in bytes per second downloads are given time for
+	downloadRate = 64 * 1024
+	// downloadTimeout is the time a download is given besides the time of its size
+	downloadTimeout = 10 * time.Second
+)
+
+// connKey is the context key of the connection of a request, see TrackConns
+type connKey struct{}
+
+// TrackConns keeps the connection in the context of the requests of the server, so downloads can extend its write timeout
+func TrackConns(srv *http.Server) {
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, c)
+	}
+}
+
+// serveDownload serves the file as an attachment of the name. The write timeout of the server is meant for API
+// responses, recordings and clips take longer, so the download gets time for its size at the download rate.
+// HTTP/2 streams keep the write timeout of the server
+func serveDownload(w http.ResponseWriter, r *http.Request, path string, name string) {
+	if info, err := os.Stat(path); err == nil && r.ProtoMajor == 1 {
+		if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+			c.SetWriteDeadline(time.Now().Add(downloadTimeout + time.Duration(info.Size()/downloadRate)*time.Second))
+		}
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,150 @@
+package cloudapp
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainer tracks drain mode: no new sessions, done when the last session ends
+type drainer struct {
+	draining int32
+	sessions int32
+	mu       sync.Mutex
+	once     *sync.Once
+	drained  chan struct{}
+	onDrain  []func()
+	onResume []func()
+}
+
+func newDrainer() *drainer {
+	return &drainer{once: &sync.Once{}, drained: make(chan struct{})}
+}
+
+func (d *drainer) isDraining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+func (d *drainer) sessionStarted() {
+	atomic.AddInt32(&d.sessions, 1)
+}
+
+// sessionEnded returns the number of sessions left
+func (d *drainer) sessionEnded() int32 {
+	left := atomic.AddInt32(&d.sessions, -1)
+	if left <= 0 && d.isDraining() {
+		d.finish()
+	}
+	return left
+}
+
+// finish closes drained, once per drain
+func (d *drainer) finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	drained := d.drained
+	d.once.Do(func() { close(drained) })
+}
+
+func (d *drainer) done() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.drained
+}
+
+func (d *drainer) start() {
+	if !atomic.CompareAndSwapInt32(&d.draining, 0, 1) {
+		return
+	}
+	log.Println("Draining: stop accepting new sessions, active sessions:", atomic.LoadInt32(&d.sessions))
+	d.mu.Lock()
+	hooks := d.onDrain
+	d.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	if atomic.LoadInt32(&d.sessions) <= 0 {
+		d.finish()
+	}
+}
+
+// resume leaves drain mode, e.g. when the migration which drained the server failed
+func (d *drainer) resume() {
+	d.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&d.draining, 1, 0) {
+		d.mu.Unlock()
+		return
+	}
+	log.Println("Resuming: accepting new sessions again")
+	d.once, d.drained = &sync.Once{}, make(chan struct{})
+	hooks := d.onResume
+	d.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// Drain stops accepting new sessions and lets current sessions finish
+func (s *Server) Drain() {
+	s.drainer.start()
+}
+
+// Drained is closed when the server is draining and the last session ended
+func (s *Server) Drained() <-chan struct{} {
+	return s.drainer.done()
+}
+
+// IsDraining returns if the server is in drain mode
+func (s *Server) IsDraining() bool {
+	return s.drainer.isDraining()
+}
+
+// OnDrain registers a hook called when drain mode starts, e.g. to deregister from the coordinator
+func (s *Server) OnDrain(hook func()) {
+	s.drainer.mu.Lock()
+	s.drainer.onDrain = append(s.drainer.onDrain, hook)
+	s.drainer.mu.Unlock()
+}
+
+// OnResume registers a hook called when the server leaves drain mode, e.g. to register with the coordinator again
+func (s *Server) OnResume(hook func()) {
+	s.drainer.mu.Lock()
+	s.drainer.onResume = append(s.drainer.onResume, hook)
+	s.drainer.mu.Unlock()
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	s.Drain()
+	s.handleDrainStatus(w, r)
+}
+
+func (s *Server) handleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Draining bool  `json:"draining"`
+		Sessions int32 `json:"sessions"`
+	}{
+		Draining: s.IsDraining(),
+		Sessions: atomic.LoadInt32(&s.drainer.sessions),
+	})
+}
+
+// Evacuate handles a reclaim of the instance at the given time: drain and migrate the session to target
+// if it's set, otherwise count down clients until the instance goes away
+func (s *Server) Evacuate(target string, at time.Time) {
+	s.Drain()
+	if target != "" && runtime.GOOS != "windows" {
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			s.startMigration(u, time.Until(at))
+			return
+		}
+		log.Println("Evacuate: wrong migrate target", target)
+	}
+	s.capp.announcer.Schedule(Announcement{
+		Message:      "This server is being shut down by the cloud provider",
+		DisconnectAt: &at,
+	})
+}
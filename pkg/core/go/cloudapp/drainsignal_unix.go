@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package cloudapp
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// DrainSignal returns the channel of SIGUSR1 which triggers drain mode
+func DrainSignal() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	return c
+}
@@ -0,0 +1,8 @@
+package cloudapp
+
+import "os"
+
+// DrainSignal returns nil on Windows which has no SIGUSR1, use the admin API instead
+func DrainSignal() <-chan os.Signal {
+	return nil
+}
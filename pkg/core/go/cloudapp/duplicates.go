@@ -0,0 +1,79 @@
+package cloudapp
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+var errDuplicateSession = errors.New("you are already playing in another tab or window")
+
+// duplicates finds players connecting twice, e.g. from a second tab, so their input and stream aren't doubled.
+// Players are identified by their user, or their guest token when anonymous. Other anonymous players aren't tracked
+type duplicates struct {
+	policy string
+
+	mu sync.Mutex
+	// sessions holds the playing connection of each player
+	sessions map[string]*cws.Client
+}
+
+func newDuplicates(policy string) *duplicates {
+	return &duplicates{policy: policy, sessions: map[string]*cws.Client{}}
+}
+
+// duplicateKey identifies the player of the request, empty when the player can't be told apart
+func duplicateKey(userID, guestToken string) string {
+	if userID != "" {
+		return userID
+	}
+	if guestToken != "" {
+		return roleGuest + ":" + guestToken
+	}
+	return ""
+}
+
+// claim applies the policy to a new connection of the player. It returns whether the connection plays, spectators
+// aren't tracked. Connections resuming their session take over whatever the policy, the old one is the same tab
+func (d *duplicates) claim(key string, ws *cws.Client, resumed bool) (bool, error) {
+	if key == "" {
+		return true, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	old, ok := d.sessions[key]
+	if !ok {
+		d.sessions[key] = ws
+		return true, nil
+	}
+	policy := d.policy
+	if resumed {
+		policy = config.DuplicateTakeover
+	}
+	log.Println("Player", key, "connected twice,", policy)
+	switch policy {
+	case config.DuplicateDeny:
+		return false, errDuplicateSession
+	case config.DuplicateSpectate:
+		return false, nil
+	}
+	d.sessions[key] = ws
+	old.Send(cws.WSPacket{Type: "SESSION_TAKEN_OVER"}, nil)
+	old.Close()
+	return true, nil
+}
+
+// release forgets the connection when it's the playing one of the player
+func (d *duplicates) release(key string, ws *cws.Client) {
+	if key == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sessions[key] == ws {
+		delete(d.sessions, key)
+	}
+}
@@ -0,0 +1,90 @@
+package cloudapp
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+// ffmpeg video encoder options passed to the app VM
+const (
+	softwareEncoder = "-c:v libx264 -tune zerolatency -quality realtime"
+	nvencEncoder    = "-c:v h264_nvenc -preset llhq -zerolatency 1"
+	vpxEncoder      = "-c:v libvpx -deadline realtime -quality realtime"
+	// AV1 needs ffmpeg 7 or later in the app VM to packetize it into RTP. NVENC encodes AV1 from the Ada generation on
+	av1Encoder      = "-c:v libaom-av1 -usage realtime -cpu-used 8 -row-mt 1 -lag-in-frames 0 -error-resilient 1"
+	av1NvencEncoder = "-c:v av1_nvenc -preset p1 -tune ull -zerolatency 1"
+)
+
+var encoderFallbacks = metrics.NewCounter("cloudmorph_encoder_fallbacks_total", "App launches falling back to software encoding because no hardware encoder slot is free")
+
+// videoEncoder schedules the app VM onto the GPU with the most free encoder slots.
+// It returns the ffmpeg encoder options and the GPU index, empty for software encoding
+func (c *ccImpl) videoEncoder() (string, string) {
+	software, name := c.encoderOptions(c.cfg.VideoCodec, false)
+	c.encoderName = name
+	if c.cfg.HWEncoder != "nvenc" {
+		return software, ""
+	}
+	if c.cfg.VideoCodec == config.CodecVPX {
+		log.Println("Warn: nvenc doesn't encode vp8, use software encoding")
+		return software, ""
+	}
+
+	gpu, ok := capacity.FreeGPU(capacity.GPUs(), c.cfg.Capacity.EncoderSlotsPerGPU)
+	if !ok {
+		log.Println("Warn: no free NVENC encoder slot, fall back to software encoding")
+		encoderFallbacks.Inc()
+		return software, ""
+	}
+	log.Printf("Schedule app VM on GPU %d %s with %d encoder sessions", gpu.Index, gpu.Name, gpu.EncoderSessions)
+	c.onGPU = true
+	hardware, name := c.encoderOptions(c.cfg.VideoCodec, true)
+	c.encoderName = name
+	return hardware, strconv.Itoa(gpu.Index)
+}
+
+// encoderOptions returns the ffmpeg options and the name of the encoder of the codec, on the GPU or in software
+func (c *ccImpl) encoderOptions(codec string, gpu bool) (string, string) {
+	switch {
+	case codec == config.CodecAV1 && gpu:
+		return av1NvencEncoder, "av1_nvenc"
+	case codec == config.CodecAV1:
+		return av1Encoder, "libaom-av1"
+	case codec == config.CodecVPX:
+		return vpxEncoder, "libvpx"
+	case gpu:
+		return nvencEncoder, "h264_nvenc"
+	}
+	software := softwareEncoder
+	if c.cfg.EncoderPreset != "" {
+		software += " -preset " + c.cfg.EncoderPreset
+	}
+	return software, "libx264"
+}
+
+// SetVideoCodec restarts the encoder with the codec, e.g. h264 while a viewer's browser can't decode av1.
+// The stream goes on with a keyframe
+func (c *ccImpl) SetVideoCodec(codec string) error {
+	if c.encoder == nil {
+		return errEncoderUnsupported
+	}
+	options, name := c.encoderOptions(codec, c.onGPU && codec != config.CodecVPX)
+	if err := c.encoder.Codec(options); err != nil {
+		return err
+	}
+	c.encoderName = name
+	log.Println("Encoder switched to", name)
+	return nil
+}
+
+// Encoder returns the name of the video encoder in the app VM
+func (c *ccImpl) Encoder() string {
+	if c.encoderName == "" {
+		return c.cfg.VideoCodec
+	}
+	return c.encoderName
+}
@@ -0,0 +1,219 @@
+package cloudapp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+// encoderProgram is the supervisord program running winvm/encode.sh
+const encoderProgram = "ffmpeg"
+
+// minKeyframeInterval limits keyframes when many viewers join or lose packets at once
+const minKeyframeInterval = time.Second
+
+// encoderControl drives the video encoder in the app VM over supervisord.
+// Keyframes and bitrate changes go to the running encoder, other commands restart it and it begins with a keyframe
+type encoderControl struct {
+	rpcURL string
+	client *http.Client
+	boost  int
+	ramp   time.Duration
+
+	mu sync.Mutex
+	// settings are steady, a joining viewer boosts the bitrate for a while
+	settings     EncoderSettings
+	lastKeyframe time.Time
+	boosted      bool
+	settle       *time.Timer
+}
+
+func newEncoderControl(rpcURL string, steady, boost int, ramp time.Duration) *encoderControl {
+	return &encoderControl{
+		rpcURL:   rpcURL,
+		client:   &http.Client{Timeout: 2 * time.Second},
+		boost:    boost,
+		ramp:     ramp,
+		settings: EncoderSettings{Bitrate: steady, FPS: videoFrameRate},
+	}
+}
+
+// Keyframe asks the encoder for a keyframe, e.g. on PLI from a viewer
+func (e *encoderControl) Keyframe() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.lastKeyframe) < minKeyframeInterval {
+		return
+	}
+	e.lastKeyframe = time.Now()
+	crash.Go("encoder control", func() { e.send("keyframe") })
+}
+
+// RampUp gives a joining viewer a keyframe at the boosted bitrate, then settles back to the steady bitrate
+func (e *encoderControl) RampUp() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.settle != nil {
+		e.settle.Stop()
+	}
+	e.settle = time.AfterFunc(e.ramp, e.settleDown)
+	if e.boosted && time.Since(e.lastKeyframe) < minKeyframeInterval {
+		return
+	}
+	e.lastKeyframe = time.Now()
+	e.boosted = true
+	crash.Go("encoder control", func() { e.send("bitrate " + strconv.Itoa(e.boost) + "\nkeyframe") })
+}
+
+func (e *encoderControl) settleDown() {
+	e.mu.Lock()
+	e.boosted = false
+	steady := e.settings.Bitrate
+	e.mu.Unlock()
+	e.send("bitrate " + strconv.Itoa(steady))
+}
+
+// Settings returns the steady settings of the encoder
+func (e *encoderControl) Settings() EncoderSettings {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.settings
+}
+
+// Reconfigure restarts the encoder with the settings, the stream goes on with a keyframe.
+// A running ramp up settles to the new bitrate
+func (e *encoderControl) Reconfigure(s EncoderSettings) error {
+	size := "-"
+	if !s.native() {
+		size = fmt.Sprintf("%d:%d", s.Width, s.Height)
+	}
+	bitrate := s.Bitrate
+	e.mu.Lock()
+	if e.boosted && e.boost > bitrate {
+		bitrate = e.boost
+	}
+	e.lastKeyframe = time.Now()
+	e.mu.Unlock()
+	cmd := fmt.Sprintf("encoder %d %d %s %s", bitrate, s.FPS, size, s.Preset)
+	if err := e.call("supervisor.sendProcessStdin", encoderProgram, cmd+"\n"); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.settings = s
+	e.mu.Unlock()
+	return nil
+}
+
+// Crop restarts the encoder streaming the region of the display, letterboxed into the output size if it's set
+func (e *encoderControl) Crop(r Region, out Letterbox) error {
+	e.mu.Lock()
+	e.lastKeyframe = time.Now()
+	e.mu.Unlock()
+	cmd := fmt.Sprintf("crop %d:%d:%d:%d", r.Width, r.Height, r.X, r.Y)
+	if !out.none() {
+		cmd += fmt.Sprintf(" %d:%d", out.Width, out.Height)
+	}
+	return e.call("supervisor.sendProcessStdin", encoderProgram, cmd+"\n")
+}
+
+// Logo restarts the encoder drawing the logo at the path in the app VM, an empty path removes it
+func (e *encoderControl) Logo(path string) error {
+	e.mu.Lock()
+	e.lastKeyframe = time.Now()
+	e.mu.Unlock()
+	if path == "" {
+		path = "-"
+	}
+	return e.call("supervisor.sendProcessStdin", encoderProgram, "logo "+path+"\n")
+}
+
+// Codec restarts the encoder with other ffmpeg video encoder options, e.g. of another codec.
+// The preset of the settings is reset
+func (e *encoderControl) Codec(options string) error {
+	e.mu.Lock()
+	e.lastKeyframe = time.Now()
+	e.settings.Preset = ""
+	e.mu.Unlock()
+	return e.call("supervisor.sendProcessStdin", encoderProgram, "codec "+options+"\n")
+}
+
+// Blank restarts the encoder streaming black frames instead of the display, or the display again
+func (e *encoderControl) Blank(on bool) error {
+	e.mu.Lock()
+	e.lastKeyframe = time.Now()
+	e.mu.Unlock()
+	state := "off"
+	if on {
+		state = "on"
+	}
+	return e.call("supervisor.sendProcessStdin", encoderProgram, "blank "+state+"\n")
+}
+
+// send writes the command to stdin of the encoder program
+func (e *encoderControl) send(cmd string) {
+	if err := e.call("supervisor.sendProcessStdin", encoderProgram, cmd+"\n"); err != nil {
+		log.Printf("Failed to send '%s' to the encoder: %v", cmd, err)
+	}
+}
+
+// Tail returns the end of the stderr log of a program in the app VM, e.g. the encoder
+func (e *encoderControl) Tail(program string, length int) (string, error) {
+	out, err := e.rpc("supervisor.tailProcessStderrLog", program, 0, length)
+	if err != nil {
+		return "", err
+	}
+	// [log, offset, overflow]
+	var resp struct {
+		Values []string `xml:"params>param>value>array>data>value>string"`
+	}
+	if err := xml.Unmarshal(out, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Values) == 0 {
+		return "", nil
+	}
+	return resp.Values[0], nil
+}
+
+func (e *encoderControl) call(method string, params ...interface{}) error {
+	_, err := e.rpc(method, params...)
+	return err
+}
+
+// rpc calls the method with string and int params and returns the response
+func (e *encoderControl) rpc(method string, params ...interface{}) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><methodCall><methodName>` + method + `</methodName><params>`)
+	for _, p := range params {
+		switch p := p.(type) {
+		case int:
+			body.WriteString(`<param><value><int>` + strconv.Itoa(p) + `</int></value></param>`)
+		default:
+			body.WriteString(`<param><value><string>` + html.EscapeString(fmt.Sprint(p)) + `</string></value></param>`)
+		}
+	}
+	body.WriteString(`</params></methodCall>`)
+
+	resp, err := e.client.Post(e.rpcURL, "text/xml", &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || bytes.Contains(out, []byte("<fault>")) {
+		return nil, fmt.Errorf("supervisord %s: %s %s", method, resp.Status, out)
+	}
+	return out, nil
+}
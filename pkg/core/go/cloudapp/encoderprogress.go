@@ -0,0 +1,98 @@
+package cloudapp
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+// encoderProgressPort receives the -progress output of ffmpeg in the app VM
+const encoderProgressPort = 5010
+
+var (
+	encoderFPS      = metrics.NewFloatGaugeVec("cloudmorph_encoder_fps", "Frames per second encoded by ffmpeg", "app")
+	encoderBitrate  = metrics.NewFloatGaugeVec("cloudmorph_encoder_bitrate_kbps", "Output bitrate of ffmpeg in kbps", "app")
+	encoderSpeed    = metrics.NewFloatGaugeVec("cloudmorph_encoder_speed", "Encoding speed relative to realtime, below 1 the encoder falls behind", "app")
+	encoderFrames   = metrics.NewCounterVec("cloudmorph_encoder_frames_total", "Frames encoded by ffmpeg", "app")
+	encoderDropped  = metrics.NewCounterVec("cloudmorph_encoder_dropped_frames_total", "Captured frames dropped by ffmpeg", "app")
+	encoderDup      = metrics.NewCounterVec("cloudmorph_encoder_duplicated_frames_total", "Frames duplicated by ffmpeg to keep the frame rate", "app")
+	encoderRestarts = metrics.NewCounterVec("cloudmorph_encoder_restarts_total", "Encoder restarts, e.g. for crops, codec switches and crashes", "app")
+)
+
+// encoderProgress exports the progress reports of ffmpeg as metrics of the app.
+// ffmpeg reports cumulative frame counts which start over when it restarts
+type encoderProgress struct {
+	app string
+	// last cumulative counts of the running ffmpeg
+	frames, dropped, dup int64
+}
+
+// listenEncoderProgress reads progress reports on the port until the listener fails
+func listenEncoderProgress(app string, port int) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("localhost"), Port: port})
+	if err != nil {
+		log.Println("Failed to listen for encoder progress:", err)
+		return
+	}
+	p := &encoderProgress{app: app}
+	report := map[string]string{}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			log.Println("Encoder progress listener stopped:", err)
+			return
+		}
+		// A report is key=value lines ending with progress=continue or progress=end
+		scanner := bufio.NewScanner(bytes.NewReader(buf[:n]))
+		for scanner.Scan() {
+			kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if kv[0] != "progress" {
+				report[kv[0]] = strings.TrimSpace(kv[1])
+				continue
+			}
+			p.update(report)
+			report = map[string]string{}
+		}
+	}
+}
+
+func (p *encoderProgress) update(report map[string]string) {
+	if v, err := strconv.ParseFloat(report["fps"], 64); err == nil {
+		encoderFPS.With(p.app).Set(v)
+	}
+	// bitrate=1498.2kbits/s, N/A before the first frames
+	if v, err := strconv.ParseFloat(strings.TrimSuffix(report["bitrate"], "kbits/s"), 64); err == nil {
+		encoderBitrate.With(p.app).Set(v)
+	}
+	// speed=1.01x
+	if v, err := strconv.ParseFloat(strings.TrimSuffix(report["speed"], "x"), 64); err == nil {
+		encoderSpeed.With(p.app).Set(v)
+	}
+	frames, err := strconv.ParseInt(report["frame"], 10, 64)
+	if err != nil {
+		return
+	}
+	dropped, _ := strconv.ParseInt(report["drop_frames"], 10, 64)
+	dup, _ := strconv.ParseInt(report["dup_frames"], 10, 64)
+	if frames < p.frames {
+		encoderRestarts.With(p.app).Inc()
+		p.frames, p.dropped, p.dup = 0, 0, 0
+	}
+	encoderFrames.With(p.app).Add(frames - p.frames)
+	if dropped >= p.dropped {
+		encoderDropped.With(p.app).Add(dropped - p.dropped)
+	}
+	if dup >= p.dup {
+		encoderDup.With(p.app).Add(dup - p.dup)
+	}
+	p.frames, p.dropped, p.dup = frames, dropped, dup
+}
@@ -0,0 +1,122 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Limits of the encoder settings of the admin API
+const (
+	minEncoderBitrate = 100
+	maxEncoderBitrate = 50000
+	maxEncoderFPS     = 60
+	maxEncoderWidth   = 3840
+	maxEncoderHeight  = 2160
+)
+
+// presetPattern matches presets of libx264 and nvenc, e.g. ultrafast or llhp
+var presetPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+var errEncoderUnsupported = errors.New("encoder settings are only supported in the Linux app VM")
+
+// EncoderSettings of the running video encoder. Width and height are zero to stream the captured size
+type EncoderSettings struct {
+	// Bitrate in kbps
+	Bitrate int `json:"bitrate"`
+	FPS     int `json:"fps"`
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	// Preset replaces the preset of the encoder options when it's set, e.g. ultrafast
+	Preset string `json:"preset,omitempty"`
+}
+
+func (s EncoderSettings) native() bool {
+	return s.Width == 0 && s.Height == 0
+}
+
+// Validate returns an error if the encoder can't run with the settings
+func (s EncoderSettings) Validate() error {
+	if s.Bitrate < minEncoderBitrate || s.Bitrate > maxEncoderBitrate {
+		return fmt.Errorf("bitrate must be between %d and %d kbps", minEncoderBitrate, maxEncoderBitrate)
+	}
+	if s.FPS < 1 || s.FPS > maxEncoderFPS {
+		return fmt.Errorf("fps must be between 1 and %d", maxEncoderFPS)
+	}
+	if s.Preset != "" && !presetPattern.MatchString(s.Preset) {
+		return fmt.Errorf("wrong preset %q", s.Preset)
+	}
+	if s.native() {
+		return nil
+	}
+	if s.Width <= 0 || s.Height <= 0 || s.Width > maxEncoderWidth || s.Height > maxEncoderHeight {
+		return fmt.Errorf("resolution must be up to %dx%d, or 0x0 for the captured size", maxEncoderWidth, maxEncoderHeight)
+	}
+	// the encoder needs even sizes
+	if s.Width%2 != 0 || s.Height%2 != 0 {
+		return errors.New("width and height must be even")
+	}
+	return nil
+}
+
+func (c *ccImpl) EncoderSettings() (EncoderSettings, error) {
+	if c.encoder == nil {
+		return EncoderSettings{}, errEncoderUnsupported
+	}
+	return c.encoder.Settings(), nil
+}
+
+func (c *ccImpl) SetEncoderSettings(s EncoderSettings) error {
+	if c.encoder == nil {
+		return errEncoderUnsupported
+	}
+	if err := c.encoder.Reconfigure(s); err != nil {
+		return err
+	}
+	log.Printf("Encoder at %d kbps, %d fps, resolution %dx%d", s.Bitrate, s.FPS, s.Width, s.Height)
+	return nil
+}
+
+func (s *Server) handleGetEncoder(w http.ResponseWriter, r *http.Request) {
+	settings, err := s.capp.ccApp.EncoderSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, settings)
+}
+
+// handleSetEncoder changes the bitrate, frame rate or resolution of the running session, fields left out are kept.
+// Changes are not persisted, the instance starts with videoBitrate again.
+// While the worker sheds load they are the steady settings, lowered until headroom returns
+func (s *Server) handleSetEncoder(w http.ResponseWriter, r *http.Request) {
+	settings, err := s.capp.ccApp.EncoderSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if s.loadShed != nil {
+		settings = s.loadShed.Steady()
+	}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "wrong encoder settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.loadShed != nil {
+		err = s.loadShed.SetSteady(settings)
+	} else {
+		err = s.capp.ccApp.SetEncoderSettings(settings)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, settings)
+}
@@ -0,0 +1,19 @@
+package cloudapp
+
+import (
+	"github.com/giongto35/cloud-morph/pkg/common/analytics"
+	"github.com/giongto35/cloud-morph/pkg/common/bus"
+)
+
+// Topics of the event bus of the app instance
+var (
+	// TopicInput carries every Packet sent to the app, from clients, macros and replays
+	TopicInput = bus.NewTopic("input", Packet{})
+	// TopicSession carries the analytics.Event of joins, leaves, errors and admin audits
+	TopicSession = bus.NewTopic("session", analytics.Event{})
+)
+
+// Events returns the event bus of the instance, addons subscribe to its topics
+func (s *Server) Events() *bus.Bus {
+	return s.capp.events
+}
@@ -0,0 +1,195 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/store"
+	"github.com/gorilla/mux"
+)
+
+// featureCollection keeps the flags admins changed at runtime, they win over the config
+const featureCollection = "features"
+
+var errUnknownFeature = errors.New("unknown feature")
+
+// features are the feature flags of the deployment. Flags are evaluated when a session joins,
+// so changes apply to new sessions
+type features struct {
+	config map[string]config.FeatureFlag
+	store  *store.Store
+
+	mu    sync.RWMutex
+	flags map[string]config.FeatureFlag
+}
+
+func newFeatures(flags map[string]config.FeatureFlag, st *store.Store) *features {
+	f := &features{config: flags, store: st, flags: map[string]config.FeatureFlag{}}
+	for name, flag := range flags {
+		f.flags[name] = flag
+	}
+	err := st.Each(featureCollection, func(name string, data json.RawMessage) error {
+		if _, ok := f.config[name]; !ok {
+			return nil
+		}
+		var flag config.FeatureFlag
+		if err := json.Unmarshal(data, &flag); err != nil {
+			return err
+		}
+		f.flags[name] = flag
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to load feature flags:", err)
+	}
+	return f
+}
+
+// forClient evaluates all flags for the user or client with the key and roles
+func (f *features) forClient(key string, roles []string) map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	enabled := make(map[string]bool, len(f.flags))
+	for name, flag := range f.flags {
+		enabled[name] = flagEnabled(name, flag, key, roles)
+	}
+	return enabled
+}
+
+// flagEnabled rolls the flag out by roles and a stable share of the keys, a user keeps its features across sessions
+func flagEnabled(name string, flag config.FeatureFlag, key string, roles []string) bool {
+	if !flag.Enabled {
+		return false
+	}
+	if len(flag.Roles) > 0 && !hasAnyRole(roles, flag.Roles) {
+		return false
+	}
+	if flag.Percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + key))
+	return int(h.Sum32()%100) < flag.Percent
+}
+
+func hasAnyRole(roles []string, wanted []string) bool {
+	for _, role := range roles {
+		for _, w := range wanted {
+			if role == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *features) list() map[string]config.FeatureFlag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	flags := make(map[string]config.FeatureFlag, len(f.flags))
+	for name, flag := range f.flags {
+		flags[name] = flag
+	}
+	return flags
+}
+
+func (f *features) get(name string) (config.FeatureFlag, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	flag, ok := f.flags[name]
+	return flag, ok
+}
+
+// set changes the flag at runtime and keeps it across restarts
+func (f *features) set(name string, flag config.FeatureFlag) error {
+	if _, ok := f.config[name]; !ok {
+		return errUnknownFeature
+	}
+	if err := f.store.Put(featureCollection, name, flag); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.flags[name] = flag
+	f.mu.Unlock()
+	return nil
+}
+
+// reset restores the flag of the config
+func (f *features) reset(name string) error {
+	flag, ok := f.config[name]
+	if !ok {
+		return errUnknownFeature
+	}
+	if err := f.store.Delete(featureCollection, name); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.flags[name] = flag
+	f.mu.Unlock()
+	return nil
+}
+
+func featuresPacket(enabled map[string]bool) cws.WSPacket {
+	data, _ := json.Marshal(enabled)
+	return cws.WSPacket{Type: "FEATURES", Data: string(data)}
+}
+
+// feature returns if the flag is enabled for the client, all features are off before the flags are evaluated
+func (c *Client) feature(name string) bool {
+	c.prefsMu.Lock()
+	defer c.prefsMu.Unlock()
+	return c.features[name]
+}
+
+func (c *Client) setFeatures(enabled map[string]bool) {
+	c.prefsMu.Lock()
+	c.features = enabled
+	c.prefsMu.Unlock()
+}
+
+func (s *Server) handleListFeatures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.features.list())
+}
+
+func (s *Server) handleSetFeature(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	flag, ok := s.features.get(name)
+	if !ok {
+		http.Error(w, errUnknownFeature.Error(), http.StatusNotFound)
+		return
+	}
+	// Fields missing in the body keep their values
+	if err := json.NewDecoder(r.Body).Decode(&flag); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := flag.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.features.set(name, flag); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, flag)
+}
+
+func (s *Server) handleResetFeature(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := s.features.reset(name); err != nil {
+		status := http.StatusInternalServerError
+		if err == errUnknownFeature {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	flag, _ := s.features.get(name)
+	writeJSON(w, flag)
+}
@@ -0,0 +1,146 @@
+package cloudapp
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// refocusBackoff is the pause after an automatic refocus, so an app fighting for focus isn't activated in a loop
+const refocusBackoff = 5 * time.Second
+
+// FocusWindow raises the window of the app VM display and gives it the keyboard focus
+func (c *ccImpl) FocusWindow(id string) error {
+	if c.osType == Windows {
+		return errWindowCaptureUnsupported
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", "exec", "-e", "DISPLAY="+c.vm.display(), c.vm.name(),
+		"xdotool", "windowmap", id, "windowraise", id, "windowfocus", "--sync", id)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// focusManager keeps the keyboard focus on the app window. Wine apps lose it when a dialog closes
+// or the desktop is clicked, and input seems broken until the window is activated again
+type focusManager struct {
+	app CloudAppClient
+	// title is the window title of the config, the target is the first visible window containing it
+	title string
+
+	mu sync.Mutex
+	// last is the time of the last automatic refocus
+	last time.Time
+}
+
+func newFocusManager(app CloudAppClient, title string) *focusManager {
+	return &focusManager{app: app, title: title}
+}
+
+// appWindow returns the window of the app among the windows, the first containing the title. An exact match wins
+func appWindow(windows []AppWindow, title string) (AppWindow, bool) {
+	var match AppWindow
+	found := false
+	for _, w := range windows {
+		if w.Name == title {
+			return w, true
+		}
+		if !found && strings.Contains(strings.ToLower(w.Name), strings.ToLower(title)) {
+			match, found = w, true
+		}
+	}
+	return match, found
+}
+
+// refocus activates the app window
+func (f *focusManager) refocus() (AppWindow, error) {
+	windows, err := f.app.Windows()
+	if err != nil {
+		return AppWindow{}, err
+	}
+	w, ok := appWindow(windows, f.title)
+	if !ok {
+		return AppWindow{}, errWindowNotFound
+	}
+	if err := f.app.FocusWindow(w.ID); err != nil {
+		return w, err
+	}
+	log.Printf("Refocused window %s (%s)", w.ID, w.Name)
+	return w, nil
+}
+
+// watch refocuses the app window when no visible window has the focus, e.g. the desktop took it.
+// Open dialogs of the app keep the focus, the user is meant to answer them
+func (f *focusManager) watch() {
+	ticker := time.NewTicker(focusPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		windows, err := f.app.Windows()
+		if err == errWindowCaptureUnsupported {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := focusedWindow(windows); ok {
+			continue
+		}
+		if _, ok := appWindow(windows, f.title); !ok {
+			continue
+		}
+		f.mu.Lock()
+		due := time.Since(f.last) >= refocusBackoff
+		if due {
+			f.last = time.Now()
+		}
+		f.mu.Unlock()
+		if !due {
+			continue
+		}
+		log.Println("App window lost the focus")
+		if _, err := f.refocus(); err != nil {
+			log.Println("Cannot refocus the app window:", err)
+		}
+	}
+}
+
+// focusedWindow returns the window with the keyboard focus, none while the desktop or a hidden window has it
+func focusedWindow(windows []AppWindow) (AppWindow, bool) {
+	for _, w := range windows {
+		if w.Focused {
+			return w, true
+		}
+	}
+	return AppWindow{}, false
+}
+
+// routeRefocus lets a player give the focus back to the app window when input stops working
+func (s *Server) routeRefocus(client *cws.Client) {
+	client.Receive("REFOCUS", func(req cws.WSPacket) cws.WSPacket {
+		if _, err := s.capp.focus.refocus(); err != nil {
+			log.Println("Cannot refocus the app window:", err)
+			return cws.WSPacket{Type: "REFOCUS_FAILED", Data: s.text(client, err.Error())}
+		}
+		return cws.EmptyPacket
+	})
+}
+
+// handleRefocus activates the app window and returns it
+func (s *Server) handleRefocus(w http.ResponseWriter, r *http.Request) {
+	win, err := s.capp.focus.refocus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, win)
+}
@@ -0,0 +1,193 @@
+package cloudapp
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// entry is what the gate learned of a client admitted to stream the app. Its slots are released by leave
+type entry struct {
+	userID   string
+	userName string
+	audience catalog.Audience
+	signedIn bool
+	// viewLink is the link the client watches by, empty for others
+	viewLink string
+	// playerKey identifies the player for duplicate sessions, empty for spectators and viewers
+	playerKey  string
+	spectating bool
+	// player tells clients with input from viewers, listeners and spectators
+	player        bool
+	guest         *guestSession
+	reservationID string
+	reserved      bool
+	// invitee is the token of the reservation invitee holding the slot
+	invitee string
+	// admitted releases the admission slot of the client
+	admitted func()
+	// room of the session and its instance of the app, the default instance has no room
+	room string
+	svc  *Service
+}
+
+// checkRequest refuses a stream before the upgrade while the worker drains, or when its API token is revoked or expired
+func (s *Server) checkRequest(w http.ResponseWriter, r *http.Request) bool {
+	if s.IsDraining() {
+		log.Println("Reject new session, server is draining")
+		http.Error(w, "server is draining", http.StatusServiceUnavailable)
+		return false
+	}
+	// Headless clients authenticate with an API token, revoked and expired tokens are refused
+	if tok := bearerToken(r); tok != "" && s.signer.Verify(tok, tokenKindUser, &userClaims{}) != nil {
+		t, err := s.apiTokens.verify(tok)
+		if err != nil {
+			log.Println("Reject API client:", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return false
+		}
+		log.Println("API client", t.Name, "is connecting")
+	}
+	return true
+}
+
+// checkFrames refuses HTTP requests for frames of the app, e.g. screenshots, to banned users and to audiences
+// the app is restricted from. Live frames also need a user or API token, anonymous lobbies only get the cached thumbnail
+func (s *Server) checkFrames(w http.ResponseWriter, r *http.Request, live bool) bool {
+	userID, _, audience, signedIn := s.identify(r)
+	if _, ok := s.banned("", r, userID); ok {
+		http.Error(w, "banned", http.StatusForbidden)
+		return false
+	}
+	if !s.content.Allows(audience) {
+		http.NotFound(w, r)
+		return false
+	}
+	if live && !signedIn {
+		http.Error(w, "a user or API token is required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// admit runs the checks every stream of the app goes through after the upgrade, whether WebRTC or MSE: bans,
+// the age and role restrictions of the app, view link limits, duplicate players, guest caps, resets and admission.
+// Admitted clients join the instance of their room, view links watch the default one.
+// viewOnly clients, e.g. listeners and MSE viewers, never play. Refused clients are told why and closed
+func (s *Server) admit(client *cws.Client, r *http.Request, viewOnly bool) (entry, bool) {
+	var e entry
+	clientID := client.GetID()
+	e.userID, e.userName, e.audience, e.signedIn = s.identify(r)
+	if ban, ok := s.banned(clientID, r, e.userID); ok {
+		log.Println("Reject session, user is banned", clientID)
+		client.Send(BannedPacket(ban), nil)
+		client.Close()
+		return e, false
+	}
+	if !s.content.Allows(e.audience) {
+		log.Println("Reject session, app is restricted", clientID)
+		client.Send(cws.WSPacket{Type: "ACCESS_DENIED", Data: s.text(client, "this app is restricted by age or role")}, nil)
+		client.Close()
+		return e, false
+	}
+	room, err := s.rooms.roomOf(r)
+	if err != nil {
+		log.Println("Reject session:", err)
+		client.Send(cws.WSPacket{Type: "ROOM_DENIED", Data: s.text(client, err.Error())}, nil)
+		client.Close()
+		return e, false
+	}
+	// Viewers of a view link watch the session without input
+	if viewToken := r.URL.Query().Get("view"); viewToken != "" {
+		room = ""
+		if s.kiosk.Enabled {
+			err = errKioskLocked
+		} else {
+			e.viewLink, err = s.shares.join(viewToken, client)
+		}
+		if err != nil {
+			log.Println("Reject viewer:", err)
+			client.Send(cws.WSPacket{Type: "VIEW_DENIED", Data: s.text(client, err.Error())}, nil)
+			client.Close()
+			return e, false
+		}
+	}
+	// A second connection of a player, e.g. another tab, is refused, takes over or spectates by the policy
+	if e.viewLink == "" && !viewOnly {
+		// Players may play several rooms at once, one connection each
+		if e.playerKey = duplicateKey(e.userID, r.URL.Query().Get("guest")); e.playerKey != "" && room != "" {
+			e.playerKey += "@" + room
+		}
+		_, resumed := s.resumeICE(r.URL.Query().Get("resume"))
+		playing, err := s.duplicates.claim(e.playerKey, client, resumed)
+		if err != nil {
+			log.Println("Reject session, player is connected already", clientID)
+			client.Send(cws.WSPacket{Type: "DUPLICATE_SESSION", Data: s.text(client, err.Error())}, nil)
+			client.Close()
+			return e, false
+		}
+		if !playing {
+			e.playerKey, e.spectating = "", true
+		}
+	}
+	e.player = e.viewLink == "" && !viewOnly && !e.spectating
+	// Anonymous players are guests with a capped session, viewers and listeners without cap
+	if s.guests != nil && !e.signedIn && e.player {
+		g, err := s.guests.join(r.URL.Query().Get("guest"))
+		if err != nil {
+			log.Println("Reject guest:", err)
+			client.Send(cws.WSPacket{Type: "GUEST_EXPIRED", Data: s.text(client, err.Error())}, nil)
+			s.leave(e, client)
+			client.Close()
+			return e, false
+		}
+		e.guest = &g
+	}
+	// New sessions wait while the app is reset for the next user.
+	// Invitees of a reservation take its held slot before admission, so the held slot is theirs to fill
+	if !s.resets.wait(client) {
+		s.leave(e, client)
+		client.Close()
+		return e, false
+	}
+	e.invitee = r.URL.Query().Get("token")
+	if e.reservationID, e.reserved = s.reservations.claim(e.invitee); !e.reserved {
+		e.invitee = ""
+	}
+	var admitted bool
+	if e.admitted, admitted = s.admission.Admit(client); !admitted {
+		log.Println("Session is not admitted", clientID)
+		s.leave(e, client)
+		client.Close()
+		return e, false
+	}
+	e.svc = s.capp
+	if room != "" {
+		if e.svc, err = s.rooms.join(room); err != nil {
+			log.Println("Reject session of room", room, err)
+			client.Send(cws.WSPacket{Type: "ROOM_DENIED", Data: s.text(client, err.Error())}, nil)
+			s.leave(e, client)
+			client.Close()
+			return e, false
+		}
+		e.room = room
+	}
+	return e, true
+}
+
+// leave releases the view link, player, reservation and room slots the client took at the gate
+func (s *Server) leave(e entry, client *cws.Client) {
+	if e.room != "" {
+		s.rooms.leave(e.room)
+	}
+	if e.reserved {
+		s.reservations.release(e.reservationID, e.invitee)
+	}
+	if e.admitted != nil {
+		e.admitted()
+	}
+	s.shares.leave(e.viewLink, client)
+	s.duplicates.release(e.playerKey, client)
+}
@@ -0,0 +1,151 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// Letterbox is the output size the captured region is scaled into keeping its aspect ratio, zero for none
+type Letterbox struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (l Letterbox) none() bool {
+	return l.Width <= 0 || l.Height <= 0
+}
+
+// picture returns the size of the streamed picture of the region
+func (l Letterbox) picture(r Region) Letterbox {
+	if l.none() {
+		return Letterbox{Width: r.Width, Height: r.Height}
+	}
+	return l
+}
+
+// toDisplay maps a point of the streamed picture to the display. Points on the black bars go to the nearest edge
+func (l Letterbox) toDisplay(r Region, x, y float32) (float32, float32) {
+	if l.none() || r.empty() {
+		return float32(r.X) + x, float32(r.Y) + y
+	}
+	scale := float32(l.Width) / float32(r.Width)
+	if s := float32(l.Height) / float32(r.Height); s < scale {
+		scale = s
+	}
+	padX := (float32(l.Width) - float32(r.Width)*scale) / 2
+	padY := (float32(l.Height) - float32(r.Height)*scale) / 2
+	return float32(r.X) + clampf((x-padX)/scale, float32(r.Width-1)), float32(r.Y) + clampf((y-padY)/scale, float32(r.Height-1))
+}
+
+func clampf(v, max float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// geometryOf returns the region of the app screen and the letterbox of the geometry
+func geometryOf(g catalog.CaptureGeometry, appScreen Region) (Region, Letterbox) {
+	screen := appScreen
+	if g.Width > 0 && g.Height > 0 {
+		screen = Region{X: g.X, Y: g.Y, Width: g.Width, Height: g.Height}
+	}
+	// the encoder needs even sizes
+	return screen.clamp(vmDisplayWidth, vmDisplayHeight), Letterbox{Width: g.OutputWidth &^ 1, Height: g.OutputHeight &^ 1}
+}
+
+// SetCapture streams the region of the display, letterboxed into the output size if it's set. Mouse input of clients is mapped into the region
+func (c *ccImpl) SetCapture(r Region, out Letterbox) error {
+	if c.encoder == nil {
+		return errWindowCaptureUnsupported
+	}
+	r = r.clamp(vmDisplayWidth, vmDisplayHeight)
+	if r.empty() {
+		return fmt.Errorf("capture region %+v is outside of the display", r)
+	}
+	if err := c.encoder.Crop(r, out); err != nil {
+		return err
+	}
+	c.captureMu.Lock()
+	c.region, c.letterbox = r, out
+	c.captureMu.Unlock()
+	log.Printf("Capture region %dx%d+%d+%d, letterbox %dx%d", r.Width, r.Height, r.X, r.Y, out.Width, out.Height)
+	return nil
+}
+
+func (c *ccImpl) capture() (Region, Letterbox) {
+	c.captureMu.Lock()
+	defer c.captureMu.Unlock()
+	return c.region, c.letterbox
+}
+
+// setGeometry changes the region of the app screen and the letterbox of all captures
+func (w *windowCapture) setGeometry(g catalog.CaptureGeometry, appScreen Region) (Capture, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prevScreen, prevLetterbox := w.screen, w.letterbox
+	w.screen, w.letterbox = geometryOf(g, appScreen)
+	target, region := w.current.Target, w.current.Region
+	if target == config.CaptureScreen {
+		region = w.screen
+	}
+	if err := w.applyLocked(target, region); err != nil {
+		w.screen, w.letterbox = prevScreen, prevLetterbox
+		return w.current, err
+	}
+	return w.current, nil
+}
+
+// captureStatus is the response of the capture admin API
+type captureStatus struct {
+	Capture  Capture                 `json:"capture"`
+	Geometry catalog.CaptureGeometry `json:"geometry"`
+}
+
+func (w *windowCapture) status() captureStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return captureStatus{
+		Capture: w.current,
+		Geometry: catalog.CaptureGeometry{
+			X:            w.screen.X,
+			Y:            w.screen.Y,
+			Width:        w.screen.Width,
+			Height:       w.screen.Height,
+			OutputWidth:  w.letterbox.Width,
+			OutputHeight: w.letterbox.Height,
+		},
+	}
+}
+
+func (s *Server) handleGetCapture(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.capp.windows.status())
+}
+
+// handleSetCapture adjusts the crop region and letterbox of the app at runtime, e.g. while watching the stream.
+// Changes are not persisted, put the geometry into the app manifest to keep it
+func (s *Server) handleSetCapture(w http.ResponseWriter, r *http.Request) {
+	var g catalog.CaptureGeometry
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "wrong capture geometry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := g.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appScreen := Region{Width: s.capp.config.ScreenWidth, Height: s.capp.config.ScreenHeight}
+	if _, err := s.capp.windows.setGeometry(g, appScreen); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, s.capp.windows.status())
+}
@@ -0,0 +1,128 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/analytics"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/token"
+	"github.com/gofrs/uuid"
+)
+
+// tokenKindGuest tokens let a guest reconnect to the rest of its capped session
+const tokenKindGuest = "guest"
+
+// guestWarning is how long before the end of a guest session the guest is warned
+const guestWarning = time.Minute
+
+var errGuestExpired = errors.New("the guest session is over, sign in to keep playing")
+
+type guestClaims struct {
+	token.Claims
+	GuestID string `json:"gid"`
+}
+
+// guestSession is the data of the GUEST packet
+type guestSession struct {
+	// Token resumes the session with ?guest= after a reconnect
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Watermark bool      `json:"watermark"`
+}
+
+// guests caps the sessions of anonymous users
+type guests struct {
+	cfg    config.GuestConfig
+	signer *token.Signer
+}
+
+func newGuests(cfg config.GuestConfig, signer *token.Signer) *guests {
+	return &guests{cfg: cfg, signer: signer}
+}
+
+// join starts a guest session, or resumes the one of tok. It fails when that session is over
+func (g *guests) join(tok string) (guestSession, error) {
+	if tok != "" {
+		var claims guestClaims
+		if err := g.signer.Verify(tok, tokenKindGuest, &claims); err != nil {
+			return guestSession{}, errGuestExpired
+		}
+		return guestSession{Token: tok, ExpiresAt: time.Unix(claims.Exp, 0), Watermark: g.cfg.Watermark}, nil
+	}
+	expiresAt := time.Now().Add(time.Duration(g.cfg.SessionLimit) * time.Second)
+	tok, err := g.signer.Sign(guestClaims{
+		Claims:  token.Claims{Kind: tokenKindGuest, Exp: expiresAt.Unix()},
+		GuestID: uuid.Must(uuid.NewV4()).String(),
+	})
+	if err != nil {
+		return guestSession{}, err
+	}
+	return guestSession{Token: tok, ExpiresAt: expiresAt, Watermark: g.cfg.Watermark}, nil
+}
+
+// startGuest ends the session of a guest when its time is up, unless it signs in with UPGRADE before.
+// The upgrade keeps the connection and the session, which moves to the user
+func (s *Server) startGuest(client *cws.Client, serviceClient *Client, guest guestSession) {
+	data, _ := json.Marshal(guest)
+	client.Send(cws.WSPacket{Type: "GUEST", Data: string(data)}, nil)
+
+	var mu sync.Mutex
+	upgraded := false
+	warn := time.AfterFunc(time.Until(guest.ExpiresAt.Add(-guestWarning)), func() {
+		ann := Announcement{
+			Level:        announceWarning,
+			At:           time.Now(),
+			Message:      s.text(client, "Your guest session ends soon, sign in to keep playing"),
+			DisconnectAt: &guest.ExpiresAt,
+		}
+		client.Send(announcePacket(ann), nil)
+	})
+	end := time.AfterFunc(time.Until(guest.ExpiresAt), func() {
+		log.Println("Guest session is over", client.GetID())
+		client.Send(cws.WSPacket{Type: "GUEST_EXPIRED", Data: s.text(client, errGuestExpired.Error())}, nil)
+		client.Close()
+	})
+	// stop returns false when the session is over or already upgraded
+	stop := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		warn.Stop()
+		if upgraded || !end.Stop() {
+			return false
+		}
+		upgraded = true
+		return true
+	}
+
+	client.Receive("UPGRADE", func(req cws.WSPacket) cws.WSPacket {
+		var claims userClaims
+		if err := s.signer.Verify(req.Data, tokenKindUser, &claims); err != nil || claims.Subject == "" {
+			return cws.WSPacket{Type: "UPGRADE_FAILED", Data: s.text(client, "sign in is not valid")}
+		}
+		if !s.content.Allows(claims.Audience) {
+			return cws.WSPacket{Type: "UPGRADE_FAILED", Data: s.text(client, "this app is restricted by age or role")}
+		}
+		if !stop() {
+			return cws.WSPacket{Type: "UPGRADE_FAILED", Data: s.text(client, errGuestExpired.Error())}
+		}
+		s.switchUser(client, serviceClient, claims.userID())
+		s.overlay.join(client.GetID(), claims.name(), claims.Roles)
+		log.Println("Guest signed in", client.GetID())
+		s.capp.events.Publish(TopicSession, analytics.Event{
+			Type:     analytics.EventGuestUpgrade,
+			ClientID: client.GetID(),
+			AppName:  s.appMeta.AppName,
+		})
+		return cws.WSPacket{Type: "UPGRADED"}
+	})
+	crash.Go("guest session", func() {
+		<-client.Done
+		stop()
+	}, "client", client.GetID())
+}
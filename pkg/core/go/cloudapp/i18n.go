@@ -0,0 +1,17 @@
+package cloudapp
+
+import (
+	"net/http"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// negotiateLocale picks the locale of the client from ?lang= of the handshake or its Accept-Language
+func (s *Server) negotiateLocale(client *cws.Client, r *http.Request) {
+	client.SetLocale(s.messages.Match(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language")))
+}
+
+// text translates a user-facing message to the locale of the client
+func (s *Server) text(client *cws.Client, msg string) string {
+	return s.messages.T(client.Locale(), msg)
+}
@@ -0,0 +1,56 @@
+package cloudapp
+
+import (
+	"log"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+const idleCheckInterval = 5 * time.Second
+
+// watchIdle warns clients who sent no input for warnAfter, then ends their session or makes them viewers at timeout
+func (s *Server) watchIdle(cfg config.IdleConfig) {
+	warnAfter := time.Duration(cfg.WarnAfter) * time.Second
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	warned := map[string]bool{}
+
+	for range time.Tick(idleCheckInterval) {
+		active := map[string]bool{}
+		for _, client := range s.capp.snapshotClients() {
+			idle, ok := client.input.idle()
+			if !ok {
+				continue
+			}
+			active[client.clientID] = true
+			switch {
+			case idle >= timeout:
+				log.Printf("Client %s is idle for %v, %s", client.clientID, idle.Round(time.Second), cfg.Action)
+				delete(warned, client.clientID)
+				if cfg.Action == config.IdleSpectate {
+					client.SetViewOnly(true)
+					client.ws.Send(cws.WSPacket{Type: "VIEW_ONLY"}, nil)
+				} else {
+					client.ws.Close()
+				}
+			case idle >= warnAfter && !warned[client.clientID]:
+				warned[client.clientID] = true
+				at := time.Now().Add(timeout - idle)
+				ann := Announcement{Level: "warning", At: time.Now(), Message: s.text(client.ws, "You seem to be away. Move the mouse or press a key to stay")}
+				if cfg.Action == config.IdleDisconnect {
+					ann.DisconnectAt = &at
+				}
+				client.ws.Send(announcePacket(ann), nil)
+			case idle < warnAfter && warned[client.clientID]:
+				delete(warned, client.clientID)
+				client.ws.Send(cws.WSPacket{Type: "IDLE_CLEARED"}, nil)
+			}
+		}
+		for clientID := range warned {
+			if !active[clientID] {
+				delete(warned, clientID)
+			}
+		}
+	}
+}
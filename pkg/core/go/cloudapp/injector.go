@@ -0,0 +1,99 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// Input backends
+const (
+	// InputSyncinput sends events to syncinput.exe, which runs next to the app and calls SendInput
+	InputSyncinput = "syncinput"
+	// InputXdotool runs xdotool in the app VM. It types X keysyms, also in scancode mode
+	InputXdotool = "xdotool"
+	// InputSendInput calls Windows SendInput from the worker, for apps running on the same Windows host
+	InputSendInput = "sendinput"
+)
+
+// InputInjector delivers input events to the app
+type InputInjector interface {
+	// Inject sends the events in order. Events are dropped when the backend is not ready
+	Inject(events []inputEvent) error
+	Close() error
+}
+
+// inputEvent is a decoded key or mouse event
+type inputEvent struct {
+	Type    string
+	KeyCode int
+	IsLeft  bool
+	// X and Y are scaled to the app screen
+	X, Y float32
+	// Width and Height of the client video element
+	Width, Height float32
+}
+
+// decodeInput returns the input event of the packet, false for packets which are not input
+func decodeInput(packet Packet, screenWidth, screenHeight float32) (inputEvent, bool) {
+	e := inputEvent{Type: packet.Type}
+	switch packet.Type {
+	case eventKeyDown, eventKeyUp:
+		var p struct {
+			KeyCode int `json:"keycode"`
+		}
+		json.Unmarshal([]byte(packet.Data), &p)
+		e.KeyCode = p.KeyCode
+	case eventMouseMove, eventMouseDown, eventMouseUp:
+		var p struct {
+			IsLeft byte    `json:"isLeft"`
+			X      float32 `json:"x"`
+			Y      float32 `json:"y"`
+			Width  float32 `json:"width"`
+			Height float32 `json:"height"`
+		}
+		json.Unmarshal([]byte(packet.Data), &p)
+		if p.Width == 0 || p.Height == 0 {
+			return e, false
+		}
+		e.IsLeft = p.IsLeft == 1
+		e.X = p.X * screenWidth / p.Width
+		e.Y = p.Y * screenHeight / p.Height
+		e.Width, e.Height = p.Width, p.Height
+	default:
+		return e, false
+	}
+	return e, true
+}
+
+// newInjector returns the input backend of the config. syncinput is the default
+func newInjector(cfg config.Config, vm appVM) (InputInjector, error) {
+	width, height := float32(cfg.ScreenWidth), float32(cfg.ScreenHeight)
+	switch cfg.InputBackend {
+	case "", InputSyncinput:
+		return newSyncinputInjector(":"+strconv.Itoa(vm.inputPort()), cfg.Scancodes)
+	case InputXdotool:
+		return newXdotoolInjector(vm), nil
+	case InputSendInput:
+		return newSendInputInjector(width, height, cfg.HWKey, cfg.Scancodes)
+	}
+	return nil, fmt.Errorf("unknown input backend %s", cfg.InputBackend)
+}
+
+// mustInjector falls back to syncinput when the configured backend is not available
+func mustInjector(cfg config.Config, vm appVM) InputInjector {
+	injector, err := newInjector(cfg, vm)
+	if err == nil {
+		log.Println("Input backend:", cfg.InputBackend)
+		return injector
+	}
+	log.Printf("Input backend %s is not available: %v, use syncinput", cfg.InputBackend, err)
+	injector, err = newSyncinputInjector(":"+strconv.Itoa(vm.inputPort()), cfg.Scancodes)
+	if err != nil {
+		panic(err)
+	}
+	return injector
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package cloudapp
+
+import "errors"
+
+func newSendInputInjector(width, height float32, hwKey bool, scancodes bool) (InputInjector, error) {
+	return nil, errors.New("sendinput is only supported on Windows")
+}
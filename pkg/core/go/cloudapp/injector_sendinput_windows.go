@@ -0,0 +1,158 @@
+package cloudapp
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	user32               = syscall.NewLazyDLL("user32.dll")
+	procSendInput        = user32.NewProc("SendInput")
+	procMapVirtualKey    = user32.NewProc("MapVirtualKeyW")
+	procGetSystemMetrics = user32.NewProc("GetSystemMetrics")
+)
+
+// winuser.h
+const (
+	inputMouse    = 0
+	inputKeyboard = 1
+
+	mouseeventfMove       = 0x0001
+	mouseeventfLeftDown   = 0x0002
+	mouseeventfLeftUp     = 0x0004
+	mouseeventfRightDown  = 0x0008
+	mouseeventfRightUp    = 0x0010
+	mouseeventfAbsolute   = 0x8000
+	keyeventfExtendedKey  = 0x0001
+	keyeventfKeyUp        = 0x0002
+	keyeventfScancode     = 0x0008
+	smCxScreen            = 0
+	smCyScreen            = 1
+	mapvkVkToVsc          = 0
+	absoluteCoordinateMax = 65535
+)
+
+type mouseInput struct {
+	dx, dy    int32
+	mouseData uint32
+	flags     uint32
+	time      uint32
+	extra     uintptr
+}
+
+type keybdInput struct {
+	vk, scan uint16
+	flags    uint32
+	time     uint32
+	extra    uintptr
+}
+
+// winInput is INPUT with MOUSEINPUT, the largest member of the union
+type winInput struct {
+	typ uint32
+	mi  mouseInput
+}
+
+// sendInputInjector calls SendInput of the Windows desktop the worker runs on
+type sendInputInjector struct {
+	mu sync.Mutex
+	// coordinates of the app screen are scaled to the absolute range of the primary monitor
+	scaleX, scaleY float32
+	// hwKey sends scan codes of the keyboard layout for DirectX games, scancodes sends raw scan codes of the keymap
+	hwKey     bool
+	scancodes bool
+}
+
+func newSendInputInjector(width, height float32, hwKey bool, scancodes bool) (InputInjector, error) {
+	if err := procSendInput.Find(); err != nil {
+		return nil, err
+	}
+	screenW, _, _ := procGetSystemMetrics.Call(smCxScreen)
+	screenH, _, _ := procGetSystemMetrics.Call(smCyScreen)
+	if screenW == 0 || screenH == 0 {
+		screenW, screenH = uintptr(width), uintptr(height)
+	}
+	return &sendInputInjector{
+		scaleX:    absoluteCoordinateMax / float32(screenW-1),
+		scaleY:    absoluteCoordinateMax / float32(screenH-1),
+		hwKey:     hwKey,
+		scancodes: scancodes,
+	}, nil
+}
+
+func (s *sendInputInjector) Inject(events []inputEvent) error {
+	inputs := make([]winInput, 0, len(events)*2)
+	for _, e := range events {
+		switch e.Type {
+		case eventKeyDown, eventKeyUp:
+			inputs = append(inputs, s.key(e))
+		case eventMouseMove, eventMouseDown, eventMouseUp:
+			in := winInput{typ: inputMouse}
+			in.mi.dx = int32(e.X * s.scaleX)
+			in.mi.dy = int32(e.Y * s.scaleY)
+			in.mi.flags = mouseeventfMove | mouseeventfAbsolute
+			switch {
+			case e.Type == eventMouseDown && e.IsLeft:
+				in.mi.flags |= mouseeventfLeftDown
+			case e.Type == eventMouseDown:
+				in.mi.flags |= mouseeventfRightDown
+			case e.Type == eventMouseUp && e.IsLeft:
+				in.mi.flags |= mouseeventfLeftUp
+			case e.Type == eventMouseUp:
+				in.mi.flags |= mouseeventfRightUp
+			}
+			inputs = append(inputs, in)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _, err := procSendInput.Call(uintptr(len(inputs)), uintptr(unsafe.Pointer(&inputs[0])), unsafe.Sizeof(inputs[0]))
+	if int(n) != len(inputs) {
+		return err
+	}
+	return nil
+}
+
+// key returns the keyboard INPUT. The browser keyCode is the virtual-key code
+func (s *sendInputInjector) key(e inputEvent) winInput {
+	in := winInput{typ: inputKeyboard}
+	ki := (*keybdInput)(unsafe.Pointer(&in.mi))
+	if code, extended, ok := scancode(e.KeyCode); s.scancodes && ok {
+		ki.scan = code
+		ki.flags = keyeventfScancode
+		if extended {
+			ki.flags |= keyeventfExtendedKey
+		}
+	} else if s.hwKey {
+		scan, _, _ := procMapVirtualKey.Call(uintptr(e.KeyCode), mapvkVkToVsc)
+		ki.scan = uint16(scan)
+		ki.flags = keyeventfScancode
+		if isExtendedKey(e.KeyCode) {
+			ki.flags |= keyeventfExtendedKey
+		}
+	} else {
+		ki.vk = uint16(e.KeyCode)
+	}
+	if e.Type == eventKeyUp {
+		ki.flags |= keyeventfKeyUp
+	}
+	return in
+}
+
+// isExtendedKey are keys with E0 prefixed scan codes, the arrows and navigation keys
+func isExtendedKey(keyCode int) bool {
+	switch keyCode {
+	case 33, 34, 35, 36, 37, 38, 39, 40, 45, 46, 91, 111:
+		return true
+	}
+	return false
+}
+
+func (s *sendInputInjector) Close() error {
+	return nil
+}
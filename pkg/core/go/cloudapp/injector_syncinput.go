@@ -0,0 +1,132 @@
+package cloudapp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+// syncinputInjector sends events to syncinput.exe over TCP. syncinput connects to the worker from the app VM
+type syncinputInjector struct {
+	mu   sync.Mutex
+	conn *net.TCPConn
+	// scancodes sends raw scan codes instead of virtual-key codes
+	scancodes bool
+}
+
+func newSyncinputInjector(addr string, scancodes bool) (*syncinputInjector, error) {
+	la, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("listening syncinput at", addr)
+	ln, err := net.ListenTCP("tcp", la)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &syncinputInjector{scancodes: scancodes}
+	crash.Go("syncinput health", s.healthCheck)
+	// NOTE: Why Websocket: because normal IPC cannot communicate cross OS.
+	crash.Go("syncinput listener", func() {
+		for {
+			log.Println("Waiting syncinput to connect")
+			// Polling Wine socket connection (input stream)
+			conn, err := ln.AcceptTCP()
+			log.Println("Accepted a TCP connection")
+			if err != nil {
+				log.Println("err: ", err)
+				continue
+			}
+			conn.SetKeepAlive(true)
+			conn.SetKeepAlivePeriod(10 * time.Second)
+			s.mu.Lock()
+			s.conn = conn
+			s.mu.Unlock()
+			log.Println("Launched IPC with VM")
+		}
+	})
+	return s, nil
+}
+
+// healthCheck pings syncinput to maintain connection with Virtual Machine
+func (s *syncinputInjector) healthCheck() {
+	log.Println("Starting health check")
+	for {
+		s.write([]byte{0})
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// disconnect drops the connection until syncinput of a relaunched VM connects
+func (s *syncinputInjector) disconnect() {
+	s.mu.Lock()
+	s.conn = nil
+	s.mu.Unlock()
+}
+
+func (s *syncinputInjector) Inject(events []inputEvent) error {
+	var msg strings.Builder
+	for _, e := range events {
+		msg.WriteString(s.format(e))
+	}
+	if msg.Len() == 0 {
+		return nil
+	}
+	return s.write([]byte(msg.String()))
+}
+
+func (s *syncinputInjector) write(msg []byte) error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// format returns the syncinput message of the event
+func (s *syncinputInjector) format(e inputEvent) string {
+	switch e.Type {
+	case eventKeyUp, eventKeyDown:
+		state := 0
+		if e.Type == eventKeyDown {
+			state = 1
+		}
+		// Scan code is in format of "S<code>,<extended>,<state>"
+		if code, extended, ok := scancode(e.KeyCode); s.scancodes && ok {
+			ext := 0
+			if extended {
+				ext = 1
+			}
+			return fmt.Sprintf("S%d,%d,%d|", code, ext, state)
+		}
+		return fmt.Sprintf("K%d,%b|", e.KeyCode, state)
+	}
+
+	var mouseState int
+	switch e.Type {
+	case eventMouseDown:
+		mouseState = 1
+	case eventMouseUp:
+		mouseState = 2
+	}
+	isLeft := 0
+	if e.IsLeft {
+		isLeft = 1
+	}
+	// Mouse is in format of comma separated "12.4,52.3"
+	return fmt.Sprintf("M%d,%d,%f,%f,%f,%f|", isLeft, mouseState, e.X, e.Y, e.Width, e.Height)
+}
+
+func (s *syncinputInjector) Close() error {
+	s.disconnect()
+	return nil
+}
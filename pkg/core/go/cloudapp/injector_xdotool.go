@@ -0,0 +1,110 @@
+package cloudapp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+// xdotoolLoop runs xdotool in the app VM once per line of arguments from stdin,
+// so only xdotool is spawned per batch instead of a docker exec
+const xdotoolLoop = `while read -r args; do xdotool $args; done`
+
+// xdotoolInjector types X keysyms and moves the X pointer of the app VM display
+type xdotoolInjector struct {
+	vm    appVM
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newXdotoolInjector(vm appVM) *xdotoolInjector {
+	return &xdotoolInjector{vm: vm}
+}
+
+// start runs the xdotool loop unless it's running. The caller holds the lock
+func (x *xdotoolInjector) start() error {
+	if x.cmd != nil {
+		return nil
+	}
+	cmd := exec.Command("docker", "exec", "-i", "-e", "DISPLAY="+x.vm.display(), x.vm.name(), "sh", "-c", xdotoolLoop)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	x.cmd, x.stdin = cmd, stdin
+	crash.Go("xdotool wait", func() {
+		err := cmd.Wait()
+		log.Println("xdotool exited:", err)
+		x.mu.Lock()
+		if x.cmd == cmd {
+			x.cmd, x.stdin = nil, nil
+		}
+		x.mu.Unlock()
+	})
+	return nil
+}
+
+func (x *xdotoolInjector) Inject(events []inputEvent) error {
+	var args []string
+	for _, e := range events {
+		args = append(args, x.format(e)...)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.start(); err != nil {
+		return err
+	}
+	// xdotool chains all commands of a batch in one run
+	_, err := fmt.Fprintln(x.stdin, strings.Join(args, " "))
+	return err
+}
+
+// format returns the xdotool commands of the event
+func (x *xdotoolInjector) format(e inputEvent) []string {
+	switch e.Type {
+	case eventKeyDown, eventKeyUp:
+		key, ok := keymap[e.KeyCode]
+		if !ok {
+			return nil
+		}
+		if e.Type == eventKeyDown {
+			return []string{"keydown", key.keysym}
+		}
+		return []string{"keyup", key.keysym}
+	}
+
+	move := []string{"mousemove", fmt.Sprint(int(e.X)), fmt.Sprint(int(e.Y))}
+	button := "3"
+	if e.IsLeft {
+		button = "1"
+	}
+	switch e.Type {
+	case eventMouseDown:
+		return append(move, "mousedown", button)
+	case eventMouseUp:
+		return append(move, "mouseup", button)
+	}
+	return move
+}
+
+func (x *xdotoolInjector) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.stdin == nil {
+		return nil
+	}
+	return x.stdin.Close()
+}
@@ -0,0 +1,81 @@
+package cloudapp
+
+import (
+	"log"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/bus"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+const inputQueueSize = 256
+
+var (
+	inputQueueDepth    = metrics.NewGauge("cloudmorph_input_queue_depth", "Number of input events waiting to be sent to the app")
+	inputEventsDropped = metrics.NewCounter("cloudmorph_input_events_dropped_total", "Input events dropped because the queue is full")
+	inputEventsMerged  = metrics.NewCounter("cloudmorph_input_events_merged_total", "Mouse move events merged into a later one")
+)
+
+// inputQueue buffers input events from all clients to the app.
+// Push never blocks the producer: consecutive mouse moves are merged into the latest position,
+// other events keep their order and are dropped when the queue is full
+type inputQueue struct {
+	mu     sync.Mutex
+	events []Packet
+	size   int
+	// ready is signaled when there are events to drain
+	ready chan struct{}
+	// bus receives every pushed event on TopicInput, in order
+	bus *bus.Bus
+}
+
+func newInputQueue(size int, events *bus.Bus) *inputQueue {
+	return &inputQueue{
+		events: make([]Packet, 0, 16),
+		size:   size,
+		ready:  make(chan struct{}, 1),
+		bus:    events,
+	}
+}
+
+// Push adds an event to the queue
+func (q *inputQueue) Push(event Packet) {
+	q.mu.Lock()
+	q.bus.Publish(TopicInput, event)
+	switch {
+	case event.Type == eventMouseMove && len(q.events) > 0 && q.events[len(q.events)-1].Type == eventMouseMove:
+		q.events[len(q.events)-1] = event
+		inputEventsMerged.Inc()
+	case len(q.events) >= q.size:
+		log.Println("Input queue is full, drop", event.Type)
+		inputEventsDropped.Inc()
+	default:
+		q.events = append(q.events, event)
+	}
+	inputQueueDepth.Set(int64(len(q.events)))
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns the channel signaled when events are pushed
+func (q *inputQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Drain returns buffered events and resets the queue
+func (q *inputQueue) Drain() []Packet {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events) == 0 {
+		return nil
+	}
+	batch := make([]Packet, len(q.events))
+	copy(batch, q.events)
+	q.events = q.events[:0]
+	inputQueueDepth.Set(0)
+	return batch
+}
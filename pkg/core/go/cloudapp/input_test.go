@@ -0,0 +1,29 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// BenchmarkInputDecodeJSON measures the DataChannel input path: JSON decode, queue and syncinput formatting
+func BenchmarkInputDecodeJSON(b *testing.B) {
+	raw := []byte(`{"type":"MOUSEMOVE","data":"{\"isLeft\":1,\"x\":120.5,\"y\":240.25,\"width\":800,\"height\":600}"}`)
+	s := &syncinputInjector{}
+	q := newInputQueue(inputQueueSize, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wspacket := cws.WSPacket{}
+		if err := json.Unmarshal(raw, &wspacket); err != nil {
+			b.Fatal(err)
+		}
+		q.Push(convertWSPacket(wspacket))
+		for _, event := range q.Drain() {
+			if e, ok := decodeInput(event, 800, 600); ok {
+				s.format(e)
+			}
+		}
+	}
+}
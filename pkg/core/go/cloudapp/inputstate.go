@@ -0,0 +1,143 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// eventBlur is sent by the browser when the tab loses focus
+const eventBlur = "BLUR"
+
+// inputState tracks keys and mouse buttons a client holds down in the app.
+// They are released on blur, disconnect and when the client loses control, so they don't stay stuck
+type inputState struct {
+	mu       sync.Mutex
+	viewOnly bool
+	// suspended while an admin has control of the session
+	suspended bool
+	// waiting for its turn in the control queue
+	waiting bool
+	keys    map[int]struct{}
+	// buttons keeps the data of the mouse down event to release the button at the same position
+	buttons map[bool]string
+	// lastInput is the time of the latest accepted input, for idle detection
+	lastInput time.Time
+}
+
+func newInputState() *inputState {
+	return &inputState{
+		keys:      map[int]struct{}{},
+		buttons:   map[bool]string{},
+		lastInput: time.Now(),
+	}
+}
+
+// accept records the packet and reports whether it goes to the app
+func (s *inputState) accept(packet Packet) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.viewOnly || s.suspended || s.waiting {
+		return false
+	}
+	s.lastInput = time.Now()
+	switch packet.Type {
+	case eventKeyDown, eventKeyUp:
+		var p struct {
+			KeyCode int `json:"keycode"`
+		}
+		json.Unmarshal([]byte(packet.Data), &p)
+		if packet.Type == eventKeyDown {
+			s.keys[p.KeyCode] = struct{}{}
+		} else {
+			delete(s.keys, p.KeyCode)
+		}
+	case eventMouseDown, eventMouseUp:
+		var p struct {
+			IsLeft byte `json:"isLeft"`
+		}
+		json.Unmarshal([]byte(packet.Data), &p)
+		if packet.Type == eventMouseDown {
+			s.buttons[p.IsLeft == 1] = packet.Data
+		} else {
+			delete(s.buttons, p.IsLeft == 1)
+		}
+	}
+	return true
+}
+
+// release returns the up events of everything held and forgets it
+func (s *inputState) release() []Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.releaseLocked()
+}
+
+func (s *inputState) releaseLocked() []Packet {
+	if len(s.keys) == 0 && len(s.buttons) == 0 {
+		return nil
+	}
+	codes := make([]int, 0, len(s.keys))
+	for code := range s.keys {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	packets := make([]Packet, 0, len(codes)+len(s.buttons))
+	for _, code := range codes {
+		packets = append(packets, Packet{Type: eventKeyUp, Data: fmt.Sprintf(`{"keycode":%d}`, code)})
+	}
+	for _, data := range s.buttons {
+		packets = append(packets, Packet{Type: eventMouseUp, Data: data})
+	}
+	s.keys = map[int]struct{}{}
+	s.buttons = map[bool]string{}
+	return packets
+}
+
+// setViewOnly turns input of the client off or on. It returns the up events of everything the client held
+func (s *inputState) setViewOnly(viewOnly bool) []Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.viewOnly = viewOnly
+	if !viewOnly {
+		return nil
+	}
+	return s.releaseLocked()
+}
+
+// suspend takes input away from the client or gives it back. It returns the up events of everything the client held
+func (s *inputState) suspend(suspended bool) []Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suspended = suspended
+	if !suspended {
+		return nil
+	}
+	return s.releaseLocked()
+}
+
+// wait takes input away from the client until its turn or gives it the turn.
+// It returns the up events of everything the client held
+func (s *inputState) wait(waiting bool) []Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waiting = waiting
+	if !waiting {
+		// the turn starts now, not at the last input before waiting
+		s.lastInput = time.Now()
+		return nil
+	}
+	return s.releaseLocked()
+}
+
+// idle returns how long the client sent no input. Clients without input control are never idle
+func (s *inputState) idle() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.viewOnly || s.suspended || s.waiting {
+		return 0, false
+	}
+	return time.Since(s.lastInput), true
+}
@@ -0,0 +1,115 @@
+package cloudapp
+
+import "strconv"
+
+// keyMapping maps a browser keyCode, which is also the Windows virtual-key code, to other input backends
+type keyMapping struct {
+	// evdev is the Linux input event code, KEY_* in linux/input-event-codes.h
+	evdev uint16
+	// keysym is the X keysym name used by xdotool
+	keysym string
+}
+
+// keymap of browser keyCodes. Keys missing here are only supported by syncinput and sendinput
+var keymap = func() map[int]keyMapping {
+	m := map[int]keyMapping{
+		8:   {14, "BackSpace"},
+		9:   {15, "Tab"},
+		13:  {28, "Return"},
+		16:  {42, "Shift_L"},
+		17:  {29, "Control_L"},
+		18:  {56, "Alt_L"},
+		19:  {119, "Pause"},
+		20:  {58, "Caps_Lock"},
+		27:  {1, "Escape"},
+		32:  {57, "space"},
+		33:  {104, "Prior"},
+		34:  {109, "Next"},
+		35:  {107, "End"},
+		36:  {102, "Home"},
+		37:  {105, "Left"},
+		38:  {103, "Up"},
+		39:  {106, "Right"},
+		40:  {108, "Down"},
+		45:  {110, "Insert"},
+		46:  {111, "Delete"},
+		91:  {125, "Super_L"},
+		106: {55, "KP_Multiply"},
+		107: {78, "KP_Add"},
+		109: {74, "KP_Subtract"},
+		110: {83, "KP_Decimal"},
+		111: {98, "KP_Divide"},
+		144: {69, "Num_Lock"},
+		145: {70, "Scroll_Lock"},
+		186: {39, "semicolon"},
+		187: {13, "equal"},
+		188: {51, "comma"},
+		189: {12, "minus"},
+		190: {52, "period"},
+		191: {53, "slash"},
+		192: {41, "grave"},
+		219: {26, "bracketleft"},
+		220: {43, "backslash"},
+		221: {27, "bracketright"},
+		222: {40, "apostrophe"},
+	}
+	// 0-9: KEY_1 is 2 ... KEY_9 is 10, KEY_0 is 11
+	for i := 1; i <= 9; i++ {
+		m[48+i] = keyMapping{uint16(1 + i), string(rune('0' + i))}
+	}
+	m[48] = keyMapping{11, "0"}
+	// A-Z in keyboard rows
+	letters := map[rune]uint16{
+		'q': 16, 'w': 17, 'e': 18, 'r': 19, 't': 20, 'y': 21, 'u': 22, 'i': 23, 'o': 24, 'p': 25,
+		'a': 30, 's': 31, 'd': 32, 'f': 33, 'g': 34, 'h': 35, 'j': 36, 'k': 37, 'l': 38,
+		'z': 44, 'x': 45, 'c': 46, 'v': 47, 'b': 48, 'n': 49, 'm': 50,
+	}
+	for r, code := range letters {
+		m[int(r-'a')+65] = keyMapping{code, string(r)}
+	}
+	// Numpad 0-9
+	numpad := []uint16{82, 79, 80, 81, 75, 76, 77, 71, 72, 73}
+	for i, code := range numpad {
+		m[96+i] = keyMapping{code, "KP_" + string(rune('0'+i))}
+	}
+	// F1-F10 are contiguous, F11 and F12 are not
+	for i := 0; i < 10; i++ {
+		m[112+i] = keyMapping{uint16(59 + i), "F" + strconv.Itoa(i+1)}
+	}
+	m[122] = keyMapping{87, "F11"}
+	m[123] = keyMapping{88, "F12"}
+	return m
+}()
+
+// extendedScancodes are the PS/2 set 1 scan codes with the E0 prefix of evdev codes
+// outside the main block. The main block evdev codes are the same as set 1
+var extendedScancodes = map[uint16]uint16{
+	98:  0x35, // KP divide
+	102: 0x47, // Home
+	103: 0x48, // Up
+	104: 0x49, // Page up
+	105: 0x4b, // Left
+	106: 0x4d, // Right
+	107: 0x4f, // End
+	108: 0x50, // Down
+	109: 0x51, // Page down
+	110: 0x52, // Insert
+	111: 0x53, // Delete
+	125: 0x5b, // Left meta
+}
+
+// scancode returns the set 1 scan code of the browser keyCode and if it's an extended key
+func scancode(keyCode int) (code uint16, extended bool, ok bool) {
+	key, ok := keymap[keyCode]
+	if !ok {
+		return 0, false, false
+	}
+	if code, ok := extendedScancodes[key.evdev]; ok {
+		return code, true, true
+	}
+	// Pause has a multi-byte sequence without a single scan code
+	if key.evdev > 88 {
+		return 0, false, false
+	}
+	return key.evdev, false, true
+}
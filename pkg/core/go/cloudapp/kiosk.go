@@ -0,0 +1,19 @@
+package cloudapp
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+)
+
+var errKioskLocked = errors.New("not available on this kiosk")
+
+// handleKiosk serves the app page without chat and lobby
+func (s *Server) handleKiosk(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles(embedPage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, s.RuntimeConfig(r))
+}
@@ -0,0 +1,136 @@
+package cloudapp
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+var loadShedLevel = metrics.NewGauge("cloudmorph_load_shed_level", "Steps the encoder is lowered on the quality ladder because the worker is overloaded")
+
+const loadShedInterval = 2 * time.Second
+
+// loadShedLadder lowers the steady settings step by step: first a faster preset at the same frame rate,
+// then the frame rate. Steps never raise the frame rate of the steady settings
+var loadShedLadder = []int{videoFrameRate, 24, 20, 15}
+
+// fastPresets trade quality per bit for encoding speed
+var fastPresets = map[string]string{"libx264": "ultrafast", "h264_nvenc": "llhp"}
+
+// loadShedder watches the CPU and GPU load of the worker and steps the encoder down the ladder while it's overloaded,
+// before the encoder falls behind and the stream freezes for everyone. It steps back up when headroom returns
+type loadShedder struct {
+	cfg       config.LoadShedConfig
+	app       CloudAppClient
+	collector *capacity.Collector
+
+	mu sync.Mutex
+	// steady are the settings without load shedding, e.g. set with the admin API
+	steady EncoderSettings
+	level  int
+}
+
+// newLoadShedder returns nil when the encoder can't be reconfigured
+func newLoadShedder(cfg config.LoadShedConfig, limits config.CapacityConfig, app CloudAppClient) *loadShedder {
+	steady, err := app.EncoderSettings()
+	if err != nil {
+		log.Println("Load shedding is disabled:", err)
+		return nil
+	}
+	return &loadShedder{cfg: cfg, app: app, collector: capacity.NewCollector(limits), steady: steady}
+}
+
+func (l *loadShedder) run() {
+	hold := int(time.Duration(l.cfg.Hold) * time.Second / loadShedInterval)
+	if hold < 1 {
+		hold = 1
+	}
+	above, below := 0, 0
+	for range time.Tick(loadShedInterval) {
+		load := l.load()
+		switch {
+		case load >= l.cfg.High:
+			above, below = above+1, 0
+		case load <= l.cfg.Low:
+			above, below = 0, below+1
+		default:
+			above, below = 0, 0
+		}
+		if above >= hold {
+			above = 0
+			l.step(1, load)
+		}
+		if below >= hold {
+			below = 0
+			l.step(-1, load)
+		}
+	}
+}
+
+// load returns the percent of the busiest of CPU and the GPUs
+func (l *loadShedder) load() float64 {
+	load := l.collector.CPU()
+	if l.app.Encoder() != "h264_nvenc" {
+		return load
+	}
+	for _, gpu := range capacity.GPUs() {
+		if gpu.Utilization > load {
+			load = gpu.Utilization
+		}
+	}
+	return load
+}
+
+// step moves down the ladder by 1 or up by -1
+func (l *loadShedder) step(delta int, load float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	level := l.level + delta
+	if level < 0 || level > len(loadShedLadder) {
+		return
+	}
+	if err := l.app.SetEncoderSettings(l.settings(l.steady, level)); err != nil {
+		log.Println("Load shedding failed to reconfigure the encoder:", err)
+		return
+	}
+	l.level = level
+	loadShedLevel.Set(int64(level))
+	log.Printf("Load at %.0f%%, encoder at load shedding level %d", load, level)
+}
+
+// settings returns the steady settings lowered to the level of the ladder
+func (l *loadShedder) settings(steady EncoderSettings, level int) EncoderSettings {
+	if level == 0 {
+		return steady
+	}
+	s := steady
+	if preset, ok := fastPresets[l.app.Encoder()]; ok {
+		s.Preset = preset
+	}
+	if fps := loadShedLadder[level-1]; fps < s.FPS {
+		s.FPS = fps
+	}
+	return s
+}
+
+// Steady returns the settings without load shedding
+func (l *loadShedder) Steady() EncoderSettings {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.steady
+}
+
+// SetSteady changes the settings without load shedding, the encoder runs them lowered to the current level
+func (l *loadShedder) SetSteady(s EncoderSettings) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.app.SetEncoderSettings(l.settings(s, l.level)); err != nil {
+		return err
+	}
+	l.steady = s
+	return nil
+}
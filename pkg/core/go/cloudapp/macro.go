@@ -0,0 +1,172 @@
+package cloudapp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/secret"
+)
+
+// eventMacro runs the macro named in the packet data
+const eventMacro = "MACRO"
+
+// textKeyDelay is the gap between typed characters, some apps drop keys typed faster
+const textKeyDelay = 20 * time.Millisecond
+
+const keyShift = 16
+
+// shiftedKeys are characters typed with shift on a US keyboard layout, by their unshifted key code
+var shiftedKeys = map[rune]int{
+	'!': 49, '@': 50, '#': 51, '$': 52, '%': 53, '^': 54, '&': 55, '*': 56, '(': 57, ')': 48,
+	':': 186, '+': 187, '<': 188, '_': 189, '>': 190, '?': 191, '~': 192, '{': 219, '|': 220, '}': 221, '"': 222,
+}
+
+var plainKeys = map[rune]int{
+	' ': 32, '\n': 13, '\t': 9,
+	';': 186, '=': 187, ',': 188, '-': 189, '.': 190, '/': 191, '`': 192, '[': 219, '\\': 220, ']': 221, '\'': 222,
+}
+
+// macroStep is a batch of input packets followed by a delay
+type macroStep struct {
+	packets []Packet
+	delay   time.Duration
+}
+
+// macroRunner runs the configured macros. A client runs one macro at a time
+type macroRunner struct {
+	macros map[string][]macroStep
+	queue  *inputQueue
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newMacroRunner(macros map[string][]config.MacroStep, secrets map[string]string, screenWidth, screenHeight int, queue *inputQueue) *macroRunner {
+	m := &macroRunner{
+		macros:  map[string][]macroStep{},
+		queue:   queue,
+		running: map[string]bool{},
+	}
+	for name, steps := range macros {
+		var compiled []macroStep
+		for _, step := range steps {
+			compiled = append(compiled, compileMacroStep(step, secrets, screenWidth, screenHeight)...)
+		}
+		m.macros[name] = compiled
+	}
+	return m
+}
+
+func compileMacroStep(step config.MacroStep, secrets map[string]string, screenWidth, screenHeight int) []macroStep {
+	delay := time.Duration(step.Delay) * time.Millisecond
+	key := func(t string, code int) Packet {
+		return Packet{Type: t, Data: fmt.Sprintf(`{"keycode":%d}`, code)}
+	}
+	// Mouse positions are in the app screen, so the client size is the screen size
+	mouse := func(t string) Packet {
+		isLeft := 1
+		if step.Right {
+			isLeft = 0
+		}
+		return Packet{Type: t, Data: fmt.Sprintf(`{"isLeft":%d,"x":%d,"y":%d,"width":%d,"height":%d}`,
+			isLeft, step.X, step.Y, screenWidth, screenHeight)}
+	}
+
+	switch step.Type {
+	case config.MacroKey:
+		return []macroStep{{packets: []Packet{key(eventKeyDown, step.KeyCode), key(eventKeyUp, step.KeyCode)}, delay: delay}}
+	case config.MacroKeyDown:
+		return []macroStep{{packets: []Packet{key(eventKeyDown, step.KeyCode)}, delay: delay}}
+	case config.MacroKeyUp:
+		return []macroStep{{packets: []Packet{key(eventKeyUp, step.KeyCode)}, delay: delay}}
+	case config.MacroClick:
+		return []macroStep{{packets: []Packet{mouse(eventMouseMove), mouse(eventMouseDown), mouse(eventMouseUp)}, delay: delay}}
+	case config.MacroMouseDown:
+		return []macroStep{{packets: []Packet{mouse(eventMouseMove), mouse(eventMouseDown)}, delay: delay}}
+	case config.MacroMouseUp:
+		return []macroStep{{packets: []Packet{mouse(eventMouseMove), mouse(eventMouseUp)}, delay: delay}}
+	case config.MacroMouseMove:
+		return []macroStep{{packets: []Packet{mouse(eventMouseMove)}, delay: delay}}
+	case config.MacroText:
+		var steps []macroStep
+		for _, r := range os.Expand(step.Text, secret.Lookup(secrets)) {
+			code, shift, ok := textKey(r)
+			if !ok {
+				continue
+			}
+			packets := []Packet{key(eventKeyDown, code), key(eventKeyUp, code)}
+			if shift {
+				packets = []Packet{key(eventKeyDown, keyShift), packets[0], packets[1], key(eventKeyUp, keyShift)}
+			}
+			steps = append(steps, macroStep{packets: packets, delay: textKeyDelay})
+		}
+		if len(steps) > 0 {
+			steps[len(steps)-1].delay = delay
+		}
+		return steps
+	}
+	return nil
+}
+
+// textKey returns the key code of the character and if it's typed with shift
+func textKey(r rune) (code int, shift bool, ok bool) {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return int(r-'a') + 65, false, true
+	case r >= 'A' && r <= 'Z':
+		return int(r-'A') + 65, true, true
+	case r >= '0' && r <= '9':
+		return int(r-'0') + 48, false, true
+	}
+	if code, ok := plainKeys[r]; ok {
+		return code, false, true
+	}
+	if code, ok := shiftedKeys[r]; ok {
+		return code, true, true
+	}
+	return 0, false, false
+}
+
+// names returns the sorted macro names
+func (m *macroRunner) names() []string {
+	names := make([]string, 0, len(m.macros))
+	for name := range m.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// run starts the macro for the client in background
+func (m *macroRunner) run(clientID string, name string) error {
+	steps, ok := m.macros[name]
+	if !ok {
+		return fmt.Errorf("macro %s is not found", name)
+	}
+	m.mu.Lock()
+	if m.running[clientID] {
+		m.mu.Unlock()
+		return errors.New("a macro is already running")
+	}
+	m.running[clientID] = true
+	m.mu.Unlock()
+
+	crash.Go("macro", func() {
+		for _, step := range steps {
+			for _, packet := range step.packets {
+				m.queue.Push(packet)
+			}
+			time.Sleep(step.delay)
+		}
+		m.mu.Lock()
+		delete(m.running, clientID)
+		m.mu.Unlock()
+	}, "client", clientID)
+	return nil
+}
@@ -0,0 +1,74 @@
+package media
+
+import (
+	"sync"
+	"time"
+)
+
+// clockWindow is the media time after which the capture estimate is refreshed to follow clock drift
+const clockWindow = 10 * time.Second
+
+// CaptureClock maps RTP timestamps of a stream to the wall clock time of capture.
+// Packets arrive later than their capture by the encoding latency and jitter, so the earliest
+// arrival relative to its media time is the closest estimate of the capture time.
+// Clocks of all streams share the wall clock, which aligns audio and video for lip-sync
+type CaptureClock struct {
+	clockRate float64
+	// offset shifts the capture time, positive to play the stream later
+	offset time.Duration
+
+	mu      sync.Mutex
+	started bool
+	baseTS  uint32
+	// baseTime is the capture time of baseTS
+	baseTime time.Time
+	// windowMin is the capture estimate of the current window
+	windowMin time.Time
+}
+
+// NewCaptureClock returns the clock of a stream with the clock rate, shifted by offset
+func NewCaptureClock(clockRate uint32, offset time.Duration) *CaptureClock {
+	return &CaptureClock{clockRate: float64(clockRate), offset: offset}
+}
+
+// Observe updates the capture estimate with a packet timestamp and its arrival time
+func (c *CaptureClock) Observe(ts uint32, arrival time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		c.started = true
+		c.baseTS = ts
+		c.baseTime = arrival
+		c.windowMin = arrival
+		return
+	}
+	elapsed := c.duration(ts - c.baseTS)
+	capture := arrival.Add(-elapsed)
+	if capture.Before(c.baseTime) {
+		c.baseTime = capture
+	}
+	if capture.Before(c.windowMin) {
+		c.windowMin = capture
+	}
+	// Move the base forward, it keeps timestamp differences small and lets the estimate follow drift
+	if elapsed >= clockWindow {
+		c.baseTS = ts
+		c.baseTime = c.windowMin.Add(elapsed)
+		c.windowMin = arrival
+	}
+}
+
+// RTPTime returns the RTP timestamp captured at the time, false until a packet is observed
+func (c *CaptureClock) RTPTime(at time.Time) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		return 0, false
+	}
+	elapsed := at.Sub(c.baseTime.Add(c.offset))
+	return c.baseTS + uint32(int64(elapsed.Seconds()*c.clockRate)), true
+}
+
+func (c *CaptureClock) duration(ticks uint32) time.Duration {
+	return time.Duration(float64(int32(ticks)) / c.clockRate * float64(time.Second))
+}
@@ -0,0 +1,177 @@
+package media
+
+import (
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// H264 RTP aggregation and fragmentation NAL unit types
+const (
+	h264STAPA = 24
+	h264FUA   = 28
+)
+
+// FrameDropper drops video frames for one client on a slow link.
+// Non-reference frames go first. Dropping a reference frame breaks the following frames,
+// so then every frame is dropped till the next keyframe
+type FrameDropper struct {
+	vp8       bool
+	av1       bool
+	congested bool
+	// skipToKeyframe drops frames till the next keyframe after a reference frame was dropped
+	skipToKeyframe bool
+	started        bool
+	timestamp      uint32
+	dropFrame      bool
+	// seqOffset is the number of dropped packets, kept packets are renumbered without gaps
+	seqOffset uint16
+	// Dropped counts dropped frames
+	Dropped int
+}
+
+// NewFrameDropper returns a dropper of the mime type of the video track
+func NewFrameDropper(mimeType string) *FrameDropper {
+	return &FrameDropper{
+		vp8: strings.EqualFold(mimeType, webrtc.MimeTypeVP8),
+		av1: strings.EqualFold(mimeType, webrtc.MimeTypeAV1),
+	}
+}
+
+// SetCongested switches dropping on or off. It returns true when the congestion is over and the client
+// waits for a keyframe to recover from dropped reference frames, then a keyframe should be requested
+func (d *FrameDropper) SetCongested(congested bool) bool {
+	recovered := d.congested && !congested && d.skipToKeyframe
+	d.congested = congested
+	return recovered
+}
+
+// Keep decides if the packet is sent and returns its sequence number without the gaps of dropped packets
+func (d *FrameDropper) Keep(p *rtp.Packet) (uint16, bool) {
+	if !d.started || p.Timestamp != d.timestamp {
+		d.started = true
+		d.timestamp = p.Timestamp
+		d.dropFrame = d.decide(p)
+		if d.dropFrame {
+			d.Dropped++
+		}
+	}
+	if d.dropFrame {
+		d.seqOffset++
+		return 0, false
+	}
+	return p.SequenceNumber - d.seqOffset, true
+}
+
+// decide whether the frame starting with the packet is dropped
+func (d *FrameDropper) decide(p *rtp.Packet) bool {
+	keyframe := d.isKeyframe(p.Payload)
+	if d.skipToKeyframe {
+		if !keyframe {
+			return true
+		}
+		d.skipToKeyframe = false
+	}
+	if !d.congested || keyframe {
+		return false
+	}
+	if !d.isReference(p.Payload) {
+		return true
+	}
+	d.skipToKeyframe = true
+	return true
+}
+
+func (d *FrameDropper) isKeyframe(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	if d.vp8 {
+		header, ok := vp8Header(payload)
+		// P bit of the frame tag at the start of a partition, 0 is a keyframe
+		return ok && header.S == 1 && header.PID == 0 && len(header.Payload) > 0 && header.Payload[0]&0x01 == 0
+	}
+	if d.av1 {
+		// N bit of the aggregation header, the packet starts a new coded video sequence
+		return payload[0]&0x08 != 0
+	}
+	switch payload[0] & 0x1F {
+	case 5, 7:
+		return true
+	case h264FUA:
+		// start of a fragmented IDR slice
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == 5
+	case h264STAPA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	}
+	return false
+}
+
+// isReference checks if other frames predict from the frame
+func (d *FrameDropper) isReference(payload []byte) bool {
+	if len(payload) == 0 {
+		return true
+	}
+	if d.vp8 {
+		header, ok := vp8Header(payload)
+		return !ok || header.N == 0
+	}
+	if d.av1 {
+		// The aggregation header doesn't tell, every AV1 frame is taken as a reference
+		return true
+	}
+	// nal_ref_idc of the NAL unit or of the aggregation/fragmentation indicator, 0 is not used for reference
+	return payload[0]&0x60 != 0
+}
+
+type vp8Descriptor struct {
+	S, N, PID uint8
+	Payload   []byte
+}
+
+// vp8Header parses the RTP payload descriptor of VP8 (RFC 7741)
+func vp8Header(payload []byte) (vp8Descriptor, bool) {
+	var h vp8Descriptor
+	if len(payload) < 1 {
+		return h, false
+	}
+	h.N = payload[0] >> 5 & 0x01
+	h.S = payload[0] >> 4 & 0x01
+	h.PID = payload[0] & 0x07
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return h, false
+		}
+		ext := payload[1]
+		i++
+		if ext&0x80 != 0 {
+			// PictureID, 2 bytes with the M bit
+			if len(payload) <= i {
+				return h, false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 {
+			i++
+		}
+		if ext&0x30 != 0 {
+			i++
+		}
+	}
+	if len(payload) < i {
+		return h, false
+	}
+	h.Payload = payload[i:]
+	return h, true
+}
@@ -0,0 +1,190 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const videoTimescale = 90000
+
+// FMP4Muxer muxes H264 frames into fragmented MP4 segments for Media Source Extensions
+type FMP4Muxer struct {
+	width  int
+	height int
+	sps    []byte
+	pps    []byte
+	seq    uint32
+	// decode time is accumulated from RTP timestamp deltas to survive wrap around
+	baseTime uint64
+	lastTS   uint32
+	started  bool
+}
+
+// ErrNoParameterSets is returned when the init segment is requested before SPS/PPS are seen
+var ErrNoParameterSets = errors.New("fmp4: SPS/PPS not received yet")
+
+// NewFMP4Muxer returns a muxer of a video track with the size
+func NewFMP4Muxer(width, height int) *FMP4Muxer {
+	return &FMP4Muxer{width: width, height: height}
+}
+
+// Ready returns if the muxer has parameter sets to build the init segment
+func (m *FMP4Muxer) Ready() bool {
+	return m.sps != nil && m.pps != nil
+}
+
+// Codec returns the RFC 6381 codec string for MediaSource.addSourceBuffer
+func (m *FMP4Muxer) Codec() string {
+	if len(m.sps) < 4 {
+		return "avc1.42e01f"
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", m.sps[1], m.sps[2], m.sps[3])
+}
+
+// InitSegment returns ftyp+moov
+func (m *FMP4Muxer) InitSegment() ([]byte, error) {
+	if !m.Ready() {
+		return nil, ErrNoParameterSets
+	}
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5"), []byte("iso6"), []byte("mp41"))
+	return append(ftyp, m.moov()...), nil
+}
+
+// Fragment converts an Annex-B frame to moof+mdat. It also picks up SPS/PPS from the frame.
+// The returned segment is nil until the first keyframe after parameter sets
+func (m *FMP4Muxer) Fragment(frame *Frame) []byte {
+	var samples [][]byte
+	for _, nal := range SplitNALUnits(frame.Data) {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1F {
+		case 7:
+			m.sps = append([]byte{}, nal...)
+			continue
+		case 8:
+			m.pps = append([]byte{}, nal...)
+			continue
+		case 9:
+			// access unit delimiter
+			continue
+		}
+		samples = append(samples, nal)
+	}
+	if !m.Ready() || len(samples) == 0 || (!m.started && !frame.Keyframe) {
+		return nil
+	}
+
+	duration := uint32(videoTimescale / 30)
+	if m.started {
+		duration = frame.Timestamp - m.lastTS
+		m.baseTime += uint64(duration)
+	}
+	m.started = true
+	m.lastTS = frame.Timestamp
+	m.seq++
+
+	var mdatPayload []byte
+	for _, nal := range samples {
+		mdatPayload = append(mdatPayload, u32(uint32(len(nal)))...)
+		mdatPayload = append(mdatPayload, nal...)
+	}
+
+	sampleFlags := uint32(0x01010000) // depends on others, non sync
+	if frame.Keyframe {
+		sampleFlags = 0x02000000
+	}
+	moof := m.moof(uint32(len(mdatPayload)), duration, sampleFlags, 0)
+	// data offset points to mdat payload, right after moof and mdat header
+	moof = m.moof(uint32(len(mdatPayload)), duration, sampleFlags, uint32(len(moof)+8))
+	return append(moof, box("mdat", mdatPayload)...)
+}
+
+func (m *FMP4Muxer) moov() []byte {
+	w, h := uint32(m.width), uint32(m.height)
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0),
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		matrix(), make([]byte, 24), u32(2))
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(1), u32(0), u32(0), make([]byte, 8),
+		u16(0), u16(0), u16(0), u16(0), matrix(), u32(w<<16), u32(h<<16))
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(videoTimescale), u32(0), u16(0x55c4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+	vmhd := fullBox("vmhd", 0, 1, u16(0), make([]byte, 6))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	avcC := box("avcC",
+		[]byte{1, m.sps[1], m.sps[2], m.sps[3], 0xFF, 0xE1},
+		u16(uint16(len(m.sps))), m.sps,
+		[]byte{1}, u16(uint16(len(m.pps))), m.pps)
+	avc1 := box("avc1",
+		make([]byte, 6), u16(1), u16(0), u16(0), make([]byte, 12),
+		u16(uint16(w)), u16(uint16(h)), u32(0x00480000), u32(0x00480000),
+		u32(0), u16(1), make([]byte, 32), u16(0x0018), u16(0xFFFF), avcC)
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), avc1),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+	trak := box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", vmhd, dinf, stbl)))
+	mvex := box("mvex", fullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0)))
+	return box("moov", mvhd, trak, mvex)
+}
+
+func (m *FMP4Muxer) moof(size, duration, flags, dataOffset uint32) []byte {
+	mfhd := fullBox("mfhd", 0, 0, u32(m.seq))
+	// default-base-is-moof
+	tfhd := fullBox("tfhd", 0, 0x020000, u32(1))
+	tfdt := fullBox("tfdt", 1, 0, u64(m.baseTime))
+	// data-offset, sample-duration, sample-size, sample-flags
+	trun := fullBox("trun", 0, 0x000701, u32(1), u32(dataOffset), u32(duration), u32(size), u32(flags))
+	return box("moof", mfhd, box("traf", tfhd, tfdt, trun))
+}
+
+func box(name string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], name)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBox(name string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := u32(flags)
+	header[0] = version
+	return box(name, append([][]byte{header}, payloads...)...)
+}
+
+func matrix() []byte {
+	var b []byte
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = append(b, u32(v)...)
+	}
+	return b
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
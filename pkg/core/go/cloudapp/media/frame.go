@@ -0,0 +1,163 @@
+// Package media reassembles encoded frames from the RTP stream produced by FFMPEG.
+// Frame-level transports, the MSE and WebCodecs fallbacks over websocket, consume frames instead of RTP packets
+package media
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// Frame is an encoded video frame
+type Frame struct {
+	// RTP timestamp of the frame (90kHz clock)
+	Timestamp uint32
+	Keyframe  bool
+	// Annex-B NAL units for H264, raw frame for VP8
+	Data []byte
+}
+
+var errUnsupportedCodec = errors.New("media: frames are only assembled of H264 and VP8")
+
+// FrameAssembler collects RTP packets of the same timestamp into a Frame
+type FrameAssembler struct {
+	mimeType  string
+	h264      *codecs.H264Packet
+	vp8       *codecs.VP8Packet
+	buf       []byte
+	timestamp uint32
+	keyframe  bool
+	started   bool
+	// drop packets till the first frame boundary to avoid a partial frame
+	synced bool
+}
+
+// NewFrameAssembler returns an assembler of the mime type of the video track, H264 or VP8
+func NewFrameAssembler(mimeType string) (*FrameAssembler, error) {
+	a := &FrameAssembler{mimeType: mimeType}
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		a.h264 = &codecs.H264Packet{}
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		a.vp8 = &codecs.VP8Packet{}
+	default:
+		return nil, errUnsupportedCodec
+	}
+	return a, nil
+}
+
+// MimeType returns the codec of assembled frames
+func (a *FrameAssembler) MimeType() string {
+	return a.mimeType
+}
+
+// Push adds a packet and returns a frame when the packet completes it
+func (a *FrameAssembler) Push(p *rtp.Packet) (*Frame, bool) {
+	if !a.synced {
+		// the frame after a marker is a complete one
+		if p.Marker {
+			a.synced = true
+		}
+		return nil, false
+	}
+
+	if a.started && p.Timestamp != a.timestamp {
+		// lost the marker packet, start over with the new frame
+		a.reset()
+	}
+	if !a.started {
+		a.started = true
+		a.timestamp = p.Timestamp
+	}
+
+	switch {
+	case a.vp8 != nil:
+		payload, err := a.vp8.Unmarshal(p.Payload)
+		if err != nil {
+			a.reset()
+			return nil, false
+		}
+		if a.vp8.S == 1 && a.vp8.PID == 0 && len(payload) > 0 {
+			// P bit of VP8 frame tag, 0 is a keyframe
+			a.keyframe = payload[0]&0x01 == 0
+		}
+		a.buf = append(a.buf, payload...)
+	case a.h264 != nil:
+		payload, err := a.h264.Unmarshal(p.Payload)
+		if err != nil {
+			a.reset()
+			return nil, false
+		}
+		if isH264Keyframe(payload) {
+			a.keyframe = true
+		}
+		a.buf = append(a.buf, payload...)
+	}
+
+	if !p.Marker {
+		return nil, false
+	}
+
+	frame := &Frame{
+		Timestamp: a.timestamp,
+		Keyframe:  a.keyframe,
+		Data:      make([]byte, len(a.buf)),
+	}
+	copy(frame.Data, a.buf)
+	a.reset()
+	return frame, true
+}
+
+// Resync drops the current partial frame and waits for the next frame boundary.
+// It's used when packets were skipped, e.g. while nobody subscribed to frames
+func (a *FrameAssembler) Resync() {
+	a.reset()
+	a.synced = false
+}
+
+func (a *FrameAssembler) reset() {
+	a.buf = a.buf[:0]
+	a.started = false
+	a.keyframe = false
+}
+
+// isH264Keyframe checks if Annex-B NAL units contain SPS or IDR slice
+func isH264Keyframe(nals []byte) bool {
+	for _, nal := range SplitNALUnits(nals) {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1F {
+		case 5, 7:
+			return true
+		}
+	}
+	return false
+}
+
+// SplitNALUnits splits Annex-B data into NAL units without start codes
+func SplitNALUnits(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			nals = append(nals, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+	return nals
+}
@@ -0,0 +1,76 @@
+package media
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// h264Frame returns the RTP packets of a keyframe (SPS, PPS, IDR) of about 20KB
+func h264Frame(b *testing.B, timestamp uint32) []*rtp.Packet {
+	idr := make([]byte, 20000)
+	idr[0] = 0x65
+	nals := append([]byte{0, 0, 0, 1, 0x67, 0x42, 0xe0, 0x1f, 0xda}, []byte{0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80}...)
+	nals = append(nals, 0, 0, 0, 1)
+	nals = append(nals, idr...)
+
+	payloader := &codecs.H264Payloader{}
+	payloads := payloader.Payload(1200, nals)
+	packets := make([]*rtp.Packet, len(payloads))
+	for i, payload := range payloads {
+		packets[i] = &rtp.Packet{
+			Header:  rtp.Header{Version: 2, Timestamp: timestamp, SequenceNumber: uint16(i), Marker: i == len(payloads)-1},
+			Payload: payload,
+		}
+	}
+	return packets
+}
+
+// BenchmarkFrameAssemblerH264 measures encoder ingestion: RTP packets from FFMPEG back to frames
+func BenchmarkFrameAssemblerH264(b *testing.B) {
+	packets := h264Frame(b, 3000)
+	a, err := NewFrameAssembler("video/H264")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// sync to the first frame boundary
+	a.Push(packets[len(packets)-1])
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, p := range packets {
+			p.Timestamp = uint32(i) * 3000
+			a.Push(p)
+		}
+	}
+}
+
+// BenchmarkFMP4Fragment measures muxing a keyframe for the MSE fallback
+func BenchmarkFMP4Fragment(b *testing.B) {
+	packets := h264Frame(b, 3000)
+	a, err := NewFrameAssembler("video/H264")
+	if err != nil {
+		b.Fatal(err)
+	}
+	a.Push(packets[len(packets)-1])
+	var frame *Frame
+	for _, p := range packets {
+		if f, ok := a.Push(p); ok {
+			frame = f
+		}
+	}
+	if frame == nil {
+		b.Fatal("frame is not assembled")
+	}
+
+	m := NewFMP4Muxer(800, 600)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame.Timestamp = uint32(i) * 3000
+		if m.Fragment(frame) == nil {
+			b.Fatal("no segment")
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package media
+
+import (
+	"sync"
+	"time"
+)
+
+// FrameHistory is a rolling buffer of the latest encoded frames, e.g. to clip the last seconds of a session.
+// The buffer always starts with a keyframe, so it holds up to the window plus one keyframe interval
+type FrameHistory struct {
+	window   uint32
+	maxBytes int
+
+	mu     sync.Mutex
+	frames []*Frame
+	bytes  int
+}
+
+// NewFrameHistory returns a history of the window, bounded by maxBytes
+func NewFrameHistory(window time.Duration, maxBytes int) *FrameHistory {
+	return &FrameHistory{window: uint32(window.Seconds() * videoTimescale), maxBytes: maxBytes}
+}
+
+// Add appends a frame. Frames before the first keyframe are skipped
+func (h *FrameHistory) Add(frame *Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.frames) == 0 && !frame.Keyframe {
+		return
+	}
+	h.frames = append(h.frames, frame)
+	h.bytes += len(frame.Data)
+
+	// Drop the oldest keyframe interval while the next one still covers the window
+	for {
+		k := h.nextKeyframe(1)
+		if k < 0 {
+			break
+		}
+		if frame.Timestamp-h.frames[k].Timestamp < h.window && h.bytes <= h.maxBytes {
+			break
+		}
+		h.drop(k)
+	}
+	if h.bytes > h.maxBytes && h.nextKeyframe(1) < 0 {
+		// a single keyframe interval over the limit, start over at the next keyframe
+		h.drop(len(h.frames))
+	}
+}
+
+// Snapshot returns the frames of the window, starting with a keyframe
+func (h *FrameHistory) Snapshot() []*Frame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.frames) == 0 {
+		return nil
+	}
+	last := h.frames[len(h.frames)-1].Timestamp
+	start := 0
+	for k := h.nextKeyframe(1); k >= 0 && last-h.frames[k].Timestamp >= h.window; k = h.nextKeyframe(k + 1) {
+		start = k
+	}
+	return append([]*Frame{}, h.frames[start:]...)
+}
+
+// nextKeyframe returns the index of the first keyframe from i, -1 if there is none
+func (h *FrameHistory) nextKeyframe(i int) int {
+	for ; i < len(h.frames); i++ {
+		if h.frames[i].Keyframe {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *FrameHistory) drop(n int) {
+	for _, f := range h.frames[:n] {
+		h.bytes -= len(f.Data)
+	}
+	h.frames = append(h.frames[:0], h.frames[n:]...)
+}
@@ -0,0 +1,56 @@
+package media
+
+import (
+	"log"
+	"sync"
+)
+
+// FrameHub fans out assembled frames to frame-level subscribers
+type FrameHub struct {
+	mu          sync.Mutex
+	subscribers map[string]chan *Frame
+}
+
+// NewFrameHub returns an empty hub
+func NewFrameHub() *FrameHub {
+	return &FrameHub{subscribers: map[string]chan *Frame{}}
+}
+
+// Subscribe returns the frame channel of the subscriber
+func (h *FrameHub) Subscribe(id string, size int) chan *Frame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan *Frame, size)
+	h.subscribers[id] = ch
+	return ch
+}
+
+// Unsubscribe removes and closes the subscriber channel
+func (h *FrameHub) Unsubscribe(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.subscribers[id]; ok {
+		delete(h.subscribers, id)
+		close(ch)
+	}
+}
+
+// HasSubscribers returns if any subscriber is waiting for frames
+func (h *FrameHub) HasSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers) > 0
+}
+
+// Publish sends the frame to all subscribers. A slow subscriber skips the frame instead of blocking the stream
+func (h *FrameHub) Publish(frame *Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, ch := range h.subscribers {
+		select {
+		case ch <- frame:
+		default:
+			log.Println("Frame subscriber is slow, drop frame for", id)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package media
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+// packetBufferSize fits one RTP packet from FFMPEG (UDP MTU)
+const packetBufferSize = 1500
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &Packet{buf: make([]byte, packetBufferSize)}
+	},
+}
+
+// Packet is a pooled RTP packet shared by all clients of the fanout.
+// The packet is parsed once and the payload points to the pooled buffer, so
+// every holder must Release it when done and must not keep the payload after that
+type Packet struct {
+	rtp.Packet
+	buf  []byte
+	refs int32
+}
+
+// NewPacket returns a packet from the pool with one reference held by the caller
+func NewPacket() *Packet {
+	p := packetPool.Get().(*Packet)
+	p.refs = 1
+	return p
+}
+
+// Buffer returns the raw buffer to read a packet into
+func (p *Packet) Buffer() []byte {
+	return p.buf[:cap(p.buf)]
+}
+
+// Unmarshal parses the first n bytes of the buffer
+func (p *Packet) Unmarshal(n int) error {
+	return p.Packet.Unmarshal(p.buf[:n])
+}
+
+// Retain adds n references, one per extra holder
+func (p *Packet) Retain(n int) {
+	atomic.AddInt32(&p.refs, int32(n))
+}
+
+// Release drops a reference and returns the packet to the pool when nobody holds it
+func (p *Packet) Release() {
+	if refs := atomic.AddInt32(&p.refs, -1); refs == 0 {
+		p.Packet = rtp.Packet{}
+		packetPool.Put(p)
+	} else if refs < 0 {
+		panic("media: packet released too many times")
+	}
+}
@@ -0,0 +1,122 @@
+package media
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// TestPacketRelease checks the packet is reset for the pool once every holder released it
+func TestPacketRelease(t *testing.T) {
+	p := NewPacket()
+	p.SequenceNumber = 7
+	p.Retain(8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Release()
+		}()
+	}
+	wg.Wait()
+	if p.refs != 1 || p.SequenceNumber != 7 {
+		t.Fatalf("packet has %d references and sequence %d, want the one of the reader", p.refs, p.SequenceNumber)
+	}
+	p.Release()
+	if p.refs != 0 || p.SequenceNumber != 0 {
+		t.Fatalf("released packet has %d references and sequence %d, want it reset", p.refs, p.SequenceNumber)
+	}
+}
+
+// TestPacketOverRelease checks a packet released more often than it's held panics instead of being pooled twice
+func TestPacketOverRelease(t *testing.T) {
+	p := &Packet{buf: make([]byte, packetBufferSize), refs: 1}
+	p.Release()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("over-released packet doesn't panic")
+		}
+	}()
+	p.Release()
+}
+
+func sampleRTP(b *testing.B) []byte {
+	p := rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 1, Timestamp: 3000, SSRC: 1234},
+		Payload: make([]byte, 1200),
+	}
+	raw, err := p.Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return raw
+}
+
+// fanout mimics Service.Handle handing the packet to every client and each client releasing it after write
+func fanout(p *Packet, out []chan *Packet) {
+	p.Retain(len(out))
+	for _, ch := range out {
+		ch <- p
+	}
+	p.Release()
+	for _, ch := range out {
+		(<-ch).Release()
+	}
+}
+
+var benchClients = []int{1, 8, 64}
+
+// BenchmarkFanoutAlloc is the previous scheme: a new rtp.Packet per read
+func BenchmarkFanoutAlloc(b *testing.B) {
+	raw := sampleRTP(b)
+	for _, clients := range benchClients {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			out := make([]chan *rtp.Packet, clients)
+			for i := range out {
+				out[i] = make(chan *rtp.Packet, 1)
+			}
+			buf := make([]byte, packetBufferSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := copy(buf, raw)
+				p := &rtp.Packet{}
+				if err := p.Unmarshal(buf[:n]); err != nil {
+					b.Fatal(err)
+				}
+				for _, ch := range out {
+					ch <- p
+				}
+				for _, ch := range out {
+					<-ch
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFanoutPool reads into pooled, reference counted packets
+func BenchmarkFanoutPool(b *testing.B) {
+	raw := sampleRTP(b)
+	for _, clients := range benchClients {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			out := make([]chan *Packet, clients)
+			for i := range out {
+				out[i] = make(chan *Packet, 1)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p := NewPacket()
+				n := copy(p.Buffer(), raw)
+				if err := p.Unmarshal(n); err != nil {
+					b.Fatal(err)
+				}
+				fanout(p, out)
+			}
+		})
+	}
+}
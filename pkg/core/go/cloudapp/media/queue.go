@@ -0,0 +1,53 @@
+package media
+
+// PacketQueue is the bounded video queue of a client in the fanout. Pushing never blocks the fanout,
+// so a slow client doesn't hold up the others: on a full queue the packet is dropped, and so is the rest
+// of the stream till the next keyframe, the frames after a lost packet can't be decoded anyway.
+// Only the fanout pushes to a queue
+type PacketQueue struct {
+	C chan *Packet
+	// keyframes tells the keyframes of the stream, it's replaced when the stream switches its codec
+	keyframes *FrameDropper
+	mimeType  string
+	skipping  bool
+	// Dropped counts the packets dropped for the client
+	Dropped int
+}
+
+// NewPacketQueue returns a queue holding up to size packets
+func NewPacketQueue(size int) *PacketQueue {
+	return &PacketQueue{C: make(chan *Packet, size)}
+}
+
+// Push queues the packet of a stream of the mime type or releases it. It returns true when the queue
+// overflows and starts skipping to the next keyframe, then a keyframe should be requested
+func (q *PacketQueue) Push(p *Packet, mimeType string) bool {
+	if q.keyframes == nil || mimeType != q.mimeType {
+		q.keyframes, q.mimeType = NewFrameDropper(mimeType), mimeType
+	}
+	if q.skipping {
+		if !q.keyframes.isKeyframe(p.Payload) {
+			q.drop(p)
+			return false
+		}
+		q.skipping = false
+	}
+	select {
+	case q.C <- p:
+		return false
+	default:
+		q.drop(p)
+		q.skipping = true
+		return true
+	}
+}
+
+func (q *PacketQueue) drop(p *Packet) {
+	q.Dropped++
+	p.Release()
+}
+
+// Close closes the queue, the client releases the packets left in it
+func (q *PacketQueue) Close() {
+	close(q.C)
+}
@@ -0,0 +1,40 @@
+package media
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func h264Packet(nal byte) *Packet {
+	p := NewPacket()
+	p.Payload = []byte{nal, 0x88}
+	return p
+}
+
+// TestPacketQueueSkipsToKeyframe checks a full queue drops packets without blocking till the next keyframe
+func TestPacketQueueSkipsToKeyframe(t *testing.T) {
+	q := NewPacketQueue(2)
+	for i := 0; i < 2; i++ {
+		if q.Push(h264Packet(0x41), webrtc.MimeTypeH264) {
+			t.Fatal("queue overflows below its size")
+		}
+	}
+	if !q.Push(h264Packet(0x41), webrtc.MimeTypeH264) {
+		t.Fatal("full queue doesn't ask for a keyframe")
+	}
+	(<-q.C).Release()
+	if q.Push(h264Packet(0x41), webrtc.MimeTypeH264) || len(q.C) != 1 {
+		t.Fatal("delta frame is queued before the keyframe")
+	}
+	if q.Push(h264Packet(0x65), webrtc.MimeTypeH264) || len(q.C) != 2 {
+		t.Fatal("keyframe isn't queued")
+	}
+	(<-q.C).Release()
+	if q.Push(h264Packet(0x41), webrtc.MimeTypeH264) || len(q.C) != 2 {
+		t.Fatal("delta frame after the keyframe isn't queued")
+	}
+	if q.Dropped != 2 {
+		t.Fatalf("dropped %d packets, want 2", q.Dropped)
+	}
+}
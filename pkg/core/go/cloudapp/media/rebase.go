@@ -0,0 +1,48 @@
+package media
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Rebaser keeps sequence numbers and timestamps of a stream continuous across encoder restarts.
+// A restarted encoder starts a new SSRC with random sequence numbers and timestamps, which
+// browsers would take as massive loss or a jump in time
+type Rebaser struct {
+	clockRate float64
+	// minGap is the smallest timestamp gap inserted on restart, one frame
+	minGap    uint32
+	started   bool
+	ssrc      uint32
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastTime  time.Time
+}
+
+// NewRebaser returns a rebaser of a stream with the clock rate, inserting at least minGap on restart
+func NewRebaser(clockRate uint32, minGap uint32) *Rebaser {
+	return &Rebaser{clockRate: float64(clockRate), minGap: minGap}
+}
+
+// Rebase rewrites the packet sequence number and timestamp in place.
+// The timestamp gap of a restart follows the arrival time, so the stream stays in sync with others
+func (r *Rebaser) Rebase(p *rtp.Packet, arrival time.Time) {
+	if r.started && p.SSRC != r.ssrc {
+		gap := uint32(arrival.Sub(r.lastTime).Seconds() * r.clockRate)
+		if gap < r.minGap {
+			gap = r.minGap
+		}
+		r.seqOffset = r.lastSeq + 1 - p.SequenceNumber
+		r.tsOffset = r.lastTS + gap - p.Timestamp
+	}
+	r.started = true
+	r.ssrc = p.SSRC
+	p.SequenceNumber += r.seqOffset
+	p.Timestamp += r.tsOffset
+	r.lastSeq = p.SequenceNumber
+	r.lastTS = p.Timestamp
+	r.lastTime = arrival
+}
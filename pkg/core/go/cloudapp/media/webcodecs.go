@@ -0,0 +1,38 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// webCodecsHeaderSize is the keyframe flag and the RTP timestamp in front of the data of a WebCodecs message
+const webCodecsHeaderSize = 5
+
+// MarshalWebCodecs returns the websocket message of the frame for WebCodecs clients, which feed it to their
+// VideoDecoder as an EncodedVideoChunk: a byte of flags, 1 for keyframes, the RTP timestamp and the frame data
+func MarshalWebCodecs(frame *Frame) []byte {
+	msg := make([]byte, webCodecsHeaderSize+len(frame.Data))
+	if frame.Keyframe {
+		msg[0] = 1
+	}
+	binary.BigEndian.PutUint32(msg[1:webCodecsHeaderSize], frame.Timestamp)
+	copy(msg[webCodecsHeaderSize:], frame.Data)
+	return msg
+}
+
+// WebCodecsCodec returns the codec string of VideoDecoder.configure for frames of the mime type.
+// H264 takes profile and level from the SPS of the keyframe
+func WebCodecsCodec(mimeType string, keyframe *Frame) string {
+	if strings.EqualFold(mimeType, webrtc.MimeTypeVP8) {
+		return "vp8"
+	}
+	for _, nal := range SplitNALUnits(keyframe.Data) {
+		if len(nal) >= 4 && nal[0]&0x1F == 7 {
+			return fmt.Sprintf("avc1.%02x%02x%02x", nal[1], nal[2], nal[3])
+		}
+	}
+	return "avc1.42e01f"
+}
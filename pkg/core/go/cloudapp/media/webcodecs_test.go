@@ -0,0 +1,30 @@
+package media
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// TestWebCodecsMessage checks the header of WebCodecs messages and the codec string of the SPS
+func TestWebCodecsMessage(t *testing.T) {
+	keyframe := &Frame{
+		Timestamp: 0x01020304,
+		Keyframe:  true,
+		Data:      []byte{0, 0, 0, 1, 0x67, 0x64, 0x00, 0x28, 0xac, 0, 0, 0, 1, 0x68, 0xee, 0, 0, 0, 1, 0x65, 0x88},
+	}
+	msg := MarshalWebCodecs(keyframe)
+	if !bytes.Equal(msg[:webCodecsHeaderSize], []byte{1, 1, 2, 3, 4}) || !bytes.Equal(msg[webCodecsHeaderSize:], keyframe.Data) {
+		t.Fatalf("message is %x", msg)
+	}
+	if msg := MarshalWebCodecs(&Frame{Data: []byte{0x41}}); msg[0] != 0 {
+		t.Fatal("delta frame is flagged as keyframe")
+	}
+	if codec := WebCodecsCodec(webrtc.MimeTypeH264, keyframe); codec != "avc1.640028" {
+		t.Fatalf("codec is %s, want avc1.640028", codec)
+	}
+	if codec := WebCodecsCodec(webrtc.MimeTypeVP8, keyframe); codec != "vp8" {
+		t.Fatalf("codec is %s, want vp8", codec)
+	}
+}
@@ -0,0 +1,34 @@
+package cloudapp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+// relayCredentialTTL is how long clients have to allocate on the media relay with their credentials.
+// The relay keeps accepting them from the address of the client till it leaves, they last the session
+const relayCredentialTTL = 2 * time.Minute
+
+// relayServers returns the JSON list of RTCIceServer of the media relay with credentials of the client signed by the secret,
+// over UDP and TCP for clients behind firewalls blocking UDP
+func relayServers(cfg config.MediaRelayConfig, secret string, clientID string) (string, error) {
+	username := strconv.FormatInt(time.Now().Add(relayCredentialTTL).Unix(), 10) + ":" + clientID
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	b, err := json.Marshal([]pwebrtc.ICEServer{{
+		URLs:       []string{cfg.URL, cfg.URL + "?transport=tcp"},
+		Username:   username,
+		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	}})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
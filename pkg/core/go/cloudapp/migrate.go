@@ -0,0 +1,406 @@
+package cloudapp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	migrationSnapshotting = "snapshotting"
+	migrationTransferring = "transferring"
+	migrationRestoring    = "restoring"
+	migrationReady        = "ready"
+	migrationSwitching    = "switching"
+	migrationDone         = "done"
+	migrationFailed       = "failed"
+)
+
+// migrationChunkSize keeps every transfer request within the HTTP server timeouts
+const migrationChunkSize = 4 << 20
+
+// migrationSwitchTimeout is how long clients have to reconnect to the new worker before they are disconnected
+const migrationSwitchTimeout = 30 * time.Second
+
+const defaultMigrationTimeout = 120
+
+// Migration is the state of a session migration, on the source or the target worker
+type Migration struct {
+	ID     string `json:"id"`
+	Target string `json:"target,omitempty"`
+	State  string `json:"state"`
+	Error  string `json:"error,omitempty"`
+}
+
+// migrator moves the app session to another worker: snapshot the Wine prefix, transfer it,
+// restore it on the target and re-signal clients to reconnect there.
+// The target should be an idle worker, its app is relaunched with the snapshot
+type migrator struct {
+	mu         sync.Mutex
+	migrations map[string]*Migration
+}
+
+func newMigrator() *migrator {
+	return &migrator{migrations: map[string]*Migration{}}
+}
+
+func (m *migrator) get(id string) (Migration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mig, ok := m.migrations[id]
+	if !ok {
+		return Migration{}, false
+	}
+	return *mig, true
+}
+
+func (m *migrator) set(id string, state string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mig, ok := m.migrations[id]
+	if !ok {
+		mig = &Migration{ID: id}
+		m.migrations[id] = mig
+	}
+	mig.State = state
+	if err != nil {
+		mig.Error = err.Error()
+	}
+}
+
+func snapshotPath(id string) string {
+	return filepath.Join(os.TempDir(), "cloudmorph-migration-"+id+".tar.gz")
+}
+
+func runMigrateScript(ctx context.Context, command string, path string) error {
+	out, err := exec.CommandContext(ctx, "./migrate-wine.sh", command, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("migrate-wine.sh %s: %v: %s", command, err, out)
+	}
+	return nil
+}
+
+// migrateRequest is the body of POST /api/admin/migrate
+type migrateRequest struct {
+	// Target is the base URL of the worker receiving the session, e.g. https://worker2:8080
+	Target string `json:"target"`
+	// Timeout in seconds for snapshot, transfer and restore, default 120
+	Timeout int `json:"timeout"`
+}
+
+func (s *Server) handleMigrate(w http.ResponseWriter, r *http.Request) {
+	if runtime.GOOS == "windows" {
+		http.Error(w, "migration is only supported for the docker runtime", http.StatusNotImplemented)
+		return
+	}
+	var req migrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(req.Target)
+	if err != nil || target.Host == "" {
+		http.Error(w, "target must be the base URL of a worker", http.StatusBadRequest)
+		return
+	}
+	if req.Timeout <= 0 {
+		req.Timeout = defaultMigrationTimeout
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, s.startMigration(target, time.Duration(req.Timeout)*time.Second))
+}
+
+func (s *Server) startMigration(target *url.URL, timeout time.Duration) Migration {
+	id := uuid.Must(uuid.NewV4()).String()
+	s.migrator.mu.Lock()
+	mig := &Migration{ID: id, Target: target.String(), State: migrationSnapshotting}
+	s.migrator.migrations[id] = mig
+	s.migrator.mu.Unlock()
+	crash.Go("migration", func() { s.migrate(id, target, timeout) }, "migration", id)
+	return *mig
+}
+
+func (s *Server) handleMigrationStatus(w http.ResponseWriter, r *http.Request) {
+	mig, ok := s.migrator.get(mux.Vars(r)["id"])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, mig)
+}
+
+// migrate runs on the source worker. On failure the app is resumed and the session continues here,
+// the worker takes new sessions again unless it was draining before the migration
+func (s *Server) migrate(id string, target *url.URL, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Println("Migration", id, "to", target)
+	wasDraining := s.IsDraining()
+	s.Drain()
+	s.capp.announcer.Schedule(Announcement{
+		Message: "Your session is moving to another server, please wait",
+		Level:   announceMaintenance,
+	})
+
+	path := snapshotPath(id)
+	defer os.Remove(path)
+	fail := func(state string, err error) {
+		log.Println("Migration", id, "failed while", state, err)
+		s.migrator.set(id, migrationFailed, err)
+		if err := runMigrateScript(context.Background(), "resume", path); err != nil {
+			log.Println(err)
+		}
+		if !wasDraining {
+			s.drainer.resume()
+		}
+		s.capp.announcer.Schedule(Announcement{
+			Message: "Moving your session failed, it continues on this server",
+			Level:   announceWarning,
+		})
+	}
+
+	if err := runMigrateScript(ctx, "snapshot", path); err != nil {
+		fail(migrationSnapshotting, err)
+		return
+	}
+
+	s.migrator.set(id, migrationTransferring, nil)
+	sum, err := s.transferSnapshot(ctx, target, id, path)
+	if err != nil {
+		fail(migrationTransferring, err)
+		return
+	}
+
+	s.migrator.set(id, migrationRestoring, nil)
+	body, _ := json.Marshal(restoreRequest{SHA256: sum})
+	if _, err := s.migrationCall(ctx, http.MethodPost, target, "/api/admin/migration/"+id+"/restore", bytes.NewReader(body)); err != nil {
+		fail(migrationRestoring, err)
+		return
+	}
+	if err := s.waitRestored(ctx, target, id); err != nil {
+		fail(migrationRestoring, err)
+		return
+	}
+
+	// Re-signal clients to the new worker and give them time to move before disconnecting
+	s.migrator.set(id, migrationSwitching, nil)
+	protocol := "http:"
+	if target.Scheme == "https" {
+		protocol = "https:"
+	}
+	data, _ := json.Marshal(struct {
+		Protocol string `json:"protocol"`
+		Addr     string `json:"addr"`
+	}{protocol, target.Host + "/ws"})
+	s.capp.Broadcast(cws.WSPacket{Type: "MIGRATE", Data: string(data)})
+
+	deadline := time.Now().Add(migrationSwitchTimeout)
+	for atomic.LoadInt32(&s.drainer.sessions) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	s.capp.DisconnectAll()
+	s.migrator.set(id, migrationDone, nil)
+	log.Println("Migration", id, "done")
+}
+
+// transferSnapshot uploads the snapshot in chunks and returns its sha256
+func (s *Server) transferSnapshot(ctx context.Context, target *url.URL, id string, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	buf := make([]byte, migrationChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			endpoint := "/api/admin/migration/" + id + "/chunk?offset=" + strconv.FormatInt(offset, 10)
+			if _, err := s.migrationCall(ctx, http.MethodPost, target, endpoint, bytes.NewReader(buf[:n])); err != nil {
+				return "", err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *Server) waitRestored(ctx context.Context, target *url.URL, id string) error {
+	for {
+		body, err := s.migrationCall(ctx, http.MethodGet, target, "/api/admin/migration/"+id, nil)
+		if err != nil {
+			return err
+		}
+		var mig Migration
+		if err := json.Unmarshal(body, &mig); err != nil {
+			return err
+		}
+		switch mig.State {
+		case migrationReady:
+			return nil
+		case migrationFailed:
+			return errors.New(mig.Error)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// migrationCall calls the admin API of the target worker, workers of a fleet share the admin token
+// and present the fleet certificate when fleet TLS is on
+func (s *Server) migrationCall(ctx context.Context, method string, target *url.URL, endpoint string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, target.String()+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+s.adminToken)
+	resp, err := s.fleet.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("%s %s: %s %s", method, endpoint, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// handleMigrationChunk runs on the target worker and appends a chunk of the snapshot
+func (s *Server) handleMigrationChunk(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.FromString(id); err != nil {
+		http.Error(w, "invalid migration id", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	if offset == 0 {
+		s.migrator.set(id, migrationTransferring, nil)
+	} else if mig, ok := s.migrator.get(id); !ok || mig.State != migrationTransferring {
+		http.Error(w, "migration is not transferring", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(snapshotPath(id), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	// Only accept the next chunk, a retried chunk overwrites itself
+	if info, err := f.Stat(); err != nil || offset > info.Size() {
+		http.Error(w, "unexpected offset", http.StatusConflict)
+		return
+	}
+	if err := f.Truncate(offset); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(f, io.LimitReader(r.Body, migrationChunkSize)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreRequest is the body of POST /api/admin/migration/{id}/restore
+type restoreRequest struct {
+	SHA256 string `json:"sha256"`
+}
+
+// handleMigrationRestore runs on the target worker, verifies the snapshot and relaunches the app with it
+func (s *Server) handleMigrationRestore(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if mig, ok := s.migrator.get(id); !ok || mig.State != migrationTransferring {
+		http.Error(w, "migration is not transferring", http.StatusConflict)
+		return
+	}
+
+	path := snapshotPath(id)
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != req.SHA256 {
+		s.migrator.set(id, migrationFailed, errors.New("checksum mismatch"))
+		os.Remove(path)
+		http.Error(w, "checksum mismatch", http.StatusBadRequest)
+		return
+	}
+
+	// Restoring and relaunching takes longer than the server write timeout, the source polls the status
+	s.migrator.set(id, migrationRestoring, nil)
+	crash.Go("migration restore", func() {
+		defer os.Remove(path)
+		if err := runMigrateScript(context.Background(), "restore", path); err != nil {
+			log.Println("Migration", id, "restore failed", err)
+			s.migrator.set(id, migrationFailed, err)
+			return
+		}
+		s.capp.ccApp.Relaunch()
+		s.migrator.set(id, migrationReady, nil)
+		log.Println("Migration", id, "restored")
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
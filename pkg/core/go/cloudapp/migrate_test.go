@@ -0,0 +1,62 @@
+package cloudapp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newMigrationTestServer() *Server {
+	return &Server{
+		migrator: newMigrator(),
+		drainer:  newDrainer(),
+		capp:     &Service{announcer: newAnnouncer("", func(Announcement) {}, func() {})},
+	}
+}
+
+// TestMigrationFailureResumes checks a failed migration takes the worker out of drain mode and
+// registers it again, there is no migrate-wine.sh here so the snapshot fails
+func TestMigrationFailureResumes(t *testing.T) {
+	s := newMigrationTestServer()
+	s.drainer.sessionStarted()
+	resumed := 0
+	s.OnResume(func() { resumed++ })
+	target, _ := url.Parse("http://worker2:8080")
+
+	s.migrate("m1", target, time.Second)
+	if mig, _ := s.migrator.get("m1"); mig.State != migrationFailed || mig.Error == "" {
+		t.Fatalf("migration is %+v, want failed", mig)
+	}
+	if s.IsDraining() || resumed != 1 {
+		t.Fatalf("draining %v after the failed migration, resumed %d times", s.IsDraining(), resumed)
+	}
+
+	// The session ending doesn't count as the end of a drain any more
+	s.drainer.sessionEnded()
+	select {
+	case <-s.Drained():
+		t.Fatal("drained after the drain was called off")
+	default:
+	}
+	s.Drain()
+	select {
+	case <-s.Drained():
+	default:
+		t.Fatal("not drained without sessions")
+	}
+}
+
+// TestMigrationFailureKeepsDrain checks a worker draining before the migration keeps draining when it fails
+func TestMigrationFailureKeepsDrain(t *testing.T) {
+	s := newMigrationTestServer()
+	s.drainer.sessionStarted()
+	resumed := 0
+	s.OnResume(func() { resumed++ })
+	s.Drain()
+	target, _ := url.Parse("http://worker2:8080")
+
+	s.migrate("m1", target, time.Second)
+	if !s.IsDraining() || resumed != 0 {
+		t.Fatalf("draining %v after the failed migration, resumed %d times", s.IsDraining(), resumed)
+	}
+}
@@ -0,0 +1,122 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
+	"github.com/gorilla/websocket"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+// mseInit is the first text message of MSE stream, the client creates SourceBuffer with the codec
+type mseInit struct {
+	MimeType string `json:"mime_type"`
+}
+
+// MSE streams the app as fragmented MP4 over websocket for clients which cannot do WebRTC.
+// It's view-only, the client doesn't have input channel. Viewers go through the same gate as WebRTC sessions,
+// refusals and queue positions come as JSON packets before the init segment
+func (s *Server) MSE(w http.ResponseWriter, r *http.Request) {
+	if s.capp.webrtcConf.VideoCodec != pwebrtc.MimeTypeH264 {
+		http.Error(w, "MSE fallback supports H264 only", http.StatusNotImplemented)
+		return
+	}
+	c, client, e, ok := s.acceptFrameViewer(w, r)
+	if !ok {
+		return
+	}
+	defer c.Close()
+	defer s.leave(e, client)
+	id := client.GetID()
+	frames := e.svc.Frames().Subscribe(id, 60)
+	defer e.svc.Frames().Unsubscribe(id)
+	log.Println("MSE viewer joined", id)
+
+	muxer := media.NewFMP4Muxer(s.capp.config.ScreenWidth, s.capp.config.ScreenHeight)
+	initialized := false
+	for {
+		select {
+		case <-client.Done:
+			log.Println("MSE viewer left", id)
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			segment := muxer.Fragment(frame)
+			if segment == nil {
+				continue
+			}
+			if !initialized {
+				if err := s.sendMSEInit(c, muxer); err != nil {
+					log.Println("MSE: send init segment failed", err)
+					return
+				}
+				initialized = true
+			}
+			c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := c.WriteMessage(websocket.BinaryMessage, segment); err != nil {
+				log.Println("MSE: send segment failed", err)
+				return
+			}
+		}
+	}
+}
+
+// acceptFrameViewer upgrades a viewer of a frame transport, MSE or WebCodecs, and admits it through the gate of
+// WebRTC sessions. The client only wraps the connection for the gate, frames are written to it directly once admitted
+func (s *Server) acceptFrameViewer(w http.ResponseWriter, r *http.Request) (*websocket.Conn, *cws.Client, entry, bool) {
+	if !s.checkRequest(w, r) {
+		return nil, nil, entry{}, false
+	}
+
+	upgrader.CheckOrigin = func(r *http.Request) bool {
+		// TODO: can we be stricter?
+		return true
+	}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Frames: [!] WS upgrade:", err)
+		return nil, nil, entry{}, false
+	}
+
+	client := cws.NewClient(c)
+	s.negotiateLocale(client, r)
+	// Reader loop only detects closing from viewer
+	crash.Go("frame viewer reader", func() {
+		defer close(client.Done)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}, "viewer", client.GetID())
+
+	e, ok := s.admit(client, r, true)
+	if !ok {
+		c.Close()
+		return nil, nil, e, false
+	}
+	return c, client, e, true
+}
+
+func (s *Server) sendMSEInit(c *websocket.Conn, muxer *media.FMP4Muxer) error {
+	meta, err := json.Marshal(mseInit{MimeType: `video/mp4; codecs="` + muxer.Codec() + `"`})
+	if err != nil {
+		return err
+	}
+	initSegment, err := muxer.InitSegment()
+	if err != nil {
+		return err
+	}
+	c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := c.WriteMessage(websocket.TextMessage, meta); err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.BinaryMessage, initSegment)
+}
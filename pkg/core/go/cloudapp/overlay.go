@@ -0,0 +1,209 @@
+package cloudapp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+// overlayHostDir is mounted at overlayVMDir in the app VM, the encoder composites its logo and text into the stream
+const (
+	overlayHostDir = appsHostDir + "/.overlay"
+	overlayVMDir   = "/apps/.overlay"
+)
+
+// roleGuest is the role of guests when the overlay is picked
+const roleGuest = "guest"
+
+// guestWatermark is drawn on the stream of guests unless the overlay has an entry for their role
+const guestWatermark = "GUEST {timer}"
+
+var errOverlayUnsupported = errors.New("overlays are only supported in the Linux app VM")
+
+// overlayPlayer is a player the overlay can be drawn for
+type overlayPlayer struct {
+	name     string
+	roles    []string
+	joinedAt time.Time
+}
+
+// overlay draws the logo and text of the player who is in the session the longest.
+// The text is rewritten every second for the timer, the encoder reloads it on every frame
+type overlay struct {
+	cfg catalog.Overlay
+	app CloudAppClient
+
+	mu      sync.Mutex
+	players map[string]overlayPlayer
+	logo    string
+	text    string
+	since   time.Time
+	name    string
+}
+
+// newOverlay returns nil when nothing is drawn. The text file must exist before the encoder starts
+func newOverlay(cfg catalog.Overlay, guestWatermarks bool) *overlay {
+	os.RemoveAll(overlayHostDir)
+	if guestWatermarks && !hasRole(cfg.Roles, roleGuest) {
+		cfg.Roles = append(cfg.Roles, catalog.RoleOverlay{Role: roleGuest, Logo: cfg.Logo, Text: guestWatermark})
+	}
+	if !cfg.Enabled() {
+		return nil
+	}
+	o := &overlay{cfg: cfg, players: map[string]overlayPlayer{}}
+	if err := os.MkdirAll(overlayHostDir, 0755); err != nil {
+		log.Println("Overlay is disabled:", err)
+		return nil
+	}
+	o.writeText()
+	return o
+}
+
+func hasRole(roles []catalog.RoleOverlay, role string) bool {
+	for _, r := range roles {
+		if r.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// start draws the overlay with app, it runs until the process ends
+func (o *overlay) start(app CloudAppClient) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	o.app = app
+	o.mu.Unlock()
+	crash.Go("overlay", func() {
+		for range time.Tick(time.Second) {
+			o.writeText()
+		}
+	})
+}
+
+// join adds a player, leave removes it. Viewers aren't players
+func (o *overlay) join(clientID string, name string, roles []string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	joinedAt := time.Now()
+	if p, ok := o.players[clientID]; ok {
+		// e.g. a guest who signed in keeps its timer
+		joinedAt = p.joinedAt
+	}
+	o.players[clientID] = overlayPlayer{name: name, roles: roles, joinedAt: joinedAt}
+	o.mu.Unlock()
+	o.update()
+}
+
+func (o *overlay) leave(clientID string) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	delete(o.players, clientID)
+	o.mu.Unlock()
+	o.update()
+}
+
+// update picks the overlay of the longest playing player and restarts the encoder when its logo changes
+func (o *overlay) update() {
+	o.mu.Lock()
+	players := make([]overlayPlayer, 0, len(o.players))
+	for _, p := range o.players {
+		players = append(players, p)
+	}
+	sort.Slice(players, func(i, j int) bool { return players[i].joinedAt.Before(players[j].joinedAt) })
+	var logo, text string
+	if len(players) > 0 {
+		logo, text = o.cfg.For(players[0].roles)
+		o.name, o.since = players[0].name, players[0].joinedAt
+	} else {
+		o.name, o.since = "", time.Time{}
+	}
+	o.text = text
+	changed := logo != o.logo
+	o.logo = logo
+	app := o.app
+	o.mu.Unlock()
+
+	o.writeText()
+	if changed && app != nil {
+		if err := setOverlayLogo(app, logo); err != nil {
+			log.Println("Cannot draw the overlay logo:", err)
+		}
+	}
+}
+
+// writeText renders the text with the player and timer. It's replaced atomically, the encoder may read it any time
+func (o *overlay) writeText() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	text := o.text
+	if text != "" {
+		timer := time.Duration(0)
+		if !o.since.IsZero() {
+			timer = time.Since(o.since).Truncate(time.Second)
+		}
+		text = strings.NewReplacer("{user}", o.name, "{timer}", formatTimer(timer)).Replace(text)
+	}
+	// An empty file would fail the text filter of the encoder
+	if text == "" {
+		text = " "
+	}
+	if err := writeOverlayFile("text", []byte(text)); err != nil {
+		log.Println("Cannot write the overlay text:", err)
+	}
+}
+
+func writeOverlayFile(name string, data []byte) error {
+	tmp := filepath.Join(overlayHostDir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(overlayHostDir, name))
+}
+
+func formatTimer(d time.Duration) string {
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
+
+// setOverlayLogo copies the logo into the shared directory and makes the encoder draw it, an empty logo removes it.
+// The encoder reads the logo once when it restarts
+func setOverlayLogo(app CloudAppClient, logo string) error {
+	if logo == "" {
+		return app.SetOverlayLogo("")
+	}
+	data, err := ioutil.ReadFile(logo)
+	if err != nil {
+		return err
+	}
+	if err := writeOverlayFile("logo.png", data); err != nil {
+		return err
+	}
+	return app.SetOverlayLogo(overlayVMDir + "/logo.png")
+}
+
+func (c *ccImpl) SetOverlayLogo(path string) error {
+	if c.encoder == nil {
+		return errOverlayUnsupported
+	}
+	return c.encoder.Logo(path)
+}
@@ -0,0 +1,146 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+	"github.com/pion/interceptor/pkg/cc"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+const (
+	// preflightProbes is the number of probes running at once, more are refused
+	preflightProbes = 8
+	// preflightTimeout closes the probe peer connection whether the client is done or not
+	preflightTimeout = 15 * time.Second
+	// preflightGathering is the time the server has to gather its candidates for the answer
+	preflightGathering = 3 * time.Second
+)
+
+// preflightProbe is the response of the pre-flight, the client connects with the answer
+// and measures the RTT with pings echoed on the preflight DataChannel
+type preflightProbe struct {
+	ICEServers []pwebrtc.ICEServer         `json:"iceServers"`
+	Answer     *pwebrtc.SessionDescription `json:"answer,omitempty"`
+	// Candidates of the offer by type. Without srflx candidates the client can't reach the STUN servers
+	Candidates map[string]int `json:"candidates,omitempty"`
+	STUN       bool           `json:"stun"`
+}
+
+// handlePreflight returns the ICE servers, which the client gathers candidates with for the probe
+func (s *Server) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	if s.capp == nil {
+		http.Error(w, "no stream to probe", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, preflightProbe{ICEServers: s.capp.webrtcConf.Configuration.ICEServers})
+}
+
+// handlePreflightProbe answers the offer of the client with a peer connection echoing its DataChannel,
+// so the client checks the stream will connect before it queues for a session
+func (s *Server) handlePreflightProbe(w http.ResponseWriter, r *http.Request) {
+	if s.capp == nil {
+		http.Error(w, "no stream to probe", http.StatusServiceUnavailable)
+		return
+	}
+	var offer pwebrtc.SessionDescription
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&offer); err != nil || offer.Type != pwebrtc.SDPTypeOffer {
+		http.Error(w, "body must be an SDP offer", http.StatusBadRequest)
+		return
+	}
+	select {
+	case s.preflights <- struct{}{}:
+	default:
+		http.Error(w, "too many pre-flight probes, try again", http.StatusServiceUnavailable)
+		return
+	}
+	probe := preflightProbe{ICEServers: s.capp.webrtcConf.Configuration.ICEServers, Candidates: offerCandidates(offer.SDP)}
+	probe.STUN = probe.Candidates["srflx"] > 0
+	answer, err := startPreflight(s.capp.webrtcConf, offer, func() { <-s.preflights })
+	if err != nil {
+		log.Println("Pre-flight probe failed:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	probe.Answer = answer
+	writeJSON(w, probe)
+}
+
+// startPreflight answers the offer with a peer connection which echoes messages of the client's DataChannels.
+// done is called when the probe is closed
+func startPreflight(conf *webrtc.Config, offer pwebrtc.SessionDescription, done func()) (*pwebrtc.SessionDescription, error) {
+	pc, err := webrtc.NewPeerConnection(conf, func(cc.BandwidthEstimator) {})
+	if err != nil {
+		done()
+		return nil, err
+	}
+	var once sync.Once
+	closeProbe := func() {
+		once.Do(func() {
+			pc.Close()
+			done()
+		})
+	}
+	timer := time.AfterFunc(preflightTimeout, closeProbe)
+	pc.OnConnectionStateChange(func(state pwebrtc.PeerConnectionState) {
+		if state == pwebrtc.PeerConnectionStateFailed {
+			timer.Stop()
+			closeProbe()
+		}
+	})
+	pc.OnDataChannel(func(dc *pwebrtc.DataChannel) {
+		dc.OnMessage(func(msg pwebrtc.DataChannelMessage) {
+			dc.Send(msg.Data)
+		})
+		dc.OnClose(func() {
+			timer.Stop()
+			closeProbe()
+		})
+	})
+
+	fail := func(err error) (*pwebrtc.SessionDescription, error) {
+		timer.Stop()
+		closeProbe()
+		return nil, err
+	}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return fail(err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fail(err)
+	}
+	gathered := pwebrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fail(err)
+	}
+	// The answer carries the candidates, the probe doesn't trickle
+	select {
+	case <-gathered:
+	case <-time.After(preflightGathering):
+	}
+	return pc.LocalDescription(), nil
+}
+
+// offerCandidates counts the candidates of the SDP by type
+func offerCandidates(sdp string) map[string]int {
+	types := map[string]int{}
+	for _, line := range strings.Split(sdp, "\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "typ" {
+				types[fields[i+1]]++
+				break
+			}
+		}
+	}
+	return types
+}
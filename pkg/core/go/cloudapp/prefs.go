@@ -0,0 +1,112 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// prefsCollection keeps the preferences of signed-in users across sessions
+const prefsCollection = "prefs"
+
+// Stream preferences of a slow link
+const (
+	// PreferQuality thins the frame rate so every frame arrives intact
+	PreferQuality = "quality"
+	// PreferSmoothness keeps the full frame rate and accepts loss
+	PreferSmoothness = "smoothness"
+)
+
+// Prefs are the bandwidth and quality preferences of the PREFS packet
+type Prefs struct {
+	// MaxHeight the client scales the video to, 0 for the full resolution. The stream is shared by all clients
+	MaxHeight int    `json:"max_height"`
+	Prefer    string `json:"prefer"`
+	Mute      bool   `json:"mute"`
+}
+
+func (p Prefs) valid() bool {
+	return p.MaxHeight >= 0 && (p.Prefer == "" || p.Prefer == PreferQuality || p.Prefer == PreferSmoothness)
+}
+
+// loadPrefs returns the saved preferences of the user, anonymous users start with the defaults
+func (s *Server) loadPrefs(userID string) (Prefs, bool) {
+	var prefs Prefs
+	if userID == "" {
+		return prefs, false
+	}
+	ok, err := s.store.Get(prefsCollection, userID, &prefs)
+	if err != nil {
+		log.Println("Failed to load preferences:", err)
+	}
+	return prefs, ok
+}
+
+// routePrefs applies the preferences of the user to the session and saves the ones it sends with PREFS.
+// Saved preferences are sent back on join so the client applies its part, e.g. the max height
+func (s *Server) routePrefs(client *cws.Client, serviceClient *Client, userID string) {
+	s.switchUser(client, serviceClient, userID)
+	client.Receive("PREFS", func(req cws.WSPacket) cws.WSPacket {
+		var prefs Prefs
+		if err := json.Unmarshal([]byte(req.Data), &prefs); err != nil || !prefs.valid() {
+			return cws.WSPacket{Type: "PREFS_FAILED", Data: s.text(client, "invalid preferences")}
+		}
+		serviceClient.setPrefs(prefs)
+		s.savePrefs(serviceClient.user(), prefs)
+		return prefsPacket(prefs)
+	})
+}
+
+// switchUser makes userID the user of the session and applies its saved preferences.
+// Without saved ones the preferences of the session are saved for the user, e.g. of an upgraded guest
+func (s *Server) switchUser(client *cws.Client, serviceClient *Client, userID string) {
+	serviceClient.prefsMu.Lock()
+	serviceClient.userID = userID
+	current := serviceClient.prefs
+	serviceClient.prefsMu.Unlock()
+	if prefs, ok := s.loadPrefs(userID); ok {
+		serviceClient.setPrefs(prefs)
+		client.Send(prefsPacket(prefs), nil)
+	} else if current != (Prefs{}) {
+		s.savePrefs(userID, current)
+	}
+}
+
+func (s *Server) savePrefs(userID string, prefs Prefs) {
+	if userID == "" {
+		return
+	}
+	if err := s.store.Put(prefsCollection, userID, prefs); err != nil {
+		log.Println("Failed to save preferences:", err)
+	}
+}
+
+func prefsPacket(prefs Prefs) cws.WSPacket {
+	data, _ := json.Marshal(prefs)
+	return cws.WSPacket{Type: "PREFS", Data: string(data)}
+}
+
+func (c *Client) user() string {
+	c.prefsMu.Lock()
+	defer c.prefsMu.Unlock()
+	return c.userID
+}
+
+// setPrefs applies the preferences to the running stream, or to the stream started later
+func (c *Client) setPrefs(prefs Prefs) {
+	c.prefsMu.Lock()
+	c.prefs = prefs
+	rtcConn := c.rtcConn
+	c.prefsMu.Unlock()
+	if rtcConn == nil {
+		return
+	}
+	rtcConn.SetPreferSmoothness(prefs.Prefer == PreferSmoothness)
+	if rtcConn.IsNegotiated() {
+		if err := rtcConn.SetAudio(!prefs.Mute && c.feature(config.FeatureAudio)); err != nil {
+			log.Println("Error: Cannot switch audio of client:", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+// Link quality levels of the QUALITY packet
+const (
+	QualityGood     = "good"
+	QualityDegraded = "degraded"
+	QualityBad      = "bad"
+)
+
+const qualityInterval = 2 * time.Second
+
+// qualitySamples a new level must hold before it's reported, so the indicator doesn't flap
+const qualitySamples = 2
+
+// qualityReport is the data of the QUALITY packet
+type qualityReport struct {
+	Level string  `json:"level"`
+	RTT   int64   `json:"rtt"`
+	Loss  float64 `json:"loss"`
+	// Estimate is the bandwidth estimate in kbps
+	Estimate int64 `json:"estimate"`
+}
+
+// classifyLink rates the link from loss, RTT, dropped frames per second and the bandwidth estimate against the target bitrate
+func classifyLink(link webrtc.LinkStats, droppedPerSec float64, targetKbps int64) string {
+	ratio := 1.0
+	if targetKbps > 0 && link.Estimate > 0 {
+		ratio = float64(link.Estimate) / float64(targetKbps)
+	}
+	switch {
+	case link.Loss >= 10 || link.RTT >= 300 || droppedPerSec >= 5 || ratio < 0.3:
+		return QualityBad
+	case link.Loss >= 3 || link.RTT >= 150 || droppedPerSec > 0 || ratio < 0.6:
+		return QualityDegraded
+	}
+	return QualityGood
+}
+
+// watchQuality sends QUALITY packets when the link level of the client changes, until the client is gone
+func (c *Client) watchQuality(rtcConn *webrtc.WebRTC) {
+	ticker := time.NewTicker(qualityInterval)
+	defer ticker.Stop()
+	target := int64(c.webrtcConf.StartBitrate / 1000)
+	level, pending, held := QualityGood, QualityGood, 0
+	lastDropped := rtcConn.FramesDropped()
+	for {
+		select {
+		case <-c.cancel:
+			return
+		case <-ticker.C:
+		}
+		link := rtcConn.Link()
+		dropped := float64(link.Dropped-lastDropped) / qualityInterval.Seconds()
+		lastDropped = link.Dropped
+		if link.RTT > 0 {
+			inputRTT.With(c.region).Observe(float64(link.RTT))
+		}
+
+		sample := classifyLink(link, dropped, target)
+		c.recordSample(linkSample{At: time.Now(), LinkStats: link, DroppedPerSec: dropped, Level: sample})
+		if sample != pending {
+			pending, held = sample, 0
+		}
+		held++
+		if pending == level || held < qualitySamples {
+			continue
+		}
+		level = pending
+		data, _ := json.Marshal(qualityReport{Level: level, RTT: link.RTT, Loss: link.Loss, Estimate: link.Estimate})
+		c.ws.Send(cws.WSPacket{Type: "QUALITY", Data: string(data)}, nil)
+	}
+}
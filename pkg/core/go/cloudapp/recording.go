@@ -0,0 +1,282 @@
+package cloudapp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+const recordingExt = ".jsonl"
+
+// recordingFlushInterval bounds the input lost when the worker crashes
+const recordingFlushInterval = time.Second
+
+// maxRecordingLine is the longest event line of a replayed recording
+const maxRecordingLine = 64 << 10
+
+var errReplayRunning = errors.New("a replay is already running")
+
+// recordedEvent is a line of a recording
+type recordedEvent struct {
+	// T is milliseconds since the first event of the recording
+	T    int64  `json:"t"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// Recording is a recorded input file
+type Recording struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// inputRecorder writes all events going to the app with their time, one file per app session.
+// The file is created with the first event
+type inputRecorder struct {
+	dir     string
+	appName string
+
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+func newInputRecorder(dir string, appName string) *inputRecorder {
+	r := &inputRecorder{dir: dir, appName: appName}
+	crash.Go("input recorder", r.flushLoop)
+	return r
+}
+
+func (r *inputRecorder) record(packet Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.file == nil {
+		if err := r.open(now); err != nil {
+			log.Println("Cannot record input:", err)
+			return
+		}
+	}
+	line, _ := json.Marshal(recordedEvent{
+		T:    now.Sub(r.start).Milliseconds(),
+		Type: packet.Type,
+		Data: packet.Data,
+	})
+	r.w.Write(line)
+	r.w.WriteByte('\n')
+}
+
+// open creates the recording file. The caller holds the lock
+func (r *inputRecorder) open(now time.Time) error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	name := strings.Map(func(c rune) rune {
+		if c == '/' || c == '\\' || c == ' ' {
+			return '-'
+		}
+		return c
+	}, r.appName) + "-" + now.Format("20060102-150405") + recordingExt
+	file, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+	log.Println("Recording input to", file.Name())
+	r.file, r.w, r.start = file, bufio.NewWriter(file), now
+	return nil
+}
+
+func (r *inputRecorder) flushLoop() {
+	for range time.Tick(recordingFlushInterval) {
+		r.mu.Lock()
+		if r.w != nil {
+			r.w.Flush()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// list returns the recordings, the latest first
+func (r *inputRecorder) list() []Recording {
+	files, _ := ioutil.ReadDir(r.dir)
+	list := []Recording{}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != recordingExt {
+			continue
+		}
+		list = append(list, Recording{Name: f.Name(), CreatedAt: f.ModTime(), Size: f.Size()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// readRecording parses a recording. Events must be in time order
+func readRecording(rd io.Reader) ([]recordedEvent, error) {
+	var events []recordedEvent
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 4096), maxRecordingLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var e recordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(events) > 0 && e.T < events[len(events)-1].T {
+			return nil, fmt.Errorf("line %d: event is earlier than the previous one", line)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// inputReplayer sends recorded events to the app with their original timing
+type inputReplayer struct {
+	queue *inputQueue
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+func newInputReplayer(queue *inputQueue) *inputReplayer {
+	return &inputReplayer{queue: queue}
+}
+
+// start replays the events in background
+func (p *inputReplayer) start(events []recordedEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return errReplayRunning
+	}
+	stop := make(chan struct{})
+	p.stop = stop
+	crash.Go("input replay", func() {
+		p.run(events, stop)
+		p.mu.Lock()
+		if p.stop == stop {
+			p.stop = nil
+		}
+		p.mu.Unlock()
+	})
+	return nil
+}
+
+func (p *inputReplayer) run(events []recordedEvent, stop chan struct{}) {
+	log.Printf("Replaying %d input events", len(events))
+	// Keys held when the replay is stopped are released
+	held := newInputState()
+	defer func() {
+		for _, packet := range held.release() {
+			p.queue.Push(packet)
+		}
+	}()
+	start := time.Now()
+	for _, e := range events {
+		if wait := time.Until(start.Add(time.Duration(e.T) * time.Millisecond)); wait > 0 {
+			select {
+			case <-stop:
+				log.Println("Replay is stopped")
+				return
+			case <-time.After(wait):
+			}
+		}
+		packet := Packet{Type: e.Type, Data: e.Data}
+		held.accept(packet)
+		p.queue.Push(packet)
+	}
+	log.Println("Replay is done")
+}
+
+// cancel stops the running replay, false if there is none
+func (p *inputReplayer) cancel() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop == nil {
+		return false
+	}
+	close(p.stop)
+	p.stop = nil
+	return true
+}
+
+func (p *inputReplayer) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stop != nil
+}
+
+func (s *Server) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	if s.recorder == nil {
+		writeJSON(w, []Recording{})
+		return
+	}
+	writeJSON(w, s.recorder.list())
+}
+
+func (s *Server) handleRecordingFile(w http.ResponseWriter, r *http.Request) {
+	if s.recorder == nil {
+		http.Error(w, "input recording is disabled", http.StatusNotFound)
+		return
+	}
+	name := filepath.Base(filepath.Clean("/" + mux.Vars(r)["name"]))
+	serveDownload(w, r, filepath.Join(s.recorder.dir, name), name)
+}
+
+// handleReplay replays a recording of the recording directory with ?name=, or the recording in the request body
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	var rd io.Reader = r.Body
+	if name := r.URL.Query().Get("name"); name != "" {
+		if s.recorder == nil {
+			http.Error(w, "input recording is disabled", http.StatusNotFound)
+			return
+		}
+		f, err := os.Open(filepath.Join(s.recorder.dir, filepath.Base(filepath.Clean("/"+name))))
+		if err != nil {
+			http.Error(w, "recording is not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		rd = f
+	}
+	events, err := readRecording(rd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.replayer.start(events); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) handleReplayStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]bool{"running": s.replayer.running()})
+}
+
+func (s *Server) handleStopReplay(w http.ResponseWriter, r *http.Request) {
+	if !s.replayer.cancel() {
+		http.Error(w, "no replay is running", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
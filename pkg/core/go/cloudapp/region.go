@@ -0,0 +1,124 @@
+package cloudapp
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/metrics"
+)
+
+const (
+	regionUnknown = "unknown"
+	// regionOther is the label of regions past maxRegions, clients can report anything
+	regionOther = "other"
+	maxRegions  = 128
+)
+
+// inputRTT is sampled every quality interval of a session, so sessions weigh by their length
+var inputRTT = metrics.NewHistogramVec("cloudmorph_input_rtt_ms", "Round trip time of the input link of sessions by region of the client",
+	[]float64{10, 20, 40, 60, 80, 100, 150, 200, 300, 500, 1000}, "region")
+
+// regionLabel is a country code, a region name or an IANA time zone
+var regionLabel = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+\-/]{0,63}$`)
+
+// regions tags sessions with the region of the client
+type regions struct {
+	header   string
+	names    []string
+	nets     map[string][]*net.IPNet
+	reported bool
+
+	mu     sync.Mutex
+	labels map[string]bool
+}
+
+func newRegions(cfg config.RegionsConfig) *regions {
+	// ReadConfig validates them
+	nets, _ := cfg.Nets()
+	names := make([]string, 0, len(nets))
+	for name := range nets {
+		names = append(names, name)
+	}
+	// Overlapping networks go to the first region by name
+	sort.Strings(names)
+	return &regions{header: cfg.Header, names: names, nets: nets, reported: cfg.Reported, labels: map[string]bool{}}
+}
+
+// of returns the region of the client of the request
+func (g *regions) of(r *http.Request, ip net.IP) string {
+	// XX and T1 are unknown countries and Tor of Cloudflare
+	if g.header != "" {
+		if country := strings.ToUpper(strings.TrimSpace(r.Header.Get(g.header))); country != "" && country != "XX" && country != "T1" {
+			return g.label(country)
+		}
+	}
+	if ip != nil {
+		for _, name := range g.names {
+			for _, n := range g.nets[name] {
+				if n.Contains(ip) {
+					return name
+				}
+			}
+		}
+	}
+	if g.reported {
+		if tz := r.URL.Query().Get("tz"); tz != "" {
+			return g.label(tz)
+		}
+	}
+	return regionUnknown
+}
+
+// label bounds the label values of the metrics, malformed regions are unknown and new ones past maxRegions other
+func (g *regions) label(region string) string {
+	if !regionLabel.MatchString(region) {
+		return regionUnknown
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.labels[region] {
+		if len(g.labels) >= maxRegions {
+			return regionOther
+		}
+		g.labels[region] = true
+	}
+	return region
+}
+
+// regionLatency is the input RTT distribution of a region in ms
+type regionLatency struct {
+	Region string `json:"region"`
+	// Sessions of the region now
+	Sessions  int                       `json:"sessions"`
+	Samples   int64                     `json:"samples"`
+	Mean      float64                   `json:"mean"`
+	P50       float64                   `json:"p50"`
+	P90       float64                   `json:"p90"`
+	P99       float64                   `json:"p99"`
+	Histogram metrics.HistogramSnapshot `json:"histogram"`
+}
+
+// handleRegions lists the input RTT of regions since the start, the worst first, to see where workers are missing
+func (s *Server) handleRegions(w http.ResponseWriter, r *http.Request) {
+	sessions := map[string]int{}
+	for _, c := range s.capp.snapshotClients() {
+		sessions[c.region]++
+	}
+	snapshots := inputRTT.Snapshots()
+	latencies := make([]regionLatency, 0, len(snapshots))
+	for region, h := range snapshots {
+		l := regionLatency{Region: region, Sessions: sessions[region], Samples: h.Count, Histogram: h}
+		if h.Count > 0 {
+			l.Mean = h.Sum / float64(h.Count)
+		}
+		l.P50, l.P90, l.P99 = h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99)
+		latencies = append(latencies, l)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i].P90 > latencies[j].P90 })
+	writeJSON(w, latencies)
+}
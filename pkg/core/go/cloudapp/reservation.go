@@ -0,0 +1,311 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/store"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+const reservationCollection = "reservations"
+
+// Reservation holds app slots for invited users at a future time, e.g. a training session
+type Reservation struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title,omitempty"`
+	Group    string    `json:"group,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Slots    int       `json:"slots"`
+	Invitees []Invitee `json:"invitees"`
+	// Notified is set when join links are sent at pre-warm time
+	Notified bool `json:"notified"`
+}
+
+// Invitee is a user invited to a reservation with a personal join link
+type Invitee struct {
+	Name    string `json:"name,omitempty"`
+	Email   string `json:"email,omitempty"`
+	Token   string `json:"token"`
+	JoinURL string `json:"join_url"`
+}
+
+// reservations schedules pre-warm and holds slots from pre-warm time until the end of each reservation
+type reservations struct {
+	store   *store.Store
+	prewarm time.Duration
+	smtp    config.SMTPConfig
+	// onPrewarm prepares the instance before a reservation starts
+	onPrewarm func(Reservation)
+
+	mu    sync.Mutex
+	items map[string]*Reservation
+	// claimed are the tokens of the invitees holding a slot by reservation, one slot each
+	claimed map[string]map[string]bool
+	timers  map[string][]*time.Timer
+}
+
+func newReservations(st *store.Store, cfg config.ReservationConfig, onPrewarm func(Reservation)) *reservations {
+	rs := &reservations{
+		store:     st,
+		prewarm:   time.Duration(cfg.PrewarmMinutes) * time.Minute,
+		smtp:      cfg.SMTP,
+		onPrewarm: onPrewarm,
+		items:     map[string]*Reservation{},
+		claimed:   map[string]map[string]bool{},
+		timers:    map[string][]*time.Timer{},
+	}
+	err := st.Each(reservationCollection, func(id string, data json.RawMessage) error {
+		var r Reservation
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if time.Now().After(r.End) {
+			return st.Delete(reservationCollection, id)
+		}
+		rs.schedule(&r)
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to load reservations:", err)
+	}
+	return rs
+}
+
+func (rs *reservations) add(r Reservation) (Reservation, error) {
+	if err := rs.store.Put(reservationCollection, r.ID, r); err != nil {
+		return r, err
+	}
+	rs.schedule(&r)
+	return r, nil
+}
+
+// schedule sets timers of pre-warm and end of the reservation
+func (rs *reservations) schedule(r *Reservation) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.items[r.ID] = r
+	id := r.ID
+	rs.timers[id] = []*time.Timer{
+		time.AfterFunc(time.Until(r.Start.Add(-rs.prewarm)), func() { rs.warm(id) }),
+		time.AfterFunc(time.Until(r.End), func() { rs.cancel(id) }),
+	}
+}
+
+func (rs *reservations) warm(id string) {
+	rs.mu.Lock()
+	r, ok := rs.items[id]
+	var snapshot Reservation
+	if ok {
+		snapshot = *r
+	}
+	rs.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Println("Pre-warm instance for reservation", id, snapshot.Title)
+	rs.onPrewarm(snapshot)
+	if snapshot.Notified {
+		return
+	}
+	rs.notify(snapshot)
+	rs.mu.Lock()
+	r.Notified = true
+	snapshot = *r
+	rs.mu.Unlock()
+	if err := rs.store.Put(reservationCollection, id, snapshot); err != nil {
+		log.Println(err)
+	}
+}
+
+// notify sends join links to invitees by email, they are always in the reservation API too
+func (rs *reservations) notify(r Reservation) {
+	for _, invitee := range r.Invitees {
+		if invitee.Email == "" || rs.smtp.Host == "" {
+			log.Println("Reservation", r.ID, "join link of", invitee.Name, invitee.JoinURL)
+			continue
+		}
+		msg := fmt.Sprintf("To: %s\r\nSubject: Your session %s is ready\r\n\r\nJoin at %s: %s\r\n",
+			invitee.Email, r.Title, r.Start.Format(time.RFC1123), invitee.JoinURL)
+		var auth smtp.Auth
+		if rs.smtp.Username != "" {
+			auth = smtp.PlainAuth("", rs.smtp.Username, rs.smtp.Password, rs.smtp.Host)
+		}
+		addr := rs.smtp.Host + ":" + strconv.Itoa(rs.smtp.Port)
+		if err := smtp.SendMail(addr, auth, rs.smtp.From, []string{invitee.Email}, []byte(msg)); err != nil {
+			log.Println("Failed to email join link to", invitee.Email, err)
+		}
+	}
+}
+
+func (rs *reservations) cancel(id string) bool {
+	rs.mu.Lock()
+	_, ok := rs.items[id]
+	for _, t := range rs.timers[id] {
+		t.Stop()
+	}
+	delete(rs.items, id)
+	delete(rs.timers, id)
+	delete(rs.claimed, id)
+	rs.mu.Unlock()
+	if err := rs.store.Delete(reservationCollection, id); err != nil {
+		log.Println(err)
+	}
+	return ok
+}
+
+func (rs *reservations) list() []Reservation {
+	rs.mu.Lock()
+	list := make([]Reservation, 0, len(rs.items))
+	for _, r := range rs.items {
+		list = append(list, *r)
+	}
+	rs.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+func (rs *reservations) isHolding(r *Reservation, now time.Time) bool {
+	return now.After(r.Start.Add(-rs.prewarm)) && now.Before(r.End)
+}
+
+// held returns slots held for reservations which aren't taken by their invitees yet
+func (rs *reservations) held() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	held := 0
+	for id, r := range rs.items {
+		if rs.isHolding(r, now) && r.Slots > len(rs.claimed[id]) {
+			held += r.Slots - len(rs.claimed[id])
+		}
+	}
+	return held
+}
+
+// claim takes a held slot for the invitee token. It returns the reservation ID.
+// An invitee holds one slot, another connection with its token goes without
+func (rs *reservations) claim(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	for id, r := range rs.items {
+		if !rs.isHolding(r, now) || len(rs.claimed[id]) >= r.Slots || rs.claimed[id][token] {
+			continue
+		}
+		for _, invitee := range r.Invitees {
+			if invitee.Token == token {
+				if rs.claimed[id] == nil {
+					rs.claimed[id] = map[string]bool{}
+				}
+				rs.claimed[id][token] = true
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// release gives the slot of the invitee token back to the reservation
+func (rs *reservations) release(id, token string) {
+	rs.mu.Lock()
+	delete(rs.claimed[id], token)
+	rs.mu.Unlock()
+}
+
+// reservationRequest is the body of POST /api/admin/reservations
+type reservationRequest struct {
+	Title string    `json:"title"`
+	Group string    `json:"group"`
+	Start time.Time `json:"start"`
+	// Duration in minutes
+	Duration int `json:"duration"`
+	// Held slots. Default: number of invitees
+	Slots    int `json:"slots"`
+	Invitees []struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"invitees"`
+}
+
+func (s *Server) handleReserve(w http.ResponseWriter, r *http.Request) {
+	var req reservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Start.Before(time.Now()) || req.Duration <= 0 {
+		http.Error(w, "start must be in the future and duration positive", http.StatusBadRequest)
+		return
+	}
+	if len(req.Invitees) == 0 {
+		http.Error(w, "invitees are required", http.StatusBadRequest)
+		return
+	}
+
+	res := Reservation{
+		ID:    uuid.Must(uuid.NewV4()).String(),
+		Title: req.Title,
+		Group: req.Group,
+		Start: req.Start,
+		End:   req.Start.Add(time.Duration(req.Duration) * time.Minute),
+		Slots: req.Slots,
+	}
+	if res.Slots <= 0 {
+		res.Slots = len(req.Invitees)
+	}
+	if max := s.admission.limits.MaxSessions; max > 0 && res.Slots > max {
+		http.Error(w, fmt.Sprintf("CAPACITY: at most %d slots", max), http.StatusConflict)
+		return
+	}
+	for _, invitee := range req.Invitees {
+		token := uuid.Must(uuid.NewV4()).String()
+		res.Invitees = append(res.Invitees, Invitee{
+			Name:    invitee.Name,
+			Email:   invitee.Email,
+			Token:   token,
+			JoinURL: s.publicURL + "/embed?token=" + token,
+		})
+	}
+	res, err := s.reservations.add(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) handleListReservations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.reservations.list())
+}
+
+func (s *Server) handleCancelReservation(w http.ResponseWriter, r *http.Request) {
+	if !s.reservations.cancel(mux.Vars(r)["id"]) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// prewarm relaunches the app VM for a fresh instance unless users are still in it
+func (s *Server) prewarm(r Reservation) {
+	if s.IsDraining() || atomic.LoadInt32(&s.drainer.sessions) > 0 {
+		return
+	}
+	s.capp.ccApp.Relaunch()
+}
@@ -0,0 +1,41 @@
+package cloudapp
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReservationClaimsPerInvitee checks an invitee holds one slot of the reservation however often it joins
+func TestReservationClaimsPerInvitee(t *testing.T) {
+	rs := &reservations{items: map[string]*Reservation{}, claimed: map[string]map[string]bool{}}
+	rs.items["r1"] = &Reservation{
+		ID:       "r1",
+		Start:    time.Now().Add(-time.Minute),
+		End:      time.Now().Add(time.Hour),
+		Slots:    2,
+		Invitees: []Invitee{{Token: "a"}, {Token: "b"}},
+	}
+
+	if id, ok := rs.claim("a"); !ok || id != "r1" {
+		t.Fatal("invitee doesn't get its slot")
+	}
+	if _, ok := rs.claim("a"); ok {
+		t.Fatal("invitee takes a second slot")
+	}
+	if _, ok := rs.claim("c"); ok {
+		t.Fatal("stranger takes a slot")
+	}
+	if held := rs.held(); held != 1 {
+		t.Fatalf("%d slots held, want 1 for the other invitee", held)
+	}
+	if _, ok := rs.claim("b"); !ok {
+		t.Fatal("other invitee doesn't get its slot")
+	}
+	rs.release("r1", "a")
+	if held := rs.held(); held != 1 {
+		t.Fatalf("%d slots held after the invitee left, want 1", held)
+	}
+	if _, ok := rs.claim("a"); !ok {
+		t.Fatal("invitee doesn't get its slot back")
+	}
+}
@@ -0,0 +1,115 @@
+package cloudapp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// resetter resets the app with its reset policy when the last user leaves, so the next user of a shared
+// instance doesn't inherit documents and logins. The slot is held while it runs, so new users wait in queue
+type resetter struct {
+	policy string
+	// pristine is the snapshot of the Wine prefix restored by the snapshot policy
+	pristine string
+
+	mu      sync.Mutex
+	running int32
+}
+
+func newResetter(policy string, dataDir string, appName string) *resetter {
+	return &resetter{policy: policy, pristine: filepath.Join(dataDir, "pristine", appName+".tar.gz")}
+}
+
+// held counts the slot of a running reset for admission
+func (rs *resetter) held() int {
+	return int(atomic.LoadInt32(&rs.running))
+}
+
+// wait queues a new session while the app is reset. It returns false if the client leaves
+func (rs *resetter) wait(client *cws.Client) bool {
+	if rs.held() == 0 {
+		return true
+	}
+	client.Send(cws.WSPacket{Type: "QUEUE", Data: "1"}, nil)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for rs.held() > 0 {
+		select {
+		case <-client.Done:
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// sessionEnded ends a session and resets the app if it was the last one
+func (s *Server) sessionEnded() {
+	s.resets.mu.Lock()
+	defer s.resets.mu.Unlock()
+	if s.drainer.sessionEnded() > 0 || s.resets.policy == catalog.ResetNone {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&s.resets.running, 0, 1) {
+		crash.Go("app reset", s.resetApp)
+	}
+}
+
+// resetApp runs the reset policy and releases the slot
+func (s *Server) resetApp() {
+	defer atomic.StoreInt32(&s.resets.running, 0)
+	log.Printf("Reset: the last user left, reset the app with policy %s", s.resets.policy)
+	if s.resets.policy == catalog.ResetSnapshot && runtime.GOOS != "windows" {
+		if err := s.restorePristine(); err != nil {
+			log.Println("Reset: cannot restore the Wine prefix:", err)
+		}
+	}
+	s.capp.ccApp.Relaunch()
+}
+
+// restorePristine restores the pristine snapshot of the Wine prefix. Without one the prefix is emptied,
+// and the app launches with a freshly provisioned prefix
+func (s *Server) restorePristine() error {
+	if _, err := os.Stat(s.resets.pristine); err != nil {
+		log.Println("Reset: no pristine snapshot, start with a fresh Wine prefix")
+		if out, err := exec.Command("./reset-wine.sh").CombinedOutput(); err != nil {
+			return fmt.Errorf("reset-wine.sh: %v: %s", err, out)
+		}
+		return nil
+	}
+	return runMigrateScript(context.Background(), "restore", s.resets.pristine)
+}
+
+// handleSnapshotPristine saves the Wine prefix as the pristine snapshot, e.g. after an admin installed and set up the app.
+// The app is paused while it's copied
+func (s *Server) handleSnapshotPristine(w http.ResponseWriter, r *http.Request) {
+	if err := os.MkdirAll(filepath.Dir(s.resets.pristine), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	err := runMigrateScript(ctx, "snapshot", s.resets.pristine)
+	if rerr := runMigrateScript(context.Background(), "resume", s.resets.pristine); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Println("Reset: saved the pristine snapshot", s.resets.pristine)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package cloudapp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/token"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+// tokenKindResume tokens carry the ICE credentials of a stream, a refreshed page resumes with them
+const tokenKindResume = "resume"
+
+// resumeTTL is how long after the stream started the page can resume it
+const resumeTTL = 5 * time.Minute
+
+type resumeClaims struct {
+	token.Claims
+	webrtc.ICECredentials
+}
+
+// resumeICE returns the ICE credentials of the resume token. They are refused while another stream uses them,
+// e.g. of a duplicated tab, which then starts cold with new ones
+func (s *Server) resumeICE(tok string) (webrtc.ICECredentials, bool) {
+	var claims resumeClaims
+	if tok == "" || s.signer.Verify(tok, tokenKindResume, &claims) != nil || !claims.Valid() {
+		return webrtc.ICECredentials{}, false
+	}
+	for _, c := range s.capp.snapshotClients() {
+		c.prefsMu.Lock()
+		used := c.ice.Ufrag == claims.Ufrag
+		c.prefsMu.Unlock()
+		if used {
+			return webrtc.ICECredentials{}, false
+		}
+	}
+	return claims.ICECredentials, true
+}
+
+// routeResume resumes the stream of the token and sends the page a RESUME token for each new stream
+func (s *Server) routeResume(client *cws.Client, serviceClient *Client, tok string) {
+	if ice, ok := s.resumeICE(tok); ok {
+		serviceClient.prefsMu.Lock()
+		serviceClient.ice = ice
+		serviceClient.prefsMu.Unlock()
+	}
+	serviceClient.onICE = func(ice webrtc.ICECredentials) {
+		tok, err := s.signer.Sign(resumeClaims{
+			Claims:         token.Claims{Kind: tokenKindResume, Exp: time.Now().Add(resumeTTL).Unix()},
+			ICECredentials: ice,
+		})
+		if err != nil {
+			return
+		}
+		client.Send(cws.WSPacket{Type: "RESUME", Data: tok}, nil)
+	}
+}
+
+// resumeGrace is how long the stream of a page whose websocket dropped waits for the page to reconnect
+const resumeGrace = 20 * time.Second
+
+// parkedPeers keep the peer connections of the pages whose websocket dropped by their ICE username fragment.
+// The page keeps its peer connection and reconnects, the next session takes the stream over with an
+// ICE restart instead of a new handshake
+type parkedPeers struct {
+	mu    sync.Mutex
+	peers map[string]*webrtc.WebRTC
+}
+
+func newParkedPeers() *parkedPeers {
+	return &parkedPeers{peers: map[string]*webrtc.WebRTC{}}
+}
+
+// park keeps the peer connection till the page reconnects, it's stopped after the grace period or when it closes
+func (p *parkedPeers) park(ufrag string, conn *webrtc.WebRTC) {
+	p.mu.Lock()
+	old := p.peers[ufrag]
+	p.peers[ufrag] = conn
+	p.mu.Unlock()
+	if old != nil {
+		old.StopClient()
+	}
+	crash.Go("parked peer", func() {
+		select {
+		case <-conn.Closed():
+		case <-time.After(resumeGrace):
+		}
+		p.mu.Lock()
+		expired := p.peers[ufrag] == conn
+		if expired {
+			delete(p.peers, ufrag)
+		}
+		p.mu.Unlock()
+		if expired {
+			conn.StopClient()
+		}
+	}, "peer", conn.ID)
+}
+
+// take returns the parked peer connection of the ufrag, nil when there is none
+func (p *parkedPeers) take(ufrag string) *webrtc.WebRTC {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn := p.peers[ufrag]
+	delete(p.peers, ufrag)
+	return conn
+}
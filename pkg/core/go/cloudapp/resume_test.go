@@ -0,0 +1,42 @@
+package cloudapp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+// TestParkedPeers checks the next session of the page takes the parked peer connection over once,
+// and a connection which closes while it's parked is dropped
+func TestParkedPeers(t *testing.T) {
+	p := newParkedPeers()
+	conn := webrtc.NewWebRTC()
+	p.park("ufrag", conn)
+	if p.take("other") != nil {
+		t.Fatal("took the peer connection of another ufrag")
+	}
+	if p.take("ufrag") != conn {
+		t.Fatal("parked peer connection isn't taken over")
+	}
+	if p.take("ufrag") != nil {
+		t.Fatal("parked peer connection is taken over twice")
+	}
+
+	closed := webrtc.NewWebRTC()
+	p.park("ufrag", closed)
+	closed.StopClient()
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		n := len(p.peers)
+		p.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed peer connection stays parked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,175 @@
+package cloudapp
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+var roomName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// roomLaunchTimeout is how long sessions wait for the app VM of their room to stream
+const roomLaunchTimeout = 2 * time.Minute
+
+var (
+	errRoomName     = errors.New("the room name is not valid")
+	errNoRoom       = errors.New("all rooms are in use, try again later")
+	errRoomStarting = errors.New("the room is still starting, try again later")
+	errRoomFailed   = errors.New("the room failed to start, try again later")
+)
+
+// rooms runs independent instances of the app in the worker, one per ?room= of the sessions.
+// Each instance is a Service of its own, with its app VM, fanout, input queue and frames.
+// Sessions without room play the default instance, which isn't part of the pool
+type rooms struct {
+	conf config.Config
+	idle time.Duration
+
+	mu sync.Mutex
+	// instances by slot-1, launched for their first room
+	instances []*roomInstance
+}
+
+// roomInstance is an instance of the pool, it keeps its room while empty until the idle timeout,
+// so players reconnecting to the room find the app as they left it
+type roomInstance struct {
+	vm       appVM
+	svc      *Service
+	room     string
+	sessions int
+	// idleSince is when the last session left
+	idleSince time.Time
+	// ready is closed once the app VM of the room streams
+	ready chan struct{}
+}
+
+func newRooms(conf config.Config) *rooms {
+	if conf.Rooms.Max <= 0 {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		log.Println("Rooms need the Linux app VM, sessions of rooms play the default instance")
+		return nil
+	}
+	r := &rooms{conf: conf, idle: time.Duration(conf.Rooms.IdleTimeout) * time.Second}
+	for slot := 1; slot <= conf.Rooms.Max; slot++ {
+		r.instances = append(r.instances, &roomInstance{vm: appVM{slot: slot}})
+	}
+	return r
+}
+
+// roomOf returns the room of the request, empty for the default instance and when rooms are disabled
+func (r *rooms) roomOf(req *http.Request) (string, error) {
+	room := req.URL.Query().Get("room")
+	if r == nil || room == "" {
+		return "", nil
+	}
+	if !roomName.MatchString(room) {
+		return "", errRoomName
+	}
+	return room, nil
+}
+
+// join returns the instance of the room for a new session. A room without one takes a free instance of the pool,
+// an instance which was never launched or whose room is idle, and the app is launched fresh for it.
+// It blocks until the app VM streams, sessions of a room which doesn't come up within roomLaunchTimeout are refused
+func (r *rooms) join(room string) (*Service, error) {
+	r.mu.Lock()
+	if inst := r.instanceOf(room); inst != nil {
+		inst.sessions++
+		ready := inst.ready
+		r.mu.Unlock()
+		timeout := time.NewTimer(roomLaunchTimeout)
+		defer timeout.Stop()
+		select {
+		case <-ready:
+		case <-timeout.C:
+			r.leave(room)
+			return nil, errRoomStarting
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if inst.svc == nil {
+			return nil, errRoomFailed
+		}
+		return inst.svc, nil
+	}
+	inst := r.free(time.Now())
+	if inst == nil {
+		r.mu.Unlock()
+		return nil, errNoRoom
+	}
+	if inst.room != "" {
+		log.Println("Room", inst.room, "is idle, its instance moves to room", room)
+	}
+	inst.room, inst.sessions, inst.ready = room, 1, make(chan struct{})
+	svc := inst.svc
+	r.mu.Unlock()
+
+	if svc == nil {
+		log.Println("Launching instance", inst.vm.slot, "for room", room)
+		var err error
+		if svc, err = newCloudService(r.conf, inst.vm); err != nil {
+			// The instance is free again, the sessions waiting for it are refused
+			r.mu.Lock()
+			inst.room, inst.sessions = "", 0
+			r.mu.Unlock()
+			close(inst.ready)
+			return nil, err
+		}
+		crash.Go("app input", svc.Handle, "room", room)
+	} else {
+		svc.ccApp.Relaunch()
+	}
+	r.mu.Lock()
+	inst.svc = svc
+	r.mu.Unlock()
+	close(inst.ready)
+	return svc, nil
+}
+
+// leave releases a session of the room, the room is idle once all its sessions left
+func (r *rooms) leave(room string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if inst := r.instanceOf(room); inst != nil {
+		inst.sessions--
+		if inst.sessions == 0 {
+			inst.idleSince = time.Now()
+		}
+	}
+}
+
+// instanceOf returns the instance of the room, nil when it has none. The caller holds the lock
+func (r *rooms) instanceOf(room string) *roomInstance {
+	for _, inst := range r.instances {
+		if inst.room == room {
+			return inst
+		}
+	}
+	return nil
+}
+
+// free returns an instance for a new room, preferring launched ones. The caller holds the lock
+func (r *rooms) free(now time.Time) *roomInstance {
+	var unused *roomInstance
+	for _, inst := range r.instances {
+		if inst.room == "" {
+			if unused == nil {
+				unused = inst
+			}
+			continue
+		}
+		if inst.sessions == 0 && now.Sub(inst.idleSince) >= r.idle {
+			return inst
+		}
+	}
+	return unused
+}
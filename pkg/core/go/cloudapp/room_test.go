@@ -0,0 +1,37 @@
+package cloudapp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// TestRoomsReuseIdleInstances checks rooms keep their instance while in use or recently left, and idle ones are reused
+func TestRoomsReuseIdleInstances(t *testing.T) {
+	r := newRooms(config.Config{Rooms: config.RoomsConfig{Max: 2, IdleTimeout: 60}})
+	now := time.Unix(1000, 0)
+	a, b := r.instances[0], r.instances[1]
+	a.room, a.sessions = "a", 1
+	if got := r.free(now); got != b {
+		t.Fatalf("free instance is %v, want the unused one", got)
+	}
+	b.room, b.sessions = "b", 1
+	if got := r.free(now); got != nil {
+		t.Fatalf("free instance is %v while all rooms are in use", got)
+	}
+
+	a.sessions, a.idleSince = 0, now
+	if got := r.free(now.Add(59 * time.Second)); got != nil {
+		t.Fatal("room is taken before its idle timeout")
+	}
+	if got := r.free(now.Add(60 * time.Second)); got != a {
+		t.Fatalf("free instance is %v, want the idle one", got)
+	}
+	if r.instanceOf("a") != a || r.instanceOf("c") != nil {
+		t.Fatal("instances aren't found by room")
+	}
+	if inst := (appVM{slot: 2}); inst.videoPort() != 5024 || inst.inputPort() != 9092 || inst.display() != ":101" {
+		t.Fatalf("ports of slot 2 are %d %d %s", inst.videoPort(), inst.inputPort(), inst.display())
+	}
+}
@@ -0,0 +1,56 @@
+package cloudapp
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/monitoring"
+	"github.com/giongto35/cloud-morph/pkg/common/preemption"
+)
+
+// Run serves the app instance of the config until it's stopped or drained
+func Run(cfg config.Config) {
+	if err := crash.Setup(cfg.Crash); err != nil {
+		log.Println("Crash reporting is disabled:", err)
+	}
+	// TODO: Make the communication over websocket
+	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets"))))
+	if mon := monitoring.NewServer(cfg); mon != nil {
+		mon.Run()
+	}
+	server := NewServer(cfg)
+	server.Handle()
+	preemption.Watch(cfg.Preemption, func(notice preemption.Notice) {
+		server.Evacuate(cfg.Preemption.MigrateTarget, notice.Time)
+	})
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	drain := DrainSignal()
+	for {
+		select {
+		case <-stop:
+			log.Println("Received SIGTERM, Quiting")
+			server.Shutdown()
+			return
+		case <-drain:
+			log.Println("Received SIGUSR1, Draining")
+			server.Drain()
+		case <-server.Drained():
+			log.Println("Drained, Quiting")
+			server.Shutdown()
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cloudapp
+
+import (
+	"net/http"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+// ProtocolVersion of the packets between the JS client and the server, bumped on incompatible changes
+const ProtocolVersion = 1
+
+// RuntimeConfig is what the JS client needs to know about the server. It fills the page templates,
+// is embedded into the pages for the scripts and served as config.json
+type RuntimeConfig struct {
+	// BasePath prefixes links of the page when served behind a reverse proxy
+	BasePath string `json:"basePath"`
+	// WSEndpoint is the websocket path of the page below the base path
+	WSEndpoint string `json:"wsEndpoint"`
+	// ICEServers of the worker, the stream uses the ones sent when it starts. Empty on relays
+	ICEServers []pwebrtc.ICEServer `json:"iceServers"`
+	Features   Features            `json:"features"`
+	// Flags are the feature flags evaluated for the user, sessions get theirs with the FEATURES packet
+	Flags map[string]bool `json:"flags"`
+	// Apps are the catalog apps the user can see
+	Apps            []AppEntry `json:"apps"`
+	ProtocolVersion int        `json:"protocolVersion"`
+	// Encodings of websocket packets, negotiated as subprotocols
+	Encodings []string `json:"encodings"`
+}
+
+// Features are the parts of the pages enabled by the config
+type Features struct {
+	Chat  bool `json:"chat"`
+	Lobby bool `json:"lobby"`
+	Kiosk bool `json:"kiosk"`
+	Relay bool `json:"relay"`
+	// Stats is the stats feed of the debug HUD
+	Stats bool `json:"stats"`
+	// Guests join without an account for a limited session
+	Guests bool `json:"guests"`
+}
+
+// NewRuntimeConfig returns the runtime config of the pages of the config, without the worker parts
+func NewRuntimeConfig(cfg config.Config) RuntimeConfig {
+	return RuntimeConfig{
+		BasePath:   cfg.BasePath(),
+		WSEndpoint: "/ws",
+		Features: Features{
+			Chat:   cfg.HasChat,
+			Lobby:  cfg.Chat.Lobby,
+			Kiosk:  cfg.Kiosk.Enabled,
+			Relay:  cfg.Relay,
+			Stats:  !cfg.DisableStats,
+			Guests: cfg.Guests.Enabled,
+		},
+		Apps:            []AppEntry{},
+		ProtocolVersion: ProtocolVersion,
+		Encodings:       cws.Subprotocols,
+	}
+}
+
+// RuntimeConfig returns the runtime config of the pages for the user of the request
+func (s *Server) RuntimeConfig(r *http.Request) RuntimeConfig {
+	c := s.runtime
+	if s.capp != nil {
+		c.ICEServers = s.capp.webrtcConf.Configuration.ICEServers
+	}
+	userID, audience, _ := s.user(r)
+	c.Apps = s.listApps(audience, catalog.Query{}, false)
+	if userID != "" {
+		c.Flags = s.features.forClient(userID, audience.Roles)
+	}
+	return c
+}
+
+func (s *Server) handleRuntimeConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.RuntimeConfig(r))
+}
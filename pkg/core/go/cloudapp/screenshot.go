@@ -0,0 +1,140 @@
+package cloudapp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/gorilla/mux"
+)
+
+// thumbnailWidth of the cached lobby previews, the height keeps the aspect ratio
+const thumbnailWidth = 320
+
+var errScreenshotUnsupported = errors.New("screenshots are only supported in the Linux app VM")
+
+// Screenshot grabs the current screen of the app VM as JPEG, scaled to the width or full size for 0
+func (c *ccImpl) Screenshot(width int) ([]byte, error) {
+	if c.osType == Windows {
+		return nil, errScreenshotUnsupported
+	}
+	args := []string{"exec", c.vm.name(), "ffmpeg", "-loglevel", "error",
+		"-f", "x11grab", "-draw_mouse", "0",
+		"-video_size", fmt.Sprintf("%dx%d", int(c.screenWidth), int(c.screenHeight)), "-i", c.vm.display(),
+		"-frames:v", "1"}
+	if width > 0 {
+		args = append(args, "-vf", "scale="+strconv.Itoa(width)+":-2")
+	}
+	args = append(args, "-f", "image2", "-c:v", "mjpeg", "-")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// thumbnails caches a periodic preview of the running app for the lobby
+type thumbnails struct {
+	mu    sync.RWMutex
+	img   []byte
+	taken time.Time
+}
+
+func (t *thumbnails) get() ([]byte, time.Time) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.img, t.taken
+}
+
+// run refreshes the thumbnail with the interval until the process exits
+func (t *thumbnails) run(app CloudAppClient, interval time.Duration) {
+	for {
+		img, err := app.Screenshot(thumbnailWidth)
+		if err == errScreenshotUnsupported {
+			return
+		}
+		if err != nil {
+			log.Println("Failed to take thumbnail:", err)
+		} else {
+			t.mu.Lock()
+			t.img, t.taken = img, time.Now()
+			t.mu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handleScreenshot takes a live frame of the app on demand
+func (s *Server) handleScreenshot(w http.ResponseWriter, r *http.Request) {
+	if mux.Vars(r)["name"] != s.appMeta.AppName {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.checkFrames(w, r, true) {
+		return
+	}
+	width, _ := strconv.Atoi(r.URL.Query().Get("width"))
+	img, err := s.capp.ccApp.Screenshot(width)
+	if err == errScreenshotUnsupported {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to take screenshot:", err)
+		http.Error(w, "failed to take screenshot", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(img)
+}
+
+// handleThumbnail serves the periodic cached preview to the lobby, it never takes a frame on demand
+func (s *Server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	img, taken := s.thumbnails.get()
+	if mux.Vars(r)["name"] != s.appMeta.AppName || img == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.checkFrames(w, r, false) {
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(s.thumbnailInterval.Seconds())))
+	http.ServeContent(w, r, "", taken, bytes.NewReader(img))
+}
+
+// routeScreenshot saves full size screenshots for the player. They're sent over the bulk channel of its peer,
+// so they don't starve the video, and the player gets SCREENSHOT_FAILED when there is no channel or frame
+func (s *Server) routeScreenshot(client *cws.Client, c *Client) {
+	client.Receive("SCREENSHOT", func(req cws.WSPacket) cws.WSPacket {
+		rtcConn := c.rtcConn
+		if rtcConn == nil || rtcConn.Bulk() == nil {
+			return cws.WSPacket{Type: "SCREENSHOT_FAILED", Data: s.text(client, "screenshots need the data channel")}
+		}
+		crash.Go("screenshot", func() {
+			img, err := c.app.Screenshot(0)
+			if err == nil {
+				name := fmt.Sprintf("%s-%s.jpg", s.appMeta.AppName, time.Now().Format("20060102-150405"))
+				err = rtcConn.Bulk().SendFile(name, "image/jpeg", img)
+			}
+			if err != nil {
+				log.Println("Screenshot failed:", err)
+				client.Send(cws.WSPacket{Type: "SCREENSHOT_FAILED", Data: s.text(client, "failed to take screenshot")}, nil)
+			}
+		}, "client", c.clientID)
+		return cws.EmptyPacket
+	})
+}
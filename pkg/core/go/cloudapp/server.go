@@ -4,18 +4,29 @@ package cloudapp
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
-	"text/template"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
 	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/i18n"
+	"github.com/giongto35/cloud-morph/pkg/common/listener"
+	"github.com/giongto35/cloud-morph/pkg/common/mtls"
+	"github.com/giongto35/cloud-morph/pkg/common/proxy"
+	"github.com/giongto35/cloud-morph/pkg/common/store"
+	"github.com/giongto35/cloud-morph/pkg/common/token"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{}
+var upgrader = websocket.Upgrader{Subprotocols: cws.Subprotocols}
 
 type initData struct {
 	CurAppID string `json:"cur_app_id"`
@@ -24,14 +35,59 @@ type initData struct {
 }
 
 const embedPage string = "web/embed/embed.html"
-const addr string = ":8080"
+
+const catalogWatchInterval = 2 * time.Second
 
 type Server struct {
-	appID      string
-	httpServer *http.Server
-	wsClients  map[string]*cws.Client
-	capp       *Service
-	appMeta    config.AppDiscoveryMeta
+	appID             string
+	httpServer        *http.Server
+	wsClients         map[string]*cws.Client
+	capp              *Service
+	appMeta           config.AppDiscoveryMeta
+	tls               config.TLSConfig
+	drainer           *drainer
+	migrator          *migrator
+	admission         *admission
+	catalog           *catalog.Catalog
+	appLoad           func() (map[string]AppLoad, error)
+	store             *store.Store
+	reservations      *reservations
+	publicURL         string
+	shares            *shares
+	viewers           *viewerPolicy
+	duplicates        *duplicates
+	regions           *regions
+	clips             *clips
+	recorder          *inputRecorder
+	replayer          *inputReplayer
+	assist            assist
+	signer            *token.Signer
+	apiTokens         *apiTokens
+	content           catalog.ContentControls
+	thumbnails        *thumbnails
+	thumbnailInterval time.Duration
+	adminToken        string
+	kiosk             config.KioskConfig
+	resets            *resetter
+	wsCompression     config.WSCompressionConfig
+	basePath          string
+	runtime           RuntimeConfig
+	messages          *i18n.Catalog
+	guests            *guests
+	overlay           *overlay
+	loadShed          *loadShedder
+	features          *features
+	bans              *bans
+	// preflights holds a slot per running pre-flight probe
+	preflights chan struct{}
+	// queue of the players waiting for control, nil when players share control
+	queue          *controlQueue
+	queueModerator string
+	// fleet calls other workers, with the fleet certificate when fleet TLS is on
+	fleet    *http.Client
+	fleetTLS bool
+	// rooms are the instances of the app besides capp, nil when rooms are disabled
+	rooms *rooms
 }
 
 func NewServer(cfg config.Config) *Server {
@@ -45,9 +101,76 @@ func NewServer(cfg config.Config) *Server {
 }
 
 func NewServerWithHTTPServerMux(cfg config.Config, r *mux.Router, svmux *http.ServeMux) *Server {
-	server := &Server{}
+	server := &Server{
+		drainer:    newDrainer(),
+		migrator:   newMigrator(),
+		adminToken: cfg.AdminToken,
+		publicURL:  cfg.PublicURL,
+		signer:     token.NewSigner(cfg.TokenSecret),
+		content:    cfg.ContentControls,
+		kiosk:      cfg.Kiosk,
+		resets:     newResetter(cfg.Reset, cfg.DataDir, cfg.AppName),
+
+		wsCompression: cfg.WSCompression,
+		basePath:      cfg.Proxy.BasePath,
+		runtime:       NewRuntimeConfig(cfg),
+		preflights:    make(chan struct{}, preflightProbes),
+		fleet:         http.DefaultClient,
+		fleetTLS:      cfg.FleetTLS.IsEnabled(),
+	}
+	if server.fleetTLS {
+		fleet, err := mtls.Client(cfg.FleetTLS, 0)
+		if err != nil {
+			log.Fatal("Cannot load the fleet certificate: ", err)
+		}
+		server.fleet = fleet
+	}
+	upgrader.EnableCompression = cfg.WSCompression.Enabled
+	messages, err := i18n.Load(cfg.Locales)
+	if err != nil {
+		log.Println("Messages are not translated:", err)
+	}
+	server.messages = messages
+	st, err := store.Open(filepath.Join(cfg.DataDir, "cloudapp.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.store = st
+	server.reservations = newReservations(st, cfg.Reservations, server.prewarm)
+	server.shares = newShares(server.signer, cfg.PublicURL)
+	server.viewers = newViewerPolicy(cfg.Viewers)
+	server.duplicates = newDuplicates(cfg.DuplicateSessions)
+	server.rooms = newRooms(cfg)
+	server.regions = newRegions(cfg.Regions)
+	server.apiTokens = newAPITokens(server.signer, st)
+	server.features = newFeatures(cfg.Features, st)
+	server.bans = newBans(st)
+	if cfg.Guests.Enabled {
+		server.guests = newGuests(cfg.Guests, server.signer)
+	}
+	server.catalog = catalog.New(cfg.AppsDir)
+	server.catalog.Watch(catalogWatchInterval)
+	server.watchCatalog()
+	server.admission = newAdmission(cfg.SessionLimits(), func() int {
+		return int(atomic.LoadInt32(&server.drainer.sessions))
+	}, func() int {
+		return server.reservations.held() + server.resets.held()
+	}, server.messages)
 
 	r.HandleFunc("/ws", server.WS)
+	r.HandleFunc("/mse", server.MSE)
+	r.HandleFunc("/webcodecs", server.WebCodecs)
+	r.HandleFunc("/config.json", server.handleRuntimeConfig).Methods(http.MethodGet)
+	r.HandleFunc("/api/apps", server.handleListApps).Methods(http.MethodGet)
+	r.HandleFunc("/api/bans/{id}/appeal", server.handleAppealBan).Methods(http.MethodPost)
+	r.HandleFunc("/api/preflight", server.handlePreflight).Methods(http.MethodGet)
+	r.HandleFunc("/api/preflight", server.handlePreflightProbe).Methods(http.MethodPost)
+	r.HandleFunc("/api/apps/{name}/icon", server.handleAppIcon).Methods(http.MethodGet)
+	r.HandleFunc("/api/apps/{name}/screenshot", server.handleScreenshot).Methods(http.MethodGet)
+	r.HandleFunc("/api/apps/{name}/thumbnail", server.handleThumbnail).Methods(http.MethodGet)
+	if cfg.Kiosk.Enabled {
+		r.HandleFunc("/kiosk", server.handleKiosk)
+	}
 	r.HandleFunc("/embed",
 		func(w http.ResponseWriter, r *http.Request) {
 			tmpl, err := template.ParseFiles(embedPage)
@@ -55,42 +178,86 @@ func NewServerWithHTTPServerMux(cfg config.Config, r *mux.Router, svmux *http.Se
 				log.Fatal(err)
 			}
 
-			tmpl.Execute(w, nil)
+			tmpl.Execute(w, server.RuntimeConfig(r))
 		},
 	)
 	fmt.Println("handler", r)
 
 	httpServer := &http.Server{
-		Addr:         addr,
+		Addr:         cfg.Addr,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		IdleTimeout:  120 * time.Second,
-		Handler:      svmux,
+		Handler:      proxy.Handler(cfg.Proxy, svmux),
+	}
+	TrackConns(httpServer)
+	if server.fleetTLS && cfg.TLS.IsEnabled() {
+		if httpServer.TLSConfig, err = mtls.VerifyIfGiven(cfg.FleetTLS); err != nil {
+			log.Fatal("Cannot load the fleet CA: ", err)
+		}
 	}
 	log.Println("Embedded server")
-	server.capp = NewCloudService(cfg)
+	// The overlay text is written before the encoder in the app VM starts
+	server.overlay = newOverlay(cfg.Overlay, cfg.Guests.Enabled && cfg.Guests.Watermark)
+	if server.capp, err = NewCloudService(cfg); err != nil {
+		log.Fatal("Cannot launch the app: ", err)
+	}
+	server.overlay.start(server.capp.ccApp)
+	if cfg.ControlQueue.Enabled {
+		server.queue = newControlQueue(cfg.ControlQueue, server.capp.snapshotClients)
+		server.queueModerator = cfg.ControlQueue.ModeratorRole
+	}
+	server.thumbnails = &thumbnails{}
+	server.thumbnailInterval = time.Duration(cfg.ThumbnailInterval) * time.Second
+	crash.Go("thumbnails", func() { server.thumbnails.run(server.capp.ccApp, server.thumbnailInterval) })
+	server.setupClips(r, cfg)
+	server.replayer = newInputReplayer(server.capp.appEvents)
+	if cfg.RecordInput {
+		server.recorder = newInputRecorder(filepath.Join(cfg.DataDir, "recordings"), cfg.AppName)
+		server.capp.events.Subscribe(TopicInput, "input recorder", func(e interface{}) {
+			server.recorder.record(e.(Packet))
+		})
+	}
+	server.registerAdminAPI(r, cfg.AdminToken)
+	if cfg.Idle.WarnAfter > 0 {
+		crash.Go("idle watch", func() { server.watchIdle(cfg.Idle) })
+	}
+	if cfg.LoadShed.Enabled {
+		if server.loadShed = newLoadShedder(cfg.LoadShed, cfg.Capacity, server.capp.ccApp); server.loadShed != nil {
+			crash.Go("load shedding", server.loadShed.run)
+		}
+	}
 	appMeta := config.AppDiscoveryMeta{
-		Addr:         cfg.InstanceAddr,
+		Addr:         cfg.InstanceAddr + cfg.Proxy.BasePath,
 		AppName:      cfg.AppName,
 		AppMode:      cfg.AppMode,
 		HasChat:      cfg.HasChat,
 		PageTitle:    cfg.PageTitle,
 		ScreenWidth:  cfg.ScreenWidth,
 		ScreenHeight: cfg.ScreenHeight,
+		MaxInstances: cfg.MaxInstances,
+		AgeRating:    cfg.AgeRating,
+		RequiredRole: cfg.RequiredRole,
 	}
 	server.httpServer = httpServer
 	server.appMeta = appMeta
+	server.tls = cfg.TLS
 
 	return server
 }
 
 func (o *Server) Handle() {
 	// Spawn CloudGaming Handle
-	go o.capp.Handle()
+	crash.Go("app input", o.capp.Handle)
 }
 
 func (s *Server) WS(w http.ResponseWriter, r *http.Request) {
-	log.Println("A user is connecting...")
+	log.Println("A user is connecting from", r.RemoteAddr)
+	// Admins attach to any session invisibly
+	admin := s.isAdmin(r)
+	if !admin && !s.checkRequest(w, r) {
+		return
+	}
 	// defer func() {
 	// 	if r := recover(); r != nil {
 	// 		log.Println("Warn: Something wrong. Recovered in ", r)
@@ -111,21 +278,140 @@ func (s *Server) WS(w http.ResponseWriter, r *http.Request) {
 
 	// Create websocket Client
 	wsClient := cws.NewClient(c)
+	if s.wsCompression.Enabled {
+		if err := wsClient.Compress(s.wsCompression.Threshold, s.wsCompression.Level); err != nil {
+			log.Println("Coordinator: [!] WS compression:", err)
+		}
+	}
+	s.negotiateLocale(wsClient, r)
+	negotiateSignaling(wsClient, r)
 	clientID := wsClient.GetID()
+	crash.Go("ws listen", wsClient.Listen, "client", clientID)
+	if admin {
+		s.wsAdmin(wsClient, r.RemoteAddr)
+		return
+	}
+	// Monitoring sessions listen to the app without video and input
+	audioOnly := r.URL.Query().Get("audio") == "only"
+	e, ok := s.admit(wsClient, r, audioOnly)
+	if !ok {
+		return
+	}
 	// TODO: Update packet
-	// Add websocket client to app service
-	serviceClient := s.capp.AddClient(clientID, wsClient)
+	// Add websocket client to app service. Viewers watch from the SFU when the worker publishes to one,
+	// otherwise the viewer policy degrades their streams as they pile up
+	var serviceClient *Client
+	if e.viewLink != "" && s.capp.sfu != nil {
+		serviceClient = s.capp.AddSFUViewer(clientID, wsClient)
+	} else if e.viewLink != "" {
+		serviceClient = s.viewers.join(s.capp, clientID, wsClient)
+	} else {
+		serviceClient = e.svc.AddClient(clientID, wsClient)
+	}
+	serviceClient.remoteIP = remoteIP(r.RemoteAddr)
+	serviceClient.region = s.regions.of(r, serviceClient.remoteIP)
+	s.routeResume(wsClient, serviceClient, r.URL.Query().Get("resume"))
+	// Features roll out by user, anonymous sessions by client
+	featureKey, featureRoles := e.userID, e.audience.Roles
+	if featureKey == "" {
+		featureKey = clientID
+	}
+	if e.guest != nil {
+		featureRoles = []string{roleGuest}
+	}
+	enabled := s.features.forClient(featureKey, featureRoles)
+	serviceClient.setFeatures(enabled)
+	wsClient.Send(featuresPacket(enabled), nil)
+	if audioOnly {
+		if !enabled[config.FeatureAudio] {
+			log.Println("Audio-only session of", clientID, "has no audio, the audio feature is off")
+		}
+		serviceClient.SetAudioOnly()
+		wsClient.Send(cws.WSPacket{Type: "VIEW_ONLY"}, nil)
+	} else if e.viewLink != "" || e.spectating {
+		serviceClient.SetViewOnly(true)
+		wsClient.Send(cws.WSPacket{Type: "VIEW_ONLY"}, nil)
+	} else if e.room != "" {
+		// Rooms are played by their players alone, the tools of the default instance don't reach them
+		s.routeScreenshot(wsClient, serviceClient)
+		if macros := e.svc.Macros(); len(macros) > 0 {
+			data, _ := json.Marshal(macros)
+			wsClient.Send(cws.WSPacket{Type: "MACROS", Data: string(data)}, nil)
+		}
+	} else {
+		s.routeRefocus(wsClient)
+		if s.assist.active() {
+			serviceClient.Suspend(true)
+			wsClient.Send(cws.WSPacket{Type: "ASSIST", Data: "on"}, nil)
+		}
+		if s.kiosk.Enabled {
+			// Visitors of a kiosk can't share the session or change what's streamed
+			wsClient.Send(cws.WSPacket{Type: "KIOSK"}, nil)
+		} else {
+			s.routeShare(wsClient)
+			s.routeClip(wsClient)
+			s.routeScreenshot(wsClient, serviceClient)
+			s.routeWindows(wsClient)
+			if capture := s.capp.windows.get(); capture.Target != config.CaptureScreen {
+				wsClient.Send(capturePacket(capture), nil)
+			}
+		}
+		if macros := s.capp.Macros(); len(macros) > 0 {
+			data, _ := json.Marshal(macros)
+			wsClient.Send(cws.WSPacket{Type: "MACROS", Data: string(data)}, nil)
+		}
+	}
+	s.routePrefs(wsClient, serviceClient, e.userID)
+	if s.queue != nil && e.room == "" {
+		if e.player {
+			name := e.userName
+			if name == "" {
+				name = "Player " + clientID[:4]
+			}
+			s.routeControlQueue(wsClient, serviceClient, name, e.audience.Roles)
+		} else {
+			wsClient.Send(queuePacket(s.queue.view(clientID)), nil)
+		}
+	}
+	if e.guest != nil {
+		s.startGuest(wsClient, serviceClient, *e.guest)
+		if e.room == "" {
+			s.overlay.join(clientID, roleGuest, []string{roleGuest})
+		}
+	} else if e.player && e.room == "" {
+		s.overlay.join(clientID, e.userName, e.audience.Roles)
+	}
 	serviceClient.Route()
+	s.drainer.sessionStarted()
+	// The session counts itself from now on
+	if e.admitted != nil {
+		e.admitted()
+	}
 	log.Println("Initialized ServiceClient")
 
 	s.initClientData(wsClient)
-	go func(browserClient *cws.Client) {
-		browserClient.Listen()
+	if motd := s.capp.announcer.MOTD(); motd != nil {
+		wsClient.Send(announcePacket(*motd), nil)
+	}
+	crash.Go("session end", func() {
+		<-wsClient.Done
 		log.Println("Closing connection")
-		browserClient.Close()
-		s.capp.RemoveClient(clientID)
+		wsClient.Close()
+		e.svc.RemoveClient(clientID)
+		s.viewers.leave(clientID)
+		if s.queue != nil {
+			s.queue.leave(clientID)
+		}
+		s.overlay.leave(clientID)
+		s.sessionEnded()
+		s.leave(e, wsClient)
 		log.Println("Closed connection")
-	}(wsClient)
+	}, "client", clientID)
+}
+
+// Capacity returns the resource usage and sessions of the worker for heartbeats
+func (s *Server) Capacity() capacity.Report {
+	return s.admission.Report()
 }
 
 func (s *Server) initClientData(client *cws.Client) {
@@ -145,8 +431,15 @@ func (s *Server) initClientData(client *cws.Client) {
 }
 
 func (o *Server) ListenAndServe() error {
-	log.Println("Server is running at", addr)
-	return o.httpServer.ListenAndServe()
+	ln, err := listener.Listen(o.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Server is running at", o.httpServer.Addr)
+	if o.tls.IsEnabled() {
+		return o.httpServer.ServeTLS(ln, o.tls.CertFile, o.tls.KeyFile)
+	}
+	return o.httpServer.Serve(ln)
 }
 
 func (o *Server) Shutdown() {
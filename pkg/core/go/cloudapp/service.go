@@ -3,13 +3,21 @@ package cloudapp
 import (
 	"encoding/json"
 	"log"
+	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/analytics"
+	"github.com/giongto35/cloud-morph/pkg/common/bus"
+	"github.com/giongto35/cloud-morph/pkg/common/chaos"
 	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/secret"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
 	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
-	"github.com/pion/rtp"
+	pwebrtc "github.com/pion/webrtc/v3"
 )
 
 const (
@@ -19,30 +27,102 @@ const (
 	OnDemandMode = "ondemand"
 )
 
+// clientVideoQueueSize bounds the packets queued for a client, a few frames of the stream.
+// A client further behind skips to the next keyframe
+const clientVideoQueueSize = 100
+
 type Service struct {
 	clients        map[string]*Client
+	clientsLock    sync.RWMutex
 	appModeHandler *appModeHandler
 	ccApp          CloudAppClient
 	config         config.Config
 	// chat           *textchat.TextChat Not using own chat
 	// communicate with cloud app
-	appEvents  chan Packet
+	appEvents  *inputQueue
 	webrtcConf *webrtc.Config
+	// frames is the frame-level fanout for non-RTP transports
+	frames    *media.FrameHub
+	assembler *media.FrameAssembler
+	// events is the event bus of the instance
+	events    *bus.Bus
+	announcer *announcer
+	stats     *serverStats
+	macros    *macroRunner
+	windows   *windowCapture
+	focus     *focusManager
+	codecs    *codecSwitch
+	// signalingDir is where the signaling of sessions is recorded, empty when it isn't
+	signalingDir string
+	// sfu publishes the stream to the SFU of viewers, nil without one
+	sfu *sfuPublisher
+	// parked are the peer connections of pages reconnecting their websocket
+	parked *parkedPeers
 }
 
 type Client struct {
-	clientID    string
-	ws          *cws.Client
-	rtcConn     *webrtc.WebRTC
-	videoStream chan *rtp.Packet
-	audioStream chan *rtp.Packet
-	appEvents   chan Packet
+	clientID string
+	ws       *cws.Client
+	rtcConn  *webrtc.WebRTC
+	// video is the bounded queue of the client in the fanout, it skips to the next keyframe when the client falls behind
+	video       *media.PacketQueue
+	audioStream chan *media.Packet
+	appEvents   *inputQueue
 	// videoTrack   *webrtc.Track
 	// cancel to trigger cleaning up when client is disconnected
 	cancel chan struct{}
 	// done to notify if the client is done clean up
 	done       chan struct{}
+	doneOnce   sync.Once
 	webrtcConf *webrtc.Config
+	joinedAt   time.Time
+	events     *bus.Bus
+	appName    string
+	app        CloudAppClient
+	stats      *serverStats
+	// input tracks held keys of the client. Viewers of a view link watch without input
+	input  *inputState
+	macros *macroRunner
+	// prefs of the PREFS packet, applied to the stream when it starts.
+	// They are saved for the user, none for anonymous users
+	prefsMu sync.Mutex
+	prefs   Prefs
+	userID  string
+	// samples of the link for diagnostics
+	samplesMu sync.Mutex
+	samples   []linkSample
+	// features enabled for the client by the feature flags, guarded by prefsMu
+	features map[string]bool
+	// remoteIP of the websocket, bans of a live session cover it for anonymous users
+	remoteIP net.IP
+	// region of the client, its input RTT is aggregated by region
+	region string
+	// signaling records the negotiation of the session, nil unless it's recorded
+	signaling *signalingLog
+	// onError records failures of the signaling, nil unless it's recorded
+	onError func(errorType string, err error)
+	// rtpLink and wsLink impair the outgoing stream and websocket for tests, nil unless chaos is enabled
+	rtpLink *chaos.Link
+	wsLink  *chaos.Link
+	// ice are the ICE credentials of the stream, the ones of the last session when the page resumes it.
+	// Guarded by prefsMu
+	ice webrtc.ICECredentials
+	// onICE hands the credentials of a new stream to the page to resume it after a refresh
+	onICE func(webrtc.ICECredentials)
+	// adopt takes the parked peer connection of the ICE username fragment over, nil when there is none
+	adopt func(ufrag string) *webrtc.WebRTC
+	// videoCodec returns the codec of the stream for the video codecs the browser decodes
+	videoCodec func(codecs []string) string
+	// audioOnly clients listen to the app without the video track, e.g. monitoring bots
+	audioOnly bool
+	// relay returns the ICE servers of the media relay for a client which can't reach the worker directly,
+	// nil without a media relay
+	relay func() (string, error)
+	// noPeer clients watch without a peer connection of the worker, from the SFU or the MSE stream.
+	// The fanout skips them
+	noPeer bool
+	// thinned spectators get a thinned stream as the audience grows, guarded by prefsMu
+	thinned bool
 }
 
 type AppHost struct {
@@ -83,34 +163,130 @@ func (c *Client) Heartbeat() {
 }
 
 func (s *Service) AddClient(clientID string, ws *cws.Client) *Client {
+	return s.addClient(clientID, ws, false)
+}
+
+// AddSFUViewer adds a viewer watching the stream from the SFU, it's sent where to join it
+func (s *Service) AddSFUViewer(clientID string, ws *cws.Client) *Client {
+	packet, err := s.sfu.sfuPacket(sfuIdentity(clientID))
+	if err != nil {
+		log.Println("Cannot sign the SFU token, the viewer connects to the worker:", err)
+		return s.addClient(clientID, ws, false)
+	}
+	client := s.addClient(clientID, ws, true)
+	ws.Send(packet, nil)
+	return client
+}
+
+// AddStreamViewer adds a viewer watching the MSE stream, the worker keeps no peer connection for it
+func (s *Service) AddStreamViewer(clientID string, ws *cws.Client) *Client {
+	client := s.addClient(clientID, ws, true)
+	ws.Send(cws.WSPacket{Type: "STREAM_FALLBACK"}, nil)
+	return client
+}
+
+func (s *Service) addClient(clientID string, ws *cws.Client, noPeer bool) *Client {
+	// The signaling is recorded from the first packet on
+	var signaling *signalingLog
+	if s.signalingDir != "" {
+		signaling = newSignalingLog(s.signalingDir, clientID)
+		ws.SetTap(signaling.tap)
+	}
 	client := NewServiceClient(clientID, ws, s.appEvents, s.webrtcConf)
+	if signaling != nil {
+		client.signaling = signaling
+		client.onError = func(errorType string, err error) { signaling.record(signalingError, errorType, err.Error()) }
+	}
+	client.noPeer = noPeer
+	client.events = s.events
+	client.appName = s.config.AppName
+	client.app = s.ccApp
+	client.stats = s.stats
+	client.macros = s.macros
+	client.videoCodec = func(codecs []string) string { return s.codecs.join(clientID, codecs) }
+	client.adopt = s.parked.take
+	if s.config.Chaos {
+		client.rtpLink, client.wsLink = chaos.NewLink(false), chaos.NewLink(true)
+		ws.SetChaos(client.wsLink)
+	}
+	if s.config.MediaRelay.IsEnabled() {
+		client.relay = func() (string, error) { return relayServers(s.config.MediaRelay, s.config.TokenSecret, clientID) }
+	}
+	s.clientsLock.Lock()
 	s.clients[clientID] = client
+	s.clientsLock.Unlock()
+	s.events.Publish(TopicSession, analytics.Event{
+		Type:     analytics.EventJoin,
+		ClientID: clientID,
+		AppName:  s.config.AppName,
+		Codec:    s.codecs.mimeType(),
+	})
 	return client
 }
 
 func (s *Service) RemoveClient(clientID string) {
+	s.clientsLock.RLock()
 	client := s.clients[clientID]
+	s.clientsLock.RUnlock()
 	close(client.cancel)
-	<-client.done
+	if client.noPeer {
+		// The fanout skips clients without a peer connection, there is no stream to wait for
+		s.clientsLock.Lock()
+		delete(s.clients, clientID)
+		s.clientsLock.Unlock()
+	} else {
+		<-client.done
+	}
+	leave := analytics.Event{
+		Type:     analytics.EventLeave,
+		ClientID: clientID,
+		AppName:  s.config.AppName,
+		Codec:    s.codecs.mimeType(),
+		Duration: time.Since(client.joinedAt).Seconds(),
+		Region:   client.region,
+	}
 	if client.rtcConn != nil {
-		client.rtcConn.StopClient()
+		if leave.Duration > 0 {
+			leave.AvgBitrate = int64(float64(client.rtcConn.BytesSent()*8) / leave.Duration / 1000)
+		}
+		// The page may only have lost its websocket, it takes the stream over when it reconnects
+		client.prefsMu.Lock()
+		ufrag := client.ice.Ufrag
+		client.prefsMu.Unlock()
+		if client.onICE != nil && ufrag != "" && client.rtcConn.IsNegotiated() {
+			s.parked.park(ufrag, client.rtcConn)
+		} else {
+			client.rtcConn.StopClient()
+		}
 		client.rtcConn = nil
 	}
+	if client.signaling != nil {
+		client.signaling.close()
+	}
+	if client.rtpLink != nil {
+		client.rtpLink.Close()
+		client.wsLink.Close()
+	}
+	client.releaseInput()
+	s.codecs.leave(clientID)
+	s.events.Publish(TopicSession, leave)
 }
 
-func NewServiceClient(clientID string, ws *cws.Client, appEvents chan Packet, conf *webrtc.Config) *Client {
+func NewServiceClient(clientID string, ws *cws.Client, appEvents *inputQueue, conf *webrtc.Config) *Client {
 	// The 1st packet
-	ws.Send(cws.WSPacket{Type: "init", Data: conf.GetStun()}, nil)
+	ws.Send(cws.WSPacket{Type: "init", Data: conf.GetICEServers()}, nil)
 
 	return &Client{
 		appEvents:   appEvents,
 		clientID:    clientID,
 		ws:          ws,
-		videoStream: make(chan *rtp.Packet, 100),
-		audioStream: make(chan *rtp.Packet, 100),
+		video:       media.NewPacketQueue(clientVideoQueueSize),
+		audioStream: make(chan *media.Packet, 100),
 		cancel:      make(chan struct{}),
 		done:        make(chan struct{}),
 		webrtcConf:  conf,
+		joinedAt:    time.Now(),
+		input:       newInputState(),
 	}
 }
 
@@ -122,10 +298,11 @@ func (c *Client) Handle() {
 	}()
 
 	wg := sync.WaitGroup{}
+	crash.Go("client quality", func() { c.watchQuality(c.rtcConn) }, "client", c.clientID)
 
 	// Video Stream
 	wg.Add(1)
-	go func() {
+	crash.Go("client video", func() {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Println("Recovered. Maybe we :sent to Closed Channel", r)
@@ -134,20 +311,25 @@ func (c *Client) Handle() {
 		}()
 
 	loop:
-		for packet := range c.videoStream {
+		for packet := range c.video.C {
+			if c.audioOnly {
+				packet.Release()
+				continue
+			}
 			select {
 			case <-c.cancel:
+				packet.Release()
 				break loop
 			case c.rtcConn.ImageChannel <- packet:
 			}
 		}
 		wg.Done()
 		log.Println("Closed Service Video Channel")
-	}()
+	}, "client", c.clientID)
 
 	// Audio Stream
 	wg.Add(1)
-	go func() {
+	crash.Go("client audio", func() {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Println("Recovered. Maybe we :sent to Closed Channel", r)
@@ -159,31 +341,116 @@ func (c *Client) Handle() {
 		for packet := range c.audioStream {
 			select {
 			case <-c.cancel:
+				packet.Release()
 				break loop
 			case c.rtcConn.AudioChannel <- packet:
 			}
 		}
 		wg.Done()
 		log.Println("Closed Service Audio Channel")
-	}()
+	}, "client", c.clientID)
 
-	// Input stream is closed after StopClient . TODO: check if can close earlier
-	// wg.Add(1)
-	go func() {
+	// Input stream is closed after StopClient, or handed over to the next session of the page
+	inputs := c.rtcConn.InputChannel
+	crash.Go("client input", func() {
 		// Data channel input
-		for rawInput := range c.rtcConn.InputChannel {
-			// TODO: No dynamic allocation
-			wspacket := cws.WSPacket{}
-			err := json.Unmarshal(rawInput, &wspacket)
-			if err != nil {
-				log.Println(err)
+		for {
+			select {
+			case <-c.cancel:
+				return
+			case rawInput, ok := <-inputs:
+				if !ok {
+					return
+				}
+				c.handleInput(rawInput)
 			}
-			c.appEvents <- convertWSPacket(wspacket)
 		}
-		// wg.Done()
-	}()
+	}, "client", c.clientID)
 	wg.Wait()
-	close(c.done)
+	// The stream of a client reconnecting over the media relay is handled again
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// handleInput forwards an input packet of the DataChannel or the websocket to the app
+func (c *Client) handleInput(rawInput []byte) {
+	// TODO: No dynamic allocation
+	wspacket := cws.WSPacket{}
+	err := json.Unmarshal(rawInput, &wspacket)
+	if err != nil {
+		log.Println(err)
+	}
+	if wspacket.Type == eventBlur {
+		c.releaseInput()
+		return
+	}
+	packet := convertWSPacket(wspacket)
+	if !c.input.accept(packet) {
+		return
+	}
+	if packet.Type == eventMacro {
+		if err := c.macros.run(c.clientID, packet.Data); err != nil {
+			log.Println("Cannot run macro:", err)
+		}
+		return
+	}
+	c.appEvents.Push(packet)
+}
+
+// releaseInput sends up events of the keys and buttons the client holds
+func (c *Client) releaseInput() {
+	for _, packet := range c.input.release() {
+		c.appEvents.Push(packet)
+	}
+}
+
+// SetViewOnly hands control of the client over. Keys it holds are released when it loses control
+// SetAudioOnly makes the client a listener without video and input, it's set before the stream starts
+func (c *Client) SetAudioOnly() {
+	c.audioOnly = true
+	c.SetViewOnly(true)
+}
+
+func (c *Client) SetViewOnly(viewOnly bool) {
+	for _, packet := range c.input.setViewOnly(viewOnly) {
+		c.appEvents.Push(packet)
+	}
+}
+
+// setThinned thins the stream of a spectator, streams started later are thinned too
+func (c *Client) setThinned(thinned bool) {
+	c.prefsMu.Lock()
+	defer c.prefsMu.Unlock()
+	c.thinned = thinned
+	if c.rtcConn != nil {
+		c.rtcConn.SetThinned(thinned)
+	}
+}
+
+// Suspend takes input away from the client while an admin has control
+func (c *Client) Suspend(suspended bool) {
+	for _, packet := range c.input.suspend(suspended) {
+		c.appEvents.Push(packet)
+	}
+}
+
+// Wait takes input away from the client until its turn in the control queue, or gives it the turn
+func (c *Client) Wait(waiting bool) {
+	for _, packet := range c.input.wait(waiting) {
+		c.appEvents.Push(packet)
+	}
+}
+
+func (c *Client) emitError(errorType string, err error) {
+	if c.onError != nil {
+		c.onError(errorType, err)
+	}
+	c.events.Publish(TopicSession, analytics.Event{
+		Type:      analytics.EventError,
+		ClientID:  c.clientID,
+		AppName:   c.appName,
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
 }
 
 func (c *Client) Route() {
@@ -191,8 +458,49 @@ func (c *Client) Route() {
 	// WebRTC
 	c.ws.Receive("initwebrtc", func(req cws.WSPacket) (resp cws.WSPacket) {
 		log.Println("Received a request to createOffer from browser", req)
+		if c.noPeer {
+			return cws.EmptyPacket
+		}
+		// The connection which failed is replaced, e.g. by one over the media relay
+		if c.rtcConn != nil {
+			c.rtcConn.StopClient()
+		}
+		// so is the one of the last session the page didn't take over
+		c.prefsMu.Lock()
+		ufrag := c.ice.Ufrag
+		c.prefsMu.Unlock()
+		if ufrag != "" && c.adopt != nil {
+			if parked := c.adopt(ufrag); parked != nil {
+				parked.StopClient()
+			}
+		}
 
-		c.rtcConn = webrtc.NewWebRTC()
+		rtcConn := webrtc.NewWebRTC()
+		rtcConn.AudioOnly = c.audioOnly
+		if c.videoCodec != nil && !c.audioOnly {
+			rtcConn.VideoCodec = c.videoCodec(parseCodecs(req.Data))
+		}
+		c.prefsMu.Lock()
+		rtcConn.Muted = (c.prefs.Mute && !c.audioOnly) || !c.features[config.FeatureAudio]
+		rtcConn.NoInputChannel = !c.features[config.FeatureDataChannelInput]
+		rtcConn.SetPreferSmoothness(c.prefs.Prefer == PreferSmoothness)
+		if !c.ice.Valid() {
+			c.ice = webrtc.NewICECredentials()
+		}
+		rtcConn.ICE = c.ice
+		rtcConn.Chaos = c.rtpLink
+		rtcConn.Compression = c.ws.Compression()
+		rtcConn.SetThinned(c.thinned)
+		c.rtcConn = rtcConn
+		c.prefsMu.Unlock()
+		// A new viewer needs a keyframe to show a picture
+		c.rtcConn.OnStreamStart = c.app.RampUp
+		c.rtcConn.OnKeyframeRequest = c.app.ForceKeyframe
+		c.rtcConn.VideoClock, c.rtcConn.AudioClock = c.app.Clocks()
+		c.rtcConn.OnStats = c.stats.fill
+		c.rtcConn.OnOffer = func(offer string) {
+			c.ws.Send(cws.WSPacket{Type: "offer", Data: offer}, nil)
+		}
 
 		localSession, err := c.rtcConn.StartClient(
 			func(candidate string) {
@@ -204,8 +512,12 @@ func (c *Client) Route() {
 
 		if err != nil {
 			log.Println("Error: Cannot create new webrtc session", err)
+			c.emitError("webrtc_init", err)
 			return cws.EmptyPacket
 		}
+		if c.onICE != nil {
+			c.onICE(rtcConn.ICE)
+		}
 
 		return cws.WSPacket{Type: "offer", Data: localSession}
 	})
@@ -214,12 +526,112 @@ func (c *Client) Route() {
 		"answer",
 		func(resp cws.WSPacket) (req cws.WSPacket) {
 			log.Println("Received answer SDP from browser", resp)
+			// later answers are of renegotiation, the session is running
+			renegotiation := c.rtcConn.IsNegotiated()
 			err := c.rtcConn.SetRemoteSDP(resp.Data)
 			if err != nil {
 				log.Println("Error: Cannot set RemoteSDP of client: " + resp.SessionID)
+				c.emitError("remote_sdp", err)
+			}
+
+			if !renegotiation {
+				crash.Go("client stream", c.Handle, "client", c.clientID)
+			}
+			return cws.EmptyPacket
+		},
+	)
+
+	// The page kept its peer connection while its websocket reconnected, it takes the stream over
+	// and restarts ICE with a reoffer
+	c.ws.Receive("resumestream", func(req cws.WSPacket) cws.WSPacket {
+		if c.noPeer || c.adopt == nil || c.rtcConn != nil {
+			return cws.WSPacket{Type: "RESUME_FAILED"}
+		}
+		c.prefsMu.Lock()
+		ufrag := c.ice.Ufrag
+		c.prefsMu.Unlock()
+		rtcConn := c.adopt(ufrag)
+		if ufrag == "" || rtcConn == nil {
+			return cws.WSPacket{Type: "RESUME_FAILED"}
+		}
+		if c.videoCodec != nil && !c.audioOnly {
+			if err := rtcConn.SetVideoCodec(c.videoCodec(parseCodecs(req.Data))); err != nil {
+				log.Println("Error: Cannot switch the codec of the resumed stream:", err)
+			}
+		}
+		c.prefsMu.Lock()
+		rtcConn.SetPreferSmoothness(c.prefs.Prefer == PreferSmoothness)
+		rtcConn.SetThinned(c.thinned)
+		c.rtcConn = rtcConn
+		c.prefsMu.Unlock()
+		rtcConn.SetSignaling(
+			func(candidate string) {
+				c.ws.Send(cws.WSPacket{Type: "candidate", Data: candidate, SessionID: req.SessionID}, nil)
+			},
+			func(offer string) {
+				c.ws.Send(cws.WSPacket{Type: "offer", Data: offer}, nil)
+			},
+		)
+		crash.Go("client stream", c.Handle, "client", c.clientID)
+		c.app.ForceKeyframe()
+		if c.onICE != nil {
+			c.onICE(rtcConn.ICE)
+		}
+		log.Println("Client", c.clientID, "took the stream of its last session over")
+		return cws.WSPacket{Type: "RESUMED"}
+	})
+
+	c.ws.Receive("reoffer", func(req cws.WSPacket) cws.WSPacket {
+		if c.rtcConn == nil {
+			return cws.WSPacket{Type: "RESUME_FAILED"}
+		}
+		answer, err := c.rtcConn.Answer(req.Data)
+		if err != nil {
+			log.Println("Error: Cannot restart ICE of client:", err)
+			c.emitError("ice_restart", err)
+			return cws.WSPacket{Type: "RESUME_FAILED"}
+		}
+		return cws.WSPacket{Type: "reanswer", Data: answer}
+	})
+
+	// The browser couldn't reach the worker directly and reconnects over the media relay
+	c.ws.Receive(
+		"ICE_RELAY",
+		func(req cws.WSPacket) cws.WSPacket {
+			if c.relay == nil {
+				return cws.WSPacket{Type: "ICE_RELAY_FAILED"}
+			}
+			servers, err := c.relay()
+			if err != nil {
+				log.Println("Error: Cannot sign media relay credentials:", err)
+				return cws.WSPacket{Type: "ICE_RELAY_FAILED"}
 			}
+			log.Println("Client", c.clientID, "reconnects over the media relay")
+			return cws.WSPacket{Type: "ICE_RELAY", Data: servers}
+		},
+	)
 
-			go c.Handle()
+	c.ws.Receive(
+		"AUDIO",
+		func(req cws.WSPacket) cws.WSPacket {
+			if c.rtcConn == nil {
+				return cws.EmptyPacket
+			}
+			if err := c.rtcConn.SetAudio(req.Data == "on" && c.feature(config.FeatureAudio)); err != nil {
+				log.Println("Error: Cannot switch audio of client:", err)
+			}
+			return cws.EmptyPacket
+		},
+	)
+
+	// Input of clients without the input DataChannel
+	c.ws.Receive(
+		"INPUT",
+		func(req cws.WSPacket) cws.WSPacket {
+			if c.feature(config.FeatureDataChannelInput) {
+				return cws.EmptyPacket
+			}
+			c.handleInput([]byte(req.Data))
 			return cws.EmptyPacket
 		},
 	)
@@ -232,6 +644,7 @@ func (c *Client) Route() {
 			err := c.rtcConn.AddCandidate(resp.Data)
 			if err != nil {
 				log.Println("Error: Cannot add IceCandidate of client: " + resp.SessionID)
+				c.emitError("ice_candidate", err)
 			}
 
 			return cws.EmptyPacket
@@ -239,28 +652,180 @@ func (c *Client) Route() {
 	)
 }
 
-// NewCloudService returns a Cloud Service
-func NewCloudService(conf config.Config) *Service {
-	appEvents := make(chan Packet, 1)
+// NewCloudService returns a Cloud Service of the default instance of the app
+func NewCloudService(conf config.Config) (*Service, error) {
+	return newCloudService(conf, appVM{})
+}
+
+// newCloudService returns a Cloud Service running the app in the VM, rooms have one each
+func newCloudService(conf config.Config, vm appVM) (*Service, error) {
+	events := bus.New()
+	if pipeline := analytics.NewPipeline(conf.Analytics); pipeline != nil {
+		events.Subscribe(TopicSession, "analytics", func(e interface{}) {
+			pipeline.Emit(e.(analytics.Event))
+		})
+	}
+	appEvents := newInputQueue(inputQueueSize, events)
 
-	webrtcConf := &webrtc.DefaultConfig
-	webrtcConf.Override(
-		webrtc.Codec(conf.VideoCodec),
-		webrtc.DisableInterceptors(conf.DisableInterceptors),
-		webrtc.Nat1to1(conf.NAT1To1IP),
-		webrtc.StunServer(conf.StunTurn),
-	)
+	webrtcConf := newWebRTCConfig(conf)
+
+	// Apps still launch without secrets which can't be read, e.g. to show a login screen
+	secrets, err := secret.Resolve(conf.Secrets, conf.Vault)
+	if err != nil {
+		log.Println("Failed to resolve secrets:", err)
+	}
+	ccApp, err := NewCloudAppClient(conf, appEvents, secrets, vm)
+	if err != nil {
+		return nil, err
+	}
 
 	s := &Service{
 		clients:        map[string]*Client{},
 		appEvents:      appEvents,
 		appModeHandler: NewAppMode(conf.AppMode),
-		ccApp:          NewCloudAppClient(conf, appEvents),
+		ccApp:          ccApp,
 		config:         conf,
 		webrtcConf:     webrtcConf,
+		frames:         media.NewFrameHub(),
+		events:         events,
+		parked:         newParkedPeers(),
+	}
+	// Frame transports, e.g. the MSE fallback, go without frames of other codecs
+	if s.assembler, err = media.NewFrameAssembler(webrtcConf.VideoCodec); err != nil {
+		log.Println("No frames of", webrtcConf.VideoCodec, "for frame transports:", err)
+	}
+	s.stats = newServerStats(s.ccApp, conf.Capacity, conf.ScreenWidth, conf.ScreenHeight)
+	s.macros = newMacroRunner(conf.Macros, secrets, conf.ScreenWidth, conf.ScreenHeight, appEvents)
+	s.windows = newWindowCapture(s.ccApp, conf.WindowTitle, Region{Width: conf.ScreenWidth, Height: conf.ScreenHeight}, conf.Capture, func(c Capture) {
+		s.Broadcast(capturePacket(c))
+	})
+	crash.Go("window capture", func() { s.windows.start(conf.WindowCapture) })
+	if conf.HideDesktop {
+		crash.Go("hide desktop", func() { hideDesktop(s.ccApp, conf.WindowTitle) })
+	}
+	s.focus = newFocusManager(s.ccApp, conf.WindowTitle)
+	if conf.AutoRefocus {
+		crash.Go("window focus", s.focus.watch)
+	}
+	s.codecs = newCodecSwitch(conf, s.ccApp, s.peers)
+	if conf.RecordSignaling {
+		s.signalingDir = filepath.Join(conf.DataDir, "signaling")
+	}
+	// The SFU fans out the default instance, rooms stream to their players only
+	if conf.SFU.Enabled && vm.slot == 0 {
+		s.sfu = newSFUPublisher(conf.SFU, webrtcConf, s.ccApp)
+		crash.Go("sfu publisher", s.sfu.run)
+	}
+
+	return s, nil
+}
+
+// newWebRTCConfig returns the WebRTC config of the peer connections of clients
+func newWebRTCConfig(conf config.Config) *webrtc.Config {
+	webrtcConf := &webrtc.DefaultConfig
+	webrtcConf.Override(
+		webrtc.Codec(conf.VideoCodec),
+		webrtc.DisableInterceptors(conf.DisableInterceptors),
+		webrtc.DisableStats(conf.DisableStats),
+		webrtc.StartBitrate(conf.VideoBitrate),
+		webrtc.Nat1to1(conf.WebRTC.Nat1to1),
+		webrtc.PublicIP(conf.WebRTC.PublicIP),
+		webrtc.PortRange(conf.WebRTC.PortMin, conf.WebRTC.PortMax),
+		webrtc.UDPMux(conf.WebRTC.UDPMuxPort),
+		webrtc.TCPMux(conf.WebRTC.TCPMuxPort),
+		webrtc.StunServer(conf.StunTurn),
+		webrtc.ICEServers(toICEServers(conf.WebRTC.ICEServers)),
+		webrtc.ICETransportPolicy(conf.WebRTC.ICETransportPolicy),
+		webrtc.DTLSCert(dtlsCertFile(conf.WebRTC.DTLSCert)),
+		webrtc.ICETimeouts(
+			time.Duration(conf.WebRTC.ICEDisconnectedTimeout)*time.Second,
+			time.Duration(conf.WebRTC.ICEFailedTimeout)*time.Second,
+			time.Duration(conf.WebRTC.ICEKeepalive)*time.Millisecond,
+		),
+		webrtc.NackHistory(conf.WebRTC.NackHistory),
+		webrtc.FEC(conf.WebRTC.FEC.Enabled, conf.WebRTC.FEC.Percent),
+		webrtc.Audio(conf.Audio.Bitrate, conf.Audio.Channels, conf.Audio.DTX, conf.Audio.FEC),
+	)
+	// Load or generate the DTLS certificate at startup instead of on the first connection
+	webrtcConf.Certificate()
+	return webrtcConf
+}
+
+// peers returns the peer connections of the clients
+func (s *Service) peers() []*webrtc.WebRTC {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+	peers := make([]*webrtc.WebRTC, 0, len(s.clients))
+	for _, c := range s.clients {
+		if c.rtcConn != nil {
+			peers = append(peers, c.rtcConn)
+		}
+	}
+	return peers
+}
+
+// dtlsCertFile returns the certificate path, empty to generate a certificate per connection
+func dtlsCertFile(path string) string {
+	if path == "none" {
+		return ""
+	}
+	return path
+}
+
+func toICEServers(servers []config.ICEServer) []pwebrtc.ICEServer {
+	var ice []pwebrtc.ICEServer
+	for _, server := range servers {
+		ice = append(ice, pwebrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return ice
+}
+
+// snapshotClients returns current clients, so fanout doesn't hold the lock while sending
+func (s *Service) snapshotClients() []*Client {
+	s.clientsLock.RLock()
+	defer s.clientsLock.RUnlock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Broadcast sends a websocket packet to all clients
+func (s *Service) Broadcast(packet cws.WSPacket) {
+	for _, client := range s.snapshotClients() {
+		client.ws.Send(packet, nil)
 	}
+}
+
+// DisconnectAll closes websocket of all clients, their sessions are cleaned up as normal disconnection
+func (s *Service) DisconnectAll() {
+	for _, client := range s.snapshotClients() {
+		client.ws.Close()
+	}
+}
 
-	return s
+// SuspendInput takes input away from all clients except one, or gives it back
+func (s *Service) SuspendInput(exceptID string, suspended bool) {
+	for _, client := range s.snapshotClients() {
+		if client.clientID != exceptID {
+			client.Suspend(suspended)
+		}
+	}
+}
+
+// Macros returns the names of the macros clients can run
+func (s *Service) Macros() []string {
+	return s.macros.names()
+}
+
+// Frames returns the frame-level fanout of the video stream
+func (s *Service) Frames() *media.FrameHub {
+	return s.frames
 }
 
 func (s *Service) SendInput(packet Packet) {
@@ -268,43 +833,81 @@ func (s *Service) SendInput(packet Packet) {
 }
 
 func (s *Service) Handle() {
-	go func() {
+	crash.Go("video fanout", func() {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Println("Recovered when sent to closed Video Stream channel", r)
 			}
 		}()
 		for p := range s.ccApp.VideoStream() {
-			for id, client := range s.clients {
+			if s.assembler != nil {
+				if s.frames.HasSubscribers() {
+					if frame, ok := s.assembler.Push(&p.Packet); ok {
+						s.frames.Publish(frame)
+					}
+				} else {
+					s.assembler.Resync()
+				}
+			}
+			// every client holds a reference till the packet is written to its track
+			clients := s.snapshotClients()
+			if s.sfu != nil {
+				s.sfu.push(s.sfu.video, p)
+			}
+			p.Retain(len(clients))
+			mimeType := s.codecs.mimeType()
+			for _, client := range clients {
+				if client.noPeer {
+					p.Release()
+					continue
+				}
 				select {
 				case <-client.cancel:
 					log.Println("Closing Video Audio")
 					// stop producing for client
-					delete(s.clients, id)
+					s.clientsLock.Lock()
+					delete(s.clients, client.clientID)
+					s.clientsLock.Unlock()
 					close(client.audioStream)
-					close(client.videoStream)
-				case client.videoStream <- p:
+					client.video.Close()
+					p.Release()
+					continue
+				default:
+				}
+				if client.video.Push(p, mimeType) {
+					log.Println("Client", client.clientID, "falls behind the stream, skip to the next keyframe")
+					s.ccApp.ForceKeyframe()
 				}
 			}
+			p.Release()
 		}
-	}()
-	go func() {
+	})
+	crash.Go("audio fanout", func() {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Println("Recovered when sent to closed Video Stream channel", r)
 			}
 		}()
 		for p := range s.ccApp.AudioStream() {
-			for _, client := range s.clients {
+			clients := s.snapshotClients()
+			if s.sfu != nil {
+				s.sfu.push(s.sfu.audio, p)
+			}
+			p.Retain(len(clients))
+			for _, client := range clients {
+				if client.noPeer {
+					p.Release()
+					continue
+				}
+				// A client falling behind loses audio packets instead of holding up the others
 				select {
-				// case <-client.cancel:
-				// fmt.Println("Closing Audio")
-				// stop producing for client
-				// close(client.audioStream)
 				case client.audioStream <- p:
+				default:
+					p.Release()
 				}
 			}
+			p.Release()
 		}
-	}()
+	})
 	s.ccApp.Handle()
 }
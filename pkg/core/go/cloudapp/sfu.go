@@ -0,0 +1,258 @@
+package cloudapp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+const (
+	// sfuRetryInterval is the wait before the worker publishes again after the SFU dropped it
+	sfuRetryInterval = 5 * time.Second
+	// sfuGatherTimeout bounds ICE gathering of the offer, WHIP takes it with all candidates
+	sfuGatherTimeout = 5 * time.Second
+)
+
+var errSFUGather = errors.New("sfu: ICE gathering timed out")
+
+// sfuPublisher publishes the stream of the worker to the SFU over WHIP, one peer connection whatever the audience.
+// It's fed like a client, but never holds up the fanout: packets are dropped while it's behind
+type sfuPublisher struct {
+	cfg    config.SFUConfig
+	conf   *webrtc.Config
+	app    CloudAppClient
+	client *http.Client
+	video  chan *media.Packet
+	audio  chan *media.Packet
+}
+
+func newSFUPublisher(cfg config.SFUConfig, conf *webrtc.Config, app CloudAppClient) *sfuPublisher {
+	return &sfuPublisher{
+		cfg:    cfg,
+		conf:   conf,
+		app:    app,
+		client: &http.Client{Timeout: 10 * time.Second},
+		video:  make(chan *media.Packet, 100),
+		audio:  make(chan *media.Packet, 100),
+	}
+}
+
+// push hands the packet of the fanout to the publisher, dropping it when the publisher is behind
+func (p *sfuPublisher) push(packets chan *media.Packet, packet *media.Packet) {
+	packet.Retain(1)
+	select {
+	case packets <- packet:
+	default:
+		packet.Release()
+	}
+}
+
+// run publishes the stream, again whenever the connection to the SFU ends
+func (p *sfuPublisher) run() {
+	for {
+		if err := p.publish(); err != nil {
+			log.Println("Cannot publish to the SFU:", err)
+		}
+		time.Sleep(sfuRetryInterval)
+	}
+}
+
+// publish streams to the SFU until the connection ends
+func (p *sfuPublisher) publish() error {
+	rtcConn := webrtc.NewWebRTC()
+	rtcConn.NoInputChannel = true
+	rtcConn.OnStreamStart = p.app.RampUp
+	// Viewers joining the room ask for keyframes through the SFU
+	rtcConn.OnKeyframeRequest = p.app.ForceKeyframe
+	rtcConn.VideoClock, rtcConn.AudioClock = p.app.Clocks()
+	gathered := make(chan struct{})
+	var once sync.Once
+	if _, err := rtcConn.StartClient(func(candidate string) {
+		if candidate == "" {
+			once.Do(func() { close(gathered) })
+		}
+	}, p.conf); err != nil {
+		return err
+	}
+	defer rtcConn.StopClient()
+	select {
+	case <-gathered:
+	case <-time.After(sfuGatherTimeout):
+		return errSFUGather
+	}
+	offer, err := rtcConn.LocalSDP()
+	if err != nil {
+		return err
+	}
+	answer, resource, err := p.whip(offer)
+	if err != nil {
+		return err
+	}
+	defer p.unpublish(resource)
+	remote, err := webrtc.Encode(pwebrtc.SessionDescription{Type: pwebrtc.SDPTypeAnswer, SDP: answer})
+	if err != nil {
+		return err
+	}
+	if err := rtcConn.SetRemoteSDP(remote); err != nil {
+		return err
+	}
+	log.Println("Publishing to the SFU room", p.cfg.Room)
+	// Packets queued while the previous connection failed or this one was negotiated are stale
+	drainPackets(p.video)
+	drainPackets(p.audio)
+	// The forwarding ends when the connection stops, e.g. when ICE fails
+	var wg sync.WaitGroup
+	wg.Add(2)
+	crash.Go("sfu video", func() { defer wg.Done(); forwardPackets(rtcConn.Closed(), p.video, rtcConn.ImageChannel) })
+	crash.Go("sfu audio", func() { defer wg.Done(); forwardPackets(rtcConn.Closed(), p.audio, rtcConn.AudioChannel) })
+	wg.Wait()
+	return errors.New("sfu: connection ended")
+}
+
+// forwardPackets moves the packets to the channel of a connection until the connection is done
+func forwardPackets(done <-chan struct{}, from <-chan *media.Packet, to chan<- *media.Packet) {
+	var packet *media.Packet
+	defer func() {
+		// The connection closes its channels as it's done, a packet sent meanwhile is still ours
+		if r := recover(); r != nil && packet != nil {
+			packet.Release()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case packet = <-from:
+		}
+		select {
+		case <-done:
+			packet.Release()
+			return
+		case to <- packet:
+			packet = nil
+		}
+	}
+}
+
+// drainPackets releases the packets waiting in the channel
+func drainPackets(packets <-chan *media.Packet) {
+	for {
+		select {
+		case packet := <-packets:
+			packet.Release()
+		default:
+			return
+		}
+	}
+}
+
+// whip posts the offer to the WHIP endpoint, returning the answer and the URL of the session resource
+func (p *sfuPublisher) whip(offer string) (string, string, error) {
+	req, err := http.NewRequest(http.MethodPost, p.cfg.WHIPURL, bytes.NewBufferString(offer))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if p.cfg.WHIPToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.WHIPToken)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("sfu: WHIP %s %s", resp.Status, bytes.TrimSpace(body))
+	}
+	resource := ""
+	if location, err := resp.Location(); err == nil {
+		resource = location.String()
+	}
+	return string(body), resource, nil
+}
+
+// unpublish ends the WHIP session, the SFU notices the closed connection without it too
+func (p *sfuPublisher) unpublish(resource string) {
+	if resource == "" {
+		return
+	}
+	req, err := http.NewRequest(http.MethodDelete, resource, nil)
+	if err != nil {
+		return
+	}
+	if p.cfg.WHIPToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.WHIPToken)
+	}
+	if resp, err := p.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// viewerToken returns a LiveKit access token of the viewer, allowed to subscribe to the room and nothing else
+func (p *sfuPublisher) viewerToken(identity string) (string, error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.cfg.APIKey,
+		"sub": identity,
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Duration(p.cfg.TokenTTL) * time.Minute).Unix(),
+		"video": map[string]interface{}{
+			"room":           p.cfg.Room,
+			"roomJoin":       true,
+			"canPublish":     false,
+			"canPublishData": false,
+			"canSubscribe":   true,
+		},
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(p.cfg.APISecret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// sfuPacket tells a viewer to watch the stream in the room of the SFU instead of connecting to the worker
+func (p *sfuPublisher) sfuPacket(identity string) (cws.WSPacket, error) {
+	tok, err := p.viewerToken(identity)
+	if err != nil {
+		return cws.EmptyPacket, err
+	}
+	data, err := json.Marshal(map[string]string{
+		"url":    p.cfg.URL,
+		"token":  tok,
+		"script": p.cfg.ClientScript,
+	})
+	if err != nil {
+		return cws.EmptyPacket, err
+	}
+	return cws.WSPacket{Type: "SFU", Data: string(data)}, nil
+}
+
+// sfuIdentity is the identity of the viewer in the room, unique per session
+func sfuIdentity(clientID string) string {
+	return "viewer-" + clientID
+}
@@ -0,0 +1,195 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/token"
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+const tokenKindView = "view"
+
+const (
+	defaultShareTTL        = 2 * time.Hour
+	defaultShareMaxViewers = 10
+)
+
+var (
+	errShareRevoked = errors.New("view link is revoked")
+	errShareFull    = errors.New("view link reached its viewer limit")
+)
+
+// ShareLink grants view-only access to the session: video without input
+type ShareLink struct {
+	ID         string    `json:"id"`
+	CreatedBy  string    `json:"created_by"`
+	MaxViewers int       `json:"max_viewers"`
+	Viewers    int       `json:"viewers"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	URL        string    `json:"url"`
+}
+
+type viewClaims struct {
+	token.Claims
+	LinkID string `json:"lid"`
+}
+
+// shares keeps view links of the session and their connected viewers
+type shares struct {
+	signer    *token.Signer
+	publicURL string
+
+	mu      sync.Mutex
+	links   map[string]*ShareLink
+	viewers map[string]map[*cws.Client]struct{}
+}
+
+func newShares(signer *token.Signer, publicURL string) *shares {
+	return &shares{
+		signer:    signer,
+		publicURL: publicURL,
+		links:     map[string]*ShareLink{},
+		viewers:   map[string]map[*cws.Client]struct{}{},
+	}
+}
+
+func (sh *shares) create(createdBy string, maxViewers int, ttl time.Duration) (ShareLink, error) {
+	if maxViewers <= 0 {
+		maxViewers = defaultShareMaxViewers
+	}
+	if ttl <= 0 {
+		ttl = defaultShareTTL
+	}
+	link := ShareLink{
+		ID:         uuid.Must(uuid.NewV4()).String(),
+		CreatedBy:  createdBy,
+		MaxViewers: maxViewers,
+		ExpiresAt:  time.Now().Add(ttl),
+	}
+	tok, err := sh.signer.Sign(viewClaims{
+		Claims: token.Claims{Kind: tokenKindView, Exp: link.ExpiresAt.Unix()},
+		LinkID: link.ID,
+	})
+	if err != nil {
+		return link, err
+	}
+	link.URL = sh.publicURL + "/embed?view=" + tok
+
+	sh.mu.Lock()
+	sh.links[link.ID] = &link
+	sh.viewers[link.ID] = map[*cws.Client]struct{}{}
+	sh.mu.Unlock()
+	return link, nil
+}
+
+// join verifies the view token and counts the client as a viewer of its link
+func (sh *shares) join(tok string, client *cws.Client) (string, error) {
+	var claims viewClaims
+	if err := sh.signer.Verify(tok, tokenKindView, &claims); err != nil {
+		return "", err
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	link, ok := sh.links[claims.LinkID]
+	if !ok {
+		return "", errShareRevoked
+	}
+	if link.Viewers >= link.MaxViewers {
+		return "", errShareFull
+	}
+	link.Viewers++
+	sh.viewers[link.ID][client] = struct{}{}
+	return link.ID, nil
+}
+
+func (sh *shares) leave(linkID string, client *cws.Client) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.viewers[linkID][client]; !ok {
+		return
+	}
+	delete(sh.viewers[linkID], client)
+	sh.links[linkID].Viewers--
+}
+
+// revoke removes the link and disconnects its viewers. Only the creator can revoke, any for empty createdBy
+func (sh *shares) revoke(linkID string, createdBy string) bool {
+	sh.mu.Lock()
+	link, ok := sh.links[linkID]
+	if !ok || (createdBy != "" && link.CreatedBy != createdBy) {
+		sh.mu.Unlock()
+		return false
+	}
+	viewers := sh.viewers[linkID]
+	delete(sh.links, linkID)
+	delete(sh.viewers, linkID)
+	sh.mu.Unlock()
+
+	log.Println("Revoked view link", linkID, "with", len(viewers), "viewers")
+	for client := range viewers {
+		client.Close()
+	}
+	return true
+}
+
+func (sh *shares) list() []ShareLink {
+	sh.mu.Lock()
+	list := make([]ShareLink, 0, len(sh.links))
+	for _, link := range sh.links {
+		list = append(list, *link)
+	}
+	sh.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ExpiresAt.Before(list[j].ExpiresAt) })
+	return list
+}
+
+// shareRequest is the data of SHARE_CREATE packet
+type shareRequest struct {
+	MaxViewers int `json:"max_viewers"`
+	// TTL in minutes
+	TTL int `json:"ttl"`
+}
+
+// routeShare lets a participant create and revoke view links of the session
+func (s *Server) routeShare(client *cws.Client) {
+	client.Receive("SHARE_CREATE", func(req cws.WSPacket) cws.WSPacket {
+		var sr shareRequest
+		if req.Data != "" {
+			if err := json.Unmarshal([]byte(req.Data), &sr); err != nil {
+				log.Println("Wrong SHARE_CREATE request", err)
+				return cws.EmptyPacket
+			}
+		}
+		link, err := s.shares.create(client.GetID(), sr.MaxViewers, time.Duration(sr.TTL)*time.Minute)
+		if err != nil {
+			log.Println("Failed to create view link", err)
+			return cws.EmptyPacket
+		}
+		data, _ := json.Marshal(link)
+		return cws.WSPacket{Type: "SHARE", Data: string(data)}
+	})
+	client.Receive("SHARE_REVOKE", func(req cws.WSPacket) cws.WSPacket {
+		s.shares.revoke(req.Data, client.GetID())
+		return cws.EmptyPacket
+	})
+}
+
+func (s *Server) handleListShares(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.shares.list())
+}
+
+func (s *Server) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	if !s.shares.revoke(mux.Vars(r)["id"], "") {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
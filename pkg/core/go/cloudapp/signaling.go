@@ -0,0 +1,347 @@
+package cloudapp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/bus"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+	"github.com/gorilla/mux"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+// Directions of signaling events
+const (
+	signalingIn    = "in"
+	signalingOut   = "out"
+	signalingError = "error"
+)
+
+const (
+	// maxSignalingRecordings are kept in the directory, the oldest go first
+	maxSignalingRecordings = 500
+	// maxReplayGap caps the wait between replayed packets, e.g. a session idle for minutes before its renegotiation
+	maxReplayGap = 2 * time.Second
+	// replaySettle is the wait for the last packets of the worker after the replayed ones
+	replaySettle = 2 * time.Second
+)
+
+var errNoSignaling = errors.New("the recording has no packets of the browser")
+
+// signalingChunks in the signaling of the handshake asks for large packets in chunks
+const signalingChunks = "chunks"
+
+// signalingTypes are the packets of the WebRTC negotiation, the rest of the session isn't recorded
+var signalingTypes = map[string]bool{
+	"init":             true,
+	"initwebrtc":       true,
+	"offer":            true,
+	"answer":           true,
+	"candidate":        true,
+	"ICE_RELAY":        true,
+	"ICE_RELAY_FAILED": true,
+	"AUDIO":            true,
+	"SFU":              true,
+	"STREAM_FALLBACK":  true,
+	"resumestream":     true,
+	"RESUMED":          true,
+	"RESUME_FAILED":    true,
+	"reoffer":          true,
+	"reanswer":         true,
+}
+
+// signalingEvent is a line of a signaling recording
+type signalingEvent struct {
+	// T is milliseconds since the first event of the session
+	T int64 `json:"t"`
+	// Dir is in for packets of the browser, out for the worker's and error for failures of the worker
+	Dir  string `json:"dir"`
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+}
+
+// signalingLog records the signaling of a session to a file of its own, created with the first event.
+// Events are written right away, the recording of a session which crashed the worker is complete
+type signalingLog struct {
+	dir  string
+	name string
+
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+func newSignalingLog(dir, clientID string) *signalingLog {
+	return &signalingLog{dir: dir, name: time.Now().Format("20060102-150405") + "-" + clientID + recordingExt}
+}
+
+// tap records the signaling packets of the websocket
+func (l *signalingLog) tap(out bool, packet cws.WSPacket) {
+	if !signalingTypes[packet.Type] {
+		return
+	}
+	dir := signalingIn
+	if out {
+		dir = signalingOut
+	}
+	l.record(dir, packet.Type, packet.Data)
+}
+
+func (l *signalingLog) record(dir, typ, data string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.file == nil {
+		if err := l.open(now); err != nil {
+			log.Println("Cannot record signaling:", err)
+			return
+		}
+	}
+	line, _ := json.Marshal(signalingEvent{T: now.Sub(l.start).Milliseconds(), Dir: dir, Type: typ, Data: data})
+	l.file.Write(append(line, '\n'))
+}
+
+func (l *signalingLog) open(now time.Time) error {
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return err
+	}
+	pruneSignaling(l.dir, maxSignalingRecordings-1)
+	file, err := os.Create(filepath.Join(l.dir, l.name))
+	if err != nil {
+		return err
+	}
+	l.file, l.start = file, now
+	return nil
+}
+
+func (l *signalingLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+// path returns the file of the recording, empty before the first event
+func (l *signalingLog) path() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return ""
+	}
+	return l.file.Name()
+}
+
+// negotiateSignaling sets what the client takes from the signaling query of the handshake, e.g. gzip,deflate,chunks:
+// offers and candidates are compressed with the first compression the worker knows, large packets are sent in chunks
+func negotiateSignaling(client *cws.Client, r *http.Request) {
+	for _, name := range strings.Split(r.URL.Query().Get("signaling"), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case webrtc.CompressionGzip, webrtc.CompressionDeflate:
+			if client.Compression() == "" {
+				client.SetCompression(name)
+			}
+		case signalingChunks:
+			client.SetChunked(true)
+		}
+	}
+}
+
+// listSignaling returns the signaling recordings, the latest first
+func listSignaling(dir string) []Recording {
+	files, _ := ioutil.ReadDir(dir)
+	list := []Recording{}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != recordingExt {
+			continue
+		}
+		list = append(list, Recording{Name: f.Name(), CreatedAt: f.ModTime(), Size: f.Size()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// pruneSignaling removes the oldest recordings beyond keep
+func pruneSignaling(dir string, keep int) {
+	list := listSignaling(dir)
+	for i := keep; i < len(list); i++ {
+		os.Remove(filepath.Join(dir, list[i].Name))
+	}
+}
+
+// readSignaling parses a signaling recording
+func readSignaling(rd io.Reader) ([]signalingEvent, error) {
+	var events []signalingEvent
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 4096), maxRecordingLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var e signalingEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+func (s *Server) handleListSignaling(w http.ResponseWriter, r *http.Request) {
+	if s.capp.signalingDir == "" {
+		writeJSON(w, []Recording{})
+		return
+	}
+	writeJSON(w, listSignaling(s.capp.signalingDir))
+}
+
+func (s *Server) handleSignalingFile(w http.ResponseWriter, r *http.Request) {
+	if s.capp.signalingDir == "" {
+		http.Error(w, "signaling recording is disabled", http.StatusNotFound)
+		return
+	}
+	name := filepath.Base(filepath.Clean("/" + mux.Vars(r)["name"]))
+	serveDownload(w, r, filepath.Join(s.capp.signalingDir, name), name)
+}
+
+// replayApp stands in for the app VM in replays, the signaling path only asks it for keyframes and clocks
+type replayApp struct {
+	CloudAppClient
+	video, audio *media.CaptureClock
+}
+
+func (a replayApp) RampUp()        {}
+func (a replayApp) ForceKeyframe() {}
+func (a replayApp) Encoder() string {
+	return "replay"
+}
+func (a replayApp) Clocks() (*media.CaptureClock, *media.CaptureClock) {
+	return a.video, a.audio
+}
+
+// ReplaySignaling re-drives the signaling path of the worker with a recording: packets of the browser are handled
+// by a client without connection with the recorded gaps, up to 2s, and the ICE credentials of the recorded offer.
+// The recorded and the replayed packets of the worker are written to out in order, a failed negotiation fails again
+// offline. It returns an error when the replay fails differently from the recording
+func ReplaySignaling(cfg config.Config, rd io.Reader, out io.Writer) error {
+	events, err := readSignaling(rd)
+	if err != nil {
+		return err
+	}
+	// Replays don't take the ports of a worker running on the host
+	cfg.WebRTC.UDPMuxPort, cfg.WebRTC.TCPMuxPort = 0, 0
+	conf := newWebRTCConfig(cfg)
+
+	var mu sync.Mutex
+	start := time.Now()
+	var replayedErrors []string
+	show := func(source string, e signalingEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		data := e.Data
+		if len(data) > 120 {
+			data = data[:120] + "..."
+		}
+		fmt.Fprintf(out, "%-8s %6dms %-5s %-16s %s\n", source, e.T, e.Dir, e.Type, data)
+		if source == "replayed" && e.Dir == signalingError {
+			replayedErrors = append(replayedErrors, e.Type)
+		}
+	}
+	record := func(dir, typ, data string) {
+		show("replayed", signalingEvent{T: time.Since(start).Milliseconds(), Dir: dir, Type: typ, Data: data})
+	}
+
+	ws := cws.NewClient(nil)
+	ws.SetTap(func(out bool, packet cws.WSPacket) {
+		if signalingTypes[packet.Type] && out {
+			record(signalingOut, packet.Type, packet.Data)
+		}
+	})
+	client := NewServiceClient("replay", ws, nil, conf)
+	client.events = bus.New()
+	client.features = map[string]bool{config.FeatureAudio: true, config.FeatureDataChannelInput: true}
+	client.app = replayApp{video: media.NewCaptureClock(90000, 0), audio: media.NewCaptureClock(48000, 0)}
+	client.onError = func(errorType string, err error) { record(signalingError, errorType, err.Error()) }
+	if ice, ok := recordedICE(events); ok {
+		client.ice = ice
+	}
+	client.Route()
+	defer func() {
+		close(client.cancel)
+		if client.rtcConn != nil {
+			client.rtcConn.StopClient()
+		}
+	}()
+
+	var recordedErrors []string
+	injected := 0
+	var last int64
+	for _, e := range events {
+		if gap := time.Duration(e.T-last) * time.Millisecond; gap > 0 {
+			if gap > maxReplayGap {
+				gap = maxReplayGap
+			}
+			time.Sleep(gap)
+		}
+		last = e.T
+		show("recorded", e)
+		switch e.Dir {
+		case signalingIn:
+			ws.Inject(cws.WSPacket{Type: e.Type, Data: e.Data})
+			injected++
+		case signalingError:
+			recordedErrors = append(recordedErrors, e.Type)
+		}
+	}
+	if injected == 0 {
+		return errNoSignaling
+	}
+	time.Sleep(replaySettle)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(replayedErrors, ",") != strings.Join(recordedErrors, ",") {
+		return fmt.Errorf("replay failed with %v, the recording with %v", replayedErrors, recordedErrors)
+	}
+	return nil
+}
+
+// recordedICE returns the ICE credentials of the first offer of the worker, so the replayed offer matches the recorded answer
+func recordedICE(events []signalingEvent) (webrtc.ICECredentials, bool) {
+	for _, e := range events {
+		if e.Dir != signalingOut || e.Type != "offer" {
+			continue
+		}
+		var offer pwebrtc.SessionDescription
+		if err := webrtc.Decode(e.Data, &offer); err != nil {
+			return webrtc.ICECredentials{}, false
+		}
+		var ice webrtc.ICECredentials
+		for _, line := range strings.Split(offer.SDP, "\n") {
+			line = strings.TrimSpace(line)
+			if v := strings.TrimPrefix(line, "a=ice-ufrag:"); v != line {
+				ice.Ufrag = v
+			}
+			if v := strings.TrimPrefix(line, "a=ice-pwd:"); v != line {
+				ice.Pwd = v
+			}
+		}
+		return ice, ice.Valid()
+	}
+	return webrtc.ICECredentials{}, false
+}
@@ -0,0 +1,48 @@
+package cloudapp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
+)
+
+// serverStats adds the worker side to the stats feed of clients.
+// CPU is sampled at most once per feed interval, however many clients read it
+type serverStats struct {
+	app        CloudAppClient
+	resolution string
+	collector  *capacity.Collector
+
+	mu      sync.Mutex
+	cpu     float64
+	sampled time.Time
+}
+
+func newServerStats(app CloudAppClient, cfg config.CapacityConfig, width, height int) *serverStats {
+	return &serverStats{
+		app:        app,
+		resolution: fmt.Sprintf("%dx%d", width, height),
+		collector:  capacity.NewCollector(cfg),
+	}
+}
+
+func (s *serverStats) fill(stats *webrtc.Stats) {
+	stats.Encoder = s.app.Encoder()
+	stats.Resolution = s.resolution
+	stats.CPU = s.CPU()
+}
+
+// CPU returns the recent CPU usage of the worker in percent
+func (s *serverStats) CPU() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.sampled) >= time.Second {
+		s.cpu = s.collector.CPU()
+		s.sampled = time.Now()
+	}
+	return s.cpu
+}
@@ -0,0 +1,71 @@
+package cloudapp
+
+import (
+	"log"
+	"sync"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	pwebrtc "github.com/pion/webrtc/v3"
+)
+
+// viewerPolicy degrades the streams of spectators of view links as they pile up, so the player keeps its stream.
+// Past ReduceFPSAbove spectators their streams are thinned, past MaxDirect new spectators watch the MSE stream
+type viewerPolicy struct {
+	policy catalog.ViewerPolicy
+
+	mu sync.Mutex
+	// spectators streamed to by the worker by client ID, nil for those of the MSE stream
+	spectators map[string]*Client
+}
+
+func newViewerPolicy(policy catalog.ViewerPolicy) *viewerPolicy {
+	return &viewerPolicy{policy: policy, spectators: map[string]*Client{}}
+}
+
+// join adds the spectator to the service, with a peer connection while there are fewer than MaxDirect of them.
+// The MSE stream is H264 only, spectators of other codecs all get a peer connection
+func (v *viewerPolicy) join(capp *Service, clientID string, ws *cws.Client) *Client {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	direct := 0
+	for _, c := range v.spectators {
+		if c != nil {
+			direct++
+		}
+	}
+	if v.policy.MaxDirect > 0 && direct >= v.policy.MaxDirect && capp.webrtcConf.VideoCodec == pwebrtc.MimeTypeH264 {
+		log.Println("Spectator", clientID, "watches the MSE stream,", direct, "spectators have a peer connection")
+		v.spectators[clientID] = nil
+		v.thin()
+		return capp.AddStreamViewer(clientID, ws)
+	}
+	client := capp.AddClient(clientID, ws)
+	v.spectators[clientID] = client
+	v.thin()
+	return client
+}
+
+// leave removes the spectator, the others get their full stream back when they're few enough again
+func (v *viewerPolicy) leave(clientID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.spectators[clientID]; !ok {
+		return
+	}
+	delete(v.spectators, clientID)
+	v.thin()
+}
+
+// thin thins the streams of all spectators while there are more than ReduceFPSAbove of them
+func (v *viewerPolicy) thin() {
+	if v.policy.ReduceFPSAbove == 0 {
+		return
+	}
+	thinned := len(v.spectators) > v.policy.ReduceFPSAbove
+	for _, c := range v.spectators {
+		if c != nil {
+			c.setThinned(thinned)
+		}
+	}
+}
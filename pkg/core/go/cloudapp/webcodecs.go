@@ -0,0 +1,78 @@
+package cloudapp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
+	"github.com/gorilla/websocket"
+)
+
+// webCodecsInit is the first text message of WebCodecs stream, the client configures its VideoDecoder with it
+type webCodecsInit struct {
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// WebCodecs streams the encoded frames of the app over websocket to clients decoding them with WebCodecs,
+// for networks where WebRTC cannot connect. Unlike MSE it isn't limited to H264 and adds no muxing delay.
+// It's view-only and admitted like MSE. The stream starts at a keyframe, a viewer whose frames pile up
+// skips to the next keyframe so its decoder never gets a frame without its references
+func (s *Server) WebCodecs(w http.ResponseWriter, r *http.Request) {
+	if s.capp.assembler == nil {
+		http.Error(w, "WebCodecs fallback supports H264 and VP8 only", http.StatusNotImplemented)
+		return
+	}
+	c, client, e, ok := s.acceptFrameViewer(w, r)
+	if !ok {
+		return
+	}
+	defer c.Close()
+	defer s.leave(e, client)
+	id := client.GetID()
+	const size = 60
+	frames := e.svc.Frames().Subscribe(id, size)
+	defer e.svc.Frames().Unsubscribe(id)
+	log.Println("WebCodecs viewer joined", id)
+
+	mimeType := e.svc.assembler.MimeType()
+	initialized, skipping := false, true
+	for {
+		select {
+		case <-client.Done:
+			log.Println("WebCodecs viewer left", id)
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			if len(frames) > size/2 {
+				skipping = true
+			}
+			if skipping && !frame.Keyframe {
+				continue
+			}
+			skipping = false
+			c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if !initialized {
+				meta, _ := json.Marshal(webCodecsInit{
+					Codec:  media.WebCodecsCodec(mimeType, frame),
+					Width:  s.capp.config.ScreenWidth,
+					Height: s.capp.config.ScreenHeight,
+				})
+				if err := c.WriteMessage(websocket.TextMessage, meta); err != nil {
+					log.Println("WebCodecs: send config failed", err)
+					return
+				}
+				initialized = true
+			}
+			if err := c.WriteMessage(websocket.BinaryMessage, media.MarshalWebCodecs(frame)); err != nil {
+				log.Println("WebCodecs: send frame failed", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// bulkLabel is the DataChannel of bulk transfers to players
+	bulkLabel = "bulk"
+	// bulkChunk is the size of bulk messages, SCTP of browsers takes up to 64KB but smaller ones interleave with input
+	bulkChunk = 16 * 1024
+	// bulkShare of the spare capacity goes to bulk transfers, the rest is headroom for the video to grow back
+	bulkShare = 0.5
+	// bulkMinRate is the spare capacity in bps below which bulk transfers wait
+	bulkMinRate = 64 * 1000
+	// bulkMaxBuffered bounds the data queued in the channel, the SCTP window isn't congestion controlled with the video
+	bulkMaxBuffered = 256 * 1024
+	// bulkDropRatio of the previous rate or less is a drop, of the target rate or of the measured video bitrate.
+	// It pauses bulk transfers
+	bulkDropRatio = 0.85
+	// bulkPauseHold is how long bulk transfers pause after a drop
+	bulkPauseHold = 3 * time.Second
+	// bulkPoll is the wait between checks of a paused transfer
+	bulkPoll = 50 * time.Millisecond
+)
+
+var errBulkClosed = errors.New("webrtc: bulk channel is closed")
+
+// bulkGate decides when bulk transfers send and how fast, from the target rate of the congestion controller and
+// the bitrate of the video measured by the video writer. Transfers take a share of what the video leaves and pause
+// for a while when either rate drops, the video gets the capacity back before bulk data competes for it again
+type bulkGate struct {
+	// target and video are rates in bps
+	target int64
+	video  int64
+	// hold is the time in unix ns until which bulk transfers pause
+	hold int64
+}
+
+// setTarget follows the target rate of the congestion controller
+func (g *bulkGate) setTarget(bps int64, now time.Time) {
+	if float64(bps) <= float64(atomic.SwapInt64(&g.target, bps))*bulkDropRatio {
+		g.pause(now)
+	}
+}
+
+// setVideo follows the measured bitrate of the video, a drop means the encoder or the pacer backed off
+func (g *bulkGate) setVideo(bps int64, now time.Time) {
+	if float64(bps) <= float64(atomic.SwapInt64(&g.video, bps))*bulkDropRatio {
+		g.pause(now)
+	}
+}
+
+func (g *bulkGate) pause(now time.Time) {
+	atomic.StoreInt64(&g.hold, now.Add(bulkPauseHold).UnixNano())
+}
+
+// spare returns the rate in bps of bulk transfers, a share of the target rate above the video
+func (g *bulkGate) spare() float64 {
+	return float64(atomic.LoadInt64(&g.target)-atomic.LoadInt64(&g.video)) * bulkShare
+}
+
+// open returns if bulk transfers may send, they're not paused and the video leaves enough capacity
+func (g *bulkGate) open(now time.Time) bool {
+	return now.UnixNano() >= atomic.LoadInt64(&g.hold) && g.spare() >= bulkMinRate
+}
+
+// BulkChannel sends large data to the peer, e.g. screenshots and files, without starving the video.
+// Transfers are paced by the bulk gate of the peer, one at a time
+type BulkChannel struct {
+	gate    *bulkGate
+	channel *webrtc.DataChannel
+	closed  int32
+	// mu runs the transfers one after another, their chunks can't interleave
+	mu sync.Mutex
+}
+
+// bulkHeader is the text message starting a transfer, the binary chunks of its size follow
+type bulkHeader struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Size     int    `json:"size"`
+}
+
+// OpenBulkChannel creates an ordered and reliable DataChannel of the label for bulk transfers
+func (w *WebRTC) OpenBulkChannel(label string) (*BulkChannel, error) {
+	if w.connection == nil {
+		return nil, errNotConnected
+	}
+	channel, err := w.connection.CreateDataChannel(label, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := &BulkChannel{gate: &w.bulkGate, channel: channel}
+	channel.OnClose(func() { atomic.StoreInt32(&b.closed, 1) })
+	return b, nil
+}
+
+// Bulk returns the bulk channel of the peer, nil for peers without input, e.g. viewers
+func (w *WebRTC) Bulk() *BulkChannel {
+	return w.bulk
+}
+
+// SendFile sends the data as a file of the name and mime type, blocking until it's queued or the channel closes
+func (b *BulkChannel) SendFile(name string, mimeType string, data []byte) error {
+	header, err := json.Marshal(bulkHeader{Name: name, MimeType: mimeType, Size: len(data)})
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.wait(); err != nil {
+		return err
+	}
+	if err := b.channel.SendText(string(header)); err != nil {
+		return err
+	}
+	return b.send(data)
+}
+
+// send sends the data in chunks as the video leaves room
+func (b *BulkChannel) send(data []byte) error {
+	for len(data) > 0 {
+		n := bulkChunk
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := b.wait(); err != nil {
+			return err
+		}
+		if err := b.channel.Send(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		rate := b.gate.spare()
+		if rate < bulkMinRate {
+			rate = bulkMinRate
+		}
+		time.Sleep(time.Duration(float64(n*8) / rate * float64(time.Second)))
+	}
+	return nil
+}
+
+// Close closes the channel, transfers return right away
+func (b *BulkChannel) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
+	return b.channel.Close()
+}
+
+// wait blocks while the channel isn't open, the gate is closed or the channel has too much data queued
+func (b *BulkChannel) wait() error {
+	for {
+		if atomic.LoadInt32(&b.closed) == 1 || b.channel.ReadyState() == webrtc.DataChannelStateClosed {
+			return errBulkClosed
+		}
+		open := b.channel.ReadyState() == webrtc.DataChannelStateOpen
+		if open && b.gate.open(time.Now()) && b.channel.BufferedAmount() < bulkMaxBuffered {
+			return nil
+		}
+		time.Sleep(bulkPoll)
+	}
+}
+
+// setTargetRate follows the target rate of the congestion controller with the pacer and the bulk gate
+func (w *WebRTC) setTargetRate(bitrate int) {
+	w.bulkGate.setTarget(int64(bitrate), time.Now())
+	w.pacer.SetRate(bitrate)
+}
@@ -0,0 +1,54 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBulkGateYieldsToVideo checks bulk transfers only take what the video leaves, and pause when it backs off
+func TestBulkGateYieldsToVideo(t *testing.T) {
+	now := time.Unix(1000, 0)
+	g := &bulkGate{}
+	g.setTarget(4000000, now)
+	g.setVideo(2000000, now)
+	if !g.open(now) {
+		t.Fatal("gate is closed with 2Mbps spare")
+	}
+	if spare := g.spare(); spare != 1000000 {
+		t.Fatalf("spare rate is %v, want half of the 2Mbps the video leaves", spare)
+	}
+
+	// The video grows into the capacity, bulk transfers wait for it
+	now = now.Add(time.Second)
+	g.setVideo(3950000, now)
+	if g.open(now) {
+		t.Fatal("gate is open while the video takes the target rate")
+	}
+
+	// The measured video bitrate drops, bulk transfers pause although capacity is spare
+	now = now.Add(time.Second)
+	g.setVideo(1000000, now)
+	if g.open(now) {
+		t.Fatal("gate is open right after the video bitrate dropped")
+	}
+	if g.open(now.Add(bulkPauseHold - time.Millisecond)) {
+		t.Fatal("gate is open before the pause is over")
+	}
+	now = now.Add(bulkPauseHold)
+	if !g.open(now) {
+		t.Fatal("gate is closed after the pause")
+	}
+
+	// The congestion controller backs off, bulk transfers pause again
+	g.setTarget(3000000, now)
+	if g.open(now) {
+		t.Fatal("gate is open right after the target rate dropped")
+	}
+	// Small changes of the rates don't pause
+	now = now.Add(bulkPauseHold)
+	g.setTarget(2900000, now)
+	g.setVideo(950000, now)
+	if !g.open(now) {
+		t.Fatal("gate is closed after small changes of the rates")
+	}
+}
@@ -0,0 +1,82 @@
+package webrtc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// certRenewBefore renews the DTLS certificate before it expires, generated ones are valid for a month
+const certRenewBefore = 24 * time.Hour
+
+// DTLSCert reuses one DTLS certificate persisted at the path for all peer connections,
+// instead of generating a key for every connection. Empty path keeps per-connection certificates
+func DTLSCert(path string) Option { return func(c *Config) { c.DTLSCertFile = path } }
+
+// ICETimeouts sets how long ICE waits without traffic before disconnected and failed, and the keepalive interval.
+// Zero values keep pion defaults
+func ICETimeouts(disconnected, failed, keepalive time.Duration) Option {
+	return func(c *Config) {
+		c.ICEDisconnectedTimeout = disconnected
+		c.ICEFailedTimeout = failed
+		c.ICEKeepalive = keepalive
+	}
+}
+
+// Certificate returns the shared DTLS certificate, nil when it's disabled or failed to load
+func (c *Config) Certificate() *webrtc.Certificate {
+	if c.DTLSCertFile == "" {
+		return nil
+	}
+	c.certMu.Lock()
+	defer c.certMu.Unlock()
+	if c.cert != nil && time.Until(c.cert.Expires()) > certRenewBefore {
+		return c.cert
+	}
+	cert, err := loadCertificate(c.DTLSCertFile)
+	if err != nil {
+		log.Println("Error: cannot load DTLS certificate, generate per connection:", err)
+		return nil
+	}
+	c.cert = cert
+	return cert
+}
+
+// loadCertificate reads the certificate of the PEM file. A new one is generated and saved when it's missing or expires soon
+func loadCertificate(path string) (*webrtc.Certificate, error) {
+	if pem, err := ioutil.ReadFile(path); err == nil {
+		cert, err := webrtc.CertificateFromPEM(string(pem))
+		if err == nil && time.Until(cert.Expires()) > certRenewBefore {
+			return cert, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := webrtc.GenerateCertificate(key)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := cert.PEM()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// The file holds the private key
+	if err := ioutil.WriteFile(path, []byte(pem), 0600); err != nil {
+		return nil, err
+	}
+	log.Println("Generated DTLS certificate", path, "valid until", cert.Expires().Format(time.RFC3339))
+	return cert, nil
+}
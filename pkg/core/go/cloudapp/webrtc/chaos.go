@@ -0,0 +1,32 @@
+package webrtc
+
+import (
+	"github.com/giongto35/cloud-morph/pkg/common/chaos"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// chaosFactory impairs the outgoing RTP of a peer connection. It's the first interceptor, so it sits next to the
+// transport: FEC, retransmissions and the transport-wide sequence numbers go through it and see the loss
+type chaosFactory struct {
+	link *chaos.Link
+}
+
+func (f chaosFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &chaosInterceptor{link: f.link}, nil
+}
+
+type chaosInterceptor struct {
+	interceptor.NoOp
+	link *chaos.Link
+}
+
+func (c *chaosInterceptor) BindLocalStream(_ *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		// Callers reuse their buffers once the write returns
+		h := header.Clone()
+		p := append([]byte(nil), payload...)
+		c.link.Send(func() { writer.Write(&h, p, attributes) })
+		return h.MarshalSize() + len(p), nil
+	})
+}
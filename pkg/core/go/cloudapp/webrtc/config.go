@@ -1,20 +1,65 @@
 package webrtc
 
-import "github.com/pion/webrtc/v3"
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
 
 type Config struct {
 	webrtc.Configuration
 
-	Nat1to1             string
+	Nat1to1  string
+	PublicIP string
+	PortMin  uint16
+	PortMax  uint16
+	// UDPMuxPort serves all ICE traffic over a single UDP port
+	UDPMuxPort int
+	udpMuxOnce sync.Once
+	udpMux     ice.UDPMux
+	// TCPMuxPort enables ICE-TCP candidates on a single TCP port
+	TCPMuxPort          int
+	tcpMuxOnce          sync.Once
+	tcpMux              ice.TCPMux
 	DisableInterceptors bool
-	VideoCodec          string
+	// DisableStats disables the stats DataChannel of the debug HUD
+	DisableStats bool
+	VideoCodec   string
+	// StartBitrate is the video target rate in bps before the congestion controller estimates it
+	StartBitrate int
+	// FrameInterval of the video, the pacer spreads a frame over it
+	FrameInterval time.Duration
+	// DTLSCertFile persists the DTLS certificate shared by all peer connections
+	DTLSCertFile string
+	certMu       sync.Mutex
+	cert         *webrtc.Certificate
+	// ICE timeouts without network activity and keepalive interval, zero keeps pion defaults
+	ICEDisconnectedTimeout time.Duration
+	ICEFailedTimeout       time.Duration
+	ICEKeepalive           time.Duration
+	// NackHistory is the number of sent packets per stream kept to answer NACKs, a power of two
+	NackHistory uint16
+	// FECPercent is the ULPFEC overhead of the video, 0 disables FEC
+	FECPercent int
+	// Opus settings of the audio encoder announced to the peer, zero values keep the pion defaults
+	AudioBitrate  int
+	AudioChannels int
+	AudioDTX      bool
+	AudioFEC      bool
 }
 
 var DefaultConfig = Config{
 	Configuration: webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	},
-	VideoCodec: webrtc.MimeTypeH264,
+	VideoCodec:    webrtc.MimeTypeH264,
+	FrameInterval: time.Second / 30,
 }
 
 func (c *Config) GetStun() string {
@@ -25,6 +70,23 @@ func (c *Config) GetStun() string {
 	return c.Configuration.ICEServers[0].URLs[0]
 }
 
+// GetICEServers returns ICE servers for the browser.
+// A single STUN url is kept as a plain string, otherwise it's the JSON of RTCIceServer list
+func (c *Config) GetICEServers() string {
+	servers := c.Configuration.ICEServers
+	if len(servers) == 1 && len(servers[0].URLs) == 1 && servers[0].Username == "" {
+		return c.GetStun()
+	}
+	if len(servers) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(servers)
+	if err != nil {
+		return c.GetStun()
+	}
+	return string(b)
+}
+
 func (c *Config) Override(options ...Option) {
 	for _, opt := range options {
 		opt(c)
@@ -34,17 +96,18 @@ func (c *Config) Override(options ...Option) {
 type Option func(*Config)
 
 func Codec(name string) Option {
-	return func(c *Config) {
-		var codec string
-		switch name {
-		case "h264":
-			codec = webrtc.MimeTypeH264
-		case "vpx":
-			codec = webrtc.MimeTypeVP8
-		default:
-			codec = webrtc.MimeTypeH264
-		}
-		c.VideoCodec = codec
+	return func(c *Config) { c.VideoCodec = MimeType(name) }
+}
+
+// MimeType returns the mime type of the video codec of the config, h264 for unknown ones
+func MimeType(name string) string {
+	switch name {
+	case "vpx":
+		return webrtc.MimeTypeVP8
+	case "av1":
+		return webrtc.MimeTypeAV1
+	default:
+		return webrtc.MimeTypeH264
 	}
 }
 
@@ -52,8 +115,108 @@ func DisableInterceptors(disable bool) Option {
 	return func(c *Config) { c.DisableInterceptors = disable }
 }
 
+// StartBitrate sets the video target rate in kbps before the first bandwidth estimate
+func StartBitrate(kbps int) Option { return func(c *Config) { c.StartBitrate = kbps * 1000 } }
+
+// NackHistory sets the number of sent packets kept for retransmission, 0 keeps the default
+func NackHistory(packets int) Option { return func(c *Config) { c.NackHistory = uint16(packets) } }
+
+// FEC adds ULPFEC to the video with the overhead in percent of the media packets, 0 disables it
+func FEC(enabled bool, percent int) Option {
+	return func(c *Config) {
+		c.FECPercent = 0
+		if enabled {
+			c.FECPercent = percent
+		}
+	}
+}
+
+// Audio announces the Opus settings of the encoder: bitrate in kbps, channels, DTX and in-band FEC
+func Audio(kbps int, channels int, dtx bool, fec bool) Option {
+	return func(c *Config) {
+		c.AudioBitrate, c.AudioChannels, c.AudioDTX, c.AudioFEC = kbps, channels, dtx, fec
+	}
+}
+
+func DisableStats(disable bool) Option {
+	return func(c *Config) { c.DisableStats = disable }
+}
+
 func Nat1to1(natIp string) Option { return func(c *Config) { c.Nat1to1 = natIp } }
 
+// PublicIP announces the ip as a server reflexive candidate
+func PublicIP(ip string) Option { return func(c *Config) { c.PublicIP = ip } }
+
+// PortRange restricts UDP ports of ICE candidates
+func PortRange(min, max uint16) Option {
+	return func(c *Config) {
+		c.PortMin = min
+		c.PortMax = max
+	}
+}
+
+// UDPMux serves all ICE UDP traffic over one port. 0 disables it
+func UDPMux(port int) Option { return func(c *Config) { c.UDPMuxPort = port } }
+
+// getUDPMux returns the UDP mux shared by all peer connections, nil if it's disabled or failed to listen
+func (c *Config) getUDPMux() ice.UDPMux {
+	if c.UDPMuxPort == 0 {
+		return nil
+	}
+	c.udpMuxOnce.Do(func() {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.UDPMuxPort})
+		if err != nil {
+			log.Printf("Error: cannot listen UDP mux at port %d, %v", c.UDPMuxPort, err)
+			return
+		}
+		log.Printf("Listening ICE UDP mux at port %d", c.UDPMuxPort)
+		c.udpMux = ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: conn})
+	})
+	return c.udpMux
+}
+
+// TCPMux enables ICE-TCP candidates served over one port. 0 disables it
+func TCPMux(port int) Option { return func(c *Config) { c.TCPMuxPort = port } }
+
+// getTCPMux returns the TCP mux shared by all peer connections, nil if it's disabled or failed to listen
+func (c *Config) getTCPMux() ice.TCPMux {
+	if c.TCPMuxPort == 0 {
+		return nil
+	}
+	c.tcpMuxOnce.Do(func() {
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: c.TCPMuxPort})
+		if err != nil {
+			log.Printf("Error: cannot listen ICE-TCP mux at port %d, %v", c.TCPMuxPort, err)
+			return
+		}
+		log.Printf("Listening ICE-TCP mux at port %d", c.TCPMuxPort)
+		c.tcpMux = ice.NewTCPMuxDefault(ice.TCPMuxParams{Listener: ln, ReadBufferSize: 8})
+	})
+	return c.tcpMux
+}
+
+// ICEServers replaces STUN/TURN servers. Empty list is ignored
+func ICEServers(servers []webrtc.ICEServer) Option {
+	return func(c *Config) {
+		if len(servers) == 0 {
+			return
+		}
+		c.Configuration.ICEServers = servers
+	}
+}
+
+// ICETransportPolicy sets the policy to gather all candidates or relay only
+func ICETransportPolicy(policy string) Option {
+	return func(c *Config) {
+		switch strings.ToLower(policy) {
+		case "relay":
+			c.Configuration.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+		default:
+			c.Configuration.ICETransportPolicy = webrtc.ICETransportPolicyAll
+		}
+	}
+}
+
 func StunServer(server string) Option {
 	return func(c *Config) {
 		var ice []webrtc.ICEServer
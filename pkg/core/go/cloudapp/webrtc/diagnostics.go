@@ -0,0 +1,41 @@
+package webrtc
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+// Diagnostics of the peer connection for bug reports
+type Diagnostics struct {
+	LocalSDP  string `json:"local_sdp"`
+	RemoteSDP string `json:"remote_sdp"`
+	ICEState  string `json:"ice_state"`
+	// ICE are the stats of the candidate pairs and their local and remote candidates
+	ICE  []webrtc.Stats `json:"ice"`
+	Link LinkStats      `json:"link"`
+}
+
+// Diagnostics returns the negotiated SDPs and the ICE candidate pairs of the connection
+func (w *WebRTC) Diagnostics() (Diagnostics, error) {
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil {
+		return Diagnostics{}, errNotConnected
+	}
+	d := Diagnostics{
+		ICEState: w.connection.ICEConnectionState().String(),
+		Link:     w.Link(),
+	}
+	if local := w.connection.LocalDescription(); local != nil {
+		d.LocalSDP = local.SDP
+	}
+	if remote := w.connection.RemoteDescription(); remote != nil {
+		d.RemoteSDP = remote.SDP
+	}
+	for _, s := range w.connection.GetStats() {
+		switch s.(type) {
+		case webrtc.ICECandidatePairStats, webrtc.ICECandidateStats:
+			d.ICE = append(d.ICE, s)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,179 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mimeTypeRED = "video/red"
+	// redPayloadType is free in the default codecs of pion, ULPFEC is registered there at 116
+	redPayloadType    = 117
+	ulpfecPayloadType = 116
+	// maxFECGroup is the number of packets an ULPFEC packet with the short mask protects at most
+	maxFECGroup = 16
+)
+
+// registerFEC offers RED and ULPFEC for the video. onFEC gets the generator of the peer connection,
+// which stays off until the peer answers with both
+func registerFEC(m *webrtc.MediaEngine, i *interceptor.Registry, percent int, onFEC func(*fecGenerator)) error {
+	err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRED, ClockRate: 90000},
+		PayloadType:        redPayloadType,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return err
+	}
+	i.Add(fecFactory{group: fecGroup(percent), onFEC: onFEC})
+	return nil
+}
+
+// fecGroup is the number of media packets per FEC packet for the overhead in percent
+func fecGroup(percent int) int {
+	if percent <= 0 {
+		return maxFECGroup
+	}
+	n := (100 + percent - 1) / percent
+	if n < 2 {
+		n = 2
+	}
+	if n > maxFECGroup {
+		n = maxFECGroup
+	}
+	return n
+}
+
+type fecFactory struct {
+	group int
+	onFEC func(*fecGenerator)
+}
+
+func (f fecFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	g := &fecGenerator{group: f.group}
+	if f.onFEC != nil {
+		f.onFEC(g)
+	}
+	return g, nil
+}
+
+// fecGenerator wraps the outgoing video in RED (RFC 2198) and adds an ULPFEC packet (RFC 5109)
+// per group of media packets or at the end of a frame, so the peer recovers a lost packet without a NACK round trip.
+// The NACK responder sits behind it and keeps the packets as they are sent
+type fecGenerator struct {
+	interceptor.NoOp
+	group  int
+	active int32
+}
+
+// Activate turns the FEC on, it's off until the peer negotiated RED and ULPFEC
+func (g *fecGenerator) Activate() { atomic.StoreInt32(&g.active, 1) }
+
+func (g *fecGenerator) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	s := &fecStream{writer: writer}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		return s.write(header, payload, attributes, g.group, atomic.LoadInt32(&g.active) == 1)
+	})
+}
+
+// fecStream renumbers the packets of a stream, which gets FEC packets in between
+type fecStream struct {
+	mu      sync.Mutex
+	writer  interceptor.RTPWriter
+	started bool
+	seq     uint16
+	// protected are the media packets of the current group as the peer restores them from RED
+	protected [][]byte
+}
+
+func (s *fecStream) write(header *rtp.Header, payload []byte, attributes interceptor.Attributes, group int, active bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.seq = header.SequenceNumber
+		s.started = true
+	}
+	h := header.Clone()
+	h.SequenceNumber = s.seq
+	s.seq++
+	if !active || h.Padding {
+		return s.writer.Write(&h, payload, attributes)
+	}
+
+	raw, err := h.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	s.protected = append(s.protected, append(raw, payload...))
+
+	red := h
+	red.PayloadType = redPayloadType
+	n, err := s.writer.Write(&red, append([]byte{h.PayloadType & 0x7f}, payload...), attributes)
+	if err != nil {
+		return n, err
+	}
+
+	switch {
+	case len(s.protected) >= group || (h.Marker && len(s.protected) > 1):
+		fec := rtp.Header{
+			Version:        2,
+			PayloadType:    redPayloadType,
+			SequenceNumber: s.seq,
+			Timestamp:      h.Timestamp,
+			SSRC:           h.SSRC,
+		}
+		s.seq++
+		_, err = s.writer.Write(&fec, append([]byte{ulpfecPayloadType}, ulpfec(s.protected)...), attributes)
+		s.protected = s.protected[:0]
+	case h.Marker:
+		// A frame of a single packet goes without FEC, the next frame starts a new group
+		s.protected = s.protected[:0]
+	}
+	return n, err
+}
+
+// ulpfec returns the payload of an ULPFEC packet with a single level protecting
+// the packets of consecutive sequence numbers
+func ulpfec(packets [][]byte) []byte {
+	length := 0
+	for _, p := range packets {
+		if len(p)-12 > length {
+			length = len(p) - 12
+		}
+	}
+	base := binary.BigEndian.Uint16(packets[0][2:4])
+	fec := make([]byte, 14+length)
+	var lengthRecovery, mask uint16
+	for _, p := range packets {
+		// E and L are 0, the short mask
+		fec[0] ^= p[0] & 0x3f
+		fec[1] ^= p[1]
+		for i := 4; i < 8; i++ {
+			fec[i] ^= p[i]
+		}
+		lengthRecovery ^= uint16(len(p) - 12)
+		mask |= 1 << (15 - (binary.BigEndian.Uint16(p[2:4]) - base))
+		for i, b := range p[12:] {
+			fec[14+i] ^= b
+		}
+	}
+	binary.BigEndian.PutUint16(fec[2:4], base)
+	binary.BigEndian.PutUint16(fec[8:10], lengthRecovery)
+	binary.BigEndian.PutUint16(fec[10:12], uint16(length))
+	binary.BigEndian.PutUint16(fec[12:14], mask)
+	return fec
+}
+
+// negotiatedFEC returns if the SDP has both RED and ULPFEC for the video
+func negotiatedFEC(sdp string) bool {
+	sdp = strings.ToLower(sdp)
+	return strings.Contains(sdp, "red/90000") && strings.Contains(sdp, "ulpfec/90000")
+}
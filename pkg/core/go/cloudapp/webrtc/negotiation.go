@@ -0,0 +1,154 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+)
+
+var errNotConnected = errors.New("webrtc connection is closed")
+
+// Renegotiation changes the tracks of a running session. The worker is always the offerer:
+// it sends a new offer with OnOffer and the peer answers it like the first offer.
+// Changes made while an offer is unanswered are sent in one offer when the answer arrives
+
+// AddTrack sends a track to the peer mid-session, e.g. a second app window
+func (w *WebRTC) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil {
+		return nil, errNotConnected
+	}
+	sender, err := w.connection.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	// RTCP must be read for the interceptors to work
+	crash.Go("rtcp reader", func() {
+		for {
+			if _, _, err := sender.ReadRTCP(); err != nil {
+				return
+			}
+		}
+	}, "peer", w.ID)
+	log.Printf("Add %s track %s", track.Kind(), track.ID())
+	return sender, w.renegotiateLocked()
+}
+
+// RemoveTrack stops sending the track of the sender. The peer ends its track with the answer
+func (w *WebRTC) RemoveTrack(sender *webrtc.RTPSender) error {
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil {
+		return errNotConnected
+	}
+	if err := w.connection.RemoveTrack(sender); err != nil {
+		return err
+	}
+	log.Println("Remove track")
+	return w.renegotiateLocked()
+}
+
+// SetAudio starts or stops sending audio to the peer
+func (w *WebRTC) SetAudio(enabled bool) error {
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil || w.opusTrack == nil {
+		return errNotConnected
+	}
+	if enabled == (w.audioSender != nil) {
+		return nil
+	}
+	if !enabled {
+		if err := w.connection.RemoveTrack(w.audioSender); err != nil {
+			return err
+		}
+		w.audioSender = nil
+		w.audioReport.setSender(nil)
+		log.Println("Audio is off")
+		return w.renegotiateLocked()
+	}
+	sender, err := w.connection.AddTrack(w.opusTrack)
+	if err != nil {
+		return err
+	}
+	w.audioSender = sender
+	w.audioReport.setSender(sender)
+	log.Println("Audio is on")
+	return w.renegotiateLocked()
+}
+
+// SetVideoCodec replaces the video track with one of another codec, e.g. when the stream falls back from AV1.
+// The peer answered with every codec it decodes, the new track is sent without renegotiation
+func (w *WebRTC) SetVideoCodec(mimeType string) error {
+	if w.AudioOnly {
+		return nil
+	}
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil || w.videoSender == nil {
+		return errNotConnected
+	}
+	current := w.videoTrack.Load().(*webrtc.TrackLocalStaticRTP)
+	if strings.EqualFold(current.Codec().MimeType, mimeType) {
+		return nil
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, "video", "pion")
+	if err != nil {
+		return err
+	}
+	if err := w.videoSender.ReplaceTrack(track); err != nil {
+		return err
+	}
+	w.videoTrack.Store(track)
+	log.Println("Video codec is", mimeType)
+	return nil
+}
+
+// renegotiateLocked sends a new offer, or defers it until the pending offer is answered.
+// The caller holds negotiationMu
+func (w *WebRTC) renegotiateLocked() error {
+	if !w.negotiated || w.connection.SignalingState() != webrtc.SignalingStateStable {
+		w.pendingOffer = true
+		return nil
+	}
+	w.pendingOffer = false
+	offer, err := w.connection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err = w.connection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	sdp, err := EncodeCompressed(offer, w.Compression)
+	if err != nil {
+		return err
+	}
+	log.Println("Created renegotiation offer")
+	if w.OnOffer != nil {
+		w.OnOffer(sdp)
+	}
+	return nil
+}
+
+// IsNegotiated reports whether the peer has answered the first offer
+func (w *WebRTC) IsNegotiated() bool {
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	return w.negotiated
+}
+
+// LocalSDP returns the SDP of the local description with the candidates gathered so far,
+// e.g. for WHIP, which takes the offer without trickled candidates
+func (w *WebRTC) LocalSDP() (string, error) {
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil || w.connection.LocalDescription() == nil {
+		return "", errNotConnected
+	}
+	return w.connection.LocalDescription().SDP, nil
+}
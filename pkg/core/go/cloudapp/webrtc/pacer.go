@@ -0,0 +1,106 @@
+package webrtc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+)
+
+// pacingFactor lets the pacer send faster than the target rate, so a frame drains well within its interval
+const pacingFactor = 2.5
+
+// defaultStartBitrate is the target rate before the first estimate, in bps
+const defaultStartBitrate = 1500 * 1000
+
+// pacer spreads the packets of a frame over the frame interval instead of sending them in a burst.
+// The pace follows the target rate of the congestion controller
+type pacer struct {
+	// rate is the target rate in bps
+	rate int64
+	// maxDelay bounds the pacing debt, the stream outrunning the target rate is not delayed further
+	maxDelay time.Duration
+	next     time.Time
+}
+
+func newPacer(startBitrate int, frameInterval time.Duration) *pacer {
+	if startBitrate <= 0 {
+		startBitrate = defaultStartBitrate
+	}
+	return &pacer{rate: int64(startBitrate), maxDelay: frameInterval}
+}
+
+// SetRate updates the target rate in bps
+func (p *pacer) SetRate(bitrate int) {
+	atomic.StoreInt64(&p.rate, int64(bitrate))
+}
+
+// Rate returns the target rate in bps
+func (p *pacer) Rate() int64 {
+	return atomic.LoadInt64(&p.rate)
+}
+
+// Wait blocks until a packet of the size can be sent. Only one goroutine waits on a pacer
+func (p *pacer) Wait(size int) {
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	if delay > p.maxDelay {
+		// Forgive the debt instead of adding latency, the congestion controller lowers the rate on loss
+		p.next = now
+		delay = 0
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	rate := float64(atomic.LoadInt64(&p.rate)) * pacingFactor
+	p.next = p.next.Add(time.Duration(float64(size*8) / rate * float64(time.Second)))
+}
+
+// rateMeter measures the bitrate of a stream over fixed windows
+type rateMeter struct {
+	window time.Duration
+	start  time.Time
+	bytes  int
+	// rate of the last window in bps
+	rate int64
+}
+
+// add counts a packet and returns true when a window is complete and rate is updated
+func (m *rateMeter) add(size int, now time.Time) bool {
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.bytes += size
+	elapsed := now.Sub(m.start)
+	if elapsed < m.window {
+		return false
+	}
+	m.rate = int64(float64(m.bytes*8) / elapsed.Seconds())
+	m.bytes = 0
+	m.start = now
+	return true
+}
+
+// registerCongestionController adds the GCC estimator. onEstimator gets the estimator of the peer connection
+func registerCongestionController(i *interceptor.Registry, startBitrate int, onEstimator func(cc.BandwidthEstimator)) error {
+	if startBitrate <= 0 {
+		startBitrate = defaultStartBitrate
+	}
+	controller, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// Packets are paced per client in startStreaming
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(startBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return err
+	}
+	controller.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		onEstimator(estimator)
+	})
+	i.Add(controller)
+	return nil
+}
@@ -0,0 +1,129 @@
+package webrtc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// senderReportInterval of RTCP sender reports. Browsers synchronize audio and video with them
+const senderReportInterval = time.Second
+
+// ntpEpochOffset is the seconds from the NTP epoch 1900 to the Unix epoch 1970
+const ntpEpochOffset = 2208988800
+
+// reportStream counts what is sent on a track for its sender reports
+type reportStream struct {
+	ssrc    uint32
+	clock   *media.CaptureClock
+	packets uint32
+	octets  uint32
+}
+
+func newReportStream(sender *webrtc.RTPSender, clock *media.CaptureClock) *reportStream {
+	s := &reportStream{clock: clock}
+	s.setSender(sender)
+	return s
+}
+
+// setSender moves the reports to a new sender of the track, a nil sender stops them.
+// The counts start over with the new SSRC
+func (s *reportStream) setSender(sender *webrtc.RTPSender) {
+	var ssrc uint32
+	if sender != nil {
+		if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+			ssrc = uint32(encodings[0].SSRC)
+		}
+	}
+	atomic.StoreUint32(&s.packets, 0)
+	atomic.StoreUint32(&s.octets, 0)
+	atomic.StoreUint32(&s.ssrc, ssrc)
+}
+
+func (s *reportStream) sent(payload int) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint32(&s.packets, 1)
+	atomic.AddUint32(&s.octets, uint32(payload))
+}
+
+// report maps the current wall clock to the RTP time of capture, false before the first packet
+func (s *reportStream) report(now time.Time) (*rtcp.SenderReport, bool) {
+	ssrc := atomic.LoadUint32(&s.ssrc)
+	if s.clock == nil || ssrc == 0 {
+		return nil, false
+	}
+	rtpTime, ok := s.clock.RTPTime(now)
+	if !ok {
+		return nil, false
+	}
+	return &rtcp.SenderReport{
+		SSRC:        ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     rtpTime,
+		PacketCount: atomic.LoadUint32(&s.packets),
+		OctetCount:  atomic.LoadUint32(&s.octets),
+	}, true
+}
+
+// sendReports writes sender reports of the streams until the connection is closed
+func sendReports(conn *webrtc.PeerConnection, streams ...*reportStream) {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		var packets []rtcp.Packet
+		for _, s := range streams {
+			if sr, ok := s.report(now); ok {
+				packets = append(packets, sr)
+			}
+		}
+		if len(packets) == 0 {
+			continue
+		}
+		if err := conn.WriteRTCP(packets); err != nil {
+			return
+		}
+	}
+}
+
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// registerInterceptors registers the default interceptors of pion except its sender reports,
+// which map RTP time to the send time. sendReports maps it to the capture time instead.
+// The NACK responder keeps nackHistory sent packets of a stream to resend, 0 keeps the pion default
+func registerInterceptors(m *webrtc.MediaEngine, i *interceptor.Registry, nackHistory uint16) error {
+	var opts []nack.ResponderOption
+	if nackHistory > 0 {
+		opts = append(opts, nack.ResponderSize(nackHistory))
+	}
+	responder, err := nack.NewResponderInterceptor(opts...)
+	if err != nil {
+		return err
+	}
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	i.Add(responder)
+	i.Add(generator)
+	receiver, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return err
+	}
+	i.Add(receiver)
+	return webrtc.ConfigureTWCCSender(m, i)
+}
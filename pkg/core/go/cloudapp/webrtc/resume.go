@@ -0,0 +1,81 @@
+package webrtc
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+
+	"github.com/giongto35/cloud-morph/pkg/common/chaos"
+	"github.com/pion/webrtc/v3"
+)
+
+// iceChars are the characters of ICE credentials, RFC 8445 ice-char
+const iceChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/"
+
+// ICECredentials are the local ICE username fragment and password of a peer connection.
+// A refreshed page resumes with the credentials of its last session, together with the shared DTLS certificate
+// the worker looks the same to the browser and the handshake skips the cold start
+type ICECredentials struct {
+	Ufrag string `json:"ufrag"`
+	Pwd   string `json:"pwd"`
+}
+
+// NewICECredentials returns random credentials
+func NewICECredentials() ICECredentials {
+	return ICECredentials{Ufrag: randomICEString(16), Pwd: randomICEString(32)}
+}
+
+// Valid returns if the credentials are long enough and only use ice-chars
+func (c ICECredentials) Valid() bool {
+	return len(c.Ufrag) >= 4 && len(c.Ufrag) <= 256 && len(c.Pwd) >= 22 && len(c.Pwd) <= 256 &&
+		iceString(c.Ufrag) && iceString(c.Pwd)
+}
+
+func randomICEString(n int) string {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(iceChars)))
+	for i := range b {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = iceChars[v.Int64()]
+	}
+	return string(b)
+}
+
+func iceString(s string) bool {
+	for _, r := range s {
+		if r > 127 || strings.IndexByte(iceChars, byte(r)) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// peerSettings are the settings of a single peer connection
+type peerSettings struct {
+	engine *webrtc.SettingEngine
+	// onFEC gets the FEC generator of the peer connection when FEC is enabled
+	onFEC func(*fecGenerator)
+	// chaos impairs the outgoing RTP, nil for none
+	chaos *chaos.Link
+}
+
+// PeerOption changes the settings of a single peer connection
+type PeerOption func(*peerSettings)
+
+// WithICECredentials makes the peer connection use the local ICE credentials
+func WithICECredentials(c ICECredentials) PeerOption {
+	return func(s *peerSettings) { s.engine.SetICECredentials(c.Ufrag, c.Pwd) }
+}
+
+// withChaos impairs the outgoing RTP of the peer connection with the link
+func withChaos(link *chaos.Link) PeerOption {
+	return func(s *peerSettings) { s.chaos = link }
+}
+
+// withFEC hands the FEC generator of the peer connection over, so it's activated once the peer answered
+func withFEC(onFEC func(*fecGenerator)) PeerOption {
+	return func(s *peerSettings) { s.onFEC = onFEC }
+}
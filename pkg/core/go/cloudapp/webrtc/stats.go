@@ -0,0 +1,106 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// statsInterval of the stats DataChannel feed
+const statsInterval = time.Second
+
+// Stats is the compact message of the stats DataChannel, rendered by the debug HUD of the web client
+type Stats struct {
+	FPS int64 `json:"fps"`
+	// Video bitrate in kbps
+	Bitrate int64 `json:"bitrate"`
+	// Round trip time in ms, from the receiver reports of the peer
+	RTT int64 `json:"rtt"`
+	// Video packet loss in percent reported by the peer
+	Loss    float64 `json:"loss"`
+	Dropped int64   `json:"dropped"`
+	// Filled by OnStats of the worker
+	Encoder    string  `json:"encoder,omitempty"`
+	Resolution string  `json:"resolution,omitempty"`
+	CPU        float64 `json:"cpu"`
+}
+
+// peerStats are the latest receiver report values of the video track
+type peerStats struct {
+	rttMs int64
+	// lossPermille is the loss fraction * 1000
+	lossPermille int64
+}
+
+// onReceiverReport updates RTT and loss from the report block about the video stream
+func (p *peerStats) onReceiverReport(rr *rtcp.ReceiverReport, ssrc uint32, now time.Time) {
+	for _, r := range rr.Reports {
+		if r.SSRC != ssrc {
+			continue
+		}
+		atomic.StoreInt64(&p.lossPermille, int64(r.FractionLost)*1000/256)
+		if r.LastSenderReport == 0 {
+			continue
+		}
+		// middle 32 bits of NTP time, in 1/65536 seconds
+		mid := uint32(ntpTime(now) >> 16)
+		rtt := mid - r.LastSenderReport - r.Delay
+		atomic.StoreInt64(&p.rttMs, int64(rtt)*1000/65536)
+	}
+}
+
+// sendStats writes stats to the DataChannel every second until it's closed
+func (w *WebRTC) sendStats(channel *webrtc.DataChannel) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	lastBytes, lastFrames := w.BytesSent(), atomic.LoadInt64(&w.framesSent)
+	for range ticker.C {
+		bytes, frames := w.BytesSent(), atomic.LoadInt64(&w.framesSent)
+		stats := Stats{
+			FPS:     int64(float64(frames-lastFrames) / statsInterval.Seconds()),
+			Bitrate: int64(float64((bytes-lastBytes)*8) / statsInterval.Seconds() / 1000),
+			RTT:     atomic.LoadInt64(&w.peer.rttMs),
+			Loss:    float64(atomic.LoadInt64(&w.peer.lossPermille)) / 10,
+			Dropped: w.FramesDropped(),
+		}
+		lastBytes, lastFrames = bytes, frames
+		if w.OnStats != nil {
+			w.OnStats(&stats)
+		}
+		data, err := json.Marshal(stats)
+		if err != nil {
+			continue
+		}
+		if err := channel.SendText(string(data)); err != nil {
+			return
+		}
+	}
+}
+
+// LinkStats are the latest measurements of the link to the peer
+type LinkStats struct {
+	// Round trip time in ms
+	RTT int64 `json:"rtt"`
+	// Video packet loss in percent
+	Loss float64 `json:"loss"`
+	// Estimate is the target video bitrate of the congestion controller in kbps
+	Estimate int64 `json:"estimate"`
+	// Dropped video frames since the start
+	Dropped int64 `json:"dropped"`
+}
+
+// Link returns the link measurements, they are independent of the stats DataChannel
+func (w *WebRTC) Link() LinkStats {
+	link := LinkStats{
+		RTT:     atomic.LoadInt64(&w.peer.rttMs),
+		Loss:    float64(atomic.LoadInt64(&w.peer.lossPermille)) / 10,
+		Dropped: w.FramesDropped(),
+	}
+	if w.pacer != nil {
+		link.Estimate = w.pacer.Rate() / 1000
+	}
+	return link
+}
@@ -1,16 +1,28 @@
 package webrtc
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/giongto35/cloud-morph/pkg/common/chaos"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/media"
 	"github.com/gofrs/uuid"
 	"github.com/pion/interceptor"
-	"github.com/pion/rtp"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -20,33 +32,162 @@ type WebRTC struct {
 	connection  *webrtc.PeerConnection
 	isConnected bool
 	isClosed    bool
-
-	ImageChannel chan *rtp.Packet
-	AudioChannel chan *rtp.Packet
+	// closed is closed by StopClient
+	closed    chan struct{}
+	closeOnce sync.Once
+	// streamOnce starts the stream on the first connection, ICE connects again after a restart
+	streamOnce sync.Once
+
+	ImageChannel chan *media.Packet
+	AudioChannel chan *media.Packet
 	InputChannel chan []byte
 
 	Done     bool
 	lastTime time.Time
 	curFPS   int
+	// bytesSent counts video payload bytes written to the track
+	bytesSent int64
+	// framesDropped counts video frames dropped on a slow link
+	framesDropped int64
+	// framesSent counts video frames written to the track
+	framesSent int64
+	peer       peerStats
+
+	// OnStreamStart is called when the video track starts streaming to the peer
+	OnStreamStart func()
+	// OnKeyframeRequest is called on PLI or FIR from the peer
+	OnKeyframeRequest func()
+	// OnStats adds the worker stats to the stats feed
+	OnStats func(*Stats)
+	// OnOffer sends an offer of renegotiation to the peer
+	OnOffer func(offer string)
+	// Muted starts the peer without audio, SetAudio turns it on
+	Muted bool
+	// NoInputChannel starts the peer without the input DataChannel, input comes over the websocket
+	NoInputChannel bool
+	// AudioOnly starts the peer without the video track, e.g. to check a long-running app still makes sound
+	AudioOnly bool
+	// ICE are the local ICE credentials, StartClient generates them unless a resumed session sets them
+	ICE ICECredentials
+	// Chaos impairs the outgoing RTP for tests, nil for none
+	Chaos *chaos.Link
+	// Compression of the offers and candidates sent to the peer, empty for none
+	Compression string
+	// VideoCodec is the mime type of the video track, the codec of the config when it's empty
+	VideoCodec string
+	// Capture clocks of the streams for sender reports
+	VideoClock *media.CaptureClock
+	AudioClock *media.CaptureClock
+
+	videoReport *reportStream
+	audioReport *reportStream
+	pacer       *pacer
+	// fec is nil unless the FEC of the video is enabled
+	fec *fecGenerator
+	// preferSmooth keeps the full frame rate on a slow link, accepting loss, instead of thinning the stream
+	preferSmooth int32
+	// thinned drops frames as on a congested link whatever the link, e.g. for spectators of a large audience
+	thinned int32
+	// bulkGate paces the bulk transfers of the peer below the video
+	bulkGate bulkGate
+	// bulk is the bulk channel of players, nil for peers without input
+	bulk *BulkChannel
+
+	negotiationMu sync.Mutex
+	// negotiated after the peer answered the first offer
+	negotiated bool
+	// pendingOffer is set when tracks changed while an offer was unanswered
+	pendingOffer bool
+	signalMu     sync.Mutex
+	// onCandidate sends the local ICE candidates to the peer
+	onCandidate func(c string)
+	opusTrack   *webrtc.TrackLocalStaticRTP
+	videoSender *webrtc.RTPSender
+	// videoTrack is replaced when the stream switches its codec
+	videoTrack atomic.Value
+	// audioSender is nil while audio is off
+	audioSender *webrtc.RTPSender
 }
 
+// Compressions of encoded payloads, the browser decompresses them with DecompressionStream
+const (
+	CompressionGzip = "gzip"
+	// CompressionDeflate is zlib, "deflate" of the Compression Streams API
+	CompressionDeflate = "deflate"
+)
+
+const (
+	// compressAbove is the size of JSON compressed, candidates and small SDPs gain nothing
+	compressAbove = 1024
+	// maxDecodedSize bounds decompressed payloads, so a small packet can't inflate into a huge one
+	maxDecodedSize = 1 << 20
+)
+
+var errDecodedSize = errors.New("webrtc: decoded payload is too large")
+
 // Encode encodes the input in base64
 func Encode(obj interface{}) (string, error) {
+	return EncodeCompressed(obj, "")
+}
+
+// EncodeCompressed encodes the input in base64, compressed with gzip or deflate when it's large enough.
+// Compressed payloads are flagged with the compression as a header, e.g. gzip:H4sI..., base64 has no colon
+func EncodeCompressed(obj interface{}, compression string) (string, error) {
 	b, err := json.Marshal(obj)
 	if err != nil {
 		return "", err
 	}
+	if len(b) < compressAbove || (compression != CompressionGzip && compression != CompressionDeflate) {
+		return base64.StdEncoding.EncodeToString(b), nil
+	}
 
-	return base64.StdEncoding.EncodeToString(b), nil
+	var buf bytes.Buffer
+	var zw io.WriteCloser = gzip.NewWriter(&buf)
+	if compression == CompressionDeflate {
+		zw = zlib.NewWriter(&buf)
+	}
+	if _, err := zw.Write(b); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return compression + ":" + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
-// Decode decodes the input from base64
+// Decode decodes the input from base64, decompressing it when it has the header of a compression
 func Decode(in string, obj interface{}) error {
+	compression := ""
+	if i := strings.IndexByte(in, ':'); i >= 0 {
+		compression, in = in[:i], in[i+1:]
+	}
 	b, err := base64.StdEncoding.DecodeString(in)
 	if err != nil {
 		return err
 	}
 
+	var zr io.Reader
+	switch compression {
+	case "":
+	case CompressionGzip:
+		zr, err = gzip.NewReader(bytes.NewReader(b))
+	case CompressionDeflate:
+		zr, err = zlib.NewReader(bytes.NewReader(b))
+	default:
+		err = fmt.Errorf("webrtc: unknown compression %s", compression)
+	}
+	if err != nil {
+		return err
+	}
+	if zr != nil {
+		if b, err = ioutil.ReadAll(io.LimitReader(zr, maxDecodedSize+1)); err != nil {
+			return err
+		}
+		if len(b) > maxDecodedSize {
+			return errDecodedSize
+		}
+	}
+
 	err = json.Unmarshal(b, obj)
 	if err != nil {
 		return err
@@ -60,9 +201,10 @@ func NewWebRTC() *WebRTC {
 	w := &WebRTC{
 		ID: uuid.Must(uuid.NewV4()).String(),
 
-		ImageChannel: make(chan *rtp.Packet, 100),
-		AudioChannel: make(chan *rtp.Packet, 100),
+		ImageChannel: make(chan *media.Packet, 100),
+		AudioChannel: make(chan *media.Packet, 100),
 		InputChannel: make(chan []byte, 100),
+		closed:       make(chan struct{}),
 	}
 	return w
 }
@@ -85,67 +227,114 @@ func (w *WebRTC) StartClient(onIceCandidate func(c string), conf *Config) (strin
 	}
 
 	log.Println("=== StartClient ===")
-	w.connection, err = NewPeerConnection(conf)
+	w.signalMu.Lock()
+	w.onCandidate = onIceCandidate
+	w.signalMu.Unlock()
+	w.pacer = newPacer(conf.StartBitrate, conf.FrameInterval)
+	atomic.StoreInt64(&w.bulkGate.target, w.pacer.Rate())
+	if !w.ICE.Valid() {
+		w.ICE = NewICECredentials()
+	}
+	w.fec = nil
+	w.connection, err = NewPeerConnection(conf, func(estimator cc.BandwidthEstimator) {
+		estimator.OnTargetBitrateChange(w.setTargetRate)
+	}, WithICECredentials(w.ICE), withFEC(func(g *fecGenerator) { w.fec = g }), withChaos(w.Chaos))
 	if err != nil {
 		return "", err
 	}
 
 	// add video track
-	videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: conf.VideoCodec}, "video", "pion")
+	var videoSender *webrtc.RTPSender
+	if !w.AudioOnly {
+		codec := w.VideoCodec
+		if codec == "" {
+			codec = conf.VideoCodec
+		}
+		videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: codec}, "video", "pion")
 
-	if err != nil {
-		return "", err
-	}
+		if err != nil {
+			return "", err
+		}
 
-	_, err = w.connection.AddTrack(videoTrack)
-	if err != nil {
-		return "", err
+		if videoSender, err = w.connection.AddTrack(videoTrack); err != nil {
+			return "", err
+		}
+		w.videoTrack.Store(videoTrack)
+		crash.Go("rtcp reader", func() { w.readRTCP(videoSender) }, "peer", w.ID)
+		log.Println("Add video track")
 	}
-	log.Println("Add video track")
+	w.videoSender = videoSender
+	w.videoReport = newReportStream(videoSender, w.VideoClock)
 
 	// add audio track
 	opusTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
 	if err != nil {
 		return "", err
 	}
-	_, err = w.connection.AddTrack(opusTrack)
-	if err != nil {
-		return "", err
+	var audioSender *webrtc.RTPSender
+	if !w.Muted {
+		if audioSender, err = w.connection.AddTrack(opusTrack); err != nil {
+			return "", err
+		}
 	}
+	w.opusTrack, w.audioSender = opusTrack, audioSender
+	w.audioReport = newReportStream(audioSender, w.AudioClock)
+	crash.Go("sender reports", func() { sendReports(w.connection, w.videoReport, w.audioReport) }, "peer", w.ID)
 
 	_, err = w.connection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
 
-	// create data channel for input, and register callbacks
-	// order: true, negotiated: false, id: random
-	inputTrack, err := w.connection.CreateDataChannel("app-input", nil)
+	if !w.NoInputChannel {
+		// create data channel for input, and register callbacks
+		// order: true, negotiated: false, id: random
+		inputTrack, err := w.connection.CreateDataChannel("app-input", nil)
+		if err != nil {
+			return "", err
+		}
 
-	inputTrack.OnOpen(func() {
-		log.Printf("Data channel '%s'-'%d' open.\n", inputTrack.Label(), inputTrack.ID())
-	})
+		inputTrack.OnOpen(func() {
+			log.Printf("Data channel '%s'-'%d' open.\n", inputTrack.Label(), inputTrack.ID())
+		})
 
-	// Register text message handling
-	inputTrack.OnMessage(func(msg webrtc.DataChannelMessage) {
-		// TODO: Can add recover here
-		w.InputChannel <- msg.Data
-	})
+		// Register text message handling
+		inputTrack.OnMessage(func(msg webrtc.DataChannelMessage) {
+			// TODO: Can add recover here
+			w.InputChannel <- msg.Data
+		})
 
-	inputTrack.OnClose(func() {
-		log.Println("Data channel closed")
-		log.Println("Closed webrtc")
-	})
+		inputTrack.OnClose(func() {
+			log.Println("Data channel closed")
+			log.Println("Closed webrtc")
+		})
+
+		// Players receive files, e.g. screenshots, on the bulk channel
+		if w.bulk, err = w.OpenBulkChannel(bulkLabel); err != nil {
+			return "", err
+		}
+	}
+
+	// Stats are sent unreliably, a late message is worthless
+	if !conf.DisableStats {
+		ordered, maxRetransmits := false, uint16(0)
+		statsChannel, err := w.connection.CreateDataChannel("stats", &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &maxRetransmits})
+		if err != nil {
+			return "", err
+		}
+		statsChannel.OnOpen(func() { go w.sendStats(statsChannel) })
+	}
 
 	// WebRTC state callback
 	w.connection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		log.Printf("ICE Connection State has changed: %s\n", connectionState.String())
 		if connectionState == webrtc.ICEConnectionStateConnected {
-			go func() {
+			crash.Go("peer connected", func() {
 				w.isConnected = true
 				log.Println("ConnectionStateConnected")
-				w.startStreaming(videoTrack, opusTrack)
-			}()
+				w.streamOnce.Do(func() { w.startStreaming(opusTrack) })
+			}, "peer", w.ID)
 
 		}
-		if connectionState == webrtc.ICEConnectionStateFailed || connectionState == webrtc.ICEConnectionStateClosed || connectionState == webrtc.ICEConnectionStateDisconnected {
+		// A disconnected peer connects again or fails, the page restarts ICE meanwhile when its websocket reconnects
+		if connectionState == webrtc.ICEConnectionStateFailed || connectionState == webrtc.ICEConnectionStateClosed {
 			log.Println("ICE Connection failed")
 			w.StopClient()
 		}
@@ -154,15 +343,15 @@ func (w *WebRTC) StartClient(onIceCandidate func(c string), conf *Config) (strin
 	w.connection.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
 		if iceCandidate != nil {
 			log.Println("OnIceCandidate:", iceCandidate.ToJSON().Candidate)
-			candidate, err := Encode(iceCandidate.ToJSON())
+			candidate, err := EncodeCompressed(iceCandidate.ToJSON(), w.Compression)
 			if err != nil {
 				log.Println("Encode IceCandidate failed: " + iceCandidate.ToJSON().Candidate)
 				return
 			}
-			onIceCandidate(candidate)
+			w.sendCandidate(candidate)
 		} else {
 			// finish, send null
-			onIceCandidate("")
+			w.sendCandidate("")
 		}
 	})
 
@@ -178,7 +367,7 @@ func (w *WebRTC) StartClient(onIceCandidate func(c string), conf *Config) (strin
 		return "", err
 	}
 
-	localSession, err := Encode(offer)
+	localSession, err := EncodeCompressed(offer, w.Compression)
 	if err != nil {
 		return "", err
 	}
@@ -186,6 +375,25 @@ func (w *WebRTC) StartClient(onIceCandidate func(c string), conf *Config) (strin
 	return localSession, nil
 }
 
+// SetPreferSmoothness keeps the full frame rate when the link can't take the stream bitrate.
+// Frames are still dropped when the backlog of the peer grows
+func (w *WebRTC) SetPreferSmoothness(smooth bool) {
+	var v int32
+	if smooth {
+		v = 1
+	}
+	atomic.StoreInt32(&w.preferSmooth, v)
+}
+
+// SetThinned drops frames of the stream as on a congested link, or stops it
+func (w *WebRTC) SetThinned(thinned bool) {
+	var v int32
+	if thinned {
+		v = 1
+	}
+	atomic.StoreInt32(&w.thinned, v)
+}
+
 func (w *WebRTC) SetRemoteSDP(remoteSDP string) error {
 	var answer webrtc.SessionDescription
 	err := Decode(remoteSDP, &answer)
@@ -194,6 +402,11 @@ func (w *WebRTC) SetRemoteSDP(remoteSDP string) error {
 		return err
 	}
 
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil {
+		return errNotConnected
+	}
 	fmt.Println("Wconnection", w.connection)
 	err = w.connection.SetRemoteDescription(answer)
 	if err != nil {
@@ -202,9 +415,70 @@ func (w *WebRTC) SetRemoteSDP(remoteSDP string) error {
 	}
 
 	log.Println("Set Remote Description")
+	if w.fec != nil && answer.Type == webrtc.SDPTypeAnswer && negotiatedFEC(answer.SDP) {
+		w.fec.Activate()
+	}
+	w.negotiated = true
+	if w.pendingOffer {
+		return w.renegotiateLocked()
+	}
 	return nil
 }
 
+// Answer answers an offer of the peer, which restarts ICE when the page reconnects with the connection of
+// its last session
+func (w *WebRTC) Answer(remoteSDP string) (string, error) {
+	var offer webrtc.SessionDescription
+	if err := Decode(remoteSDP, &offer); err != nil {
+		return "", err
+	}
+
+	w.negotiationMu.Lock()
+	defer w.negotiationMu.Unlock()
+	if w.connection == nil {
+		return "", errNotConnected
+	}
+	if err := w.connection.SetRemoteDescription(offer); err != nil {
+		return "", err
+	}
+	answer, err := w.connection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	if err = w.connection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	log.Println("Answered offer of the peer")
+	localSession, err := EncodeCompressed(answer, w.Compression)
+	if err != nil {
+		return "", err
+	}
+	if w.pendingOffer {
+		err = w.renegotiateLocked()
+	}
+	return localSession, err
+}
+
+// SetSignaling sends the candidates and offers to the peer with other callbacks, e.g. when the page
+// reconnects its websocket and its next session takes the connection over
+func (w *WebRTC) SetSignaling(onIceCandidate func(c string), onOffer func(offer string)) {
+	w.signalMu.Lock()
+	w.onCandidate = onIceCandidate
+	w.signalMu.Unlock()
+	w.negotiationMu.Lock()
+	w.OnOffer = onOffer
+	w.negotiationMu.Unlock()
+}
+
+func (w *WebRTC) sendCandidate(candidate string) {
+	w.signalMu.Lock()
+	onCandidate := w.onCandidate
+	w.signalMu.Unlock()
+	if onCandidate != nil {
+		onCandidate(candidate)
+	}
+}
+
 func (w *WebRTC) AddCandidate(candidate string) error {
 	var iceCandidate webrtc.ICECandidateInit
 	err := Decode(candidate, &iceCandidate)
@@ -237,6 +511,7 @@ func (w *WebRTC) StopClient() {
 	// }
 
 	log.Println("===StopClient===")
+	w.closeOnce.Do(func() { close(w.closed) })
 	if w.connection != nil {
 		log.Println("WebRTC Connection close")
 		w.connection.Close()
@@ -251,24 +526,103 @@ func (w *WebRTC) StopClient() {
 	close(w.AudioChannel)
 }
 
+// Closed is closed when the client stops, e.g. after ICE failed
+func (w *WebRTC) Closed() <-chan struct{} {
+	return w.closed
+}
+
+// BytesSent returns video payload bytes sent to the peer
+func (w *WebRTC) BytesSent() int64 {
+	return atomic.LoadInt64(&w.bytesSent)
+}
+
+// FramesDropped returns video frames dropped for the slow link of the peer
+func (w *WebRTC) FramesDropped() int64 {
+	return atomic.LoadInt64(&w.framesDropped)
+}
+
 // IsConnected comment
 func (w *WebRTC) IsConnected() bool {
 	return w.isConnected
 }
 
-func (w *WebRTC) startStreaming(videoTrack *webrtc.TrackLocalStaticRTP, opusTrack *webrtc.TrackLocalStaticRTP) {
+// readRTCP handles keyframe requests of the peer until the sender is closed
+func (w *WebRTC) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			switch p := p.(type) {
+			case *rtcp.ReceiverReport:
+				w.peer.onReceiverReport(p, atomic.LoadUint32(&w.videoReport.ssrc), time.Now())
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if w.OnKeyframeRequest != nil {
+					w.OnKeyframeRequest()
+				}
+			}
+		}
+	}
+}
+
+func (w *WebRTC) startStreaming(opusTrack *webrtc.TrackLocalStaticRTP) {
 	log.Println("Start streaming")
+	if w.OnStreamStart != nil && !w.AudioOnly {
+		w.OnStreamStart()
+	}
 	// receive frame buffer
-	go func() {
+	crash.Go("video writer", func() {
+		if w.AudioOnly {
+			return
+		}
+		// The stream is thinned for this client when its link can't take the stream bitrate.
+		// There is no lower quality layer to switch to
+		videoTrack := w.videoTrack.Load().(*webrtc.TrackLocalStaticRTP)
+		dropper := media.NewFrameDropper(videoTrack.Codec().MimeType)
+		meter := rateMeter{window: time.Second}
+		belowRate := false
 		for packet := range w.ImageChannel {
-			if writeErr := videoTrack.WriteRTP(packet); writeErr != nil {
+			if track := w.videoTrack.Load().(*webrtc.TrackLocalStaticRTP); track != videoTrack {
+				// The stream switched its codec, the encoder restarts with a keyframe
+				videoTrack = track
+				dropper = media.NewFrameDropper(videoTrack.Codec().MimeType)
+			}
+			if meter.add(len(packet.Payload), time.Now()) {
+				w.bulkGate.setVideo(meter.rate, time.Now())
+				belowRate = w.pacer.Rate() < meter.rate && atomic.LoadInt32(&w.preferSmooth) == 0
+			}
+			backlog := len(w.ImageChannel) > cap(w.ImageChannel)/2
+			thinned := atomic.LoadInt32(&w.thinned) == 1
+			if dropper.SetCongested(belowRate || backlog || thinned) && w.OnKeyframeRequest != nil {
+				w.OnKeyframeRequest()
+			}
+			seq, keep := dropper.Keep(&packet.Packet)
+			if !keep {
+				atomic.StoreInt64(&w.framesDropped, int64(dropper.Dropped))
+				packet.Release()
+				continue
+			}
+			// copy the header, the packet is shared by all clients
+			rtpPacket := packet.Packet
+			rtpPacket.SequenceNumber = seq
+
+			w.pacer.Wait(rtpPacket.MarshalSize())
+			atomic.AddInt64(&w.bytesSent, int64(len(rtpPacket.Payload)))
+			w.videoReport.sent(len(rtpPacket.Payload))
+			if rtpPacket.Marker {
+				atomic.AddInt64(&w.framesSent, 1)
+			}
+			writeErr := videoTrack.WriteRTP(&rtpPacket)
+			packet.Release()
+			if writeErr != nil {
 				panic(writeErr)
 			}
 		}
-	}()
+	}, "peer", w.ID)
 
 	// send audio
-	go func() {
+	crash.Go("audio writer", func() {
 		defer func() {
 			if r := recover(); r != nil {
 				fmt.Println("Recovered from err", r)
@@ -276,38 +630,161 @@ func (w *WebRTC) startStreaming(videoTrack *webrtc.TrackLocalStaticRTP, opusTrac
 		}()
 
 		for packet := range w.AudioChannel {
-			if writeErr := opusTrack.WriteRTP(packet); writeErr != nil {
+			w.audioReport.sent(len(packet.Payload))
+			writeErr := opusTrack.WriteRTP(&packet.Packet)
+			packet.Release()
+			if writeErr != nil {
 				panic(writeErr)
 			}
 		}
-	}()
+	}, "peer", w.ID)
 }
 
-func NewPeerConnection(conf *Config) (*webrtc.PeerConnection, error) {
+// NewPeerConnection returns a peer connection. onEstimator gets its bandwidth estimator unless interceptors are disabled
+func NewPeerConnection(conf *Config, onEstimator func(cc.BandwidthEstimator), opts ...PeerOption) (*webrtc.PeerConnection, error) {
 	m := &webrtc.MediaEngine{}
+	// The Opus of the config takes the payload type of the default one
+	if err := registerOpus(m, conf); err != nil {
+		return nil, err
+	}
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		return nil, err
 	}
 
+	s, err := newSettingEngine(conf)
+	if err != nil {
+		return nil, err
+	}
+	settings := peerSettings{engine: &s}
+	for _, opt := range opts {
+		opt(&settings)
+	}
+
+	if conf.VideoCodec == webrtc.MimeTypeAV1 {
+		if err := registerAV1(m); err != nil {
+			return nil, err
+		}
+	}
+
 	i := &interceptor.Registry{}
+	if settings.chaos != nil {
+		i.Add(chaosFactory{link: settings.chaos})
+	}
 	if !conf.DisableInterceptors {
-		if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		if err := registerInterceptors(m, i, conf.NackHistory); err != nil {
+			return nil, err
+		}
+		if conf.FECPercent > 0 && settings.onFEC != nil {
+			if err := registerFEC(m, i, conf.FECPercent, settings.onFEC); err != nil {
+				return nil, err
+			}
+		}
+		if err := registerCongestionController(i, conf.StartBitrate, onEstimator); err != nil {
 			return nil, err
 		}
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+			return nil, err
+		}
+	}
+
+	configuration := conf.Configuration
+	if cert := conf.Certificate(); cert != nil {
+		configuration.Certificates = []webrtc.Certificate{*cert}
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
+	return api.NewPeerConnection(configuration)
+}
+
+// opusPayloadType is the one of Opus in the default codecs of pion
+const opusPayloadType = 111
+
+// registerOpus offers Opus with the fmtp of the encoder settings: stereo, DTX, in-band FEC and the bitrate.
+// The page answers with stereo when the offer has it
+func registerOpus(m *webrtc.MediaEngine, conf *Config) error {
+	if conf.AudioChannels == 0 && conf.AudioBitrate == 0 {
+		return nil
+	}
+	fmtp := []string{"minptime=10"}
+	if conf.AudioFEC {
+		fmtp = append(fmtp, "useinbandfec=1")
+	}
+	if conf.AudioChannels == 2 {
+		fmtp = append(fmtp, "stereo=1", "sprop-stereo=1")
+	}
+	if conf.AudioDTX {
+		fmtp = append(fmtp, "usedtx=1")
+	}
+	if conf.AudioBitrate > 0 {
+		fmtp = append(fmtp, fmt.Sprintf("maxaveragebitrate=%d", conf.AudioBitrate*1000))
 	}
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: strings.Join(fmtp, ";"),
+		},
+		PayloadType: opusPayloadType,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+// av1PayloadType is free in the default codecs of pion, which don't offer AV1
+const av1PayloadType = 45
+
+// registerAV1 adds AV1 to the offer, browsers without AV1 decode answer without it
+func registerAV1(m *webrtc.MediaEngine) error {
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeAV1,
+			ClockRate: 90000,
+			RTCPFeedback: []webrtc.RTCPFeedback{
+				{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"},
+			},
+		},
+		PayloadType: av1PayloadType,
+	}, webrtc.RTPCodecTypeVideo)
+}
 
+func newSettingEngine(conf *Config) (webrtc.SettingEngine, error) {
 	s := webrtc.SettingEngine{}
-	if conf.Nat1to1 != "" {
+	switch {
+	case conf.Nat1to1 != "":
 		if ip, ct, err := parseNatCandidate(conf.Nat1to1); err == nil {
 			s.SetNAT1To1IPs(ip, ct)
 			log.Printf("Using 1:1 NAT %s", conf.Nat1to1)
 		} else {
 			log.Printf("NAT map error: %v", err)
 		}
+	case conf.PublicIP != "":
+		// Keep host candidates for LAN peers and add the public one as srflx
+		s.SetNAT1To1IPs([]string{conf.PublicIP}, webrtc.ICECandidateTypeSrflx)
+		log.Printf("Using public IP %s", conf.PublicIP)
 	}
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
-	return api.NewPeerConnection(conf.Configuration)
+	if mux := conf.getUDPMux(); mux != nil {
+		// A single port mux replaces the port range
+		s.SetICEUDPMux(mux)
+	} else if conf.PortMin != 0 || conf.PortMax != 0 {
+		if err := s.SetEphemeralUDPPortRange(conf.PortMin, conf.PortMax); err != nil {
+			return s, fmt.Errorf("wrong UDP port range %d-%d, %v", conf.PortMin, conf.PortMax, err)
+		}
+	}
+	if conf.ICEDisconnectedTimeout > 0 || conf.ICEFailedTimeout > 0 || conf.ICEKeepalive > 0 {
+		s.SetICETimeouts(
+			durationOr(conf.ICEDisconnectedTimeout, 5*time.Second),
+			durationOr(conf.ICEFailedTimeout, 25*time.Second),
+			durationOr(conf.ICEKeepalive, 2*time.Second),
+		)
+	}
+	if mux := conf.getTCPMux(); mux != nil {
+		s.SetICETCPMux(mux)
+		s.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4,
+			webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4,
+			webrtc.NetworkTypeTCP6,
+		})
+	}
+	return s, nil
 }
 
 func parseNatCandidate(v string) (ips []string, candidateType webrtc.ICECandidateType, err error) {
@@ -319,3 +796,11 @@ func parseNatCandidate(v string) (ips []string, candidateType webrtc.ICECandidat
 	candidateType, err = webrtc.NewICECandidateType(parts[1])
 	return
 }
+
+// durationOr returns d, or the default when it's not set
+func durationOr(d time.Duration, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
@@ -0,0 +1,336 @@
+package cloudapp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/cws"
+)
+
+// Size of the Xvfb screen of the app VM, see winvm/supervisord.conf.
+// Dialogs of the app may open on it outside the app screen
+const vmDisplayWidth, vmDisplayHeight = 800, 600
+
+const focusPollInterval = time.Second
+
+var (
+	errWindowCaptureUnsupported = errors.New("window capture is only supported in the Linux app VM")
+	errWindowNotFound           = errors.New("window is not found")
+)
+
+// windowListScript prints the focused window ID, then "id x y width height name" of the visible windows of the app VM display
+const windowListScript = `xdotool getwindowfocus
+for id in $(xdotool search --onlyvisible --name .); do
+eval "$(xdotool getwindowgeometry --shell "$id")"
+echo "$id $X $Y $WIDTH $HEIGHT $(xdotool getwindowname "$id")"
+done`
+
+// Region is a rectangle of the app VM display
+type Region struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// clamp fits the region into the display with the even size yuv420p needs
+func (r Region) clamp(width, height int) Region {
+	if r.X < 0 {
+		r.Width, r.X = r.Width+r.X, 0
+	}
+	if r.Y < 0 {
+		r.Height, r.Y = r.Height+r.Y, 0
+	}
+	if r.X+r.Width > width {
+		r.Width = width - r.X
+	}
+	if r.Y+r.Height > height {
+		r.Height = height - r.Y
+	}
+	r.Width &^= 1
+	r.Height &^= 1
+	return r
+}
+
+func (r Region) empty() bool {
+	return r.Width <= 0 || r.Height <= 0
+}
+
+// union returns the bounding box of both regions
+func (r Region) union(o Region) Region {
+	if r.empty() {
+		return o
+	}
+	x, y := minInt(r.X, o.X), minInt(r.Y, o.Y)
+	return Region{
+		X:      x,
+		Y:      y,
+		Width:  maxInt(r.X+r.Width, o.X+o.Width) - x,
+		Height: maxInt(r.Y+r.Height, o.Y+o.Height) - y,
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// AppWindow is a visible window of the app VM display
+type AppWindow struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Region  Region `json:"region"`
+	Focused bool   `json:"focused"`
+}
+
+// Windows returns the visible windows of the app VM display
+func (c *ccImpl) Windows() ([]AppWindow, error) {
+	if c.osType == Windows {
+		return nil, errWindowCaptureUnsupported
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker", "exec", "-e", "DISPLAY="+c.vm.display(), c.vm.name(), "sh", "-c", windowListScript)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return parseWindows(stdout.Bytes()), nil
+}
+
+// parseWindows reads the output of windowListScript. Wine keeps tiny hidden helper windows, they are skipped
+func parseWindows(out []byte) []AppWindow {
+	windows := []AppWindow{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	focused := ""
+	if scanner.Scan() {
+		focused = strings.TrimSpace(scanner.Text())
+	}
+	for scanner.Scan() {
+		f := strings.SplitN(scanner.Text(), " ", 6)
+		if len(f) < 5 {
+			continue
+		}
+		var n [4]int
+		for i := range n {
+			n[i], _ = strconv.Atoi(f[i+1])
+		}
+		w := AppWindow{ID: f[0], Region: Region{X: n[0], Y: n[1], Width: n[2], Height: n[3]}, Focused: f[0] == focused}
+		if len(f) == 6 {
+			w.Name = f[5]
+		}
+		w.Region = w.Region.clamp(vmDisplayWidth, vmDisplayHeight)
+		if w.Region.Width < 8 || w.Region.Height < 8 {
+			continue
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// Capture is what the encoder streams: the app screen, the app window, the focused window, all windows or a window ID
+type Capture struct {
+	Target    string    `json:"target"`
+	Region    Region    `json:"region"`
+	Letterbox Letterbox `json:"letterbox"`
+}
+
+// windowCapture switches the captured window of the shared stream and follows the focused window.
+// Every client sees the switch in a WINDOW packet
+type windowCapture struct {
+	app      CloudAppClient
+	onChange func(Capture)
+	// title is the window title of the config, which finds the app window
+	title string
+
+	mu sync.Mutex
+	// screen is the configured region of the app screen and letterbox the output of all captures
+	screen    Region
+	letterbox Letterbox
+	current   Capture
+	// unfollow stops following the focused or the app window
+	unfollow chan struct{}
+}
+
+// newWindowCapture starts from the encoder streaming the app screen, the configured geometry is applied by start
+func newWindowCapture(app CloudAppClient, title string, appScreen Region, geometry catalog.CaptureGeometry, onChange func(Capture)) *windowCapture {
+	screen, letterbox := geometryOf(geometry, appScreen)
+	return &windowCapture{
+		app:       app,
+		onChange:  onChange,
+		title:     title,
+		screen:    screen,
+		letterbox: letterbox,
+		current:   Capture{Target: config.CaptureScreen, Region: appScreen},
+	}
+}
+
+func (w *windowCapture) get() Capture {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// following returns if the target moves with the windows of the display
+func following(target string) bool {
+	return target == config.CaptureFocused || target == config.CaptureApp
+}
+
+// set captures the target. Following the focused or the app window starts even if there's none yet
+func (w *windowCapture) set(target string) (Capture, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.unfollow != nil {
+		close(w.unfollow)
+		w.unfollow = nil
+	}
+	region := w.screen
+	if target != config.CaptureScreen {
+		windows, err := w.app.Windows()
+		if err != nil {
+			return w.current, err
+		}
+		region = Region{}
+		if target == config.CaptureApp {
+			if win, ok := appWindow(windows, w.title); ok {
+				region = win.Region
+			}
+		}
+		for _, win := range windows {
+			switch {
+			case target == config.CaptureAll,
+				target == config.CaptureFocused && win.Focused,
+				target == win.ID:
+				region = region.union(win.Region)
+			}
+		}
+		if region.empty() {
+			if !following(target) {
+				return w.current, errWindowNotFound
+			}
+			region = w.current.Region
+		}
+	}
+	if err := w.applyLocked(target, region); err != nil {
+		return w.current, err
+	}
+	if following(target) {
+		w.unfollow = make(chan struct{})
+		crash.Go("window follow", func() { w.follow(target, w.unfollow) })
+	}
+	return w.current, nil
+}
+
+// applyLocked switches the encoder to the region. The caller holds the lock
+func (w *windowCapture) applyLocked(target string, region Region) error {
+	next := Capture{Target: target, Region: region, Letterbox: w.letterbox}
+	if next == w.current {
+		return nil
+	}
+	if next.Region != w.current.Region || next.Letterbox != w.current.Letterbox {
+		if err := w.app.SetCapture(region, w.letterbox); err != nil {
+			return err
+		}
+	}
+	w.current = next
+	if w.onChange != nil {
+		w.onChange(w.current)
+	}
+	return nil
+}
+
+// follow moves the capture to the focused or the app window when focus changes or the window moves
+func (w *windowCapture) follow(target string, stop chan struct{}) {
+	ticker := time.NewTicker(focusPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		windows, err := w.app.Windows()
+		if err != nil {
+			continue
+		}
+		win, ok := appWindow(windows, w.title)
+		if target == config.CaptureFocused {
+			win, ok = focusedWindow(windows)
+		}
+		if !ok {
+			continue
+		}
+		w.mu.Lock()
+		select {
+		case <-stop:
+		default:
+			if err := w.applyLocked(target, win.Region); err != nil {
+				log.Printf("Cannot follow the %s window: %v", target, err)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// start applies the configured geometry and captures the configured target once the app VM is up
+func (w *windowCapture) start(target string) {
+	for {
+		_, err := w.set(target)
+		if err == nil || err == errWindowCaptureUnsupported {
+			return
+		}
+		time.Sleep(focusPollInterval)
+	}
+}
+
+// windowList is the data of the WINDOWS packet
+type windowList struct {
+	Windows []AppWindow `json:"windows"`
+	Capture Capture     `json:"capture"`
+}
+
+func capturePacket(c Capture) cws.WSPacket {
+	data, _ := json.Marshal(c)
+	return cws.WSPacket{Type: "WINDOW", Data: string(data)}
+}
+
+// routeWindows lets a participant list the app windows and switch the captured one
+func (s *Server) routeWindows(client *cws.Client) {
+	client.Receive("WINDOWS", func(req cws.WSPacket) cws.WSPacket {
+		windows, err := s.capp.ccApp.Windows()
+		if err != nil {
+			return cws.WSPacket{Type: "WINDOW_FAILED", Data: s.text(client, err.Error())}
+		}
+		data, _ := json.Marshal(windowList{Windows: windows, Capture: s.capp.windows.get()})
+		return cws.WSPacket{Type: "WINDOWS", Data: string(data)}
+	})
+	client.Receive("WINDOW_CAPTURE", func(req cws.WSPacket) cws.WSPacket {
+		// every client is told about the switch with a WINDOW packet
+		if _, err := s.capp.windows.set(req.Data); err != nil {
+			log.Println("Cannot capture window:", err)
+			return cws.WSPacket{Type: "WINDOW_FAILED", Data: s.text(client, err.Error())}
+		}
+		return cws.EmptyPacket
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/mtls"
+	"github.com/giongto35/cloud-morph/pkg/common/preemption"
+	"github.com/gofrs/uuid"
+)
+
+// registry lists the workers of the apps. The discovery service is polled, etcd and Consul are watched
+type registry interface {
+	GetApps() ([]appDiscoveryMeta, error)
+	// AppListUpdate sends the workers whenever they change
+	AppListUpdate() chan []appDiscoveryMeta
+	// Register adds the worker and returns its app ID
+	Register(meta appDiscoveryMeta) (string, error)
+	Remove(appID string) error
+	// Heartbeat publishes the capacity of the worker
+	Heartbeat(appID string, report capacity.Report) error
+	// ReportReclaimed tells the registry the instance is reclaimed by the cloud provider
+	ReportReclaimed(appID string, notice preemption.Notice) error
+}
+
+// newRegistry returns the registry of the config, the discovery service without a registry backend
+func newRegistry(cfg config.Config) registry {
+	var fleet *tls.Config
+	if cfg.FleetTLS.IsEnabled() {
+		var err error
+		if fleet, err = mtls.ClientConfig(cfg.FleetTLS); err != nil {
+			log.Fatal("Cannot load the fleet certificate: ", err)
+		}
+	}
+	switch cfg.Registry.Backend {
+	case config.RegistryEtcd:
+		r, err := newEtcdRegistry(cfg.Registry, fleet)
+		if err != nil {
+			log.Fatal("Cannot connect to etcd: ", err)
+		}
+		return r
+	case config.RegistryConsul:
+		return newConsulRegistry(cfg.Registry, fleet)
+	}
+	d := NewDiscovery(cfg.DiscoveryHost)
+	d.httpClient.Transport = fleetTransport(fleet)
+	return d
+}
+
+// fleetTransport presents the fleet certificate, the default transport without fleet TLS
+func fleetTransport(fleet *tls.Config) http.RoundTripper {
+	if fleet == nil {
+		return http.DefaultTransport
+	}
+	return &http.Transport{TLSClientConfig: fleet}
+}
+
+// newAppID returns the ID of a worker registering in etcd or Consul
+func newAppID() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// checkMaxInstances refuses a worker of an app which runs its maximum of instances elsewhere
+func checkMaxInstances(apps []appDiscoveryMeta, meta appDiscoveryMeta) error {
+	if meta.MaxInstances <= 0 {
+		return nil
+	}
+	instances := 0
+	for _, app := range apps {
+		if app.AppName == meta.AppName && app.Addr != meta.Addr {
+			instances++
+		}
+	}
+	if instances >= meta.MaxInstances {
+		return fmt.Errorf("Failed to register app. Err: CAPACITY: %s reached max instances %d", meta.AppName, meta.MaxInstances)
+	}
+	return nil
+}
+
+// decodeApps returns the workers of registry values, sorted by key so the list is stable
+func decodeApps(values map[string][]byte) []appDiscoveryMeta {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	apps := make([]appDiscoveryMeta, 0, len(values))
+	for _, key := range keys {
+		var app appDiscoveryMeta
+		if err := json.Unmarshal(values[key], &app); err != nil {
+			log.Printf("Skip worker %s with wrong value: %v", key, err)
+			continue
+		}
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+// sameApps returns if both lists have the same workers in the same state
+func sameApps(a, b []appDiscoveryMeta) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// withCapacity returns the worker with the players and saturation of the capacity report
+func withCapacity(meta appDiscoveryMeta, report capacity.Report) appDiscoveryMeta {
+	meta.Saturated = report.Saturated
+	meta.Players = report.Sessions
+	return meta
+}
+
+// registryKey returns the key of the app ID under the prefix
+func registryKey(prefix, appID string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + appID
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/preemption"
+)
+
+// consulWait is how long a blocking query for changes of the workers waits
+const consulWait = "5m"
+
+var errConsulNotFound = errors.New("consul: not found")
+
+// consulRegistry keeps the workers in the KV store of Consul over its HTTP API. A worker's key is held by a session
+// with a TTL the worker renews, Consul deletes the key when the session expires
+type consulRegistry struct {
+	addr   string
+	prefix string
+	ttl    time.Duration
+	client *http.Client
+	// watcher waits for blocking queries
+	watcher *http.Client
+
+	mu sync.Mutex
+	// sessions of the workers registered by this process by app ID
+	sessions map[string]*consulSession
+}
+
+type consulSession struct {
+	id   string
+	meta appDiscoveryMeta
+	stop chan struct{}
+}
+
+func newConsulRegistry(cfg config.RegistryConfig, fleet *tls.Config) *consulRegistry {
+	addr := strings.TrimSuffix(cfg.Endpoints[0], "/")
+	if !strings.Contains(addr, "://") {
+		scheme := "http://"
+		if fleet != nil {
+			scheme = "https://"
+		}
+		addr = scheme + addr
+	}
+	transport := fleetTransport(fleet)
+	return &consulRegistry{
+		addr:     addr,
+		prefix:   strings.TrimPrefix(cfg.Prefix, "/"),
+		ttl:      time.Duration(cfg.TTL) * time.Second,
+		client:   &http.Client{Timeout: 2 * time.Second, Transport: transport},
+		watcher:  &http.Client{Timeout: 6 * time.Minute, Transport: transport},
+		sessions: map[string]*consulSession{},
+	}
+}
+
+// do sends the request and decodes the JSON response into out unless it's nil. It returns the Consul index
+func (c *consulRegistry) do(client *http.Client, method, path string, body []byte, out interface{}) (uint64, error) {
+	req, err := http.NewRequest(method, c.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		// A prefix without keys is not found
+		if method == http.MethodGet {
+			return index, nil
+		}
+		return index, errConsulNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return index, fmt.Errorf("consul %s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(reason))
+	}
+	if out == nil {
+		return index, nil
+	}
+	return index, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// list returns the workers, blocking until the index changes when it's set
+func (c *consulRegistry) list(index uint64) ([]appDiscoveryMeta, uint64, error) {
+	path := "/v1/kv/" + c.prefix + "?recurse=true"
+	client := c.client
+	if index > 0 {
+		path += "&index=" + strconv.FormatUint(index, 10) + "&wait=" + consulWait
+		client = c.watcher
+	}
+	var kvs []struct {
+		Key   string
+		Value []byte
+	}
+	index, err := c.do(client, http.MethodGet, path, nil, &kvs)
+	if err != nil {
+		return []appDiscoveryMeta{}, index, err
+	}
+	values := map[string][]byte{}
+	for _, kv := range kvs {
+		values[kv.Key] = kv.Value
+	}
+	return decodeApps(values), index, nil
+}
+
+func (c *consulRegistry) GetApps() ([]appDiscoveryMeta, error) {
+	apps, _, err := c.list(0)
+	return apps, err
+}
+
+// AppListUpdate watches the prefix with blocking queries, the first list is sent right away
+func (c *consulRegistry) AppListUpdate() chan []appDiscoveryMeta {
+	updatedApps := make(chan []appDiscoveryMeta, 1)
+	crash.Go("consul watch", func() {
+		var index uint64
+		var last []appDiscoveryMeta
+		for {
+			apps, next, err := c.list(index)
+			if err != nil {
+				log.Println(err)
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			// The index going back means the KV store was reset
+			if next < index {
+				next = 0
+			}
+			if next != index && (last == nil || !sameApps(apps, last)) {
+				updatedApps <- apps
+				last = apps
+			}
+			index = next
+		}
+	})
+	return updatedApps
+}
+
+func (c *consulRegistry) Register(meta appDiscoveryMeta) (string, error) {
+	apps, err := c.GetApps()
+	if err != nil {
+		return "", err
+	}
+	if err := checkMaxInstances(apps, meta); err != nil {
+		return "", err
+	}
+	meta.ID = newAppID()
+	create, _ := json.Marshal(map[string]string{
+		"Name":      "cloudmorph " + meta.ID,
+		"TTL":       c.ttl.String(),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	})
+	var session struct{ ID string }
+	if _, err := c.do(c.client, http.MethodPut, "/v1/session/create", create, &session); err != nil {
+		return "", err
+	}
+	s := &consulSession{id: session.ID, meta: meta, stop: make(chan struct{})}
+	if err := c.put(s, meta); err != nil {
+		c.destroy(s)
+		return "", err
+	}
+	crash.Go("consul renew", func() { c.renew(s) })
+	c.mu.Lock()
+	c.sessions[meta.ID] = s
+	c.mu.Unlock()
+	return meta.ID, nil
+}
+
+// put writes the worker to its key held by the session
+func (c *consulRegistry) put(s *consulSession, meta appDiscoveryMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	var acquired bool
+	if _, err := c.do(c.client, http.MethodPut, "/v1/kv/"+registryKey(c.prefix, meta.ID)+"?acquire="+s.id, value, &acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("consul: key of %s is held by another session", meta.ID)
+	}
+	return nil
+}
+
+// renew keeps the session alive at half its TTL until it's stopped or gone
+func (c *consulRegistry) renew(s *consulSession) {
+	ticker := time.NewTicker(c.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		_, err := c.do(c.client, http.MethodPut, "/v1/session/renew/"+s.id, nil, nil)
+		if err == errConsulNotFound {
+			// The worker registers again when it's missing
+			log.Println("Consul session of", s.meta.ID, "ended")
+			c.mu.Lock()
+			delete(c.sessions, s.meta.ID)
+			c.mu.Unlock()
+			return
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (c *consulRegistry) destroy(s *consulSession) error {
+	_, err := c.do(c.client, http.MethodPut, "/v1/session/destroy/"+s.id, nil, nil)
+	return err
+}
+
+// Remove destroys the session, which deletes the key of the worker
+func (c *consulRegistry) Remove(appID string) error {
+	c.mu.Lock()
+	s, ok := c.sessions[appID]
+	delete(c.sessions, appID)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	close(s.stop)
+	return c.destroy(s)
+}
+
+// Heartbeat updates the players and saturation of the worker
+func (c *consulRegistry) Heartbeat(appID string, report capacity.Report) error {
+	c.mu.Lock()
+	s, ok := c.sessions[appID]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.put(s, withCapacity(s.meta, report))
+}
+
+// ReportReclaimed removes the worker right away, so new users are routed elsewhere
+func (c *consulRegistry) ReportReclaimed(appID string, notice preemption.Notice) error {
+	log.Printf("Instance is reclaimed at %v, leave Consul", notice.Time)
+	return c.Remove(appID)
+}
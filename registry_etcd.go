@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
+	"github.com/giongto35/cloud-morph/pkg/common/preemption"
+	"go.etcd.io/etcd/client/v3"
+)
+
+const etcdTimeout = 2 * time.Second
+
+// etcdRegistry keeps the workers under a key prefix of etcd. A worker's key is bound to a lease it keeps alive,
+// etcd deletes the key when the worker stops renewing it
+type etcdRegistry struct {
+	cli    *clientv3.Client
+	prefix string
+	ttl    int64
+
+	mu sync.Mutex
+	// leases of the workers registered by this process by app ID
+	leases map[string]*etcdLease
+}
+
+type etcdLease struct {
+	id     clientv3.LeaseID
+	meta   appDiscoveryMeta
+	cancel context.CancelFunc
+}
+
+func newEtcdRegistry(cfg config.RegistryConfig, fleet *tls.Config) (*etcdRegistry, error) {
+	cli, err := clientv3.New(clientv3.Config{Endpoints: cfg.Endpoints, DialTimeout: etcdTimeout, TLS: fleet})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdRegistry{cli: cli, prefix: cfg.Prefix, ttl: int64(cfg.TTL), leases: map[string]*etcdLease{}}, nil
+}
+
+func (e *etcdRegistry) GetApps() ([]appDiscoveryMeta, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := e.cli.Get(ctx, e.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return []appDiscoveryMeta{}, err
+	}
+	values := map[string][]byte{}
+	for _, kv := range resp.Kvs {
+		values[string(kv.Key)] = kv.Value
+	}
+	return decodeApps(values), nil
+}
+
+// AppListUpdate watches the prefix, the first list is sent right away
+func (e *etcdRegistry) AppListUpdate() chan []appDiscoveryMeta {
+	updatedApps := make(chan []appDiscoveryMeta, 1)
+	crash.Go("etcd watch", func() {
+		var last []appDiscoveryMeta
+		send := func() {
+			apps, err := e.GetApps()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if last == nil || !sameApps(apps, last) {
+				updatedApps <- apps
+				last = apps
+			}
+		}
+		for {
+			watch := e.cli.Watch(clientv3.WithRequireLeader(context.Background()), e.prefix, clientv3.WithPrefix())
+			send()
+			for resp := range watch {
+				if err := resp.Err(); err != nil {
+					log.Println("etcd watch:", err)
+					break
+				}
+				send()
+			}
+			time.Sleep(etcdTimeout)
+		}
+	})
+	return updatedApps
+}
+
+func (e *etcdRegistry) Register(meta appDiscoveryMeta) (string, error) {
+	apps, err := e.GetApps()
+	if err != nil {
+		return "", err
+	}
+	if err := checkMaxInstances(apps, meta); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	grant, err := e.cli.Grant(ctx, e.ttl)
+	if err != nil {
+		return "", err
+	}
+	meta.ID = newAppID()
+	if err := e.put(ctx, grant.ID, meta); err != nil {
+		return "", err
+	}
+	keepCtx, stop := context.WithCancel(context.Background())
+	keepAlive, err := e.cli.KeepAlive(keepCtx, grant.ID)
+	if err != nil {
+		stop()
+		return "", err
+	}
+	crash.Go("etcd keepalive", func() {
+		for range keepAlive {
+		}
+		// The lease is gone, e.g. etcd was unreachable longer than the TTL. The worker registers again when it's missing
+		log.Println("etcd lease of", meta.ID, "ended")
+		e.mu.Lock()
+		delete(e.leases, meta.ID)
+		e.mu.Unlock()
+	})
+	e.mu.Lock()
+	e.leases[meta.ID] = &etcdLease{id: grant.ID, meta: meta, cancel: stop}
+	e.mu.Unlock()
+	return meta.ID, nil
+}
+
+func (e *etcdRegistry) put(ctx context.Context, lease clientv3.LeaseID, meta appDiscoveryMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = e.cli.Put(ctx, registryKey(e.prefix, meta.ID), string(value), clientv3.WithLease(lease))
+	return err
+}
+
+// Remove revokes the lease, which deletes the key of the worker
+func (e *etcdRegistry) Remove(appID string) error {
+	e.mu.Lock()
+	lease, ok := e.leases[appID]
+	delete(e.leases, appID)
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	lease.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err := e.cli.Revoke(ctx, lease.id)
+	return err
+}
+
+// Heartbeat updates the players and saturation of the worker under its lease
+func (e *etcdRegistry) Heartbeat(appID string, report capacity.Report) error {
+	e.mu.Lock()
+	lease, ok := e.leases[appID]
+	e.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	return e.put(ctx, lease.id, withCapacity(lease.meta, report))
+}
+
+// ReportReclaimed removes the worker right away, so new users are routed elsewhere
+func (e *etcdRegistry) ReportReclaimed(appID string, notice preemption.Notice) error {
+	log.Printf("Instance is reclaimed at %v, leave etcd", notice.Time)
+	return e.Remove(appID)
+}
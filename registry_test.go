@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/config"
+)
+
+// fakeConsul serves the KV store and sessions of the Consul HTTP API used by the registry
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	kv       map[string][]byte
+	holders  map[string]string
+	sessions map[string]bool
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, kv: map[string][]byte{}, holders: map[string]string{}, sessions: map[string]bool{}}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == "/v1/session/create":
+		f.mu.Lock()
+		id := "session-" + strconv.Itoa(len(f.sessions)+1)
+		f.sessions[id] = true
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.sessions[strings.TrimPrefix(path, "/v1/session/renew/")] {
+			http.NotFound(w, r)
+		}
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		f.expire(strings.TrimPrefix(path, "/v1/session/destroy/"))
+	case strings.HasPrefix(path, "/v1/kv/") && r.Method == http.MethodPut:
+		key := strings.TrimPrefix(path, "/v1/kv/")
+		session := r.URL.Query().Get("acquire")
+		value, _ := ioutil.ReadAll(r.Body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if holder, ok := f.holders[key]; !f.sessions[session] || ok && holder != session {
+			json.NewEncoder(w).Encode(false)
+			return
+		}
+		f.kv[key] = value
+		f.holders[key] = session
+		f.index++
+		json.NewEncoder(w).Encode(true)
+	case strings.HasPrefix(path, "/v1/kv/"):
+		f.list(w, r, strings.TrimPrefix(path, "/v1/kv/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// list answers a recursive get, blocking while the index of the request is current
+func (f *fakeConsul) list(w http.ResponseWriter, r *http.Request, prefix string) {
+	wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	deadline := time.Now().Add(time.Second)
+	f.mu.Lock()
+	for wait > 0 && f.index <= wait && time.Now().Before(deadline) {
+		f.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	type kv struct {
+		Key   string
+		Value []byte
+	}
+	var kvs []kv
+	for key, value := range f.kv {
+		if strings.HasPrefix(key, prefix) {
+			kvs = append(kvs, kv{key, value})
+		}
+	}
+	if len(kvs) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(kvs)
+}
+
+// expire ends the session and deletes the keys it holds, like a destroyed or timed out session
+func (f *fakeConsul) expire(session string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, session)
+	for key, holder := range f.holders {
+		if holder == session {
+			delete(f.kv, key)
+			delete(f.holders, key)
+		}
+	}
+	f.index++
+}
+
+func newTestConsulRegistry(t *testing.T) (*consulRegistry, *fakeConsul) {
+	f := newFakeConsul()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	r := newConsulRegistry(config.RegistryConfig{Endpoints: []string{server.URL}, Prefix: "/cloudmorph/workers", TTL: 10}, nil)
+	return r, f
+}
+
+func receiveApps(t *testing.T, updates chan []appDiscoveryMeta) []appDiscoveryMeta {
+	select {
+	case apps := <-updates:
+		return apps
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update of the workers")
+		return nil
+	}
+}
+
+// TestConsulRegistry checks a registered worker is listed with its heartbeats and is gone once it's removed
+func TestConsulRegistry(t *testing.T) {
+	r, _ := newTestConsulRegistry(t)
+	updates := r.AppListUpdate()
+	if apps := receiveApps(t, updates); len(apps) != 0 {
+		t.Fatalf("empty registry lists %+v", apps)
+	}
+
+	id, err := r.Register(appDiscoveryMeta{AppName: "notepad", Addr: "10.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apps := receiveApps(t, updates); len(apps) != 1 || apps[0].ID != id || apps[0].AppName != "notepad" {
+		t.Fatalf("registered worker %s, listed %+v", id, apps)
+	}
+
+	if err := r.Heartbeat(id, capacity.Report{Sessions: 3, Saturated: true}); err != nil {
+		t.Fatal(err)
+	}
+	if apps := receiveApps(t, updates); len(apps) != 1 || apps[0].Players != 3 || !apps[0].Saturated {
+		t.Fatalf("worker after a saturated heartbeat is listed as %+v", apps)
+	}
+
+	if err := r.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if apps := receiveApps(t, updates); len(apps) != 0 {
+		t.Fatalf("removed worker is listed as %+v", apps)
+	}
+	if err := r.Heartbeat(id, capacity.Report{Sessions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if apps, _ := r.GetApps(); len(apps) != 0 {
+		t.Fatalf("heartbeat after removal lists %+v", apps)
+	}
+}
+
+// TestConsulRegistryExpired checks a worker whose session times out leaves the list
+func TestConsulRegistryExpired(t *testing.T) {
+	r, f := newTestConsulRegistry(t)
+	id, err := r.Register(appDiscoveryMeta{AppName: "notepad", Addr: "10.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.expire(r.sessions[id].id)
+	if apps, err := r.GetApps(); err != nil || len(apps) != 0 {
+		t.Fatalf("expired worker is listed as %+v, %v", apps, err)
+	}
+}
+
+// TestConsulRegistryMaxInstances checks a worker is refused when its app runs its maximum of instances elsewhere
+func TestConsulRegistryMaxInstances(t *testing.T) {
+	r, _ := newTestConsulRegistry(t)
+	meta := appDiscoveryMeta{AppName: "notepad", Addr: "10.0.0.1:8080", MaxInstances: 1}
+	if _, err := r.Register(meta); err != nil {
+		t.Fatal(err)
+	}
+	meta.Addr = "10.0.0.2:8080"
+	if _, err := r.Register(meta); err == nil || !strings.Contains(err.Error(), "CAPACITY") {
+		t.Fatalf("second instance registers with %v, want a capacity error", err)
+	}
+	other := appDiscoveryMeta{AppName: "paint", Addr: "10.0.0.2:8080", MaxInstances: 1}
+	if _, err := r.Register(other); err != nil {
+		t.Fatalf("other app is refused: %v", err)
+	}
+}
+
+// TestDecodeApps checks the workers are sorted by key and a wrong value is skipped
+func TestDecodeApps(t *testing.T) {
+	apps := decodeApps(map[string][]byte{
+		"w/b": []byte(`{"id":"b"}`),
+		"w/a": []byte(`{"id":"a"}`),
+		"w/c": []byte(`not json`),
+	})
+	if len(apps) != 2 || apps[0].ID != "a" || apps[1].ID != "b" {
+		t.Fatalf("decoded %+v", apps)
+	}
+}
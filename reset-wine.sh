@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+# Remove appvm and empty its Wine prefix, the next launch creates and provisions a fresh one
+# Usage: ./reset-wine.sh
+set -e
+docker rm -f appvm || true
+docker run --rm --volume "winecfg:/root/.wine" syncwine sh -c "rm -rf /root/.wine/* /root/.wine/.[!.]*"
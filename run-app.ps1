@@ -19,7 +19,8 @@ sleep 2
     $ffmpegParams = -join @(
         "-f gdigrab -framerate 30 -i title=`"$title`" -pix_fmt yuv420p "
         if ( 'h264' -eq $vcodec )
-            { "-c:v libx264 -tune zerolatency " } else
+            { "-c:v libx264 -tune zerolatency " } elseif ( 'av1' -eq $vcodec )
+            { "-c:v libaom-av1 -usage realtime -cpu-used 8 -row-mt 1 -lag-in-frames 0 " } else
             { "-c:v libvpx -deadline realtime -quality realtime " }
         "-vf scale=1280:-2 "
         "-f rtp rtp://127.0.0.2:5004 "
@@ -1,13 +1,49 @@
 #!/usr/bin/env bash
 cd winvm
-docker build -t syncwine .
-docker rm -f appvm
+# $9 is ffmpeg video encoder options, ${10} is the GPU index for hardware encoding, ${11} is the app VM image
+# ${12} is the provisioning script in the app VM, run once for a new Wine prefix, ${13} is the video bitrate in kbps
+# ${14} are names of secrets in the environment of this script, passed on to the app VM without their values in the command
+# ${15} is ffmpeg libopus options of the audio encoder, ${16} is 1 to start the stream blank until the app window shows up
+# ${17} is the container name and ${18} the X display of the instance, rooms run several side by side on the host network
+# ${19} and ${20} are the video and audio RTP ports, ${21} the encoder progress port, ${22} the syncinput port of the worker,
+# ${23} the supervisord port and ${24} the volume of the Wine prefix, empty for a fresh prefix
+# ${25} is the directory of the overlay text in the app VM, empty for none
+# The supervisord config and the app launcher are mounted, images other than syncwine have no /winvm of their own
+image=${11:-syncwine}
+name=${17:-appvm}
+display=${18:-:99}
+rpcport=${23:-9001}
+if [ "$image" == "syncwine" ]
+then
+    docker build -t syncwine .
+fi
+docker rm -f "$name"
+videoencoder=${9:-"-c:v libx264 -tune zerolatency -quality realtime"}
+audioencoder=${15:-"-b:a 96k -ac 2"}
+gpuflags=()
+if [ -n "${10}" ]
+then
+    gpuflags=(--gpus "device=${10}" --env "NVIDIA_DRIVER_CAPABILITIES=video,compute,utility")
+fi
+secretflags=()
+for secret in ${14}
+do
+    secretflags+=(--env "$secret")
+done
+volumeflags=()
+if [ -n "${24-winecfg}" ]
+then
+    volumeflags=(--volume "${24-winecfg}:/root/.wine")
+fi
+portenv=(--env "videoport=${19:-5004}" --env "audioport=${20:-4004}" --env "progressport=${21:-5010}" \
+    --env "inputport=${22:-9090}" --env "rpcport=$rpcport" --env "overlaydir=${25-/apps/.overlay}")
 if [ $(uname -s) == "Darwin" ]
 then
     echo "Spawn container on Mac"
-    docker run -d --privileged --rm --name "appvm" \
+    docker run -d --privileged --rm --name "$name" \
     --mount type=bind,source="$(pwd)"/apps,target=/apps \
     --mount type=bind,source="$(pwd)"/supervisord.conf,target=/etc/supervisor/conf.d/supervisord.conf  \
+    --mount type=bind,source="$(pwd)"/launch-app.sh,target=/winvm/launch-app.sh \
     --env "apppath=$1" \
     --env "appfile=$2" \
     --env "appname=$3" \
@@ -15,14 +51,24 @@ then
     --env "screenwidth=$5" \
     --env "screenheight=$6" \
     --env "wineoptions=$7" \
+    --env "videoencoder=$videoencoder" \
+    --env "audioencoder=$audioencoder" \
+    --env "provision=${12}" \
+    --env "bitrate=${13}" \
+    --env "hidedesktop=${16}" \
+    "${gpuflags[@]}" \
+    "${secretflags[@]}" \
+    "${portenv[@]}" \
+    --publish "127.0.0.1:$rpcport:$rpcport" \
     --env "dockerhost=host.docker.internal" \
-    --env "DISPLAY=:99" \
-    --volume "winecfg:/root/.wine" syncwine supervisord
+    --env "DISPLAY=$display" \
+    "${volumeflags[@]}" "$image" supervisord
 else 
     echo "Spawn container on Linux"
-    docker run -t -d --privileged --rm --name "appvm" \
+    docker run -t -d --privileged --rm --name "$name" \
     --mount type=bind,source="$(pwd)"/apps,target=/apps \
     --mount type=bind,source="$(pwd)"/supervisord.conf,target=/etc/supervisor/conf.d/supervisord.conf  \
+    --mount type=bind,source="$(pwd)"/launch-app.sh,target=/winvm/launch-app.sh \
     --network=host \
     --env "apppath=$1" \
     --env "appfile=$2" \
@@ -31,7 +77,15 @@ else
     --env "screenwidth=$5" \
     --env "screenheight=$6" \
     --env "wineoptions=$7" \
+    --env "videoencoder=$videoencoder" \
+    --env "audioencoder=$audioencoder" \
+    --env "provision=${12}" \
+    --env "bitrate=${13}" \
+    --env "hidedesktop=${16}" \
+    "${gpuflags[@]}" \
+    "${secretflags[@]}" \
+    "${portenv[@]}" \
     --env "dockerhost=127.0.0.1" \
-    --env "DISPLAY=:99" \
-    --volume "winecfg:/root/.wine" syncwine supervisord
+    --env "DISPLAY=$display" \
+    "${volumeflags[@]}" "$image" supervisord
 fi
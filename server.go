@@ -2,37 +2,46 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/giongto35/cloud-morph/pkg/addon/textchat"
+	"github.com/giongto35/cloud-morph/pkg/common/capacity"
+	"github.com/giongto35/cloud-morph/pkg/common/catalog"
 	"github.com/giongto35/cloud-morph/pkg/common/config"
+	"github.com/giongto35/cloud-morph/pkg/common/crash"
 	"github.com/giongto35/cloud-morph/pkg/common/cws"
+	"github.com/giongto35/cloud-morph/pkg/common/listener"
+	"github.com/giongto35/cloud-morph/pkg/common/monitoring"
+	"github.com/giongto35/cloud-morph/pkg/common/mtls"
+	"github.com/giongto35/cloud-morph/pkg/common/preemption"
+	"github.com/giongto35/cloud-morph/pkg/common/proxy"
+	"github.com/giongto35/cloud-morph/pkg/common/store"
 	"github.com/giongto35/cloud-morph/pkg/common/ws"
 	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp"
+	"github.com/giongto35/cloud-morph/pkg/core/go/cloudapp/webrtc"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{}
-
-const configFilePath = "config.yaml"
+var upgrader = websocket.Upgrader{Subprotocols: cws.Subprotocols}
 
 var curApp = "Notepad"
 
 const embedPage string = "web/embed/embed.html"
 const indexPage string = "web/index.html"
-const addr string = ":8080"
 
-var chatEventTypes = []string{"CHAT"}
+var chatEventTypes = []string{"CHAT", "CHAT_EDIT", "CHAT_DELETE", "REACT", "TYPING", "DM", "BLOCK", "UNBLOCK", "REPORT"}
 var appEventTypes = []string{"OFFER", "ANSWER", "MOUSEDOWN", "MOUSEUP", "MOUSEMOVE", "KEYDOWN", "KEYUP"}
 var dscvEventTypes = []string{"SELECTHOST"}
 
@@ -45,13 +54,21 @@ var clientID string
 // }
 
 type Server struct {
-	appID            string
+	link             *coordinatorLink
 	httpServer       *http.Server
 	wsClients        map[string]*cws.Client
 	chat             *textchat.TextChat
-	discoveryHandler *discoveryHandler
+	discoveryHandler registry
 	appMeta          appDiscoveryMeta
-	cappServer       *cloudapp.Server
+	// cappServer is nil on relays
+	cappServer *cloudapp.Server
+	cfg        config.Config
+	// audience of the user of a request
+	audience func(r *http.Request) catalog.Audience
+	// audiences of ws clients filter the apps they see
+	audiences sync.Map
+	// sticky routes bound browsers to their worker, nil without proxy.sticky
+	sticky *stickyRouter
 }
 
 type discoveryHandler struct {
@@ -70,6 +87,12 @@ type appDiscoveryMeta struct {
 	PageTitle    string `json:"page_title"`
 	ScreenWidth  int    `json:"screen_width"`
 	ScreenHeight int    `json:"screen_height"`
+	MaxInstances int    `json:"max_instances,omitempty"`
+	AgeRating    int    `json:"age_rating,omitempty"`
+	RequiredRole string `json:"required_role,omitempty"`
+	// Saturated and Players are set by discovery from capacity heartbeats
+	Saturated bool `json:"saturated"`
+	Players   int  `json:"players"`
 }
 
 type initData struct {
@@ -81,7 +104,7 @@ type initData struct {
 
 // WSO handles all connections from user/frontend to coordinator
 func (s *Server) WS(w http.ResponseWriter, r *http.Request) {
-	log.Println("A user is connecting...")
+	log.Println("A user is connecting from", r.RemoteAddr)
 	// defer func() {
 	// 	if r := recover(); r != nil {
 	// 		log.Println("Warn: Something wrong. Recovered in ", r)
@@ -102,25 +125,56 @@ func (s *Server) WS(w http.ResponseWriter, r *http.Request) {
 
 	// Create websocket Client
 	wsClient := cws.NewClient(c)
+	if s.cfg.WSCompression.Enabled {
+		if err := wsClient.Compress(s.cfg.WSCompression.Threshold, s.cfg.WSCompression.Level); err != nil {
+			log.Println("Coordinator: [!] WS compression:", err)
+		}
+	}
+	// Banned users are kept out of the chat and lobby as well
+	if s.cappServer != nil {
+		if ban, ok := s.cappServer.Banned(r); ok {
+			log.Println("Reject banned user from", r.RemoteAddr)
+			wsClient.Send(cloudapp.BannedPacket(ban), nil)
+			wsClient.Close()
+			return
+		}
+	}
 	// clientID := wsClient.GetID()
 	s.wsClients[wsClient.GetID()] = wsClient
-	// Add websocket client to chat service
-	// DEPRECATED because we use external chat
-	// chatClient := s.chat.AddClient(clientID, wsClient)
-	// chatClient.Route()
+	s.audiences.Store(wsClient.GetID(), s.audience(r))
+	// Add websocket client to chat service. The admin token in mod param makes the client a moderator
+	mod := r.URL.Query().Get("mod")
+	moderator := s.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(mod), []byte(s.cfg.AdminToken)) == 1
+	chatClient := s.chat.AddClient(wsClient.GetID(), wsClient, s.chatRoom(r.URL.Query().Get("room")), moderator)
+	chatClient.Route()
 	log.Println("Initialized Chat")
 	// TODO: Update packet
 	// Add websocket client to app service
 	log.Println("Initialized ServiceClient")
 
 	s.initClientData(wsClient)
-	go func(browserClient *cws.Client) {
-		browserClient.Listen()
+	crash.Go("coordinator client", func() {
+		wsClient.Listen()
 		log.Println("Closing connection")
-		// chatClient.Close()
-		browserClient.Close()
+		chatClient.Close()
+		s.chat.RemoveClient(wsClient.GetID())
+		s.audiences.Delete(wsClient.GetID())
+		wsClient.Close()
 		log.Println("Closed connection")
-	}(wsClient)
+	}, "client", wsClient.GetID())
+}
+
+// chatRoom is the room of the app instance. The instance address is used because appID changes on re-register.
+// Players of a room of the app, see rooms in the config, chat among themselves
+func (s *Server) chatRoom(appRoom string) string {
+	room := s.cfg.AppName
+	if s.cfg.InstanceAddr != "" {
+		room = s.cfg.InstanceAddr
+	}
+	if appRoom != "" && s.cfg.Rooms.Max > 0 {
+		room += "#" + appRoom
+	}
+	return room
 }
 
 func (s *Server) initClientData(client *cws.Client) {
@@ -130,9 +184,9 @@ func (s *Server) initClientData(client *cws.Client) {
 		apps = []appDiscoveryMeta{}
 	}
 	data := initData{
-		CurAppID: s.appID,
+		CurAppID: s.link.appID(),
 		App:      s.appMeta,
-		Apps:     apps,
+		Apps:     s.visibleApps(client.GetID(), apps),
 	}
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -146,26 +200,49 @@ func (s *Server) initClientData(client *cws.Client) {
 }
 
 func (s *Server) updateClientApps(client *cws.Client, updatedApps []appDiscoveryMeta) {
-	data, _ := json.Marshal(updatedApps)
+	data, _ := json.Marshal(s.visibleApps(client.GetID(), updatedApps))
 	client.Send(cws.WSPacket{
 		Type: "UPDATEAPPLIST",
 		Data: string(data),
 	}, nil)
 }
 
+// visibleApps filters out apps restricted by age or role for the client
+func (s *Server) visibleApps(clientID string, apps []appDiscoveryMeta) []appDiscoveryMeta {
+	v, _ := s.audiences.Load(clientID)
+	audience, _ := v.(catalog.Audience)
+	return allowedApps(apps, audience)
+}
+
+func allowedApps(apps []appDiscoveryMeta, audience catalog.Audience) []appDiscoveryMeta {
+	allowed := []appDiscoveryMeta{}
+	for _, app := range apps {
+		if (catalog.ContentControls{AgeRating: app.AgeRating, RequiredRole: app.RequiredRole}).Allows(audience) {
+			allowed = append(allowed, app)
+		}
+	}
+	return allowed
+}
+
 func (s *Server) registerIfMissing(updatedApps []appDiscoveryMeta) {
+	if s.cfg.Relay || s.cappServer.IsDraining() {
+		return
+	}
 	for _, app := range updatedApps {
 		if app.Addr == s.appMeta.Addr {
 			return
 		}
 	}
 	log.Println("Server is not found in Discovery. Re-Register")
-	s.RegisterApp(s.appMeta)
+	s.link.markLost()
 }
 
 func (s *Server) ListenAppListUpdate() {
 	for updatedApps := range s.AppListUpdate() {
 		log.Println("Get updated apps: ", updatedApps, s.wsClients)
+		if s.sticky != nil {
+			s.sticky.update(updatedApps)
+		}
 		for _, client := range s.wsClients {
 			s.updateClientApps(client, updatedApps)
 		}
@@ -173,26 +250,34 @@ func (s *Server) ListenAppListUpdate() {
 	}
 }
 
-func NewServer() *Server {
-	cfg, err := config.ReadConfig(configFilePath)
-	if err != nil {
-		panic(err)
-	}
+func NewServer(cfg config.Config) *Server {
 	log.Printf("Config: %+v", cfg)
+	if err := crash.Setup(cfg.Crash); err != nil {
+		log.Println("Crash reporting is disabled:", err)
+	}
+	upgrader.EnableCompression = cfg.WSCompression.Enabled
 
 	server := &Server{
 		wsClients:        map[string]*cws.Client{},
-		discoveryHandler: NewDiscovery(cfg.DiscoveryHost),
+		discoveryHandler: newRegistry(cfg),
+		cfg:              cfg,
 	}
+	server.link = newCoordinatorLink(server, cfg.Reconnect, time.Duration(cfg.Capacity.HeartbeatInterval)*time.Second)
 
 	r := mux.NewRouter()
 	r.HandleFunc("/wscloudmorph", server.WS)
+	// Registered before the cloudapp routes, the pages of the coordinator connect to its websocket
+	r.HandleFunc("/config.json", server.handleRuntimeConfig).Methods(http.MethodGet)
 	r.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 	})
-	if cfg.DiscoveryHost != "" {
+	if cfg.HasDiscovery() {
 		r.HandleFunc("/apps", server.GetAppsHandler)
 	}
+	// Registered before the cloudapp admin API, which takes the rest of /api/admin
+	r.Handle("/api/admin/chat/export", server.requireAdmin(http.HandlerFunc(server.handleChatExport))).Methods(http.MethodGet)
+	r.Handle("/api/admin/reports", server.requireAdmin(http.HandlerFunc(server.handleListReports))).Methods(http.MethodGet)
+	r.Handle("/api/admin/reports/{id}", server.requireAdmin(http.HandlerFunc(server.handleUpdateReport))).Methods(http.MethodPatch)
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./web"))))
 	r.HandleFunc("/embed",
 		func(w http.ResponseWriter, r *http.Request) {
@@ -201,24 +286,57 @@ func NewServer() *Server {
 				log.Fatal(err)
 			}
 
-			tmpl.Execute(w, nil)
+			tmpl.Execute(w, server.runtimeConfig(r))
 		},
 	)
 	svmux := &http.ServeMux{}
 
-	// Spawn a separated server running CloudApp
-	log.Println("Spawn cloudapp server")
-	cappServer := cloudapp.NewServerWithHTTPServerMux(cfg, r, svmux)
-	server.cappServer = cappServer
-	cappServer.Handle()
+	if cfg.Relay {
+		// Relays have no app to capture, users join the workers of discovery
+		log.Println("Running as relay of", cfg.DiscoveryHost, cfg.Registry.Endpoints)
+		server.audience = cloudapp.TokenAudience(cfg.TokenSecret)
+	} else {
+		// Spawn a separated server running CloudApp
+		log.Println("Spawn cloudapp server")
+		cappServer := cloudapp.NewServerWithHTTPServerMux(cfg, r, svmux)
+		server.cappServer = cappServer
+		server.audience = cappServer.Audience
+		cappServer.Handle()
+		if cfg.HasDiscovery() {
+			cappServer.SetAppLoad(server.appLoad)
+		}
+		// Leave discovery when draining so the coordinator routes new users elsewhere
+		cappServer.OnDrain(func() {
+			if err := server.RemoveApp(server.link.appID()); err != nil {
+				log.Println(err)
+			}
+		})
+		// and come back when the drain is called off, e.g. by a failed migration
+		cappServer.OnResume(func() {
+			if cfg.HasDiscovery() {
+				server.link.markLost()
+				return
+			}
+			appID, err := server.RegisterApp(server.appMeta)
+			if err != nil {
+				log.Println(err)
+			}
+			server.link.setAppID(appID)
+		})
+	}
 
+	// Kiosk visitors go straight to the app page without lobby and chat
+	page := indexPage
+	if cfg.Kiosk.Enabled {
+		page = embedPage
+	}
 	r.PathPrefix("/").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			tmpl, err := template.ParseFiles(indexPage)
+			tmpl, err := template.ParseFiles(page)
 			if err != nil {
 				log.Fatal(err)
 			}
-			if err := tmpl.Execute(w, cfg); err != nil {
+			if err := tmpl.Execute(w, server.runtimeConfig(r)); err != nil {
 				log.Fatal(err)
 			}
 		},
@@ -227,16 +345,54 @@ func NewServer() *Server {
 	svmux.Handle("/", r)
 	// go cappServer.ListenAndServe()
 
+	var handler http.Handler = svmux
+	if cfg.Proxy.Sticky {
+		node := cfg.InstanceAddr
+		if cfg.Relay {
+			node = ""
+		}
+		var transport http.RoundTripper = http.DefaultTransport
+		if cfg.FleetTLS.IsEnabled() {
+			fleet, err := mtls.ClientConfig(cfg.FleetTLS)
+			if err != nil {
+				log.Fatal("Cannot load the fleet certificate: ", err)
+			}
+			transport = fleetTransport(fleet)
+		}
+		server.sticky = newStickyRouter(cfg.TokenSecret, node, stickyScheme(cfg.TLS.IsEnabled()), cfg.Proxy.BasePath, transport)
+		handler = server.sticky.Handler(svmux)
+	}
 	httpServer := &http.Server{
-		Addr:         addr,
+		Addr:         cfg.Addr,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		IdleTimeout:  120 * time.Second,
-		Handler:      svmux,
+		Handler:      proxy.Handler(cfg.Proxy, handler),
+	}
+	// Downloads of the worker, e.g. recordings and clips, outlast the write timeout
+	cloudapp.TrackConns(httpServer)
+	if cfg.FleetTLS.IsEnabled() && cfg.TLS.IsEnabled() {
+		// Workers calling each other present the fleet certificate, browsers have none
+		tlsConfig, err := mtls.VerifyIfGiven(cfg.FleetTLS)
+		if err != nil {
+			log.Fatal("Cannot load the fleet CA: ", err)
+		}
+		httpServer.TLSConfig = tlsConfig
 	}
 	server.httpServer = httpServer
 
-	server.chat = textchat.NewTextChat()
+	chatStore, err := store.Open(filepath.Join(cfg.DataDir, "chat.json"))
+	if err != nil {
+		log.Println("Chat history is not persisted:", err)
+	}
+	server.chat = textchat.NewTextChat(chatStore, cfg.Chat)
+	if server.cappServer != nil {
+		server.chat.PublishTo(server.cappServer.Events())
+	}
+	if cfg.Relay {
+		crash.Go("app list update", server.ListenAppListUpdate)
+		return server
+	}
 	appMeta := appDiscoveryMeta{
 		Addr:         cfg.InstanceAddr,
 		AppName:      cfg.AppName,
@@ -245,25 +401,36 @@ func NewServer() *Server {
 		PageTitle:    cfg.PageTitle,
 		ScreenWidth:  cfg.ScreenWidth,
 		ScreenHeight: cfg.ScreenHeight,
+		MaxInstances: cfg.MaxInstances,
+		AgeRating:    cfg.AgeRating,
+		RequiredRole: cfg.RequiredRole,
 	}
 	fmt.Println("appMeta", appMeta)
 
-	appID, err := server.RegisterApp(appMeta)
-	if err != nil {
-		log.Println(err)
-	}
-	server.appID = appID
 	server.appMeta = appMeta
-	log.Println("Registered with AppID", server.appID)
 
-	if cfg.DiscoveryHost != "" {
-		go server.ListenAppListUpdate()
+	if !cfg.HasDiscovery() || cfg.Relay {
+		appID, err := server.RegisterApp(appMeta)
+		if err != nil {
+			log.Println(err)
+		}
+		server.link.setAppID(appID)
+		log.Println("Registered with AppID", appID)
+		if cfg.HasDiscovery() {
+			crash.Go("app list update", server.ListenAppListUpdate)
+		}
+		return server
 	}
+	crash.Go("app list update", server.ListenAppListUpdate)
+	crash.Go("discovery link", server.link.run)
 	return server
 }
 
 func (o *Server) Shutdown() {
-	err := o.RemoveApp(o.appID)
+	if o.cfg.Relay {
+		return
+	}
+	err := o.RemoveApp(o.link.appID())
 	if err != nil {
 		log.Println(err)
 	}
@@ -271,49 +438,39 @@ func (o *Server) Shutdown() {
 
 func (o *Server) Handle() {
 	// Spawn Chat Handle
-	go o.chat.Handle()
+	crash.Go("chat", o.chat.Handle)
 }
 
 func (o *Server) ListenAndServe() error {
-	log.Println("Server is running at", addr)
-	return o.httpServer.ListenAndServe()
-}
-
-func monitor() {
-	monitoringServerMux := http.NewServeMux()
-
-	srv := http.Server{
-		Addr:    fmt.Sprintf(":%d", 3535),
-		Handler: monitoringServerMux,
+	ln, err := listener.Listen(o.httpServer.Addr)
+	if err != nil {
+		return err
 	}
-	log.Println("Starting monitoring server at", srv.Addr)
-
-	pprofPath := fmt.Sprintf("/debug/pprof")
-	log.Println("Profiling is enabled at", srv.Addr+pprofPath)
-	monitoringServerMux.Handle(pprofPath+"/", http.HandlerFunc(pprof.Index))
-	monitoringServerMux.Handle(pprofPath+"/cmdline", http.HandlerFunc(pprof.Cmdline))
-	monitoringServerMux.Handle(pprofPath+"/profile", http.HandlerFunc(pprof.Profile))
-	monitoringServerMux.Handle(pprofPath+"/symbol", http.HandlerFunc(pprof.Symbol))
-	monitoringServerMux.Handle(pprofPath+"/trace", http.HandlerFunc(pprof.Trace))
-	// pprof handler for custom pprof path needs to be explicitly specified, according to: https://github.com/gin-contrib/pprof/issues/8 . Don't know why this is not fired as ticket
-	// https://golang.org/src/net/http/pprof/pprof.go?s=7411:7461#L305 only render index page
-	monitoringServerMux.Handle(pprofPath+"/allocs", pprof.Handler("allocs"))
-	monitoringServerMux.Handle(pprofPath+"/block", pprof.Handler("block"))
-	monitoringServerMux.Handle(pprofPath+"/goroutine", pprof.Handler("goroutine"))
-	monitoringServerMux.Handle(pprofPath+"/heap", pprof.Handler("heap"))
-	monitoringServerMux.Handle(pprofPath+"/mutex", pprof.Handler("mutex"))
-	monitoringServerMux.Handle(pprofPath+"/threadcreate", pprof.Handler("threadcreate"))
-	go srv.ListenAndServe()
-
+	log.Println("Server is running at", o.httpServer.Addr)
+	if o.cfg.TLS.IsEnabled() {
+		return o.httpServer.ServeTLS(ln, o.cfg.TLS.CertFile, o.cfg.TLS.KeyFile)
+	}
+	return o.httpServer.Serve(ln)
 }
 
-func main() {
+// serve runs the coordinator until it's stopped or drained
+func serve(cfg config.Config) {
 	// HTTP server
 	// TODO: Make the communication over websocket
 	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets"))))
-	monitor()
-	server := NewServer()
+	server := NewServer(cfg)
+	if mon := monitoring.NewServer(server.cfg); mon != nil {
+		mon.Run()
+	}
 	server.Handle()
+	if cfg.MediaRelay.Port != 0 {
+		relay, err := startMediaRelay(cfg.MediaRelay, cfg.TokenSecret)
+		if err != nil {
+			log.Fatal("Cannot start the media relay: ", err)
+		}
+		defer relay.Close()
+		log.Printf("Media relay is running at %s:%d", cfg.MediaRelay.PublicIP, cfg.MediaRelay.Port)
+	}
 
 	go func() {
 		err := server.ListenAndServe()
@@ -324,34 +481,48 @@ func main() {
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
-	select {
-	case <-stop:
+	if cfg.Relay {
+		<-stop
 		log.Println("Received SIGTERM, Quiting")
-		server.Shutdown()
+		return
+	}
+
+	preemption.Watch(server.cfg.Preemption, func(notice preemption.Notice) {
+		if err := server.discoveryHandler.ReportReclaimed(server.link.appID(), notice); err != nil {
+			log.Println(err)
+		}
+		server.cappServer.Evacuate(server.cfg.Preemption.MigrateTarget, notice.Time)
+	})
+	drain := cloudapp.DrainSignal()
+	for {
+		select {
+		case <-stop:
+			log.Println("Received SIGTERM, Quiting")
+			server.Shutdown()
+			return
+		case <-drain:
+			log.Println("Received SIGUSR1, Draining")
+			server.cappServer.Drain()
+		case <-server.cappServer.Drained():
+			log.Println("Drained, Quiting")
+			server.Shutdown()
+			return
+		}
 	}
 }
 
-// Encode encodes the input in base64
-// It can optionally zip the input before encoding
+// Encode encodes the input in base64, see webrtc.EncodeCompressed to compress it
 func Encode(obj interface{}) string {
-	b, err := json.Marshal(obj)
+	encoded, err := webrtc.Encode(obj)
 	if err != nil {
 		panic(err)
 	}
-
-	return base64.StdEncoding.EncodeToString(b)
+	return encoded
 }
 
-// Decode decodes the input from base64
-// It can optionally unzip the input after decoding
+// Decode decodes the input from base64, gzip and deflate payloads are decompressed
 func Decode(in string, obj interface{}) {
-	b, err := base64.StdEncoding.DecodeString(in)
-	if err != nil {
-		panic(err)
-	}
-
-	err = json.Unmarshal(b, obj)
-	if err != nil {
+	if err := webrtc.Decode(in, obj); err != nil {
 		panic(err)
 	}
 }
@@ -365,13 +536,119 @@ func NewDiscovery(discoveryHost string) *discoveryHandler {
 	}
 }
 
+// requireAdmin allows only requests with the admin token, all are refused without the token
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	if s.cfg.AdminToken == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "admin API is disabled", http.StatusForbidden)
+		})
+	}
+	return monitoring.RequireAuth("", "", s.cfg.AdminToken, next)
+}
+
+// handleChatExport writes the chat history of a room as JSON or CSV.
+// Query: room (default: this instance), from and to in RFC3339, format json or csv
+func (s *Server) handleChatExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	room := q.Get("room")
+	if room == "" {
+		room = s.chatRoom("")
+	}
+	var from, to time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "invalid "+p.name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*p.t = t
+		}
+	}
+	msgs := s.chat.Export(room, from, to)
+
+	filename := fmt.Sprintf("chat-%s", time.Now().UTC().Format("20060102-150405"))
+	switch q.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		if err := json.NewEncoder(w).Encode(msgs); err != nil {
+			log.Println("Failed to export chat", err)
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		if err := textchat.WriteCSV(w, msgs); err != nil {
+			log.Println("Failed to export chat", err)
+		}
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+	}
+}
+
+// handleListReports lists the abuse reports of the chat, query status filters them, e.g. open
+func (s *Server) handleListReports(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.chat.Reports(r.URL.Query().Get("status"))); err != nil {
+		log.Println("Failed to list reports", err)
+	}
+}
+
+// handleUpdateReport resolves or dismisses a report with a note of the moderator
+func (s *Server) handleUpdateReport(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := s.chat.UpdateReport(mux.Vars(r)["id"], body.Status, body.Note)
+	switch err {
+	case nil:
+	case textchat.ErrReportNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case textchat.ErrReportStatus:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Println("Report", report.ID, "is", report.Status)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// runtimeConfig is the runtime config of the pages of the coordinator, which connect to its websocket
+func (s *Server) runtimeConfig(r *http.Request) cloudapp.RuntimeConfig {
+	c := cloudapp.NewRuntimeConfig(s.cfg)
+	if s.cappServer != nil {
+		c = s.cappServer.RuntimeConfig(r)
+	}
+	c.WSEndpoint = "/wscloudmorph"
+	return c
+}
+
+func (s *Server) handleRuntimeConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.runtimeConfig(r)); err != nil {
+		log.Println("Failed to write runtime config", err)
+	}
+}
+
 func (s *Server) GetAppsHandler(w http.ResponseWriter, r *http.Request) {
 	apps, err := s.GetApps()
 	if err != nil {
 		log.Println(err)
 	}
 
-	appsJSON, _ := json.Marshal(apps)
+	appsJSON, _ := json.Marshal(allowedApps(apps, s.audience(r)))
 	packet := ws.Packet{
 		PType: "UPDATEAPPLIST",
 		Data:  string(appsJSON),
@@ -381,6 +658,25 @@ func (s *Server) GetAppsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(packetBytes)
 }
 
+// appLoad counts the instances registered in discovery and their players by app name for the lobby
+func (s *Server) appLoad() (map[string]cloudapp.AppLoad, error) {
+	apps, err := s.GetApps()
+	if err != nil {
+		return nil, err
+	}
+	loads := map[string]cloudapp.AppLoad{}
+	for _, app := range apps {
+		load := loads[app.AppName]
+		load.Instances++
+		load.Players += app.Players
+		if !app.Saturated {
+			load.Available++
+		}
+		loads[app.AppName] = load
+	}
+	return loads, nil
+}
+
 func (s *Server) GetApps() ([]appDiscoveryMeta, error) {
 	return s.discoveryHandler.GetApps()
 }
@@ -390,7 +686,7 @@ func (s *Server) RegisterApp(meta appDiscoveryMeta) (string, error) {
 }
 
 func (s *Server) RemoveApp(appID string) error {
-	return s.discoveryHandler.Remove(s.appID)
+	return s.discoveryHandler.Remove(appID)
 }
 
 func (s *Server) AppListUpdate() chan []appDiscoveryMeta {
@@ -432,7 +728,7 @@ func (d *discoveryHandler) isNeedAppListUpdate(newApps []appDiscoveryMeta) bool
 
 func (d *discoveryHandler) AppListUpdate() chan []appDiscoveryMeta {
 	updatedApps := make(chan []appDiscoveryMeta, 1)
-	go func() {
+	crash.Go("discovery poll", func() {
 		// TODO: Change to subscription based
 		for range time.Tick(5 * time.Second) {
 			newApps, err := d.GetApps()
@@ -447,7 +743,7 @@ func (d *discoveryHandler) AppListUpdate() chan []appDiscoveryMeta {
 				copy(d.apps, newApps)
 			}
 		}
-	}()
+	})
 
 	return updatedApps
 }
@@ -465,6 +761,10 @@ func (d *discoveryHandler) Register(meta appDiscoveryMeta) (string, error) {
 	defer func() {
 		resp.Body.Close()
 	}()
+	if resp.StatusCode != http.StatusOK {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Failed to register app. Err: %s", bytes.TrimSpace(reason))
+	}
 	var appID string
 	err = json.NewDecoder(resp.Body).Decode(&appID)
 	if err != nil {
@@ -488,3 +788,50 @@ func (d *discoveryHandler) Remove(appID string) error {
 
 	return err
 }
+
+// Heartbeat sends the capacity of the app instance to discovery
+func (d *discoveryHandler) Heartbeat(appID string, report capacity.Report) error {
+	reqBytes, err := json.Marshal(struct {
+		AppID    string          `json:"app_id"`
+		Capacity capacity.Report `json:"capacity"`
+	}{appID, report})
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.httpClient.Post(d.discoveryHost+"/heartbeat", "application/json", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return fmt.Errorf("Failed to send heartbeat. Err: %s", err.Error())
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		// Discovery lost the worker, e.g. its storage was reset
+		return errNotRegistered
+	}
+	return fmt.Errorf("Failed to send heartbeat. Status: %s", resp.Status)
+}
+
+// ReportReclaimed tells discovery the instance of the app is reclaimed by the cloud provider
+func (d *discoveryHandler) ReportReclaimed(appID string, notice preemption.Notice) error {
+	if d.discoveryHost == "" {
+		return nil
+	}
+	reqBytes, err := json.Marshal(struct {
+		AppID string `json:"app_id"`
+		preemption.Notice
+	}{appID, notice})
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.httpClient.Post(d.discoveryHost+"/reclaimed", "application/json", bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return fmt.Errorf("Failed to report reclaimed instance. Err: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	return nil
+}
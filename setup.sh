@@ -9,7 +9,7 @@ apt-get update
 curl -fsSL https://get.docker.com -o get-docker.sh
 sh get-docker.sh
 apt-get install -y golang-go
-go build server.go
+go build -o server .
 mkdir -p ./winvm/apps/
 cd ./winvm
 docker build . -t syncwine
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/giongto35/cloud-morph/pkg/common/token"
+)
+
+const (
+	// stickyCookie binds the browser to the node of its session
+	stickyCookie = "cloudmorph_node"
+	stickyKind   = "node"
+	stickyTTL    = 12 * time.Hour
+	// stickyHeader marks requests forwarded by another node, they are never forwarded again
+	stickyHeader = "X-Cloudmorph-Forwarded"
+)
+
+type stickyClaims struct {
+	token.Claims
+	// Node is the instance address of the worker
+	Node string `json:"node"`
+}
+
+// stickyRouter keeps users on the worker of their session when a load balancer spreads them over the nodes.
+// Workers bind the browser with a signed cookie when the page loads, other nodes forward its requests
+// to that worker as long as discovery lists it
+type stickyRouter struct {
+	signer *token.Signer
+	// transport presents the fleet certificate to the workers
+	transport http.RoundTripper
+	// node is the instance address of this node, empty on relays, which serve no sessions
+	node     string
+	scheme   string
+	basePath string
+
+	mu sync.Mutex
+	// proxies of the workers discovery lists by instance address
+	proxies map[string]*httputil.ReverseProxy
+}
+
+func newStickyRouter(secret, node, scheme, basePath string, transport http.RoundTripper) *stickyRouter {
+	return &stickyRouter{
+		signer:    token.NewSigner(secret),
+		transport: transport,
+		node:      node,
+		scheme:    scheme,
+		basePath:  basePath,
+		proxies:   map[string]*httputil.ReverseProxy{},
+	}
+}
+
+// update replaces the workers requests are forwarded to
+func (s *stickyRouter) update(apps []appDiscoveryMeta) {
+	proxies := map[string]*httputil.ReverseProxy{}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, app := range apps {
+		if app.Addr == "" || app.Addr == s.node {
+			continue
+		}
+		if p, ok := s.proxies[app.Addr]; ok {
+			proxies[app.Addr] = p
+			continue
+		}
+		target := &url.URL{Scheme: s.scheme, Host: app.Addr, Path: s.basePath}
+		p := httputil.NewSingleHostReverseProxy(target)
+		p.Transport = s.transport
+		director := p.Director
+		p.Director = func(r *http.Request) {
+			director(r)
+			r.Header.Set(stickyHeader, "1")
+		}
+		proxies[app.Addr] = p
+	}
+	s.proxies = proxies
+}
+
+// proxy returns the proxy of the worker bound to the request, nil to serve it here
+func (s *stickyRouter) proxy(r *http.Request) *httputil.ReverseProxy {
+	if r.Header.Get(stickyHeader) != "" {
+		return nil
+	}
+	cookie, err := r.Cookie(stickyCookie)
+	if err != nil {
+		return nil
+	}
+	var claims stickyClaims
+	if err := s.signer.Verify(cookie.Value, stickyKind, &claims); err != nil || claims.Node == s.node {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proxies[claims.Node]
+}
+
+// bind sets the cookie binding the browser to this worker
+func (s *stickyRouter) bind(w http.ResponseWriter, r *http.Request) {
+	value, err := s.signer.Sign(stickyClaims{
+		Claims: token.Claims{Kind: stickyKind, Exp: time.Now().Add(stickyTTL).Unix()},
+		Node:   s.node,
+	})
+	if err != nil {
+		log.Println("Cannot sign the node cookie:", err)
+		return
+	}
+	path := s.basePath
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stickyCookie,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(stickyTTL / time.Second),
+		HttpOnly: true,
+		Secure:   s.scheme == "https" || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Handler forwards the requests of browsers bound to another worker, and binds browsers loading a page of this one
+func (s *stickyRouter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := s.proxy(r); p != nil {
+			p.ServeHTTP(w, r)
+			return
+		}
+		if s.node != "" && r.Method == http.MethodGet && isPage(r.URL.Path) {
+			s.bind(w, r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isPage returns if the path loads a page starting a session, static files and APIs don't
+func isPage(path string) bool {
+	return path == "/" || path == "/embed" || path == "/kiosk"
+}
+
+// stickyScheme is the scheme the nodes serve with, they share the TLS config
+func stickyScheme(tlsEnabled bool) string {
+	if tlsEnabled {
+		return "https"
+	}
+	return "http"
+}
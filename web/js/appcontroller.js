@@ -11,6 +11,28 @@
   const appd = document.getElementById("app");
   const appTitle = document.getElementById("app-title");
   const appScreen = document.getElementById("app-screen");
+  const appAnnouncement = document.getElementById("app-announcement");
+  const appShare = document.getElementById("app-share");
+  const appClip = document.getElementById("app-clip");
+  const appScreenshot = document.getElementById("app-screenshot");
+  const appAudio = document.getElementById("app-audio");
+  const appWindows = document.getElementById("app-windows");
+  const appRefocus = document.getElementById("app-refocus");
+  // targets of window capture besides window IDs
+  const CAPTURE_TARGETS = ["screen", "app", "focused", "all"];
+  const appMacros = document.getElementById("app-macros");
+  const appAssist = document.getElementById("app-assist");
+  const appAssistIndicator = document.getElementById("app-assist-indicator");
+  const appTurn = document.getElementById("app-turn");
+  const appTurnStatus = document.getElementById("app-turn-status");
+  const appTurnRequest = document.getElementById("app-turn-request");
+  const appQuality = document.getElementById("app-quality");
+  // Admins watch invisibly and take control to assist
+  let isAdmin = false;
+  let inControl = false;
+  let announcementTimer;
+  // Viewers of a share link watch the session without input
+  let viewOnly = false;
 
   var offerst;
 
@@ -39,6 +61,7 @@
   };
 
   const onKeyPress = (data) => {
+    if (viewOnly) return;
     rtcp.input(
       JSON.stringify({
         type: "KEYDOWN",
@@ -50,6 +73,7 @@
   };
 
   const onKeyRelease = (data) => {
+    if (viewOnly) return;
     rtcp.input(
       JSON.stringify({
         type: "KEYUP",
@@ -62,6 +86,7 @@
 
   const onMouseDown = (data) => {
     appScreen.muted = false;
+    if (viewOnly) return;
     rtcp.input(
       JSON.stringify({
         type: "MOUSEDOWN",
@@ -71,6 +96,7 @@
   };
 
   const onMouseUp = (data) => {
+    if (viewOnly) return;
     rtcp.input(
       JSON.stringify({
         type: "MOUSEUP",
@@ -80,6 +106,7 @@
   };
 
   const onMouseMove = (data) => {
+    if (viewOnly) return;
     rtcp.input(
       JSON.stringify({
         type: "MOUSEMOVE",
@@ -89,6 +116,12 @@
   };
 
   document.addEventListener("keydown", (e) => {
+    // Ctrl+Shift+S toggles the stats HUD instead of going to the app
+    if (e.ctrlKey && e.shiftKey && e.code === "KeyS") {
+      e.preventDefault();
+      event.pub(STATS_TOGGLE);
+      return;
+    }
     //if (
       //document.activeElement === username ||
       //document.activeElement === chatmessage
@@ -141,6 +174,301 @@
     });
   });
 
+  // The app doesn't get key up of keys released outside the tab, the server releases held keys on blur
+  const onBlur = () => {
+    if (viewOnly || !rtcp.isInputReady()) return;
+    rtcp.input(JSON.stringify({ type: "BLUR" }));
+  };
+  window.addEventListener("blur", onBlur);
+  document.addEventListener("visibilitychange", () => {
+    if (document.hidden) onBlur();
+  });
+
+  const showAnnouncement = (ann) => {
+    clearInterval(announcementTimer);
+    appAnnouncement.className = `announcement ${ann.level}`;
+    const render = () => {
+      let text = ann.message;
+      if (ann.disconnect_at) {
+        const secs = Math.max(0, Math.round((new Date(ann.disconnect_at) - Date.now()) / 1000));
+        text += ` (disconnecting in ${secs}s)`;
+      }
+      appAnnouncement.innerText = text;
+    };
+    render();
+    if (ann.disconnect_at) {
+      announcementTimer = setInterval(render, 1000);
+    } else {
+      announcementTimer = setTimeout(() => appAnnouncement.className = "announcement hidden", 10000);
+    }
+  };
+
+  // The worker is going down and moved the session, reconnect to the new worker
+  const MIGRATION_TIMEOUT_MS = 30000;
+  let migrationTimer;
+  const onMigrating = ({ protocol, addr }) => {
+    log.info(`[control] session is moving to ${addr}`);
+    showAnnouncement({ level: "maintenance", message: "Reconnecting to the new server..." });
+    rtcp.stop();
+    clearTimeout(migrationTimer);
+    migrationTimer = setTimeout(
+      () => showAnnouncement({ level: "warning", message: "Could not reconnect to the new server. Please refresh" }),
+      MIGRATION_TIMEOUT_MS
+    );
+    socket.connect(protocol, addr);
+  };
+
+  // A dropped websocket reconnects while the peer connection runs on, the worker hands the stream over
+  // to the new session and the page restarts ICE. Otherwise the stream starts cold
+  const RECONNECT_DELAYS_MS = [500, 1000, 2000, 4000, 8000];
+  let reconnects = 0;
+  const onConnectionLost = () => {
+    if (!rtcp.isResumable() || reconnects >= RECONNECT_DELAYS_MS.length) return;
+    showAnnouncement({ level: "maintenance", message: "Connection lost, reconnecting..." });
+    setTimeout(socket.reconnect, RECONNECT_DELAYS_MS[reconnects++]);
+  };
+  const onStreamResumed = () => {
+    reconnects = 0;
+    appAnnouncement.className = "announcement hidden";
+    rtcp.restartIce();
+  };
+
+  appShare.addEventListener("click", () => socket.send({ type: "SHARE_CREATE" }));
+
+  // Audio is renegotiated off and on, no audio is streamed while it's off
+  let audioOn = true;
+  appAudio.addEventListener("click", () => {
+    audioOn = !audioOn;
+    socket.send({ type: "AUDIO", data: audioOn ? "on" : "off" });
+    appAudio.textContent = audioOn ? "Sound off" : "Sound on";
+  });
+
+  appClip.addEventListener("click", () => {
+    socket.send({ type: "CLIP", data: "gif" });
+    showAnnouncement({ level: "info", message: "Clipping the last seconds..." });
+  });
+
+  appScreenshot.addEventListener("click", () => {
+    socket.send({ type: "SCREENSHOT" });
+    showAnnouncement({ level: "info", message: "Taking a screenshot..." });
+  });
+
+  const onMacrosAvailable = (names) => {
+    appMacros.innerHTML = "";
+    const placeholder = document.createElement("option");
+    placeholder.textContent = "Macros";
+    placeholder.value = "";
+    appMacros.appendChild(placeholder);
+    names.forEach((name) => {
+      const option = document.createElement("option");
+      option.textContent = name;
+      option.value = name;
+      appMacros.appendChild(option);
+    });
+    appMacros.classList.remove("hidden");
+  };
+
+  appMacros.addEventListener("change", () => {
+    const name = appMacros.value;
+    appMacros.value = "";
+    if (!name || viewOnly || !rtcp.isInputReady()) return;
+    rtcp.input(JSON.stringify({ type: "MACRO", data: name }));
+  });
+
+  appRefocus.addEventListener("click", () => {
+    if (viewOnly) return;
+    socket.send({ type: "REFOCUS" });
+  });
+
+  // The window list is refreshed whenever the picker is opened
+  appWindows.addEventListener("mousedown", () => socket.send({ type: "WINDOWS" }));
+  appWindows.addEventListener("change", () => {
+    if (viewOnly) return;
+    socket.send({ type: "WINDOW_CAPTURE", data: appWindows.value });
+  });
+
+  const onWindowsListed = ({ windows, capture }) => {
+    Array.from(appWindows.options)
+      .filter((option) => !CAPTURE_TARGETS.includes(option.value))
+      .forEach((option) => option.remove());
+    windows.forEach((w) => {
+      const option = document.createElement("option");
+      option.value = w.id;
+      option.textContent = w.name || `Window ${w.id}`;
+      appWindows.appendChild(option);
+    });
+    onWindowCaptured(capture);
+  };
+
+  const onWindowCaptured = ({ target }) => {
+    if (!Array.from(appWindows.options).some((option) => option.value === target)) {
+      const option = document.createElement("option");
+      option.value = target;
+      option.textContent = `Window ${target}`;
+      appWindows.appendChild(option);
+    }
+    appWindows.value = target;
+  };
+
+  const onClipReady = ({ url }) => {
+    const a = document.createElement("a");
+    a.href = url;
+    a.download = "";
+    a.click();
+    showAnnouncement({ level: "info", message: "Your clip is downloading" });
+  };
+
+  // Files of the bulk channel, e.g. screenshots, are saved as they arrive
+  const onFileReceived = ({ name, blob }) => {
+    const a = document.createElement("a");
+    a.href = URL.createObjectURL(blob);
+    a.download = name;
+    a.click();
+    setTimeout(() => URL.revokeObjectURL(a.href), 1000);
+    showAnnouncement({ level: "info", message: `${name} is saved` });
+  };
+
+  const onShareLinkCreated = (link) => {
+    const message = `View-only link for up to ${link.max_viewers} viewers`;
+    navigator.clipboard
+      .writeText(link.url)
+      .then(() => showAnnouncement({ level: "info", message: `${message} is copied to clipboard` }))
+      .catch(() => showAnnouncement({ level: "info", message: `${message}: ${link.url}` }));
+  };
+
+  // Pages opened with ?audio=only listen to the app, the worker streams no video
+  const audioOnly = new URLSearchParams(location.search).get("audio") === "only";
+
+  const onViewOnly = () => {
+    viewOnly = true;
+    appShare.classList.add("hidden");
+    appClip.classList.add("hidden");
+    appScreenshot.classList.add("hidden");
+    appWindows.classList.add("hidden");
+    appRefocus.classList.add("hidden");
+    showAnnouncement({
+      level: "info",
+      message: audioOnly ? "You are listening to this session" : "You are watching this session",
+    });
+  };
+
+  // Kiosk visitors play the app without sharing or switching what's streamed
+  const onKioskMode = () => {
+    appShare.classList.add("hidden");
+    appClip.classList.add("hidden");
+    appScreenshot.classList.add("hidden");
+    appWindows.classList.add("hidden");
+  };
+
+  // Guests play a capped session, the token resumes it after a reload
+  const onGuestSession = ({ token }) => {
+    sessionStorage.setItem("guest", token);
+  };
+
+  // Banned users see the reason and appeal the ban once, the answer of the admin shows on the next visit
+  const onBanned = ({ id, reason, expires_at, appeal }) => {
+    let message = reason ? `You are banned: ${reason}` : "You are banned";
+    if (!expires_at.startsWith("0001")) message += ` until ${new Date(expires_at).toLocaleString()}`;
+    if (appeal) {
+      message += appeal.status === "rejected" ? `. Your appeal was rejected${appeal.response ? ": " + appeal.response : ""}` : ". Your appeal is pending";
+      showAnnouncement({ level: "maintenance", message });
+      return;
+    }
+    showAnnouncement({ level: "maintenance", message });
+    const text = window.prompt(`${message}\n\nIf you think this is a mistake, tell us why to appeal the ban:`);
+    if (!text) return;
+    fetch(`api/bans/${id}/appeal`, { method: "POST", body: JSON.stringify({ message: text }) })
+      .then((resp) => showAnnouncement({ level: "info", message: resp.ok ? "Your appeal is sent" : "Your appeal could not be sent" }));
+  };
+
+  const onSessionUpgraded = () => {
+    sessionStorage.removeItem("guest");
+    showAnnouncement({ level: "info", message: "You are signed in, enjoy" });
+  };
+
+  // The page embedding the app signs the guest in with a user token of the community site
+  window.addEventListener("message", ({ data }) => {
+    if (data && data.type === "UPGRADE" && data.token) socket.send({ type: "UPGRADE", data: data.token });
+  });
+
+  const onAdminAttached = () => {
+    isAdmin = true;
+    viewOnly = true;
+    appShare.classList.add("hidden");
+    appClip.classList.add("hidden");
+    appScreenshot.classList.add("hidden");
+    appWindows.classList.add("hidden");
+    appRefocus.classList.add("hidden");
+    appAssist.classList.remove("hidden");
+  };
+
+  appAssist.addEventListener("click", () =>
+    socket.send({ type: inControl ? "ASSIST_STOP" : "ASSIST_START" })
+  );
+
+  const onAssistControl = ({ control }) => {
+    inControl = control;
+    viewOnly = !control;
+    appAssist.innerText = control ? "Hand back" : "Take control";
+  };
+
+  // Users see an indicator while an admin has control, their input is ignored
+  const onAssistChanged = ({ active }) => {
+    if (isAdmin) return;
+    appAssistIndicator.classList.toggle("hidden", !active);
+  };
+
+  // Shared rooms with a control queue give input to one player at a time, the turn counts down locally
+  let turnTimer;
+  let inLine = false;
+  appTurnRequest.addEventListener("click", () =>
+    socket.send({ type: inLine ? "CONTROL_RELEASE" : "CONTROL_REQUEST" })
+  );
+  const onControlQueue = ({ queue, remaining, frozen, position }) => {
+    inLine = position >= 0;
+    appTurn.classList.remove("hidden");
+    appTurnRequest.classList.toggle("hidden", isAdmin || viewOnly);
+    appTurnRequest.innerText = inLine ? "Release control" : "Request control";
+    const render = () => {
+      if (!queue.length) {
+        appTurnStatus.innerText = "Nobody has control";
+        return;
+      }
+      let status = position === 0 ? "Your turn" : `${queue[0].name}'s turn`;
+      status += frozen ? " (paused)" : `, ${remaining}s left`;
+      if (position > 0) status += `, you are #${position} in line`;
+      appTurnStatus.innerText = status;
+    };
+    clearInterval(turnTimer);
+    render();
+    if (frozen || !queue.length) return;
+    turnTimer = setInterval(() => {
+      remaining = Math.max(0, remaining - 1);
+      render();
+    }, 1000);
+  };
+
+  // The server rates the link, so users know a frozen picture is their connection
+  const qualityTitles = {
+    good: "Connection is good",
+    degraded: "Connection is unstable",
+    bad: "Connection is poor",
+  };
+  const onLinkQuality = ({ level, rtt, loss }) => {
+    appQuality.className = `quality ${level}`;
+    appQuality.title = `${qualityTitles[level]} (RTT ${rtt}ms, loss ${loss}%)`;
+    if (level === "bad") {
+      showAnnouncement({
+        level: "warning",
+        message: "Your connection is poor. Try a lower resolution or a wired network",
+      });
+    }
+  };
+
+  appAnnouncement.addEventListener("click", () => {
+    if (!appAnnouncement.classList.contains("maintenance")) appAnnouncement.className = "announcement hidden";
+  });
+
   document.addEventListener(
     "contextmenu",
     function (e) {
@@ -162,6 +490,25 @@
   );
   event.sub(MEDIA_STREAM_CANDIDATE_FLUSH, () => rtcp.flushCandidate());
   event.sub(MEDIA_STREAM_READY, () => rtcp.start());
+  event.sub(MEDIA_STREAM_FALLBACK, () => webcodecs.start(appScreen));
+  event.sub(MEDIA_STREAM_RELAY, (data) => rtcp.relay(data.iceservers));
+  event.sub(MEDIA_STREAM_RELAY_FAILED, () => rtcp.relayFailed());
+  event.sub(MEDIA_STREAM_SPECTATOR_FALLBACK, () => {
+    rtcp.stop();
+    webcodecs.start(appScreen);
+  });
+  event.sub(MEDIA_STREAM_RESUMED, onStreamResumed);
+  event.sub(MEDIA_STREAM_RESUME_FAILED, () => {
+    reconnects = 0;
+    appAnnouncement.className = "announcement hidden";
+    rtcp.resumeFailed();
+  });
+  event.sub(MEDIA_STREAM_REANSWER, (data) => rtcp.setRemoteAnswer(data.sdp).catch(log.error));
+  event.sub(CONNECTION_LOST, onConnectionLost);
+  event.sub(MEDIA_STREAM_SFU, ({ data }) => {
+    rtcp.stop();
+    sfu.start(data, appScreen);
+  });
   event.sub(CONNECTION_READY, onConnectionReady);
   //event.sub(NUM_PLAYER, ({ data }) => updateNumPlayers(data));
   //event.sub(CLIENT_INIT, ({ data }) => {
@@ -171,10 +518,48 @@
     //updateAppList(JSON.parse(data));
   //});
   // event.sub(CONNECTION_CLOSED, () => input.poll().disable());
+  event.sub(ANNOUNCEMENT, ({ data }) => showAnnouncement(JSON.parse(data)));
+  event.sub(SESSION_MIGRATING, ({ data }) => onMigrating(JSON.parse(data)));
+  event.sub(SESSION_QUEUED, ({ position }) =>
+    showAnnouncement({ level: "maintenance", message: `The server is busy, you are number ${position} in queue` })
+  );
+  event.sub(SESSION_REFUSED, ({ reason }) => showAnnouncement({ level: "maintenance", message: reason }));
+  event.sub(SHARE_LINK_CREATED, ({ data }) => onShareLinkCreated(JSON.parse(data)));
+  event.sub(VIEW_ONLY, onViewOnly);
+  event.sub(KIOSK_MODE, onKioskMode);
+  event.sub(CLIP_READY, onClipReady);
+  event.sub(FILE_RECEIVED, onFileReceived);
+  event.sub(LINK_QUALITY, ({ data }) => onLinkQuality(JSON.parse(data)));
+  event.sub(IDLE_CLEARED, () => {
+    clearInterval(announcementTimer);
+    appAnnouncement.className = "announcement hidden";
+  });
+  event.sub(ADMIN_ATTACHED, onAdminAttached);
+  event.sub(GUEST_SESSION, ({ data }) => onGuestSession(JSON.parse(data)));
+  event.sub(SESSION_UPGRADED, onSessionUpgraded);
+  event.sub(PREFLIGHT_DONE, ({ udp, stun }) => {
+    if (!udp) showAnnouncement({ level: "maintenance", message: "UDP is blocked on your network, expect a fallback stream" });
+    else if (!stun) log.info("[preflight] STUN servers are unreachable, the stream relies on host candidates");
+  });
+  // A refresh resumes the stream with the ICE credentials of the token
+  event.sub(SESSION_RESUMABLE, ({ token }) => sessionStorage.setItem("resume", token));
+  event.sub(SESSION_BANNED, ({ data }) => onBanned(JSON.parse(data)));
+  event.sub(ASSIST_CONTROL, onAssistControl);
+  event.sub(ASSIST_CHANGED, onAssistChanged);
+  event.sub(CONTROL_QUEUE_UPDATED, ({ data }) => onControlQueue(JSON.parse(data)));
+  event.sub(WINDOWS_LISTED, ({ data }) => onWindowsListed(JSON.parse(data)));
+  event.sub(WINDOW_CAPTURED, ({ data }) => onWindowCaptured(JSON.parse(data)));
+  event.sub(MACROS_AVAILABLE, ({ data }) => onMacrosAvailable(JSON.parse(data)));
+  event.sub(CONNECTION_OPENED, () => {
+    if (!migrationTimer) return;
+    clearTimeout(migrationTimer);
+    migrationTimer = null;
+    appAnnouncement.className = "announcement hidden";
+  });
   event.sub(KEY_PRESSED, onKeyPress);
   event.sub(KEY_RELEASED, onKeyRelease);
   event.sub(MOUSE_MOVE, onMouseMove);
   event.sub(MOUSE_DOWN, onMouseDown);
   event.sub(MOUSE_UP, onMouseUp);
-  event.sub(KEY_STATE_UPDATED, (data) => rtcp.input(data));
+  event.sub(KEY_STATE_UPDATED, (data) => !viewOnly && rtcp.input(data));
 })(document, event, env);
@@ -21,17 +21,114 @@
   const discovery = document.getElementById("discovery");
   const appTitle = document.getElementById("app-title");
   const appContainer = document.getElementById("app-container");
+  const appPreview = document.getElementById("app-preview");
+  const lobby = document.getElementById("lobby");
+  const lobbySearch = document.getElementById("lobby-search");
+  const PREVIEW_REFRESH_MS = 30000;
+  const LOBBY_REFRESH_MS = 10000;
+  let previewApp;
   let curAppID = 0;
 
   var appList = [];
+  // User token of the community site carries age and roles for restricted apps, the room picks the instance of the app
+  const pageQuery = new URLSearchParams(location.search);
+  const userQuery = ["user", "room"]
+    .filter((name) => pageQuery.get(name))
+    .map((name) => `${name}=${encodeURIComponent(pageQuery.get(name))}`)
+    .join("&");
 
-  discoverydropdown.addEventListener("change", () => {
-    app = appList[discoverydropdown.selectedIndex];
+  const selectApp = (app) => {
     curAppID = app.id;
-      socket.connect("http", `${app.addr}/wscloudmorph`);
-      appContainer.setAttribute("src", `${location.protocol}//${app.addr}/embed`);
+    socket.connect("http", `${app.addr}/wscloudmorph${userQuery ? "?" + userQuery : ""}`);
+    appContainer.setAttribute("src", `${location.protocol}//${app.addr}/embed${userQuery ? "?" + userQuery : ""}`);
     updatePage(app);
+  };
+  discoverydropdown.addEventListener("change", () => selectApp(appList[discoverydropdown.selectedIndex]));
+
+  // Live preview of the hovered app, refreshed with the thumbnails of the worker
+  const showPreview = (app) => {
+    previewApp = app;
+    if (!app) {
+      appPreview.classList.add("hidden");
+      return;
+    }
+    appPreview.src = `${location.protocol}//${app.addr}/api/apps/${encodeURIComponent(app.app_name)}/thumbnail?_=${Date.now()}${userQuery ? "&" + userQuery : ""}`;
+  };
+  appPreview.addEventListener("load", () => appPreview.classList.remove("hidden"));
+  appPreview.addEventListener("error", () => appPreview.classList.add("hidden"));
+  discoverydropdown.addEventListener("mouseover", (e) => {
+    if (e.target.tagName !== "OPTION") return;
+    showPreview(appList[e.target.index]);
   });
+  discoverydropdown.addEventListener("mouseleave", () => showPreview(null));
+  setInterval(() => previewApp && showPreview(previewApp), PREVIEW_REFRESH_MS);
+
+  // Lobby of the catalog with running instances and players, a click joins the least loaded instance of the app
+  const joinApp = (name) => {
+    const instances = [...appList.keys()].filter((idx) => appList[idx].app_name === name && !appList[idx].saturated);
+    if (!instances.length) return;
+    const idx = instances.reduce((best, i) => (appList[i].players < appList[best].players ? i : best));
+    discoverydropdown.selectedIndex = idx;
+    discoverydropdown.dispatchEvent(new Event("change"));
+  };
+
+  const renderLobbyEntry = (app) => {
+    const node = document.createElement("div");
+    node.setAttribute("class", "lobby-app");
+    node.classList.toggle("lobby-app-idle", !app.instances);
+    if (app.icon_url) {
+      const icon = document.createElement("img");
+      icon.src = app.icon_url + (userQuery ? "?" + userQuery : "");
+      node.appendChild(icon);
+    }
+    const name = document.createElement("strong");
+    name.textContent = app.page_title || app.name;
+    node.appendChild(name);
+    if (app.description) {
+      const description = document.createElement("span");
+      description.textContent = app.description;
+      node.appendChild(description);
+    }
+    const labels = [app.category, ...(app.tags || [])].filter(Boolean);
+    if (labels.length) {
+      const tags = document.createElement("span");
+      tags.setAttribute("class", "lobby-tags");
+      tags.textContent = labels.join(" · ");
+      node.appendChild(tags);
+    }
+    const load = document.createElement("span");
+    load.setAttribute("class", "lobby-load");
+    load.textContent = `${app.instances} running · ${app.players} playing`;
+    node.appendChild(load);
+    node.addEventListener("click", () => joinApp(app.name));
+    return node;
+  };
+
+  // The search filters on the server, words like tag:puzzle or category:games narrow it down
+  const lobbyParams = () => {
+    const params = new URLSearchParams(userQuery);
+    const text = [];
+    for (const word of lobbySearch.value.trim().split(/\s+/).filter(Boolean)) {
+      const [key, value] = word.split(":", 2);
+      if (value && (key === "tag" || key === "category")) {
+        params.append(key, value);
+      } else {
+        text.push(word);
+      }
+    }
+    text.length && params.set("q", text.join(" "));
+    return params.toString();
+  };
+
+  const updateLobby = () => {
+    const params = lobbyParams();
+    return fetch(`api/apps${params ? "?" + params : ""}`)
+      .then((resp) => resp.json())
+      .then((apps) => lobby.replaceChildren(...apps.map(renderLobbyEntry)))
+      .catch(() => log.warn("[lobby] cannot list apps"));
+  };
+  setInterval(updateLobby, LOBBY_REFRESH_MS);
+  lobbySearch.addEventListener("input", updateLobby);
 
   //document.addEventListener(
   //"contextmenu",
@@ -96,6 +193,9 @@
     userSpanNode.setAttribute("class", "output-user-label");
     messageSpanNode.setAttribute("class", "output-message-label");
     divNode.setAttribute("class", "output-row");
+    divNode.dataset.id = chatrow.id;
+    divNode.classList.toggle("output-row-lobby", chatrow.room === "lobby");
+    divNode.classList.toggle("output-row-dm", !!chatrow.to);
     var userTextnode = document.createTextNode(chatrow.user);
     var messageTextnode = document.createTextNode(chatrow.message);
     boldNode.appendChild(userTextnode);
@@ -103,10 +203,104 @@
     messageSpanNode.appendChild(messageTextnode);
     divNode.appendChild(userSpanNode);
     divNode.appendChild(messageSpanNode);
+    (chatrow.links || []).forEach((link) =>
+      divNode.appendChild(renderLinkPreview(link))
+    );
+    if (chatrow.author_id && !chatrow.to) divNode.appendChild(renderReportButton(chatrow));
     chatoutput.appendChild(divNode);
+    renderReactions(divNode, chatrow.reactions);
     chatoutput.scrollTop = chatoutput.scrollHeight;
   };
 
+  // Previews come sanitized from the server, still only text nodes and https images are used
+  const renderLinkPreview = (link) => {
+    const node = document.createElement("a");
+    node.setAttribute("class", "output-link-preview");
+    node.href = link.url;
+    node.target = "_blank";
+    node.rel = "noopener noreferrer nofollow";
+    if (link.image && link.image.startsWith("https://")) {
+      const img = document.createElement("img");
+      img.src = link.image;
+      img.referrerPolicy = "no-referrer";
+      node.appendChild(img);
+    }
+    const title = document.createElement("strong");
+    title.textContent = link.title || link.url;
+    node.appendChild(title);
+    if (link.description) {
+      const description = document.createElement("span");
+      description.textContent = link.description;
+      node.appendChild(description);
+    }
+    return node;
+  };
+
+  // Reports go to the moderators with the recent chat of the room
+  const renderReportButton = (chatrow) => {
+    const node = document.createElement("button");
+    node.setAttribute("class", "output-report");
+    node.title = `Report ${chatrow.user}`;
+    node.textContent = "\u2691";
+    node.addEventListener("click", () => {
+      const reason = window.prompt(`Why are you reporting ${chatrow.user}?`);
+      if (reason === null) return;
+      socket.send({
+        type: "REPORT",
+        data: JSON.stringify({ client_id: chatrow.author_id, message_id: chatrow.id, room: chatrow.room, reason }),
+      });
+    });
+    return node;
+  };
+
+  const chatRow = (id) =>
+    chatoutput.querySelector(`.output-row[data-id="${CSS.escape(id)}"]`);
+
+  const editChatMessage = (chatrowData) => {
+    const chatrow = JSON.parse(chatrowData);
+    const row = chatRow(chatrow.id);
+    if (!row) return;
+    const message = row.querySelector(".output-message-label");
+    message.textContent = chatrow.message;
+    row.classList.toggle("output-row-edited", chatrow.edited);
+  };
+
+  const renderReactions = (row, reactions = {}) => {
+    let node = row.querySelector(".output-reactions");
+    if (!node) {
+      node = document.createElement("span");
+      node.setAttribute("class", "output-reactions");
+      row.appendChild(node);
+    }
+    node.textContent = Object.entries(reactions)
+      .map(([emoji, count]) => `${emoji} ${count}`)
+      .join(" ");
+  };
+
+  const reactChatMessage = (data) => {
+    const reactions = JSON.parse(data);
+    const row = chatRow(reactions.id);
+    row && renderReactions(row, reactions.reactions);
+  };
+
+  const showTyping = (data) => {
+    const { users } = JSON.parse(data);
+    let node = document.getElementById("chat-typing");
+    if (!node) {
+      node = document.createElement("div");
+      node.id = "chat-typing";
+      chatoutput.after(node);
+    }
+    node.textContent = users.length
+      ? `${users.join(", ")} ${users.length > 1 ? "are" : "is"} typing...`
+      : "";
+  };
+
+  const deleteChatMessage = (data) => {
+    const row = chatRow(JSON.parse(data).id);
+    row && row.remove();
+  };
+
   const updateNumPlayers = (numplayersData) => {
     sNumPlayers = JSON.parse(numplayersData);
     numplayers.innerText = "Number of players: " + sNumPlayers;
@@ -121,6 +315,13 @@
   const initApps = ({ cur_app_id, cur_app, apps }) => {
     curAppID = cur_app_id;
     updateAppList(apps);
+    updateLobby();
+    // Relays have no app of their own, the least loaded worker is joined
+    const open = apps.filter((app) => !app.saturated);
+    if (!cur_app_id && open.length) {
+      selectApp(open.reduce((best, app) => (app.players < best.players ? app : best)));
+      return;
+    }
     updatePage(cur_app);
   };
 
@@ -148,7 +349,7 @@
       for (const idx of appList.keys()) {
         const app = appList[idx];
         appEntry = document.createElement("option");
-        appEntry.innerText = app.app_name + "-" + latencies[app.addr] + "ms";
+        appEntry.innerText = app.app_name + "-" + latencies[app.addr] + "ms" + (app.saturated ? " (full)" : "");
         discoverydropdown.appendChild(appEntry);
         if (app.id == curAppID) {
           discoverydropdown.selectedIndex = idx;
@@ -184,11 +385,23 @@
   };
 
   event.sub(CHAT, (data) => appendChatMessage(data.chatrow));
+  event.sub(CHAT_EDITED, (data) => editChatMessage(data.chatrow));
+  event.sub(CHAT_DELETED, ({ data }) => deleteChatMessage(data));
+  event.sub(CHAT_REACTED, ({ data }) => reactChatMessage(data));
+  event.sub(CHAT_TYPING, ({ data }) => showTyping(data));
+  event.sub(DM_RECEIVED, (data) => appendChatMessage(data.chatrow));
+  event.sub(DM_FAILED, () =>
+    log.warn("[chat] direct message is not delivered")
+  );
+  event.sub(CHAT_REPORTED, ({ ok }) =>
+    ok ? log.info("[chat] report is sent to the moderators") : log.warn("[chat] report is not sent")
+  );
   event.sub(NUM_PLAYER, ({ data }) => updateNumPlayers(data));
   event.sub(CLIENT_INIT, ({ data }) => {
     initApps(JSON.parse(data));
   });
   event.sub(UPDATE_APP_LIST, ({ data }) => {
     updateAppList(JSON.parse(data));
+    updateLobby();
   });
 })(document, event, env, socket);
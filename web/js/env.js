@@ -63,8 +63,23 @@ const env = (() => {
     // window.addEventListener('orientationchange', fixScreenLayout);
     // document.addEventListener('DOMContentLoaded', () => fixScreenLayout(), false);
 
+    // Path the page is served under behind a reverse proxy, from the base of the page. Empty at the root
+    const basePath = () => new URL(document.baseURI).pathname.replace(/\/$/, '');
+
+    // Runtime config of the server embedded into the page, also served as config.json
+    let runtimeConfig;
+    const config = () => {
+        if (!runtimeConfig) {
+            const el = document.getElementById('runtime-config');
+            runtimeConfig = el ? JSON.parse(el.textContent) : {wsEndpoint: '/ws', features: {}, apps: []};
+        }
+        return runtimeConfig;
+    };
+
     return {
         getOs: getOS,
+        basePath: basePath,
+        config: config,
         getBrowser: getBrowser,
         display: () => ({
             isPortrait: isPortrait,
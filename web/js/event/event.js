@@ -66,8 +66,17 @@ const GAME_PLAYER_IDX = "gamePlayerIndex";
 
 const CONNECTION_READY = "connectionReady";
 const CONNECTION_CLOSED = "connectionClosed";
+const CONNECTION_OPENED = "connectionOpened";
+const CONNECTION_LOST = "connectionLost";
 
 const CHAT = "chat";
+const CHAT_EDITED = "chatEdited";
+const CHAT_DELETED = "chatDeleted";
+const CHAT_REACTED = "chatReacted";
+const CHAT_TYPING = "chatTyping";
+const DM_RECEIVED = "dmReceived";
+const DM_FAILED = "dmFailed";
+const CHAT_REPORTED = "chatReported";
 const NUM_PLAYER = "num_player";
 
 const MEDIA_STREAM_INITIALIZED = "mediaStreamInitialized";
@@ -75,6 +84,14 @@ const MEDIA_STREAM_SDP_AVAILABLE = "mediaStreamSdpAvailable";
 const MEDIA_STREAM_CANDIDATE_ADD = "mediaStreamCandidateAdd";
 const MEDIA_STREAM_CANDIDATE_FLUSH = "mediaStreamCandidateFlush";
 const MEDIA_STREAM_READY = "mediaStreamReady";
+const MEDIA_STREAM_FALLBACK = "mediaStreamFallback";
+const MEDIA_STREAM_RELAY = "mediaStreamRelay";
+const MEDIA_STREAM_RELAY_FAILED = "mediaStreamRelayFailed";
+const MEDIA_STREAM_SFU = "mediaStreamSfu";
+const MEDIA_STREAM_SPECTATOR_FALLBACK = "mediaStreamSpectatorFallback";
+const MEDIA_STREAM_RESUMED = "mediaStreamResumed";
+const MEDIA_STREAM_RESUME_FAILED = "mediaStreamResumeFailed";
+const MEDIA_STREAM_REANSWER = "mediaStreamReanswer";
 
 const GAMEPAD_CONNECTED = "gamepadConnected";
 const GAMEPAD_DISCONNECTED = "gamepadDisconnected";
@@ -97,6 +114,7 @@ const MOUSE_MOVE = "mouseMove";
 
 const DPAD_TOGGLE = "dpadToggle";
 const STATS_TOGGLE = "statsToggle";
+const STATS_UPDATED = "statsUpdated";
 const HELP_OVERLAY_TOGGLED = "helpOverlayToggled";
 
 const SETTINGS_CHANGED = "settingsChanged";
@@ -104,3 +122,27 @@ const SETTINGS_CLOSED = "settingsClosed";
 
 const UPDATE_APP_LIST = "updateapplist";
 const CLIENT_INIT = "clientInit";
+const ANNOUNCEMENT = "announcement";
+const SESSION_MIGRATING = "sessionMigrating";
+const SESSION_QUEUED = "sessionQueued";
+const SESSION_REFUSED = "sessionRefused";
+const SHARE_LINK_CREATED = "shareLinkCreated";
+const VIEW_ONLY = "viewOnly";
+const KIOSK_MODE = "kioskMode";
+const CLIP_READY = "clipReady";
+const FILE_RECEIVED = "fileReceived";
+const MACROS_AVAILABLE = "macrosAvailable";
+const ADMIN_ATTACHED = "adminAttached";
+const IDLE_CLEARED = "idleCleared";
+const LINK_QUALITY = "linkQuality";
+const ASSIST_CHANGED = "assistChanged";
+const ASSIST_CONTROL = "assistControl";
+const WINDOWS_LISTED = "windowsListed";
+const WINDOW_CAPTURED = "windowCaptured";
+const GUEST_SESSION = "guestSession";
+const SESSION_UPGRADED = "sessionUpgraded";
+const FEATURES_UPDATED = "featuresUpdated";
+const CONTROL_QUEUE_UPDATED = "controlQueueUpdated";
+const SESSION_BANNED = "sessionBanned";
+const PREFLIGHT_DONE = "preflightDone";
+const SESSION_RESUMABLE = "sessionResumable";
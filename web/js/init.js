@@ -1 +1,16 @@
-socket.connect(location.protocol, `${location.host}/ws`);
+// Query carries access tokens of join links to the websocket, and the token of a guest session to resume it
+const query = new URLSearchParams(location.search);
+const guestToken = sessionStorage.getItem("guest");
+guestToken && !query.has("guest") && query.set("guest", guestToken);
+// A refreshed page resumes its stream and skips the pre-flight, the stream just worked
+const resumeToken = sessionStorage.getItem("resume");
+resumeToken && query.set("resume", resumeToken);
+// The time zone tells the region of the user when the worker trusts it
+const timeZone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+timeZone && query.set("tz", timeZone);
+// Compressions of offers the page decompresses, and chunks of large packets
+query.set("signaling", signal.supported());
+const connect = () =>
+  socket.connect(location.protocol, `${location.host}${env.basePath()}${env.config().wsEndpoint}?${query}`);
+// The pre-flight warns about a blocked stream before the user queues for the session
+resumeToken ? connect() : preflight.run().then(connect);
@@ -1 +1,2 @@
-socket.connect(location.protocol, `${location.host}/wscloudmorph`);
+// Query carries the user token filtering restricted apps
+socket.connect(location.protocol, `${location.host}${env.basePath()}${env.config().wsEndpoint}${location.search}`);
@@ -0,0 +1,81 @@
+/**
+ * MSE fallback module.
+ *
+ * View-only stream of fragmented MP4 over websocket, used when WebRTC cannot connect.
+ * The worker admits viewers like the websocket session, so the query of the page goes along.
+ *
+ * @version 1
+ */
+const mse = (() => {
+  let conn;
+  let sourceBuffer;
+  let queue = [];
+
+  const appendNext = () => {
+    if (!sourceBuffer || sourceBuffer.updating || queue.length === 0) return;
+    sourceBuffer.appendBuffer(queue.shift());
+  };
+
+  const onPacket = (packet) => {
+    switch (packet.type) {
+      case "QUEUE":
+        event.pub(SESSION_QUEUED, { position: packet.data });
+        break;
+      case "BANNED":
+        event.pub(SESSION_BANNED, { data: packet.data });
+        break;
+      case "VIEW_DENIED":
+        event.pub(SESSION_REFUSED, { reason: `Cannot watch this session: ${packet.data}` });
+        break;
+      default:
+        event.pub(SESSION_REFUSED, { reason: packet.data });
+    }
+  };
+
+  const start = (media) => {
+    if (conn || !window.MediaSource) {
+      log.error("[mse] MediaSource is not supported");
+      return;
+    }
+
+    const mediaSource = new MediaSource();
+    media.srcObject = null;
+    media.src = URL.createObjectURL(mediaSource);
+
+    const address = `${location.protocol !== "https:" ? "ws" : "wss"}://${location.host}${env.basePath()}/mse${location.search}`;
+    log.info(`[mse] connecting to ${address}`);
+    conn = new WebSocket(address);
+    conn.binaryType = "arraybuffer";
+    conn.onclose = () => {
+      log.info("[mse] closed");
+      conn = undefined;
+    };
+    conn.onmessage = (message) => {
+      if (typeof message.data === "string") {
+        const meta = JSON.parse(message.data);
+        // refusals and queue positions of the gate come before the init segment
+        if (meta.type) {
+          onPacket(meta);
+          return;
+        }
+        log.info(`[mse] <- ${meta.mime_type}`);
+        sourceBuffer = mediaSource.addSourceBuffer(meta.mime_type);
+        sourceBuffer.mode = "sequence";
+        sourceBuffer.addEventListener("updateend", appendNext);
+        return;
+      }
+      queue.push(message.data);
+      appendNext();
+      // stay close to the live edge
+      if (media.buffered.length > 0) {
+        const end = media.buffered.end(media.buffered.length - 1);
+        if (end - media.currentTime > 1) media.currentTime = end - 0.1;
+      }
+    };
+  };
+
+  return {
+    start: start,
+    isActive: () => conn !== undefined,
+  };
+})(event, log);
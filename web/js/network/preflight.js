@@ -0,0 +1,66 @@
+/**
+ * Pre-flight module.
+ *
+ * Probes the WebRTC connectivity to the worker before the session starts:
+ * STUN reachability from the gathered candidates and the RTT of pings echoed by the worker.
+ *
+ * @version 1
+ */
+const preflight = (() => {
+    const TIMEOUT_MS = 5000;
+    const PINGS = 5;
+
+    const gathered = (pc) => new Promise((resolve) => {
+        if (pc.iceGatheringState === 'complete') return resolve();
+        pc.onicegatheringstatechange = () => pc.iceGatheringState === 'complete' && resolve();
+    });
+
+    const within = (promise, ms) => Promise.race([
+        promise,
+        new Promise((_, reject) => setTimeout(() => reject(new Error('timeout')), ms)),
+    ]);
+
+    // pings sends timestamps over the channel and returns the median RTT in ms
+    const pings = (channel) => new Promise((resolve) => {
+        const rtts = [];
+        channel.onmessage = ({data}) => {
+            rtts.push(performance.now() - Number(data));
+            if (rtts.length < PINGS) return channel.send(String(performance.now()));
+            rtts.sort((a, b) => a - b);
+            resolve(Math.round(rtts[Math.floor(rtts.length / 2)]));
+        };
+        channel.send(String(performance.now()));
+    });
+
+    // run resolves with {udp, stun, rtt}, udp is false when the stream has to fall back. It never rejects
+    const run = async () => {
+        const result = {udp: false, stun: false, rtt: 0};
+        let pc;
+        try {
+            const servers = await (await fetch('api/preflight')).json();
+            pc = new RTCPeerConnection({iceServers: servers.iceServers || []});
+            const channel = pc.createDataChannel('preflight');
+            const opened = new Promise((resolve) => channel.onopen = resolve);
+            await pc.setLocalDescription(await pc.createOffer());
+            await within(gathered(pc), TIMEOUT_MS);
+
+            const resp = await fetch('api/preflight', {method: 'POST', body: JSON.stringify(pc.localDescription)});
+            if (!resp.ok) throw new Error(await resp.text());
+            const probe = await resp.json();
+            result.stun = probe.stun;
+            await pc.setRemoteDescription(probe.answer);
+            await within(opened, TIMEOUT_MS);
+            result.udp = true;
+            result.rtt = await within(pings(channel), TIMEOUT_MS);
+        } catch (e) {
+            log.warn('[preflight] probe is not complete', e);
+        } finally {
+            pc && pc.close();
+        }
+        log.info('[preflight] result', result);
+        event.pub(PREFLIGHT_DONE, result);
+        return result;
+    };
+
+    return {run};
+})(event, log);
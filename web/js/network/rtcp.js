@@ -12,23 +12,56 @@ const rtcp = (() => {
 
     let connected = false;
     let inputReady = false;
+    // input goes over the websocket when the worker has the input DataChannel off for this client
+    let wsInput = false;
+    event.sub(FEATURES_UPDATED, ({features}) => wsInput = !features.datachannelInput);
+    // ICE restarts before falling back to MSE stream
+    const MAX_ICE_FAILURES = 1;
+    let failures = 0;
+    // the first failure reconnects over the media relay of the coordinator when the worker has one
+    let relayed = false;
+    // the STUN/TURN config of the worker, a cold start after a failed resume uses it again
+    let lastIceservers;
 
     const start = (iceservers) => {
         log.info("[rtcp] <- received STUN/TURN config from the worker", iceservers);
+        lastIceservers = iceservers;
+        // the websocket reconnected, the worker takes the running peer connection over
+        if (isResumable()) {
+            log.info("[rtcp] -> resuming the stream of the last session");
+            socket.send({type: "resumestream", data: JSON.stringify({codecs: videoCodecs()})});
+            return;
+        }
 
         let conf
-        if (iceservers !== "") {
+        if (iceservers === undefined) {
+            // without servers from the worker, the ones of the runtime config of the page are used
+            conf = {iceServers: env.config().iceServers || []}
+        } else if (iceservers !== "") {
+            // the worker sends either a single STUN url or a JSON list of RTCIceServer
             conf = {
-                iceservers: {urls: iceservers}
+                iceServers: iceservers.startsWith("[") ? JSON.parse(iceservers) : [{urls: iceservers}]
             }
         }
 
+        certificate().then((cert) => open(cert ? {...conf, certificates: [cert]} : conf));
+    };
+
+    const open = (conf) => {
         connection = conf ? new RTCPeerConnection(conf) : new RTCPeerConnection();
 
         mediaStream = new MediaStream();
 
         connection.ondatachannel = (e) => {
             log.debug(`[rtcp] ondatachannel: ${e.channel.label}`);
+            if (e.channel.label === "stats") {
+                e.channel.onmessage = (msg) => event.pub(STATS_UPDATED, JSON.parse(msg.data));
+                return;
+            }
+            if (e.channel.label === "bulk") {
+                receiveFiles(e.channel);
+                return;
+            }
             inputChannel = e.channel;
             inputChannel.onopen = () => {
                 log.debug("[rtcp] the input channel has opened");
@@ -46,9 +79,116 @@ const rtcp = (() => {
         connection.onicecandidate = ice.onIcecandidate;
         connection.ontrack = (event) => {
             mediaStream.addTrack(event.track);
+            // tracks removed by the worker with renegotiation leave the stream
+            event.streams.forEach((stream) => {
+                stream.onremovetrack = (e) => mediaStream.removeTrack(e.track);
+            });
+        };
+
+        socket.send({type: "initwebrtc", data: JSON.stringify({codecs: videoCodecs()})});
+    };
+
+    // receiveFiles collects the files of the bulk channel, a JSON header with the size comes before the chunks
+    const receiveFiles = (channel) => {
+        let file;
+        channel.binaryType = "arraybuffer";
+        channel.onmessage = (msg) => {
+            if (typeof msg.data === "string") {
+                file = {...JSON.parse(msg.data), chunks: [], received: 0};
+                return;
+            }
+            if (!file) return;
+            file.chunks.push(msg.data);
+            file.received += msg.data.byteLength;
+            if (file.received < file.size) return;
+            event.pub(FILE_RECEIVED, {name: file.name, blob: new Blob(file.chunks, {type: file.mime_type})});
+            file = undefined;
         };
+    };
+
+    // videoCodecs are the mime types of the video codecs the browser decodes,
+    // the worker falls the stream back to one of them, e.g. when AV1 is missing
+    const videoCodecs = () => {
+        if (!window.RTCRtpReceiver || !RTCRtpReceiver.getCapabilities) return [];
+        const caps = RTCRtpReceiver.getCapabilities("video");
+        return caps ? [...new Set(caps.codecs.map((c) => c.mimeType))] : [];
+    };
+
+    // The DTLS certificate of the page is kept in IndexedDB, with the ICE credentials of the RESUME token
+    // a refreshed page looks like the same peer to the worker. Without IndexedDB every connection gets a new one
+    const CERT_RENEW_MS = 24 * 60 * 60 * 1000;
+    const certificate = () => new Promise((resolve) => {
+        if (!window.indexedDB || !RTCPeerConnection.generateCertificate) return resolve(null);
+        const req = indexedDB.open("cloudmorph", 1);
+        req.onupgradeneeded = () => req.result.createObjectStore("certs");
+        req.onerror = () => resolve(null);
+        req.onsuccess = () => {
+            const db = req.result;
+            const get = db.transaction("certs").objectStore("certs").get("dtls");
+            get.onerror = () => resolve(null);
+            get.onsuccess = () => {
+                if (get.result && get.result.expires > Date.now() + CERT_RENEW_MS) return resolve(get.result);
+                RTCPeerConnection.generateCertificate({name: "ECDSA", namedCurve: "P-256"})
+                    .then((cert) => {
+                        db.transaction("certs", "readwrite").objectStore("certs").put(cert, "dtls");
+                        resolve(cert);
+                    })
+                    .catch(() => resolve(null));
+            };
+        };
+    });
+
+    // stop closes the peer connection, e.g. before reconnecting to another worker
+    const stop = () => {
+        if (connection) connection.close();
+        connection = null;
+        candidates = Array();
+        isAnswered = false;
+        connected = false;
+        inputReady = false;
+        failures = 0;
+        relayed = false;
+    };
 
-        socket.send({type: "initwebrtc"});
+    // relay reconnects with the TURN server of the media relay only, the worker streams through it
+    const relay = (iceservers) => {
+        log.info("[rtcp] <- reconnecting over the media relay");
+        if (connection) connection.close();
+        candidates = Array();
+        isAnswered = false;
+        const conf = {iceServers: JSON.parse(iceservers), iceTransportPolicy: "relay"};
+        certificate().then((cert) => open(cert ? {...conf, certificates: [cert]} : conf));
+    };
+
+    // isResumable tells the peer connection still runs, e.g. while the websocket reconnects
+    const isResumable = () =>
+        !!connection && isAnswered && connection.connectionState !== "failed" && connection.connectionState !== "closed";
+
+    // restartIce restarts ICE on the peer connection the worker took over, the worker answers the offer
+    const restartIce = async () => {
+        log.info("[rtcp] <- the worker took the stream over, restarting ICE");
+        candidates = Array();
+        isAnswered = false;
+        const offer = await connection.createOffer({iceRestart: true});
+        await connection.setLocalDescription(offer);
+        socket.send({type: "reoffer", data: await signal.encode(offer)});
+    };
+
+    // resumeFailed starts cold when the worker has no peer connection of the last session any more
+    const resumeFailed = () => {
+        log.info("[rtcp] <- the stream can't be resumed, starting a new one");
+        stop();
+        start(lastIceservers);
+    };
+
+    const restart = () => {
+        log.error("[rtcp] connection failed, retry...");
+        connection
+            .createOffer({iceRestart: true})
+            .then((description) =>
+                connection.setLocalDescription(description).catch(log.error)
+            )
+            .catch(log.error);
     };
 
     const ice = (() => {
@@ -86,6 +226,10 @@ const rtcp = (() => {
                     case "connected": {
                         log.info("[rtcp] connected...");
                         connected = true;
+                        if (wsInput) {
+                            inputReady = true;
+                            event.pub(CONNECTION_READY);
+                        }
                         break;
                     }
                     case "disconnected": {
@@ -95,14 +239,20 @@ const rtcp = (() => {
                         break;
                     }
                     case "failed": {
-                        log.error("[rtcp] connection failed, retry...");
                         connected = false;
-                        connection
-                            .createOffer({iceRestart: true})
-                            .then((description) =>
-                                connection.setLocalDescription(description).catch(log.error)
-                            )
-                            .catch(log.error);
+                        failures++;
+                        if (failures > MAX_ICE_FAILURES) {
+                            log.error("[rtcp] connection failed, fallback to view-only stream");
+                            event.pub(MEDIA_STREAM_FALLBACK);
+                            break;
+                        }
+                        if (!relayed) {
+                            relayed = true;
+                            log.error("[rtcp] connection failed, asking for the media relay...");
+                            socket.send({type: "ICE_RELAY"});
+                            break;
+                        }
+                        restart();
                         break;
                     }
                 }
@@ -112,21 +262,43 @@ const rtcp = (() => {
 
     return {
         start: start,
+        stop: stop,
+        restartIce: () => restartIce().catch((e) => {
+            log.error(e);
+            resumeFailed();
+        }),
+        resumeFailed: resumeFailed,
+        setRemoteAnswer: async (data) => {
+            await connection.setRemoteDescription(new RTCSessionDescription(await signal.decode(data)));
+            isAnswered = true;
+            event.pub(MEDIA_STREAM_CANDIDATE_FLUSH);
+        },
+        isResumable: isResumable,
+        relay: relay,
+        // without a media relay the connection is retried directly
+        relayFailed: () => {
+            if (connection) restart();
+        },
         setRemoteDescription: async (data, media) => {
-            const offer = new RTCSessionDescription(JSON.parse(atob(data)));
+            const offer = new RTCSessionDescription(await signal.decode(data));
             await connection.setRemoteDescription(offer);
 
             const answer = await connection.createAnswer();
             // Chrome bug https://bugs.chromium.org/p/chromium/issues/detail?id=818180 workaround
-            // force stereo params for Opus tracks (a=fmtp:111 ...)
-            answer.sdp = answer.sdp.replace(/(a=fmtp:111 .*)/g, "$1;stereo=1;sprop-stereo=1");
+            // the answer asks for stereo Opus when the worker encodes stereo (sprop-stereo=1 in the offer)
+            const opus = answer.sdp.match(/a=rtpmap:(\d+) opus\/48000/i);
+            if (opus && /sprop-stereo=1/.test(offer.sdp)) {
+                answer.sdp = answer.sdp.replace(new RegExp(`(a=fmtp:${opus[1]} .*)`, "g"), "$1;stereo=1;sprop-stereo=1");
+            }
             await connection.setLocalDescription(answer);
 
+            socket.send({type: "answer", data: await signal.encode(answer)});
+
+            // later offers renegotiate tracks of the running session
+            if (isAnswered) return;
             isAnswered = true;
             event.pub(MEDIA_STREAM_CANDIDATE_FLUSH);
 
-            socket.send({type: "answer", data: btoa(JSON.stringify(answer))});
-
             media.srcObject = mediaStream;
         },
         addCandidate: (data) => {
@@ -140,15 +312,18 @@ const rtcp = (() => {
             if (isFlushing || !isAnswered) return;
             isFlushing = true;
             candidates.forEach((data) => {
-                const d = atob(data);
-                const candidate = new RTCIceCandidate(JSON.parse(d));
-                log.debug("[rtcp] add candidate", d);
-                connection.addIceCandidate(candidate).catch(log.error);
+                signal.decode(data)
+                    .then((d) => {
+                        log.debug("[rtcp] add candidate", d);
+                        return connection.addIceCandidate(new RTCIceCandidate(d));
+                    })
+                    .catch(log.error);
             });
             isFlushing = false;
         },
         input: (data) => {
-            if (inputChannel) inputChannel.send(data);
+            if (wsInput) socket.send({type: "INPUT", data: data});
+            else if (inputChannel) inputChannel.send(data);
         },
         isConnected: () => connected,
         isInputReady: () => inputReady,
@@ -0,0 +1,45 @@
+/**
+ * SFU viewer module.
+ *
+ * Viewers of a session the worker publishes to an SFU (LiveKit) watch it from the room of the SFU,
+ * with a token of the worker, instead of a peer connection to the worker.
+ *
+ * @version 1
+ */
+const sfu = (() => {
+  let room;
+
+  // the LiveKit client SDK is loaded by viewers of the SFU only
+  const load = (script) => new Promise((resolve, reject) => {
+    if (window.LivekitClient) return resolve(window.LivekitClient);
+    const el = document.createElement("script");
+    el.src = script;
+    el.onload = () => resolve(window.LivekitClient);
+    el.onerror = () => reject(new Error(`cannot load ${script}`));
+    document.head.appendChild(el);
+  });
+
+  const start = ({ url, token, script }, media) => {
+    load(script)
+      .then((lk) => {
+        room = new lk.Room();
+        const stream = new MediaStream();
+        media.srcObject = stream;
+        room.on(lk.RoomEvent.TrackSubscribed, (track) => stream.addTrack(track.mediaStreamTrack));
+        room.on(lk.RoomEvent.TrackUnsubscribed, (track) => stream.removeTrack(track.mediaStreamTrack));
+        room.on(lk.RoomEvent.Disconnected, () => log.info("[sfu] left the room"));
+        return room.connect(url, token);
+      })
+      .then(() => log.info(`[sfu] watching from the room ${room.name}`))
+      .catch((e) => {
+        log.error("[sfu] cannot join the room, fallback to view-only stream", e);
+        room = undefined;
+        event.pub(MEDIA_STREAM_FALLBACK);
+      });
+  };
+
+  return {
+    start: start,
+    isActive: () => room !== undefined,
+  };
+})(event, log);
@@ -0,0 +1,106 @@
+/**
+ * Signaling payload module.
+ *
+ * SDPs and candidates are base64 of JSON, large ones compressed with gzip or deflate behind a "gzip:" or "deflate:"
+ * header. Packets with more data than a chunk are split into CHUNK packets of the same packet_id, both ways.
+ * The page tells the worker what it takes in the signaling query of the websocket.
+ *
+ * @version 1
+ */
+const signal = (() => {
+  // the worker drops chunks of more than 16KB, 3 bytes per UTF-16 unit at most
+  const CHUNK_LENGTH = Math.floor((16 * 1024) / 3);
+  const MAX_CHUNKS = 64;
+  const CHUNK_TIMEOUT_MS = 10000;
+  const COMPRESS_ABOVE = 1024;
+
+  const compressions = typeof DecompressionStream !== "undefined" ? ["gzip", "deflate"] : [];
+  const assemblies = new Map();
+
+  // supported is the signaling query of the websocket
+  const supported = () => [...compressions, "chunks"].join(",");
+
+  const pipe = async (bytes, stream) =>
+    new Uint8Array(await new Response(new Blob([bytes]).stream().pipeThrough(stream)).arrayBuffer());
+
+  const toBase64 = (bytes) => {
+    let s = "";
+    for (let i = 0; i < bytes.length; i += 0x8000) s += String.fromCharCode(...bytes.subarray(i, i + 0x8000));
+    return btoa(s);
+  };
+
+  const decode = async (data) => {
+    const i = data.indexOf(":");
+    if (i < 0) return JSON.parse(atob(data));
+    const bytes = Uint8Array.from(atob(data.slice(i + 1)), (c) => c.charCodeAt(0));
+    return JSON.parse(new TextDecoder().decode(await pipe(bytes, new DecompressionStream(data.slice(0, i)))));
+  };
+
+  const encode = async (obj) => {
+    const json = JSON.stringify(obj);
+    if (json.length < COMPRESS_ABOVE || typeof CompressionStream === "undefined") return btoa(json);
+    return "gzip:" + toBase64(await pipe(new TextEncoder().encode(json), new CompressionStream("gzip")));
+  };
+
+  // split returns the packets to send, chunks never end within a surrogate pair
+  const split = (packet) => {
+    const data = packet.data;
+    if (typeof data !== "string" || data.length <= CHUNK_LENGTH) return [packet];
+    const parts = [];
+    for (let start = 0; start < data.length; ) {
+      let end = Math.min(start + CHUNK_LENGTH, data.length);
+      const code = data.charCodeAt(end - 1);
+      if (end < data.length && code >= 0xd800 && code <= 0xdbff) end--;
+      parts.push(data.slice(start, end));
+      start = end;
+    }
+    const id = packet.packet_id || `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+    return parts.map((part, index) => ({
+      type: "CHUNK",
+      packet_id: id,
+      session_id: packet.session_id,
+      data: JSON.stringify({ type: packet.type, index: index, total: parts.length, data: part }),
+    }));
+  };
+
+  // assemble returns the packet of the chunk once all its chunks arrived, malformed chunks are dropped
+  const assemble = (packet) => {
+    let c;
+    try {
+      c = JSON.parse(packet.data);
+    } catch (e) {
+      return null;
+    }
+    if (!packet.packet_id || !c.type || c.type === "CHUNK" || !(c.total >= 1 && c.total <= MAX_CHUNKS) ||
+        !(c.index >= 0 && c.index < c.total)) {
+      log.warn("[signal] dropping malformed chunk");
+      return null;
+    }
+    const now = Date.now();
+    assemblies.forEach((a, id) => now - a.started > CHUNK_TIMEOUT_MS && assemblies.delete(id));
+    let a = assemblies.get(packet.packet_id);
+    if (!a) {
+      a = { type: c.type, parts: new Array(c.total), missing: c.total, started: now };
+      assemblies.set(packet.packet_id, a);
+    }
+    if (a.type !== c.type || a.parts.length !== c.total) {
+      assemblies.delete(packet.packet_id);
+      return null;
+    }
+    if (a.parts[c.index] === undefined) {
+      a.parts[c.index] = c.data;
+      a.missing--;
+    }
+    if (a.missing > 0) return null;
+    assemblies.delete(packet.packet_id);
+    return { type: a.type, data: a.parts.join(""), packet_id: packet.packet_id, session_id: packet.session_id };
+  };
+
+  return {
+    supported: supported,
+    decode: decode,
+    encode: encode,
+    split: split,
+    assemble: assemble,
+  };
+})(log);
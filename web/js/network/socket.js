@@ -27,13 +27,28 @@ const socket = (() => {
   // const pingIntervalMs = 1000 / 5; // too much
 
   let conn;
+  let pingTimer;
   let curPacketId = "";
+  // the last connection, reconnect() connects to it again
+  let lastProtocol;
+  let lastAddr;
+  // the worker ended the session and closes the connection, it's not reconnected
+  let ended = false;
+  const SESSION_END = new Set(["BANNED", "SESSION_TAKEN_OVER", "DUPLICATE_SESSION", "CAPACITY", "ACCESS_DENIED", "GUEST_EXPIRED"]);
 
   const connect = (protocol, addr) => {
     // const params = new URLSearchParams({room_id: roomId, zone: zone}).toString()
     // const address = `${location.protocol !== 'https:' ? 'ws' : 'wss'}://${location.host}/ws`;
     const address = `${protocol !== "https:" ? "ws" : "wss"}://${addr}`;
     console.info(`[ws] connecting to ${address}`);
+    if (conn) {
+      conn.onclose = null;
+      conn.close();
+    }
+    clearInterval(pingTimer);
+    lastProtocol = protocol;
+    lastAddr = addr;
+    ended = false;
     conn = new WebSocket(address);
 
     // Clear old roomID
@@ -41,14 +56,22 @@ const socket = (() => {
       log.info("[ws] <- open connection");
       log.info(`[ws] -> setting ping interval to ${pingIntervalMs}ms`);
       // !to add destructor if SPA
-      setInterval(ping, pingIntervalMs);
+      pingTimer = setInterval(ping, pingIntervalMs);
+      event.pub(CONNECTION_OPENED);
     };
     conn.onerror = (error) => log.error(`[ws] ${error}`);
-    conn.onclose = () => log.info("[ws] closed");
+    conn.onclose = () => {
+      log.info("[ws] closed");
+      clearInterval(pingTimer);
+      if (!ended) event.pub(CONNECTION_LOST);
+    };
     // Message received from server
     conn.onmessage = (response) => {
-      const data = JSON.parse(response.data);
+      let data = JSON.parse(response.data);
+      // large packets come in chunks, handled once complete
+      if (data.type === "CHUNK" && !(data = signal.assemble(data))) return;
       const message = data.type;
+      if (SESSION_END.has(message)) ended = true;
 
       if (message !== "heartbeat")
         log.debug(`[ws] <- message '${message}' `, data);
@@ -64,6 +87,30 @@ const socket = (() => {
         case "candidate":
           event.pub(MEDIA_STREAM_CANDIDATE_ADD, { candidate: data.data });
           break;
+        case "ICE_RELAY":
+          event.pub(MEDIA_STREAM_RELAY, { iceservers: data.data });
+          break;
+        case "ICE_RELAY_FAILED":
+          event.pub(MEDIA_STREAM_RELAY_FAILED);
+          break;
+        case "SFU":
+          // viewers watch from the room of the SFU
+          event.pub(MEDIA_STREAM_SFU, { data: JSON.parse(data.data) });
+          break;
+        case "RESUMED":
+          // the worker took the peer connection of the last session over
+          event.pub(MEDIA_STREAM_RESUMED);
+          break;
+        case "RESUME_FAILED":
+          event.pub(MEDIA_STREAM_RESUME_FAILED);
+          break;
+        case "reanswer":
+          event.pub(MEDIA_STREAM_REANSWER, { sdp: data.data });
+          break;
+        case "STREAM_FALLBACK":
+          // spectators past the cap of the app watch the MSE stream
+          event.pub(MEDIA_STREAM_SPECTATOR_FALLBACK);
+          break;
         case "heartbeat":
           event.pub(PING_RESPONSE);
           break;
@@ -77,6 +124,30 @@ const socket = (() => {
         case "CHAT":
           event.pub(CHAT, { chatrow: data.data });
           break;
+        case "CHAT_EDIT":
+          event.pub(CHAT_EDITED, { chatrow: data.data });
+          break;
+        case "CHAT_DELETE":
+          event.pub(CHAT_DELETED, { data: data.data });
+          break;
+        case "REACT":
+          event.pub(CHAT_REACTED, { data: data.data });
+          break;
+        case "TYPING":
+          event.pub(CHAT_TYPING, { data: data.data });
+          break;
+        case "DM":
+          event.pub(DM_RECEIVED, { chatrow: data.data });
+          break;
+        case "DM_FAILED":
+          event.pub(DM_FAILED, { data: data.data });
+          break;
+        case "REPORTED":
+          event.pub(CHAT_REPORTED, { ok: true });
+          break;
+        case "REPORT_FAILED":
+          event.pub(CHAT_REPORTED, { ok: false });
+          break;
         case "NUMPLAYER":
           event.pub(NUM_PLAYER, { numplayers: data.data });
           break;
@@ -86,6 +157,112 @@ const socket = (() => {
         case "UPDATEAPPLIST":
           event.pub(UPDATE_APP_LIST, { data: data.data });
           break;
+        case "ANNOUNCE":
+          event.pub(ANNOUNCEMENT, { data: data.data });
+          break;
+        case "MIGRATE":
+          event.pub(SESSION_MIGRATING, { data: data.data });
+          break;
+        case "QUEUE":
+          event.pub(SESSION_QUEUED, { position: data.data });
+          break;
+        case "CAPACITY":
+          event.pub(SESSION_REFUSED, { reason: data.data });
+          break;
+        case "SHARE":
+          event.pub(SHARE_LINK_CREATED, { data: data.data });
+          break;
+        case "CLIP_READY":
+          event.pub(CLIP_READY, { url: data.data });
+          break;
+        case "CLIP_FAILED":
+          event.pub(SESSION_REFUSED, { reason: `Clip failed: ${data.data}` });
+          break;
+        case "SCREENSHOT_FAILED":
+          event.pub(SESSION_REFUSED, { reason: `Screenshot failed: ${data.data}` });
+          break;
+        case "VIEW_ONLY":
+          event.pub(VIEW_ONLY);
+          break;
+        case "KIOSK":
+          event.pub(KIOSK_MODE);
+          break;
+        case "QUALITY":
+          event.pub(LINK_QUALITY, { data: data.data });
+          break;
+        case "IDLE_CLEARED":
+          event.pub(IDLE_CLEARED);
+          break;
+        case "ADMIN_ATTACHED":
+          event.pub(ADMIN_ATTACHED);
+          break;
+        case "CONTROL_QUEUE":
+          event.pub(CONTROL_QUEUE_UPDATED, { data: data.data });
+          break;
+        case "QUEUE_FAILED":
+          event.pub(SESSION_REFUSED, { reason: `Queue: ${data.data}` });
+          break;
+        case "FEATURES":
+          event.pub(FEATURES_UPDATED, { features: JSON.parse(data.data) });
+          break;
+        case "ASSIST":
+          event.pub(ASSIST_CHANGED, { active: data.data === "on" });
+          break;
+        case "ASSIST_GRANTED":
+          event.pub(ASSIST_CONTROL, { control: true });
+          break;
+        case "ASSIST_RETURNED":
+          event.pub(ASSIST_CONTROL, { control: false });
+          break;
+        case "RESUME":
+          event.pub(SESSION_RESUMABLE, { token: data.data });
+          break;
+        case "BANNED":
+          event.pub(SESSION_BANNED, { data: data.data });
+          break;
+        case "ACCESS_DENIED":
+          event.pub(SESSION_REFUSED, { reason: data.data });
+          break;
+        case "ASSIST_DENIED":
+          event.pub(SESSION_REFUSED, { reason: `Cannot take control: ${data.data}` });
+          break;
+        case "WINDOWS":
+          event.pub(WINDOWS_LISTED, { data: data.data });
+          break;
+        case "WINDOW":
+          event.pub(WINDOW_CAPTURED, { data: data.data });
+          break;
+        case "WINDOW_FAILED":
+          event.pub(SESSION_REFUSED, { reason: `Cannot switch the window: ${data.data}` });
+          break;
+        case "REFOCUS_FAILED":
+          event.pub(SESSION_REFUSED, { reason: `Cannot refocus the app: ${data.data}` });
+          break;
+        case "MACROS":
+          event.pub(MACROS_AVAILABLE, { data: data.data });
+          break;
+        case "GUEST":
+          event.pub(GUEST_SESSION, { data: data.data });
+          break;
+        case "GUEST_EXPIRED":
+          event.pub(SESSION_REFUSED, { reason: data.data });
+          break;
+        case "UPGRADED":
+          event.pub(SESSION_UPGRADED);
+          break;
+        case "UPGRADE_FAILED":
+          event.pub(SESSION_REFUSED, { reason: `Cannot sign in: ${data.data}` });
+          break;
+        case "VIEW_DENIED":
+          event.pub(SESSION_REFUSED, { reason: `Cannot watch this session: ${data.data}` });
+          break;
+        case "DUPLICATE_SESSION":
+        case "ROOM_DENIED":
+          event.pub(SESSION_REFUSED, { reason: data.data });
+          break;
+        case "SESSION_TAKEN_OVER":
+          event.pub(SESSION_REFUSED, { reason: "The session continues in another tab or window" });
+          break;
       }
     };
   };
@@ -96,7 +273,15 @@ const socket = (() => {
     send({ id: "heartbeat", data: time.toString() });
     event.pub(PING_REQUEST, { time: time });
   };
-  const send = (data) => conn.send(JSON.stringify(data));
+  // reconnect connects again with the RESUME token of the last stream, the worker hands the stream over
+  const reconnect = () => {
+    const [path, search] = lastAddr.split("?");
+    const query = new URLSearchParams(search || "");
+    const token = sessionStorage.getItem("resume");
+    token && query.set("resume", token);
+    connect(lastProtocol, `${path}?${query}`);
+  };
+  const send = (data) => signal.split(data).forEach((packet) => conn.send(JSON.stringify(packet)));
   const latency = (workers, packetId) =>
     send({
       id: "checkLatency",
@@ -118,6 +303,7 @@ const socket = (() => {
     latency: latency,
     // start: start,
     connect: connect,
+    reconnect: reconnect,
     // quit: quit,
   };
 })(event, log);
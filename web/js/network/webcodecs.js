@@ -0,0 +1,116 @@
+/**
+ * WebCodecs fallback module.
+ *
+ * View-only stream of encoded frames over websocket, decoded with WebCodecs, used when WebRTC cannot connect.
+ * Decoded frames are drawn to a canvas whose stream plays in the media element.
+ * Browsers without WebCodecs, and workers refusing the stream, fall back to MSE.
+ * The worker admits viewers like the websocket session, so the query of the page goes along.
+ *
+ * @version 1
+ */
+const webcodecs = (() => {
+  let conn;
+  let decoder;
+  let firstTimestamp;
+  // streaming tells refusals and played streams from codecs the worker or the decoder can't take, those fall back to MSE
+  let streaming = false;
+
+  const isSupported = () => window.VideoDecoder !== undefined && HTMLCanvasElement.prototype.captureStream !== undefined;
+
+  const onPacket = (packet) => {
+    switch (packet.type) {
+      case "QUEUE":
+        event.pub(SESSION_QUEUED, { position: packet.data });
+        break;
+      case "BANNED":
+        event.pub(SESSION_BANNED, { data: packet.data });
+        break;
+      case "VIEW_DENIED":
+        event.pub(SESSION_REFUSED, { reason: `Cannot watch this session: ${packet.data}` });
+        break;
+      default:
+        event.pub(SESSION_REFUSED, { reason: packet.data });
+    }
+  };
+
+  const configure = (config, media) => {
+    const canvas = document.createElement("canvas");
+    canvas.width = config.width;
+    canvas.height = config.height;
+    const ctx = canvas.getContext("2d");
+    media.src = "";
+    media.srcObject = canvas.captureStream();
+    decoder = new VideoDecoder({
+      output: (frame) => {
+        ctx.drawImage(frame, 0, 0, canvas.width, canvas.height);
+        frame.close();
+      },
+      error: (e) => {
+        log.error("[webcodecs] decoder error, fallback to MSE", e);
+        streaming = false;
+        if (conn) conn.close();
+      },
+    });
+    // Annex-B H264 goes without description
+    decoder.configure({ codec: config.codec, optimizeForLatency: true });
+  };
+
+  // frames are a byte of flags, 1 for keyframes, the 90kHz RTP timestamp and the frame data
+  const decode = (data) => {
+    const view = new DataView(data);
+    const timestamp = view.getUint32(1);
+    if (firstTimestamp === undefined) firstTimestamp = timestamp;
+    decoder.decode(
+      new EncodedVideoChunk({
+        type: view.getUint8(0) & 1 ? "key" : "delta",
+        timestamp: Math.round((((timestamp - firstTimestamp) >>> 0) * 1e6) / 90000),
+        data: new Uint8Array(data, 5),
+      })
+    );
+  };
+
+  const start = (media) => {
+    if (conn) return;
+    if (!isSupported()) {
+      log.info("[webcodecs] WebCodecs is not supported, fallback to MSE");
+      mse.start(media);
+      return;
+    }
+
+    const address = `${location.protocol !== "https:" ? "ws" : "wss"}://${location.host}${env.basePath()}/webcodecs${location.search}`;
+    log.info(`[webcodecs] connecting to ${address}`);
+    streaming = false;
+    conn = new WebSocket(address);
+    conn.binaryType = "arraybuffer";
+    conn.onclose = () => {
+      log.info("[webcodecs] closed");
+      conn = undefined;
+      firstTimestamp = undefined;
+      if (decoder && decoder.state !== "closed") decoder.close();
+      decoder = undefined;
+      // the worker or the decoder can't take the codec of the app
+      if (!streaming) mse.start(media);
+    };
+    conn.onmessage = (message) => {
+      if (typeof message.data === "string") {
+        const meta = JSON.parse(message.data);
+        // refusals and queue positions of the gate come before the decoder config
+        if (meta.type) {
+          streaming = true;
+          onPacket(meta);
+          return;
+        }
+        log.info(`[webcodecs] <- ${meta.codec} ${meta.width}x${meta.height}`);
+        streaming = true;
+        configure(meta, media);
+        return;
+      }
+      if (decoder && decoder.state === "configured") decode(message.data);
+    };
+  };
+
+  return {
+    start: start,
+    isActive: () => conn !== undefined,
+  };
+})(event, log);
@@ -0,0 +1,28 @@
+/**
+ * Stats HUD module.
+ * Renders the stats feed of the worker, toggled with Ctrl+Shift+S.
+ * @version 1
+ */
+(() => {
+  const hud = document.getElementById("app-stats");
+  let visible = false;
+
+  const render = (stats) => {
+    if (!visible) return;
+    hud.innerText = [
+      `${stats.resolution || "-"} ${stats.encoder || ""}`,
+      `fps ${stats.fps}  ${stats.bitrate} kbps`,
+      `rtt ${stats.rtt} ms  loss ${stats.loss}%  dropped ${stats.dropped}`,
+      `server cpu ${Math.round(stats.cpu)}%`,
+    ].join("\n");
+  };
+
+  const toggle = () => {
+    visible = !visible;
+    hud.classList.toggle("hidden", !visible);
+    if (visible) hud.innerText = "Waiting for stats...";
+  };
+
+  event.sub(STATS_UPDATED, render);
+  event.sub(STATS_TOGGLE, toggle);
+})(document, event);
@@ -0,0 +1,145 @@
+#!/usr/bin/env bash
+# Runs the video encoder and takes commands from stdin, sent by the host over supervisord.
+# ffmpeg captures and filters the display, vencode encodes and streams it. Keyframes and bitrate changes go to the
+# running vencode over its control FIFO, other commands restart both, a restarted encoder begins with a keyframe.
+#   keyframe        the next frame is a keyframe
+#   bitrate <kbps>  encode at the new bitrate
+#   crop <w:h:x:y> [<w:h>]  restart streaming the region of the display, e.g. a window,
+#                           letterboxed into the output size keeping its aspect ratio
+#   logo <path|->   restart with the logo in the top right corner, - removes it
+#   encoder <kbps> <fps> <w:h|-> [preset]  restart with the bitrate, frame rate and output resolution, - streams the captured size.
+#                                          The preset replaces the one of the video encoder options
+#   codec <options>  restart with other video encoder options, e.g. h264 while a viewer can't decode av1. The preset is reset
+#   blank <on|off>  restart streaming black frames instead of the display, e.g. while the app restarts. hidedesktop starts blank
+# The overlay text of the host, e.g. the user and the session timer, is drawn when it exists and reloaded every frame
+bitrate=${bitrate:-1500}
+fps=${fps:-30}
+scale=""
+preset=""
+crop="${screenwidth}:${screenheight}:0:0"
+letterbox=""
+overlaydir=${overlaydir-/apps/.overlay}
+logo=""
+blank=${hidedesktop:-}
+control=/tmp/encoder-control
+frames=/tmp/encoder-frames
+rm -f "$control" "$frames"
+mkfifo "$control" "$frames"
+
+start() {
+    filter="crop=${crop}"
+    if [ -n "$letterbox" ]; then
+        w=${letterbox%:*}
+        h=${letterbox#*:}
+        filter="${filter},scale=${w}:${h}:force_original_aspect_ratio=decrease,pad=${w}:${h}:(ow-iw)/2:(oh-ih)/2"
+    fi
+    if [ -n "$scale" ]; then
+        filter="${filter},scale=${scale}"
+    fi
+    if [ -n "$blank" ]; then
+        filter="${filter},drawbox=color=black:t=fill"
+    fi
+    if [ -n "$overlaydir" ] && [ -f "${overlaydir}/text" ]; then
+        filter="${filter},drawtext=fontfile=/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf:textfile=${overlaydir}/text:reload=1:x=10:y=h-th-10:fontcolor=white@0.6:fontsize=20:box=1:boxcolor=black@0.3"
+    fi
+    if [ -n "$logo" ] && [ -f "$logo" ]; then
+        filter="[in]${filter}[base];movie=${logo}[logo];[base][logo]overlay=W-w-10:10[out]"
+    fi
+    # The size of the frames vencode reads is the size after the filters
+    size=${crop%:*:*}
+    if [ -n "$letterbox" ]; then
+        size=$letterbox
+    fi
+    if [ -n "$scale" ]; then
+        size=$scale
+    fi
+    ffmpeg -loglevel error -r "$fps" -f x11grab -draw_mouse 0 -s 800x600 -i "${DISPLAY:-:99}" \
+        -filter:v "$filter" -pix_fmt yuv420p -f rawvideo -y "$frames" &
+    capture=$!
+    # Progress reports go to the worker and are exported as encoder metrics
+    /winvm/vencode "${size%:*}" "${size#*:}" "$fps" "$bitrate" "$control" "rtp://${dockerhost}:${videoport:-5004}" \
+        "udp://${dockerhost}:${progressport:-5010}" $videoencoder ${preset:+-preset "$preset"} <"$frames" &
+    pid=$!
+}
+
+# send hands the command to the running vencode. The FIFO is opened read-write, so it doesn't block while vencode is down
+send() {
+    echo "$*" 1<>"$control"
+}
+
+restart() {
+    kill "$pid" "$capture" 2>/dev/null
+    wait "$pid" "$capture"
+    start
+}
+
+start
+while true; do
+    if read -r -t 1 cmd arg; then
+        case "$cmd" in
+        keyframe)
+            send keyframe
+            ;;
+        bitrate)
+            if [[ "$arg" =~ ^[0-9]+$ ]]; then
+                bitrate=$arg
+                send bitrate "$bitrate"
+            fi
+            ;;
+        crop)
+            read -r region output <<<"$arg"
+            if [[ "$region" =~ ^[0-9]+:[0-9]+:[0-9]+:[0-9]+$ ]]; then
+                crop=$region
+                letterbox=""
+                if [[ "$output" =~ ^[0-9]+:[0-9]+$ ]]; then
+                    letterbox=$output
+                fi
+                restart
+            fi
+            ;;
+        encoder)
+            read -r kbps rate size name <<<"$arg"
+            if [[ "$kbps" =~ ^[0-9]+$ ]] && [[ "$rate" =~ ^[0-9]+$ ]]; then
+                bitrate=$kbps
+                fps=$rate
+                scale=""
+                if [[ "$size" =~ ^[0-9]+:[0-9]+$ ]]; then
+                    scale=$size
+                fi
+                preset=""
+                if [[ "$name" =~ ^[a-z0-9]+$ ]]; then
+                    preset=$name
+                fi
+                restart
+            fi
+            ;;
+        codec)
+            if [ -n "$arg" ]; then
+                videoencoder=$arg
+                preset=""
+                restart
+            fi
+            ;;
+        blank)
+            if [ "$arg" = "on" ]; then
+                blank=1
+            else
+                blank=""
+            fi
+            restart
+            ;;
+        logo)
+            if [ "$arg" = "-" ]; then
+                logo=""
+            else
+                logo=$arg
+            fi
+            restart
+            ;;
+        esac
+    elif ! kill -0 "$pid" 2>/dev/null || ! kill -0 "$capture" 2>/dev/null; then
+        # The encoder died, e.g. before Xvfb is up
+        sleep 1
+        restart
+    fi
+done
@@ -0,0 +1,12 @@
+#!/usr/bin/env bash
+# Provision the Wine prefix once, then run the app
+if [ -n "$provision" ] && [ -f "$provision" ]
+then
+    marker="/root/.wine/.provisioned-$(sha256sum "$provision" | cut -c1-16)"
+    if [ ! -f "$marker" ]
+    then
+        echo "Provisioning Wine prefix with $provision"
+        bash "$provision" && touch "$marker"
+    fi
+fi
+exec wine "$appfile" $wineoptions
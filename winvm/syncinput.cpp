@@ -35,7 +35,13 @@ int clientConnect()
     int server = socket(AF_INET, SOCK_STREAM, 0);
 
     addr.sin_family = AF_INET;
-    addr.sin_port = htons(9090);
+    // inputport is the port of the worker, rooms run their app VMs side by side on other ports
+    int port = 9090;
+    if (getenv("inputport") != NULL)
+    {
+        port = atoi(getenv("inputport"));
+    }
+    addr.sin_port = htons(port);
     if (isMac)
     {
         // Mac doesn't have host mode in docker, hence need to get local docker address
@@ -170,6 +176,28 @@ HWND sendIt(int key, bool state, bool isDxGame)
     return hwnd;
 }
 
+// sendScancode sends a raw scan code for games reading DirectInput, which ignore virtual keys
+void sendScancode(int scan, bool extended, byte state)
+{
+    SetActiveWindow(hwnd);
+    SetFocus(hwnd);
+
+    INPUT ip;
+    ZeroMemory(&ip, sizeof(INPUT));
+    ip.type = INPUT_KEYBOARD;
+    ip.ki.wScan = scan;
+    ip.ki.dwFlags = KEYEVENTF_SCANCODE;
+    if (extended)
+    {
+        ip.ki.dwFlags |= KEYEVENTF_EXTENDEDKEY;
+    }
+    if (state == KEY_UP)
+    {
+        ip.ki.dwFlags |= KEYEVENTF_KEYUP;
+    }
+    SendInput(1, &ip, sizeof(INPUT));
+}
+
 int MakeLParam(float x, float y)
 {
     return int(y) << 16 | (int(x) & 0xFFFF);
@@ -333,6 +361,16 @@ void processEvent(string ev, bool isDxGame)
         cout << '\n'
              << "Press a key to continue...";
     }
+    else if (ev[0] == 'S')
+    {
+        // Scan code payload: code,extended,state
+        stringstream ss(ev.substr(1, ev.length() - 1));
+        string scan, extended, state;
+        getline(ss, scan, ',');
+        getline(ss, extended, ',');
+        getline(ss, state, ',');
+        sendScancode(stoi(scan), stoi(extended) == 1, stoi(state));
+    }
     else if (ev[0] == 'M')
     {
         Mouse mouse = parseMousePayload(ev.substr(1, ev.length() - 1));
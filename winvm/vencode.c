@@ -0,0 +1,250 @@
+// vencode encodes raw yuv420p frames from stdin and streams them over RTP, like the ffmpeg it replaces in encode.sh,
+// but takes commands while it runs instead of being restarted for them. Commands are lines of the control FIFO:
+//   keyframe        the next frame is a keyframe
+//   bitrate <kbps>  encode at the bitrate from the next frame on
+// Encoders which can't change their bitrate on the fly are reopened with it, the RTP stream and the capture go on.
+// Progress reports in the key=value format of ffmpeg -progress go to the progress URL every second.
+//
+// Usage: vencode <width> <height> <fps> <kbps> <control fifo> <rtp url> <progress url> -c:v <encoder> [-<option> <value>]...
+//
+// Build: gcc vencode.c -o vencode $(pkg-config --cflags --libs libavformat libavcodec libavutil)
+
+#include <errno.h>
+#include <fcntl.h>
+#include <inttypes.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <unistd.h>
+
+#include <libavcodec/avcodec.h>
+#include <libavformat/avformat.h>
+#include <libavutil/imgutils.h>
+#include <libavutil/opt.h>
+
+// Encoders of libavcodec applying a new bit_rate of the context to the next frame
+static const char *reconfigurable[] = {"libx264", NULL};
+
+struct encoder {
+    const AVCodec *codec;
+    AVCodecContext *ctx;
+    // options are the encoder options of the command line, applied again when the encoder is reopened
+    AVDictionary *options;
+    int width, height, fps, kbps;
+    int reconfigurable;
+};
+
+struct output {
+    AVFormatContext *rtp;
+    AVStream *stream;
+    AVIOContext *progress;
+    // counters of the progress reports
+    int64_t frames, bytes;
+    time_t started, reported;
+};
+
+static void set_bitrate(AVCodecContext *ctx, int kbps) {
+    ctx->bit_rate = (int64_t)kbps * 1000;
+    ctx->rc_max_rate = ctx->bit_rate;
+    ctx->rc_buffer_size = (int)(ctx->bit_rate / 2);
+}
+
+static int open_encoder(struct encoder *e) {
+    e->ctx = avcodec_alloc_context3(e->codec);
+    if (!e->ctx) return AVERROR(ENOMEM);
+    e->ctx->width = e->width;
+    e->ctx->height = e->height;
+    e->ctx->pix_fmt = AV_PIX_FMT_YUV420P;
+    e->ctx->time_base = (AVRational){1, e->fps};
+    e->ctx->framerate = (AVRational){e->fps, 1};
+    set_bitrate(e->ctx, e->kbps);
+    AVDictionary *options = NULL;
+    av_dict_copy(&options, e->options, 0);
+    // Keyframes asked for are IDR frames, decoders joining at them need no earlier frame
+    av_dict_set(&options, "forced-idr", "1", 0);
+    int err = avcodec_open2(e->ctx, e->codec, &options);
+    av_dict_free(&options);
+    return err;
+}
+
+static int open_output(struct output *o, struct encoder *e, const char *url, const char *progress) {
+    int err = avformat_alloc_output_context2(&o->rtp, NULL, "rtp", url);
+    if (err < 0) return err;
+    o->stream = avformat_new_stream(o->rtp, NULL);
+    if (!o->stream) return AVERROR(ENOMEM);
+    if ((err = avcodec_parameters_from_context(o->stream->codecpar, e->ctx)) < 0) return err;
+    o->stream->time_base = e->ctx->time_base;
+    if ((err = avio_open(&o->rtp->pb, url, AVIO_FLAG_WRITE)) < 0) return err;
+    if ((err = avformat_write_header(o->rtp, NULL)) < 0) return err;
+    // Progress is best effort, the stream goes on without it
+    if (avio_open(&o->progress, progress, AVIO_FLAG_WRITE) < 0) o->progress = NULL;
+    o->started = o->reported = time(NULL);
+    return 0;
+}
+
+static void report(struct output *o) {
+    time_t now = time(NULL);
+    if (!o->progress || now == o->reported) return;
+    o->reported = now;
+    double elapsed = difftime(now, o->started);
+    avio_printf(o->progress, "frame=%" PRId64 "\n", o->frames);
+    avio_printf(o->progress, "fps=%.2f\n", elapsed > 0 ? o->frames / elapsed : 0);
+    avio_printf(o->progress, "bitrate=%.1fkbits/s\n", elapsed > 0 ? o->bytes * 8 / elapsed / 1000 : 0);
+    avio_printf(o->progress, "progress=continue\n");
+    avio_flush(o->progress);
+}
+
+// drain writes the packets the encoder has ready to the RTP stream
+static int drain(struct encoder *e, struct output *o, AVPacket *pkt) {
+    for (;;) {
+        int err = avcodec_receive_packet(e->ctx, pkt);
+        if (err == AVERROR(EAGAIN) || err == AVERROR_EOF) return 0;
+        if (err < 0) return err;
+        o->bytes += pkt->size;
+        av_packet_rescale_ts(pkt, e->ctx->time_base, o->stream->time_base);
+        pkt->stream_index = o->stream->index;
+        err = av_write_frame(o->rtp, pkt);
+        av_packet_unref(pkt);
+        if (err < 0) return err;
+    }
+}
+
+// command applies a line of the control FIFO, it returns if the next frame is a keyframe
+static int command(struct encoder *e, struct output *o, AVPacket *pkt, char *line) {
+    int kbps;
+    if (strcmp(line, "keyframe") == 0) return 1;
+    if (sscanf(line, "bitrate %d", &kbps) != 1 || kbps <= 0) {
+        fprintf(stderr, "vencode: unknown command %s\n", line);
+        return 0;
+    }
+    e->kbps = kbps;
+    if (e->reconfigurable) {
+        set_bitrate(e->ctx, kbps);
+        return 0;
+    }
+    // Reopen the encoder with the bitrate, its first frame is a keyframe anyway
+    avcodec_send_frame(e->ctx, NULL);
+    drain(e, o, pkt);
+    avcodec_free_context(&e->ctx);
+    if (open_encoder(e) < 0) {
+        fprintf(stderr, "vencode: cannot reopen the encoder at %d kbps\n", kbps);
+        exit(1);
+    }
+    return 0;
+}
+
+// poll reads the commands waiting in the control FIFO, it returns if the next frame is a keyframe
+static int poll_commands(int fd, struct encoder *e, struct output *o, AVPacket *pkt) {
+    static char buf[256];
+    static size_t len;
+    int keyframe = 0;
+    for (;;) {
+        ssize_t n = read(fd, buf + len, sizeof(buf) - 1 - len);
+        if (n <= 0) break;
+        len += n;
+        buf[len] = 0;
+        char *line = buf, *end;
+        while ((end = strchr(line, '\n'))) {
+            *end = 0;
+            keyframe |= command(e, o, pkt, line);
+            line = end + 1;
+        }
+        len = strlen(line);
+        memmove(buf, line, len + 1);
+        // Lines longer than the buffer are dropped
+        if (len == sizeof(buf) - 1) len = 0;
+    }
+    return keyframe;
+}
+
+static int read_full(uint8_t *buf, size_t size) {
+    size_t got = 0;
+    while (got < size) {
+        ssize_t n = read(STDIN_FILENO, buf + got, size - got);
+        if (n < 0 && errno == EINTR) continue;
+        if (n <= 0) return 0;
+        got += n;
+    }
+    return 1;
+}
+
+int main(int argc, char **argv) {
+    if (argc < 10 || strcmp(argv[8], "-c:v") != 0) {
+        fprintf(stderr, "usage: %s <width> <height> <fps> <kbps> <control fifo> <rtp url> <progress url> -c:v <encoder> [-<option> <value>]...\n", argv[0]);
+        return 2;
+    }
+    struct encoder e = {0};
+    struct output o = {0};
+    e.width = atoi(argv[1]);
+    e.height = atoi(argv[2]);
+    e.fps = atoi(argv[3]);
+    e.kbps = atoi(argv[4]);
+    if (e.width <= 0 || e.height <= 0 || e.fps <= 0 || e.kbps <= 0) {
+        fprintf(stderr, "vencode: size, frame rate and bitrate must be positive\n");
+        return 2;
+    }
+    e.codec = avcodec_find_encoder_by_name(argv[9]);
+    if (!e.codec) {
+        fprintf(stderr, "vencode: unknown encoder %s\n", argv[9]);
+        return 2;
+    }
+    for (int i = 0; reconfigurable[i]; i++) {
+        if (strcmp(e.codec->name, reconfigurable[i]) == 0) e.reconfigurable = 1;
+    }
+    // The encoder options are ffmpeg style -name value pairs, e.g. -tune zerolatency -preset veryfast
+    for (int i = 10; i + 1 < argc; i += 2) {
+        if (argv[i][0] == '-') av_dict_set(&e.options, argv[i] + 1, argv[i + 1], 0);
+    }
+
+    // The FIFO is opened read-write, so it stays open while no one writes commands to it
+    int control = open(argv[5], O_RDWR | O_NONBLOCK);
+    if (control < 0) {
+        perror("vencode: control fifo");
+        return 1;
+    }
+    int err;
+    if ((err = open_encoder(&e)) < 0 || (err = open_output(&o, &e, argv[6], argv[7])) < 0) {
+        fprintf(stderr, "vencode: %s\n", av_err2str(err));
+        return 1;
+    }
+
+    AVFrame *frame = av_frame_alloc();
+    AVPacket *pkt = av_packet_alloc();
+    int size = av_image_get_buffer_size(AV_PIX_FMT_YUV420P, e.width, e.height, 1);
+    uint8_t *raw = av_malloc(size);
+    if (!frame || !pkt || !raw) {
+        fprintf(stderr, "vencode: out of memory\n");
+        return 1;
+    }
+    frame->format = AV_PIX_FMT_YUV420P;
+    frame->width = e.width;
+    frame->height = e.height;
+    if (av_frame_get_buffer(frame, 0) < 0) {
+        fprintf(stderr, "vencode: out of memory\n");
+        return 1;
+    }
+    uint8_t *planes[4];
+    int linesizes[4];
+    av_image_fill_arrays(planes, linesizes, raw, AV_PIX_FMT_YUV420P, e.width, e.height, 1);
+    for (int64_t pts = 0; read_full(raw, size); pts++) {
+        // The encoder may still hold the previous frame
+        if ((err = av_frame_make_writable(frame)) < 0) {
+            fprintf(stderr, "vencode: %s\n", av_err2str(err));
+            return 1;
+        }
+        av_image_copy(frame->data, frame->linesize, (const uint8_t **)planes, linesizes, AV_PIX_FMT_YUV420P, e.width, e.height);
+        frame->pts = pts;
+        frame->pict_type = poll_commands(control, &e, &o, pkt) ? AV_PICTURE_TYPE_I : AV_PICTURE_TYPE_NONE;
+        if ((err = avcodec_send_frame(e.ctx, frame)) < 0 || (err = drain(&e, &o, pkt)) < 0) {
+            fprintf(stderr, "vencode: %s\n", av_err2str(err));
+            return 1;
+        }
+        o.frames++;
+        report(&o);
+    }
+    avcodec_send_frame(e.ctx, NULL);
+    drain(&e, &o, pkt);
+    av_write_trailer(o.rtp);
+    return 0;
+}